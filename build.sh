@@ -2,6 +2,14 @@
 
 set -e
 
+if [ "$1" = "images" ]; then
+    echo building container images
+    docker build --target server -t codegrinder/server .
+    docker build --target daycare -t codegrinder/daycare .
+    docker build --target all -t codegrinder/all .
+    exit 0
+fi
+
 echo building codegrinder server
 go install github.com/russross/codegrinder/codegrinder
 
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// Assembly problems are assembled and linked as Linux user programs and
+// run under QEMU user-mode emulation, so programs make Linux system calls
+// for input and output and start at _start. The program is run once for
+// each input file in in/ and its output is compared with the file of the
+// same name in out/, as with the other in/out problem types. QEMU's
+// instruction counting plugin reports how many instructions each run
+// executed; a run that exceeds the limit fails. The limit is
+// DefaultInstructionLimit unless the problem has an "instructions=<n>"
+// option.
+
+// InstructionLimitOption is the prefix of the problem option giving the
+// most instructions a single run may execute.
+const InstructionLimitOption = "instructions="
+
+// DefaultInstructionLimit is the instruction limit for a run when the
+// problem does not set one.
+const DefaultInstructionLimit = 10000000
+
+const (
+	asmProgram   = "/tmp/prog"
+	asmInsnsLog  = "/tmp/insns.txt"
+	asmInsPlugin = "/usr/local/lib/qemu/libinsn.so"
+)
+
+// asmTarget describes the toolchain and emulator for one architecture.
+type asmTarget struct {
+	Assembler string
+	Linker    string
+	Emulator  string
+}
+
+var asmTargets = map[string]*asmTarget{
+	"mipsasm": &asmTarget{
+		Assembler: "mips-linux-gnu-as",
+		Linker:    "mips-linux-gnu-ld",
+		Emulator:  "qemu-mips",
+	},
+	"armasm": &asmTarget{
+		Assembler: "arm-linux-gnueabihf-as",
+		Linker:    "arm-linux-gnueabihf-ld",
+		Emulator:  "qemu-arm",
+	},
+}
+
+func init() {
+	for name, target := range asmTargets {
+		handler := asmGrader(target)
+		problemTypes[name] = &ProblemType{
+			Name:        name,
+			Image:       "codegrinder/asm",
+			MaxCPU:      10,
+			MaxFD:       10,
+			MaxFileSize: 10,
+			MaxMemory:   128,
+			MaxThreads:  20,
+			Actions: map[string]*ProblemTypeAction{
+				"grade": &ProblemTypeAction{
+					Action:  "grade",
+					Button:  "Grade",
+					Message: "Grading‥",
+					Class:   "btn-grade",
+					Handler: handler,
+				},
+				"": &ProblemTypeAction{
+					Action: "",
+					Button: "Save",
+					Class:  "btn-save",
+				},
+				"confirm": &ProblemTypeAction{
+					Action:  "confirm",
+					Handler: handler,
+				},
+			},
+		}
+	}
+}
+
+var (
+	asmErrorLine = regexp.MustCompile(`(?m)^(\S+\.[sS]):(\d+): Error:`)
+	asmInsnCount = regexp.MustCompile(`insns: (\d+)`)
+)
+
+// asmGrader returns the grading handler for one architecture.
+func asmGrader(target *asmTarget) nannyHandler {
+	return func(n *Nanny, args []string, options []string, files map[string]string) {
+		asmGrade(n, target, options, files)
+	}
+}
+
+func asmGrade(n *Nanny, target *asmTarget, options []string, files map[string]string) {
+	log.Printf("asmGrade %s", target.Emulator)
+
+	// work out the instruction limit
+	limit := int64(DefaultInstructionLimit)
+	for _, option := range options {
+		if !strings.HasPrefix(option, InstructionLimitOption) {
+			continue
+		}
+		value, err := strconv.ParseInt(strings.TrimPrefix(option, InstructionLimitOption), 10, 64)
+		if err != nil || value < 1 {
+			n.ReportCard.LogAndFailf("invalid problem option %q: must be a number of instructions", option)
+			return
+		}
+		limit = value
+	}
+
+	// find the sources and the test cases
+	var sources, inputs []string
+	for name := range files {
+		switch {
+		case !strings.Contains(name, "/") && (strings.HasSuffix(name, ".s") || strings.HasSuffix(name, ".S")):
+			sources = append(sources, name)
+		case strings.HasPrefix(name, "in/"):
+			inputs = append(inputs, name)
+		}
+	}
+	sort.Strings(sources)
+	sort.Strings(inputs)
+	if len(sources) == 0 {
+		n.ReportCard.LogAndFailf("no assembly source files found")
+		return
+	}
+	if len(inputs) == 0 {
+		n.ReportCard.LogAndFailf("no input files found in in/")
+		return
+	}
+
+	// put the files in the container
+	if err := n.PutFiles(files); err != nil {
+		n.ReportCard.LogAndFailf("PutFiles error: %v", err)
+		return
+	}
+
+	// assemble and link
+	build := fmt.Sprintf("%s -g -o /tmp/prog.o %s && %s -o %s /tmp/prog.o",
+		target.Assembler, strings.Join(sources, " "), target.Linker, asmProgram)
+	_, stderr, _, status, err := n.ExecNonInteractive([]string{"sh", "-c", build})
+	if err != nil {
+		n.ReportCard.LogAndFailf("exec error: %v", err)
+		return
+	}
+	if status != 0 {
+		context := ""
+		if groups := asmErrorLine.FindStringSubmatch(stderr.String()); groups != nil {
+			context = groups[1] + ":" + groups[2]
+		}
+		n.ReportCard.AddFailedResult("assemble", "<h1>Assembly failed</h1>\n"+htmlEscapePre(stderr.String()), context)
+		n.ReportCard.Duration = time.Since(n.Start)
+		n.ReportCard.Note = "assembly failed"
+		return
+	}
+
+	locale := OutputLocale(options)
+	failed := 0
+	for _, input := range inputs {
+		name := strings.TrimPrefix(input, "in/")
+		output := ExpectedOutputFile(files, name, locale)
+		contents, ok := files[output]
+		if !ok {
+			n.ReportCard.LogAndFailf("no expected output file %s for input %s", output, input)
+			return
+		}
+		expected, err := ParseExpectedOutput(contents)
+		if err != nil {
+			n.ReportCard.LogAndFailf("error in %s: %v", output, err)
+			return
+		}
+
+		run := fmt.Sprintf("rm -f %s; exec %s -plugin %s -d plugin -D %s %s < %s",
+			asmInsnsLog, target.Emulator, asmInsPlugin, asmInsnsLog, asmProgram, input)
+		stdout, stderr, _, status, err := n.ExecNonInteractive([]string{"sh", "-c", run})
+		if err != nil {
+			n.ReportCard.LogAndFailf("exec error: %v", err)
+			return
+		}
+		counts, _, _, _, err := n.ExecNonInteractive([]string{"cat", asmInsnsLog})
+		if err != nil {
+			n.ReportCard.LogAndFailf("exec error: %v", err)
+			return
+		}
+		instructions := int64(-1)
+		if groups := asmInsnCount.FindStringSubmatch(counts.String()); groups != nil {
+			instructions, _ = strconv.ParseInt(groups[1], 10, 64)
+		}
+		n.Events <- &EventMessage{
+			Time:       time.Now(),
+			Event:      "stdout",
+			StreamData: asmInstructionSummary(name, instructions, limit),
+		}
+
+		passed, msg := expected.Match(stdout.String())
+		switch {
+		case instructions > limit:
+			passed, msg = false, fmt.Sprintf("executed %d instructions, more than the limit of %d", instructions, limit)
+		case passed && status != 0:
+			passed, msg = false, fmt.Sprintf("exit status %d", status)
+		}
+		if passed {
+			n.ReportCard.AddPassedResult(name, htmlEscapePara(fmt.Sprintf("output matched using %d instructions", instructions)))
+			continue
+		}
+		failed++
+		details := "<h1>Output did not match</h1>\n" + htmlEscapePara(msg) + htmlEscapePre(stdout.String())
+		if stderr.Len() > 0 {
+			details += "\n<h1>Error output</h1>\n" + htmlEscapePre(stderr.String())
+		}
+		n.ReportCard.AddFailedResult(name, details, input)
+	}
+	n.ReportCard.Duration = time.Since(n.Start)
+	if n.ReportCard.Note == "" {
+		n.ReportCard.Note = fmt.Sprintf("%d/%d tests passed in %v", len(n.ReportCard.Results)-failed, len(n.ReportCard.Results), n.ReportCard.Duration)
+	}
+}
+
+// asmInstructionSummary describes the instruction count of one run for the
+// transcript.
+func asmInstructionSummary(name string, instructions, limit int64) string {
+	if instructions < 0 {
+		return fmt.Sprintf("%s: instruction count unavailable (limit %d)\n", name, limit)
+	}
+	return fmt.Sprintf("%s: %d instructions executed (limit %d)\n", name, instructions, limit)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// AuditEntry records a single change made through the API.
+// withTx maps a fresh entry into every request and saves it when a
+// mutating request succeeds. Handlers that make changes worth singling out
+// call Record to give the entry a type, the affected object, and a summary.
+type AuditEntry struct {
+	ID             int64     `json:"id" meddler:"id,pk"`
+	UserID         int64     `json:"userID,omitempty" meddler:"user_id,zeroisnull"`
+	ImpersonatorID int64     `json:"impersonatorID,omitempty" meddler:"impersonator_id,zeroisnull"`
+	Method         string    `json:"method" meddler:"method"`
+	Path           string    `json:"path" meddler:"path"`
+	Type           string    `json:"type" meddler:"type"`
+	ObjectID       int64     `json:"objectID,omitempty" meddler:"object_id,zeroisnull"`
+	Summary        string    `json:"summary,omitempty" meddler:"summary,zeroisnull"`
+	CreatedAt      time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// Audit entry types for changes that are recorded specifically.
+// Other mutating requests are recorded with type AuditRequest.
+const (
+	AuditRequest       = "request"
+	AuditGradeChange   = "grade"
+	AuditProblemUpdate = "problem"
+	AuditCommitDelete  = "commit-delete"
+	AuditRestore       = "restore"
+	AuditImpersonation = "impersonation"
+	AuditQuarantine    = "quarantine"
+	AuditReopen        = "reopen"
+	AuditScoreOverride = "score-override"
+	AuditWebhook       = "webhook"
+)
+
+// Record sets the type, affected object, and summary for an audit entry.
+// A request that records an entry is saved even if it did not use a
+// mutating HTTP method.
+func (entry *AuditEntry) Record(kind string, objectID int64, format string, args ...interface{}) {
+	entry.Type = kind
+	entry.ObjectID = objectID
+	entry.Summary = fmt.Sprintf(format, args...)
+}
+
+// shouldSave reports whether an entry should be written to the audit log.
+// Every request made while impersonating another user is kept, including
+// reads and failed attempts, so there is a record of what an administrator
+// looked at or tried to do.
+func (entry *AuditEntry) shouldSave() bool {
+	return entry.Type != "" || entry.ImpersonatorID != 0 || (entry.Method != "GET" && entry.Method != "HEAD")
+}
+
+// saveAuditEntry writes an entry to the audit log if it is worth keeping.
+func saveAuditEntry(db meddler.DB, entry *AuditEntry) error {
+	if !entry.shouldSave() {
+		return nil
+	}
+	if entry.Type == "" {
+		entry.Type = AuditRequest
+	}
+	return meddler.Insert(db, "audit_log", entry)
+}
+
+// GetAudit handles a request to /v2/audit,
+// returning audit log entries, newest first.
+//
+// If parameter user=<...> present, results will be filtered by the user ID that made the change.
+// If parameter type=<...> present, results will be filtered by entry type.
+// If parameter since=<...> present, only entries at or after that RFC 3339 time or YYYY-MM-DD date are included.
+// If parameter limit=<...> present, at most that many entries are returned (default 1000).
+func GetAudit(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	where := ""
+	args := []interface{}{}
+
+	if user := r.FormValue("user"); user != "" {
+		userID, err := strconv.ParseInt(user, 10, 64)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing user ID %q: %v", user, err)
+			return
+		}
+		where, args = addWhereEq(where, args, "user_id", userID)
+	}
+
+	if kind := r.FormValue("type"); kind != "" {
+		where, args = addWhereEq(where, args, "type", kind)
+	}
+
+	if since := r.FormValue("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			if t, err = time.ParseInLocation("2006-01-02", since, time.Local); err != nil {
+				loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing since %q: expected RFC 3339 time or YYYY-MM-DD date", since)
+				return
+			}
+		}
+		if where == "" {
+			where = " WHERE"
+		} else {
+			where += " AND"
+		}
+		args = append(args, t)
+		where += fmt.Sprintf(" created_at >= $%d", len(args))
+	}
+
+	limit := 1000
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	entries := []*AuditEntry{}
+	if err := meddler.QueryAll(tx, &entries, `SELECT * FROM audit_log`+where+
+		fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT %d`, limit), args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, entries)
+}
+
+// auditScoreChange records a change to an assignment's score, marking
+// changes made after the assignment was reopened.
+func auditScoreChange(audit *AuditEntry, asst *Assignment, oldScore float64, postReopen bool) {
+	if asst.Score == oldScore {
+		return
+	}
+	if postReopen {
+		audit.Record(AuditGradeChange, asst.ID, "assignment %d score %.4f -> %.4f (post-reopen)", asst.ID, oldScore, asst.Score)
+	} else {
+		audit.Record(AuditGradeChange, asst.ID, "assignment %d score %.4f -> %.4f", asst.ID, oldScore, asst.Score)
+	}
+}
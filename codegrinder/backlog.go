@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+)
+
+// Near a deadline the work queue can back up, and students who see no
+// progress tend to submit again, which makes it worse. Any logged in user
+// can ask how many jobs are waiting for a problem type and roughly how
+// long a new request would wait, so grind can say so before it starts.
+// The estimate uses the recent average run time of the problem type and
+// the slots of the live workers that can run it.
+
+// DefaultGradingSeconds is the run time assumed for a problem type with no
+// recent runs.
+const DefaultGradingSeconds = 30
+
+// GradingWaitWindow is how far back run times are averaged.
+const GradingWaitWindow = 24 * time.Hour
+
+// gradingWait estimates the wait for a new request for a problem type.
+func gradingWait(tx *sql.Tx, problemType *ProblemType, workers []*DaycareWorker, now time.Time) (*GradingWait, error) {
+	wait := &GradingWait{ProblemType: problemType.Name}
+	err := tx.QueryRow(`SELECT COUNT(*) FILTER (WHERE status = 'queued'), COUNT(*) FILTER (WHERE status = 'running') `+
+		`FROM daycare_jobs WHERE problem_type = $1`, problemType.Name).Scan(&wait.JobsAhead, &wait.Running)
+	if err != nil {
+		return nil, err
+	}
+	var average sql.NullFloat64
+	err = tx.QueryRow(`SELECT AVG(duration_ms) FROM action_runs WHERE problem_type = $1 AND created_at >= $2`,
+		problemType.Name, now.Add(-GradingWaitWindow)).Scan(&average)
+	if err != nil {
+		return nil, err
+	}
+	wait.AverageSeconds = DefaultGradingSeconds
+	if average.Valid && average.Float64 > 0 {
+		wait.AverageSeconds = average.Float64 / 1000.0
+	}
+
+	route := daycareRoute(problemType, workers)
+	for _, worker := range workers {
+		for _, name := range route.Workers {
+			if name == worker.Name {
+				wait.Slots += worker.Slots
+			}
+		}
+	}
+	if wait.Slots > 0 {
+		// a new job starts once enough of the jobs ahead of it finish to free a slot
+		busy := float64(wait.JobsAhead + wait.Running + 1 - wait.Slots)
+		wait.WaitSeconds = math.Max(0, busy) / float64(wait.Slots) * wait.AverageSeconds
+	}
+	return wait, nil
+}
+
+// GetGradingWaits handles a request to /v2/grading_waits,
+// returning the estimated wait for each problem type.
+func GetGradingWaits(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+	now := time.Now()
+	workers, err := liveDaycareWorkers(tx, now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	var names []string
+	for name := range problemTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	waits := []*GradingWait{}
+	for _, name := range names {
+		wait, err := gradingWait(tx, problemTypes[name], workers, now)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		waits = append(waits, wait)
+	}
+	render.JSON(http.StatusOK, waits)
+}
+
+// GetGradingWait handles a request to /v2/grading_waits/:problem_type,
+// returning the estimated wait for one problem type.
+func GetGradingWait(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	now := time.Now()
+	problemType, exists := problemTypes[params["problem_type"]]
+	if !exists {
+		loggedHTTPErrorf(w, http.StatusNotFound, "problem type %q not found", params["problem_type"])
+		return
+	}
+	workers, err := liveDaycareWorkers(tx, now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	wait, err := gradingWait(tx, problemType, workers, now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, wait)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Jobs that work through every commit in a course, such as a regrade, an
+// export, or course analytics, should not load every row at once. A
+// batchCursor walks the rows of a query a batch at a time, asking each time
+// for the rows with keys after the last one it saw, so only one batch is
+// in memory and each query is short. A cursor stops when its context is
+// cancelled, e.g., when the client of a request goes away.
+//
+// A background job can give its cursor a name and report each key it
+// finishes with Checkpoint. The position is saved in the job_checkpoints
+// table, so a job that is interrupted, e.g., by a server restart, resumes
+// after the last key it finished instead of starting over.
+
+// BatchSize is the number of rows a batchCursor fetches at a time.
+const BatchSize = 500
+
+// batchDB is the part of *sql.DB and *sql.Tx that a batchCursor uses.
+type batchDB interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type batchCursor struct {
+	db    batchDB
+	name  string
+	query string
+	args  []interface{}
+	size  int
+	after int64
+	done  bool
+}
+
+// newBatchCursor returns a cursor over the rows of a query. The first
+// column the query selects must be a bigint key, and the query takes two
+// parameters after args: the key to start after and the batch size. It
+// must return only rows with greater keys, in increasing key order, and
+// no more than the batch size, e.g.:
+//
+//	SELECT id, ... FROM commits WHERE assignment_id = $1 AND id > $2 ORDER BY id LIMIT $3
+//
+// A cursor with a name starts after the checkpoint saved under that name,
+// if there is one.
+func newBatchCursor(ctx context.Context, db batchDB, name, query string, args ...interface{}) (*batchCursor, error) {
+	cursor := &batchCursor{db: db, name: name, query: query, args: args, size: BatchSize}
+	if name != "" {
+		err := db.QueryRowContext(ctx, `SELECT last_key FROM job_checkpoints WHERE job = $1`, name).Scan(&cursor.after)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	return cursor, nil
+}
+
+// Next fetches the next batch and calls scan for each row. scan must scan
+// the row and return its key. The rows are closed before Next returns, so
+// the caller can run other queries while it works through a batch. Next
+// returns the number of rows in the batch, which is zero when there are
+// no more.
+func (cursor *batchCursor) Next(ctx context.Context, scan func(rows *sql.Rows) (int64, error)) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if cursor.done {
+		return 0, nil
+	}
+	args := append(append([]interface{}{}, cursor.args...), cursor.after, cursor.size)
+	rows, err := cursor.db.QueryContext(ctx, cursor.query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		key, err := scan(rows)
+		if err != nil {
+			return count, err
+		}
+		cursor.after = key
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	cursor.done = count < cursor.size
+	return count, nil
+}
+
+// scanKey returns a scan function for Next that collects the key of
+// each row, for queries that select only the key.
+func scanKey(keys *[]int64) func(rows *sql.Rows) (int64, error) {
+	return func(rows *sql.Rows) (int64, error) {
+		var key int64
+		err := rows.Scan(&key)
+		*keys = append(*keys, key)
+		return key, err
+	}
+}
+
+// Checkpoint saves the key of the last row a job has finished, so the job
+// resumes after it if it is interrupted. It does nothing for a cursor
+// without a name.
+func (cursor *batchCursor) Checkpoint(key int64) error {
+	if cursor.name == "" {
+		return nil
+	}
+	_, err := cursor.db.ExecContext(context.Background(),
+		`INSERT INTO job_checkpoints (job, last_key, updated_at) VALUES ($1, $2, $3) `+
+			`ON CONFLICT (job) DO UPDATE SET last_key = $2, updated_at = $3`,
+		cursor.name, key, time.Now())
+	return err
+}
+
+// Finish discards the saved checkpoint once a job is complete.
+func (cursor *batchCursor) Finish() error {
+	if cursor.name == "" {
+		return nil
+	}
+	_, err := cursor.db.ExecContext(context.Background(), `DELETE FROM job_checkpoints WHERE job = $1`, cursor.name)
+	return err
+}
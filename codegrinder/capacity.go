@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/martini-contrib/render"
+)
+
+// The capacity planner projects how many grading containers will be busy
+// at once in the run-up to each upcoming deadline. For each course it
+// looks at past deadlines to find the busiest hour of grading in the day
+// before the deadline, relative to the number of students, and scales that
+// by the number of students facing the upcoming deadline. Multiplying the
+// expected runs per hour by the mean run time gives the average number of
+// busy containers, which is padded by CapacityBurstFactor since requests
+// bunch up within the hour. Courses with no history use the pattern across
+// all courses, and failing that, defaults.
+
+const (
+	// CapacityHistory is how far back the planner looks for past deadlines.
+	CapacityHistory = 365 * 24 * time.Hour
+
+	// CapacityBurstFactor pads the average load to allow for bursts.
+	CapacityBurstFactor = 2.0
+
+	// DefaultPeakRunsPerStudent is the peak hourly grading rate per student
+	// assumed when there is no history.
+	DefaultPeakRunsPerStudent = 0.5
+
+	// DefaultRunSeconds is the run time assumed when there is no history.
+	DefaultRunSeconds = 10.0
+)
+
+// CapacityDeadline is the projected grading load for one upcoming deadline.
+// Basis tells where the projection came from: "course", "all courses", or
+// "default".
+type CapacityDeadline struct {
+	CourseID        int64     `json:"courseID"`
+	CourseName      string    `json:"courseName"`
+	ProblemSetID    int64     `json:"problemSetID"`
+	DueAt           time.Time `json:"dueAt"`
+	Students        int       `json:"students"`
+	PeakRunsPerHour float64   `json:"peakRunsPerHour"`
+	MeanRunSeconds  float64   `json:"meanRunSeconds"`
+	Containers      int       `json:"containers"`
+	Basis           string    `json:"basis"`
+}
+
+// CapacityDay is the projected load for one day. Deadlines on the same day
+// are assumed to peak together.
+type CapacityDay struct {
+	Date       string              `json:"date"`
+	Containers int                 `json:"containers"`
+	Overloaded bool                `json:"overloaded"`
+	Deadlines  []*CapacityDeadline `json:"deadlines"`
+}
+
+// CapacityPlan is the capacity planner report. Capacity is 0 if it is unknown.
+type CapacityPlan struct {
+	Capacity int            `json:"capacity"`
+	Days     []*CapacityDay `json:"days"`
+}
+
+// capacityHistory is the observed grading pattern for a course, or for all
+// courses when courseID is 0.
+type capacityHistory struct {
+	peakRunsPerStudent float64
+	deadlines          int
+	meanRunSeconds     float64
+	runs               int
+}
+
+// GetCapacityPlan handles a request to /v2/capacity_plan,
+// projecting the grading capacity needed for upcoming deadlines and
+// flagging days that exceed the configured capacity.
+//
+// If parameter days=<...> present, deadlines that many days ahead are included (default 14).
+func GetCapacityPlan(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	now := time.Now()
+	days := 14
+	if s := r.FormValue("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing days %q: expected a positive number", s)
+			return
+		}
+		days = n
+	}
+
+	capacity, err := gradingCapacity(tx, now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// find upcoming deadlines
+	rows, err := tx.Query(`SELECT assignments.course_id, courses.name, assignments.problem_set_id, assignments.due_at, COUNT(*) `+
+		`FROM assignments JOIN courses ON assignments.course_id = courses.id `+
+		`WHERE NOT assignments.instructor AND assignments.due_at >= $1 AND assignments.due_at < $2 `+
+		`GROUP BY assignments.course_id, courses.name, assignments.problem_set_id, assignments.due_at `+
+		`ORDER BY assignments.due_at`,
+		now, now.AddDate(0, 0, days))
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	deadlines := []*CapacityDeadline{}
+	for rows.Next() {
+		d := new(CapacityDeadline)
+		if err := rows.Scan(&d.CourseID, &d.CourseName, &d.ProblemSetID, &d.DueAt, &d.Students); err != nil {
+			rows.Close()
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		deadlines = append(deadlines, d)
+	}
+	rows.Close()
+
+	// project the load for each deadline
+	overall, err := loadCapacityHistory(tx, now, 0)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	histories := make(map[int64]*capacityHistory)
+	for _, d := range deadlines {
+		history, ok := histories[d.CourseID]
+		if !ok {
+			if history, err = loadCapacityHistory(tx, now, d.CourseID); err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			histories[d.CourseID] = history
+		}
+
+		rate, basis := DefaultPeakRunsPerStudent, "default"
+		if history.deadlines > 0 {
+			rate, basis = history.peakRunsPerStudent, "course"
+		} else if overall.deadlines > 0 {
+			rate, basis = overall.peakRunsPerStudent, "all courses"
+		}
+		d.MeanRunSeconds = DefaultRunSeconds
+		if history.runs > 0 {
+			d.MeanRunSeconds = history.meanRunSeconds
+		} else if overall.runs > 0 {
+			d.MeanRunSeconds = overall.meanRunSeconds
+		}
+		d.Basis = basis
+		d.PeakRunsPerHour = rate * float64(d.Students)
+		d.Containers = int(math.Ceil(d.PeakRunsPerHour * d.MeanRunSeconds / 3600.0 * CapacityBurstFactor))
+	}
+
+	// group by day
+	plan := &CapacityPlan{Capacity: capacity, Days: []*CapacityDay{}}
+	byDate := make(map[string]*CapacityDay)
+	for _, d := range deadlines {
+		date := d.DueAt.Local().Format("2006-01-02")
+		day, ok := byDate[date]
+		if !ok {
+			day = &CapacityDay{Date: date}
+			byDate[date] = day
+			plan.Days = append(plan.Days, day)
+		}
+		day.Deadlines = append(day.Deadlines, d)
+		day.Containers += d.Containers
+	}
+	sort.Slice(plan.Days, func(i, j int) bool { return plan.Days[i].Date < plan.Days[j].Date })
+	for _, day := range plan.Days {
+		day.Overloaded = capacity > 0 && day.Containers > capacity
+	}
+
+	render.JSON(http.StatusOK, plan)
+}
+
+// loadCapacityHistory measures the grading pattern around past deadlines
+// for a course, or for all courses if courseID is 0.
+func loadCapacityHistory(tx *sql.Tx, now time.Time, courseID int64) (*capacityHistory, error) {
+	history := new(capacityHistory)
+	since := now.Add(-CapacityHistory)
+
+	// mean run time
+	var mean sql.NullFloat64
+	if err := tx.QueryRow(`SELECT COUNT(*), AVG(duration_ms) FROM action_runs WHERE ($1 = 0 OR course_id = $1) AND created_at >= $2`,
+		courseID, since).Scan(&history.runs, &mean); err != nil {
+		return nil, err
+	}
+	history.meanRunSeconds = mean.Float64 / 1000.0
+
+	// busiest hour before each past deadline, per student
+	rows, err := tx.Query(`SELECT course_id, due_at, COUNT(*) FROM assignments `+
+		`WHERE NOT instructor AND ($1 = 0 OR course_id = $1) AND due_at >= $2 AND due_at < $3 `+
+		`GROUP BY course_id, due_at`,
+		courseID, since, now)
+	if err != nil {
+		return nil, err
+	}
+	type pastDeadline struct {
+		courseID int64
+		dueAt    time.Time
+		students int
+	}
+	var past []pastDeadline
+	for rows.Next() {
+		var p pastDeadline
+		if err := rows.Scan(&p.courseID, &p.dueAt, &p.students); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		past = append(past, p)
+	}
+	rows.Close()
+
+	total := 0.0
+	for _, p := range past {
+		var peak int
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(n), 0) FROM (SELECT COUNT(*) AS n FROM action_runs `+
+			`WHERE course_id = $1 AND created_at > $2 AND created_at <= $3 `+
+			`GROUP BY date_trunc('hour', created_at)) AS hours`,
+			p.courseID, p.dueAt.Add(-24*time.Hour), p.dueAt).Scan(&peak); err != nil {
+			return nil, err
+		}
+		if peak == 0 || p.students == 0 {
+			// no grading recorded, probably from before runs were tracked
+			continue
+		}
+		total += float64(peak) / float64(p.students)
+		history.deadlines++
+	}
+	if history.deadlines > 0 {
+		history.peakRunsPerStudent = total / float64(history.deadlines)
+	}
+	return history, nil
+}
+
+// gradingCapacity is the number of containers that can run at once across
+// all daycares, or 0 if it is unknown.
+func gradingCapacity(tx *sql.Tx, now time.Time) (int, error) {
+	if Config().GradingCapacity > 0 {
+		return Config().GradingCapacity, nil
+	}
+	if Config().WorkQueue {
+		var slots int
+		err := tx.QueryRow(`SELECT COALESCE(SUM(slots), 0) FROM daycare_workers WHERE last_seen_at >= $1`,
+			now.Add(-2*WorkerHeartbeat)).Scan(&slots)
+		return slots, err
+	}
+	if Config().DaycareMaxRunning > 0 {
+		hosts := len(Config().DaycareHosts)
+		if hosts == 0 {
+			hosts = 1
+		}
+		return Config().DaycareMaxRunning * hosts, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// When an author updates a problem that students are already working on,
+// the update must say what changed. The entry is kept with the problem as
+// the record of that version, sent to the students with the notice that
+// the problem changed, and listed for them by grind whatsnew.
+
+// MaxChangelogLength is the longest changelog entry an author can give.
+const MaxChangelogLength = 2000
+
+// checkChangelog cleans up a changelog entry, returning an error message
+// if it is missing but required, or too long.
+func checkChangelog(entry string, required bool) (string, string) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" && required {
+		return "", "students are working on this problem, so the update must include a changelog entry saying what changed"
+	}
+	if len(entry) > MaxChangelogLength {
+		return "", "changelog entries cannot be longer than " + strconv.Itoa(MaxChangelogLength) + " bytes"
+	}
+	return entry, ""
+}
+
+// recordChangelog saves a changelog entry for a problem update.
+func recordChangelog(tx *sql.Tx, problemID, authorID int64, entry string, now time.Time) (*ProblemChangelog, error) {
+	changelog := &ProblemChangelog{
+		ProblemID: problemID,
+		AuthorID:  authorID,
+		Entry:     entry,
+		CreatedAt: now,
+	}
+	if err := meddler.Insert(tx, "problem_changelogs", changelog); err != nil {
+		return nil, err
+	}
+	return changelog, nil
+}
+
+// fillChangelogProblems fills in the problem unique ID and note of each
+// changelog entry.
+func fillChangelogProblems(tx *sql.Tx, entries []*ProblemChangelog) error {
+	problems := make(map[int64]*Problem)
+	for _, entry := range entries {
+		problem := problems[entry.ProblemID]
+		if problem == nil {
+			problem = new(Problem)
+			if err := meddler.Load(tx, "problems", problem, entry.ProblemID); err != nil {
+				return err
+			}
+			problems[entry.ProblemID] = problem
+		}
+		entry.Unique, entry.ProblemNote = problem.Unique, problem.Note
+	}
+	return nil
+}
+
+// GetProblemChangelog handles a request to /v2/problems/:problem_id/changelog,
+// returning the changelog entries for a problem, most recent first.
+func GetProblemChangelog(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	if !currentUser.Admin && !currentUser.Author {
+		var visible bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM user_problems WHERE user_id = $1 AND problem_id = $2)`,
+			currentUser.ID, problemID).Scan(&visible); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !visible {
+			loggedHTTPErrorf(w, http.StatusNotFound, "not found")
+			return
+		}
+	}
+	entries := []*ProblemChangelog{}
+	if err := meddler.QueryAll(tx, &entries, `SELECT * FROM problem_changelogs WHERE problem_id = $1 ORDER BY created_at DESC, id DESC`, problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := fillChangelogProblems(tx, entries); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, entries)
+}
+
+// GetUserMeChangelog handles a request to /v2/users/me/changelog,
+// returning the changelog entries for problems in the current user's open
+// assignments that were written after the user started the assignment,
+// most recent first. Parameters:
+//
+//	days: only list entries from the last few days
+func GetUserMeChangelog(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser *User, render render.Render) {
+	now := time.Now()
+	since := time.Time{}
+	if s := r.FormValue("days"); s != "" {
+		days, err := strconv.Atoi(s)
+		if err != nil || days < 1 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "days must be a positive number")
+			return
+		}
+		since = now.AddDate(0, 0, -days)
+	}
+
+	entries := []*ProblemChangelog{}
+	if err := meddler.QueryAll(tx, &entries, `SELECT DISTINCT problem_changelogs.* FROM problem_changelogs `+
+		`JOIN problem_set_problems ON problem_set_problems.problem_id = problem_changelogs.problem_id `+
+		`JOIN assignments ON assignments.problem_set_id = problem_set_problems.problem_set_id `+
+		`WHERE assignments.user_id = $1 AND problem_changelogs.created_at > assignments.created_at `+
+		`AND problem_changelogs.created_at >= $2 `+
+		`AND (assignments.lock_at IS NULL OR assignments.lock_at > $3 OR `+
+		`(SELECT lock_at FROM assignment_reopens WHERE assignment_id = assignments.id ORDER BY created_at DESC, id DESC LIMIT 1) > $3) `+
+		`ORDER BY problem_changelogs.created_at DESC, problem_changelogs.id DESC`,
+		currentUser.ID, since, now); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := fillChangelogProblems(tx, entries); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// confirmedChecklist keeps the confirmed items that are on the problem's
+// checklist, in checklist order, and drops anything else.
+func confirmedChecklist(problem *Problem, confirmed []string) []string {
+	have := make(map[string]bool)
+	for _, item := range confirmed {
+		have[item] = true
+	}
+	var list []string
+	for _, item := range problem.Checklist {
+		if have[item] {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// GetAssignmentChecklist handles a request to /v2/assignments/:assignment_id/checklist,
+// reporting for each step of each problem with a checklist how many of the
+// students in the course have confirmed it. Any student's assignment ID for
+// the assignment will do. Instructor work is not counted.
+func GetAssignmentChecklist(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	problems := []*Problem{}
+	if err := meddler.QueryAll(tx, &problems, `SELECT problems.* FROM problems JOIN problem_set_problems ON problems.id = problem_set_problems.problem_id `+
+		`WHERE problem_set_problems.problem_set_id = $1 AND problems.checklist != 'null'::jsonb ORDER BY problems.unique_id`, assignment.ProblemSetID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	report := []*ChecklistCompliance{}
+	for _, problem := range problems {
+		if len(problem.Checklist) == 0 {
+			continue
+		}
+		rows, err := tx.Query(`SELECT commits.step, commits.checklist FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+			`WHERE assignments.course_id = $1 AND assignments.problem_set_id = $2 AND NOT assignments.instructor AND commits.problem_id = $3 `+
+			`ORDER BY commits.step`, assignment.CourseID, assignment.ProblemSetID, problem.ID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		var current *ChecklistCompliance
+		counts := make(map[string]int)
+		finish := func() {
+			if current == nil {
+				return
+			}
+			for _, item := range problem.Checklist {
+				current.Items = append(current.Items, &ChecklistItemCount{Item: item, Confirmed: counts[item]})
+			}
+			report = append(report, current)
+		}
+		for rows.Next() {
+			var step int64
+			var raw []byte
+			if err := rows.Scan(&step, &raw); err != nil {
+				rows.Close()
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			var confirmed []string
+			if err := json.Unmarshal(raw, &confirmed); err != nil {
+				rows.Close()
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "json error decoding checklist: %v", err)
+				return
+			}
+			if current == nil || current.Step != step {
+				finish()
+				current = &ChecklistCompliance{ProblemID: problem.ID, Unique: problem.Unique, Step: step, Items: []*ChecklistItemCount{}}
+				counts = make(map[string]int)
+			}
+			current.Students++
+			if problem.ChecklistConfirmed(confirmed) {
+				current.Confirmed++
+			}
+			for _, item := range confirmedChecklist(problem, confirmed) {
+				counts[item]++
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		finish()
+	}
+	render.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// MaxCheckpointsPerProblem is how many checkpoints a student may keep for
+// one problem of an assignment. The oldest are discarded to make room.
+const MaxCheckpointsPerProblem = 50
+
+// saveCheckpoint keeps a labeled copy of a saved commit's files. The files
+// must already be in the file store.
+func saveCheckpoint(tx *sql.Tx, now time.Time, commit *Commit) error {
+	checkpoint := &Checkpoint{
+		AssignmentID: commit.AssignmentID,
+		ProblemID:    commit.ProblemID,
+		Step:         commit.Step,
+		Label:        commit.Note,
+		FileHashes:   commit.FileHashes,
+		CreatedAt:    now,
+	}
+	if err := meddler.Insert(tx, "checkpoints", checkpoint); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM checkpoints WHERE assignment_id = $1 AND problem_id = $2 AND id NOT IN `+
+		`(SELECT id FROM checkpoints WHERE assignment_id = $1 AND problem_id = $2 ORDER BY created_at DESC, id DESC LIMIT $3)`,
+		commit.AssignmentID, commit.ProblemID, MaxCheckpointsPerProblem)
+	return err
+}
+
+// GetAssignmentProblemCheckpoints handles requests to /v2/assignments/:assignment_id/problems/:problem_id/checkpoints,
+// returning the checkpoints for the given problem of the given assignment, oldest first, without their files.
+func GetAssignmentProblemCheckpoints(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+
+	checkpoints := []*Checkpoint{}
+
+	if currentUser.Admin {
+		err = meddler.QueryAll(tx, &checkpoints, `SELECT * FROM checkpoints WHERE assignment_id = $1 AND problem_id = $2 ORDER BY created_at, id`,
+			assignmentID, problemID)
+	} else {
+		err = meddler.QueryAll(tx, &checkpoints, `SELECT checkpoints.* `+
+			`FROM checkpoints JOIN user_assignments ON checkpoints.assignment_id = user_assignments.assignment_id `+
+			`WHERE checkpoints.assignment_id = $1 AND problem_id = $2 AND user_assignments.user_id = $3 `+
+			`ORDER BY created_at, id`, assignmentID, problemID, currentUser.ID)
+	}
+
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	render.JSON(http.StatusOK, checkpoints)
+}
+
+// GetAssignmentProblemCheckpoint handles requests to /v2/assignments/:assignment_id/problems/:problem_id/checkpoints/:checkpoint_id,
+// returning a single checkpoint with its files.
+func GetAssignmentProblemCheckpoint(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	checkpointID, err := parseID(w, "checkpoint_id", params["checkpoint_id"])
+	if err != nil {
+		return
+	}
+
+	checkpoint := new(Checkpoint)
+
+	if currentUser.Admin {
+		err = meddler.QueryRow(tx, checkpoint, `SELECT * FROM checkpoints WHERE id = $1 AND assignment_id = $2 AND problem_id = $3`,
+			checkpointID, assignmentID, problemID)
+	} else {
+		err = meddler.QueryRow(tx, checkpoint, `SELECT checkpoints.* `+
+			`FROM checkpoints JOIN user_assignments ON checkpoints.assignment_id = user_assignments.assignment_id `+
+			`WHERE checkpoints.id = $1 AND checkpoints.assignment_id = $2 AND problem_id = $3 AND user_assignments.user_id = $4`,
+			checkpointID, assignmentID, problemID, currentUser.ID)
+	}
+
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	// the file store is shared with commits
+	files := &Commit{ID: checkpoint.ID, FileHashes: checkpoint.FileHashes}
+	if err := loadCommitFiles(tx, files); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading checkpoint files: %v", err)
+		return
+	}
+	checkpoint.Files = files.Files
+
+	render.JSON(http.StatusOK, checkpoint)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// GetAssignmentStepFailureClusters handles a request to /v2/assignments/:assignment_id/steps/:step/failure_clusters,
+// grouping the students in the course whose latest submission for a step
+// did not pass by the tests they failed and the first error message in
+// their transcripts. Any student's assignment ID for the assignment will
+// do. Instructor work is not counted. Parameters:
+//
+//	problem: the ID or unique ID of the problem, needed if the assignment has more than one
+func GetAssignmentStepFailureClusters(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	step, err := parseID(w, "step", params["step"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	// find the problem
+	problems := []*Problem{}
+	if err := meddler.QueryAll(tx, &problems, `SELECT problems.* FROM problems JOIN problem_set_problems ON problems.id = problem_set_problems.problem_id `+
+		`WHERE problem_set_problems.problem_set_id = $1 ORDER BY problems.unique_id`, assignment.ProblemSetID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	var problem *Problem
+	name := r.FormValue("problem")
+	for _, elt := range problems {
+		if name == "" && len(problems) == 1 || name == elt.Unique || name == strconv.FormatInt(elt.ID, 10) {
+			problem = elt
+		}
+	}
+	if problem == nil {
+		names := []string{}
+		for _, elt := range problems {
+			names = append(names, elt.Unique)
+		}
+		if name == "" {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "the assignment has more than one problem; choose one with problem: %s", strings.Join(names, ", "))
+		} else {
+			loggedHTTPErrorf(w, http.StatusNotFound, "problem %s is not part of the assignment, which has: %s", name, strings.Join(names, ", "))
+		}
+		return
+	}
+
+	commits := []*Commit{}
+	if err := meddler.QueryAll(tx, &commits, `SELECT commits.* FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+		`WHERE assignments.course_id = $1 AND assignments.problem_set_id = $2 AND NOT assignments.instructor `+
+		`AND commits.problem_id = $3 AND commits.step = $4 AND commits.action IS NOT NULL AND commits.action <> $5 `+
+		`AND COALESCE(commits.score, 0) < 1 ORDER BY commits.id`,
+		assignment.CourseID, assignment.ProblemSetID, problem.ID, step, StyleCheckAction); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	result := &FailureClusters{ProblemID: problem.ID, Unique: problem.Unique, Step: step, Clusters: []*FailureCluster{}}
+	clusters := make(map[string]*FailureCluster)
+	for _, commit := range commits {
+		if err := revealHiddenTests(tx, currentUser, commit); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error opening hidden results of commit %d: %v", commit.ID, err)
+			return
+		}
+		failed := []string{}
+		if commit.ReportCard != nil {
+			for _, elt := range commit.ReportCard.Results {
+				if elt.Outcome == "failed" || elt.Outcome == "error" {
+					failed = append(failed, elt.Name)
+				}
+			}
+		}
+		sort.Strings(failed)
+		signature := ""
+		if messages := extractErrorMessages(commit.Transcript); len(messages) > 0 {
+			signature = messages[0]
+		}
+
+		key := strings.Join(failed, "\n") + "\x00" + signature
+		cluster := clusters[key]
+		if cluster == nil {
+			cluster = &FailureCluster{FailedTests: failed, Signature: signature, AssignmentIDs: []int64{}, ExampleCommitID: commit.ID}
+			clusters[key] = cluster
+			result.Clusters = append(result.Clusters, cluster)
+		}
+		cluster.Students++
+		cluster.AssignmentIDs = append(cluster.AssignmentIDs, commit.AssignmentID)
+		result.Failing++
+	}
+	sort.SliceStable(result.Clusters, func(i, j int) bool {
+		return result.Clusters[i].Students > result.Clusters[j].Students
+	})
+
+	render.JSON(http.StatusOK, result)
+}
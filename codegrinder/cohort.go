@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// GetProblemCohorts handles a request to /v2/problems/:problem_id/cohorts,
+// comparing pass rates, attempt counts, and time to pass on each step of a
+// problem across the course offerings that used it, oldest course first.
+// Instructor work is not counted. With current_version=true, only work begun
+// since the problem was last updated is counted, so offerings can be
+// compared on the same version of the problem.
+func GetProblemCohorts(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, render render.Render) {
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	problem := new(Problem)
+	if err := meddler.Load(tx, "problems", problem, problemID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	comparison := &CohortComparison{
+		ProblemID:        problem.ID,
+		Unique:           problem.Unique,
+		VersionUpdatedAt: problem.UpdatedAt,
+		Cohorts:          []*Cohort{},
+	}
+	var since time.Time
+	if current, _ := strconv.ParseBool(r.FormValue("current_version")); current {
+		comparison.CurrentVersionOnly = true
+		since = problem.UpdatedAt
+	}
+
+	// gather the commits for each course and step
+	type key struct{ courseID, step int64 }
+	type stepData struct {
+		students int
+		passed   int
+		minutes  []int
+		attempts []int
+	}
+	cohorts := make(map[int64]*Cohort)
+	steps := make(map[key]*stepData)
+	var stepOrder []key
+	rows, err := tx.Query(`SELECT courses.id, courses.name, courses.lti_label, commits.step, COALESCE(commits.score, 0), commits.created_at, commits.updated_at `+
+		`FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+		`JOIN courses ON assignments.course_id = courses.id `+
+		`WHERE commits.problem_id = $1 AND NOT assignments.instructor AND commits.created_at >= $2 `+
+		`ORDER BY courses.created_at, courses.id, commits.step`, problemID, since)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k key
+		var name, label string
+		var score float64
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(&k.courseID, &name, &label, &k.step, &score, &createdAt, &updatedAt); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		cohort := cohorts[k.courseID]
+		if cohort == nil {
+			cohort = &Cohort{
+				CourseID:      k.courseID,
+				CourseName:    name,
+				CourseLabel:   label,
+				FirstCommitAt: createdAt,
+				LastCommitAt:  updatedAt,
+				Steps:         []*CohortStep{},
+			}
+			cohorts[k.courseID] = cohort
+			comparison.Cohorts = append(comparison.Cohorts, cohort)
+		}
+		if createdAt.Before(cohort.FirstCommitAt) {
+			cohort.FirstCommitAt = createdAt
+		}
+		if updatedAt.After(cohort.LastCommitAt) {
+			cohort.LastCommitAt = updatedAt
+		}
+		if createdAt.Before(problem.UpdatedAt) {
+			cohort.EarlierVersion = true
+		}
+
+		data := steps[k]
+		if data == nil {
+			data = new(stepData)
+			steps[k] = data
+			stepOrder = append(stepOrder, k)
+		}
+		data.students++
+		if score == 1.0 {
+			data.passed++
+			data.minutes = append(data.minutes, int(updatedAt.Sub(createdAt).Minutes()))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// count graded submissions per student
+	attempts, err := tx.Query(`SELECT action_runs.course_id, action_runs.step, COUNT(*) `+
+		`FROM action_runs WHERE action_runs.problem_id = $1 AND action_runs.created_at >= $2 `+
+		`AND action_runs.user_id NOT IN (SELECT user_id FROM assignments WHERE course_id = action_runs.course_id AND instructor) `+
+		`GROUP BY action_runs.course_id, action_runs.user_id, action_runs.step`, problemID, since)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	defer attempts.Close()
+	for attempts.Next() {
+		var k key
+		var count int
+		if err := attempts.Scan(&k.courseID, &k.step, &count); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if data := steps[k]; data != nil {
+			data.attempts = append(data.attempts, count)
+		}
+	}
+	if err := attempts.Err(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	for _, k := range stepOrder {
+		data := steps[k]
+		step := &CohortStep{
+			Step:     k.step,
+			Students: data.students,
+			Passed:   data.passed,
+			PassRate: float64(data.passed) / float64(data.students),
+		}
+		if len(data.attempts) > 0 {
+			step.Attempts = summarizeInts(data.attempts)
+		}
+		if len(data.minutes) > 0 {
+			step.MinutesToPass = summarizeInts(data.minutes)
+		}
+		cohorts[k.courseID].Steps = append(cohorts[k.courseID].Steps, step)
+	}
+
+	render.JSON(http.StatusOK, comparison)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Instructors can annotate a student's commit with comments on ranges of
+// lines, and students see the comments on their own work. A comment keeps
+// a copy of the lines it refers to so it still makes sense after the
+// student saves newer work for the same step.
+
+// MaxCommentLength is the longest comment accepted, in bytes.
+const MaxCommentLength = 10000
+
+// loadVisibleCommit loads a commit if the current user may see it.
+func loadVisibleCommit(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) (*Commit, error) {
+	commitID, err := parseID(w, "commit_id", params["commit_id"])
+	if err != nil {
+		return nil, err
+	}
+	commit := new(Commit)
+	if currentUser.Admin {
+		err = meddler.QueryRow(tx, commit, `SELECT * FROM commits WHERE id = $1`, commitID)
+	} else {
+		err = meddler.QueryRow(tx, commit, `SELECT commits.* `+
+			`FROM commits JOIN user_assignments ON commits.assignment_id = user_assignments.assignment_id `+
+			`WHERE commits.id = $1 AND user_assignments.user_id = $2`, commitID, currentUser.ID)
+	}
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil, err
+	}
+	return commit, nil
+}
+
+// GetCommitComments handles requests to /v2/commits/:commit_id/comments,
+// returning the comments on a commit ordered by file and line.
+func GetCommitComments(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	commit, err := loadVisibleCommit(w, tx, params, currentUser)
+	if err != nil {
+		return
+	}
+	comments := []*CommitComment{}
+	if err := meddler.QueryAll(tx, &comments, `SELECT * FROM commit_comments WHERE commit_id = $1 `+
+		`ORDER BY file, line_start, created_at`, commit.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// fill in the author names
+	names := make(map[int64]string)
+	for _, comment := range comments {
+		if _, present := names[comment.AuthorID]; !present {
+			var name string
+			if err := tx.QueryRow(`SELECT name FROM users WHERE id = $1`, comment.AuthorID).Scan(&name); err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			names[comment.AuthorID] = name
+		}
+		comment.AuthorName = names[comment.AuthorID]
+	}
+
+	render.JSON(http.StatusOK, comments)
+}
+
+// PostCommitComment handles requests to /v2/commits/:commit_id/comments,
+// adding a comment on a range of lines in one of the commit's files. Only
+// TAs and instructors for the course and administrators may comment.
+func PostCommitComment(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, request CommitComment, render render.Render) {
+	now := time.Now()
+
+	commit, err := loadVisibleCommit(w, tx, params, currentUser)
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, commit.AssignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	request.Body = strings.TrimSpace(request.Body)
+	if request.Body == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "a comment must have some text")
+		return
+	}
+	if len(request.Body) > MaxCommentLength {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "a comment may be at most %d bytes", MaxCommentLength)
+		return
+	}
+	if err := loadCommitFiles(tx, commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading commit files: %v", err)
+		return
+	}
+	contents, exists := commit.Files[request.File]
+	if !exists {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "commit %d has no file %q", commit.ID, request.File)
+		return
+	}
+	lines := strings.Split(strings.TrimSuffix(contents, "\n"), "\n")
+	if request.LineEnd == 0 {
+		request.LineEnd = request.LineStart
+	}
+	if request.LineStart < 1 || request.LineEnd < request.LineStart || request.LineEnd > len(lines) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "lines %d-%d are not in %s, which has %d line%s",
+			request.LineStart, request.LineEnd, request.File, len(lines), plural(len(lines)))
+		return
+	}
+
+	comment := &CommitComment{
+		CommitID:  commit.ID,
+		AuthorID:  currentUser.ID,
+		File:      request.File,
+		LineStart: request.LineStart,
+		LineEnd:   request.LineEnd,
+		Excerpt:   strings.Join(lines[request.LineStart-1:request.LineEnd], "\n"),
+		Body:      request.Body,
+		CreatedAt: now,
+	}
+	if err := meddler.Insert(tx, "commit_comments", comment); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := recordEvent(tx, EventCommitComment, assignment.CourseID, assignment.UserID, comment.ID, map[string]interface{}{
+		"assignmentID": assignment.ID,
+		"commitID":     commit.ID,
+		"authorID":     currentUser.ID,
+		"file":         comment.File,
+		"lineStart":    comment.LineStart,
+		"lineEnd":      comment.LineEnd,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	comment.AuthorName = currentUser.Name
+	if assignment.UserID != currentUser.ID {
+		body := fmt.Sprintf("%s commented on your work for %s, step %d, %s line %d:\n\n%s\n\nRun \"grind comments\" in the problem directory to see it with your code.\n",
+			currentUser.Name, assignment.CanvasTitle, commit.Step, comment.File, comment.LineStart, comment.Body)
+		notifyUser(tx, assignment.UserID, NotifyCommitComment, "New comment on "+assignment.CanvasTitle, body)
+	}
+
+	render.JSON(http.StatusOK, comment)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-martini/martini"
+)
+
+// compressResponses is middleware that gzip or deflate encodes response
+// bodies when the client advertises support for it in Accept-Encoding.
+// Websocket upgrades and responses that are already encoded are left alone.
+func compressResponses(c martini.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "" {
+		return
+	}
+	encoding := chooseEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	cw := &compressedResponseWriter{ResponseWriter: w.(martini.ResponseWriter), encoding: encoding}
+	c.MapTo(cw, (*http.ResponseWriter)(nil))
+	c.Next()
+	if err := cw.Close(); err != nil {
+		log.Printf("error closing compressed response: %v", err)
+	}
+}
+
+// chooseEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip. Encodings with q=0 are treated as refused.
+func chooseEncoding(header string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		ok := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					ok = false
+				}
+			}
+		}
+		accepted[name] = ok
+	}
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressedResponseWriter holds back the status line until the first write
+// so that empty responses are sent without a Content-Encoding header.
+type compressedResponseWriter struct {
+	martini.ResponseWriter
+	encoding string
+	status   int
+	writer   io.WriteCloser
+}
+
+func (w *compressedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 && !w.ResponseWriter.Written() {
+		w.status = status
+	}
+}
+
+func (w *compressedResponseWriter) Written() bool {
+	return w.status != 0 || w.ResponseWriter.Written()
+}
+
+// writePendingHeader sends the held status line, marking the response as
+// compressed if it has a body that is not already encoded.
+func (w *compressedResponseWriter) writePendingHeader(hasBody bool) {
+	if w.status == 0 {
+		return
+	}
+	h := w.Header()
+	// byte ranges refer to the uncompressed body, so leave ranged responses alone
+	if hasBody && w.status != http.StatusNoContent && w.status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && h.Get("Accept-Ranges") == "" {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		if w.encoding == "gzip" {
+			w.writer = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			// HTTP deflate is the zlib format, not a raw deflate stream
+			w.writer = zlib.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.status = 0
+}
+
+func (w *compressedResponseWriter) Write(data []byte) (int, error) {
+	if !w.Written() {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	w.writePendingHeader(len(data) > 0)
+	if w.writer == nil {
+		return w.ResponseWriter.Write(data)
+	}
+	return w.writer.Write(data)
+}
+
+func (w *compressedResponseWriter) Flush() {
+	w.writePendingHeader(false)
+	if flusher, ok := w.writer.(interface {
+		Flush() error
+	}); ok {
+		flusher.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Close sends any held status line and flushes buffered compressed data to
+// the underlying writer.
+func (w *compressedResponseWriter) Close() error {
+	w.writePendingHeader(false)
+	if w.writer == nil {
+		return nil
+	}
+	return w.writer.Close()
+}
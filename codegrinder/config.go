@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// Settings come from the config file (JSON, with the fields of ServerConfig)
+// and then from the environment. Unknown fields and out-of-range values are
+// rejected when the server starts, with every problem reported at once.
+//
+// On SIGHUP the server loads the settings again. If they are valid, the
+// settings listed in reloadableSettings take effect right away; a change to
+// any other setting is logged and waits for a restart. If they are not
+// valid, the problems are logged and the running settings are kept.
+
+// reloadableSettings are the settings that can change while the server is
+// running. Each is read as it is needed rather than copied at startup.
+var reloadableSettings = []string{
+	"LTISecret",
+	"DaycareHosts",
+	"DaycareMaxRunning",
+	"CourseMaxRunning",
+	"UserMaxRunning",
+	"SessionIdleMinutes",
+	"GradingCapacity",
+	"GradeRateLimitPerMinute",
+	"GradeDailyQuota",
+	"SMTPServer",
+	"SMTPUsername",
+	"SMTPPassword",
+	"MailFrom",
+	"NudgeCooldownHours",
+	"NudgeSubject",
+	"NudgeTemplate",
+	"ImpersonationMinutes",
+	"OpenCommitMinutes",
+	"SignedCommitMinutes",
+	"TranscriptEventCountLimit",
+	"TranscriptDataLimit",
+	"RevealHiddenTests",
+	"ScanCommand",
+	"GradeHookScriptDir",
+}
+
+// defaultConfig returns the settings used when the config file and
+// environment do not say otherwise.
+func defaultConfig() *ServerConfig {
+	return &ServerConfig{
+		ToolName:             "CodeGrinder",
+		ToolID:               "codegrinder",
+		ToolDescription:      "Programming exercises with grading",
+		LetsEncryptCache:     "/etc/codegrinder/letsencrypt.cache",
+		PostgresHost:         "/var/run/postgresql",
+		PostgresUsername:     os.Getenv("USER"),
+		PostgresDatabase:     os.Getenv("USER"),
+		WorkerSlots:          DefaultWorkerSlots,
+		SessionIdleMinutes:   2,
+		NudgeCooldownHours:   48,
+		NudgeSubject:         defaultNudgeSubject,
+		NudgeTemplate:        defaultNudgeTemplate,
+		ImpersonationMinutes: 30,
+		OpenCommitMinutes:    int(OpenCommitTimeout / time.Minute),
+		SignedCommitMinutes:  int(SignedCommitTimeout / time.Minute),
+	}
+}
+
+// loadConfig reads the settings from the config file and the environment
+// and validates them. If optional is set, a missing config file is not an
+// error.
+func loadConfig(path string, optional bool) (*ServerConfig, error) {
+	config := defaultConfig()
+	if raw, err := ioutil.ReadFile(path); os.IsNotExist(err) && optional {
+		log.Printf("no config file at %q, using settings from the environment", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load config file %q: %v", path, err)
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(config); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %q: %v", path, err)
+		}
+	}
+	if err := applyEnvConfig(config); err != nil {
+		return nil, err
+	}
+	config.SessionSecret = unBase64(config.SessionSecret)
+	config.DaycareSecret = unBase64(config.DaycareSecret)
+	if problems := validateConfig(config); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid settings in config file %q:\n    %s", path, strings.Join(problems, "\n    "))
+	}
+	return config, nil
+}
+
+// validateConfig checks settings that can be checked without the
+// database or daycare, returning a description of each problem found.
+func validateConfig(config *ServerConfig) []string {
+	var problems []string
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if v.Field(i).Kind() == reflect.Int && v.Field(i).Int() < 0 {
+			problems = append(problems, fmt.Sprintf("%s cannot be negative", t.Field(i).Name))
+		}
+	}
+	for name, value := range map[string]int{
+		"WorkerSlots":          config.WorkerSlots,
+		"SessionIdleMinutes":   config.SessionIdleMinutes,
+		"ImpersonationMinutes": config.ImpersonationMinutes,
+		"OpenCommitMinutes":    config.OpenCommitMinutes,
+		"SignedCommitMinutes":  config.SignedCommitMinutes,
+	} {
+		if value == 0 {
+			problems = append(problems, fmt.Sprintf("%s must be at least 1", name))
+		}
+	}
+	if strings.Contains(config.Hostname, "/") || strings.Contains(config.Hostname, ":") {
+		problems = append(problems, fmt.Sprintf("Hostname must be a bare host name, not %q", config.Hostname))
+	}
+	if config.WorkQueueHost != "" && (strings.Contains(config.WorkQueueHost, "/") || strings.Contains(config.WorkQueueHost, ":")) {
+		problems = append(problems, fmt.Sprintf("WorkQueueHost must be a bare host name, not %q", config.WorkQueueHost))
+	}
+	for _, host := range config.DaycareHosts {
+		if host == "" || strings.Contains(host, "/") {
+			problems = append(problems, fmt.Sprintf("DaycareHosts must be bare host names, not %q", host))
+		}
+	}
+	if config.SMTPServer != "" {
+		if _, _, err := net.SplitHostPort(config.SMTPServer); err != nil {
+			problems = append(problems, fmt.Sprintf("SMTPServer must be host:port, not %q", config.SMTPServer))
+		}
+	}
+	if _, err := template.New("subject").Parse(config.NudgeSubject); err != nil {
+		problems = append(problems, fmt.Sprintf("NudgeSubject is not a valid template: %v", err))
+	}
+	if _, err := template.New("body").Parse(config.NudgeTemplate); err != nil {
+		problems = append(problems, fmt.Sprintf("NudgeTemplate is not a valid template: %v", err))
+	}
+	for name, dir := range map[string]string{
+		"StaticDir":          config.StaticDir,
+		"GradeHookScriptDir": config.GradeHookScriptDir,
+		"LetsEncryptCache":   config.LetsEncryptCache,
+	} {
+		if dir != "" && !filepath.IsAbs(dir) {
+			problems = append(problems, fmt.Sprintf("%s must be a full path, not %q", name, dir))
+		}
+	}
+	if config.ProfileIntervalMinutes > 0 && config.ProfileSeconds >= config.ProfileIntervalMinutes*60 {
+		problems = append(problems, "ProfileSeconds must be shorter than ProfileIntervalMinutes")
+	}
+	return problems
+}
+
+// openCommitTimeout is how long saved work waits to be graded before it is
+// abandoned.
+func (config *ServerConfig) openCommitTimeout() time.Duration {
+	return time.Duration(config.OpenCommitMinutes) * time.Minute
+}
+
+// signedCommitTimeout is how long a signed commit is good for.
+func (config *ServerConfig) signedCommitTimeout() time.Duration {
+	return time.Duration(config.SignedCommitMinutes) * time.Minute
+}
+
+// reloadConfig loads the settings again and puts the reloadable ones into
+// effect, reporting any others that changed.
+func reloadConfig(path string, optional bool) error {
+	fresh, err := loadConfig(path, optional)
+	if err != nil {
+		return err
+	}
+	reloadable := make(map[string]bool)
+	for _, name := range reloadableSettings {
+		reloadable[name] = true
+	}
+
+	// start with a copy so requests in progress keep a consistent view
+	current := Config()
+	next := *current
+	oldValue, newValue, nextValue := reflect.ValueOf(current).Elem(), reflect.ValueOf(fresh).Elem(), reflect.ValueOf(&next).Elem()
+	var changed, ignored []string
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := oldValue.Type().Field(i).Name
+		if reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+		if reloadable[name] {
+			nextValue.Field(i).Set(newValue.Field(i))
+			changed = append(changed, name)
+		} else {
+			ignored = append(ignored, name)
+		}
+	}
+	setConfig(&next)
+
+	if len(changed) > 0 {
+		log.Printf("config reloaded; changed %s", strings.Join(changed, ", "))
+	} else {
+		log.Printf("config reloaded; no changes")
+	}
+	if len(ignored) > 0 {
+		log.Printf("config changes to %s will take effect when the server is restarted", strings.Join(ignored, ", "))
+	}
+	return nil
+}
+
+// startConfigReload reloads the settings each time the server gets SIGHUP.
+func startConfigReload(path string, optional bool) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := reloadConfig(path, optional); err != nil {
+				log.Printf("keeping the current config: %v", err)
+			}
+		}
+	}()
+}
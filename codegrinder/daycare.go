@@ -3,6 +3,8 @@ package main
 import (
 	"archive/tar"
 	"bytes"
+	"context"
+	"database/sql"
 	"fmt"
 	"io"
 	"log"
@@ -22,8 +24,9 @@ var dockerClient *docker.Client
 // It expects a websocket connection, which will receive a series of DaycareRequest objects
 // and will respond with DaycareResponse objects, though not in a one-to-one fashion.
 // The first DaycareRequest must have the CommitBundle field present. Future requests
-// should only have Stdin present.
-func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params martini.Params) {
+// should only have Stdin present. When the TA role runs in the same process,
+// db is its database; otherwise it is nil.
+func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params martini.Params, db *sql.DB) {
 	now := time.Now()
 
 	problemType, exists := problemTypes[params["problem_type"]]
@@ -44,19 +47,51 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 		return
 	}
 	defer socket.Close()
+
+	// get the first message
+	req := new(DaycareRequest)
+	if err := socket.ReadJSON(req); err != nil {
+		msg := fmt.Sprintf("error reading first request message: %v", err)
+		log.Print(msg)
+		socket.WriteJSON(&DaycareResponse{Error: msg})
+		return
+	}
+
+	// a TA in the same process records that the commit was dispatched
+	if db != nil {
+		if err := dispatchCommitNonces(db, now, req); err != nil {
+			log.Print(err)
+			socket.WriteJSON(&DaycareResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	// kill the container if the client goes away
+	ctx, cancel := watchSession(socket)
+	defer cancel()
+
+	r.ParseForm()
+	runDaycareRequest(ctx, now, problemType, action, params["action"], req, r.Form["args"], func(res *DaycareResponse) error {
+		return socket.WriteJSON(res)
+	})
+}
+
+// runDaycareRequest checks and carries out a single request, reporting
+// events, errors, and the final commit bundle through send. It serves both
+// clients connected directly by websocket and jobs pulled from the work queue.
+// The request is abandoned when ctx is cancelled.
+func runDaycareRequest(ctx context.Context, now time.Time, problemType *ProblemType, action *ProblemTypeAction, actionName string, req *DaycareRequest, args []string, send func(*DaycareResponse) error) {
 	logAndTransmitErrorf := func(format string, args ...interface{}) {
 		msg := fmt.Sprintf(format, args...)
 		log.Print(msg)
 		res := &DaycareResponse{Error: msg}
-		if err := socket.WriteJSON(res); err != nil {
+		if err := send(res); err != nil {
 			// what can we do? we already logged the error
 		}
 	}
 
-	// get the first message
-	req := new(DaycareRequest)
-	if err := socket.ReadJSON(req); err != nil {
-		logAndTransmitErrorf("error reading first request message: %v", err)
+	if req.SetCommitBundle != nil {
+		runDaycareSetRequest(ctx, now, problemType, action, actionName, req, args, send, logAndTransmitErrorf)
 		return
 	}
 
@@ -65,41 +100,145 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 		logAndTransmitErrorf("first request message must include the commit bundle")
 		return
 	}
-	if req.CommitBundle.Problem == nil {
-		logAndTransmitErrorf("commit bundle must include the problem")
+	job, err := prepareDaycareCommit(req.CommitBundle, actionName)
+	if err != nil {
+		logAndTransmitErrorf("%v", err)
 		return
 	}
-	if len(req.CommitBundle.ProblemSteps) == 0 {
-		logAndTransmitErrorf("commit bundle must include the problem steps")
+	if err := ensureProblemTypeImages(problemType, send); err != nil {
+		logAndTransmitErrorf("%v", err)
 		return
 	}
-	if len(req.CommitBundle.ProblemSignature) == 0 {
-		logAndTransmitErrorf("commit bundle must include the problem signature")
+
+	// wait for a turn, letting the client know where it is in line
+	release, err := waitForDaycareTurn(req.CommitBundle, send)
+	if err != nil {
+		logAndTransmitErrorf("%v", err)
 		return
 	}
-	if req.CommitBundle.Commit == nil {
-		logAndTransmitErrorf("commit bundle must include the commit")
+	defer release()
+
+	if err := gradeDaycareCommit(ctx, now, problemType, action, job, req.UserID, args, send, logAndTransmitErrorf); err != nil {
+		logAndTransmitErrorf("%v", err)
 		return
 	}
-	if len(req.CommitBundle.CommitSignature) == 0 {
-		logAndTransmitErrorf("commit bundle must include the commit signature")
+
+	res := &DaycareResponse{CommitBundle: req.CommitBundle}
+	if err := send(res); err != nil {
+		logAndTransmitErrorf("error writing final commit JSON: %v", err)
 		return
 	}
+}
 
-	// check signatures
-	problem, steps := req.CommitBundle.Problem, req.CommitBundle.ProblemSteps
-	problemSig := problem.ComputeSignature(Config.DaycareSecret, steps)
-	if req.CommitBundle.ProblemSignature != problemSig {
-		logAndTransmitErrorf("problem signature mismatch: found %s but expected %s", req.CommitBundle.ProblemSignature, problemSig)
+// runDaycareSetRequest grades every commit of a problem set that is graded
+// together in a single session: the set waits for one turn and each problem
+// is graded in a fresh container, so problems cannot see each other's
+// files. The graded set is signed again and sent back as a unit.
+func runDaycareSetRequest(ctx context.Context, now time.Time, problemType *ProblemType, action *ProblemTypeAction, actionName string, req *DaycareRequest, args []string, send func(*DaycareResponse) error, logAndTransmitErrorf func(string, ...interface{})) {
+	set := req.SetCommitBundle
+	if len(set.Bundles) == 0 {
+		logAndTransmitErrorf("set commit bundle must include at least one commit bundle")
+		return
+	}
+	if len(set.Weights) != len(set.Bundles) {
+		logAndTransmitErrorf("set commit bundle has %d weights for %d commit bundles", len(set.Weights), len(set.Bundles))
 		return
 	}
-	commit := req.CommitBundle.Commit
-	commitSig := commit.ComputeSignature(Config.DaycareSecret, problemSig)
-	if req.CommitBundle.CommitSignature != commitSig {
-		logAndTransmitErrorf("commit signature mismatch: found %s but expected %s", req.CommitBundle.CommitSignature, commitSig)
+	if set.Signature != set.ComputeSignature(Config().DaycareSecret) {
+		logAndTransmitErrorf("set commit bundle signature mismatch")
+		return
+	}
+	jobs := []*daycareCommit{}
+	for _, bundle := range set.Bundles {
+		job, err := prepareDaycareCommit(bundle, actionName)
+		if err != nil {
+			logAndTransmitErrorf("%v", err)
+			return
+		}
+		if bundle.Problem.ProblemType != problemType.Name {
+			logAndTransmitErrorf("problem %s has type %s, but the set is being graded as %s", bundle.Problem.Unique, bundle.Problem.ProblemType, problemType.Name)
+			return
+		}
+		if bundle.OwnerSignature == "" || bundle.OwnerSignature != bundle.ComputeOwnerSignature(Config().DaycareSecret) {
+			logAndTransmitErrorf("owner signature mismatch")
+			return
+		}
+		if bundle.UserID != set.Bundles[0].UserID || bundle.Commit.AssignmentID != set.Bundles[0].Commit.AssignmentID {
+			logAndTransmitErrorf("every commit in a set must be for the same assignment")
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	if err := ensureProblemTypeImages(problemType, send); err != nil {
+		logAndTransmitErrorf("%v", err)
 		return
 	}
-	req.CommitBundle.CommitSignature = ""
+
+	release, err := waitForDaycareTurn(set.Bundles[0], send)
+	if err != nil {
+		logAndTransmitErrorf("%v", err)
+		return
+	}
+	defer release()
+
+	for _, job := range jobs {
+		if err := gradeDaycareCommit(ctx, now, problemType, action, job, req.UserID, args, send, logAndTransmitErrorf); err != nil {
+			logAndTransmitErrorf("%s: %v", job.bundle.Problem.Unique, err)
+			return
+		}
+	}
+	set.Signature = set.ComputeSignature(Config().DaycareSecret)
+	set.Combine()
+
+	res := &DaycareResponse{SetCommitBundle: set}
+	if err := send(res); err != nil {
+		logAndTransmitErrorf("error writing final commit JSON: %v", err)
+		return
+	}
+}
+
+// daycareCommit is a commit bundle that has been checked and is ready to
+// grade, along with the files to grade it with.
+type daycareCommit struct {
+	bundle    *CommitBundle
+	files     map[string]string
+	grader    string
+	hasGrader bool
+	hidden    *hiddenTests
+}
+
+// prepareDaycareCommit checks the signatures on a commit bundle and
+// gathers the files from the problem step and the commit.
+func prepareDaycareCommit(bundle *CommitBundle, actionName string) (*daycareCommit, error) {
+	// sanity check
+	if bundle.Problem == nil {
+		return nil, fmt.Errorf("commit bundle must include the problem")
+	}
+	if len(bundle.ProblemSteps) == 0 {
+		return nil, fmt.Errorf("commit bundle must include the problem steps")
+	}
+	if len(bundle.ProblemSignature) == 0 {
+		return nil, fmt.Errorf("commit bundle must include the problem signature")
+	}
+	if bundle.Commit == nil {
+		return nil, fmt.Errorf("commit bundle must include the commit")
+	}
+	if len(bundle.CommitSignature) == 0 {
+		return nil, fmt.Errorf("commit bundle must include the commit signature")
+	}
+
+	// check signatures
+	problem, steps := bundle.Problem, bundle.ProblemSteps
+	problemSig := problem.ComputeSignature(Config().DaycareSecret, steps)
+	if bundle.ProblemSignature != problemSig {
+		return nil, fmt.Errorf("problem signature mismatch: found %s but expected %s", bundle.ProblemSignature, problemSig)
+	}
+	commit := bundle.Commit
+	commitSig := commit.ComputeSignature(Config().DaycareSecret, problemSig)
+	if bundle.CommitSignature != commitSig {
+		return nil, fmt.Errorf("commit signature mismatch: found %s but expected %s", bundle.CommitSignature, commitSig)
+	}
+	bundle.CommitSignature = ""
 
 	// commit must be recent
 	age := time.Since(commit.UpdatedAt)
@@ -108,41 +247,144 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 		age = -age
 	}
 	if age > MaxDaycareRequestAge {
-		logAndTransmitErrorf("commit signature is %v off, cannot be more than %v", age, MaxDaycareRequestAge)
-		return
+		return nil, fmt.Errorf("commit signature is %v off, cannot be more than %v", age, MaxDaycareRequestAge)
 	}
-	if commit.Action != params["action"] {
-		logAndTransmitErrorf("commit says action is %s, but request says %s", commit.Action, params["action"])
-		return
+	if commit.Action != actionName {
+		return nil, fmt.Errorf("commit says action is %s, but request says %s", commit.Action, actionName)
+	}
+
+	// a signed commit can only be graded once, before it expires
+	if commit.Nonce == "" {
+		return nil, fmt.Errorf("signed commit has no nonce; please grade it again")
+	}
+	if err := daycareNonces.use(commit, time.Now()); err != nil {
+		return nil, err
 	}
 
 	// find the problem step
 	if commit.Step < 1 || commit.Step > int64(len(steps)) {
-		logAndTransmitErrorf("commit refers to step number %d, but there are %d steps in the problem", commit.Step, len(steps))
-		return
+		return nil, fmt.Errorf("commit refers to step number %d, but there are %d steps in the problem", commit.Step, len(steps))
 	}
 	step := steps[commit.Step-1]
 	if step.Step != commit.Step {
-		logAndTransmitErrorf("step number %d in the problem thinks it is step number %d", commit.Step, step.Step)
-		return
+		return nil, fmt.Errorf("step number %d in the problem thinks it is step number %d", commit.Step, step.Step)
+	}
+
+	// restore the hidden test files
+	if err := openHiddenTests(steps); err != nil {
+		return nil, err
 	}
 
 	// collect the files from the problem step and overlay the files from the commit
 	files := make(map[string]string)
-	for name, contents := range step.Files {
+	for name, contents := range step.VariantFiles(commit.Variant) {
 		files[name] = contents
 	}
 	for name, contents := range commit.Files {
 		files[name] = contents
 	}
+	if len(commit.Sealed) > 0 {
+		// decrypt the student's files; they are never put back in the commit,
+		// so the plaintext goes no further than this daycare
+		opened, err := openCommit(problem, steps, commit)
+		if err != nil {
+			return nil, err
+		}
+
+		// the TA could not scan these files, so scan them here
+		if Config().ScanCommand != "" {
+			if err := scanSealedFiles(opened); err != nil {
+				return nil, err
+			}
+		}
+		for name, contents := range opened {
+			files[name] = contents
+		}
+	}
+
+	// only the problem step may supply a custom grader
+	grader, hasGrader := step.VariantFiles(commit.Variant)[GraderScript]
+	if hasGrader {
+		files[GraderScript] = grader
+	} else {
+		delete(files, GraderScript)
+	}
+
+	// the same goes for the list of hidden tests
+	if list, ok := step.VariantFiles(commit.Variant)[HiddenTestsList]; ok {
+		files[HiddenTestsList] = list
+	} else {
+		delete(files, HiddenTestsList)
+	}
+
+	return &daycareCommit{
+		bundle:    bundle,
+		files:     files,
+		grader:    grader,
+		hasGrader: hasGrader,
+		hidden:    findHiddenTests(files),
+	}, nil
+}
+
+// ensureProblemTypeImages makes sure the images are present, reporting
+// progress if they must be downloaded.
+func ensureProblemTypeImages(problemType *ProblemType, send func(*DaycareResponse) error) error {
+	for _, image := range problemTypeImages(problemType) {
+		err := ensureImage(image, func(pull *ImagePull) {
+			res := &DaycareResponse{Event: &EventMessage{Time: time.Now(), Event: "pull", Pull: pull}}
+			if err := send(res); err != nil {
+				log.Printf("error writing image pull progress: %v", err)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("error downloading image %s: %v", image, err)
+		}
+	}
+	return nil
+}
+
+// waitForDaycareTurn waits until the owner of a commit bundle may run,
+// letting the client know where it is in line. The caller must call the
+// returned function when it is finished.
+func waitForDaycareTurn(bundle *CommitBundle, send func(*DaycareResponse) error) (func(), error) {
+	var userID, courseID int64
+	if bundle.OwnerSignature != "" {
+		if bundle.OwnerSignature != bundle.ComputeOwnerSignature(Config().DaycareSecret) {
+			return nil, fmt.Errorf("owner signature mismatch")
+		}
+		userID, courseID = bundle.UserID, bundle.CourseID
+	}
+	lastPosition := 0
+	release := runScheduler.acquire(userID, courseID, func(position int) {
+		if position == lastPosition {
+			return
+		}
+		lastPosition = position
+		res := &DaycareResponse{Event: &EventMessage{Time: time.Now(), Event: "queue", Position: position}}
+		if err := send(res); err != nil {
+			log.Printf("error writing queue position: %v", err)
+		}
+	})
+	return release, nil
+}
+
+// gradeDaycareCommit runs a prepared commit in a new container, streaming
+// events through send, and fills in the commit's report card, score, and
+// new signature. Problems that do not stop the run are reported through
+// logAndTransmitErrorf. If ctx is cancelled, the container is killed.
+func gradeDaycareCommit(ctx context.Context, now time.Time, problemType *ProblemType, action *ProblemTypeAction, job *daycareCommit, userID int64, args []string, send func(*DaycareResponse) error, logAndTransmitErrorf func(string, ...interface{})) error {
+	problem, commit, hidden := job.bundle.Problem, job.bundle.Commit, job.hidden
+	feedback := feedbackLevel(problem.Options)
+	if ctx.Err() != nil {
+		return fmt.Errorf("the client went away before grading started")
+	}
 
 	// launch a nanny process
-	nannyName := fmt.Sprintf("nanny-user-%d", req.UserID)
+	nannyName := fmt.Sprintf("nanny-user-%d", userID)
 	log.Printf("launching container for %s", nannyName)
-	n, err := NewNanny(problemType, problem, nannyName)
+	n, err := NewNanny(problemType, problem, nannyName, seedEnv(problem.Options, commit.AssignmentID))
 	if err != nil {
-		logAndTransmitErrorf("error creating nanny: %v", err)
-		return
+		return fmt.Errorf("error creating nanny: %v", err)
 	}
 
 	// start a listener
@@ -154,9 +396,15 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 
 			// feed event back to client
 			switch event.Event {
-			case "exec", "exit", "stdin", "stdout", "stderr", "stdinclosed", "error":
+			case "exec", "exit", "stdin", "stdout", "stderr", "stdinclosed", "error", "usage":
+				if hidden != nil && !hidden.visible(event) {
+					break
+				}
+				if feedback != FeedbackFull && !feedbackVisible(event) {
+					break
+				}
 				res := &DaycareResponse{Event: event}
-				if err := socket.WriteJSON(res); err != nil {
+				if err := send(res); err != nil {
 					logAndTransmitErrorf("error writing event JSON: %v", err)
 				}
 			}
@@ -164,18 +412,45 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 		finished <- struct{}{}
 	}()
 
+	// kill the container if the session is abandoned
+	graded := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			n.Abandon()
+		case <-graded:
+		}
+	}()
+
 	// grade the problem
-	r.ParseForm()
 	handler, ok := action.Handler.(nannyHandler)
 	if ok {
-		handler(n, r.Form["args"], problem.Options, files)
+		if commit.Action == "grade" || commit.Action == "confirm" {
+			autoFormat(n, problem.Options, job.files, len(commit.Sealed) > 0)
+		}
+		handler(n, args, problem.Options, job.files)
+		if commit.Action == "grade" || commit.Action == "confirm" {
+			gradeStyle(n, problem.Options, job.files)
+			if job.hasGrader {
+				runCustomGrader(n, job.grader)
+			}
+			applyPartWeights(n.ReportCard, problem.Options)
+		}
 	} else {
 		logAndTransmitErrorf("handler for action %s is of wrong type", commit.Action)
 	}
+	usage := n.Usage()
+	n.ReportCard.Usage = usage
+	n.Events <- &EventMessage{
+		Time:  time.Now(),
+		Event: "usage",
+		Usage: usage,
+	}
 	commit.ReportCard = n.ReportCard
 	//dump(commit.ReportCard)
 
 	// shutdown the nanny
+	close(graded)
 	if err := n.Shutdown(); err != nil {
 		logAndTransmitErrorf("nanny shutdown error: %v", err)
 	}
@@ -187,40 +462,65 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 	// send the final commit back to the client
 	commit.Compress()
 
+	// withhold the results of hidden tests
+	if hidden != nil {
+		transcript, err := hidden.withhold(commit.ReportCard, commit.Transcript)
+		if err != nil {
+			return fmt.Errorf("error sealing hidden test results: %v", err)
+		}
+		commit.Transcript = transcript
+	}
+
 	// compute the score for this step on a scale of 0.0 to 1.0
-	if commit.ReportCard.Passed {
-		// award full credit for this step
-		commit.Score = 1.0
-	} else if len(commit.ReportCard.Results) == 0 {
-		// no results? fail...
-		commit.Score = 0.0
-	} else {
-		// compute partial credit for this step
-		passed := 0
-		for _, elt := range commit.ReportCard.Results {
-			if elt.Outcome == "passed" {
-				passed++
-			}
+	commit.Score = stepScore(commit.ReportCard)
+
+	// withhold the details the instructor does not want students to see
+	if feedback != FeedbackFull {
+		if err := withholdFeedback(commit, feedback); err != nil {
+			return fmt.Errorf("error sealing grading details: %v", err)
 		}
-		commit.Score = float64(passed) / float64(len(commit.ReportCard.Results))
 	}
 	commit.UpdatedAt = now
-	req.CommitBundle.CommitSignature = commit.ComputeSignature(Config.DaycareSecret, req.CommitBundle.ProblemSignature)
+	job.bundle.CommitSignature = commit.ComputeSignature(Config().DaycareSecret, job.bundle.ProblemSignature)
+	return nil
+}
 
-	res := &DaycareResponse{CommitBundle: req.CommitBundle}
-	if err := socket.WriteJSON(res); err != nil {
-		logAndTransmitErrorf("error writing final commit JSON: %v", err)
-		return
+// stepScore computes the score for a problem step on a scale of 0.0 to 1.0
+// from its report card.
+func stepScore(card *ReportCard) float64 {
+	if len(card.Parts) > 0 {
+		// combine the weighted parts
+		return card.ComputeScore()
+	}
+	passed, total := card.Counts()
+	if card.Passed {
+		// award full credit for this step
+		return card.Deduct(1.0)
+	} else if total == 0 {
+		// no results? fail...
+		return 0.0
 	}
+
+	// compute partial credit for this step
+	return card.Deduct(float64(passed) / float64(total))
 }
 
 type Nanny struct {
-	Start      time.Time
-	Container  *docker.Container
-	ReportCard *ReportCard
-	Input      chan string
-	Events     chan *EventMessage
-	Transcript []*EventMessage
+	Start       time.Time
+	ProblemType *ProblemType
+	Container   *docker.Container
+	Services    *Services
+	ReportCard  *ReportCard
+	Input       chan string
+	Events      chan *EventMessage
+	Transcript  []*EventMessage
+
+	// resource tracking for the usage report
+	MemoryLimit int64
+	CPULimit    time.Duration
+	OutputBytes int64
+	Killed      string
+	SigKilled   bool
 }
 
 type nannyHandler func(*Nanny, []string, []string, map[string]string)
@@ -235,13 +535,26 @@ func getContainerID(msg string) string {
 	return groups[1]
 }
 
-func NewNanny(problemType *ProblemType, problem *Problem, name string) (*Nanny, error) {
+// limitContainer applies the problem type's resource limits to a container
+// config: memory with no swap, one CPU, and MaxThreads processes. The
+// grader container and each of its sidecar services get the same limits,
+// so student code cannot use a service to get around them.
+func limitContainer(problemType *ProblemType, config *docker.Config, hostConfig *docker.HostConfig) {
+	config.Memory = int64(problemType.MaxMemory) * 1024 * 1024
+	config.MemorySwap = -1
+	hostConfig.CPUPeriod = 100000
+	hostConfig.CPUQuota = 100000
+	if problemType.MaxThreads > 0 {
+		hostConfig.PidsLimit = int64(problemType.MaxThreads)
+	}
+}
+
+func NewNanny(problemType *ProblemType, problem *Problem, name string, env []string) (*Nanny, error) {
 	// create a container
 	mem := problemType.MaxMemory * 1024 * 1024
 	config := &docker.Config{
 		Hostname:        name,
-		Memory:          int64(mem),
-		MemorySwap:      -1,
+		Env:             env,
 		NetworkDisabled: true,
 		Cmd:             []string{"/bin/sh", "-c", "sleep infinity"},
 		Image:           problemType.Image,
@@ -266,28 +579,32 @@ func NewNanny(problemType *ProblemType, problem *Problem, name string) (*Nanny,
 		},
 		Ulimits: []docker.ULimit{},
 	}
+	limitContainer(problemType, config, hostConfig)
 
-	container, err := dockerClient.CreateContainer(docker.CreateContainerOptions{Name: name, Config: config, HostConfig: hostConfig})
+	policy, err := problemType.NetworkPolicyFor(problem.Options)
 	if err != nil {
-		if apiError, ok := err.(*docker.Error); ok && apiError.Status == http.StatusConflict && getContainerID(apiError.Message) != "" {
-			// container already exists with that name--try killing it
-			err2 := dockerClient.RemoveContainer(docker.RemoveContainerOptions{
-				ID:    getContainerID(apiError.Message),
-				Force: true,
-			})
-			if err2 != nil {
-				log.Printf("NewNanny->StartContainer error killing existing container: %v", err2)
-				return nil, err2
-			}
+		return nil, err
+	}
 
-			// try it one more time
-			container, err = dockerClient.CreateContainer(docker.CreateContainerOptions{Name: name, Config: config, HostConfig: hostConfig})
-		}
-		if err != nil {
-			log.Printf("NewNanny->CreateContainer: %#v", err)
+	// start any sidecar services the policy permits and set up the network
+	var services *Services
+	if policy.Mode != NetworkNone {
+		if services, err = StartServices(problemType, name); err != nil {
+			log.Printf("NewNanny->StartServices: %v", err)
 			return nil, err
 		}
 	}
+	targets, err := configureNetwork(policy, config, hostConfig, services)
+	if err != nil {
+		services.Shutdown()
+		return nil, err
+	}
+
+	container, err := createContainer(docker.CreateContainerOptions{Name: name, Config: config, HostConfig: hostConfig})
+	if err != nil {
+		services.Shutdown()
+		return nil, err
+	}
 
 	// start it
 	err = dockerClient.StartContainer(container.ID, nil)
@@ -300,19 +617,81 @@ func NewNanny(problemType *ProblemType, problem *Problem, name string) (*Nanny,
 		if err2 != nil {
 			log.Printf("NewNanny->StartContainer error killing container: %v", err2)
 		}
+		services.Shutdown()
+		return nil, err
+	}
+
+	// enforce the network policy before anything runs in the container
+	if err := connectServices(policy, container, services); err == nil {
+		err = applyFirewall(policy, targets, name, container, services)
+	}
+	if err != nil {
+		log.Printf("NewNanny->applyFirewall: %v", err)
+		err2 := dockerClient.RemoveContainer(docker.RemoveContainerOptions{
+			ID:    container.ID,
+			Force: true,
+		})
+		if err2 != nil {
+			log.Printf("NewNanny->applyFirewall error killing container: %v", err2)
+		}
+		services.Shutdown()
 		return nil, err
 	}
 
 	return &Nanny{
-		Start:      time.Now(),
-		Container:  container,
-		ReportCard: NewReportCard(),
-		Input:      make(chan string),
-		Events:     make(chan *EventMessage),
-		Transcript: []*EventMessage{},
+		Start:       time.Now(),
+		ProblemType: problemType,
+		Container:   container,
+		Services:    services,
+		ReportCard:  NewReportCard(),
+		Input:       make(chan string),
+		Events:      make(chan *EventMessage),
+		Transcript:  []*EventMessage{},
+
+		MemoryLimit: int64(mem),
+		CPULimit:    time.Duration(problemType.MaxCPU) * time.Second,
 	}, nil
 }
 
+// Usage measures the resources the container has used so far. It must be
+// called before the nanny is shut down.
+func (n *Nanny) Usage() *ResourceUsage {
+	usage := &ResourceUsage{
+		WallTime:    time.Since(n.Start),
+		MemoryLimit: n.MemoryLimit,
+		CPULimit:    n.CPULimit,
+		OutputBytes: n.OutputBytes,
+		Killed:      n.Killed,
+	}
+
+	// take a single sample of the container's statistics
+	stats := make(chan *docker.Stats, 1)
+	done := make(chan bool)
+	go func() {
+		err := dockerClient.Stats(docker.StatsOptions{
+			ID:      n.Container.ID,
+			Stats:   stats,
+			Stream:  false,
+			Done:    done,
+			Timeout: 10 * time.Second,
+		})
+		if err != nil {
+			log.Printf("Nanny.Usage->docker.Stats: %v", err)
+		}
+	}()
+	sample, ok := <-stats
+	close(done)
+	if ok && sample != nil {
+		usage.CPUTime = time.Duration(sample.CPUStats.CPUUsage.TotalUsage)
+		usage.MaxMemory = int64(sample.MemoryStats.MaxUsage)
+		if n.SigKilled && sample.MemoryStats.Failcnt > 0 && usage.Killed == "" {
+			// the kernel killed a process when the memory limit was reached
+			usage.Killed = "memory"
+		}
+	}
+	return usage
+}
+
 func (n *Nanny) Shutdown() error {
 	// shut down the container
 	err := dockerClient.RemoveContainer(docker.RemoveContainerOptions{
@@ -321,9 +700,13 @@ func (n *Nanny) Shutdown() error {
 	})
 	if err != nil {
 		log.Printf("Nanny.Shutdown: %v", err)
-		return err
 	}
-	return nil
+
+	// shut down any sidecar services
+	if err2 := n.Services.Shutdown(); err == nil {
+		err = err2
+	}
+	return err
 }
 
 // PutFiles copies a set of files to the given container.
@@ -570,6 +953,15 @@ func (n *Nanny) ExecNonInteractive(cmd []string) (stdout, stderr, script *bytes.
 		log.Printf("Nanny.ExecNonInteractive->docker.InspectExec: %v", err)
 		return nil, nil, nil, -1, err
 	}
+	n.OutputBytes += int64(out.stdout.Len() + out.stderr.Len())
+	switch inspect.ExitCode {
+	case 128 + 9:
+		// SIGKILL, possibly from the kernel at the memory limit
+		n.SigKilled = true
+	case 128 + 24:
+		// SIGXCPU
+		n.Killed = "cpu"
+	}
 	if inspect.Running {
 		log.Printf("Nanny.ExecNonInteractive: process still running")
 	} else {
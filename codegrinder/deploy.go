@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// EnvPrefix starts the names of environment variables that override config
+// file settings, e.g., CODEGRINDER_POSTGRES_HOST for PostgresHost.
+const EnvPrefix = "CODEGRINDER_"
+
+// envName converts a config field name to its environment variable name.
+func envName(field string) string {
+	runes := []rune(field)
+	var b strings.Builder
+	b.WriteString(EnvPrefix)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// envConfigured reports whether any config settings are given in the
+// environment, in which case the config file is optional.
+func envConfigured() bool {
+	for _, elt := range os.Environ() {
+		if strings.HasPrefix(elt, EnvPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyEnvConfig overrides config settings from environment variables.
+// Lists are comma-separated.
+func applyEnvConfig(config *ServerConfig) error {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := envName(t.Field(i).Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("error parsing %s: %v", name, err)
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("error parsing %s: %v", name, err)
+			}
+			field.SetBool(b)
+		case reflect.Slice:
+			list := []string{}
+			for _, elt := range strings.Split(value, ",") {
+				if elt = strings.TrimSpace(elt); elt != "" {
+					list = append(list, elt)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		default:
+			return fmt.Errorf("%s cannot be set from the environment", name)
+		}
+	}
+	return nil
+}
+
+// readinessChecks are run by /readyz. Each role adds checks for the
+// services it depends on.
+var readinessChecks = struct {
+	sync.Mutex
+	checks map[string]func() error
+}{checks: make(map[string]func() error)}
+
+func addReadinessCheck(name string, check func() error) {
+	readinessChecks.Lock()
+	defer readinessChecks.Unlock()
+	readinessChecks.checks[name] = check
+}
+
+// serveHealth answers /healthz and /readyz requests, returning false for
+// any other path. These are served on the plain http port as well as https
+// so that container health probes do not need a certificate.
+//
+// /healthz reports that the process is up and serving requests.
+// /readyz also checks that the database and docker are reachable for the
+// roles this server runs.
+func serveHealth(w http.ResponseWriter, r *http.Request) bool {
+	switch r.URL.Path {
+	case "/healthz":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+		return true
+	case "/readyz":
+		readinessChecks.Lock()
+		names := []string{}
+		for name := range readinessChecks.checks {
+			names = append(names, name)
+		}
+		checks := readinessChecks.checks
+		readinessChecks.Unlock()
+		sort.Strings(names)
+
+		status := http.StatusOK
+		var report []string
+		for _, name := range names {
+			if err := checks[name](); err != nil {
+				status = http.StatusServiceUnavailable
+				report = append(report, fmt.Sprintf("%s: %v", name, err))
+			} else {
+				report = append(report, name+": ok")
+			}
+		}
+		if status != http.StatusOK {
+			log.Printf("readiness check failed: %s", strings.Join(report, ", "))
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintln(w, strings.Join(report, "\n"))
+		return true
+	}
+	return false
+}
+
+// healthMiddleware serves health checks ahead of logging and sessions,
+// since probes arrive every few seconds.
+func healthMiddleware(w http.ResponseWriter, r *http.Request) {
+	serveHealth(w, r)
+}
+
+// runHealthcheck handles the healthcheck subcommand, used as the container
+// health check. It asks the local server's http port for /readyz.
+func runHealthcheck() int {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://127.0.0.1/readyz")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "health check failed: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "health check failed: %s\n", resp.Status)
+		return 1
+	}
+	return 0
+}
+
+// runManifest handles the manifest subcommand, printing an example
+// deployment for docker-compose or Kubernetes based on the current config.
+// Secrets are never printed; they are referenced from the environment or a
+// Kubernetes secret instead.
+func runManifest(args []string) int {
+	kind := "compose"
+	if len(args) > 0 {
+		kind = args[0]
+	}
+	hostname := Config().Hostname
+	if hostname == "" {
+		hostname = "codegrinder.example.edu"
+	}
+	email := Config().LetsEncryptEmail
+	if email == "" {
+		email = "admin@example.edu"
+	}
+	switch kind {
+	case "compose":
+		fmt.Printf(composeManifest, hostname, email)
+	case "k8s", "kubernetes":
+		fmt.Printf(kubernetesManifest, hostname, email)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown manifest type %q: expected compose or k8s\n", kind)
+		return 2
+	}
+	return 0
+}
+
+const composeManifest = `# docker-compose.yml for CodeGrinder
+# Generated by: codegrinder manifest compose
+# Set CODEGRINDER_LTI_SECRET, CODEGRINDER_SESSION_SECRET, CODEGRINDER_DAYCARE_SECRET,
+# and POSTGRES_PASSWORD in the environment or an .env file before starting.
+# Run "codegrinder migrate" to create or update the schema before starting the server.
+
+services:
+  postgres:
+    image: postgres:13
+    restart: always
+    environment:
+      POSTGRES_USER: codegrinder
+      POSTGRES_DB: codegrinder
+      POSTGRES_PASSWORD: ${POSTGRES_PASSWORD}
+    volumes:
+      - pgdata:/var/lib/postgresql/data
+
+  ta:
+    image: codegrinder/server
+    restart: always
+    depends_on:
+      - postgres
+    ports:
+      - "80:80"
+      - "443:443"
+    environment:
+      CODEGRINDER_HOSTNAME: %[1]s
+      CODEGRINDER_LETS_ENCRYPT_EMAIL: %[2]s
+      CODEGRINDER_LETS_ENCRYPT_CACHE: /var/lib/codegrinder/letsencrypt.cache
+      CODEGRINDER_POSTGRES_HOST: postgres
+      CODEGRINDER_POSTGRES_PORT: "5432"
+      CODEGRINDER_POSTGRES_USERNAME: codegrinder
+      CODEGRINDER_POSTGRES_PASSWORD: ${POSTGRES_PASSWORD}
+      CODEGRINDER_POSTGRES_DATABASE: codegrinder
+      CODEGRINDER_LTI_SECRET: ${CODEGRINDER_LTI_SECRET}
+      CODEGRINDER_SESSION_SECRET: ${CODEGRINDER_SESSION_SECRET}
+      CODEGRINDER_DAYCARE_SECRET: ${CODEGRINDER_DAYCARE_SECRET}
+      CODEGRINDER_DAYCARE_HOSTS: %[1]s
+    volumes:
+      - letsencrypt:/var/lib/codegrinder
+      # the daycare role in this container starts grading containers on the host
+      - /var/run/docker.sock:/var/run/docker.sock
+    command: ["codegrinder", "-ta", "-daycare"]
+
+volumes:
+  pgdata:
+  letsencrypt:
+`
+
+const kubernetesManifest = `# Kubernetes manifest for CodeGrinder
+# Generated by: codegrinder manifest k8s
+# Create the secret first, e.g.:
+#   kubectl create secret generic codegrinder \
+#     --from-literal=lti-secret=... --from-literal=session-secret=... \
+#     --from-literal=daycare-secret=... --from-literal=postgres-password=...
+# This assumes a PostgreSQL service named "postgres" brought up to date with "codegrinder migrate".
+# Daycare pods need access to the node's docker socket to run grading containers.
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: codegrinder-ta
+spec:
+  replicas: 1
+  selector:
+    matchLabels: {app: codegrinder-ta}
+  template:
+    metadata:
+      labels: {app: codegrinder-ta}
+    spec:
+      containers:
+        - name: ta
+          image: codegrinder/server
+          args: ["codegrinder", "-ta", "-daycare=false"]
+          ports:
+            - {name: http, containerPort: 80}
+            - {name: https, containerPort: 443}
+          env:
+            - {name: CODEGRINDER_HOSTNAME, value: "%[1]s"}
+            - {name: CODEGRINDER_LETS_ENCRYPT_EMAIL, value: "%[2]s"}
+            - {name: CODEGRINDER_LETS_ENCRYPT_CACHE, value: /var/lib/codegrinder/letsencrypt.cache}
+            - {name: CODEGRINDER_POSTGRES_HOST, value: postgres}
+            - {name: CODEGRINDER_POSTGRES_PORT, value: "5432"}
+            - {name: CODEGRINDER_POSTGRES_USERNAME, value: codegrinder}
+            - {name: CODEGRINDER_POSTGRES_DATABASE, value: codegrinder}
+            - {name: CODEGRINDER_DAYCARE_HOSTS, value: "%[1]s"}
+            - {name: CODEGRINDER_POSTGRES_PASSWORD, valueFrom: {secretKeyRef: {name: codegrinder, key: postgres-password}}}
+            - {name: CODEGRINDER_LTI_SECRET, valueFrom: {secretKeyRef: {name: codegrinder, key: lti-secret}}}
+            - {name: CODEGRINDER_SESSION_SECRET, valueFrom: {secretKeyRef: {name: codegrinder, key: session-secret}}}
+            - {name: CODEGRINDER_DAYCARE_SECRET, valueFrom: {secretKeyRef: {name: codegrinder, key: daycare-secret}}}
+          livenessProbe:
+            httpGet: {path: /healthz, port: http}
+          readinessProbe:
+            httpGet: {path: /readyz, port: http}
+          volumeMounts:
+            - {name: letsencrypt, mountPath: /var/lib/codegrinder}
+      volumes:
+        - name: letsencrypt
+          emptyDir: {}
+---
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: codegrinder-daycare
+spec:
+  selector:
+    matchLabels: {app: codegrinder-daycare}
+  template:
+    metadata:
+      labels: {app: codegrinder-daycare}
+    spec:
+      containers:
+        - name: daycare
+          image: codegrinder/daycare
+          args: ["codegrinder", "-ta=false", "-daycare"]
+          ports:
+            - {name: http, containerPort: 80}
+            - {name: https, containerPort: 443}
+          env:
+            - {name: CODEGRINDER_HOSTNAME, value: "%[1]s"}
+            - {name: CODEGRINDER_LETS_ENCRYPT_EMAIL, value: "%[2]s"}
+            - {name: CODEGRINDER_LETS_ENCRYPT_CACHE, value: /var/lib/codegrinder/letsencrypt.cache}
+            - {name: CODEGRINDER_DAYCARE_SECRET, valueFrom: {secretKeyRef: {name: codegrinder, key: daycare-secret}}}
+          livenessProbe:
+            httpGet: {path: /healthz, port: http}
+          readinessProbe:
+            httpGet: {path: /readyz, port: http}
+          volumeMounts:
+            - {name: docker, mountPath: /var/run/docker.sock}
+      volumes:
+        - name: docker
+          hostPath: {path: /var/run/docker.sock}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: codegrinder
+spec:
+  type: LoadBalancer
+  selector: {app: codegrinder-ta}
+  ports:
+    - {name: http, port: 80, targetPort: http}
+    - {name: https, port: 443, targetPort: https}
+`
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Effort is measured from the commits and grading runs already recorded:
+// graded submissions are counted from action_runs, and time on a step runs
+// from when its commit was first saved to when it was last updated. The
+// time is elapsed time, not time spent working, so it overstates the effort
+// of a student who comes back to a step after a break.
+
+// GetAssignmentEffort handles a request to /v2/assignments/:assignment_id/effort,
+// returning the graded submissions and time spent on each step of an
+// assignment and the hours of the day the student submitted work. Students
+// can see their own assignments; TAs and instructors can see any
+// assignment in their courses.
+func GetAssignmentEffort(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if assignment.UserID != currentUser.ID {
+		if ok, err := isCourseStaff(tx, currentUser, assignment.CourseID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		} else if !ok {
+			loggedHTTPErrorf(w, http.StatusNotFound, "not found")
+			return
+		}
+	}
+	student := new(User)
+	if err := meddler.Load(tx, "users", student, assignment.UserID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	effort := &AssignmentEffort{AssignmentID: assignment.ID, UserID: student.ID, Timezone: student.Timezone, Steps: []*StepEffort{}}
+	if _, err := LoadTimezone(effort.Timezone); err != nil || effort.Timezone == "" {
+		effort.Timezone = "UTC"
+	}
+
+	rows, err := tx.Query(`SELECT commits.problem_id, problems.unique_id, commits.step, commits.created_at, commits.updated_at, `+
+		`(SELECT COUNT(*) FROM action_runs WHERE action_runs.course_id = $2 AND action_runs.user_id = $3 AND action_runs.action = 'grade' `+
+		`AND action_runs.problem_id = commits.problem_id AND action_runs.step = commits.step) `+
+		`FROM commits JOIN problems ON commits.problem_id = problems.id `+
+		`WHERE commits.assignment_id = $1 ORDER BY problems.unique_id, commits.step`,
+		assignment.ID, assignment.CourseID, assignment.UserID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		elt := new(StepEffort)
+		if err := rows.Scan(&elt.ProblemID, &elt.Unique, &elt.Step, &elt.FirstCommitAt, &elt.LastCommitAt, &elt.Attempts); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		elt.Minutes = int(elt.LastCommitAt.Sub(elt.FirstCommitAt) / time.Minute)
+		effort.Attempts += elt.Attempts
+		effort.Minutes += elt.Minutes
+		effort.Steps = append(effort.Steps, elt)
+	}
+	if err := rows.Err(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	rows.Close()
+
+	if err := countEffortHours(tx, &effort.Hours, effort.Timezone, assignment.CourseID, assignment.ProblemSetID, assignment.UserID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, effort)
+}
+
+// countEffortHours counts graded submissions in a course by the hour of the
+// day. A problem set ID or user ID of zero counts every problem set or
+// every student. Instructor work is not counted.
+func countEffortHours(tx *sql.Tx, hours *[24]int, timezone string, courseID, problemSetID, userID int64) error {
+	rows, err := tx.Query(`SELECT EXTRACT(HOUR FROM action_runs.created_at AT TIME ZONE $1)::int, COUNT(*) `+
+		`FROM action_runs WHERE action_runs.course_id = $2 AND action_runs.action = 'grade' `+
+		`AND ($3 = 0 OR action_runs.problem_id IN (SELECT problem_id FROM problem_set_problems WHERE problem_set_id = $3)) `+
+		`AND ($4 = 0 OR action_runs.user_id = $4) `+
+		`AND NOT EXISTS (SELECT 1 FROM assignments WHERE assignments.user_id = action_runs.user_id `+
+		`AND assignments.course_id = action_runs.course_id AND assignments.instructor) `+
+		`GROUP BY 1`, timezone, courseID, problemSetID, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hour, count int
+		if err := rows.Scan(&hour, &count); err != nil {
+			return err
+		}
+		hours[hour] = count
+	}
+	return rows.Err()
+}
+
+// GetCourseEffort handles a request to /v2/courses/:course_id/effort,
+// summarizing the graded submissions and time spent on each step by the
+// students in a course, and the hours of the day they submitted work. No
+// student is identified, and steps with too few students to hide any one
+// of them are left out. Instructor work is not counted. Parameters:
+//
+//	problem_set: the ID of a problem set to summarize only its problems
+//	tz:          the time zone for the hours of the day (default UTC)
+func GetCourseEffort(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	effort := &CourseEffort{CourseID: courseID, Timezone: "UTC", Steps: []*StepEffortSummary{}}
+	if s := r.FormValue("problem_set"); s != "" {
+		if effort.ProblemSetID, err = parseID(w, "problem_set", s); err != nil {
+			return
+		}
+	}
+	if tz := r.FormValue("tz"); tz != "" {
+		if _, err := LoadTimezone(tz); err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		effort.Timezone = tz
+	}
+
+	where, args := "", []interface{}{}
+	where, args = addWhereEq(where, args, "assignments.course_id", courseID)
+	if effort.ProblemSetID != 0 {
+		where, args = addWhereEq(where, args, "assignments.problem_set_id", effort.ProblemSetID)
+	}
+	rows, err := tx.Query(`SELECT commits.problem_id, problems.unique_id, commits.step, assignments.user_id, `+
+		`EXTRACT(EPOCH FROM commits.updated_at - commits.created_at)::bigint / 60, `+
+		`(SELECT COUNT(*) FROM action_runs WHERE action_runs.course_id = assignments.course_id AND action_runs.user_id = assignments.user_id `+
+		`AND action_runs.action = 'grade' AND action_runs.problem_id = commits.problem_id AND action_runs.step = commits.step) `+
+		`FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+		`JOIN problems ON commits.problem_id = problems.id`+
+		where+` AND NOT assignments.instructor ORDER BY problems.unique_id, commits.step`, args...)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	defer rows.Close()
+	type stepData struct {
+		summary  *StepEffortSummary
+		attempts []int
+		minutes  []int
+	}
+	var steps []*stepData
+	index := make(map[string]*stepData)
+	students := make(map[int64]bool)
+	for rows.Next() {
+		var problemID, step, userID int64
+		var unique string
+		var minutes, attempts int
+		if err := rows.Scan(&problemID, &unique, &step, &userID, &minutes, &attempts); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		key := fmt.Sprintf("%d/%d", problemID, step)
+		data := index[key]
+		if data == nil {
+			data = &stepData{summary: &StepEffortSummary{ProblemID: problemID, Unique: unique, Step: step}}
+			index[key] = data
+			steps = append(steps, data)
+		}
+		data.attempts = append(data.attempts, attempts)
+		data.minutes = append(data.minutes, minutes)
+		students[userID] = true
+	}
+	if err := rows.Err(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	rows.Close()
+
+	effort.Students = len(students)
+	if effort.Students < MinEffortStudents {
+		// too few students to report anything without identifying them
+		render.JSON(http.StatusOK, effort)
+		return
+	}
+	for _, data := range steps {
+		if len(data.attempts) < MinEffortStudents {
+			continue
+		}
+		data.summary.Students = len(data.attempts)
+		data.summary.Attempts = summarizeInts(data.attempts)
+		data.summary.Minutes = summarizeInts(data.minutes)
+		effort.Steps = append(effort.Steps, data.summary)
+	}
+	if err := countEffortHours(tx, &effort.Hours, effort.Timezone, courseID, effort.ProblemSetID, 0); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, effort)
+}
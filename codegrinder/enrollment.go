@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Each course keeps a list of the users enrolled in it, with the roles the
+// LMS gives them there. A launch from the LMS records the user who made it,
+// and an instructor can sync the whole roster from the LMS membership
+// service so students who have not launched anything yet are known too.
+// Members who are no longer on the roster are kept but marked inactive.
+//
+// The roster can only be synced for a course that has been launched at
+// least once, since the launch gives the membership service URL and the
+// consumer key used to sign the request.
+
+// RosterSyncTimeout is how long a roster sync waits for each page from the LMS.
+const RosterSyncTimeout = 30 * time.Second
+
+// MaxRosterPages limits how many pages a roster sync will follow.
+const MaxRosterPages = 100
+
+// membershipContainer is the JSON format of a page of a course roster from
+// the LMS membership service.
+type membershipContainer struct {
+	NextPage string `json:"nextPage"`
+	PageOf   struct {
+		MembershipSubject struct {
+			Membership []struct {
+				Status string   `json:"status"`
+				Role   []string `json:"role"`
+				Member struct {
+					UserID string `json:"userId"`
+					Name   string `json:"name"`
+					Email  string `json:"email"`
+				} `json:"member"`
+			} `json:"membership"`
+		} `json:"membershipSubject"`
+	} `json:"pageOf"`
+}
+
+// isInstructorRoles reports whether a list of LTI roles includes the
+// instructor role, in either its short or its full form.
+func isInstructorRoles(roles []string) bool {
+	for _, role := range roles {
+		role = strings.TrimSpace(role)
+		if role == "Instructor" || strings.HasSuffix(role, "/Instructor") || strings.HasSuffix(role, "#Instructor") {
+			return true
+		}
+	}
+	return false
+}
+
+// get/create/update the enrollment of this user in this course
+func getUpdateEnrollment(tx *sql.Tx, form *LTIRequest, now time.Time, course *Course, user *User) error {
+	instructor := isInstructorRoles(strings.Split(form.Roles, ","))
+	_, err := tx.Exec(`INSERT INTO enrollments (course_id, user_id, roles, instructor, section, status, source, created_at, updated_at) `+
+		`VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8) `+
+		`ON CONFLICT (course_id, user_id) DO UPDATE SET roles = EXCLUDED.roles, instructor = EXCLUDED.instructor, `+
+		`section = COALESCE(EXCLUDED.section, enrollments.section), status = EXCLUDED.status, source = EXCLUDED.source, updated_at = EXCLUDED.updated_at`,
+		course.ID, user.ID, form.Roles, instructor, sql.NullString{String: form.CourseSectionSourcedID, Valid: form.CourseSectionSourcedID != ""},
+		EnrollmentActive, EnrollmentLaunch, now)
+	if err != nil {
+		log.Printf("db error saving enrollment for course %d, user %d: %v", course.ID, user.ID, err)
+	}
+	return err
+}
+
+// signGetRequest returns the OAuth Authorization header for a GET request
+// to the LMS. Query parameters are part of the signature but not the header.
+func signGetRequest(consumerKey, targetURL, secret string) (string, error) {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{}
+	v.Set("oauth_consumer_key", consumerKey)
+	v.Set("oauth_signature_method", "HMAC-SHA1")
+	v.Set("oauth_timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	v.Set("oauth_version", "1.0")
+	v.Set("oauth_nonce", strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	all := u.Query()
+	for key, val := range v {
+		all[key] = val
+	}
+	v.Set("oauth_signature", computeOAuthSignature("GET", targetURL, all, secret))
+
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf(`OAuth realm="%s"`, escape("https://"+Config().Hostname)))
+	for key, val := range v {
+		buf.WriteString(fmt.Sprintf(`,%s="%s"`, key, escape(val[0])))
+	}
+	return buf.String(), nil
+}
+
+// fetchRoster gets every page of a course roster from the LMS.
+func fetchRoster(course *Course) (map[string]*Enrollment, map[string]bool, error) {
+	client := &http.Client{Timeout: RosterSyncTimeout}
+	members := make(map[string]*Enrollment)
+	instructors := make(map[string]bool)
+	next := course.MembershipsURL
+	for page := 0; next != ""; page++ {
+		if page >= MaxRosterPages {
+			return nil, nil, fmt.Errorf("roster has more than %d pages", MaxRosterPages)
+		}
+		auth, err := signGetRequest(course.ConsumerKey, next, Config().LTISecret)
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err := http.NewRequest("GET", next, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Authorization", auth)
+		req.Header.Set("Accept", "application/vnd.ims.lis.v2.membershipcontainer+json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		container := new(membershipContainer)
+		err = json.NewDecoder(resp.Body).Decode(container)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, fmt.Errorf("status %s from the LMS membership service", resp.Status)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding the roster: %v", err)
+		}
+		for _, elt := range container.PageOf.MembershipSubject.Membership {
+			if elt.Member.UserID == "" {
+				continue
+			}
+			status := EnrollmentActive
+			if elt.Status != "" && !strings.HasSuffix(elt.Status, "Active") {
+				status = EnrollmentInactive
+			}
+			members[elt.Member.UserID] = &Enrollment{
+				Roles:  strings.Join(elt.Role, ","),
+				Status: status,
+				Name:   elt.Member.Name,
+				Email:  elt.Member.Email,
+			}
+			instructors[elt.Member.UserID] = isInstructorRoles(elt.Role)
+		}
+		next = container.NextPage
+	}
+	return members, instructors, nil
+}
+
+// GetCourseEnrollments handles a request to /v2/courses/:course_id/enrollments,
+// returning the users enrolled in a course. Parameters:
+//
+//	status: active or inactive to list only those enrollments
+func GetCourseEnrollments(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	where, args := "", []interface{}{}
+	where, args = addWhereEq(where, args, "enrollments.course_id", courseID)
+	if status := r.FormValue("status"); status != "" {
+		if status != EnrollmentActive && status != EnrollmentInactive {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "status must be %s or %s", EnrollmentActive, EnrollmentInactive)
+			return
+		}
+		where, args = addWhereEq(where, args, "enrollments.status", status)
+	}
+	enrollments := []*Enrollment{}
+	rows, err := tx.Query(`SELECT enrollments.user_id, enrollments.roles, enrollments.instructor, COALESCE(enrollments.section, ''), `+
+		`enrollments.status, enrollments.source, enrollments.created_at, enrollments.updated_at, users.name, users.email `+
+		`FROM enrollments JOIN users ON enrollments.user_id = users.id`+where+` ORDER BY users.name, users.id`, args...)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		elt := &Enrollment{CourseID: courseID}
+		if err := rows.Scan(&elt.UserID, &elt.Roles, &elt.Instructor, &elt.Section,
+			&elt.Status, &elt.Source, &elt.CreatedAt, &elt.UpdatedAt, &elt.Name, &elt.Email); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		enrollments = append(enrollments, elt)
+	}
+	if err := rows.Err(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, enrollments)
+}
+
+// PostCourseRosterSync handles a request to /v2/courses/:course_id/roster_sync,
+// bringing the enrollments of a course up to date with the roster in the LMS.
+// Members the site has never seen are counted but not added, since a user
+// record needs the details that come with a launch.
+func PostCourseRosterSync(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *AuditEntry, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if course.MembershipsURL == "" || course.ConsumerKey == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "the LMS has not given a roster URL for course %d (%s); launch an assignment from the course first", course.ID, course.Name)
+		return
+	}
+	members, instructors, err := fetchRoster(course)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadGateway, "syncing the roster for course %d (%s): %v", course.ID, course.Name, err)
+		return
+	}
+	if len(members) == 0 {
+		loggedHTTPErrorf(w, http.StatusBadGateway, "the LMS returned an empty roster for course %d (%s)", course.ID, course.Name)
+		return
+	}
+
+	now := time.Now()
+	result := &RosterSync{Members: len(members)}
+	seen := []int64{}
+	for ltiID, member := range members {
+		var userID int64
+		if err := tx.QueryRow(`SELECT id FROM users WHERE lti_id = $1`, ltiID).Scan(&userID); err == sql.ErrNoRows {
+			result.Unknown++
+			continue
+		} else if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		seen = append(seen, userID)
+		var inserted bool
+		err := tx.QueryRow(`INSERT INTO enrollments (course_id, user_id, roles, instructor, status, source, created_at, updated_at) `+
+			`VALUES ($1, $2, $3, $4, $5, $6, $7, $7) `+
+			`ON CONFLICT (course_id, user_id) DO UPDATE SET roles = EXCLUDED.roles, instructor = EXCLUDED.instructor, `+
+			`status = EXCLUDED.status, source = EXCLUDED.source, updated_at = EXCLUDED.updated_at `+
+			`RETURNING (xmax = 0)`,
+			course.ID, userID, member.Roles, instructors[ltiID], member.Status, EnrollmentRoster, now).Scan(&inserted)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if inserted {
+			result.Enrolled++
+		} else {
+			result.Updated++
+		}
+	}
+
+	// anyone no longer on the roster has dropped the course
+	list := make([]string, len(seen))
+	for i, id := range seen {
+		list[i] = strconv.FormatInt(id, 10)
+	}
+	res, err := tx.Exec(`UPDATE enrollments SET status = $1, source = $2, updated_at = $3 `+
+		`WHERE course_id = $4 AND status = $5 AND NOT (user_id = ANY($6::bigint[]))`,
+		EnrollmentInactive, EnrollmentRoster, now, course.ID, EnrollmentActive, "{"+strings.Join(list, ",")+"}")
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	dropped, _ := res.RowsAffected()
+	result.Dropped = int(dropped)
+
+	audit.Record(AuditRequest, course.ID, "course %d (%s) roster synced: %d members, %d enrolled, %d updated, %d dropped, %d unknown",
+		course.ID, course.Name, result.Members, result.Enrolled, result.Updated, result.Dropped, result.Unknown)
+	render.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// For exams in labs with no network, an instructor can download an exam
+// bundle of a problem set ahead of time with grind exam-bundle. The bundle
+// is encrypted with a key that is returned once and never stored, so it
+// is only useful to someone the instructor gives the key to. grind
+// exam-grade runs the tests in the bundle with a local Docker daemon and
+// writes a receipt for each run, and grind exam-upload sends the receipts
+// here once the network is back.
+//
+// A receipt is signed with a secret from inside the bundle, so anyone who
+// can open the bundle could forge one. Uploaded receipts are therefore
+// held until a TA or instructor reviews them, e.g., against what the
+// proctor saw in the lab; only then is an accepted receipt saved as a
+// graded commit that counts toward the student's score. Offline grading
+// only checks whether the tests pass, so the instructor should regrade the
+// assignment afterward to get the full report cards from a daycare.
+
+// MaxExamBundleDays is the longest an exam bundle can be good for.
+const MaxExamBundleDays = 14
+
+// examRunner is how to run the tests of a problem type without a daycare.
+// The command runs in the problem directory and exits with status zero if
+// every test passes.
+type examRunner struct {
+	command string
+}
+
+// examRunners lists the problem types that can be graded offline.
+var examRunners = map[string]*examRunner{
+	"python27unittest": {command: "python -m unittest discover -vbs tests"},
+	"javaunit": {command: fmt.Sprintf("find . -name '*.java' > /tmp/sources.txt && javac -encoding UTF-8 -d %s -cp %s @/tmp/sources.txt && "+
+		"java -Xmx384m -jar %s execute --class-path %s --scan-class-path --disable-banner --details=tree",
+		javaBuildDir, javaJUnitJar, javaJUnitJar, javaBuildDir)},
+	"rusttest": {command: fmt.Sprintf("cp -a /opt/rust-target %s && CARGO_TARGET_DIR=%s cargo test --offline --color never -- --test-threads=1",
+		rustTargetDir, rustTargetDir)},
+}
+
+// PostCourseProblemSetExamBundle handles a request to /v2/courses/:course_id/problem_sets/:problem_set_id/exam_bundles,
+// creating an exam bundle for grading the problem set offline. The
+// response holds the bundle and the key that opens it.
+func PostCourseProblemSetExamBundle(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, request ExamBundleRequest, audit *AuditEntry, render render.Render) {
+	now := time.Now()
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	problemSetID, err := parseID(w, "problem_set_id", params["problem_set_id"])
+	if err != nil {
+		return
+	}
+	expiresAt := request.ExpiresAt.Truncate(time.Second)
+	if !expiresAt.After(now) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "the bundle must expire in the future")
+		return
+	}
+	if expiresAt.Sub(now) > MaxExamBundleDays*24*time.Hour {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "the bundle cannot be good for more than %d days", MaxExamBundleDays)
+		return
+	}
+
+	bundle := &ExamBundle{CourseID: courseID, ProblemSet: new(ProblemSet), ExpiresAt: expiresAt}
+	if err := meddler.Load(tx, "problem_sets", bundle.ProblemSet, problemSetID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	problems := []*Problem{}
+	if err := meddler.QueryAll(tx, &problems, `SELECT problems.* FROM problems JOIN problem_set_problems ON problems.id = problem_set_problems.problem_id `+
+		`WHERE problem_set_problems.problem_set_id = $1 ORDER BY problems.unique_id`, problemSetID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	for _, problem := range problems {
+		problemType, ok := problemTypes[problem.ProblemType]
+		runner, canRun := examRunners[problem.ProblemType]
+		if !ok || !canRun {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "problem %s has type %s, which cannot be graded offline", problem.Unique, problem.ProblemType)
+			return
+		}
+		elt := &ExamProblem{Problem: problem, Image: problemType.Image, Runner: runner.command, Timeout: problemType.MaxClock}
+		if elt.Timeout < problemType.MaxCPU {
+			elt.Timeout = problemType.MaxCPU
+		}
+		if err := meddler.QueryAll(tx, &elt.Steps, `SELECT * FROM problem_steps WHERE problem_id = $1 ORDER BY step`, problem.ID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		for _, step := range elt.Steps {
+			step.Precheck = nil
+			patterns := hiddenPatterns(step.Files)
+			for name := range step.Files {
+				if name == HintsFile || isHiddenFile(patterns, name) || strings.HasPrefix(name, "_grader/") {
+					elt.Hidden = append(elt.Hidden, fmt.Sprintf("%d/%s", step.Step, name))
+				}
+			}
+		}
+		sort.Strings(elt.Hidden)
+		bundle.Problems = append(bundle.Problems, elt)
+	}
+	if len(bundle.Problems) == 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "problem set %s has no problems", bundle.ProblemSet.Unique)
+		return
+	}
+
+	bundle.ReceiptKey = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, bundle.ReceiptKey); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error generating receipt key: %v", err)
+		return
+	}
+	err = tx.QueryRow(`INSERT INTO exam_bundles (course_id, problem_set_id, created_by, receipt_key, expires_at, created_at) `+
+		`VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		courseID, problemSetID, currentUser.ID, bundle.ReceiptKey, bundle.ExpiresAt, now).Scan(&bundle.ID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	key, err := NewExamKey()
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error generating exam key: %v", err)
+		return
+	}
+	file, err := SealExamBundle(key, bundle)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error sealing exam bundle: %v", err)
+		return
+	}
+	audit.Record(AuditRequest, bundle.ID, "exam bundle %d of problem set %s for course %d, expires %s",
+		bundle.ID, bundle.ProblemSet.Unique, courseID, bundle.ExpiresAt.Format(time.RFC3339))
+	render.JSON(http.StatusOK, &ExamBundleResponse{File: file, Key: key})
+}
+
+// PostExamBundleReceipts handles a request to /v2/exam_bundles/:exam_bundle_id/receipts,
+// saving the results of offline grading runs. Each receipt that checks out
+// is kept for course staff to review; none of them count toward a score
+// until they are accepted. Receipts that were already uploaded are
+// skipped, so the same receipts can be uploaded again safely.
+func PostExamBundleReceipts(w http.ResponseWriter, tx *sql.Tx, params martini.Params, upload ExamUpload, audit *AuditEntry, render render.Render) {
+	now := time.Now()
+	bundleID, err := parseID(w, "exam_bundle_id", params["exam_bundle_id"])
+	if err != nil {
+		return
+	}
+	var courseID, problemSetID int64
+	var receiptKey []byte
+	var expiresAt time.Time
+	err = tx.QueryRow(`SELECT course_id, problem_set_id, receipt_key, expires_at FROM exam_bundles WHERE id = $1`, bundleID).
+		Scan(&courseID, &problemSetID, &receiptKey, &expiresAt)
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	result := &ExamUploadResult{Rejected: []string{}}
+	for _, receipt := range upload.Receipts {
+		reject := func(format string, args ...interface{}) {
+			result.Rejected = append(result.Rejected, fmt.Sprintf("%s %s step %d: ", receipt.Login, receipt.Unique, receipt.Step)+fmt.Sprintf(format, args...))
+		}
+		if receipt.BundleID != bundleID {
+			reject("the receipt is from bundle %d", receipt.BundleID)
+			continue
+		}
+		if !hmac.Equal([]byte(receipt.Signature), []byte(receipt.ComputeSignature(receiptKey))) {
+			reject("the signature does not match")
+			continue
+		}
+		if receipt.GradedAt.After(expiresAt) {
+			reject("graded after the bundle expired")
+			continue
+		}
+		var duplicate bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM exam_receipts WHERE signature = $1)`, receipt.Signature).Scan(&duplicate); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if duplicate {
+			result.Duplicate++
+			continue
+		}
+
+		// find the student's assignment and the problem step
+		var assignmentID int64
+		err := tx.QueryRow(`SELECT assignments.id FROM assignments JOIN users ON assignments.user_id = users.id `+
+			`WHERE users.canvas_login = $1 AND assignments.course_id = $2 AND assignments.problem_set_id = $3 `+
+			`ORDER BY assignments.id LIMIT 1`, receipt.Login, courseID, problemSetID).Scan(&assignmentID)
+		if err == sql.ErrNoRows {
+			reject("no assignment found; the student must open the assignment from the LMS first")
+			continue
+		} else if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		var problemID int64
+		err = tx.QueryRow(`SELECT problems.id FROM problems JOIN problem_set_problems ON problems.id = problem_set_problems.problem_id `+
+			`WHERE problem_set_problems.problem_set_id = $1 AND problems.unique_id = $2`, problemSetID, receipt.Unique).Scan(&problemID)
+		if err == sql.ErrNoRows {
+			reject("the problem is not part of this problem set")
+			continue
+		} else if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		var stepExists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM problem_steps WHERE problem_id = $1 AND step = $2)`, problemID, receipt.Step).Scan(&stepExists); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		} else if !stepExists {
+			reject("the problem has no such step")
+			continue
+		}
+
+		// keep it for review
+		gradedAt := receipt.GradedAt
+		uploaded := &UploadedExamReceipt{
+			BundleID:     bundleID,
+			AssignmentID: assignmentID,
+			ProblemID:    problemID,
+			Login:        receipt.Login,
+			Unique:       receipt.Unique,
+			Step:         receipt.Step,
+			Passed:       receipt.Passed,
+			Output:       receipt.Output,
+			Signature:    receipt.Signature,
+			Status:       ExamReceiptPending,
+			GradedAt:     &gradedAt,
+			CreatedAt:    now,
+		}
+		hashed := &Commit{Files: receipt.Files}
+		if err := storeCommitFiles(tx, now, hashed); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		uploaded.FileHashes = hashed.FileHashes
+		if err := meddler.Insert(tx, "exam_receipts", uploaded); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		result.Pending++
+	}
+
+	audit.Record(AuditRequest, bundleID, "exam bundle %d receipts: %d pending review, %d duplicate, %d rejected",
+		bundleID, result.Pending, result.Duplicate, len(result.Rejected))
+	render.JSON(http.StatusOK, result)
+}
+
+// GetExamBundleReceipts handles a request to /v2/exam_bundles/:exam_bundle_id/receipts,
+// listing the receipts uploaded from an exam bundle with their files, in
+// the order they were graded. Parameters:
+//
+//	status: pending, accepted, or rejected (default all)
+func GetExamBundleReceipts(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, render render.Render) {
+	bundleID, err := parseID(w, "exam_bundle_id", params["exam_bundle_id"])
+	if err != nil {
+		return
+	}
+	where, args := "", []interface{}{}
+	where, args = addWhereEq(where, args, "bundle_id", bundleID)
+	if status := r.FormValue("status"); status != "" {
+		if status != ExamReceiptPending && status != ExamReceiptAccepted && status != ExamReceiptRejected {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "status must be %s, %s, or %s", ExamReceiptPending, ExamReceiptAccepted, ExamReceiptRejected)
+			return
+		}
+		where, args = addWhereEq(where, args, "status", status)
+	}
+	receipts := []*UploadedExamReceipt{}
+	if err := meddler.QueryAll(tx, &receipts, `SELECT * FROM exam_receipts`+where+` ORDER BY graded_at, id`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := loadExamReceiptFiles(tx, receipts); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading files: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, receipts)
+}
+
+// loadExamReceiptFiles fills in the file contents of uploaded receipts.
+func loadExamReceiptFiles(tx *sql.Tx, receipts []*UploadedExamReceipt) error {
+	commits := make([]*Commit, len(receipts))
+	for i, receipt := range receipts {
+		commits[i] = &Commit{FileHashes: receipt.FileHashes}
+	}
+	if err := loadCommitFiles(tx, commits...); err != nil {
+		return err
+	}
+	for i, receipt := range receipts {
+		receipt.Files = commits[i].Files
+	}
+	return nil
+}
+
+// PostExamBundleReceiptsReview handles a request to /v2/exam_bundles/:exam_bundle_id/receipts/review,
+// accepting or rejecting pending receipts. An accepted receipt is saved as
+// the graded commit for its step, unless the student has since saved newer
+// work on that step, and the scores of the assignments involved are updated
+// and posted to the LMS. The response lists the receipts that were reviewed.
+func PostExamBundleReceiptsReview(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, review ExamReceiptReview, audit *AuditEntry, render render.Render) {
+	now := time.Now()
+	bundleID, err := parseID(w, "exam_bundle_id", params["exam_bundle_id"])
+	if err != nil {
+		return
+	}
+	decisions := make(map[int64]string)
+	for _, id := range review.Accept {
+		decisions[id] = ExamReceiptAccepted
+	}
+	for _, id := range review.Reject {
+		if decisions[id] != "" {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "receipt %d cannot be both accepted and rejected", id)
+			return
+		}
+		decisions[id] = ExamReceiptRejected
+	}
+	ids := []int64{}
+	for id := range decisions {
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "no receipts to accept or reject")
+		return
+	}
+
+	// lock the receipts and apply them in the order they were graded
+	receipts := []*UploadedExamReceipt{}
+	placeholders := []string{}
+	args := []interface{}{bundleID}
+	for _, id := range ids {
+		args = append(args, id)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+	if err := meddler.QueryAll(tx, &receipts, `SELECT * FROM exam_receipts WHERE bundle_id = $1 AND id IN (`+strings.Join(placeholders, ", ")+`) `+
+		`ORDER BY graded_at, id FOR UPDATE`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if len(receipts) != len(ids) {
+		loggedHTTPErrorf(w, http.StatusNotFound, "not every receipt was found in exam bundle %d", bundleID)
+		return
+	}
+	for _, receipt := range receipts {
+		if receipt.Status != ExamReceiptPending {
+			loggedHTTPErrorf(w, http.StatusConflict, "receipt %d was already %s", receipt.ID, receipt.Status)
+			return
+		}
+	}
+	if err := loadExamReceiptFiles(tx, receipts); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading files: %v", err)
+		return
+	}
+
+	assignments := make(map[int64]*Assignment)
+	accepted := 0
+	for _, receipt := range receipts {
+		receipt.Status = decisions[receipt.ID]
+		receipt.ReviewedBy = currentUser.ID
+		receipt.ReviewedAt = &now
+		if receipt.Status == ExamReceiptAccepted {
+			assignment, ok := assignments[receipt.AssignmentID]
+			if !ok {
+				assignment = new(Assignment)
+				if err := meddler.Load(tx, "assignments", assignment, receipt.AssignmentID); err != nil {
+					loggedHTTPDBNotFoundError(w, err)
+					return
+				}
+			}
+			commitID, saved, err := acceptExamReceipt(tx, bundleID, receipt)
+			if err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			receipt.CommitID = commitID
+			if saved {
+				if err := scoreAssignment(tx, assignment, receipt.Unique, receipt.Step, examReceiptCard(bundleID, receipt).ComputeScore()); err != nil {
+					loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
+					return
+				}
+				assignments[assignment.ID] = assignment
+			}
+			accepted++
+		}
+		if err := meddler.Update(tx, "exam_receipts", receipt); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+
+	// save the new scores and post them
+	for _, assignment := range assignments {
+		assignment.UpdatedAt = now
+		if err := meddler.Save(tx, "assignments", assignment); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		student := new(User)
+		if err := meddler.Load(tx, "users", student, assignment.UserID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if err := saveGrade(tx, assignment, student); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error posting grade back to LMS: %v", err)
+			return
+		}
+	}
+	audit.Record(AuditRequest, bundleID, "exam bundle %d receipts reviewed: %d accepted, %d rejected",
+		bundleID, accepted, len(receipts)-accepted)
+	render.JSON(http.StatusOK, receipts)
+}
+
+// examReceiptCard is the report card for an offline grading run.
+func examReceiptCard(bundleID int64, receipt *UploadedExamReceipt) *ReportCard {
+	card := NewReportCard()
+	card.Note = fmt.Sprintf("graded offline with exam bundle %d", bundleID)
+	if receipt.Passed {
+		card.AddPassedResult("offline", htmlEscapePre(receipt.Output))
+	} else {
+		card.AddFailedResult("offline", htmlEscapePre(receipt.Output), "")
+	}
+	return card
+}
+
+// acceptExamReceipt saves an accepted receipt as the graded commit for its
+// step. Commits are unique per step, so it replaces the step's commit if
+// there is one, unless that commit was saved after the receipt was graded.
+// It returns the ID of the step's commit and whether the receipt was saved.
+func acceptExamReceipt(tx *sql.Tx, bundleID int64, receipt *UploadedExamReceipt) (int64, bool, error) {
+	commit := new(Commit)
+	err := meddler.QueryRow(tx, commit, `SELECT * FROM commits WHERE assignment_id = $1 AND problem_id = $2 AND step = $3 FOR UPDATE`,
+		receipt.AssignmentID, receipt.ProblemID, receipt.Step)
+	if err == nil && commit.UpdatedAt.After(*receipt.GradedAt) {
+		return commit.ID, false, nil
+	} else if err != nil && err != sql.ErrNoRows {
+		return 0, false, err
+	}
+
+	card := examReceiptCard(bundleID, receipt)
+	if err == sql.ErrNoRows {
+		commit = &Commit{AssignmentID: receipt.AssignmentID, ProblemID: receipt.ProblemID, Step: receipt.Step, CreatedAt: *receipt.GradedAt}
+	}
+	commit.Action = "grade"
+	commit.Note = card.Note
+	commit.Files = receipt.Files
+	commit.FileHashes = receipt.FileHashes
+	commit.Sealed = nil
+	commit.Transcript = nil
+	commit.ReportCard = card
+	commit.Score = card.ComputeScore()
+	commit.UpdatedAt = *receipt.GradedAt
+	if err := meddler.Save(tx, "commits", commit); err != nil {
+		return 0, false, err
+	}
+	return commit.ID, true, nil
+}
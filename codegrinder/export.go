@@ -0,0 +1,300 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// errRangeDone is returned by rangeWriter once the requested byte range has
+// been written, which stops the export early.
+var errRangeDone = errors.New("requested range complete")
+
+// rangeWriter passes through only the bytes of a stream that fall within a
+// requested range, discarding the rest. Since an export is generated the same
+// way every time, this lets a client resume an interrupted download.
+type rangeWriter struct {
+	w         io.Writer
+	skip      int64
+	remaining int64 // -1 means no limit
+}
+
+func (rw *rangeWriter) Write(data []byte) (int, error) {
+	n := len(data)
+	if rw.skip > 0 {
+		if int64(len(data)) <= rw.skip {
+			rw.skip -= int64(len(data))
+			return n, nil
+		}
+		data = data[rw.skip:]
+		rw.skip = 0
+	}
+	if rw.remaining == 0 {
+		return 0, errRangeDone
+	}
+	if rw.remaining > 0 && int64(len(data)) > rw.remaining {
+		data = data[:rw.remaining]
+	}
+	if _, err := rw.w.Write(data); err != nil {
+		return 0, err
+	}
+	if rw.remaining > 0 {
+		rw.remaining -= int64(len(data))
+		if rw.remaining == 0 {
+			return 0, errRangeDone
+		}
+	}
+	return n, nil
+}
+
+var byteRangeRE = regexp.MustCompile(`^bytes=(\d+)-(\d*)$`)
+
+// parseByteRange parses a Range header with a single byte range.
+// Suffix ranges (bytes=-N) cannot be supported without knowing the total
+// length in advance, so they are rejected.
+func parseByteRange(header string) (start, end int64, err error) {
+	groups := byteRangeRE.FindStringSubmatch(strings.TrimSpace(header))
+	if groups == nil {
+		return 0, 0, fmt.Errorf("unsupported range %q: only a single bytes=start-[end] range is allowed", header)
+	}
+	if start, err = strconv.ParseInt(groups[1], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	end = -1
+	if groups[2] != "" {
+		if end, err = strconv.ParseInt(groups[2], 10, 64); err != nil {
+			return 0, 0, err
+		}
+		if end < start {
+			return 0, 0, fmt.Errorf("range end %d is before start %d", end, start)
+		}
+	}
+	return start, end, nil
+}
+
+// GetCourseProblemSetExport handles a request to /v2/courses/:course_id/problem_sets/:problem_set_id/export,
+// returning a tar archive of student commits for the problem set.
+// The archive is streamed as it is generated rather than built in memory.
+// Each file is stored as <login>/<problem>/step<n>/<name> with its SHA-256
+// checksum in a PAX record, and a SHA256SUMS manifest is added at the end.
+// Commit metrics, when present, are stored as <login>/<problem>/step<n>.metrics.json.
+//
+// If parameter passing=true is present, only commits that passed are included.
+// If parameter latest=true is present, only the highest step of each problem for each student is included.
+// If parameter since=<...> is present, only commits updated since that RFC 3339 time or YYYY-MM-DD date are included.
+//
+// A single Range header of the form bytes=start-[end] is honored, so an
+// interrupted download can be resumed as long as no new commits arrived.
+func GetCourseProblemSetExport(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	problemSetID, err := parseID(w, "problem_set_id", params["problem_set_id"])
+	if err != nil {
+		return
+	}
+	// build the filters
+	where := ` WHERE assignments.course_id = $1 AND assignments.problem_set_id = $2`
+	args := []interface{}{courseID, problemSetID}
+	if passing, _ := strconv.ParseBool(r.FormValue("passing")); passing {
+		where += ` AND commits.score = 1.0`
+	}
+	if latest, _ := strconv.ParseBool(r.FormValue("latest")); latest {
+		where += ` AND commits.step = (SELECT MAX(step) FROM commits AS later ` +
+			`WHERE later.assignment_id = commits.assignment_id AND later.problem_id = commits.problem_id)`
+	}
+	if since := r.FormValue("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			if t, err = time.ParseInLocation("2006-01-02", since, time.Local); err != nil {
+				loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing since %q: expected RFC 3339 time or YYYY-MM-DD date", since)
+				return
+			}
+		}
+		args = append(args, t)
+		where += fmt.Sprintf(` AND commits.updated_at >= $%d`, len(args))
+	}
+
+	// the commit IDs are fetched a batch at a time and the commits loaded one at a time
+	where += fmt.Sprintf(` AND commits.id > $%d ORDER BY commits.id LIMIT $%d`, len(args)+1, len(args)+2)
+	cursor, err := newBatchCursor(r.Context(), tx, "", `SELECT commits.id FROM commits JOIN assignments ON commits.assignment_id = assignments.id`+where, args...)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// handle range requests
+	out := &rangeWriter{w: w, remaining: -1}
+	status := http.StatusOK
+	if header := r.Header.Get("Range"); header != "" {
+		start, end, err := parseByteRange(header)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusRequestedRangeNotSatisfiable, "%v", err)
+			return
+		}
+		out.skip = start
+		if end >= 0 {
+			out.remaining = end - start + 1
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", start, end))
+		} else {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-/*", start))
+		}
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="course-%d-problem-set-%d.tar"`, courseID, problemSetID))
+	w.WriteHeader(status)
+
+	if err := writeExport(r.Context(), out, tx, cursor); err != nil && err != errRangeDone {
+		// the status line is already sent, so all we can do is log it and cut the stream short
+		loggedErrorf("error writing export for course %d problem set %d: %v", courseID, problemSetID, err)
+	}
+}
+
+// writeExport writes a tar archive of the commits a cursor finds.
+func writeExport(ctx context.Context, out io.Writer, tx *sql.Tx, cursor *batchCursor) error {
+	writer := tar.NewWriter(out)
+	users := make(map[int64]*User)
+	problems := make(map[int64]*Problem)
+	assignments := make(map[int64]*Assignment)
+	var sums []string
+
+	for {
+		var commitIDs []int64
+		if n, err := cursor.Next(ctx, scanKey(&commitIDs)); err != nil {
+			return err
+		} else if n == 0 {
+			break
+		}
+		for _, id := range commitIDs {
+			commit := new(Commit)
+			if err := meddler.Load(tx, "commits", commit, id); err != nil {
+				return err
+			}
+			if err := loadCommitFiles(tx, commit); err != nil {
+				return err
+			}
+			asst, ok := assignments[commit.AssignmentID]
+			if !ok {
+				asst = new(Assignment)
+				if err := meddler.Load(tx, "assignments", asst, commit.AssignmentID); err != nil {
+					return err
+				}
+				assignments[asst.ID] = asst
+			}
+			user, ok := users[asst.UserID]
+			if !ok {
+				user = new(User)
+				if err := meddler.Load(tx, "users", user, asst.UserID); err != nil {
+					return err
+				}
+				users[user.ID] = user
+			}
+			problem, ok := problems[commit.ProblemID]
+			if !ok {
+				problem = new(Problem)
+				if err := meddler.Load(tx, "problems", problem, commit.ProblemID); err != nil {
+					return err
+				}
+				problems[problem.ID] = problem
+			}
+
+			login := user.CanvasLogin
+			if login == "" {
+				login = fmt.Sprintf("user%d", user.ID)
+			}
+			dir := path.Join(login, problem.Unique, fmt.Sprintf("step%d", commit.Step))
+
+			names := []string{}
+			for name := range commit.Files {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				contents := commit.Files[name]
+				sum := sha256.Sum256([]byte(contents))
+				hexsum := hex.EncodeToString(sum[:])
+				full := path.Join(dir, name)
+				header := &tar.Header{
+					Name:       full,
+					Mode:       0644,
+					Size:       int64(len(contents)),
+					ModTime:    commit.UpdatedAt,
+					Typeflag:   tar.TypeReg,
+					PAXRecords: map[string]string{"CODEGRINDER.sha256": hexsum},
+					Format:     tar.FormatPAX,
+				}
+				if err := writer.WriteHeader(header); err != nil {
+					return err
+				}
+				if _, err := writer.Write([]byte(contents)); err != nil {
+					return err
+				}
+				sums = append(sums, fmt.Sprintf("%s  %s\n", hexsum, full))
+			}
+
+			// metrics go next to the step directory so they cannot collide with student files
+			if commit.Metrics != nil {
+				raw, err := json.MarshalIndent(commit.Metrics, "", "    ")
+				if err != nil {
+					return err
+				}
+				raw = append(raw, '\n')
+				sum := sha256.Sum256(raw)
+				hexsum := hex.EncodeToString(sum[:])
+				full := dir + ".metrics.json"
+				header := &tar.Header{
+					Name:       full,
+					Mode:       0644,
+					Size:       int64(len(raw)),
+					ModTime:    commit.UpdatedAt,
+					Typeflag:   tar.TypeReg,
+					PAXRecords: map[string]string{"CODEGRINDER.sha256": hexsum},
+					Format:     tar.FormatPAX,
+				}
+				if err := writer.WriteHeader(header); err != nil {
+					return err
+				}
+				if _, err := writer.Write(raw); err != nil {
+					return err
+				}
+				sums = append(sums, fmt.Sprintf("%s  %s\n", hexsum, full))
+			}
+		}
+	}
+
+	manifest := strings.Join(sums, "")
+	header := &tar.Header{
+		Name:     "SHA256SUMS",
+		Mode:     0644,
+		Size:     int64(len(manifest)),
+		ModTime:  time.Unix(0, 0),
+		Typeflag: tar.TypeReg,
+	}
+	if err := writer.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := writer.Write([]byte(manifest)); err != nil {
+		return err
+	}
+	return writer.Close()
+}
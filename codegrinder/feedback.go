@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Instructors can limit how much of the grader's output students see for
+// the problems of a problem set, e.g., for an exam:
+//
+//	full:   the report card and the full transcript (the default)
+//	names:  the names and outcomes of the tests, but no details or transcript
+//	counts: only how many tests passed and failed
+//
+// The level travels to the daycare as a problem option, so it is covered
+// by the problem signature. The daycare leaves out the details as it
+// streams events to the student, and seals the whole report card and
+// transcript into the report card so only the TA can read them. The TA
+// gives everything back to instructors, and to students only once the
+// level is set back to full. Commits graded before a level was set are
+// limited when they are shown to students.
+
+// FeedbackOption is the problem option that carries the feedback level.
+const FeedbackOption = "feedback="
+
+// feedbackLevel returns the feedback level set in a problem's options.
+// An unknown level shows as little as possible.
+func feedbackLevel(options []string) string {
+	level := FeedbackFull
+	for _, option := range options {
+		if strings.HasPrefix(option, FeedbackOption) {
+			level = strings.TrimPrefix(option, FeedbackOption)
+		}
+	}
+	switch level {
+	case FeedbackFull, FeedbackNames, FeedbackCounts:
+		return level
+	}
+	return FeedbackCounts
+}
+
+// courseFeedbackLevel returns the feedback level a course sets for a problem set.
+func courseFeedbackLevel(tx *sql.Tx, courseID, problemSetID int64) (string, error) {
+	var level string
+	err := tx.QueryRow(`SELECT level FROM course_feedback_levels WHERE course_id = $1 AND problem_set_id = $2`, courseID, problemSetID).Scan(&level)
+	if err == sql.ErrNoRows {
+		return FeedbackFull, nil
+	}
+	return level, err
+}
+
+// applyCourseFeedback sets the feedback option of a problem from the level
+// the course sets for the problem set. Like the course options, it must be
+// applied the same way everywhere a problem is signed for grading.
+func applyCourseFeedback(tx *sql.Tx, courseID, problemSetID int64, problem *Problem) error {
+	level, err := courseFeedbackLevel(tx, courseID, problemSetID)
+	if err != nil {
+		return err
+	}
+	options := []string{}
+	for _, option := range problem.Options {
+		if !strings.HasPrefix(option, FeedbackOption) {
+			options = append(options, option)
+		}
+	}
+	if level != FeedbackFull {
+		options = append(options, FeedbackOption+level)
+	}
+	problem.Options = options
+	return nil
+}
+
+// studentFeedbackLevel returns the feedback level that applies to a user
+// looking at an assignment. Course staff and administrators see everything.
+func studentFeedbackLevel(tx *sql.Tx, currentUser *User, assignmentID int64) (string, error) {
+	if currentUser.Admin {
+		return FeedbackFull, nil
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		return "", err
+	}
+	if ok, err := isCourseStaff(tx, currentUser, assignment.CourseID); err != nil || ok {
+		return FeedbackFull, err
+	}
+	return courseFeedbackLevel(tx, assignment.CourseID, assignment.ProblemSetID)
+}
+
+// feedbackVisible reports whether an event can be shown to a student when
+// the feedback level is limited.
+func feedbackVisible(event *EventMessage) bool {
+	switch event.Event {
+	case "exec", "stdin", "stdout", "stderr", "error":
+		return false
+	}
+	return true
+}
+
+// limitFeedback reduces a report card and its parts to what a feedback
+// level shows. The counts of passed and failed tests are unchanged, so the
+// score computed from the card stays the same.
+func limitFeedback(card *ReportCard, level string) {
+	if card == nil || level == FeedbackFull {
+		return
+	}
+	if card.Feedback != FeedbackCounts {
+		card.Feedback = level
+	}
+	switch level {
+	case FeedbackNames:
+		for i, result := range card.Results {
+			card.Results[i] = &ReportCardResult{Name: result.Name, Outcome: result.Outcome, Hint: result.Hint}
+		}
+	default:
+		for _, result := range card.Results {
+			switch result.Outcome {
+			case "passed":
+				card.HiddenPassed++
+			case "warning":
+			default:
+				card.HiddenFailed++
+			}
+		}
+		card.Results = []*ReportCardResult{}
+	}
+	for _, part := range card.Parts {
+		limitFeedback(part.ReportCard, level)
+	}
+}
+
+// limitTranscript returns the events of a transcript a student may see
+// when the feedback level is limited.
+func limitTranscript(transcript []*EventMessage) []*EventMessage {
+	visible := []*EventMessage{}
+	for _, event := range transcript {
+		if feedbackVisible(event) {
+			visible = append(visible, event)
+		}
+	}
+	return visible
+}
+
+// withholdFeedback seals the whole report card and transcript of a graded
+// commit into its report card and limits what is left to the feedback
+// level. Any hidden test results stay sealed inside the whole report card.
+func withholdFeedback(commit *Commit, level string) error {
+	sealed, err := sealWithSecret(&hiddenReport{Card: commit.ReportCard, Transcript: commit.Transcript})
+	if err != nil {
+		return err
+	}
+	limitFeedback(commit.ReportCard, level)
+	commit.ReportCard.Hidden = sealed
+	commit.Transcript = limitTranscript(commit.Transcript)
+	return nil
+}
+
+// limitCommitFeedback limits a commit to the feedback level that applies to
+// the user looking at it. It is called after revealHiddenTests.
+func limitCommitFeedback(tx *sql.Tx, currentUser *User, commit *Commit) error {
+	if commit.ReportCard == nil {
+		return nil
+	}
+	level, err := studentFeedbackLevel(tx, currentUser, commit.AssignmentID)
+	if err != nil || level == FeedbackFull {
+		return err
+	}
+	limitFeedback(commit.ReportCard, level)
+	commit.Transcript = limitTranscript(commit.Transcript)
+	return nil
+}
+
+// GetCourseFeedbackLevels handles a request to /v2/courses/:course_id/feedback_levels,
+// returning the problem sets in a course that show students less than
+// everything.
+func GetCourseFeedbackLevels(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	levels := []*CourseFeedbackLevel{}
+	if err := meddler.QueryAll(tx, &levels, `SELECT * FROM course_feedback_levels WHERE course_id = $1 ORDER BY problem_set_id`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, levels)
+}
+
+// PutCourseFeedbackLevel handles a request to /v2/courses/:course_id/feedback_levels/:problem_set_id,
+// setting how much grading detail students in the course see for a problem
+// set. Only the level from the request is used; full removes the limit.
+func PutCourseFeedbackLevel(w http.ResponseWriter, tx *sql.Tx, params martini.Params, request CourseFeedbackLevel, audit *AuditEntry, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	problemSetID, err := parseID(w, "problem_set_id", params["problem_set_id"])
+	if err != nil {
+		return
+	}
+	switch request.Level {
+	case FeedbackFull, FeedbackNames, FeedbackCounts:
+	default:
+		loggedHTTPErrorf(w, http.StatusBadRequest, "feedback level must be %s, %s, or %s", FeedbackFull, FeedbackNames, FeedbackCounts)
+		return
+	}
+	problemSet := new(ProblemSet)
+	if err := meddler.Load(tx, "problem_sets", problemSet, problemSetID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	level := &CourseFeedbackLevel{
+		CourseID:     courseID,
+		ProblemSetID: problemSetID,
+		Level:        request.Level,
+		UpdatedAt:    time.Now(),
+	}
+	if _, err := tx.Exec(`DELETE FROM course_feedback_levels WHERE course_id = $1 AND problem_set_id = $2`, courseID, problemSetID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if level.Level != FeedbackFull {
+		if err := meddler.Insert(tx, "course_feedback_levels", level); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	audit.Record(AuditRequest, courseID, "course %d feedback level for problem set %s: %s", courseID, problemSet.Unique, level.Level)
+	render.JSON(http.StatusOK, level)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// Commit files are stored once each in the files table, keyed by the SHA-256
+// hash of their contents. The files column of a commit maps each file name to
+// a hash, so resubmitting an unchanged file costs only the hash.
+
+// fileHash returns the key used for a file's contents in the file store.
+func fileHash(contents string) string {
+	sum := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
+
+// storeCommitFiles adds the commit's files to the file store and fills in
+// the file hashes that will be saved with the commit.
+func storeCommitFiles(tx *sql.Tx, now time.Time, commit *Commit) error {
+	commit.FileHashes = make(map[string]string)
+	for name, contents := range commit.Files {
+		hash := fileHash(contents)
+		_, err := tx.Exec(`INSERT INTO files (hash, contents, created_at) VALUES ($1, $2, $3) `+
+			`ON CONFLICT (hash) DO NOTHING`,
+			hash, contents, now)
+		if err != nil {
+			return err
+		}
+		commit.FileHashes[name] = hash
+	}
+	return nil
+}
+
+// loadCommitFiles fills in the file contents for commits loaded from the
+// database, fetching each distinct file from the store only once.
+func loadCommitFiles(tx *sql.Tx, commits ...*Commit) error {
+	hashes := make(map[string]bool)
+	for _, commit := range commits {
+		for _, hash := range commit.FileHashes {
+			hashes[hash] = true
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	placeholders := []string{}
+	args := []interface{}{}
+	for hash := range hashes {
+		args = append(args, hash)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+	rows, err := tx.Query(`SELECT hash, contents FROM files WHERE hash IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	contents := make(map[string]string)
+	for rows.Next() {
+		var hash, data string
+		if err := rows.Scan(&hash, &data); err != nil {
+			return err
+		}
+		contents[hash] = data
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, commit := range commits {
+		commit.Files = make(map[string]string)
+		for name, hash := range commit.FileHashes {
+			data, exists := contents[hash]
+			if !exists {
+				return fmt.Errorf("file %s in commit %d refers to missing file store entry %s", name, commit.ID, hash)
+			}
+			commit.Files[name] = data
+		}
+	}
+	return nil
+}
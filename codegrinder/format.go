@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// A problem whose type has a formatter can ask for the student's files to
+// be formatted before they are graded:
+//
+//	format=auto
+//
+// The daycare runs the formatter for the language (black, gofmt, or
+// clang-format) on the student's files inside the container, and the tests
+// run against the formatted files, so differences in spacing cannot break
+// tests that compare output or source text. The commit keeps the files as
+// the student wrote them, and the report card keeps the formatted version
+// of each file the formatter changed, with a warning showing the changes.
+// Formatting never changes the score. If the formatter fails, e.g., on a
+// syntax error, the files are graded as they are.
+
+// FormatOption is the problem option that turns on automatic formatting.
+const FormatOption = "format="
+
+// autoFormat formats the student's files in place before a grading action
+// if the problem asks for it. For sealed commits the formatted files and
+// changes are not put on the report card, as that would reveal the files.
+func autoFormat(n *Nanny, options []string, files map[string]string, sealed bool) {
+	mode := ""
+	for _, option := range options {
+		if strings.HasPrefix(option, FormatOption) {
+			mode = strings.TrimPrefix(option, FormatOption)
+		}
+	}
+	if mode == "" {
+		return
+	}
+	if mode != "auto" {
+		n.ReportCard.LogAndFailf("invalid problem option %q: must be auto", FormatOption+mode)
+		return
+	}
+	checker := styleCheckers[n.ProblemType.Name]
+	if checker == nil || checker.Formatter == "" {
+		log.Printf("no formatter for problem type %s", n.ProblemType.Name)
+		return
+	}
+	names := styleFiles(checker, files)
+	if len(names) == 0 {
+		return
+	}
+
+	// format the files in the container and copy them back out
+	original := make(map[string]string)
+	for _, name := range names {
+		original[name] = files[name]
+	}
+	if err := n.PutFiles(original); err != nil {
+		n.ReportCard.LogAndFailf("PutFiles error: %v", err)
+		return
+	}
+	_, stderr, _, status, err := n.ExecNonInteractive([]string{"sh", "-c", styleCommand(checker.Formatter, names)})
+	if err != nil {
+		n.ReportCard.LogAndFailf("exec error: %v", err)
+		return
+	}
+	if status != 0 {
+		n.ReportCard.AddWarningResult("format", "<h1>Formatting failed; your files were graded as written</h1>\n"+htmlEscapePre(stderr.String()), "")
+		return
+	}
+	formatted, err := n.GetFiles(names)
+	if err != nil {
+		n.ReportCard.LogAndFailf("GetFiles error: %v", err)
+		return
+	}
+
+	changed := 0
+	for _, name := range names {
+		contents, exists := formatted[name]
+		if !exists || contents == original[name] {
+			continue
+		}
+		changed++
+		files[name] = contents
+		if sealed {
+			continue
+		}
+		if n.ReportCard.Formatted == nil {
+			n.ReportCard.Formatted = make(map[string]string)
+		}
+		n.ReportCard.Formatted[name] = contents
+		out := new(bytes.Buffer)
+		writeDiffHTML(out, original[name], contents, "Formatting changes to "+name)
+		n.ReportCard.AddWarningResult("format: "+name, out.String(), name)
+	}
+	if sealed && changed > 0 {
+		n.ReportCard.AddWarningResult("format", htmlEscapePara(fmt.Sprintf("%d file%s reformatted before grading", changed, plural(changed))), "")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// fsckCheck is a single consistency check. The query finds problem rows and
+// returns a description of each one. If fix is not empty, it is a statement
+// that repairs every problem found by the query, and it is only run when it
+// is safe to do so without losing student work.
+type fsckCheck struct {
+	name  string
+	query string
+	fix   string
+}
+
+var fsckChecks = []fsckCheck{
+	{
+		name: "commits pointing at missing assignments",
+		query: `SELECT 'commit ' || id || ' refers to assignment ' || assignment_id FROM commits_all ` +
+			`WHERE NOT EXISTS (SELECT 1 FROM assignments_all WHERE assignments_all.id = commits_all.assignment_id)`,
+		fix: `DELETE FROM commits_all WHERE NOT EXISTS (SELECT 1 FROM assignments_all WHERE assignments_all.id = commits_all.assignment_id)`,
+	},
+	{
+		name: "commits pointing at missing problem steps",
+		query: `SELECT 'commit ' || id || ' refers to problem ' || problem_id || ' step ' || step FROM commits ` +
+			`WHERE NOT EXISTS (SELECT 1 FROM problem_steps ` +
+			`WHERE problem_steps.problem_id = commits.problem_id AND problem_steps.step = commits.step)`,
+	},
+	{
+		name: "assignments pointing at missing problem sets",
+		query: `SELECT 'assignment ' || id || ' refers to problem set ' || problem_set_id FROM assignments ` +
+			`WHERE NOT EXISTS (SELECT 1 FROM problem_sets WHERE problem_sets.id = assignments.problem_set_id)`,
+	},
+	{
+		name: "assignments pointing at missing users or courses",
+		query: `SELECT 'assignment ' || id || ' refers to user ' || user_id || ' and course ' || course_id FROM assignments ` +
+			`WHERE NOT EXISTS (SELECT 1 FROM users WHERE users.id = assignments.user_id) ` +
+			`OR NOT EXISTS (SELECT 1 FROM courses WHERE courses.id = assignments.course_id)`,
+	},
+	{
+		name: "problem sets with no problems",
+		query: `SELECT 'problem set ' || id || ' (' || unique_id || ') has no problems' FROM problem_sets ` +
+			`WHERE NOT EXISTS (SELECT 1 FROM problem_set_problems WHERE problem_set_problems.problem_set_id = problem_sets.id)`,
+	},
+	{
+		name: "commit files missing from the file store",
+		query: `SELECT 'commit ' || commits.id || ' file ' || f.key || ' refers to missing file ' || f.value ` +
+			`FROM commits, jsonb_each_text(commits.files) AS f ` +
+			`WHERE NOT EXISTS (SELECT 1 FROM files WHERE files.hash = f.value)`,
+	},
+	{
+		// this is report only: a running server may have stored a file for a
+		// commit it has not committed yet, and deleting it would lose work
+		name: "orphaned files in the file store",
+		query: `SELECT 'file ' || hash || ' is not used by any commit, checkpoint, or exam receipt' FROM files ` +
+			`WHERE NOT EXISTS (SELECT 1 FROM commits_all, jsonb_each_text(commits_all.files) AS f WHERE f.value = files.hash) ` +
+			`AND NOT EXISTS (SELECT 1 FROM checkpoints, jsonb_each_text(checkpoints.files) AS f WHERE f.value = files.hash) ` +
+			`AND NOT EXISTS (SELECT 1 FROM exam_receipts, jsonb_each_text(exam_receipts.files) AS f WHERE f.value = files.hash)`,
+	},
+}
+
+// runFsck handles the fsck subcommand, which scans the database for
+// referential problems and inconsistent scores and prints a report.
+// With --fix, categories that are safe to repair are repaired.
+// It returns the number of problems found.
+func runFsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "Repair problems in categories that are safe to fix")
+	flags.Parse(args)
+
+	db := setupDB(Config().PostgresHost, Config().PostgresPort, Config().PostgresUsername, Config().PostgresPassword, Config().PostgresDatabase)
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("db error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	total := 0
+	for _, check := range fsckChecks {
+		found, err := fsckQuery(tx, check.query)
+		if err != nil {
+			log.Fatalf("db error checking %s: %v", check.name, err)
+		}
+		total += fsckReport(check.name, found)
+		if *fix && len(found) > 0 && check.fix != "" {
+			result, err := tx.Exec(check.fix)
+			if err != nil {
+				log.Fatalf("db error fixing %s: %v", check.name, err)
+			}
+			n, _ := result.RowsAffected()
+			fmt.Printf("    fixed: %d row%s removed\n", n, plural(int(n)))
+		}
+	}
+
+	// scores must match the report cards they were computed from
+	found, err := fsckScores(tx)
+	if err != nil {
+		log.Fatalf("db error checking commit scores: %v", err)
+	}
+	total += fsckReport("commit scores inconsistent with report cards", found)
+
+	if *fix {
+		if err := tx.Commit(); err != nil {
+			log.Fatalf("db error committing fixes: %v", err)
+		}
+	}
+
+	if total == 0 {
+		fmt.Println("no problems found")
+	} else {
+		fmt.Printf("%d problem%s found\n", total, plural(total))
+	}
+	return total
+}
+
+func fsckQuery(tx *sql.Tx, query string) ([]string, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return nil, err
+		}
+		found = append(found, msg)
+	}
+	return found, rows.Err()
+}
+
+func fsckScores(tx *sql.Tx) ([]string, error) {
+	rows, err := tx.Query(`SELECT id, COALESCE(score, 0), report_card FROM commits WHERE report_card != 'null'::jsonb`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []string
+	for rows.Next() {
+		var id int64
+		var score float64
+		var raw []byte
+		if err := rows.Scan(&id, &score, &raw); err != nil {
+			return nil, err
+		}
+		card := new(ReportCard)
+		if err := json.Unmarshal(raw, card); err != nil {
+			found = append(found, fmt.Sprintf("commit %d has an unreadable report card: %v", id, err))
+			continue
+		}
+		if expected := stepScore(card); math.Abs(expected-score) > 1e-9 {
+			found = append(found, fmt.Sprintf("commit %d has score %.4f but its report card gives %.4f", id, score, expected))
+		}
+	}
+	return found, rows.Err()
+}
+
+func fsckReport(name string, found []string) int {
+	if len(found) == 0 {
+		fmt.Printf("ok: %s\n", name)
+		return 0
+	}
+	fmt.Printf("%d problem%s: %s\n", len(found), plural(len(found)), name)
+	for _, msg := range found {
+		fmt.Printf("    %s\n", msg)
+	}
+	return len(found)
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+)
+
+// The gradebook lists every student's score on every assignment in a
+// course. Like the commit metrics, it can be had as JSON or, with
+// ?format=csv, as a spreadsheet for importing into other systems. CSV
+// rows are written as they are read from the database rather than
+// gathered first, so a large course does not have to fit in memory.
+
+// wantCSV reports whether a request asks for a CSV response.
+func wantCSV(r *http.Request) bool {
+	return r.FormValue("format") == "csv"
+}
+
+// startCSV sets the headers for a CSV download and returns a writer for
+// its rows, starting with the header row.
+func startCSV(w http.ResponseWriter, filename string, header []string) *csv.Writer {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	out := csv.NewWriter(w)
+	out.Write(header)
+	return out
+}
+
+// formatScore formats a score from 0 to 1 for a CSV file.
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', 4, 64)
+}
+
+// GetCourseGradebook handles a request to /v2/courses/:course_id/gradebook,
+// returning each student's score on each assignment in the course, in the
+// order the assignments were created. Parameters:
+//
+//	problem_set: the ID of a problem set to list only its assignments
+//	format:      csv for a spreadsheet with one row per assignment
+func GetCourseGradebook(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	where, args := "", []interface{}{}
+	where, args = addWhereEq(where, args, "assignments.course_id", courseID)
+	if s := r.FormValue("problem_set"); s != "" {
+		problemSetID, err := parseID(w, "problem_set", s)
+		if err != nil {
+			return
+		}
+		where, args = addWhereEq(where, args, "assignments.problem_set_id", problemSetID)
+	}
+	cursor, err := newBatchCursor(r.Context(), tx, "", `SELECT assignments.id, users.id, users.name, users.email, users.canvas_login, `+
+		`problem_sets.unique_id, assignments.canvas_title, COALESCE(assignments.score, 0), score_overrides.score, COALESCE(score_overrides.comment, ''), `+
+		`assignments.updated_at `+
+		`FROM assignments JOIN users ON assignments.user_id = users.id `+
+		`JOIN problem_sets ON assignments.problem_set_id = problem_sets.id `+
+		`LEFT JOIN score_overrides ON score_overrides.assignment_id = assignments.id`+
+		where+fmt.Sprintf(` AND NOT assignments.instructor AND assignments.id > $%d ORDER BY assignments.id LIMIT $%d`, len(args)+1, len(args)+2),
+		args...)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	var out *csv.Writer
+	entries := []*GradebookEntry{}
+	if wantCSV(r) {
+		out = startCSV(w, fmt.Sprintf("codegrinder-gradebook-%d-%s.csv", courseID, time.Now().Format("2006-01-02")),
+			[]string{"assignment_id", "user_id", "name", "email", "login", "problem_set", "title",
+				"computed_score", "override_score", "override_comment", "score", "updated_at"})
+	}
+	scan := func(rows *sql.Rows) (int64, error) {
+		elt := new(GradebookEntry)
+		var override sql.NullFloat64
+		if err := rows.Scan(&elt.AssignmentID, &elt.UserID, &elt.Name, &elt.Email, &elt.Login,
+			&elt.ProblemSetUnique, &elt.Title, &elt.ComputedScore, &override, &elt.OverrideComment, &elt.UpdatedAt); err != nil {
+			return 0, err
+		}
+		elt.Score = elt.ComputedScore
+		if override.Valid {
+			elt.OverrideScore = &override.Float64
+			elt.Score = override.Float64
+		}
+		if out == nil {
+			entries = append(entries, elt)
+			return elt.AssignmentID, nil
+		}
+		overrideScore := ""
+		if elt.OverrideScore != nil {
+			overrideScore = formatScore(*elt.OverrideScore)
+		}
+		out.Write([]string{
+			strconv.FormatInt(elt.AssignmentID, 10),
+			strconv.FormatInt(elt.UserID, 10),
+			elt.Name,
+			elt.Email,
+			elt.Login,
+			elt.ProblemSetUnique,
+			elt.Title,
+			formatScore(elt.ComputedScore),
+			overrideScore,
+			elt.OverrideComment,
+			formatScore(elt.Score),
+			elt.UpdatedAt.Format(time.RFC3339),
+		})
+		return elt.AssignmentID, nil
+	}
+	for {
+		n, err := cursor.Next(r.Context(), scan)
+		if err != nil {
+			if out != nil {
+				// the download has started, so all we can do is stop it short
+				out.Flush()
+				loggedErrorf("error writing gradebook for course %d: %v", courseID, err)
+				return
+			}
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		} else if n == 0 {
+			break
+		}
+		if out != nil {
+			out.Flush()
+		}
+	}
+	if out == nil {
+		render.JSON(http.StatusOK, entries)
+	}
+}
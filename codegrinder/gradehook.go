@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Courses can register grade hooks that run after each grading action, so
+// a department can feed its own progress trackers without changing the
+// server. A hook follows the commit-graded events in the outbox the same
+// way a course webhook does, and sends each one with the commit's report
+// card as a GradeHookPayload, either:
+//
+//   - posted to an https URL at a public address and signed like a
+//     course webhook, or
+//   - on the standard input of a script from Config.GradeHookScriptDir.
+//
+// Only administrators can install scripts, and a hook can only name a
+// script in that directory. A script runs with a minimal environment and
+// a time limit; the payload is all it is given, and its exit status is all
+// the server reads back. A hook that fails is retried with the same event,
+// and is deactivated after MaxCourseWebhookFailures failures in a row.
+
+// MaxGradeHookOutput is how much of a failed script's output is kept as
+// the hook's last error.
+const MaxGradeHookOutput = 1000
+
+// checkCourseGradeHook validates the URL or script of a grade hook request.
+func checkCourseGradeHook(w http.ResponseWriter, hook *CourseGradeHook) error {
+	hook.URL = strings.TrimSpace(hook.URL)
+	hook.Script = strings.TrimSpace(hook.Script)
+	switch {
+	case hook.URL != "" && hook.Script != "":
+		return loggedHTTPErrorf(w, http.StatusBadRequest, "a grade hook must have a URL or a script, not both")
+	case hook.URL != "":
+		u, err := url.Parse(hook.URL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return loggedHTTPErrorf(w, http.StatusBadRequest, "grade hook URL must be an https URL")
+		}
+	case hook.Script != "":
+		if _, err := gradeHookScriptPath(hook.Script); err != nil {
+			return loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+		}
+	default:
+		return loggedHTTPErrorf(w, http.StatusBadRequest, "a grade hook must have a URL or a script")
+	}
+	return nil
+}
+
+// gradeHookScriptPath returns the path of an installed grade hook script.
+func gradeHookScriptPath(name string) (string, error) {
+	if Config().GradeHookScriptDir == "" {
+		return "", fmt.Errorf("grade hook scripts are not enabled on this server")
+	}
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid grade hook script name %q", name)
+	}
+	path := filepath.Join(Config().GradeHookScriptDir, name)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+		return "", fmt.Errorf("grade hook script %q is not installed", name)
+	}
+	return path, nil
+}
+
+// loadCourseGradeHook loads the grade hook named in a request.
+func loadCourseGradeHook(w http.ResponseWriter, tx *sql.Tx, params martini.Params) (*CourseGradeHook, error) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return nil, err
+	}
+	hookID, err := parseID(w, "hook_id", params["hook_id"])
+	if err != nil {
+		return nil, err
+	}
+	hook := new(CourseGradeHook)
+	if err := meddler.QueryRow(tx, hook, `SELECT * FROM course_grade_hooks WHERE id = $1 AND course_id = $2`, hookID, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil, err
+	}
+	return hook, nil
+}
+
+// GetCourseGradeHooks handles requests to /v2/courses/:course_id/grade_hooks,
+// returning the grade hooks registered for a course. Secrets are not included.
+func GetCourseGradeHooks(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	hooks := []*CourseGradeHook{}
+	if err := meddler.QueryAll(tx, &hooks, `SELECT * FROM course_grade_hooks WHERE course_id = $1 ORDER BY id`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	for _, hook := range hooks {
+		hook.Secret = ""
+	}
+	render.JSON(http.StatusOK, hooks)
+}
+
+// PostCourseGradeHook handles requests to /v2/courses/:course_id/grade_hooks,
+// registering a new grade hook for a course. The request gives a URL or the
+// name of an installed script. The response includes the signing secret
+// for URL hooks, which is not shown again. The hook runs for grading
+// actions from now on.
+func PostCourseGradeHook(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, hook CourseGradeHook, audit *AuditEntry, render render.Render) {
+	now := time.Now()
+
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	if err := checkCourseGradeHook(w, &hook); err != nil {
+		return
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error generating grade hook secret: %v", err)
+		return
+	}
+
+	// start after every transaction that has already finished
+	var xmin int64
+	if err := tx.QueryRow(`SELECT txid_snapshot_xmin(txid_current_snapshot())`).Scan(&xmin); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	hook.ID = 0
+	hook.CourseID = courseID
+	hook.Secret = secret
+	hook.Active = true
+	hook.Cursor = fmt.Sprintf("%d-0", xmin)
+	hook.Failures = 0
+	hook.LastError = ""
+	hook.CreatedBy = currentUser.ID
+	hook.CreatedAt = now
+	hook.UpdatedAt = now
+	if err := meddler.Insert(tx, "course_grade_hooks", &hook); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditWebhook, hook.ID, "course %d grade hook %d added for %s%s", courseID, hook.ID, hook.URL, hook.Script)
+	if hook.Script != "" {
+		hook.Secret = ""
+	}
+	render.JSON(http.StatusOK, &hook)
+}
+
+// PutCourseGradeHook handles requests to /v2/courses/:course_id/grade_hooks/:hook_id,
+// changing the URL, script, or active setting of a grade hook.
+// Reactivating a hook clears its failure count; it picks up with the
+// event it last failed on.
+func PutCourseGradeHook(w http.ResponseWriter, tx *sql.Tx, params martini.Params, request CourseGradeHook, audit *AuditEntry, render render.Render) {
+	hook, err := loadCourseGradeHook(w, tx, params)
+	if err != nil {
+		return
+	}
+	if err := checkCourseGradeHook(w, &request); err != nil {
+		return
+	}
+	if request.Active && !hook.Active {
+		hook.Failures = 0
+		hook.LastError = ""
+	}
+	hook.URL = request.URL
+	hook.Script = request.Script
+	hook.Active = request.Active
+	hook.UpdatedAt = time.Now()
+	if err := meddler.Update(tx, "course_grade_hooks", hook); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditWebhook, hook.ID, "course %d grade hook %d updated for %s%s (active %v)", hook.CourseID, hook.ID, hook.URL, hook.Script, hook.Active)
+	hook.Secret = ""
+	render.JSON(http.StatusOK, hook)
+}
+
+// DeleteCourseGradeHook handles requests to /v2/courses/:course_id/grade_hooks/:hook_id,
+// removing a grade hook.
+func DeleteCourseGradeHook(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *AuditEntry) {
+	hook, err := loadCourseGradeHook(w, tx, params)
+	if err != nil {
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM course_grade_hooks WHERE id = $1`, hook.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditWebhook, hook.ID, "course %d grade hook %d removed", hook.CourseID, hook.ID)
+}
+
+// startCourseGradeHooks runs grade hooks for new grading actions in the background.
+func startCourseGradeHooks(db *sql.DB) {
+	go func() {
+		for {
+			time.Sleep(CourseWebhookInterval)
+
+			hooks := []*CourseGradeHook{}
+			if err := meddler.QueryAll(db, &hooks, `SELECT * FROM course_grade_hooks WHERE active ORDER BY id`); err != nil {
+				log.Printf("db error finding course grade hooks: %v", err)
+				continue
+			}
+			for _, hook := range hooks {
+				runCourseGradeHook(db, hook)
+			}
+		}
+	}()
+}
+
+// runCourseGradeHook runs a grade hook for the grading actions since its
+// cursor, stopping at the first failure so it can be retried next time.
+// Events are read and failures are counted the same way as for course
+// webhooks.
+func runCourseGradeHook(db *sql.DB, hook *CourseGradeHook) {
+	name := fmt.Sprintf("course grade hook %d", hook.ID)
+	cursor, found, failure := deliverOutbox(db, name, hook.CourseID, EventCommitGraded, hook.Cursor, func(event *OutboxEvent) error {
+		body, err := gradeHookPayload(db, event)
+		if err != nil || body == nil {
+			return err
+		}
+		if hook.Script != "" {
+			return runGradeHookScript(hook, body)
+		}
+		return postSignedWebhook(publicWebhookClient, hook.URL, hook.Secret, event, body)
+	})
+	if !found {
+		return
+	}
+	hook.Cursor = cursor
+	recordDelivery(name, hook.CourseID, failure, &hook.Failures, &hook.LastError, &hook.Active)
+	hook.UpdatedAt = time.Now()
+	if err := meddler.Update(db, "course_grade_hooks", hook); err != nil {
+		log.Printf("db error saving %s: %v", name, err)
+	}
+}
+
+// gradeHookPayload builds the JSON payload for a commit-graded event. It
+// returns nil if the commit no longer exists.
+func gradeHookPayload(db *sql.DB, event *OutboxEvent) ([]byte, error) {
+	commit := new(Commit)
+	if err := meddler.Load(db, "commits", commit, event.ObjectID); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("db error loading commit %d: %v", event.ObjectID, err)
+	}
+	payload := &GradeHookPayload{
+		EventID:      event.ID,
+		CourseID:     event.CourseID,
+		UserID:       event.UserID,
+		AssignmentID: commit.AssignmentID,
+		CommitID:     commit.ID,
+		ProblemID:    commit.ProblemID,
+		Step:         commit.Step,
+		Action:       commit.Action,
+		Score:        commit.Score,
+		Passed:       commit.ReportCard != nil && commit.ReportCard.Passed,
+		ReportCard:   commit.ReportCard,
+		GradedAt:     event.CreatedAt,
+	}
+	return json.Marshal(payload)
+}
+
+// runGradeHookScript runs a grade hook script with one payload on its
+// standard input. A script that exits with an error has failed.
+func runGradeHookScript(hook *CourseGradeHook, body []byte) error {
+	path, err := gradeHookScriptPath(hook.Script)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), WebhookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = Config().GradeHookScriptDir
+	cmd.Env = []string{
+		"PATH=/usr/local/bin:/usr/bin:/bin",
+		fmt.Sprintf("CODEGRINDER_COURSE_ID=%d", hook.CourseID),
+		fmt.Sprintf("CODEGRINDER_HOOK_ID=%d", hook.ID),
+	}
+	cmd.Stdin = bytes.NewReader(body)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if len(msg) > MaxGradeHookOutput {
+			msg = msg[:MaxGradeHookOutput]
+		}
+		return fmt.Errorf("script %s failed: %v: %s", hook.Script, err, msg)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// A problem step can include a custom grader at _grader/run to add checks
+// that the problem type does not offer, such as fuzzy output matching or
+// property tests. After the problem type's grading action finishes, the
+// daycare makes the grader executable and runs it in the working directory
+// with the directory's path as its argument. It must print a JSON report
+// card fragment on stdout:
+//
+//	{
+//	    "passed": false,
+//	    "note": "2 of 3 properties held",
+//	    "results": [
+//	        {"name": "reverse twice", "outcome": "passed"},
+//	        {"name": "sorted output", "outcome": "failed",
+//	         "details": "<p>counterexample: [3, 1]</p>", "context": "sort.py:12"}
+//	    ]
+//	}
+//
+// The results are added to the report card, and any failed result or a
+// "passed" of false fails the step. Only the grader from the problem step
+// is used, never a file of the same name from the student.
+//
+// A grader can also score separately weighted parts of the step, such as
+// performance, which are combined with the tests by weight:
+//
+//	"parts": [
+//	    {"name": "performance", "weight": 0.5, "passed": true,
+//	     "results": [{"name": "large input under 1s", "outcome": "failed"}]}
+//	]
+//
+// A part's results and "passed" affect only the part's score, not whether
+// the student can move on to the next step.
+
+// GraderScript is the name of the custom grader in a problem step.
+const GraderScript = "_grader/run"
+
+// graderFragment is the report card fragment printed by a custom grader.
+type graderFragment struct {
+	Passed  *bool               `json:"passed"`
+	Note    string              `json:"note"`
+	Results []*ReportCardResult `json:"results"`
+	Parts   []*graderPart       `json:"parts"`
+}
+
+// graderPart is a separately weighted part scored by a custom grader.
+type graderPart struct {
+	Name    string              `json:"name"`
+	Weight  *float64            `json:"weight"`
+	Passed  *bool               `json:"passed"`
+	Note    string              `json:"note"`
+	Results []*ReportCardResult `json:"results"`
+}
+
+var graderOutcomes = map[string]bool{
+	"passed":  true,
+	"failed":  true,
+	"error":   true,
+	"skipped": true,
+	"warning": true,
+}
+
+// runCustomGrader runs a problem step's custom grader and merges its report
+// card fragment into the report card.
+func runCustomGrader(n *Nanny, script string) {
+	log.Printf("runCustomGrader")
+
+	// the grading action may not have put the files in place if it failed early
+	if err := n.PutFiles(map[string]string{GraderScript: script}); err != nil {
+		n.ReportCard.LogAndFailf("PutFiles error: %v", err)
+		return
+	}
+	stdout, stderr, _, status, err := n.ExecNonInteractive([]string{"sh", "-c", `chmod +x ` + GraderScript + ` && exec ./` + GraderScript + ` "$PWD"`})
+	if err != nil {
+		n.ReportCard.LogAndFailf("exec error: %v", err)
+		return
+	}
+
+	fragment := new(graderFragment)
+	if err := json.Unmarshal(stdout.Bytes(), fragment); err != nil {
+		n.ReportCard.Failf("custom grader did not produce a report (exit status %d)", status)
+		n.ReportCard.AddFailedResult("custom grader", "<h1>Custom grader failed</h1>\n"+htmlEscapePara(err.Error())+htmlEscapePre(stderr.String()), "")
+		return
+	}
+	mergeGraderResults(n.ReportCard, fragment.Results)
+	if fragment.Passed != nil && !*fragment.Passed {
+		n.ReportCard.Passed = false
+	}
+	for _, elt := range fragment.Parts {
+		if elt == nil || strings.TrimSpace(elt.Name) == "" || elt.Name == TestsPart {
+			n.ReportCard.Failf("custom grader returned a part with no name or a reserved name")
+			continue
+		}
+		weight := DefaultPartWeight
+		if elt.Weight != nil {
+			weight = *elt.Weight
+		}
+		if weight < 0.0 {
+			n.ReportCard.Failf("custom grader returned negative weight %g for part %s", weight, elt.Name)
+			continue
+		}
+		part := n.ReportCard.AddPart(elt.Name, weight)
+		part.Note = elt.Note
+		mergeGraderResults(part, elt.Results)
+		if elt.Passed != nil && !*elt.Passed {
+			part.Passed = false
+		}
+	}
+	if fragment.Note != "" {
+		if n.ReportCard.Note != "" {
+			n.ReportCard.Note += ", "
+		}
+		n.ReportCard.Note += fragment.Note
+	}
+	if status != 0 && n.ReportCard.Passed {
+		n.ReportCard.Failf("custom grader exited with status %d", status)
+	}
+}
+
+// mergeGraderResults checks the results returned by a custom grader and
+// adds them to a report card.
+func mergeGraderResults(card *ReportCard, results []*ReportCardResult) {
+	for _, result := range results {
+		if result == nil || strings.TrimSpace(result.Name) == "" {
+			card.Failf("custom grader returned a result with no name")
+			continue
+		}
+		if !graderOutcomes[result.Outcome] {
+			card.Failf("custom grader returned unknown outcome %q for %s", result.Outcome, result.Name)
+			continue
+		}
+		if result.Outcome == "failed" || result.Outcome == "error" {
+			card.Passed = false
+		}
+		card.Results = append(card.Results, result)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+)
+
+// DefaultHeatmapDays is how far back a heatmap goes when no start is given.
+const DefaultHeatmapDays = 28
+
+// parseHeatmapTime parses a start or end parameter, which may be an RFC 3339
+// time or a YYYY-MM-DD date in the heatmap's time zone.
+func parseHeatmapTime(w http.ResponseWriter, name, value string, loc *time.Location) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if t, err = time.ParseInLocation("2006-01-02", value, loc); err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing %s %q: expected RFC 3339 time or YYYY-MM-DD date", name, value)
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+// buildHeatmap counts the graded submissions in a course, or in every
+// course if courseID is zero, for a heatmap request. Parameters:
+//
+//	start: the beginning of the range (default four weeks before end)
+//	end:   the end of the range, a date meaning the end of that day (default now)
+//	tz:    the time zone for days and hours (default the current user's)
+func buildHeatmap(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser *User, courseID int64) *ActivityHeatmap {
+	heatmap := &ActivityHeatmap{CourseID: courseID, Timezone: currentUser.Timezone}
+	if tz := r.FormValue("tz"); tz != "" {
+		heatmap.Timezone = tz
+	}
+	if heatmap.Timezone == "" {
+		heatmap.Timezone = "UTC"
+	}
+	loc, err := LoadTimezone(heatmap.Timezone)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+		return nil
+	}
+	heatmap.End = time.Now()
+	if s := r.FormValue("end"); s != "" {
+		if heatmap.End, err = parseHeatmapTime(w, "end", s, loc); err != nil {
+			return nil
+		}
+		if len(s) == len("2006-01-02") {
+			heatmap.End = heatmap.End.AddDate(0, 0, 1)
+		}
+	}
+	heatmap.Start = heatmap.End.AddDate(0, 0, -DefaultHeatmapDays)
+	if s := r.FormValue("start"); s != "" {
+		if heatmap.Start, err = parseHeatmapTime(w, "start", s, loc); err != nil {
+			return nil
+		}
+	}
+	if !heatmap.Start.Before(heatmap.End) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "start must be before end")
+		return nil
+	}
+
+	rows, err := tx.Query(`SELECT EXTRACT(DOW FROM action_runs.created_at AT TIME ZONE $1)::int, `+
+		`EXTRACT(HOUR FROM action_runs.created_at AT TIME ZONE $1)::int, COUNT(*) `+
+		`FROM action_runs WHERE action_runs.action = 'grade' AND action_runs.created_at >= $2 AND action_runs.created_at < $3 `+
+		`AND ($4 = 0 OR action_runs.course_id = $4) `+
+		`AND NOT EXISTS (SELECT 1 FROM assignments WHERE assignments.user_id = action_runs.user_id `+
+		`AND assignments.course_id = action_runs.course_id AND assignments.instructor) `+
+		`GROUP BY 1, 2`, heatmap.Timezone, heatmap.Start, heatmap.End, courseID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day, hour, count int
+		if err := rows.Scan(&day, &hour, &count); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return nil
+		}
+		heatmap.Counts[day][hour] = count
+		heatmap.Total += count
+	}
+	if err := rows.Err(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return nil
+	}
+	return heatmap
+}
+
+// GetCourseHeatmap handles a request to /v2/courses/:course_id/heatmap,
+// returning a course's graded submissions counted by day of the week and
+// hour of the day, e.g., to schedule office hours. See buildHeatmap for
+// the parameters.
+func GetCourseHeatmap(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	if heatmap := buildHeatmap(w, r, tx, currentUser, courseID); heatmap != nil {
+		render.JSON(http.StatusOK, heatmap)
+	}
+}
+
+// GetHeatmap handles a request to /v2/heatmap, returning the graded
+// submissions of every course counted by day of the week and hour of the
+// day, e.g., to plan maintenance windows. See buildHeatmap for the
+// parameters.
+func GetHeatmap(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser *User, render render.Render) {
+	if heatmap := buildHeatmap(w, r, tx, currentUser, 0); heatmap != nil {
+		render.JSON(http.StatusOK, heatmap)
+	}
+}
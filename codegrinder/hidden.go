@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// A problem step can keep some of its test files hidden from students by
+// listing them in _grader/hidden, one pattern per line in the form accepted
+// by path.Match, e.g.:
+//
+//	tests/test_hidden.py
+//	in/secret-*
+//
+// Hidden files are never sent to students. They travel to the daycare
+// sealed with the daycare secret, and after grading the daycare seals the
+// results that mention them, together with the full transcript, into the
+// report card. Students see only how many hidden tests passed and failed
+// until the assignment is due, or always if RevealHiddenTests is set.
+// Instructors always see everything.
+
+// HiddenTestsList is the step file listing the hidden test files.
+const HiddenTestsList = "_grader/hidden"
+
+// hiddenTests describes the hidden test files of one step.
+type hiddenTests struct {
+	names    []string
+	mentions []*regexp.Regexp
+}
+
+// hiddenReport is what a report card withholds from students. When the
+// feedback level is limited, Card holds the whole report card instead of
+// the results of hidden tests.
+type hiddenReport struct {
+	Results    []*ReportCardResult `json:"results"`
+	Card       *ReportCard         `json:"card,omitempty"`
+	Transcript []*EventMessage     `json:"transcript"`
+}
+
+// hiddenPatterns returns the patterns listed in a step's hidden test list.
+func hiddenPatterns(files map[string]string) []string {
+	var patterns []string
+	for _, line := range strings.Split(files[HiddenTestsList], "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns
+}
+
+// isHiddenFile reports whether a step file matches one of the patterns,
+// looking past the variant directory for variant files.
+func isHiddenFile(patterns []string, name string) bool {
+	if name == HiddenTestsList {
+		return true
+	}
+	if strings.HasPrefix(name, VariantDirectory+"/") {
+		if parts := strings.SplitN(name, "/", 3); len(parts) == 3 {
+			name = parts[2]
+		}
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// omitHiddenTests removes the hidden test files and failure hints from steps
+// shown to students.
+func omitHiddenTests(steps ...*ProblemStep) {
+	for _, step := range steps {
+		delete(step.Files, HintsFile)
+		patterns := hiddenPatterns(step.Files)
+		if len(patterns) == 0 {
+			continue
+		}
+		for name := range step.Files {
+			if isHiddenFile(patterns, name) {
+				delete(step.Files, name)
+			}
+		}
+	}
+}
+
+// sealHiddenTests moves the hidden test files of each step into its
+// HiddenFiles, sealed so that only a daycare can read them.
+func sealHiddenTests(steps []*ProblemStep) error {
+	for _, step := range steps {
+		patterns := hiddenPatterns(step.Files)
+		if len(patterns) == 0 {
+			continue
+		}
+		hidden := make(map[string]string)
+		for name, contents := range step.Files {
+			if isHiddenFile(patterns, name) {
+				hidden[name] = contents
+				delete(step.Files, name)
+			}
+		}
+		sealed, err := sealWithSecret(hidden)
+		if err != nil {
+			return err
+		}
+		step.HiddenFiles = sealed
+	}
+	return nil
+}
+
+// openHiddenTests restores the hidden test files sealed by sealHiddenTests.
+func openHiddenTests(steps []*ProblemStep) error {
+	for _, step := range steps {
+		if len(step.HiddenFiles) == 0 {
+			continue
+		}
+		hidden := make(map[string]string)
+		if err := openWithSecret(step.HiddenFiles, &hidden); err != nil {
+			return fmt.Errorf("error opening hidden tests for step %d: %v", step.Step, err)
+		}
+		for name, contents := range hidden {
+			step.Files[name] = contents
+		}
+		step.HiddenFiles = nil
+	}
+	return nil
+}
+
+// findHiddenTests returns the hidden test files among the files being
+// graded, or nil if there are none.
+func findHiddenTests(files map[string]string) *hiddenTests {
+	patterns := hiddenPatterns(files)
+	if len(patterns) == 0 {
+		return nil
+	}
+	hidden := new(hiddenTests)
+	for name := range files {
+		if name == HiddenTestsList || !isHiddenFile(patterns, name) {
+			continue
+		}
+		hidden.names = append(hidden.names, name)
+
+		// unit test frameworks name results after the file, e.g.,
+		// tests.test_hidden.TestCase for tests/test_hidden.py
+		base := path.Base(name)
+		stem := strings.TrimSuffix(base, path.Ext(base))
+		hidden.mentions = append(hidden.mentions,
+			regexp.MustCompile(regexp.QuoteMeta(name)),
+			regexp.MustCompile(`(^|[^\w])`+regexp.QuoteMeta(stem)+`($|[^\w])`))
+	}
+	if len(hidden.names) == 0 {
+		return nil
+	}
+	return hidden
+}
+
+// mentioned reports whether text refers to a hidden test file.
+func (hidden *hiddenTests) mentioned(text string) bool {
+	for _, re := range hidden.mentions {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// visible reports whether an event can be shown to the student.
+func (hidden *hiddenTests) visible(event *EventMessage) bool {
+	switch event.Event {
+	case "exec", "stdin", "stdout", "stderr", "error":
+		return !hidden.mentioned(event.String())
+	}
+	return true
+}
+
+// withhold moves the results of hidden tests out of a report card and
+// seals them with the full transcript, returning the transcript the
+// student may see.
+func (hidden *hiddenTests) withhold(card *ReportCard, transcript []*EventMessage) ([]*EventMessage, error) {
+	report := &hiddenReport{Results: []*ReportCardResult{}, Transcript: transcript}
+	var results []*ReportCardResult
+	for _, result := range card.Results {
+		if !hidden.mentioned(result.Name) && !hidden.mentioned(result.Context) {
+			results = append(results, result)
+			continue
+		}
+		report.Results = append(report.Results, result)
+		switch result.Outcome {
+		case "passed":
+			card.HiddenPassed++
+		case "warning":
+		default:
+			card.HiddenFailed++
+		}
+	}
+	if len(report.Results) == 0 {
+		// nothing was withheld, so the transcript gives nothing away either
+		return transcript, nil
+	}
+	sealed, err := sealWithSecret(report)
+	if err != nil {
+		return nil, err
+	}
+	card.Results = results
+	if card.Results == nil {
+		card.Results = []*ReportCardResult{}
+	}
+	card.Hidden = sealed
+
+	var visible []*EventMessage
+	for _, event := range transcript {
+		if hidden.visible(event) {
+			visible = append(visible, event)
+		}
+	}
+	return visible, nil
+}
+
+// hiddenRevealed reports whether a user may see the hidden test results
+// of an assignment.
+func hiddenRevealed(tx *sql.Tx, currentUser *User, assignmentID int64) (bool, error) {
+	if currentUser.Admin || Config().RevealHiddenTests {
+		return true, nil
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		return false, err
+	}
+	if assignment.DueAt != nil && time.Now().After(*assignment.DueAt) {
+		return true, nil
+	}
+	return isCourseStaff(tx, currentUser, assignment.CourseID)
+}
+
+// revealHiddenTests puts withheld results and the full transcript back
+// into a commit if the user may see them. A report card limited by the
+// feedback level is replaced by the whole report card, which may in turn
+// withhold the results of hidden tests.
+func revealHiddenTests(tx *sql.Tx, currentUser *User, commit *Commit) error {
+	for commit.ReportCard != nil && len(commit.ReportCard.Hidden) > 0 {
+		card := commit.ReportCard
+		report := new(hiddenReport)
+		if err := openWithSecret(card.Hidden, report); err != nil {
+			return err
+		}
+		if report.Card != nil {
+			if level, err := studentFeedbackLevel(tx, currentUser, commit.AssignmentID); err != nil || level != FeedbackFull {
+				return err
+			}
+			commit.ReportCard, commit.Transcript = report.Card, report.Transcript
+			continue
+		}
+		if ok, err := hiddenRevealed(tx, currentUser, commit.AssignmentID); err != nil || !ok {
+			return err
+		}
+		card.Results = append(card.Results, report.Results...)
+		card.HiddenPassed, card.HiddenFailed, card.Hidden = 0, 0, nil
+		commit.Transcript = report.Transcript
+		return nil
+	}
+	return nil
+}
+
+// sealWithSecret encrypts a value with a key derived from the daycare
+// secret. The nonce is derived from the contents, so sealing the same
+// value twice gives the same result and signatures over it stay stable.
+func sealWithSecret(v interface{}) ([]byte, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	gcm, nonceKey, err := secretCipher()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:gcm.NonceSize()]
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// openWithSecret reverses sealWithSecret.
+func openWithSecret(sealed []byte, v interface{}) error {
+	gcm, _, err := secretCipher()
+	if err != nil {
+		return err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return fmt.Errorf("sealed data is truncated")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return fmt.Errorf("error decrypting sealed data: %v", err)
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+// secretCipher returns the cipher for sealing and the key for deriving nonces.
+func secretCipher() (cipher.AEAD, []byte, error) {
+	key := sha256.Sum256([]byte("codegrinder sealed key\x00" + Config().DaycareSecret))
+	nonceKey := sha256.Sum256([]byte("codegrinder sealed nonce\x00" + Config().DaycareSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, nonceKey[:], nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"path"
+	"strings"
+	"text/template"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// A problem step can give students hints for tests they keep failing by
+// including _grader/hints, a JSON list of hints:
+//
+//	[
+//	    {"test": "test_empty_list", "after": 2,
+//	     "hint": "What should {{.Test}} return when there is nothing to sum?"},
+//	    {"test": "tests.test_sort.*", "after": 3,
+//	     "hint": "You have failed {{.Test}} {{.Failures}} times; try a list with duplicates."}
+//	]
+//
+// A test is named exactly or with a pattern in the form accepted by
+// path.Match. The server counts how many times each student has failed each
+// test, and once the count reaches "after" (1 if omitted) the first matching
+// hint is added to the failed result in the report card. Hints are templates
+// that can use .Test, .Failures, and .Context. The hints file itself is
+// never sent to students or to the daycare.
+
+// HintsFile is the step file listing failure hints.
+const HintsFile = "_grader/hints"
+
+// failureHint is one entry in a step's hints file.
+type failureHint struct {
+	Test  string `json:"test"`
+	After int    `json:"after"`
+	Hint  string `json:"hint"`
+}
+
+// hintData is what a hint template can refer to.
+type hintData struct {
+	Test     string
+	Failures int
+	Context  string
+}
+
+// takeHints removes the hints files from problem steps, returning them
+// by step number.
+func takeHints(steps []*ProblemStep) map[int64]string {
+	hints := make(map[int64]string)
+	for _, step := range steps {
+		if contents, present := step.Files[HintsFile]; present {
+			hints[step.Step] = contents
+			delete(step.Files, HintsFile)
+		}
+	}
+	return hints
+}
+
+// parseHints parses a hints file.
+func parseHints(contents string) ([]*failureHint, error) {
+	var hints []*failureHint
+	if err := json.Unmarshal([]byte(contents), &hints); err != nil {
+		return nil, err
+	}
+	for _, hint := range hints {
+		if hint.After < 1 {
+			hint.After = 1
+		}
+	}
+	return hints, nil
+}
+
+// matches reports whether a hint applies to a test.
+func (hint *failureHint) matches(test string) bool {
+	if hint.Test == test {
+		return true
+	}
+	matched, _ := path.Match(hint.Test, test)
+	return matched
+}
+
+// applyFailureHints counts the failed results of a graded commit against
+// the student and adds the author's hint to each failure that has been
+// repeated often enough. A broken hints file is logged and otherwise
+// ignored, since it should not get in the way of grading.
+func applyFailureHints(tx *sql.Tx, commit *Commit, contents string) error {
+	card := commit.ReportCard
+	if card == nil {
+		return nil
+	}
+	var hints []*failureHint
+	if contents != "" {
+		var err error
+		if hints, err = parseHints(contents); err != nil {
+			log.Printf("error parsing %s for problem %d step %d: %v", HintsFile, commit.ProblemID, commit.Step, err)
+			hints = nil
+		}
+	}
+	for _, result := range card.Results {
+		if result.Outcome != "failed" && result.Outcome != "error" {
+			continue
+		}
+		var failures int
+		if err := tx.QueryRow(`INSERT INTO test_failures (assignment_id, problem_id, step, test, failures) `+
+			`VALUES ($1, $2, $3, $4, 1) `+
+			`ON CONFLICT (assignment_id, problem_id, step, test) DO UPDATE SET failures = test_failures.failures + 1 `+
+			`RETURNING failures`,
+			commit.AssignmentID, commit.ProblemID, commit.Step, result.Name).Scan(&failures); err != nil {
+			return err
+		}
+		for _, hint := range hints {
+			if !hint.matches(result.Name) {
+				continue
+			}
+			if failures >= hint.After {
+				result.Hint = renderHint(hint, &hintData{Test: result.Name, Failures: failures, Context: result.Context})
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// renderHint fills in a hint template, falling back to the raw text if the
+// template is broken.
+func renderHint(hint *failureHint, data *hintData) string {
+	tmpl, err := template.New("hint").Parse(hint.Hint)
+	if err != nil {
+		log.Printf("error parsing hint for test %s: %v", hint.Test, err)
+		return strings.TrimSpace(hint.Hint)
+	}
+	out := new(bytes.Buffer)
+	if err := tmpl.Execute(out, data); err != nil {
+		log.Printf("error filling in hint for test %s: %v", hint.Test, err)
+		return strings.TrimSpace(hint.Hint)
+	}
+	return strings.TrimSpace(out.String())
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	. "github.com/russross/codegrinder/types"
+)
+
+// ImagePullReportInterval is the minimum time between progress reports
+// while an image is downloading, unless a layer finishes in the meantime.
+const ImagePullReportInterval = 2 * time.Second
+
+// imagePulls tracks downloads in progress so that concurrent requests for
+// the same image wait for a single download.
+var imagePulls = struct {
+	sync.Mutex
+	active map[string]chan struct{}
+}{active: make(map[string]chan struct{})}
+
+// problemTypeImages lists the images needed to run actions for a problem type.
+func problemTypeImages(problemType *ProblemType) []string {
+	images := []string{problemType.Image}
+	for _, service := range problemType.Services {
+		images = append(images, service.Image)
+	}
+	if Config().FirewallImage != "" {
+		images = append(images, Config().FirewallImage)
+	}
+	return images
+}
+
+// ensureImage makes sure an image is present on this daycare, downloading
+// it if necessary. The progress function, if not nil, is called as the
+// download proceeds.
+func ensureImage(image string, progress func(*ImagePull)) error {
+	if progress == nil {
+		progress = func(*ImagePull) {}
+	}
+	if _, err := dockerClient.InspectImage(image); err == nil {
+		return nil
+	} else if err != docker.ErrNoSuchImage {
+		return err
+	}
+
+	imagePulls.Lock()
+	if done, ok := imagePulls.active[image]; ok {
+		imagePulls.Unlock()
+		progress(&ImagePull{Image: image, Status: "waiting"})
+		<-done
+		if _, err := dockerClient.InspectImage(image); err != nil {
+			return fmt.Errorf("image %s is not available after download: %v", image, err)
+		}
+		progress(&ImagePull{Image: image, Status: "complete", Percent: 100})
+		return nil
+	}
+	done := make(chan struct{})
+	imagePulls.active[image] = done
+	imagePulls.Unlock()
+	defer func() {
+		imagePulls.Lock()
+		delete(imagePulls.active, image)
+		imagePulls.Unlock()
+		close(done)
+	}()
+
+	log.Printf("pulling image %s", image)
+	start := time.Now()
+	if err := pullImage(image, progress); err != nil {
+		log.Printf("error pulling image %s: %v", image, err)
+		return err
+	}
+	log.Printf("pulled image %s in %v", image, time.Since(start))
+	return nil
+}
+
+// pullMessage is one message in the JSON stream docker sends during a pull.
+type pullMessage struct {
+	Status         string `json:"status"`
+	ID             string `json:"id"`
+	Error          string `json:"error"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+}
+
+type layerProgress struct {
+	current, total int64
+	done           bool
+}
+
+func pullImage(image string, progress func(*ImagePull)) error {
+	repository, tag := docker.ParseRepositoryTag(image)
+	if tag == "" {
+		tag = "latest"
+	}
+	reader, writer := io.Pipe()
+	finished := make(chan error, 1)
+	go func() {
+		err := dockerClient.PullImage(docker.PullImageOptions{
+			Repository:        repository,
+			Tag:               tag,
+			OutputStream:      writer,
+			RawJSONStream:     true,
+			InactivityTimeout: 5 * time.Minute,
+		}, docker.AuthConfiguration{})
+		writer.CloseWithError(err)
+		finished <- err
+	}()
+
+	layers := make(map[string]*layerProgress)
+	var order []string
+	var lastReport time.Time
+	lastDone := -1
+	decoder := json.NewDecoder(reader)
+	for {
+		msg := new(pullMessage)
+		if err := decoder.Decode(msg); err == io.EOF {
+			break
+		} else if err != nil {
+			reader.CloseWithError(err)
+			<-finished
+			return err
+		}
+		if msg.Error != "" {
+			reader.CloseWithError(io.ErrClosedPipe)
+			<-finished
+			return fmt.Errorf("%s", msg.Error)
+		}
+
+		// messages about the image as a whole use the tag as their ID
+		if msg.ID == "" || msg.ID == tag {
+			continue
+		}
+		layer, ok := layers[msg.ID]
+		if !ok {
+			layer = new(layerProgress)
+			layers[msg.ID] = layer
+			order = append(order, msg.ID)
+		}
+		switch msg.Status {
+		case "Downloading":
+			layer.current, layer.total = msg.ProgressDetail.Current, msg.ProgressDetail.Total
+		case "Download complete":
+			layer.current = layer.total
+		case "Pull complete", "Already exists":
+			layer.current, layer.done = layer.total, true
+		}
+
+		report := summarizePull(image, layers, order)
+		if report.LayersDone != lastDone || time.Since(lastReport) >= ImagePullReportInterval {
+			progress(report)
+			lastReport, lastDone = time.Now(), report.LayersDone
+		}
+	}
+	if err := <-finished; err != nil {
+		return err
+	}
+	progress(&ImagePull{Image: image, Status: "complete", Layers: len(layers), LayersDone: len(layers), Percent: 100})
+	return nil
+}
+
+func summarizePull(image string, layers map[string]*layerProgress, order []string) *ImagePull {
+	report := &ImagePull{Image: image, Status: "pulling", Layers: len(order)}
+	var current, total int64
+	for _, id := range order {
+		layer := layers[id]
+		if layer.done {
+			report.LayersDone++
+		}
+		current += layer.current
+		total += layer.total
+	}
+	if total > 0 {
+		report.Percent = int(current * 100 / total)
+	}
+	return report
+}
+
+// prepullSignature signs a request for a daycare to download images.
+func prepullSignature(timestamp string, images []string) string {
+	mac := hmac.New(sha256.New, []byte(Config().DaycareSecret))
+	mac.Write([]byte(timestamp + "\n" + strings.Join(images, "\n")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// prepullImages asks every daycare to download the images needed for a
+// problem type in the background, so the first student to use a newly
+// published problem does not have to wait for them.
+// If this server also runs the daycare role, it pulls the images itself.
+func prepullImages(problemType *ProblemType) {
+	if problemType == nil {
+		return
+	}
+	images := problemTypeImages(problemType)
+	if dockerClient != nil {
+		go func() {
+			for _, image := range images {
+				ensureImage(image, nil)
+			}
+		}()
+	}
+	for _, host := range Config().DaycareHosts {
+		if host == Config().Hostname && dockerClient != nil {
+			continue
+		}
+		go func(host string) {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			form := url.Values{"image": images, "timestamp": {timestamp}, "signature": {prepullSignature(timestamp, images)}}
+			resp, err := http.PostForm("https://"+host+"/v2/daycare/prepull", form)
+			if err != nil {
+				log.Printf("error asking daycare %s to pull images: %v", host, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusAccepted {
+				log.Printf("daycare %s refused to pull images: %s", host, resp.Status)
+			}
+		}(host)
+	}
+}
+
+// PostDaycarePrepull handles a request to /v2/daycare/prepull,
+// starting background downloads of the listed images.
+// The request must be signed with the daycare secret.
+func PostDaycarePrepull(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	list := r.PostForm["image"]
+	if len(list) == 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "no images listed")
+		return
+	}
+	timestamp := r.PostFormValue("timestamp")
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing timestamp: %v", err)
+		return
+	}
+	age := time.Since(time.Unix(secs, 0))
+	if age < 0 {
+		age = -age
+	}
+	if age > MaxDaycareRequestAge {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "request is %v old, cannot be more than %v", age, MaxDaycareRequestAge)
+		return
+	}
+	if !hmac.Equal([]byte(r.PostFormValue("signature")), []byte(prepullSignature(timestamp, list))) {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "signature mismatch")
+		return
+	}
+
+	go func() {
+		for _, image := range list {
+			ensureImage(image, nil)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
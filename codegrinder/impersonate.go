@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessions"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Impersonation lets an administrator see the system as a student does.
+// While it is active, the administrator's session carries the target user ID
+// and withCurrentUser loads that user instead of the administrator.
+
+const (
+	ImpersonateReadOnly = "readonly"
+	ImpersonateFull     = "full"
+)
+
+// Impersonation describes an active impersonation session.
+type Impersonation struct {
+	User    *User     `json:"user"`
+	AdminID int64     `json:"adminID"`
+	Mode    string    `json:"mode"`
+	Expires time.Time `json:"expires"`
+}
+
+// activeImpersonation returns the impersonation details stored in a session,
+// or ok=false if there is none or it has expired. Expired details are removed.
+func activeImpersonation(session sessions.Session, now time.Time) (targetID, adminID int64, mode string, ok bool) {
+	rawTarget, rawAdmin, rawMode, rawExpires := session.Get("impersonate_id"), session.Get("impersonator_id"), session.Get("impersonate_mode"), session.Get("impersonate_expires")
+	if rawTarget == nil {
+		return 0, 0, "", false
+	}
+	targetID, ok1 := rawTarget.(int64)
+	adminID, ok2 := rawAdmin.(int64)
+	mode, ok3 := rawMode.(string)
+	expires, ok4 := rawExpires.(int64)
+	if !ok1 || !ok2 || !ok3 || !ok4 || now.Unix() >= expires {
+		clearImpersonation(session)
+		return 0, 0, "", false
+	}
+	return targetID, adminID, mode, true
+}
+
+func clearImpersonation(session sessions.Session) {
+	session.Delete("impersonate_id")
+	session.Delete("impersonator_id")
+	session.Delete("impersonate_mode")
+	session.Delete("impersonate_expires")
+}
+
+// impersonationAllowed checks if a request may proceed under impersonation,
+// and logs it so staff activity on a student's behalf can be traced.
+// Requests that change anything are also tagged with the administrator's ID
+// in the audit log. API tokens cannot be created or exchanged, as a token
+// would let the administrator act as the user after impersonation ends.
+func impersonationAllowed(w http.ResponseWriter, r *http.Request, adminID int64, user *User, mode string) bool {
+	log.Printf("impersonation: admin %d as user %d (%s): %s %s", adminID, user.ID, user.Name, r.Method, r.URL.Path)
+	if mode == ImpersonateReadOnly && r.Method != "GET" && r.Method != "HEAD" {
+		loggedHTTPErrorf(w, http.StatusForbidden, "impersonation of user %d is read-only", user.ID)
+		return false
+	}
+	if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/v2/users/me/tokens") {
+		loggedHTTPErrorf(w, http.StatusForbidden, "API tokens cannot be created while impersonating user %d", user.ID)
+		return false
+	}
+	return true
+}
+
+// PostUserImpersonate handles a request to /v2/users/:user_id/impersonate,
+// switching the current administrator's session to act as the given user
+// for a limited time and returning the impersonation details.
+//
+// If parameter mode=full is present, requests that modify data are allowed.
+// Otherwise the session is read-only.
+func PostUserImpersonate(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, session sessions.Session, audit *AuditEntry, render render.Render) {
+	userID, err := parseID(w, "user_id", params["user_id"])
+	if err != nil {
+		return
+	}
+	mode := r.FormValue("mode")
+	switch mode {
+	case "":
+		mode = ImpersonateReadOnly
+	case ImpersonateReadOnly, ImpersonateFull:
+	default:
+		loggedHTTPErrorf(w, http.StatusBadRequest, "mode must be %q or %q", ImpersonateReadOnly, ImpersonateFull)
+		return
+	}
+
+	user := new(User)
+	if err := meddler.Load(tx, "users", user, userID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	expires := time.Now().Add(time.Duration(Config().ImpersonationMinutes) * time.Minute)
+	session.Set("impersonate_id", user.ID)
+	session.Set("impersonator_id", currentUser.ID)
+	session.Set("impersonate_mode", mode)
+	session.Set("impersonate_expires", expires.Unix())
+	log.Printf("impersonation: admin %d (%s) started %s impersonation of user %d (%s) until %v",
+		currentUser.ID, currentUser.Name, mode, user.ID, user.Name, expires)
+	audit.Record(AuditImpersonation, user.ID, "started %s impersonation until %s", mode, expires.Format(time.RFC3339))
+
+	render.JSON(http.StatusOK, &Impersonation{User: user, AdminID: currentUser.ID, Mode: mode, Expires: expires})
+}
+
+// DeleteUserImpersonate handles a request to /v2/users/me/impersonate,
+// ending any active impersonation and returning to the administrator's own
+// identity.
+func DeleteUserImpersonate(w http.ResponseWriter, session sessions.Session, audit *AuditEntry) {
+	if targetID, adminID, _, ok := activeImpersonation(session, time.Now()); ok {
+		log.Printf("impersonation: admin %d ended impersonation of user %d", adminID, targetID)
+		audit.UserID = adminID
+		audit.Record(AuditImpersonation, targetID, "ended impersonation")
+	}
+	clearImpersonation(session)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// Java problems are compiled together with the instructor's JUnit 5 tests,
+// which live in tests/, and graded with the JUnit console launcher. Each
+// test is limited to the problem type's MaxCPU seconds by default; a
+// "timeout=<seconds>" problem option sets a shorter per-test limit. The
+// whole run must still fit within MaxCPU.
+
+// JavaTimeoutOption is the prefix of the problem option giving the per-test
+// time limit in seconds.
+const JavaTimeoutOption = "timeout="
+
+const (
+	javaJUnitJar  = "/usr/local/lib/junit-platform-console-standalone.jar"
+	javaBuildDir  = "/tmp/build"
+	javaReportDir = "/tmp/reports"
+)
+
+// junitTestSuite is the part of a JUnit XML report that the grader uses.
+type junitTestSuite struct {
+	TestCases []*junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure"`
+	Error     *junitProblem `xml:"error"`
+	Skipped   *junitProblem `xml:"skipped"`
+	SystemOut string        `xml:"system-out"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Trace   string `xml:",chardata"`
+}
+
+func init() {
+	problemTypes["javaunit"] = &ProblemType{
+		Name:        "javaunit",
+		Image:       "codegrinder/java",
+		MaxCPU:      30,
+		MaxFD:       100,
+		MaxFileSize: 10,
+		MaxMemory:   512,
+		MaxThreads:  100,
+		Actions: map[string]*ProblemTypeAction{
+			"grade": &ProblemTypeAction{
+				Action:  "grade",
+				Button:  "Grade",
+				Message: "Grading‥",
+				Class:   "btn-grade",
+				Handler: nannyHandler(javaUnitGrade),
+			},
+			"": &ProblemTypeAction{
+				Action: "",
+				Button: "Save",
+				Class:  "btn-save",
+			},
+			"confirm": &ProblemTypeAction{
+				Action:  "confirm",
+				Handler: nannyHandler(javaUnitGrade),
+			},
+		},
+	}
+}
+
+func javaUnitGrade(n *Nanny, args []string, options []string, files map[string]string) {
+	log.Printf("javaUnitGrade")
+
+	// work out the per-test time limit
+	timeout := problemTypes["javaunit"].MaxCPU
+	for _, option := range options {
+		if !strings.HasPrefix(option, JavaTimeoutOption) {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimPrefix(option, JavaTimeoutOption))
+		if err != nil || seconds < 1 {
+			n.ReportCard.LogAndFailf("invalid problem option %q: must be a number of seconds", option)
+			return
+		}
+		if seconds < timeout {
+			timeout = seconds
+		}
+	}
+
+	// put the files in the container
+	if err := n.PutFiles(files); err != nil {
+		n.ReportCard.LogAndFailf("PutFiles error: %v", err)
+		return
+	}
+
+	// compile the student and instructor sources together
+	compile := fmt.Sprintf("find . -name '*.java' > /tmp/sources.txt && javac -encoding UTF-8 -d %s -cp %s @/tmp/sources.txt", javaBuildDir, javaJUnitJar)
+	_, stderr, _, status, err := n.ExecNonInteractive([]string{"sh", "-c", compile})
+	if err != nil {
+		n.ReportCard.LogAndFailf("exec error: %v", err)
+		return
+	}
+	if status != 0 {
+		n.ReportCard.AddFailedResult("compile", "<h1>Compile failed</h1>\n"+htmlEscapePre(stderr.String()), javaErrorContext(stderr.String()))
+		n.ReportCard.Duration = time.Since(n.Start)
+		n.ReportCard.Note = "compile failed"
+		return
+	}
+
+	// run the tests
+	_, stderr, _, status, err = n.ExecNonInteractive([]string{
+		"java", "-Xmx384m", "-jar", javaJUnitJar, "execute",
+		"--class-path", javaBuildDir,
+		"--scan-class-path",
+		"--disable-banner",
+		"--details=none",
+		"--reports-dir", javaReportDir,
+		"--config", fmt.Sprintf("junit.jupiter.execution.timeout.default=%ds", timeout),
+	})
+	if err != nil {
+		n.ReportCard.LogAndFailf("exec error: %v", err)
+		return
+	}
+	report, _, _, reportStatus, err := n.ExecNonInteractive([]string{"cat", javaReportDir + "/TEST-junit-jupiter.xml"})
+	if err != nil {
+		n.ReportCard.LogAndFailf("exec error: %v", err)
+		return
+	}
+	if reportStatus != 0 {
+		n.ReportCard.Failf("unable to run unit tests")
+		n.ReportCard.AddFailedResult("junit", htmlEscapePre(stderr.String()), "")
+		return
+	}
+	suite := new(junitTestSuite)
+	if err := xml.Unmarshal(report.Bytes(), suite); err != nil {
+		n.ReportCard.LogAndFailf("error parsing test report: %v", err)
+		return
+	}
+
+	failed := 0
+	for _, test := range suite.TestCases {
+		name := strings.TrimSuffix(test.Name, "()")
+		if test.ClassName != "" {
+			name = test.ClassName[strings.LastIndex(test.ClassName, ".")+1:] + "." + name
+		}
+		problem := test.Failure
+		if problem == nil {
+			problem = test.Error
+		}
+		switch {
+		case test.Skipped != nil:
+			// disabled tests do not count either way
+			continue
+		case problem == nil:
+			n.ReportCard.AddPassedResult(name, htmlEscapePara(fmt.Sprintf("passed in %ss", test.Time)))
+		default:
+			failed++
+			details := "<h1>Test failed</h1>\n" + htmlEscapePara(problem.Message) + htmlEscapePre(strings.TrimSpace(problem.Trace))
+			if out := strings.TrimSpace(test.SystemOut); out != "" {
+				details += "<h1>Output</h1>\n" + htmlEscapePre(out)
+			}
+			n.ReportCard.AddFailedResult(name, details, javaTraceContext(problem.Trace, test.ClassName))
+		}
+	}
+	if len(n.ReportCard.Results) == 0 {
+		n.ReportCard.Failf("no unit test results found")
+	} else if status != 0 && failed == 0 {
+		n.ReportCard.Failf("test runner exited with status %d", status)
+	}
+	n.ReportCard.Duration = time.Since(n.Start)
+
+	if n.ReportCard.Note == "" {
+		n.ReportCard.Note = fmt.Sprintf("%d/%d tests passed in %v", len(n.ReportCard.Results)-failed, len(n.ReportCard.Results), n.ReportCard.Duration)
+	}
+}
+
+var (
+	javacErrorLine = regexp.MustCompile(`(?m)^(?:\./)?(\S+\.java):(\d+): error:`)
+	javaTraceLine  = regexp.MustCompile(`at ([\w$.]+)\.[\w$<>]+\((\w+\.java):(\d+)\)`)
+)
+
+// javaErrorContext finds the location of the first compile error.
+func javaErrorContext(output string) string {
+	if groups := javacErrorLine.FindStringSubmatch(output); groups != nil {
+		return groups[1] + ":" + groups[2]
+	}
+	return ""
+}
+
+// javaTraceContext finds the line of a test class in a stack trace, falling
+// back to the first line of any class that has a source file.
+func javaTraceContext(trace, className string) string {
+	fallback := ""
+	for _, groups := range javaTraceLine.FindAllStringSubmatch(trace, -1) {
+		if groups[1] == className {
+			return "tests/" + groups[2] + ":" + groups[3]
+		}
+		if fallback == "" {
+			fallback = groups[2] + ":" + groups[3]
+		}
+	}
+	return fallback
+}
@@ -43,6 +43,7 @@ type LTIRequest struct {
 	TCInstanceVersion                string  `form:"tool_consumer_info_version"`               // cloud
 	TCInfoProductFamilyCode          string  `form:"tool_consumer_info_product_family_code"`   // canvas
 	CourseOfferingSourceDID          string  `form:"lis_course_offering_sourcedid"`            // CCRSCS-3520-42527.201440
+	CourseSectionSourcedID           string  `form:"lis_course_section_sourcedid"`             // CS-3520-01.201440
 	ContextTitle                     string  `form:"context_title"`                            // CS-3520-01 FA14
 	ContextLabel                     string  `form:"context_label"`                            // CS-3520
 	ContextID                        string  `form:"context_id"`                               // <opaque>: unique per course
@@ -61,6 +62,11 @@ type LTIRequest struct {
 	CanvasAssignmentTitle            string  `form:"custom_canvas_assignment_title"`           // YouFace Template
 	CanvasAssignmentID               int64   `form:"custom_canvas_assignment_id"`              // 1566693
 	CanvasAPIDomain                  string  `form:"custom_canvas_api_domain"`                 // dixie.instructure.com
+	CanvasAssignmentDueAt            string  `form:"custom_canvas_assignment_due_at"`          // 2014-10-20T23:59:00-06:00 (with any override for this user)
+	CanvasAssignmentLockAt           string  `form:"custom_canvas_assignment_lock_at"`         // 2014-10-27T23:59:00-06:00 (with any override for this user)
+	PersonTimezone                   string  `form:"custom_person_address_timezone"`           // America/Denver
+	ContextMembershipsURL            string  `form:"custom_context_memberships_url"`           // https://... to get the course roster
+	ExtIMSMembershipsURL             string  `form:"ext_ims_lis_memberships_url"`              // https://... to get the course roster (older LMSes)
 	OAuthVersion                     string  `form:"oauth_version"`                            // 1.0
 	OAuthSignature                   string  `form:"oauth_signature"`                          // <opaque> base64
 	OAuthSignatureMethod             string  `form:"oauth_signature_method"`                   // HMAC-SHA1
@@ -85,19 +91,20 @@ type GradeResponse struct {
 
 // LTIConfig is the XML format to configure the LMS to use this tool.
 type LTIConfig struct {
-	XMLName         xml.Name            `xml:"cartridge_basiclti_link"`
-	Namespace       string              `xml:"xmlns,attr"`
-	NamespaceBLTI   string              `xml:"xmlns:blti,attr"`
-	NamespaceLTICM  string              `xml:"xmlns:lticm,attr"`
-	NamespaceLTICP  string              `xml:"xmlns:lticp,attr"`
-	NamespaceXSI    string              `xml:"xmlns:xsi,attr"`
-	SchemaLocation  string              `xml:"xsi:schemaLocation,attr"`
-	Title           string              `xml:"blti:title"`
-	Description     string              `xml:"blti:description"`
-	Icon            string              `xml:"blti:icon"`
-	Extensions      LTIConfigExtensions `xml:"blti:extensions"`
-	CartridgeBundle LTICartridge        `xml:"cartridge_bundle"`
-	CartridgeIcon   LTICartridge        `xml:"cartridge_icon"`
+	XMLName         xml.Name             `xml:"cartridge_basiclti_link"`
+	Namespace       string               `xml:"xmlns,attr"`
+	NamespaceBLTI   string               `xml:"xmlns:blti,attr"`
+	NamespaceLTICM  string               `xml:"xmlns:lticm,attr"`
+	NamespaceLTICP  string               `xml:"xmlns:lticp,attr"`
+	NamespaceXSI    string               `xml:"xmlns:xsi,attr"`
+	SchemaLocation  string               `xml:"xsi:schemaLocation,attr"`
+	Title           string               `xml:"blti:title"`
+	Description     string               `xml:"blti:description"`
+	Icon            string               `xml:"blti:icon"`
+	Extensions      LTIConfigExtensions  `xml:"blti:extensions"`
+	Custom          []LTIConfigExtension `xml:"blti:custom>lticm:property"`
+	CartridgeBundle LTICartridge         `xml:"cartridge_bundle"`
+	CartridgeIcon   LTICartridge         `xml:"cartridge_icon"`
 }
 
 // LTIConfigExtensions is the XML format for Canvas extensions to LTI configuration.
@@ -138,21 +145,21 @@ func GetConfigXML(w http.ResponseWriter) {
 			" http://www.imsglobal.org/xsd/imsbasiclti_v1p0 http://www.imsglobal.org/xsd/lti/ltiv1p0/imsbasiclti_v1p0.xsd" +
 			" http://www.imsglobal.org/xsd/imslticm_v1p0 http://www.imsglobal.org/xsd/lti/ltiv1p0/imslticm_v1p0.xsd" +
 			" http://www.imsglobal.org/xsd/imslticp_v1p0 http://www.imsglobal.org/xsd/lti/ltiv1p0/imslticp_v1p0.xsd",
-		Title:       Config.ToolName,
-		Description: Config.ToolDescription,
+		Title:       Config().ToolName,
+		Description: Config().ToolDescription,
 		Extensions: LTIConfigExtensions{
 			Platform: "canvas.instructure.com",
 			Extensions: []LTIConfigExtension{
-				LTIConfigExtension{Name: "tool_id", Value: Config.ToolID},
+				LTIConfigExtension{Name: "tool_id", Value: Config().ToolID},
 				LTIConfigExtension{Name: "privacy_level", Value: "public"},
-				LTIConfigExtension{Name: "domain", Value: Config.Hostname},
+				LTIConfigExtension{Name: "domain", Value: Config().Hostname},
 			},
 			Options: []LTIConfigOptions{
 				LTIConfigOptions{
 					Name: "resource_selection",
 					Options: []LTIConfigExtension{
-						LTIConfigExtension{Name: "url", Value: "https://" + Config.Hostname + "/v2/lti/problem_sets"},
-						LTIConfigExtension{Name: "text", Value: Config.ToolName},
+						LTIConfigExtension{Name: "url", Value: "https://" + Config().Hostname + "/v2/lti/problem_sets"},
+						LTIConfigExtension{Name: "text", Value: Config().ToolName},
 						LTIConfigExtension{Name: "selection_width", Value: "320"},
 						LTIConfigExtension{Name: "selection_height", Value: "640"},
 						LTIConfigExtension{Name: "enabled", Value: "true"},
@@ -160,6 +167,12 @@ func GetConfigXML(w http.ResponseWriter) {
 				},
 			},
 		},
+		Custom: []LTIConfigExtension{
+			LTIConfigExtension{Name: "canvas_assignment_due_at", Value: "$Canvas.assignment.dueAt.iso8601"},
+			LTIConfigExtension{Name: "canvas_assignment_lock_at", Value: "$Canvas.assignment.lockAt.iso8601"},
+			LTIConfigExtension{Name: "person_address_timezone", Value: "$Person.address.timezone"},
+			LTIConfigExtension{Name: "context_memberships_url", Value: "$ToolProxyBinding.memberships.url"},
+		},
 		CartridgeBundle: LTICartridge{IdentifierRef: "BLTI001_Bundle"},
 		CartridgeIcon:   LTICartridge{IdentifierRef: "BLTI001_Icon"},
 	}
@@ -195,7 +208,7 @@ func signXMLRequest(consumerKey, method, targetURL, content, secret string) stri
 
 	// form the Authorization header
 	var buf bytes.Buffer
-	buf.WriteString(fmt.Sprintf(`OAuth realm="%s"`, escape("https://"+Config.Hostname)))
+	buf.WriteString(fmt.Sprintf(`OAuth realm="%s"`, escape("https://"+Config().Hostname)))
 	for key, val := range v {
 		buf.WriteString(fmt.Sprintf(`,%s="%s"`, key, escape(val[0])))
 	}
@@ -231,7 +244,7 @@ func checkOAuthSignature(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// compute the signature
-	sig := computeOAuthSignature(r.Method, getMyURL(r, true).String(), r.Form, Config.LTISecret)
+	sig := computeOAuthSignature(r.Method, getMyURL(r, true).String(), r.Form, Config().LTISecret)
 
 	// verify it
 	if sig != expected {
@@ -351,6 +364,12 @@ func LtiProblemSet(w http.ResponseWriter, r *http.Request, tx *sql.Tx, form LTIR
 		return
 	}
 
+	// record the enrollment
+	if err := getUpdateEnrollment(tx, &form, now, course, user); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
 	// load the assignment
 	asst, err := getUpdateAssignment(tx, &form, now, course, problemSet, user)
 	if err != nil {
@@ -374,7 +393,8 @@ func LtiProblemSets(w http.ResponseWriter, r *http.Request, tx *sql.Tx, form LTI
 	now := time.Now()
 
 	// load the coarse
-	if _, err := getUpdateCourse(tx, &form, now); err != nil {
+	course, err := getUpdateCourse(tx, &form, now)
+	if err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
@@ -386,6 +406,12 @@ func LtiProblemSets(w http.ResponseWriter, r *http.Request, tx *sql.Tx, form LTI
 		return
 	}
 
+	// record the enrollment
+	if err := getUpdateEnrollment(tx, &form, now, course, user); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
 	// sign the user in
 	session.Set("id", user.ID)
 
@@ -430,6 +456,21 @@ func getUpdateUser(tx *sql.Tx, form *LTIRequest, now time.Time) (*User, error) {
 	user.ImageURL = form.UserImage
 	user.CanvasLogin = form.CanvasUserLoginID
 	user.CanvasID = form.CanvasUserID
+
+	// take the timezone from the LMS unless the user has chosen one
+	if user.Timezone == "" && form.PersonTimezone != "" {
+		if _, err := LoadTimezone(form.PersonTimezone); err != nil {
+			log.Printf("ignoring timezone for user %s (%s): %v", form.UserID, form.PersonContactEmailPrimary, err)
+		} else {
+			user.Timezone = form.PersonTimezone
+			changed = true
+		}
+	}
+	// use the language from the LMS to pick localized expected output
+	if locale := LocaleLanguage(form.LaunchPresentationLocale); locale != "" && locale != user.Locale {
+		user.Locale = locale
+		changed = true
+	}
 	if user.ID > 0 && changed {
 		// if something changed, note the update time
 		log.Printf("user %d (%s) updated", user.ID, user.Email)
@@ -460,17 +501,30 @@ func getUpdateCourse(tx *sql.Tx, form *LTIRequest, now time.Time) (*Course, erro
 		course.UpdatedAt = now
 	}
 
+	// keep the last roster URL the LMS gave us
+	membershipsURL := form.ContextMembershipsURL
+	if membershipsURL == "" || strings.HasPrefix(membershipsURL, "$") {
+		membershipsURL = form.ExtIMSMembershipsURL
+	}
+	if membershipsURL == "" {
+		membershipsURL = course.MembershipsURL
+	}
+
 	// any changes?
 	changed := course.Name != form.ContextTitle ||
 		course.Label != form.ContextLabel ||
 		course.LtiID != form.ContextID ||
-		course.CanvasID != form.CanvasCourseID
+		course.CanvasID != form.CanvasCourseID ||
+		course.MembershipsURL != membershipsURL ||
+		course.ConsumerKey != form.OAuthConsumerKey
 
 	// make any changes
 	course.Name = form.ContextTitle
 	course.Label = form.ContextLabel
 	course.LtiID = form.ContextID
 	course.CanvasID = form.CanvasCourseID
+	course.MembershipsURL = membershipsURL
+	course.ConsumerKey = form.OAuthConsumerKey
 	if course.ID < 1 || changed {
 		// if something changed, note the update time and save
 		if course.ID > 0 {
@@ -505,6 +559,26 @@ func getUpdateAssignment(tx *sql.Tx, form *LTIRequest, now time.Time, course *Co
 		asst.UpdatedAt = now
 	}
 
+	// Canvas reports the due date for this user, with any override applied
+	var dueAt *time.Time
+	if form.CanvasAssignmentDueAt != "" {
+		if t, err := time.Parse(time.RFC3339, form.CanvasAssignmentDueAt); err == nil {
+			dueAt = &t
+		} else {
+			log.Printf("unable to parse due date %q for user %d: %v", form.CanvasAssignmentDueAt, user.ID, err)
+		}
+	}
+
+	// after the lock date, the assignment is finalized
+	var lockAt *time.Time
+	if form.CanvasAssignmentLockAt != "" {
+		if t, err := time.Parse(time.RFC3339, form.CanvasAssignmentLockAt); err == nil {
+			lockAt = &t
+		} else {
+			log.Printf("unable to parse lock date %q for user %d: %v", form.CanvasAssignmentLockAt, user.ID, err)
+		}
+	}
+
 	// any changes?
 	changed := asst.CourseID != course.ID ||
 		asst.ProblemSetID != problemSet.ID ||
@@ -520,7 +594,11 @@ func getUpdateAssignment(tx *sql.Tx, form *LTIRequest, now time.Time, course *Co
 		asst.OutcomeExtURL != form.ExtIMSBasicOutcomeURL ||
 		asst.OutcomeExtAccepted != form.ExtOutcomeDataValuesAccepted ||
 		asst.FinishedURL != form.LaunchPresentationReturnURL ||
-		asst.ConsumerKey != form.OAuthConsumerKey
+		asst.ConsumerKey != form.OAuthConsumerKey ||
+		(asst.DueAt == nil) != (dueAt == nil) ||
+		(dueAt != nil && !asst.DueAt.Equal(*dueAt)) ||
+		(asst.LockAt == nil) != (lockAt == nil) ||
+		(lockAt != nil && !asst.LockAt.Equal(*lockAt))
 
 	// make any changes
 	asst.CourseID = course.ID
@@ -559,6 +637,8 @@ func getUpdateAssignment(tx *sql.Tx, form *LTIRequest, now time.Time, course *Co
 	asst.OutcomeExtAccepted = form.ExtOutcomeDataValuesAccepted
 	asst.FinishedURL = form.LaunchPresentationReturnURL
 	asst.ConsumerKey = form.OAuthConsumerKey
+	asst.DueAt = dueAt
+	asst.LockAt = lockAt
 	if asst.ID < 1 || changed {
 		// if something changed, note the update time and save
 		if asst.ID > 0 {
@@ -566,6 +646,7 @@ func getUpdateAssignment(tx *sql.Tx, form *LTIRequest, now time.Time, course *Co
 				asst.ID, course.ID, course.Name, problemSet.ID, problemSet.Note, user.ID, user.Email)
 		}
 		asst.UpdatedAt = now
+		created := asst.ID < 1
 		if err := meddler.Save(tx, "assignments", asst); err != nil {
 			log.Printf("db error saving assignment for course %d, problem set %d, user %d: %v", course.ID, problemSet.ID, user.ID, err)
 			log.Printf("LtiID (resource_link_id) = %v, GradeID = %v", asst.LtiID, asst.GradeID)
@@ -580,6 +661,16 @@ func getUpdateAssignment(tx *sql.Tx, form *LTIRequest, now time.Time, course *Co
 
 			return nil, err
 		}
+		if created {
+			if err := recordEvent(tx, EventAssignmentCreated, course.ID, user.ID, asst.ID, map[string]interface{}{
+				"problemSetID": problemSet.ID,
+				"instructor":   asst.Instructor,
+				"canvasTitle":  asst.CanvasTitle,
+				"dueAt":        asst.DueAt,
+			}); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return asst, nil
@@ -595,10 +686,22 @@ func saveGrade(tx *sql.Tx, asst *Assignment, user *User) error {
 		return nil
 	}
 
+	// an instructor's override replaces the computed score
+	score := asst.Score
+	gradeText := ""
+	override, err := loadScoreOverride(tx, asst.ID)
+	if err != nil {
+		log.Printf("db error loading score override for assignment %d: %v", asst.ID, err)
+		return err
+	}
+	if override != nil {
+		score = override.Score
+		gradeText = override.Comment
+	}
+
 	// report back using lti
 	outcomeURL := asst.OutcomeURL
 	gradeURL := ""
-	gradeText := ""
 
 	// 	if strings.Contains(asst.OutcomeExtAccepted, "url") {
 	// 		outcomeURL = asst.OutcomeExtURL
@@ -613,7 +716,7 @@ func saveGrade(tx *sql.Tx, asst *Assignment, user *User) error {
 		URL:       gradeURL,
 		Text:      gradeText,
 		Language:  "en",
-		Score:     fmt.Sprintf("%0.5f", asst.Score),
+		Score:     fmt.Sprintf("%0.5f", score),
 	}
 
 	raw, err := xml.MarshalIndent(report, "", "  ")
@@ -624,7 +727,7 @@ func saveGrade(tx *sql.Tx, asst *Assignment, user *User) error {
 	result := fmt.Sprintf("%s%s\n", xml.Header, raw)
 
 	// sign the request
-	auth := signXMLRequest(asst.ConsumerKey, "POST", outcomeURL, result, Config.LTISecret)
+	auth := signXMLRequest(asst.ConsumerKey, "POST", outcomeURL, result, Config().LTISecret)
 
 	// POST the grade
 	req, err := http.NewRequest("POST", outcomeURL, strings.NewReader(result))
@@ -641,7 +744,7 @@ func saveGrade(tx *sql.Tx, asst *Assignment, user *User) error {
 	}
 	resp.Body.Close()
 	if resp.StatusCode == http.StatusOK {
-		log.Printf("grade of %0.5f posted for %s (%s)", asst.Score, user.Name, user.Email)
+		log.Printf("grade of %0.5f posted for %s (%s)", score, user.Name, user.Email)
 	} else {
 		return loggedErrorf("result status %d (%s) when posting grade for user %d", resp.StatusCode, resp.Status, asst.UserID)
 	}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// sendMessage delivers a plain-text message to a user by email.
+// If no SMTP server is configured the message is logged instead, which keeps
+// development setups working without a mail relay.
+func sendMessage(to *User, subject, body string) error {
+	if to.Email == "" {
+		return fmt.Errorf("user %d (%s) has no email address", to.ID, to.Name)
+	}
+	if Config().SMTPServer == "" {
+		log.Printf("no SMTP server configured, message to %s not sent: %s", to.Email, subject)
+		return nil
+	}
+
+	from := Config().MailFrom
+	if from == "" {
+		from = "noreply@" + Config().Hostname
+	}
+
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "From: %s <%s>\r\n", mime.QEncoding.Encode("utf-8", Config().ToolName), from)
+	fmt.Fprintf(msg, "To: %s <%s>\r\n", mime.QEncoding.Encode("utf-8", to.Name), to.Email)
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(msg, "\r\n")
+	msg.WriteString(body)
+
+	var auth smtp.Auth
+	if Config().SMTPUsername != "" {
+		host, _, err := net.SplitHostPort(Config().SMTPServer)
+		if err != nil {
+			return fmt.Errorf("bad SMTP server address %q: %v", Config().SMTPServer, err)
+		}
+		auth = smtp.PlainAuth("", Config().SMTPUsername, Config().SMTPPassword, host)
+	}
+	if err := smtp.SendMail(Config().SMTPServer, auth, from, []string{to.Email}, msg.Bytes()); err != nil {
+		log.Printf("error sending message to %s: %v", to.Email, err)
+		return err
+	}
+	return nil
+}
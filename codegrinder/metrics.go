@@ -0,0 +1,362 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// languageSyntax is just enough knowledge of a language to estimate the
+// number of functions and the cyclomatic complexity of a file with regular
+// expressions. The results are approximate, e.g., keywords inside strings
+// are counted, but they are cheap to compute and consistent across commits.
+type languageSyntax struct {
+	lineComment string
+	blockStart  string
+	blockEnd    string
+	function    *regexp.Regexp
+	decision    *regexp.Regexp
+}
+
+var (
+	pythonSyntax = &languageSyntax{
+		lineComment: "#",
+		function:    regexp.MustCompile(`^\s*(async\s+)?def\s+\w+`),
+		decision:    regexp.MustCompile(`\b(if|elif|for|while|except|and|or)\b`),
+	}
+	goSyntax = &languageSyntax{
+		lineComment: "//",
+		blockStart:  "/*",
+		blockEnd:    "*/",
+		function:    regexp.MustCompile(`^func\b`),
+		decision:    regexp.MustCompile(`\b(if|for|case)\b|&&|\|\|`),
+	}
+	rustSyntax = &languageSyntax{
+		lineComment: "//",
+		blockStart:  "/*",
+		blockEnd:    "*/",
+		function:    regexp.MustCompile(`^\s*(pub(\([\w:]+\))?\s+)?(async\s+)?(unsafe\s+)?fn\s+\w+`),
+		decision:    regexp.MustCompile(`\b(if|for|while)\b|&&|\|\||=>`),
+	}
+	cSyntax = &languageSyntax{
+		lineComment: "//",
+		blockStart:  "/*",
+		blockEnd:    "*/",
+		// top-level definitions start in the first column; declarations end with a semicolon
+		function: regexp.MustCompile(`^(?:[A-Za-z_][\w:<>,]*[\s\*&]+)+[\*&]*[A-Za-z_~][\w:~]*\s*\([^;]*$`),
+		decision: regexp.MustCompile(`\b(if|for|while|case|catch)\b|&&|\|\||\?`),
+	}
+	javascriptSyntax = &languageSyntax{
+		lineComment: "//",
+		blockStart:  "/*",
+		blockEnd:    "*/",
+		function:    regexp.MustCompile(`\bfunction\b|=>`),
+		decision:    regexp.MustCompile(`\b(if|for|while|case|catch)\b|&&|\|\||\?`),
+	}
+)
+
+// languageSyntaxes maps file extensions to the language scanners.
+var languageSyntaxes = map[string]*languageSyntax{
+	".py":  pythonSyntax,
+	".go":  goSyntax,
+	".rs":  rustSyntax,
+	".c":   cSyntax,
+	".h":   cSyntax,
+	".cc":  cSyntax,
+	".cpp": cSyntax,
+	".hpp": cSyntax,
+	".js":  javascriptSyntax,
+}
+
+// controlKeywords are never function names, even when a line looks like a
+// function definition to the C scanner.
+var controlKeywords = regexp.MustCompile(`^\s*(if|else|for|while|switch|return|do)\b`)
+
+// computeCommitMetrics measures the files of a commit.
+func computeCommitMetrics(files map[string]string) *CommitMetrics {
+	metrics := new(CommitMetrics)
+	decisions := 0
+	for name, contents := range files {
+		metrics.Files++
+		syntax := languageSyntaxes[strings.ToLower(filepath.Ext(name))]
+		if syntax != nil {
+			metrics.Supported = true
+		}
+		inBlock := false
+		for _, line := range strings.Split(strings.TrimSuffix(contents, "\n"), "\n") {
+			metrics.Lines++
+			trimmed := strings.TrimSpace(line)
+			switch {
+			case trimmed == "":
+				continue
+			case syntax == nil:
+				metrics.CodeLines++
+				continue
+			case inBlock:
+				metrics.CommentLines++
+				if strings.Contains(trimmed, syntax.blockEnd) {
+					inBlock = false
+				}
+				continue
+			case syntax.lineComment != "" && strings.HasPrefix(trimmed, syntax.lineComment):
+				metrics.CommentLines++
+				continue
+			case syntax.blockStart != "" && strings.HasPrefix(trimmed, syntax.blockStart):
+				metrics.CommentLines++
+				inBlock = !strings.Contains(trimmed[len(syntax.blockStart):], syntax.blockEnd)
+				continue
+			}
+			metrics.CodeLines++
+			if syntax.function.MatchString(line) && !controlKeywords.MatchString(line) {
+				metrics.Functions++
+			}
+			decisions += len(syntax.decision.FindAllString(line, -1))
+		}
+	}
+	if metrics.Supported {
+		// each function starts with a complexity of one
+		metrics.Complexity = metrics.Functions + decisions
+		if metrics.Functions == 0 {
+			metrics.Complexity++
+		}
+	}
+	return metrics
+}
+
+// GetAssignmentMetrics handles a request to /v2/assignments/:assignment_id/metrics,
+// returning the metrics for each commit of an assignment in problem and step order.
+// Students can see their own assignments; TAs and instructors can see any assignment in their courses.
+// With format=csv the rows are streamed as a spreadsheet.
+func GetAssignmentMetrics(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if assignment.UserID != currentUser.ID {
+		if ok, err := isCourseStaff(tx, currentUser, assignment.CourseID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		} else if !ok {
+			loggedHTTPErrorf(w, http.StatusNotFound, "not found")
+			return
+		}
+	}
+
+	rows, err := tx.Query(`SELECT id, problem_id, step, COALESCE(score, 0), updated_at, metrics FROM commits `+
+		`WHERE assignment_id = $1 AND metrics != 'null'::jsonb ORDER BY problem_id, step`, assignmentID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	defer rows.Close()
+	var out *csv.Writer
+	if wantCSV(r) {
+		out = startCSV(w, fmt.Sprintf("codegrinder-metrics-%d.csv", assignmentID),
+			[]string{"commit_id", "problem_id", "step", "score", "updated_at",
+				"files", "lines", "code_lines", "comment_lines", "functions", "complexity"})
+	}
+	fail := func(status int, format string, args ...interface{}) {
+		if out != nil {
+			// the download has started, so all we can do is stop it short
+			out.Flush()
+			loggedErrorf(format, args...)
+			return
+		}
+		loggedHTTPErrorf(w, status, format, args...)
+	}
+	entries := []*CommitMetricsEntry{}
+	for rows.Next() {
+		entry := new(CommitMetricsEntry)
+		var raw []byte
+		if err := rows.Scan(&entry.CommitID, &entry.ProblemID, &entry.Step, &entry.Score, &entry.UpdatedAt, &raw); err != nil {
+			fail(http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if err := json.Unmarshal(raw, &entry.Metrics); err != nil {
+			fail(http.StatusInternalServerError, "json error decoding metrics for commit %d: %v", entry.CommitID, err)
+			return
+		}
+		if out == nil {
+			entries = append(entries, entry)
+			continue
+		}
+		m := entry.Metrics
+		out.Write([]string{
+			strconv.FormatInt(entry.CommitID, 10),
+			strconv.FormatInt(entry.ProblemID, 10),
+			strconv.FormatInt(entry.Step, 10),
+			formatScore(entry.Score),
+			entry.UpdatedAt.Format(time.RFC3339),
+			strconv.Itoa(m.Files),
+			strconv.Itoa(m.Lines),
+			strconv.Itoa(m.CodeLines),
+			strconv.Itoa(m.CommentLines),
+			optionalMetric(m.Supported, m.Functions),
+			optionalMetric(m.Supported, m.Complexity),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		fail(http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if out != nil {
+		out.Flush()
+		return
+	}
+	render.JSON(http.StatusOK, entries)
+}
+
+// optionalMetric formats a metric that is only measured for some languages.
+func optionalMetric(supported bool, value int) string {
+	if !supported {
+		return ""
+	}
+	return strconv.Itoa(value)
+}
+
+// GetCourseProblemSetMetrics handles a request to /v2/courses/:course_id/problem_sets/:problem_set_id/metrics,
+// returning the distribution of commit metrics for each problem step across the students in the course.
+// Only instructors for the course and administrators may see this.
+// With format=csv the result is a spreadsheet with one row per step.
+func GetCourseProblemSetMetrics(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	problemSetID, err := parseID(w, "problem_set_id", params["problem_set_id"])
+	if err != nil {
+		return
+	}
+	cursor, err := newBatchCursor(r.Context(), tx, "", `SELECT commits.id, commits.problem_id, commits.step, commits.metrics `+
+		`FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+		`WHERE assignments.course_id = $1 AND assignments.problem_set_id = $2 AND NOT assignments.instructor `+
+		`AND commits.metrics != 'null'::jsonb AND commits.id > $3 ORDER BY commits.id LIMIT $4`, courseID, problemSetID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// only the metrics are kept, grouped by step
+	type key struct{ problemID, step int64 }
+	var order []key
+	groups := make(map[key][]*CommitMetrics)
+	scan := func(rows *sql.Rows) (int64, error) {
+		var id int64
+		var k key
+		var raw []byte
+		if err := rows.Scan(&id, &k.problemID, &k.step, &raw); err != nil {
+			return 0, err
+		}
+		metrics := new(CommitMetrics)
+		if err := json.Unmarshal(raw, metrics); err != nil {
+			return 0, fmt.Errorf("json error decoding metrics for commit %d: %v", id, err)
+		}
+		if _, ok := groups[k]; !ok {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], metrics)
+		return id, nil
+	}
+	for {
+		n, err := cursor.Next(r.Context(), scan)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		} else if n == 0 {
+			break
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if order[i].problemID != order[j].problemID {
+			return order[i].problemID < order[j].problemID
+		}
+		return order[i].step < order[j].step
+	})
+
+	result := []*StepMetrics{}
+	for _, k := range order {
+		list := groups[k]
+		elt := &StepMetrics{
+			ProblemID: k.problemID,
+			Step:      k.step,
+			Commits:   len(list),
+			CodeLines: summarizeMetric(list, func(m *CommitMetrics) int { return m.CodeLines }),
+		}
+		if list[0].Supported {
+			elt.Functions = summarizeMetric(list, func(m *CommitMetrics) int { return m.Functions })
+			elt.Complexity = summarizeMetric(list, func(m *CommitMetrics) int { return m.Complexity })
+		}
+		result = append(result, elt)
+	}
+	if !wantCSV(r) {
+		render.JSON(http.StatusOK, result)
+		return
+	}
+
+	header := []string{"problem_id", "step", "commits"}
+	for _, name := range []string{"code_lines", "functions", "complexity"} {
+		header = append(header, name+"_min", name+"_max", name+"_mean", name+"_median")
+	}
+	out := startCSV(w, fmt.Sprintf("codegrinder-metrics-%d-%d.csv", courseID, problemSetID), header)
+	for _, elt := range result {
+		row := []string{strconv.FormatInt(elt.ProblemID, 10), strconv.FormatInt(elt.Step, 10), strconv.Itoa(elt.Commits)}
+		for _, summary := range []*MetricSummary{elt.CodeLines, elt.Functions, elt.Complexity} {
+			if summary == nil {
+				row = append(row, "", "", "", "")
+				continue
+			}
+			row = append(row, strconv.Itoa(summary.Min), strconv.Itoa(summary.Max),
+				strconv.FormatFloat(summary.Mean, 'f', 2, 64), strconv.FormatFloat(summary.Median, 'f', 1, 64))
+		}
+		out.Write(row)
+	}
+	out.Flush()
+}
+
+// summarizeMetric computes the distribution of one metric.
+func summarizeMetric(list []*CommitMetrics, get func(*CommitMetrics) int) *MetricSummary {
+	values := make([]int, len(list))
+	for i, m := range list {
+		values[i] = get(m)
+	}
+	return summarizeInts(values)
+}
+
+// summarizeInts computes the distribution of a non-empty list of values.
+func summarizeInts(values []int) *MetricSummary {
+	values = append([]int(nil), values...)
+	total := 0
+	for _, value := range values {
+		total += value
+	}
+	sort.Ints(values)
+	summary := &MetricSummary{
+		Min:  values[0],
+		Max:  values[len(values)-1],
+		Mean: float64(total) / float64(len(values)),
+	}
+	if mid := len(values) / 2; len(values)%2 == 1 {
+		summary.Median = float64(values[mid])
+	} else {
+		summary.Median = float64(values[mid-1]+values[mid]) / 2
+	}
+	return summary
+}
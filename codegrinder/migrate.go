@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/russross/codegrinder/setup"
+)
+
+// The schema is versioned. The migrations in setup/migrations are built into
+// the binary, and the schema_migrations table records which of them have
+// been applied. The migrate subcommand applies the missing ones in order,
+// each in its own transaction, and the TA refuses to start until the
+// database is at the latest version.
+//
+// An empty database is created from setup/schema.sql, with every migration
+// recorded as applied. A database that was set up before migrations were
+// versioned must be given a starting point once with --baseline N, where N
+// is the version of the last migration it already has, or 0 if it was
+// created from the original schema and has none of them.
+
+// migration is one versioned schema change.
+type migration struct {
+	version     int
+	name        string
+	description string
+	sql         string
+}
+
+var migrationName = regexp.MustCompile(`^(\d+)-([a-z0-9-]+)\.sql$`)
+
+// loadMigrations returns the migrations built into the binary, in order.
+// Versions must start at 1 with no gaps.
+func loadMigrations() ([]*migration, error) {
+	entries, err := fs.ReadDir(setup.Migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	var list []*migration
+	for _, entry := range entries {
+		groups := migrationName.FindStringSubmatch(entry.Name())
+		if groups == nil {
+			return nil, fmt.Errorf("migration file %s is not named <version>-<name>.sql", entry.Name())
+		}
+		version, _ := strconv.Atoi(groups[1])
+		raw, err := fs.ReadFile(setup.Migrations, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		contents := string(raw)
+		description := strings.SplitN(contents, "\n", 2)[0]
+		description = strings.TrimSpace(strings.TrimPrefix(description, "--"))
+		list = append(list, &migration{version: version, name: groups[2], description: description, sql: contents})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].version < list[j].version })
+	for i, elt := range list {
+		if elt.version != i+1 {
+			return nil, fmt.Errorf("migration %04d-%s should be version %d", elt.version, elt.name, i+1)
+		}
+	}
+	return list, nil
+}
+
+// schemaVersion returns the latest migration applied to the database, and
+// whether the database has been versioned at all.
+func schemaVersion(db *sql.DB) (int, bool, error) {
+	var exists bool
+	if err := db.QueryRow(`SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil || !exists {
+		return 0, false, err
+	}
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, true, err
+}
+
+// checkSchemaVersion returns an error if the database is missing any
+// migration built into the binary. A database that is ahead of the binary
+// is allowed, so an older server can keep running during an upgrade.
+func checkSchemaVersion(db *sql.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	version, versioned, err := schemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("db error checking the schema version: %v", err)
+	}
+	latest := len(migrations)
+	switch {
+	case !versioned:
+		return fmt.Errorf("the database schema is not versioned; run codegrinder migrate (with --baseline for an existing database)")
+	case version < latest:
+		return fmt.Errorf("the database schema is at version %d but this server needs version %d; run codegrinder migrate", version, latest)
+	case version > latest:
+		log.Printf("the database schema is at version %d, newer than version %d known to this server", version, latest)
+	}
+	return nil
+}
+
+// pendingMigrations returns the migrations after a version.
+func pendingMigrations(migrations []*migration, version int) []*migration {
+	if version >= len(migrations) {
+		return nil
+	}
+	return migrations[version:]
+}
+
+// recordMigration notes that a migration has been applied.
+func recordMigration(tx *sql.Tx, elt *migration, now time.Time) error {
+	_, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`, elt.version, elt.name, now)
+	return err
+}
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version                 integer NOT NULL,
+    name                    text NOT NULL,
+    applied_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (version)
+)`
+
+// runMigrate handles the migrate subcommand, which brings the database
+// schema up to date. With --status it only reports the migrations that
+// are missing. It returns the exit status.
+func runMigrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	status := flags.Bool("status", false, "Report the schema version and missing migrations without applying them")
+	baseline := flags.Int("baseline", -1, "Record migrations up to this version as applied without running them (0 for none)")
+	flags.Parse(args)
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		log.Printf("error loading migrations: %v", err)
+		return 1
+	}
+	if *baseline < -1 || *baseline > len(migrations) {
+		log.Printf("--baseline must be between 0 and %d", len(migrations))
+		return 2
+	}
+
+	db := setupDB(Config().PostgresHost, Config().PostgresPort, Config().PostgresUsername, Config().PostgresPassword, Config().PostgresDatabase)
+	defer db.Close()
+
+	version, versioned, err := schemaVersion(db)
+	if err != nil {
+		log.Printf("db error checking the schema version: %v", err)
+		return 1
+	}
+	var empty bool
+	if err := db.QueryRow(`SELECT to_regclass('users') IS NULL`).Scan(&empty); err != nil {
+		log.Printf("db error checking for an existing schema: %v", err)
+		return 1
+	}
+
+	if *status {
+		switch {
+		case !versioned && empty:
+			fmt.Println("the database is empty; migrate will create the schema")
+		case !versioned:
+			fmt.Println("the database schema is not versioned; use --baseline to give its version")
+		default:
+			fmt.Printf("the database schema is at version %d of %d\n", version, len(migrations))
+			for _, elt := range pendingMigrations(migrations, version) {
+				fmt.Printf("    %04d-%s: %s\n", elt.version, elt.name, elt.description)
+			}
+		}
+		return 0
+	}
+
+	now := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("db error starting transaction: %v", err)
+		return 1
+	}
+	defer tx.Rollback()
+
+	switch {
+	case !versioned && empty && *baseline < 0:
+		// a new database gets the current schema, which includes every migration
+		log.Printf("creating the schema in an empty database")
+		if _, err := tx.Exec(setup.Schema); err != nil {
+			log.Printf("db error creating the schema: %v", err)
+			return 1
+		}
+		*baseline = len(migrations)
+	case !versioned && *baseline < 0:
+		log.Printf("the database schema is not versioned; run codegrinder migrate --baseline <version> with the last migration it has")
+		return 1
+	case versioned && *baseline >= 0:
+		log.Printf("the database schema is already versioned at version %d", version)
+		return 1
+	}
+	if *baseline >= 0 {
+		if _, err := tx.Exec(createMigrationsTable); err != nil {
+			log.Printf("db error creating schema_migrations: %v", err)
+			return 1
+		}
+		for _, elt := range migrations[:*baseline] {
+			if err := recordMigration(tx, elt, now); err != nil {
+				log.Printf("db error recording migration %d: %v", elt.version, err)
+				return 1
+			}
+		}
+		version = *baseline
+		log.Printf("recorded the database schema at version %d", version)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("db error committing: %v", err)
+		return 1
+	}
+
+	// apply each missing migration in its own transaction
+	for _, elt := range pendingMigrations(migrations, version) {
+		log.Printf("applying migration %04d-%s: %s", elt.version, elt.name, elt.description)
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("db error starting transaction: %v", err)
+			return 1
+		}
+		if _, err := tx.Exec(elt.sql); err != nil {
+			tx.Rollback()
+			log.Printf("error applying migration %04d-%s: %v", elt.version, elt.name, err)
+			return 1
+		}
+		if err := recordMigration(tx, elt, time.Now()); err != nil {
+			tx.Rollback()
+			log.Printf("db error recording migration %d: %v", elt.version, err)
+			return 1
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("db error committing migration %d: %v", elt.version, err)
+			return 1
+		}
+	}
+	if version < len(migrations) {
+		version = len(migrations)
+	}
+	log.Printf("the database schema is at version %d", version)
+	return 0
+}
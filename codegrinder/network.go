@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	. "github.com/russross/codegrinder/types"
+)
+
+// Grader containers normally run with networking disabled, which leaves
+// them only a loopback interface, plus a private network shared with their
+// sidecar services if they have any. That is the localhost policy. The none
+// and allowlist policies are enforced with packet filters installed in the
+// grader's network namespace by a short-lived helper container running
+// Config.FirewallImage, which must provide iptables and ip6tables. The
+// helper has NET_ADMIN but the grader does not, so code in the grader
+// cannot change the rules. Allowlisted hostnames are resolved by the
+// daycare when the container is created and written to its /etc/hosts, so
+// the grader needs no DNS access.
+
+// networkTarget is an allowlist entry resolved to addresses.
+type networkTarget struct {
+	host  string
+	port  string
+	addrs []net.IP
+}
+
+// resolveAllowlist looks up the addresses for each allowlist entry.
+func resolveAllowlist(allow []string) ([]*networkTarget, error) {
+	var targets []*networkTarget
+	for _, entry := range allow {
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, err
+		}
+		target := &networkTarget{host: host, port: port}
+		if ip := net.ParseIP(host); ip != nil {
+			target.addrs = []net.IP{ip}
+		} else if target.addrs, err = net.LookupIP(host); err != nil {
+			return nil, fmt.Errorf("resolving network allowlist host %s: %v", host, err)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// configureNetwork sets up the grader container's network for a policy
+// before it is created, returning the resolved allowlist, if any. Sidecar
+// services are only attached if the policy permits them.
+func configureNetwork(policy *NetworkPolicy, config *docker.Config, hostConfig *docker.HostConfig, services *Services) ([]*networkTarget, error) {
+	if policy.Mode != NetworkLocalhost && Config().FirewallImage == "" {
+		return nil, fmt.Errorf("network mode %s requires FirewallImage to be configured on the daycare", policy.Mode)
+	}
+
+	switch policy.Mode {
+	case NetworkNone:
+		config.NetworkDisabled = true
+
+	case NetworkLocalhost:
+		config.NetworkDisabled = true
+		if services != nil {
+			config.NetworkDisabled = false
+			hostConfig.NetworkMode = services.Network.Name
+		}
+
+	case NetworkAllowlist:
+		targets, err := resolveAllowlist(policy.Allow)
+		if err != nil {
+			return nil, err
+		}
+		config.NetworkDisabled = false
+		hostConfig.NetworkMode = "bridge"
+		for _, target := range targets {
+			if net.ParseIP(target.host) == nil {
+				hostConfig.ExtraHosts = append(hostConfig.ExtraHosts, target.host+":"+target.addrs[0].String())
+			}
+		}
+		return targets, nil
+	}
+	return nil, nil
+}
+
+// connectServices attaches a running grader container to its sidecar
+// services when the policy put it on a different network.
+func connectServices(policy *NetworkPolicy, container *docker.Container, services *Services) error {
+	if policy.Mode != NetworkAllowlist || services == nil {
+		return nil
+	}
+	if err := dockerClient.ConnectNetwork(services.Network.ID, docker.NetworkConnectionOptions{Container: container.ID}); err != nil {
+		return err
+	}
+
+	// reload the network to learn its subnet for the firewall
+	network, err := dockerClient.NetworkInfo(services.Network.ID)
+	if err != nil {
+		return err
+	}
+	services.Network = network
+	return nil
+}
+
+// firewallScript builds the shell script that installs the packet filters
+// for a policy, or "" if the policy needs none.
+func firewallScript(policy *NetworkPolicy, targets []*networkTarget, services *Services) string {
+	var lines []string
+	switch policy.Mode {
+	case NetworkNone:
+		for _, cmd := range []string{"iptables", "ip6tables"} {
+			lines = append(lines,
+				cmd+" -F",
+				cmd+" -P INPUT DROP",
+				cmd+" -P OUTPUT DROP",
+				cmd+" -P FORWARD DROP")
+		}
+
+	case NetworkAllowlist:
+		for _, cmd := range []string{"iptables", "ip6tables"} {
+			lines = append(lines,
+				cmd+" -F OUTPUT",
+				cmd+" -P OUTPUT DROP",
+				cmd+" -A OUTPUT -o lo -j ACCEPT",
+				cmd+" -A OUTPUT -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT")
+		}
+		if services != nil {
+			for _, ipam := range services.Network.IPAM.Config {
+				if ipam.Subnet != "" {
+					lines = append(lines, "iptables -A OUTPUT -d "+ipam.Subnet+" -j ACCEPT")
+				}
+			}
+		}
+		for _, target := range targets {
+			for _, addr := range target.addrs {
+				cmd := "iptables"
+				if addr.To4() == nil {
+					cmd = "ip6tables"
+				}
+				lines = append(lines, fmt.Sprintf("%s -A OUTPUT -d %s -p tcp --dport %s -j ACCEPT", cmd, addr, target.port))
+			}
+		}
+
+	default:
+		return ""
+	}
+	return "set -e\n" + strings.Join(lines, "\n") + "\n"
+}
+
+// applyFirewall runs the firewall helper in the grader container's network
+// namespace to install the packet filters for its policy.
+func applyFirewall(policy *NetworkPolicy, targets []*networkTarget, name string, container *docker.Container, services *Services) error {
+	script := firewallScript(policy, targets, services)
+	if script == "" {
+		return nil
+	}
+	helper, err := createContainer(docker.CreateContainerOptions{
+		Name: name + "-firewall",
+		Config: &docker.Config{
+			Image: Config().FirewallImage,
+			Cmd:   []string{"/bin/sh", "-c", script},
+		},
+		HostConfig: &docker.HostConfig{
+			NetworkMode: "container:" + container.ID,
+			CapDrop:     []string{"ALL"},
+			CapAdd:      []string{"NET_ADMIN", "NET_RAW"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := dockerClient.RemoveContainer(docker.RemoveContainerOptions{ID: helper.ID, Force: true}); err != nil {
+			log.Printf("applyFirewall error removing helper container: %v", err)
+		}
+	}()
+	if err := dockerClient.StartContainer(helper.ID, nil); err != nil {
+		return err
+	}
+	status, err := dockerClient.WaitContainer(helper.ID)
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("firewall helper exited with status %d", status)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"html"
+	"regexp"
+	"strings"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// When a graded commit passes its step, the response tells the student what
+// to do next: the next step of the same problem if there is one, otherwise
+// the next unfinished problem in the set. A problem can name problems that
+// should be finished first with tags of the form prereq:<unique-id>, and
+// problems whose prerequisites are done are suggested before others.
+
+// PrerequisiteTag is the prefix of a problem tag naming a prerequisite.
+const PrerequisiteTag = "prereq:"
+
+// MaxSummaryLength is the longest instructions summary sent to students.
+const MaxSummaryLength = 280
+
+var (
+	firstParagraph = regexp.MustCompile(`(?s)<p>(.*?)</p>`)
+	htmlTag        = regexp.MustCompile(`<[^>]*>`)
+)
+
+type setProblemProgress struct {
+	ID     int64    `meddler:"id"`
+	Unique string   `meddler:"unique_id"`
+	Tags   []string `meddler:"tags,json"`
+	Steps  int64    `meddler:"steps"`
+	Passed int64    `meddler:"passed"`
+}
+
+// nextSuggestion works out what a student should do after passing a step.
+func nextSuggestion(tx *sql.Tx, assignment *Assignment, problem *Problem, steps []*ProblemStep, step int64) (*NextSuggestion, error) {
+	// find the highest step passed for each problem in the set
+	problems := []*setProblemProgress{}
+	if err := meddler.QueryAll(tx, &problems, `SELECT problems.id, problems.unique_id, problems.tags, `+
+		`(SELECT COUNT(1) FROM problem_steps WHERE problem_steps.problem_id = problems.id) AS steps, `+
+		`COALESCE((SELECT MAX(step) FROM commits WHERE commits.assignment_id = $1 AND commits.problem_id = problems.id `+
+		`AND commits.report_card->>'passed' = 'true'), 0) AS passed `+
+		`FROM problem_set_problems JOIN problems ON problem_set_problems.problem_id = problems.id `+
+		`WHERE problem_set_problems.problem_set_id = $2 `+
+		`ORDER BY problems.unique_id`, assignment.ID, assignment.ProblemSetID); err != nil {
+		return nil, err
+	}
+	done := make(map[string]bool)
+	for _, elt := range problems {
+		if elt.ID == problem.ID && elt.Passed < step {
+			// the commit being graded may not be saved yet
+			elt.Passed = step
+		}
+		done[elt.Unique] = elt.Passed >= elt.Steps
+	}
+
+	next := new(NextSuggestion)
+	for _, elt := range problems {
+		if !done[elt.Unique] {
+			next.Remaining++
+		}
+	}
+
+	// move on to the next step of this problem
+	if int(step) < len(steps) {
+		following := steps[step]
+		next.Step = following.Step
+		next.Note = following.Note
+		next.Summary = summarizeInstructions(following.Instructions)
+		return next, nil
+	}
+
+	// suggest another problem, preferring those that are ready
+	var ready, waiting *setProblemProgress
+	for _, elt := range problems {
+		if done[elt.Unique] {
+			continue
+		}
+		if waiting == nil {
+			waiting = elt
+		}
+		if prerequisitesDone(elt.Tags, done) {
+			ready = elt
+			break
+		}
+	}
+	if ready == nil {
+		ready = waiting
+	}
+	if ready == nil {
+		next.Complete = true
+		return next, nil
+	}
+	next.ProblemID = ready.ID
+	next.Unique = ready.Unique
+	first := new(ProblemStep)
+	if err := meddler.QueryRow(tx, first, `SELECT * FROM problem_steps WHERE problem_id = $1 AND step = 1`, ready.ID); err != nil {
+		return nil, err
+	}
+	next.Note = first.Note
+	next.Summary = summarizeInstructions(first.Instructions)
+	return next, nil
+}
+
+// prerequisitesDone reports whether every prerequisite named in a
+// problem's tags has been finished. Prerequisites outside the set are
+// ignored.
+func prerequisitesDone(tags []string, done map[string]bool) bool {
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, PrerequisiteTag) {
+			continue
+		}
+		if finished, inSet := done[strings.TrimPrefix(tag, PrerequisiteTag)]; inSet && !finished {
+			return false
+		}
+	}
+	return true
+}
+
+// summarizeInstructions returns the first paragraph of a step's
+// instructions as plain text.
+func summarizeInstructions(instructions string) string {
+	text := instructions
+	if groups := firstParagraph.FindStringSubmatch(instructions); groups != nil {
+		text = groups[1]
+	}
+	text = html.UnescapeString(htmlTag.ReplaceAllString(text, ""))
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > MaxSummaryLength {
+		text = strings.TrimSpace(string(runes[:MaxSummaryLength-1])) + "…"
+	}
+	return text
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// When the TA signs a commit for grading, it gives the commit a random nonce
+// and an expiry time, both covered by the commit signature. The TA records
+// each nonce it issues. When it dispatches a commit to a daycare, either by
+// queuing it for a worker or by grading it in the same process, it marks
+// the nonce as dispatched and refuses one that expired or was dispatched
+// already, so a signed bundle cannot be sent for grading again later. The
+// TA also accepts a graded commit only once for each nonce, so a graded
+// bundle cannot be saved a second time. A nonce cannot be moved to another
+// commit or assignment without breaking the signature.
+//
+// Daycares refuse any commit without a nonce, as well as expired ones, and
+// remember the nonces they have graded. That memory belongs to one daycare
+// process, so it only backs up the TA's record; a daycare on its own host
+// should get its jobs from the work queue.
+//
+// Commits the TA grades for itself, such as regrades and reference
+// solution checks, get nonces the same way. Those that are not saved yet
+// have no commit ID in the record.
+
+// issueCommitNonce gives a commit a nonce and expiry time before it is
+// signed, and records the nonce. Expired nonces are cleared out as new
+// ones are issued. The record must be committed before the commit is sent
+// for grading.
+func issueCommitNonce(db meddler.DB, now time.Time, commit *Commit) error {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	expires := now.Add(Config().signedCommitTimeout())
+	commit.Nonce = base64.RawURLEncoding.EncodeToString(raw)
+	commit.ExpiresAt = &expires
+	if _, err := db.Exec(`DELETE FROM commit_nonces WHERE expires_at < $1`, now.Add(-MaxDaycareRequestAge)); err != nil {
+		return err
+	}
+	_, err := db.Exec(`INSERT INTO commit_nonces (nonce, commit_id, expires_at) VALUES ($1, NULLIF($2, 0), $3)`, commit.Nonce, commit.ID, expires)
+	return err
+}
+
+// dispatchCommitNonces marks the nonces of the commits in a grading request
+// as dispatched, returning an error that can be shown to the client if any
+// of them is missing, expired, or already dispatched. The commits of a set
+// are dispatched together or not at all.
+func dispatchCommitNonces(db *sql.DB, now time.Time, req *DaycareRequest) error {
+	var bundles []*CommitBundle
+	switch {
+	case req.CommitBundle != nil:
+		bundles = append(bundles, req.CommitBundle)
+	case req.SetCommitBundle != nil:
+		bundles = append(bundles, req.SetCommitBundle.Bundles...)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+	for _, bundle := range bundles {
+		commit := bundle.Commit
+		if commit == nil || commit.Nonce == "" {
+			return fmt.Errorf("signed commit has no nonce; please grade it again")
+		}
+		if bundle.CommitSignature != commit.ComputeSignature(Config().DaycareSecret, bundle.ProblemSignature) {
+			return fmt.Errorf("commit signature mismatch")
+		}
+		result, err := tx.Exec(`UPDATE commit_nonces SET dispatched_at = $1 `+
+			`WHERE nonce = $2 AND dispatched_at IS NULL AND expires_at >= $1`, now, commit.Nonce)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		if count, err := result.RowsAffected(); err != nil {
+			return fmt.Errorf("db error: %v", err)
+		} else if count == 0 {
+			return fmt.Errorf("this signed commit has expired or has already been sent for grading; please grade it again")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// useCommitNonce marks the nonce of a graded commit as used, returning an
+// error that can be shown to the student if the commit cannot be saved.
+// The daycare must start grading before the commit expires, so the graded
+// result is accepted for a while longer.
+func useCommitNonce(tx *sql.Tx, now time.Time, commit *Commit) error {
+	if commit.Nonce == "" || commit.ExpiresAt == nil {
+		return fmt.Errorf("graded commit has no nonce; please grade it again")
+	}
+	var commitID sql.NullInt64
+	var usedAt *time.Time
+	err := tx.QueryRow(`SELECT commit_id, used_at FROM commit_nonces WHERE nonce = $1`, commit.Nonce).Scan(&commitID, &usedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return fmt.Errorf("graded commit has expired or is not recognized; please grade it again")
+	case err != nil:
+		return fmt.Errorf("db error: %v", err)
+	case !commitID.Valid || commitID.Int64 != commit.ID:
+		return fmt.Errorf("graded commit does not match the commit it was signed for")
+	case usedAt != nil:
+		return fmt.Errorf("this graded commit was already saved at %s", usedAt.Format(time.RFC1123))
+	case now.After(commit.ExpiresAt.Add(MaxDaycareRequestAge)):
+		return fmt.Errorf("graded commit expired at %s; please grade it again", commit.ExpiresAt.Format(time.RFC1123))
+	}
+	if _, err := tx.Exec(`UPDATE commit_nonces SET used_at = $1 WHERE nonce = $2`, now, commit.Nonce); err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// nonceCache remembers the nonces a daycare has graded until they expire.
+type nonceCache struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+var daycareNonces = &nonceCache{seen: make(map[string]time.Time)}
+
+// use checks that a commit has not expired and that its nonce has not been
+// seen before, and remembers the nonce.
+func (cache *nonceCache) use(commit *Commit, now time.Time) error {
+	if commit.ExpiresAt == nil {
+		return fmt.Errorf("signed commit has no expiry time")
+	}
+	if now.After(*commit.ExpiresAt) {
+		return fmt.Errorf("signed commit expired at %s; please grade it again", commit.ExpiresAt.Format(time.RFC1123))
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+	for nonce, expires := range cache.seen {
+		if now.After(expires) {
+			delete(cache.seen, nonce)
+		}
+	}
+	if _, exists := cache.seen[commit.Nonce]; exists {
+		return fmt.Errorf("this signed commit has already been sent for grading; please grade it again")
+	}
+	cache.seen[commit.Nonce] = *commit.ExpiresAt
+	return nil
+}
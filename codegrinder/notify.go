@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Users are notified when something happens to their work that they did not
+// do themselves: a grade is posted, an instructor comments on a commit, a
+// regrade request is resolved, or a problem they are working on changes.
+// Notifications are queued in the notifications table as part of the
+// transaction that caused them, one row per delivery channel, and a
+// background worker delivers them by email and to the user's webhook,
+// retrying failures a few times.
+
+// Notification delivery channels and statuses.
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+
+	NotificationPending = "pending"
+	NotificationSent    = "sent"
+	NotificationFailed  = "failed"
+)
+
+const (
+	// NotificationInterval is how often the worker looks for notifications.
+	NotificationInterval = 30 * time.Second
+
+	// MaxNotificationAttempts is how many times delivery is tried.
+	MaxNotificationAttempts = 5
+
+	// WebhookTimeout limits how long a webhook can take to respond.
+	WebhookTimeout = 10 * time.Second
+)
+
+var notificationKinds = map[string]bool{
+	NotifyGradePosted:     true,
+	NotifyCommitComment:   true,
+	NotifyRegradeResolved: true,
+	NotifyProblemUpdated:  true,
+	NotifyQuarantine:      true,
+	NotifyNudge:           true,
+}
+
+// webhookPayload is what is posted to a user's webhook.
+type webhookPayload struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"userID"`
+	Kind      string    `json:"kind"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// queueNotification queues a notification to a user on each channel the
+// user has enabled, unless the user has muted this kind.
+func queueNotification(db meddler.DB, user *User, kind, subject, body string) error {
+	prefs := user.Notifications
+	if prefs == nil {
+		prefs = new(NotificationPreferences)
+	}
+	for _, muted := range prefs.Muted {
+		if muted == kind {
+			return nil
+		}
+	}
+	var channels []string
+	if !prefs.NoEmail && user.Email != "" {
+		channels = append(channels, ChannelEmail)
+	}
+	if prefs.WebhookURL != "" {
+		channels = append(channels, ChannelWebhook)
+	}
+	now := time.Now()
+	for _, channel := range channels {
+		notification := &Notification{
+			UserID:    user.ID,
+			Kind:      kind,
+			Channel:   channel,
+			Subject:   subject,
+			Body:      body,
+			Status:    NotificationPending,
+			CreatedAt: now,
+		}
+		if err := meddler.Insert(db, "notifications", notification); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyUser is queueNotification for a user given by ID. Failures are
+// logged, since they should not undo the change being reported.
+func notifyUser(db meddler.DB, userID int64, kind, subject, body string) {
+	user := new(User)
+	if err := meddler.Load(db, "users", user, userID); err != nil {
+		log.Printf("db error loading user %d to send %s notification: %v", userID, kind, err)
+		return
+	}
+	if err := queueNotification(db, user, kind, subject, body); err != nil {
+		log.Printf("db error queuing %s notification for user %d: %v", kind, userID, err)
+	}
+}
+
+// startNotificationDelivery delivers queued notifications in the background.
+func startNotificationDelivery(db *sql.DB) {
+	go func() {
+		for {
+			time.Sleep(NotificationInterval)
+
+			pending := []*Notification{}
+			if err := meddler.QueryAll(db, &pending, `SELECT * FROM notifications WHERE status = $1 ORDER BY created_at LIMIT 100`,
+				NotificationPending); err != nil {
+				log.Printf("db error finding notifications to deliver: %v", err)
+				continue
+			}
+			for _, notification := range pending {
+				deliverNotification(db, notification)
+			}
+		}
+	}()
+}
+
+// deliverNotification makes one attempt to deliver a notification and
+// records the outcome.
+func deliverNotification(db *sql.DB, notification *Notification) {
+	user := new(User)
+	err := meddler.Load(db, "users", user, notification.UserID)
+	if err == nil {
+		switch notification.Channel {
+		case ChannelEmail:
+			err = sendMessage(user, notification.Subject, notification.Body)
+		case ChannelWebhook:
+			err = postWebhook(user, notification)
+		default:
+			err = fmt.Errorf("unknown notification channel %q", notification.Channel)
+		}
+	}
+
+	notification.Attempts++
+	if err == nil {
+		now := time.Now()
+		notification.Status = NotificationSent
+		notification.SentAt = &now
+		notification.LastError = ""
+	} else {
+		notification.LastError = err.Error()
+		if notification.Attempts >= MaxNotificationAttempts {
+			notification.Status = NotificationFailed
+			log.Printf("giving up on notification %d to user %d: %v", notification.ID, notification.UserID, err)
+		}
+	}
+	if err := meddler.Update(db, "notifications", notification); err != nil {
+		log.Printf("db error saving notification %d: %v", notification.ID, err)
+	}
+}
+
+// postWebhook posts a notification to the user's webhook.
+func postWebhook(user *User, notification *Notification) error {
+	if user.Notifications == nil || user.Notifications.WebhookURL == "" {
+		return fmt.Errorf("user %d (%s) no longer has a webhook", user.ID, user.Name)
+	}
+	payload, err := json.Marshal(&webhookPayload{
+		ID:        notification.ID,
+		UserID:    notification.UserID,
+		Kind:      notification.Kind,
+		Subject:   notification.Subject,
+		Body:      notification.Body,
+		CreatedAt: notification.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := publicWebhookClient.Post(user.Notifications.WebhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// GetUserMeNotifications handles requests to /v2/users/me/notifications,
+// returning the current user's most recent notifications.
+func GetUserMeNotifications(w http.ResponseWriter, tx *sql.Tx, currentUser *User, render render.Render) {
+	notifications := []*Notification{}
+	if err := meddler.QueryAll(tx, &notifications, `SELECT * FROM notifications WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT 100`,
+		currentUser.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, notifications)
+}
+
+// GetUserMeNotificationPreferences handles requests to /v2/users/me/notification_preferences,
+// returning the current user's notification preferences.
+func GetUserMeNotificationPreferences(w http.ResponseWriter, currentUser *User, render render.Render) {
+	prefs := currentUser.Notifications
+	if prefs == nil {
+		prefs = new(NotificationPreferences)
+	}
+	render.JSON(http.StatusOK, prefs)
+}
+
+// PutUserMeNotificationPreferences handles requests to /v2/users/me/notification_preferences,
+// replacing the current user's notification preferences. A webhook must
+// use https, and is only delivered to public addresses.
+func PutUserMeNotificationPreferences(w http.ResponseWriter, tx *sql.Tx, currentUser *User, prefs NotificationPreferences, render render.Render) {
+	prefs.WebhookURL = strings.TrimSpace(prefs.WebhookURL)
+	if prefs.WebhookURL != "" {
+		u, err := url.Parse(prefs.WebhookURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "webhook must be an https URL")
+			return
+		}
+	}
+	for _, kind := range prefs.Muted {
+		if !notificationKinds[kind] {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "unknown notification kind %q", kind)
+			return
+		}
+	}
+	raw, err := json.Marshal(&prefs)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "json error: %v", err)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE users SET notifications = $1, updated_at = $2 WHERE id = $3`,
+		string(raw), time.Now(), currentUser.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	currentUser.Notifications = &prefs
+	render.JSON(http.StatusOK, &prefs)
+}
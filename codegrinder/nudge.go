@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+const defaultNudgeSubject = `Reminder: {{.Assignment.CanvasTitle}} in {{.Course.Name}}`
+
+const defaultNudgeTemplate = `Hi {{.User.Name}},
+
+This is a reminder that you have not started {{.Assignment.CanvasTitle}} in {{.Course.Name}} yet.
+Open the assignment from the course page to get started.
+
+-- {{.ToolName}}
+`
+
+// nudgeData is the value passed to the nudge subject and body templates.
+type nudgeData struct {
+	User       *User
+	Course     *Course
+	Assignment *Assignment
+	ToolName   string
+}
+
+// parseCutoff reads the optional cutoff=<...> parameter as an RFC 3339
+// timestamp or a YYYY-MM-DD date, defaulting to now.
+func parseCutoff(w http.ResponseWriter, r *http.Request, now time.Time) (time.Time, bool) {
+	s := r.FormValue("cutoff")
+	if s == "" {
+		return now, true
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing cutoff %q: expected RFC 3339 time or YYYY-MM-DD date", s)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// findNotStarted returns the students in a course with no commits on a
+// problem set before the cutoff time, along with the last time each was nudged.
+func findNotStarted(w http.ResponseWriter, tx *sql.Tx, params martini.Params, cutoff time.Time) (*Course, []*NotStarted, bool) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return nil, nil, false
+	}
+	problemSetID, err := parseID(w, "problem_set_id", params["problem_set_id"])
+	if err != nil {
+		return nil, nil, false
+	}
+
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil, nil, false
+	}
+
+	assignments := []*Assignment{}
+	err = meddler.QueryAll(tx, &assignments, `SELECT * FROM assignments `+
+		`WHERE course_id = $1 AND problem_set_id = $2 AND NOT instructor AND NOT EXISTS `+
+		`(SELECT 1 FROM commits WHERE commits.assignment_id = assignments.id AND commits.created_at < $3) `+
+		`ORDER BY user_id`,
+		courseID, problemSetID, cutoff)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return nil, nil, false
+	}
+
+	list := []*NotStarted{}
+	for _, asst := range assignments {
+		user := new(User)
+		if err := meddler.Load(tx, "users", user, asst.UserID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading user %d: %v", asst.UserID, err)
+			return nil, nil, false
+		}
+		elt := &NotStarted{User: user, Assignment: asst}
+
+		var last *time.Time
+		if err := tx.QueryRow(`SELECT MAX(created_at) FROM nudges WHERE assignment_id = $1`, asst.ID).Scan(&last); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return nil, nil, false
+		}
+		elt.LastNudgedAt = last
+		list = append(list, elt)
+	}
+
+	return course, list, true
+}
+
+// GetCourseProblemSetNotStarted handles requests to
+// /v2/courses/:course_id/problem_sets/:problem_set_id/not_started,
+// returning the students in the course who have not made any commits on the
+// problem set.
+//
+// If parameter cutoff=<...> is present, only commits made before that time count.
+func GetCourseProblemSetNotStarted(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, render render.Render) {
+	cutoff, ok := parseCutoff(w, r, time.Now())
+	if !ok {
+		return
+	}
+	_, list, ok := findNotStarted(w, tx, params, cutoff)
+	if !ok {
+		return
+	}
+	render.JSON(http.StatusOK, list)
+}
+
+// PostCourseProblemSetNudge handles requests to
+// /v2/courses/:course_id/problem_sets/:problem_set_id/nudge,
+// queuing a reminder message to every student who has not started the problem
+// set and returning a report of who was messaged.
+// Students nudged within the cooldown window are skipped.
+// Messages are delivered by the notification worker after the request
+// commits, on the channels each student has enabled.
+//
+// If parameter cutoff=<...> is present, only commits made before that time count.
+func PostCourseProblemSetNudge(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	now := time.Now()
+	cutoff, ok := parseCutoff(w, r, now)
+	if !ok {
+		return
+	}
+	course, list, ok := findNotStarted(w, tx, params, cutoff)
+	if !ok {
+		return
+	}
+
+	subject, err := template.New("subject").Parse(Config().NudgeSubject)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error parsing nudge subject template: %v", err)
+		return
+	}
+	body, err := template.New("body").Parse(Config().NudgeTemplate)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error parsing nudge template: %v", err)
+		return
+	}
+
+	cooldown := time.Duration(Config().NudgeCooldownHours) * time.Hour
+	report := &NudgeReport{Sent: []int64{}, Suppressed: []int64{}}
+	for _, elt := range list {
+		if elt.LastNudgedAt != nil && now.Sub(*elt.LastNudgedAt) < cooldown {
+			report.Suppressed = append(report.Suppressed, elt.User.ID)
+			continue
+		}
+
+		data := &nudgeData{User: elt.User, Course: course, Assignment: elt.Assignment, ToolName: Config().ToolName}
+		subjectText, bodyText := new(bytes.Buffer), new(bytes.Buffer)
+		if err := subject.Execute(subjectText, data); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error filling in nudge subject template: %v", err)
+			return
+		}
+		if err := body.Execute(bodyText, data); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error filling in nudge template: %v", err)
+			return
+		}
+
+		// queue the message so nothing is sent if the transaction rolls back
+		if err := queueNotification(tx, elt.User, NotifyNudge, subjectText.String(), bodyText.String()); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error queuing nudge: %v", err)
+			return
+		}
+
+		nudge := &Nudge{AssignmentID: elt.Assignment.ID, SentBy: currentUser.ID, CreatedAt: now}
+		if err := meddler.Insert(tx, "nudges", nudge); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error saving nudge: %v", err)
+			return
+		}
+		report.Sent = append(report.Sent, elt.User.ID)
+	}
+
+	render.JSON(http.StatusOK, report)
+}
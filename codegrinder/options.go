@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// A course can set default problem options for each problem type, such as
+// extra compiler flags for every C problem in the course. When work is
+// graded, the defaults are merged with the problem's own options:
+//
+//  1. the problem type's built-in behavior applies when neither sets an option
+//  2. the course defaults for the problem type come next
+//  3. the problem's own options take precedence over the course defaults
+//
+// An option of the form key=value replaces a course default with the same
+// key; any other option is a flag and is added to the course defaults.
+
+// optionKey returns the part of an option that identifies it when merging.
+func optionKey(option string) string {
+	if i := strings.Index(option, "="); i >= 0 {
+		return option[:i+1]
+	}
+	return option
+}
+
+// mergeOptions combines course defaults with a problem's options, returning
+// the effective options and where each came from.
+func mergeOptions(courseOptions, problemOptions []string) ([]string, map[string]string) {
+	overridden := make(map[string]bool)
+	for _, option := range problemOptions {
+		overridden[optionKey(option)] = true
+	}
+	options := []string{}
+	sources := make(map[string]string)
+	for _, option := range courseOptions {
+		if !overridden[optionKey(option)] {
+			options = append(options, option)
+			sources[option] = "course"
+		}
+	}
+	for _, option := range problemOptions {
+		if _, duplicate := sources[option]; !duplicate {
+			options = append(options, option)
+			sources[option] = "problem"
+		}
+	}
+	return options, sources
+}
+
+// courseOptions returns the default options a course sets for a problem type.
+func courseOptions(tx *sql.Tx, courseID int64, problemType string) ([]string, error) {
+	defaults := new(CourseProblemOptions)
+	err := meddler.QueryRow(tx, defaults, `SELECT * FROM course_problem_options WHERE course_id = $1 AND problem_type = $2`, courseID, problemType)
+	if err == sql.ErrNoRows {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return defaults.Options, nil
+}
+
+// applyCourseOptions replaces a problem's options with the effective options
+// for a course. The problem is signed with the effective options, so every
+// place that signs a problem for grading must apply them the same way.
+func applyCourseOptions(tx *sql.Tx, courseID int64, problem *Problem) error {
+	defaults, err := courseOptions(tx, courseID, problem.ProblemType)
+	if err != nil {
+		return err
+	}
+	problem.Options, _ = mergeOptions(defaults, problem.Options)
+	return nil
+}
+
+// applyUserLocale sets the locale option of a problem to a student's
+// language when one of its steps has localized expected output for that
+// language. Like the course options, it is covered by the problem signature.
+func applyUserLocale(problem *Problem, steps []*ProblemStep, locale string) {
+	options := []string{}
+	for _, option := range problem.Options {
+		if !strings.HasPrefix(option, LocaleOption) {
+			options = append(options, option)
+		}
+	}
+	problem.Options = options
+	if locale == "" {
+		return
+	}
+	for _, step := range steps {
+		for _, elt := range OutputLocales(step.Files) {
+			if elt == locale {
+				problem.Options = append(problem.Options, LocaleOption+locale)
+				return
+			}
+		}
+	}
+}
+
+// GetCourseProblemOptions handles a request to /v2/courses/:course_id/problem_options,
+// returning the default options the course sets for each problem type.
+func GetCourseProblemOptions(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	defaults := []*CourseProblemOptions{}
+	if err := meddler.QueryAll(tx, &defaults, `SELECT * FROM course_problem_options WHERE course_id = $1 ORDER BY problem_type`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, defaults)
+}
+
+// PutCourseProblemOptions handles a request to /v2/courses/:course_id/problem_options/:problem_type,
+// setting the default options for one problem type in a course. Only the
+// options from the request are used; an empty list removes the defaults.
+func PutCourseProblemOptions(w http.ResponseWriter, tx *sql.Tx, params martini.Params, request CourseProblemOptions, audit *AuditEntry, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	problemType := params["problem_type"]
+	if _, exists := problemTypes[problemType]; !exists {
+		loggedHTTPErrorf(w, http.StatusNotFound, "problem type %q not found", problemType)
+		return
+	}
+
+	defaults := &CourseProblemOptions{
+		CourseID:    courseID,
+		ProblemType: problemType,
+		Options:     []string{},
+		UpdatedAt:   time.Now(),
+	}
+	for _, option := range request.Options {
+		if option = strings.TrimSpace(option); option != "" {
+			defaults.Options = append(defaults.Options, option)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM course_problem_options WHERE course_id = $1 AND problem_type = $2`, courseID, problemType); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if len(defaults.Options) > 0 {
+		if err := meddler.Insert(tx, "course_problem_options", defaults); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	audit.Record(AuditRequest, courseID, "course %d default options for %s: %q", courseID, problemType, defaults.Options)
+	render.JSON(http.StatusOK, defaults)
+}
+
+// GetAssignmentEffectiveOptions handles a request to /v2/assignments/:assignment_id/effective_options,
+// showing the course defaults, the problem's own options, and the options
+// used for grading each problem in the assignment. Only instructors for the
+// course and administrators may see this.
+func GetAssignmentEffectiveOptions(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	problems := []*Problem{}
+	if err := meddler.QueryAll(tx, &problems, `SELECT problems.* FROM problems JOIN problem_set_problems ON problems.id = problem_set_problems.problem_id `+
+		`WHERE problem_set_problems.problem_set_id = $1 ORDER BY problems.unique_id`, assignment.ProblemSetID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	results := []*EffectiveOptions{}
+	for _, problem := range problems {
+		defaults, err := courseOptions(tx, assignment.CourseID, problem.ProblemType)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		own := problem.Options
+		if own == nil {
+			own = []string{}
+		}
+		options, sources := mergeOptions(defaults, own)
+		results = append(results, &EffectiveOptions{
+			ProblemID:      problem.ID,
+			Unique:         problem.Unique,
+			ProblemType:    problem.ProblemType,
+			CourseOptions:  defaults,
+			ProblemOptions: own,
+			Options:        options,
+			Sources:        sources,
+		})
+	}
+	render.JSON(http.StatusOK, results)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/martini-contrib/render"
+	"github.com/russross/meddler"
+)
+
+// The outbox is an append-only log of events for external systems such as
+// departmental dashboards and data warehouses. Events are written in the
+// same transaction as the change they describe, so an event is recorded if
+// and only if the change is.
+//
+// Consumers page through the log with GET /v2/outbox_events, passing back
+// the cursor from the previous page. Events are ordered by the transaction
+// that wrote them and only returned once every earlier transaction has
+// finished, so a consumer that follows the cursor sees every event exactly
+// once even when transactions commit out of order.
+
+// OutboxEvent is one entry in the outbox.
+type OutboxEvent struct {
+	ID        int64           `json:"id" meddler:"id,pk"`
+	TxID      int64           `json:"-" meddler:"txid"`
+	Kind      string          `json:"kind" meddler:"kind"`
+	CourseID  int64           `json:"courseID,omitempty" meddler:"course_id,zeroisnull"`
+	UserID    int64           `json:"userID,omitempty" meddler:"user_id,zeroisnull"`
+	ObjectID  int64           `json:"objectID" meddler:"object_id"`
+	Data      json.RawMessage `json:"data" meddler:"data"`
+	CreatedAt time.Time       `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// OutboxPage is one page of events and the cursor to fetch the next page.
+type OutboxPage struct {
+	Events []*OutboxEvent `json:"events"`
+	Cursor string         `json:"cursor"`
+}
+
+// Outbox event kinds. ObjectID is the commit for EventCommitGraded, the
+// comment for EventCommitComment, the request for EventRegradeRequest and
+// EventRegradeResolved, and the assignment for the others.
+const (
+	EventCommitGraded      = "commit-graded"
+	EventScoreChanged      = "score-changed"
+	EventAssignmentCreated = "assignment-created"
+	EventAssignmentReopen  = "assignment-reopened"
+	EventScoreOverridden   = "score-overridden"
+	EventCommitComment     = "commit-comment"
+	EventRegradeRequest    = "regrade-request"
+	EventRegradeResolved   = "regrade-resolved"
+)
+
+// DefaultOutboxLimit is the number of events in a page if the consumer does
+// not ask for a different number.
+const DefaultOutboxLimit = 1000
+
+// recordEvent appends an event to the outbox as part of a transaction.
+// The data is encoded as JSON.
+func recordEvent(tx *sql.Tx, kind string, courseID, userID, objectID int64, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO outbox_events (txid, kind, course_id, user_id, object_id, data, created_at) `+
+		`VALUES (txid_current(), $1, NULLIF($2, 0), NULLIF($3, 0), $4, $5, $6)`,
+		kind, courseID, userID, objectID, string(raw), time.Now())
+	return err
+}
+
+// outboxCursor encodes the position just after an event.
+func outboxCursor(event *OutboxEvent) string {
+	return fmt.Sprintf("%d-%d", event.TxID, event.ID)
+}
+
+// parseOutboxCursor decodes a cursor. The empty cursor is the start of the log.
+func parseOutboxCursor(cursor string) (txid, id int64, err error) {
+	if cursor == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(cursor, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("malformed cursor %q", cursor)
+	}
+	if txid, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("malformed cursor %q", cursor)
+	}
+	if id, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("malformed cursor %q", cursor)
+	}
+	return txid, id, nil
+}
+
+// GetOutboxEvents handles a request to /v2/outbox_events,
+// returning the next page of events from the outbox, oldest first.
+//
+// If parameter after=<...> present, only events after that cursor are returned.
+// If parameter kind=<...> present, results will be filtered by event kind.
+// If parameter limit=<...> present, at most that many events are returned (default 1000).
+//
+// The response includes the cursor to pass as after=<...> for the next page,
+// which is unchanged if there were no new events.
+func GetOutboxEvents(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	cursor := r.FormValue("after")
+	txid, id, err := parseOutboxCursor(cursor)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	limit := DefaultOutboxLimit
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	// a kind filter still advances the cursor past the events it skips, so
+	// scan without the filter and apply it afterward
+	events := []*OutboxEvent{}
+	if err := meddler.QueryAll(tx, &events, `SELECT * FROM outbox_events `+
+		`WHERE (txid, id) > ($1, $2) AND txid < txid_snapshot_xmin(txid_current_snapshot()) `+
+		`ORDER BY txid, id LIMIT $3`, txid, id, limit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	page := &OutboxPage{Events: []*OutboxEvent{}, Cursor: cursor}
+	kind := r.FormValue("kind")
+	for _, event := range events {
+		page.Cursor = outboxCursor(event)
+		if kind == "" || event.Kind == kind {
+			page.Events = append(page.Events, event)
+		}
+	}
+	render.JSON(http.StatusOK, page)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// An instructor can override the computed score of a student's assignment,
+// giving a comment that explains why. The computed score keeps changing as
+// the student works, but while an override is in place it is the score
+// posted to the LMS, with the comment attached, and the one students see.
+// Removing the override posts the computed score again.
+//
+// Every change to the score is kept in the score history, so students and
+// staff can see when a score was set by hand, by whom, and why.
+
+// recordScoreChange adds an entry to the score history of an assignment.
+func recordScoreChange(tx *sql.Tx, assignmentID int64, score float64, source, comment string, changedBy int64, now time.Time) error {
+	change := &ScoreChange{
+		AssignmentID: assignmentID,
+		Score:        score,
+		Source:       source,
+		Comment:      comment,
+		ChangedBy:    changedBy,
+		CreatedAt:    now,
+	}
+	return meddler.Insert(tx, "score_history", change)
+}
+
+// loadScoreOverride returns the score override for an assignment, or nil if
+// there is none.
+func loadScoreOverride(tx *sql.Tx, assignmentID int64) (*ScoreOverride, error) {
+	override := new(ScoreOverride)
+	err := meddler.QueryRow(tx, override, `SELECT * FROM score_overrides WHERE assignment_id = $1`, assignmentID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return override, nil
+}
+
+// attachScoreOverrides fills in the score override of each assignment.
+func attachScoreOverrides(tx *sql.Tx, assignments ...*Assignment) error {
+	for _, asst := range assignments {
+		override, err := loadScoreOverride(tx, asst.ID)
+		if err != nil {
+			return err
+		}
+		asst.ScoreOverride = override
+	}
+	return nil
+}
+
+// loadOverrideAssignment loads the assignment named in a score override
+// request. The route may name the student as well as the assignment.
+func loadOverrideAssignment(w http.ResponseWriter, tx *sql.Tx, params martini.Params) (*Assignment, *User, error) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return nil, nil, err
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil, nil, err
+	}
+	if params["user_id"] != "" {
+		userID, err := parseID(w, "user_id", params["user_id"])
+		if err != nil {
+			return nil, nil, err
+		}
+		if userID != assignment.UserID {
+			err := sql.ErrNoRows
+			loggedHTTPDBNotFoundError(w, err)
+			return nil, nil, err
+		}
+	}
+	student := new(User)
+	if err := meddler.Load(tx, "users", student, assignment.UserID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil, nil, err
+	}
+	return assignment, student, nil
+}
+
+// PutAssignmentScore handles a request to /v2/assignments/:assignment_id/score_override
+// or /v2/users/:user_id/assignments/:assignment_id/score,
+// overriding the computed score of the assignment. The request gives the
+// new score from 0.0 to 1.0 and a comment justifying it. Only instructors
+// for the course and administrators may do this.
+func PutAssignmentScore(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, request ScoreOverride, audit *AuditEntry, render render.Render) {
+	now := time.Now()
+
+	assignment, student, err := loadOverrideAssignment(w, tx, params)
+	if err != nil {
+		return
+	}
+	request.Comment = strings.TrimSpace(request.Comment)
+	if request.Comment == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "a comment justifying the score override is required")
+		return
+	}
+	if request.Score < 0.0 || request.Score > 1.0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "score must be between 0.0 and 1.0")
+		return
+	}
+
+	override, err := loadScoreOverride(tx, assignment.ID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	oldScore := assignment.Score
+	if override == nil {
+		override = &ScoreOverride{AssignmentID: assignment.ID, CreatedAt: now}
+	} else {
+		oldScore = override.Score
+	}
+	override.Score = request.Score
+	override.Comment = request.Comment
+	override.OverriddenBy = currentUser.ID
+	override.UpdatedAt = now
+	if err := meddler.Save(tx, "score_overrides", override); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := recordScoreChange(tx, assignment.ID, override.Score, ScoreSourceOverride, override.Comment, currentUser.ID, now); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := recordEvent(tx, EventScoreOverridden, assignment.CourseID, assignment.UserID, assignment.ID, map[string]interface{}{
+		"overriddenBy": currentUser.ID,
+		"oldScore":     oldScore,
+		"score":        override.Score,
+		"comment":      override.Comment,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditScoreOverride, assignment.ID, "assignment %d for user %d score overridden %.4f -> %.4f: %s",
+		assignment.ID, assignment.UserID, oldScore, override.Score, override.Comment)
+	if err := queueNotification(tx, student, NotifyGradePosted, "Grade posted: "+assignment.CanvasTitle,
+		fmt.Sprintf("Your instructor set your score for %s to %.0f%%:\n\n%s\n", assignment.CanvasTitle, override.Score*100, override.Comment)); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	if err := saveGrade(tx, assignment, student); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error posting grade back to LMS: %v", err)
+		return
+	}
+
+	render.JSON(http.StatusOK, override)
+}
+
+// DeleteAssignmentScore handles a request to /v2/assignments/:assignment_id/score_override
+// or /v2/users/:user_id/assignments/:assignment_id/score,
+// removing a score override so the computed score applies again.
+func DeleteAssignmentScore(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *AuditEntry) {
+	assignment, student, err := loadOverrideAssignment(w, tx, params)
+	if err != nil {
+		return
+	}
+	override, err := loadScoreOverride(tx, assignment.ID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if override == nil {
+		loggedHTTPErrorf(w, http.StatusNotFound, "assignment %d has no score override", assignment.ID)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM score_overrides WHERE id = $1`, override.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := recordScoreChange(tx, assignment.ID, assignment.Score, ScoreSourceOverrideRemoved, "", currentUser.ID, time.Now()); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := recordEvent(tx, EventScoreOverridden, assignment.CourseID, assignment.UserID, assignment.ID, map[string]interface{}{
+		"overriddenBy": currentUser.ID,
+		"oldScore":     override.Score,
+		"score":        assignment.Score,
+		"removed":      true,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditScoreOverride, assignment.ID, "assignment %d for user %d score override removed %.4f -> %.4f",
+		assignment.ID, assignment.UserID, override.Score, assignment.Score)
+	if err := queueNotification(tx, student, NotifyGradePosted, "Grade posted: "+assignment.CanvasTitle,
+		fmt.Sprintf("Your score for %s is %.0f%% again, as computed from your work.\n", assignment.CanvasTitle, assignment.Score*100)); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	if err := saveGrade(tx, assignment, student); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error posting grade back to LMS: %v", err)
+		return
+	}
+}
+
+// GetAssignmentScoreHistory handles a request to /v2/assignments/:assignment_id/score_history,
+// returning every change to the assignment's score, oldest first. Students
+// can see the history of their own assignments, and course staff can see
+// any in the course.
+func GetAssignmentScoreHistory(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if assignment.UserID != currentUser.ID {
+		if ok, err := isCourseStaff(tx, currentUser, assignment.CourseID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		} else if !ok {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) cannot see the score history of assignment %d", currentUser.ID, currentUser.Name, assignment.ID)
+			return
+		}
+	}
+	history := []*ScoreChange{}
+	if err := meddler.QueryAll(tx, &history, `SELECT * FROM score_history WHERE assignment_id = $1 ORDER BY created_at, id`, assignment.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, history)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// A grading action can score distinct components of a step, such as style
+// or performance, as separately weighted parts of the report card. The
+// results of the report card itself form the "tests" part with a weight of
+// 1, and the step score is the weighted average of the parts. Instructors
+// can override the weight of any part with a problem option:
+//
+//	weight-tests=<weight>
+//	weight-style=<weight>
+//	weight-performance=<weight>
+//
+// The tests must have a positive weight. A part named in an option but
+// never scored is ignored. Only the tests
+// decide whether the step is passed.
+
+const (
+	PartWeightOption  = "weight-"
+	DefaultPartWeight = 1.0
+)
+
+// applyPartWeights sets the weights of the parts of a report card from
+// the problem options.
+func applyPartWeights(card *ReportCard, options []string) {
+	for _, option := range options {
+		if !strings.HasPrefix(option, PartWeightOption) {
+			continue
+		}
+		setting := strings.TrimPrefix(option, PartWeightOption)
+		eq := strings.Index(setting, "=")
+		if eq < 1 {
+			card.LogAndFailf("invalid problem option %q: must be of the form %s<part>=<weight>", option, PartWeightOption)
+			continue
+		}
+		name := setting[:eq]
+		weight, err := strconv.ParseFloat(setting[eq+1:], 64)
+		if err == nil && (weight < 0.0 || weight == 0.0 && name == TestsPart) {
+			err = strconv.ErrRange
+		}
+		if err != nil {
+			card.LogAndFailf("invalid problem option %q: %v", option, err)
+			continue
+		}
+		if name == TestsPart {
+			card.Weight = weight
+			continue
+		}
+		for _, part := range card.Parts {
+			if part.Name == name {
+				part.Weight = weight
+			}
+		}
+	}
+}
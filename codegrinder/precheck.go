@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+
+	"github.com/go-martini/martini"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Pre-check modules are WebAssembly programs supplied by problem authors
+// that run a quick subset of the tests on the student's machine, either in
+// the browser or through grind precheck. They are compiled as WASI commands:
+// the student's files are in the current directory, their names are passed
+// as arguments, and a non-zero exit status means the pre-check failed.
+// Pre-checks are experimental and purely advisory; grading always happens in
+// the daycare.
+
+// omitPrechecks drops pre-check modules from problem steps before they are
+// sent to clients that do not need them, since they can be large.
+func omitPrechecks(steps ...*ProblemStep) {
+	for _, step := range steps {
+		step.Precheck = nil
+	}
+}
+
+// GetProblemStepPrecheck handles a request to /v2/problems/:problem_id/steps/:step/precheck.wasm,
+// returning the WebAssembly pre-check module for a problem step.
+// The ETag changes whenever the module does, so clients can cache it per
+// problem version.
+func GetProblemStepPrecheck(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User) {
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	step, err := parseID(w, "step", params["step"])
+	if err != nil {
+		return
+	}
+
+	problemStep := new(ProblemStep)
+
+	if currentUser.Admin || currentUser.Author {
+		err = meddler.QueryRow(tx, problemStep, `SELECT * FROM problem_steps WHERE problem_id = $1 AND step = $2`, problemID, step)
+	} else {
+		err = meddler.QueryRow(tx, problemStep, `SELECT problem_steps.* `+
+			`FROM problem_steps JOIN user_problems ON problem_steps.problem_id = user_problems.problem_id `+
+			`WHERE user_problems.user_id = $1 AND problem_steps.problem_id = $2 AND problem_steps.step = $3`,
+			currentUser.ID, problemID, step)
+	}
+
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if len(problemStep.Precheck) == 0 {
+		loggedHTTPErrorf(w, http.StatusNotFound, "problem %d step %d has no pre-check", problemID, step)
+		return
+	}
+
+	sum := sha256.Sum256(problemStep.Precheck)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/wasm")
+	w.Header().Set("Content-Length", strconv.Itoa(len(problemStep.Precheck)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(problemStep.Precheck)
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/render"
@@ -13,13 +17,13 @@ import (
 
 // GetProblemTypes handles a request to /v2/problemtypes,
 // returning a complete list of problem types.
-func GetProblemTypes(w http.ResponseWriter, render render.Render) {
-	render.JSON(http.StatusOK, problemTypes)
+func GetProblemTypes(w http.ResponseWriter, r *http.Request) {
+	renderJSONWithETag(w, r, problemTypes)
 }
 
 // GetProblemType handles a request to /v2/problemtypes/:name,
 // returning a single problem type with the given name.
-func GetProblemType(w http.ResponseWriter, params martini.Params, render render.Render) {
+func GetProblemType(w http.ResponseWriter, r *http.Request, params martini.Params) {
 	name := params["name"]
 
 	problemType, exists := problemTypes[name]
@@ -29,7 +33,7 @@ func GetProblemType(w http.ResponseWriter, params martini.Params, render render.
 		return
 	}
 
-	render.JSON(http.StatusOK, problemType)
+	renderJSONWithETag(w, r, problemType)
 }
 
 // GetProblems handles a request to /v2/problems,
@@ -74,9 +78,117 @@ func GetProblems(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser
 	render.JSON(http.StatusOK, problems)
 }
 
+// GetProblemsSearch handles a request to /v2/problems/search,
+// returning problems that match a query, most relevant first.
+// Only authors and administrators may search, since the point is to find
+// existing problems to reuse.
+//
+// If parameter q=<...> present, results must match the words of the query in the problem note,
+// the instructions of any step, or the unique ID. Quoted phrases and -word exclusions are supported.
+// If parameter tags=<...> present, results must have all of the comma-separated tags.
+// If parameter problemType=<...> present, results will be filtered by matching ProblemType.
+// If parameter author=<...> present, results will be filtered by author, given as a user ID or email address.
+// If parameter limit=<...> present, at most that many results are returned (default 50).
+func GetProblemsSearch(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	where := ""
+	args := []interface{}{}
+	rank := "0"
+
+	if q := strings.TrimSpace(r.FormValue("q")); q != "" {
+		args = append(args, q)
+		query := fmt.Sprintf("websearch_to_tsquery('english', $%d)", len(args))
+		rank = fmt.Sprintf("ts_rank(to_tsvector('english', problems.note), %s) + "+
+			"COALESCE((SELECT MAX(ts_rank(to_tsvector('english', instructions), %s)) FROM problem_steps WHERE problem_id = problems.id), 0)",
+			query, query)
+		args = append(args, "%"+strings.ToLower(q)+"%")
+		where = fmt.Sprintf(" WHERE (to_tsvector('english', problems.note) @@ %s"+
+			" OR EXISTS (SELECT 1 FROM problem_steps WHERE problem_id = problems.id AND to_tsvector('english', instructions) @@ %s)"+
+			" OR lower(problems.unique_id) LIKE $%d)", query, query, len(args))
+	}
+
+	if tags := r.FormValue("tags"); tags != "" {
+		list := []string{}
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				list = append(list, tag)
+			}
+		}
+		raw, err := json.Marshal(list)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "json error: %v", err)
+			return
+		}
+		if where == "" {
+			where = " WHERE"
+		} else {
+			where += " AND"
+		}
+		args = append(args, string(raw))
+		where += fmt.Sprintf(" problems.tags @> $%d::jsonb", len(args))
+	}
+
+	if problemType := r.FormValue("problemType"); problemType != "" {
+		where, args = addWhereEq(where, args, "problems.problem_type", problemType)
+	}
+
+	if author := strings.TrimSpace(r.FormValue("author")); author != "" {
+		if authorID, err := strconv.ParseInt(author, 10, 64); err == nil {
+			where, args = addWhereEq(where, args, "problems.author_id", authorID)
+		} else {
+			where, args = addWhereEq(where, args, "lower(users.email)", strings.ToLower(author))
+		}
+	}
+
+	limit := 50
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	rows, err := tx.Query(`SELECT problems.id, `+rank+` AS rank `+
+		`FROM problems LEFT JOIN users ON problems.author_id = users.id`+where+
+		fmt.Sprintf(` ORDER BY rank DESC, problems.unique_id LIMIT %d`, limit), args...)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	results := []*ProblemSearchResult{}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		result := new(ProblemSearchResult)
+		if err := rows.Scan(&id, &result.Rank); err != nil {
+			rows.Close()
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		ids = append(ids, id)
+		results = append(results, result)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	for i, id := range ids {
+		results[i].Problem = new(Problem)
+		if err := meddler.Load(tx, "problems", results[i].Problem, id); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+
+	render.JSON(http.StatusOK, results)
+}
+
 // GetProblem handles a request to /v2/problems/:problem_id,
 // returning a single problem.
-func GetProblem(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+func GetProblem(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User) {
 	problemID, err := parseID(w, "problem_id", params["problem_id"])
 	if err != nil {
 		return
@@ -98,12 +210,12 @@ func GetProblem(w http.ResponseWriter, tx *sql.Tx, params martini.Params, curren
 		return
 	}
 
-	render.JSON(http.StatusOK, problem)
+	renderJSONWithETag(w, r, problem)
 }
 
 // DeleteProblem handles request to /v2/problems/:problem_id,
-// deleting the given problem.
-// Note: this deletes all steps, assignments, and commits related to the problem,
+// deleting the given problem. It can be restored until it is purged.
+// Note: purging deletes all steps, assignments, and commits related to the problem,
 // and it removes it from any problem sets it was part of.
 func DeleteProblem(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
 	problemID, err := strconv.ParseInt(params["problem_id"], 10, 64)
@@ -112,7 +224,7 @@ func DeleteProblem(w http.ResponseWriter, tx *sql.Tx, params martini.Params, ren
 		return
 	}
 
-	if _, err := tx.Exec(`DELETE FROM problems WHERE id = $1`, problemID); err != nil {
+	if err := softDeleteProblem(tx, problemID, time.Now()); err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
@@ -120,7 +232,7 @@ func DeleteProblem(w http.ResponseWriter, tx *sql.Tx, params martini.Params, ren
 
 // GetProblemSteps handles a request to /v2/problems/:problem_id/steps,
 // returning a list of all steps for a problem.
-func GetProblemSteps(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+func GetProblemSteps(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User) {
 	problemID, err := parseID(w, "problem_id", params["problem_id"])
 	if err != nil {
 		return
@@ -149,12 +261,22 @@ func GetProblemSteps(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params
 		return
 	}
 
-	render.JSON(http.StatusOK, problemSteps)
+	// students only see the files for their starter variant
+	if !currentUser.Admin && !currentUser.Author {
+		if err := applyVariant(tx, problemID, currentUser.ID, problemSteps...); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		omitHiddenTests(problemSteps...)
+	}
+
+	omitPrechecks(problemSteps...)
+	renderJSONWithETag(w, r, problemSteps)
 }
 
 // GetProblemStep handles a request to /v2/problems/:problem_id/steps/:step,
 // returning a single problem step.
-func GetProblemStep(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+func GetProblemStep(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User) {
 	problemID, err := parseID(w, "problem_id", params["problem_id"])
 	if err != nil {
 		return
@@ -180,7 +302,61 @@ func GetProblemStep(w http.ResponseWriter, tx *sql.Tx, params martini.Params, cu
 		return
 	}
 
-	render.JSON(http.StatusOK, problemStep)
+	// students only see the files for their starter variant
+	if !currentUser.Admin && !currentUser.Author {
+		if err := applyVariant(tx, problemID, currentUser.ID, problemStep); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		omitHiddenTests(problemStep)
+	}
+
+	omitPrechecks(problemStep)
+	renderJSONWithETag(w, r, problemStep)
+}
+
+// applyVariant replaces the files of each step with the files of the
+// starter variant assigned to the given user.
+func applyVariant(tx *sql.Tx, problemID, userID int64, steps ...*ProblemStep) error {
+	problem := new(Problem)
+	if err := meddler.Load(tx, "problems", problem, problemID); err != nil {
+		return err
+	}
+	variant := problem.ChooseVariant(userID)
+	for _, step := range steps {
+		step.Files = step.VariantFiles(variant)
+	}
+	return nil
+}
+
+// VariantStats summarizes the results for one step of one starter variant.
+type VariantStats struct {
+	Variant string `json:"variant" meddler:"variant"`
+	Step    int64  `json:"step" meddler:"step"`
+	Commits int64  `json:"commits" meddler:"commits"`
+	Passed  int64  `json:"passed" meddler:"passed"`
+}
+
+// GetProblemVariants handles a request to /v2/problems/:problem_id/variants,
+// returning the number of commits and passing commits for each step of each
+// starter variant so that pass rates can be compared across variants.
+func GetProblemVariants(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+
+	stats := []*VariantStats{}
+	if err := meddler.QueryAll(tx, &stats, `SELECT COALESCE(variant, '') AS variant, step, COUNT(1) AS commits, `+
+		`SUM(CASE WHEN score = 1.0 THEN 1 ELSE 0 END) AS passed `+
+		`FROM commits WHERE problem_id = $1 `+
+		`GROUP BY variant, step ORDER BY variant, step`,
+		problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	render.JSON(http.StatusOK, stats)
 }
 
 // GetProblemSets handles a request to /v2/problem_sets,
@@ -248,6 +424,38 @@ func GetProblemSet(w http.ResponseWriter, tx *sql.Tx, params martini.Params, cur
 	render.JSON(http.StatusOK, problemSet)
 }
 
+// GetProblemSetInstructions handles a request to /v2/problem_sets/:problem_set_id/instructions,
+// returning the compiled overview of the problem set as an HTML document.
+func GetProblemSetInstructions(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User) {
+	problemSetID, err := parseID(w, "problem_set_id", params["problem_set_id"])
+	if err != nil {
+		return
+	}
+
+	problemSet := new(ProblemSet)
+
+	if currentUser.Admin || currentUser.Author {
+		err = meddler.Load(tx, "problem_sets", problemSet, problemSetID)
+	} else {
+		err = meddler.QueryRow(tx, problemSet, `SELECT problem_sets.* `+
+			`FROM problem_sets JOIN user_problem_sets ON problem_sets.id = problem_set_id `+
+			`WHERE user_id = $1 AND problem_set_id = $2`,
+			currentUser.ID, problemSetID)
+	}
+
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if problemSet.Instructions == "" {
+		loggedHTTPErrorf(w, http.StatusNotFound, "problem set %d has no instructions", problemSetID)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(problemSet.Instructions))
+}
+
 // GetProblemSetProblems handles a request to /v2/problem_sets/:problem_set_id/problems,
 // returning a list of all problems set problems for a given problem set.
 func GetProblemSetProblems(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
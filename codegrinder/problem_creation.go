@@ -3,8 +3,10 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-martini/martini"
@@ -16,7 +18,7 @@ import (
 // PostProblemBundleConfirmed handles a request to /v2/problem_bundles/confirmed,
 // creating a new problem.
 // The bundle must have a full set of passing commits signed by the daycare.
-func PostProblemBundleConfirmed(w http.ResponseWriter, tx *sql.Tx, bundle ProblemBundle, render render.Render) {
+func PostProblemBundleConfirmed(w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle ProblemBundle, render render.Render) {
 	if bundle.Problem == nil {
 		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must contain a problem")
 		return
@@ -25,6 +27,7 @@ func PostProblemBundleConfirmed(w http.ResponseWriter, tx *sql.Tx, bundle Proble
 		loggedHTTPErrorf(w, http.StatusBadRequest, "new problem cannot already have a problem ID")
 		return
 	}
+	bundle.Problem.AuthorID = currentUser.ID
 
 	saveProblemBundleCommon(w, tx, &bundle, render)
 }
@@ -34,7 +37,7 @@ func PostProblemBundleConfirmed(w http.ResponseWriter, tx *sql.Tx, bundle Proble
 // The bundle must have a full set of passing commits signed by the daycare.
 // If any assignments exist that refer to this problem, then the updates cannot change the number
 // of steps in the problem.
-func PutProblemBundle(w http.ResponseWriter, tx *sql.Tx, params martini.Params, bundle ProblemBundle, render render.Render) {
+func PutProblemBundle(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, bundle ProblemBundle, audit *AuditEntry, render render.Render) {
 	if bundle.Problem == nil {
 		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must contain a problem")
 		return
@@ -57,6 +60,7 @@ func PutProblemBundle(w http.ResponseWriter, tx *sql.Tx, params martini.Params,
 		loggedHTTPErrorf(w, http.StatusBadRequest, "updating a problem cannot change its type from %q to %q; create a new problem instead", old.ProblemType, bundle.Problem.ProblemType)
 		return
 	}
+	bundle.Problem.AuthorID = old.AuthorID
 	if !bundle.Problem.CreatedAt.Equal(old.CreatedAt) {
 		loggedHTTPErrorf(w, http.StatusBadRequest, "updating a problem cannot change its created time from %v to %v", old.CreatedAt, bundle.Problem.CreatedAt)
 		return
@@ -79,10 +83,87 @@ func PutProblemBundle(w http.ResponseWriter, tx *sql.Tx, params martini.Params,
 			return
 		}
 	}
+	entry, msg := checkChangelog(bundle.Changelog, assignmentCount > 0)
+	if msg != "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "%s", msg)
+		return
+	}
+	if entry != "" {
+		if _, err := recordChangelog(tx, old.ID, currentUser.ID, entry, time.Now()); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
 
+	audit.Record(AuditProblemUpdate, old.ID, "updated problem %s: note %q -> %q, %d step(s), last updated %s",
+		old.Unique, old.Note, bundle.Problem.Note, len(bundle.ProblemSteps), old.UpdatedAt.Format(time.RFC3339))
+	if assignmentCount > 0 {
+		if err := notifyProblemUpdated(tx, bundle.Problem, entry); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
 	saveProblemBundleCommon(w, tx, &bundle, render)
 }
 
+// notifyProblemUpdated tells the students working on a problem that it
+// has changed, and what the author said changed.
+func notifyProblemUpdated(tx *sql.Tx, problem *Problem, changelog string) error {
+	students := []*User{}
+	if err := meddler.QueryAll(tx, &students, `SELECT * FROM users WHERE id IN `+
+		`(SELECT assignments.user_id FROM assignments `+
+		`JOIN problem_set_problems ON problem_set_problems.problem_set_id = assignments.problem_set_id `+
+		`WHERE problem_set_problems.problem_id = $1 AND NOT assignments.instructor)`, problem.ID); err != nil {
+		return err
+	}
+	body := fmt.Sprintf("The problem %s (%s) has been updated by its author:\n\n%s\n\n"+
+		"Run \"grind get\" again if you want a fresh copy of the instructions and starter files.\n", problem.Unique, problem.Note, changelog)
+	for _, student := range students {
+		if err := queueNotification(tx, student, NotifyProblemUpdated, "Problem updated: "+problem.Unique, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetProblemBundle handles requests to /v2/problem_bundles/:problem_id,
+// returning a problem with all of its steps, including every variant and
+// pre-check, so an author can export it and update it later.
+// The reference solution for each step is included as a commit if the
+// server has one.
+func GetProblemBundle(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+
+	bundle := &ProblemBundle{Problem: new(Problem)}
+	if err := meddler.Load(tx, "problems", bundle.Problem, problemID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if err := meddler.QueryAll(tx, &bundle.ProblemSteps, `SELECT * FROM problem_steps WHERE problem_id = $1 ORDER BY step`, problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	solutions := []*ProblemSolution{}
+	if err := meddler.QueryAll(tx, &solutions, `SELECT * FROM problem_solutions WHERE problem_id = $1 ORDER BY step`, problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	for _, solution := range solutions {
+		bundle.Commits = append(bundle.Commits, &Commit{
+			ProblemID: problemID,
+			Step:      solution.Step,
+			Files:     solution.Files,
+			CreatedAt: solution.CreatedAt,
+			UpdatedAt: solution.UpdatedAt,
+		})
+	}
+
+	render.JSON(http.StatusOK, bundle)
+}
+
 func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, bundle *ProblemBundle, render render.Render) {
 	now := time.Now()
 
@@ -92,11 +173,17 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, bundle *ProblemB
 		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
 		return
 	}
+	if problemType, exists := problemTypes[problem.ProblemType]; exists {
+		if _, err := problemType.NetworkPolicyFor(problem.Options); err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
 
 	// note: unique constraint will be checked by the database
 
 	// verify the signature
-	sig := problem.ComputeSignature(Config.DaycareSecret, steps)
+	sig := problem.ComputeSignature(Config().DaycareSecret, steps)
 	if sig != bundle.ProblemSignature {
 		loggedHTTPErrorf(w, http.StatusBadRequest, "problem signature does not check out: found %s but expected %s", bundle.ProblemSignature, sig)
 		return
@@ -113,7 +200,7 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, bundle *ProblemB
 	}
 	for i, commit := range bundle.Commits {
 		// check the commit signature
-		csig := commit.ComputeSignature(Config.DaycareSecret, bundle.ProblemSignature)
+		csig := commit.ComputeSignature(Config().DaycareSecret, bundle.ProblemSignature)
 		if csig != bundle.CommitSignatures[i] {
 			loggedHTTPErrorf(w, http.StatusBadRequest, "commit for step %d has a bad signature", commit.Step)
 			return
@@ -125,7 +212,7 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, bundle *ProblemB
 		}
 
 		// make sure this step passed
-		if commit.Score != 1.0 || commit.ReportCard == nil || !commit.ReportCard.Passed {
+		if !commit.StepPassed() {
 			loggedHTTPErrorf(w, http.StatusBadRequest, "commit for step %d did not pass", i+1)
 			return
 		}
@@ -145,8 +232,8 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, bundle *ProblemB
 				loggedHTTPErrorf(w, http.StatusInternalServerError, "json error: %v", err)
 				return
 			}
-			if _, err = tx.Exec(`UPDATE problem_steps SET note=$1,instructions=$2,weight=$3,files=$4 WHERE problem_id=$5 AND step=$6`,
-				step.Note, step.Instructions, step.Weight, raw, step.ProblemID, step.Step); err != nil {
+			if _, err = tx.Exec(`UPDATE problem_steps SET note=$1,instructions=$2,weight=$3,files=$4,precheck=$5 WHERE problem_id=$6 AND step=$7`,
+				step.Note, step.Instructions, step.Weight, raw, step.Precheck, step.ProblemID, step.Step); err != nil {
 				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 				return
 			}
@@ -157,12 +244,19 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, bundle *ProblemB
 			}
 		}
 	}
+	if err := storeSolutions(tx, now, problem.ID, bundle.Commits); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error saving reference solutions: %v", err)
+		return
+	}
 	if isUpdate {
 		log.Printf("problem %s (%d) with %d step(s) updated", problem.Unique, problem.ID, len(steps))
 	} else {
 		log.Printf("problem %s (%d) with %d step(s) created", problem.Unique, problem.ID, len(steps))
 	}
 
+	// get the daycares ready before students start using the problem
+	prepullImages(problemTypes[problem.ProblemType])
+
 	render.JSON(http.StatusOK, bundle)
 }
 
@@ -241,7 +335,7 @@ func PostProblemBundleUnconfirmed(w http.ResponseWriter, tx *sql.Tx, currentUser
 	bundle.Problem.UpdatedAt = now
 
 	// compute signature
-	bundle.ProblemSignature = bundle.Problem.ComputeSignature(Config.DaycareSecret, bundle.ProblemSteps)
+	bundle.ProblemSignature = bundle.Problem.ComputeSignature(Config().DaycareSecret, bundle.ProblemSteps)
 
 	// check the commits
 	whitelists := bundle.Problem.GetStepWhitelists(bundle.ProblemSteps)
@@ -267,7 +361,11 @@ func PostProblemBundleUnconfirmed(w http.ResponseWriter, tx *sql.Tx, currentUser
 		}
 
 		// set timestamps and compute signature
-		sig := commit.ComputeSignature(Config.DaycareSecret, bundle.ProblemSignature)
+		if err := issueCommitNonce(tx, now, commit); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		sig := commit.ComputeSignature(Config().DaycareSecret, bundle.ProblemSignature)
 		bundle.CommitSignatures = append(bundle.CommitSignatures, sig)
 	}
 
@@ -288,28 +386,133 @@ func PostProblemSetBundle(w http.ResponseWriter, tx *sql.Tx, bundle ProblemSetBu
 		loggedHTTPErrorf(w, http.StatusBadRequest, "a new problem set must not have an ID")
 		return
 	}
-	if len(bundle.ProblemIDs) == 0 {
-		loggedHTTPErrorf(w, http.StatusBadRequest, "a problem set must have at least one problem")
+	if err := checkProblemSetBundle(tx, now, &bundle); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
 		return
 	}
-	if len(bundle.Weights) != len(bundle.ProblemIDs) {
-		loggedHTTPErrorf(w, http.StatusBadRequest, "each problem must have exactly one associated weight")
+
+	// save the problem set object
+	if err := meddler.Insert(tx, "problem_sets", set); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
 
-	// clean up basic fields and do some checks
-	if err := set.Normalize(now); err != nil {
+	// save the problem set problem list
+	if err := saveProblemSetProblems(tx, set.ID, &bundle); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	log.Printf("problem set %s (%d) with %d problem(s) created", set.Unique, set.ID, len(bundle.ProblemIDs))
+
+	render.JSON(http.StatusOK, bundle)
+}
+
+// PutProblemSetBundle handles requests to /v2/problem_set_bundles/:problem_set_id,
+// updating an existing problem set and replacing its list of problems.
+// The unique ID cannot be changed.
+func PutProblemSetBundle(w http.ResponseWriter, tx *sql.Tx, params martini.Params, bundle ProblemSetBundle, render render.Render) {
+	now := time.Now()
+
+	problemSetID, err := parseID(w, "problem_set_id", params["problem_set_id"])
+	if err != nil {
+		return
+	}
+	if bundle.ProblemSet == nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must contain a problem set")
+		return
+	}
+	set := bundle.ProblemSet
+	if set.ID != problemSetID {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "problem set ID %d does not match ID %d in the URL", set.ID, problemSetID)
+		return
+	}
+	old := new(ProblemSet)
+	if err := meddler.Load(tx, "problem_sets", old, problemSetID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if set.Unique != old.Unique {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "the unique ID of a problem set cannot be changed from %q", old.Unique)
+		return
+	}
+	set.CreatedAt = old.CreatedAt
+	set.UpdatedAt = now
+	if err := checkProblemSetBundle(tx, now, &bundle); err != nil {
 		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
 		return
 	}
 
-	// save the problem set object
-	if err := meddler.Insert(tx, "problem_sets", set); err != nil {
+	if err := meddler.Update(tx, "problem_sets", set); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM problem_set_problems WHERE problem_set_id = $1`, set.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := saveProblemSetProblems(tx, set.ID, &bundle); err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
 
-	// save the problem set problem list
+	log.Printf("problem set %s (%d) updated with %d problem(s)", set.Unique, set.ID, len(bundle.ProblemIDs))
+
+	render.JSON(http.StatusOK, bundle)
+}
+
+// checkProblemSetBundle validates a problem set bundle, makes sure every
+// problem it lists exists, and compiles the problem set overview.
+func checkProblemSetBundle(tx *sql.Tx, now time.Time, bundle *ProblemSetBundle) error {
+	set := bundle.ProblemSet
+	if len(bundle.ProblemIDs) == 0 {
+		return fmt.Errorf("a problem set must have at least one problem")
+	}
+	if len(bundle.Weights) != len(bundle.ProblemIDs) {
+		return fmt.Errorf("each problem must have exactly one associated weight")
+	}
+
+	// clean up basic fields and do some checks
+	if err := set.Normalize(now); err != nil {
+		return err
+	}
+
+	// make sure the problems exist and are not listed twice
+	seen := make(map[int64]bool)
+	for _, problemID := range bundle.ProblemIDs {
+		if seen[problemID] {
+			return fmt.Errorf("problem %d is listed more than once", problemID)
+		}
+		seen[problemID] = true
+		var count int
+		if err := tx.QueryRow(`SELECT COUNT(1) FROM problems WHERE id = $1`, problemID).Scan(&count); err != nil {
+			return fmt.Errorf("db error checking problem %d: %v", problemID, err)
+		}
+		if count == 0 {
+			return fmt.Errorf("problem %d does not exist", problemID)
+		}
+	}
+
+	// compile the problem set overview if one was included
+	set.Instructions = ""
+	for name := range bundle.Files {
+		if !strings.HasPrefix(name, "_doc/") {
+			return fmt.Errorf("problem set file %s is not in the _doc directory", name)
+		}
+	}
+	if len(bundle.Files) > 0 {
+		instructions, err := BuildInstructions(bundle.Files)
+		if err != nil {
+			return fmt.Errorf("error building problem set instructions: %v", err)
+		}
+		set.Instructions = instructions
+	}
+	return nil
+}
+
+// saveProblemSetProblems inserts the problem list of a bundle.
+// Problems with no weight are given a weight of one.
+func saveProblemSetProblems(tx *sql.Tx, problemSetID int64, bundle *ProblemSetBundle) error {
 	for i := 0; i < len(bundle.ProblemIDs); i++ {
 		problemID, weight := bundle.ProblemIDs[i], bundle.Weights[i]
 		if weight <= 0.0 {
@@ -317,17 +520,13 @@ func PostProblemSetBundle(w http.ResponseWriter, tx *sql.Tx, bundle ProblemSetBu
 			weight = 1.0
 		}
 		psp := &ProblemSetProblem{
-			ProblemSetID: set.ID,
+			ProblemSetID: problemSetID,
 			ProblemID:    problemID,
 			Weight:       weight,
 		}
 		if err := meddler.Insert(tx, "problem_set_problems", psp); err != nil {
-			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
-			return
+			return err
 		}
 	}
-
-	log.Printf("problem set %s (%d) with %d problem(s) created", set.Unique, set.ID, len(bundle.ProblemIDs))
-
-	render.JSON(http.StatusOK, bundle)
+	return nil
 }
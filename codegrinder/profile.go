@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	runtimepprof "runtime/pprof"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"github.com/russross/meddler"
+)
+
+// Administrators can profile a running server through the usual pprof
+// handlers, served under /v2/debug/pprof/. To help diagnose slowdowns that
+// have already passed, such as during a deadline rush, the server can also
+// take a short CPU profile and a heap profile every ProfileIntervalMinutes
+// and keep them in the profiles table for ProfileRetentionDays. Saved
+// profiles can be listed and downloaded for use with go tool pprof.
+
+// Profile kinds.
+const (
+	ProfileCPU  = "cpu"
+	ProfileHeap = "heap"
+)
+
+// DefaultProfileSeconds is the length of a background CPU profile if the
+// config does not give one.
+const DefaultProfileSeconds = 10
+
+// Profile is a saved runtime profile. Data is only sent when the profile is
+// downloaded.
+type Profile struct {
+	ID        int64     `json:"id" meddler:"id,pk"`
+	Kind      string    `json:"kind" meddler:"kind"`
+	Host      string    `json:"host" meddler:"host"`
+	Size      int       `json:"size" meddler:"size"`
+	Data      []byte    `json:"-" meddler:"data"`
+	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// startProfiling takes profiles in the background on the configured schedule
+// and discards old ones.
+func startProfiling(db *sql.DB) {
+	if Config().ProfileIntervalMinutes <= 0 {
+		return
+	}
+	seconds := Config().ProfileSeconds
+	if seconds <= 0 {
+		seconds = DefaultProfileSeconds
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = Config().Hostname
+	}
+	go func() {
+		for {
+			time.Sleep(time.Duration(Config().ProfileIntervalMinutes) * time.Minute)
+
+			var cpu bytes.Buffer
+			if err := runtimepprof.StartCPUProfile(&cpu); err != nil {
+				// most likely an administrator is profiling right now
+				log.Printf("skipping background CPU profile: %v", err)
+			} else {
+				time.Sleep(time.Duration(seconds) * time.Second)
+				runtimepprof.StopCPUProfile()
+				if err := saveProfile(db, ProfileCPU, host, cpu.Bytes()); err != nil {
+					log.Printf("db error saving CPU profile: %v", err)
+				}
+			}
+
+			var heap bytes.Buffer
+			if err := runtimepprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+				log.Printf("error taking heap profile: %v", err)
+			} else if err := saveProfile(db, ProfileHeap, host, heap.Bytes()); err != nil {
+				log.Printf("db error saving heap profile: %v", err)
+			}
+
+			if Config().ProfileRetentionDays > 0 {
+				cutoff := time.Now().AddDate(0, 0, -Config().ProfileRetentionDays)
+				if _, err := db.Exec(`DELETE FROM profiles WHERE created_at < $1`, cutoff); err != nil {
+					log.Printf("db error discarding old profiles: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// saveProfile stores one profile.
+func saveProfile(db *sql.DB, kind, host string, data []byte) error {
+	profile := &Profile{
+		Kind:      kind,
+		Host:      host,
+		Size:      len(data),
+		Data:      data,
+		CreatedAt: time.Now(),
+	}
+	return meddler.Insert(db, "profiles", profile)
+}
+
+// GetDebugPprof handles requests to /v2/debug/pprof/**, serving the
+// standard pprof handlers to administrators.
+func GetDebugPprof(w http.ResponseWriter, r *http.Request, params martini.Params) {
+	switch name := params["_1"]; name {
+	case "":
+		pprof.Index(w, r)
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		if runtimepprof.Lookup(name) == nil {
+			loggedHTTPErrorf(w, http.StatusNotFound, "unknown profile: %s", name)
+			return
+		}
+		pprof.Handler(name).ServeHTTP(w, r)
+	}
+}
+
+// GetDebugProfiles handles requests to /v2/debug/profiles, listing the
+// saved profiles from newest to oldest without their data. Parameters:
+//
+//	kind: only list profiles of this kind, cpu or heap
+//	limit: the most profiles to list, 100 by default
+func GetDebugProfiles(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	where, args := "", []interface{}{}
+	if kind := r.FormValue("kind"); kind != "" {
+		where = " WHERE kind = $1"
+		args = append(args, kind)
+	}
+	limit := 100
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+	profiles := []*Profile{}
+	if err := meddler.QueryAll(tx, &profiles, `SELECT id, kind, host, size, created_at FROM profiles`+where+
+		fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT %d`, limit), args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, profiles)
+}
+
+// GetDebugProfile handles requests to /v2/debug/profiles/:profile_id,
+// downloading a saved profile in the format read by go tool pprof.
+func GetDebugProfile(w http.ResponseWriter, tx *sql.Tx, params martini.Params) {
+	profileID, err := parseID(w, "profile_id", params["profile_id"])
+	if err != nil {
+		return
+	}
+	profile := new(Profile)
+	if err := meddler.Load(tx, "profiles", profile, profileID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s-%s.pprof"`,
+		profile.Kind, profile.Host, profile.CreatedAt.UTC().Format("20060102-150405")))
+	w.Write(profile.Data)
+}
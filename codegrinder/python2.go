@@ -6,6 +6,7 @@ import (
 	"log"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -61,7 +62,7 @@ func init() {
 				Action:  "stylecheck",
 				Button:  "Check style",
 				Message: "Checking for pep8 style problems‥",
-				//handler: autoHandler(python27StyleCheck),
+				Handler: nannyHandler(styleCheckGrade),
 			},
 			"stylefix": &ProblemTypeAction{
 				Action:  "stylefix",
@@ -89,7 +90,7 @@ func init() {
 				Button:  "Grade",
 				Message: "Grading‥",
 				Class:   "btn-grade",
-				//handler: autoHandler(python27InOutGrade),
+				Handler: nannyHandler(python2InOutGrade),
 			},
 			"": &ProblemTypeAction{
 				Action: "",
@@ -121,7 +122,7 @@ func init() {
 				Action:  "stylecheck",
 				Button:  "Check style",
 				Message: "Checking for pep8 style problems‥",
-				//handler: autoHandler(python27StyleCheck),
+				Handler: nannyHandler(styleCheckGrade),
 			},
 			"stylefix": &ProblemTypeAction{
 				Action:  "stylefix",
@@ -274,3 +275,85 @@ func python2UnittestGrade(n *Nanny, args []string, options []string, files map[s
 		}
 	}
 }
+
+// python2InOutGrade runs the student's program once for each input file in
+// in/ and compares its output with the file of the same name in out/, or
+// in out/<language>/ when the student's language has localized output.
+// Expected output files may use the tolerance directives described by
+// ExpectedOutputDirective.
+func python2InOutGrade(n *Nanny, args []string, options []string, files map[string]string) {
+	log.Printf("python2InOutGrade")
+
+	// find the program and the test cases
+	var programs, inputs []string
+	for name := range files {
+		switch {
+		case !strings.Contains(name, "/") && strings.HasSuffix(name, ".py"):
+			programs = append(programs, name)
+		case strings.HasPrefix(name, "in/"):
+			inputs = append(inputs, name)
+		}
+	}
+	sort.Strings(programs)
+	sort.Strings(inputs)
+	if len(programs) == 0 {
+		n.ReportCard.LogAndFailf("no Python program found")
+		return
+	}
+	program := programs[0]
+	if _, ok := files["main.py"]; ok {
+		program = "main.py"
+	}
+	if len(inputs) == 0 {
+		n.ReportCard.LogAndFailf("no input files found in in/")
+		return
+	}
+
+	// put the files in the container
+	if err := n.PutFiles(files); err != nil {
+		n.ReportCard.LogAndFailf("PutFiles error: %v", err)
+		return
+	}
+
+	locale := OutputLocale(options)
+	failed := 0
+	for _, input := range inputs {
+		name := strings.TrimPrefix(input, "in/")
+		output := ExpectedOutputFile(files, name, locale)
+		contents, ok := files[output]
+		if !ok {
+			n.ReportCard.LogAndFailf("no expected output file %s for input %s", output, input)
+			return
+		}
+		expected, err := ParseExpectedOutput(contents)
+		if err != nil {
+			n.ReportCard.LogAndFailf("error in %s: %v", output, err)
+			return
+		}
+
+		stdout, stderr, _, status, err := n.ExecNonInteractive(
+			[]string{"sh", "-c", "exec python " + program + " < " + input})
+		if err != nil {
+			n.ReportCard.LogAndFailf("exec error: %v", err)
+			return
+		}
+		passed, msg := expected.Match(stdout.String())
+		if passed && status != 0 {
+			passed, msg = false, fmt.Sprintf("exit status %d", status)
+		}
+		if passed {
+			n.ReportCard.AddPassedResult(name, htmlEscapePara("output matched"))
+			continue
+		}
+		failed++
+		details := "<h1>Output did not match</h1>\n" + htmlEscapePara(msg) + htmlEscapePre(stdout.String())
+		if stderr.Len() > 0 {
+			details += "\n<h1>Error output</h1>\n" + htmlEscapePre(stderr.String())
+		}
+		n.ReportCard.AddFailedResult(name, details, input)
+	}
+	n.ReportCard.Duration = time.Since(n.Start)
+	if n.ReportCard.Note == "" {
+		n.ReportCard.Note = fmt.Sprintf("%d/%d tests passed in %v", len(n.ReportCard.Results)-failed, len(n.ReportCard.Results), n.ReportCard.Duration)
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/gorilla/websocket"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// When Config.WorkQueue is set, the TA server accepts grading websockets
+// itself and records each request as a job in the daycare_jobs table.
+// Daycare workers register with the TA server, claim jobs for the problem
+// types they support, and stream their responses back over a websocket to
+// the TA server, which relays them to the waiting client. Responses are
+// relayed in memory, so the queue assumes a single TA server.
+
+// DefaultWorkerSlots is the number of jobs a worker runs at once if
+// Config.WorkerSlots is not set.
+const DefaultWorkerSlots = 4
+
+// WorkerHeartbeat is how often a worker re-registers with the TA server.
+const WorkerHeartbeat = 30 * time.Second
+
+// jobStream is how responses for a job reach the waiting client.
+// done is closed once the client stops listening, so a worker socket
+// never blocks forever on a send that nobody will receive.
+type jobStream struct {
+	responses chan *DaycareResponse
+	done      chan struct{}
+}
+
+// jobStreams holds the stream each waiting client receives responses on.
+var jobStreams = struct {
+	sync.Mutex
+	m map[int64]*jobStream
+}{m: make(map[int64]*jobStream)}
+
+// workerSignature signs a request from a daycare worker to the TA server.
+// The body is covered by its SHA-256 hash, so a captured request cannot be
+// replayed with a different body or query.
+func workerSignature(timestamp, method, path, rawQuery string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(Config().DaycareSecret))
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + path + "\n" + rawQuery + "\n" + hex.EncodeToString(sum[:])))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// workerAuthorization returns the Authorization header value for a worker
+// request. The secret itself is never sent; the header carries a timestamp
+// and a signature over the timestamp, method, path, query, and body.
+func workerAuthorization(method, path, rawQuery string, body []byte) string {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	return "Daycare " + timestamp + " " + workerSignature(timestamp, method, path, rawQuery, body)
+}
+
+// daycareWorkerOnly is a martini service that requires a request to come
+// from a daycare worker holding the daycare secret.
+func daycareWorkerOnly(w http.ResponseWriter, r *http.Request) {
+	fields := strings.Fields(r.Header.Get("Authorization"))
+	if len(fields) != 3 || fields[0] != "Daycare" {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "daycare worker authorization required")
+		return
+	}
+	secs, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "error parsing timestamp: %v", err)
+		return
+	}
+	age := time.Since(time.Unix(secs, 0))
+	if age < 0 {
+		age = -age
+	}
+	if age > MaxDaycareRequestAge {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "request is %v old, cannot be more than %v", age, MaxDaycareRequestAge)
+		return
+	}
+
+	// read the body to check its hash, then put it back for the handler
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "error reading request body: %v", err)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if !hmac.Equal([]byte(fields[2]), []byte(workerSignature(fields[1], r.Method, r.URL.Path, r.URL.RawQuery, body))) {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "signature mismatch")
+	}
+}
+
+// SocketQueueProblemTypeAction handles a request to /sockets/:problem_type/:action
+// when the work queue is enabled. It speaks the same protocol as
+// SocketProblemTypeAction, but queues the request for a worker and relays
+// the worker's responses back to the client.
+func SocketQueueProblemTypeAction(w http.ResponseWriter, r *http.Request, params martini.Params, db *sql.DB) {
+	now := time.Now()
+
+	problemType, exists := problemTypes[params["problem_type"]]
+	if !exists {
+		loggedHTTPErrorf(w, http.StatusNotFound, "problem type %q not found", params["problem_type"])
+		return
+	}
+	if _, exists := problemType.Actions[params["action"]]; !exists {
+		loggedHTTPErrorf(w, http.StatusNotFound, "action %q not defined from problem type %s", params["action"], params["problem_type"])
+		return
+	}
+
+	// get a websocket
+	socket, err := websocket.Upgrade(w, r, nil, 1024, 1024)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "websocket error: %v", err)
+		return
+	}
+	defer socket.Close()
+	logAndTransmitErrorf := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		log.Print(msg)
+		socket.WriteJSON(&DaycareResponse{Error: msg})
+	}
+
+	// get the first message
+	req := new(DaycareRequest)
+	if err := socket.ReadJSON(req); err != nil {
+		logAndTransmitErrorf("error reading first request message: %v", err)
+		return
+	}
+	if req.CommitBundle == nil && req.SetCommitBundle == nil {
+		logAndTransmitErrorf("first request message must include the commit bundle")
+		return
+	}
+	if err := checkDaycareRoute(db, problemType, now); err != nil {
+		logAndTransmitErrorf("%v", err)
+		return
+	}
+
+	// queue the job, listening for responses before a worker can claim it
+	r.ParseForm()
+	job := &DaycareJob{
+		ProblemType: params["problem_type"],
+		Action:      params["action"],
+		Args:        r.Form["args"],
+		Request:     req,
+		Status:      "queued",
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	responses, err := queueJob(db, job)
+	if err != nil {
+		logAndTransmitErrorf("error queuing job: %v", err)
+		return
+	}
+	defer finishJob(db, job.ID)
+
+	// relay responses until the job finishes or the client goes away
+	ctx, cancel := watchSession(socket)
+	defer cancel()
+	timeout := time.After(MaxDaycareRequestAge)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("abandoning job %d: the client went away", job.ID)
+			return
+		case res := <-responses:
+			if err := socket.WriteJSON(res); err != nil {
+				log.Printf("error relaying response for job %d: %v", job.ID, err)
+				return
+			}
+			if res.CommitBundle != nil || res.SetCommitBundle != nil || res.Error != "" {
+				return
+			}
+		case <-timeout:
+			logAndTransmitErrorf("no daycare finished job %d within %v", job.ID, MaxDaycareRequestAge)
+			return
+		}
+	}
+}
+
+// queueJob adds a job to the queue and returns the channel its responses
+// will arrive on. The caller must call finishJob once it is done. This is
+// where commits are dispatched, so their nonces are marked as used here.
+func queueJob(db *sql.DB, job *DaycareJob) (chan *DaycareResponse, error) {
+	if err := dispatchCommitNonces(db, job.CreatedAt, job.Request); err != nil {
+		return nil, err
+	}
+	if job.Request != nil && job.Request.CommitBundle != nil && job.Request.CommitBundle.Problem != nil {
+		job.ProblemID = job.Request.CommitBundle.Problem.ID
+	} else if job.Request != nil && job.Request.SetCommitBundle != nil && len(job.Request.SetCommitBundle.Bundles) > 0 && job.Request.SetCommitBundle.Bundles[0].Problem != nil {
+		job.ProblemID = job.Request.SetCommitBundle.Bundles[0].Problem.ID
+	}
+	stream := &jobStream{
+		responses: make(chan *DaycareResponse, 64),
+		done:      make(chan struct{}),
+	}
+	jobStreams.Lock()
+	defer jobStreams.Unlock()
+	if err := meddler.Insert(db, "daycare_jobs", job); err != nil {
+		return nil, err
+	}
+	jobStreams.m[job.ID] = stream
+	return stream.responses, nil
+}
+
+// finishJob stops relaying responses for a job and removes it from the queue.
+func finishJob(db *sql.DB, jobID int64) {
+	jobStreams.Lock()
+	if stream := jobStreams.m[jobID]; stream != nil {
+		close(stream.done)
+		delete(jobStreams.m, jobID)
+	}
+	jobStreams.Unlock()
+	if _, err := db.Exec(`DELETE FROM daycare_jobs WHERE id = $1`, jobID); err != nil {
+		log.Printf("db error removing job %d: %v", jobID, err)
+	}
+}
+
+// PostDaycareWorker handles a request to /v2/daycare_workers,
+// registering a worker or recording a heartbeat from one.
+func PostDaycareWorker(w http.ResponseWriter, db *sql.DB, worker DaycareWorker, render render.Render) {
+	now := time.Now()
+	if worker.Name == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "worker must have a name")
+		return
+	}
+	types, err := json.Marshal(worker.ProblemTypes)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "json error: %v", err)
+		return
+	}
+	imageIDs, err := json.Marshal(worker.ImageIDs)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "json error: %v", err)
+		return
+	}
+	if _, err := db.Exec(`INSERT INTO daycare_workers (name, problem_types, slots, running, last_seen_at, created_at, image_ids, abandoned_sessions, orphaned_containers) `+
+		`VALUES ($1, $2, $3, $4, $5, $5, $6, $7, $8) `+
+		`ON CONFLICT (name) DO UPDATE SET problem_types = $2, slots = $3, running = $4, last_seen_at = $5, image_ids = $6, abandoned_sessions = $7, orphaned_containers = $8`,
+		worker.Name, types, worker.Slots, worker.Running, now, imageIDs, worker.AbandonedSessions, worker.OrphanedContainers); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &worker)
+}
+
+// GetDaycareWorkers handles a request to /v2/daycare_workers,
+// listing the registered workers and how busy they are.
+func GetDaycareWorkers(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+	workers := []*DaycareWorker{}
+	if err := meddler.QueryAll(tx, &workers, `SELECT * FROM daycare_workers ORDER BY name`); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, workers)
+}
+
+// PostDaycareJobClaim handles a request to /v2/daycare_jobs/claim,
+// handing the oldest queued job for one of the worker's problem types to
+// the worker. Jobs meant for another worker and jobs for problems that
+// failed their smoke test on this worker are skipped. It responds with no
+// content if there is nothing to do.
+func PostDaycareJobClaim(w http.ResponseWriter, db *sql.DB, worker DaycareWorker, render render.Render) {
+	if worker.Name == "" || len(worker.ProblemTypes) == 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "worker must have a name and at least one problem type")
+		return
+	}
+
+	// only offer jobs the worker's tags allow it to run
+	registered := new(DaycareWorker)
+	if err := meddler.QueryRow(db, registered, `SELECT * FROM daycare_workers WHERE name = $1`, worker.Name); err != nil && err != sql.ErrNoRows {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	allowed := routableProblemTypes(worker.ProblemTypes, registered.Tags)
+	if len(allowed) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	types, err := json.Marshal(allowed)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "json error: %v", err)
+		return
+	}
+	job := new(DaycareJob)
+	err = meddler.QueryRow(db, job, `UPDATE daycare_jobs SET status = 'running', worker = $1, updated_at = $2 `+
+		`WHERE id = (SELECT id FROM daycare_jobs WHERE status = 'queued' `+
+		`AND problem_type IN (SELECT json_array_elements_text($3::json)) `+
+		`AND (target_worker IS NULL OR target_worker = $1) `+
+		`AND (target_worker = $1 OR problem_id IS NULL OR problem_id NOT IN (SELECT problem_id FROM smoke_tests WHERE worker = $1 AND NOT passed)) `+
+		`ORDER BY id FOR UPDATE SKIP LOCKED LIMIT 1) RETURNING *`,
+		worker.Name, time.Now(), string(types))
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, job)
+}
+
+// SocketDaycareJob handles a request to /v2/daycare_jobs/:job_id/socket.
+// A worker streams DaycareResponse messages for a claimed job over it,
+// and they are relayed to the client waiting for that job.
+func SocketDaycareJob(w http.ResponseWriter, r *http.Request, params martini.Params) {
+	jobID, err := parseID(w, "job_id", params["job_id"])
+	if err != nil {
+		return
+	}
+	jobStreams.Lock()
+	stream := jobStreams.m[jobID]
+	jobStreams.Unlock()
+	if stream == nil {
+		loggedHTTPErrorf(w, http.StatusNotFound, "no client is waiting for job %d", jobID)
+		return
+	}
+
+	socket, err := websocket.Upgrade(w, r, nil, 1024, 1024)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "websocket error: %v", err)
+		return
+	}
+	defer socket.Close()
+
+	// hang up on the worker if the client goes away, so it kills the container
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-finished:
+		case <-stream.done:
+			socket.Close()
+		}
+	}()
+	for {
+		res := new(DaycareResponse)
+		if err := socket.ReadJSON(res); err != nil {
+			select {
+			case stream.responses <- &DaycareResponse{Error: fmt.Sprintf("lost connection to daycare running job %d: %v", jobID, err)}:
+			case <-stream.done:
+			}
+			return
+		}
+		select {
+		case stream.responses <- res:
+		default:
+			// the client has fallen far behind; drop events but never the
+			// final result, unless the client has gone away entirely
+			if res.CommitBundle == nil && res.SetCommitBundle == nil && res.Error == "" {
+				continue
+			}
+			select {
+			case stream.responses <- res:
+			case <-stream.done:
+				return
+			}
+		}
+		if res.CommitBundle != nil || res.SetCommitBundle != nil || res.Error != "" {
+			return
+		}
+	}
+}
+
+// startQueueWorker runs this daycare as a worker that pulls jobs from the
+// TA server instead of accepting client connections.
+func startQueueWorker() {
+	host := Config().WorkQueueHost
+	if host == "" {
+		host = Config().Hostname
+	}
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		name = Config().Hostname
+	}
+	slots := Config().WorkerSlots
+	if slots <= 0 {
+		slots = DefaultWorkerSlots
+	}
+	var names []string
+	for name := range problemTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var mutex sync.Mutex
+	running := 0
+	imageIDs := make(map[string]string)
+	worker := func() *DaycareWorker {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sessionStats.Lock()
+		defer sessionStats.Unlock()
+		return &DaycareWorker{Name: name, ProblemTypes: names, Slots: int64(slots), Running: int64(running), ImageIDs: imageIDs,
+			AbandonedSessions: sessionStats.abandoned, OrphanedContainers: sessionStats.orphaned}
+	}
+
+	// register and keep the registration fresh
+	go func() {
+		for {
+			ids := make(map[string]string)
+			for _, name := range names {
+				ids[name] = problemTypeImageIDs(problemTypes[name])
+			}
+			mutex.Lock()
+			imageIDs = ids
+			mutex.Unlock()
+			if _, err := workerRequest(host, "POST", "/v2/daycare_workers", worker(), nil); err != nil {
+				log.Printf("error registering with work queue at %s: %v", host, err)
+			}
+			time.Sleep(WorkerHeartbeat)
+		}
+	}()
+	log.Printf("pulling jobs from %s with %d slot%s", host, slots, plural(slots))
+
+	// claim jobs as slots free up
+	go func() {
+		free := make(chan struct{}, slots)
+		for i := 0; i < slots; i++ {
+			free <- struct{}{}
+		}
+		for {
+			<-free
+			job := new(DaycareJob)
+			status, err := workerRequest(host, "POST", "/v2/daycare_jobs/claim", worker(), job)
+			if err != nil || status == http.StatusNoContent {
+				if err != nil {
+					log.Printf("error claiming job from %s: %v", host, err)
+				}
+				free <- struct{}{}
+				time.Sleep(time.Second)
+				continue
+			}
+
+			mutex.Lock()
+			running++
+			mutex.Unlock()
+			go func() {
+				runQueuedJob(host, job)
+				mutex.Lock()
+				running--
+				mutex.Unlock()
+				free <- struct{}{}
+			}()
+		}
+	}()
+}
+
+// runQueuedJob carries out a claimed job, streaming the responses back
+// to the TA server.
+func runQueuedJob(host string, job *DaycareJob) {
+	path := "/v2/daycare_jobs/" + strconv.FormatInt(job.ID, 10) + "/socket"
+	headers := http.Header{"Authorization": {workerAuthorization("GET", path, "", nil)}}
+	url := "wss://" + host + path
+	socket, _, err := websocket.DefaultDialer.Dial(url, headers)
+	if err != nil {
+		log.Printf("error dialing %s for job %d: %v", url, job.ID, err)
+		return
+	}
+	defer socket.Close()
+
+	// events are sent from the nanny listener as well as the main handler
+	var mutex sync.Mutex
+	send := func(res *DaycareResponse) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return socket.WriteJSON(res)
+	}
+
+	problemType, exists := problemTypes[job.ProblemType]
+	if !exists {
+		send(&DaycareResponse{Error: fmt.Sprintf("problem type %q not found", job.ProblemType)})
+		return
+	}
+	action, exists := problemType.Actions[job.Action]
+	if !exists || job.Request == nil {
+		send(&DaycareResponse{Error: fmt.Sprintf("action %q not defined from problem type %s", job.Action, job.ProblemType)})
+		return
+	}
+	log.Printf("running job %d: %s %s", job.ID, job.ProblemType, job.Action)
+	ctx, cancel := watchSession(socket)
+	defer cancel()
+	runDaycareRequest(ctx, time.Now(), problemType, action, job.Action, job.Request, job.Args, send)
+}
+
+// workerRequest sends a JSON request from a worker to the TA server and
+// decodes the reply into out, if given.
+func workerRequest(host, method, path string, in, out interface{}) (int, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(method, "https://"+host+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", workerAuthorization(method, path, "", body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// Grading requests are recorded in the grade_requests table so that a
+// single user cannot monopolize the daycare. The limits are enforced when a
+// commit bundle with an action is signed, since that is the gateway to the
+// daycare. Keeping the counts in the database means every TA server sees
+// the same counts.
+
+// gradeLimits returns the per-minute and per-day limits that apply to a
+// grading action. Course settings override problem type settings, which
+// override the server defaults.
+func gradeLimits(problemType *ProblemType, course *Course) (perMinute, perDay int) {
+	perMinute, perDay = Config().GradeRateLimitPerMinute, Config().GradeDailyQuota
+	if problemType != nil {
+		if problemType.RateLimitPerMinute > 0 {
+			perMinute = problemType.RateLimitPerMinute
+		}
+		if problemType.DailyQuota > 0 {
+			perDay = problemType.DailyQuota
+		}
+	}
+	if course != nil {
+		if course.RateLimitPerMinute > 0 {
+			perMinute = course.RateLimitPerMinute
+		}
+		if course.DailyQuota > 0 {
+			perDay = course.DailyQuota
+		}
+	}
+	return perMinute, perDay
+}
+
+// checkGradeLimits records a grading request by a user against an assignment.
+// If a limit is exceeded, the request is not recorded and it returns a
+// message explaining which limit and a suggested retry delay.
+func checkGradeLimits(tx *sql.Tx, now time.Time, userID, assignmentID int64, perMinute, perDay int) (string, time.Duration, error) {
+	// one request at a time per user, so concurrent requests cannot both slip under a limit
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, userID); err != nil {
+		return "", 0, err
+	}
+
+	if perMinute > 0 {
+		cutoff := now.Add(-time.Minute)
+		wait, err := gradeLimitWait(tx, cutoff, perMinute, `SELECT created_at FROM grade_requests `+
+			`WHERE user_id = $1 AND created_at > $2 ORDER BY created_at DESC OFFSET $3 LIMIT 1`,
+			userID, cutoff, perMinute-1)
+		if err != nil || wait > 0 {
+			return fmt.Sprintf("too many grading requests: limit is %d per minute", perMinute), wait, err
+		}
+	}
+	if perDay > 0 {
+		cutoff := now.Add(-24 * time.Hour)
+		wait, err := gradeLimitWait(tx, cutoff, perDay, `SELECT created_at FROM grade_requests `+
+			`WHERE user_id = $1 AND assignment_id = $2 AND created_at > $3 ORDER BY created_at DESC OFFSET $4 LIMIT 1`,
+			userID, assignmentID, cutoff, perDay-1)
+		if err != nil || wait > 0 {
+			return fmt.Sprintf("daily grading quota of %d reached for this assignment", perDay), wait, err
+		}
+	}
+
+	_, err := tx.Exec(`INSERT INTO grade_requests (user_id, assignment_id, created_at) VALUES ($1, $2, $3)`,
+		userID, assignmentID, now)
+	return "", 0, err
+}
+
+// gradeLimitWait runs a query that finds the request that fills a limit,
+// the limit'th most recent one since the cutoff. If there is one, it
+// returns how long until that request ages out of the window.
+func gradeLimitWait(tx *sql.Tx, cutoff time.Time, limit int, query string, args ...interface{}) (time.Duration, error) {
+	var filled time.Time
+	if err := tx.QueryRow(query, args...).Scan(&filled); err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if wait := filled.Sub(cutoff); wait > 0 {
+		return wait, nil
+	}
+	return time.Second, nil
+}
+
+// startGradeRequestSweep forgets grading requests in the background once
+// they no longer affect rate limits.
+func startGradeRequestSweep(db *sql.DB) {
+	go func() {
+		for {
+			time.Sleep(time.Hour)
+			if _, err := db.Exec(`DELETE FROM grade_requests WHERE created_at < $1`, time.Now().Add(-24*time.Hour)); err != nil {
+				log.Printf("db error removing old grading requests: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Access is decided by role. Administrators, authors, and chairs are set
+// on the user and apply everywhere. Within a course, a user is a student
+// if they have an assignment or an active enrollment in it, and an
+// instructor if the LMS launched them as one or lists them as one on the
+// course roster. Instructors can also give other users a staff role in
+// the course, TA or instructor, which is kept in the course_roles table.
+// A user has the highest role that any of these gives them, and a token
+// scoped to students never has more than the student role.
+//
+// Routes declare the role they need with requireRole, and handlers that
+// need to decide for themselves use courseRole and hasCourseRole.
+
+// roleRank orders the course roles; each includes the access of the ones
+// ranked below it.
+var roleRank = map[string]int{
+	RoleStudent:    1,
+	RoleTA:         2,
+	RoleInstructor: 3,
+	RoleAdmin:      4,
+}
+
+// roleTitle describes a role in error messages.
+var roleTitle = map[string]string{
+	RoleStudent:    "a student",
+	RoleTA:         "a TA",
+	RoleInstructor: "an instructor",
+	RoleAuthor:     "an author",
+	RoleChair:      "a department chair",
+	RoleAdmin:      "an administrator",
+}
+
+// courseRole returns the role a user has in a course, or an empty string
+// if the user has no part in it.
+func courseRole(tx *sql.Tx, user *User, courseID int64) (string, error) {
+	if user.Admin {
+		return RoleAdmin, nil
+	}
+	role := ""
+	var enrolled, instructor bool
+	err := tx.QueryRow(`SELECT COUNT(1) > 0, COALESCE(BOOL_OR(instructor), FALSE) FROM (`+
+		`SELECT instructor FROM assignments WHERE user_id = $1 AND course_id = $2 UNION ALL `+
+		`SELECT instructor FROM enrollments WHERE user_id = $1 AND course_id = $2 AND status = $3) AS memberships`,
+		user.ID, courseID, EnrollmentActive).Scan(&enrolled, &instructor)
+	if err != nil {
+		return "", err
+	}
+	if enrolled {
+		role = RoleStudent
+	}
+	if user.TokenScope == TokenScopeStudent {
+		return role, nil
+	}
+	if instructor {
+		role = RoleInstructor
+	}
+	var staff string
+	err = tx.QueryRow(`SELECT role FROM course_roles WHERE course_id = $1 AND user_id = $2`, courseID, user.ID).Scan(&staff)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if roleRank[staff] > roleRank[role] {
+		role = staff
+	}
+	return role, nil
+}
+
+// hasCourseRole returns true if a user has at least the given role in a course.
+func hasCourseRole(tx *sql.Tx, user *User, courseID int64, role string) (bool, error) {
+	have, err := courseRole(tx, user, courseID)
+	if err != nil {
+		return false, err
+	}
+	return have != "" && roleRank[have] >= roleRank[role], nil
+}
+
+// isCourseInstructor returns true if the user is an administrator or is an
+// instructor in the given course.
+func isCourseInstructor(tx *sql.Tx, user *User, courseID int64) (bool, error) {
+	return hasCourseRole(tx, user, courseID, RoleInstructor)
+}
+
+// isCourseStaff returns true if the user is a TA, an instructor, or an
+// administrator in the given course.
+func isCourseStaff(tx *sql.Tx, user *User, courseID int64) (bool, error) {
+	return hasCourseRole(tx, user, courseID, RoleTA)
+}
+
+// routeCourseID finds the course a request is about from its route
+// parameters: a course, an assignment, a commit, a regrade, a regrade
+// request, or an exam bundle.
+func routeCourseID(tx *sql.Tx, params martini.Params) (int64, error) {
+	var courseID int64
+	var err error
+	switch {
+	case params["course_id"] != "":
+		courseID, err = strconv.ParseInt(params["course_id"], 10, 64)
+	case params["assignment_id"] != "":
+		err = tx.QueryRow(`SELECT course_id FROM assignments WHERE id = $1`, params["assignment_id"]).Scan(&courseID)
+	case params["commit_id"] != "":
+		err = tx.QueryRow(`SELECT assignments.course_id FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+			`WHERE commits.id = $1`, params["commit_id"]).Scan(&courseID)
+	case params["regrade_id"] != "":
+		err = tx.QueryRow(`SELECT course_id FROM regrades WHERE id = $1`, params["regrade_id"]).Scan(&courseID)
+	case params["regrade_request_id"] != "":
+		err = tx.QueryRow(`SELECT course_id FROM regrade_requests WHERE id = $1`, params["regrade_request_id"]).Scan(&courseID)
+	case params["exam_bundle_id"] != "":
+		err = tx.QueryRow(`SELECT course_id FROM exam_bundles WHERE id = $1`, params["exam_bundle_id"]).Scan(&courseID)
+	default:
+		err = fmt.Errorf("the request does not name a course")
+	}
+	return courseID, err
+}
+
+// requireRole returns a martini service that requires the logged in user to
+// have a role (requires withCurrentUser). Administrators have every role.
+// For a course role, the course is found from the route parameters.
+func requireRole(role string) martini.Handler {
+	return func(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+		if currentUser.Admin {
+			return
+		}
+		switch role {
+		case RoleAdmin:
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an administrator", currentUser.ID, currentUser.Email)
+			return
+		case RoleAuthor:
+			if !currentUser.Author {
+				loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an author", currentUser.ID, currentUser.Name)
+			}
+			return
+		case RoleChair:
+			if !currentUser.Chair {
+				loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not a department chair", currentUser.ID, currentUser.Name)
+			}
+			return
+		}
+
+		courseID, err := routeCourseID(tx, params)
+		if err == sql.ErrNoRows {
+			loggedHTTPDBNotFoundError(w, err)
+			return
+		} else if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "finding the course for the request: %v", err)
+			return
+		}
+		if ok, err := hasCourseRole(tx, currentUser, courseID, role); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		} else if !ok {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not %s for course %d", currentUser.ID, currentUser.Name, roleTitle[role], courseID)
+			return
+		}
+	}
+}
+
+// grantCourseRole gives a user a staff role in a course, replacing any
+// staff role they had.
+func grantCourseRole(tx *sql.Tx, courseID int64, user *User, role string, grantedBy *User, now time.Time) (*CourseRole, error) {
+	courseRole := &CourseRole{
+		CourseID:  courseID,
+		UserID:    user.ID,
+		Role:      role,
+		GrantedBy: grantedBy.ID,
+		CreatedAt: now,
+	}
+	if _, err := tx.Exec(`DELETE FROM course_roles WHERE course_id = $1 AND user_id = $2`, courseID, user.ID); err != nil {
+		return nil, err
+	}
+	if err := meddler.Insert(tx, "course_roles", courseRole); err != nil {
+		return nil, err
+	}
+	return courseRole, nil
+}
+
+// GetCourseStaff handles a request to /v2/courses/:course_id/staff,
+// returning the staff roles given in a course. Instructors that the LMS
+// launched as instructors are not included.
+func GetCourseStaff(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	roles := []*CourseRole{}
+	if err := meddler.QueryAll(tx, &roles, `SELECT * FROM course_roles WHERE course_id = $1 ORDER BY user_id`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, roles)
+}
+
+// PutCourseStaff handles a request to /v2/courses/:course_id/staff/:user_id,
+// giving a user a staff role in a course. Only the role from the request
+// is used, and it must be ta or instructor.
+func PutCourseStaff(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, request CourseRole, audit *AuditEntry, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	userID, err := parseID(w, "user_id", params["user_id"])
+	if err != nil {
+		return
+	}
+	switch request.Role {
+	case RoleTA, RoleInstructor:
+	default:
+		loggedHTTPErrorf(w, http.StatusBadRequest, "staff role must be %s or %s", RoleTA, RoleInstructor)
+		return
+	}
+	user := new(User)
+	if err := meddler.Load(tx, "users", user, userID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	role, err := grantCourseRole(tx, courseID, user, request.Role, currentUser, time.Now())
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditRequest, courseID, "course %d: user %d (%s) given the %s role", courseID, user.ID, user.Name, role.Role)
+	render.JSON(http.StatusOK, role)
+}
+
+// DeleteCourseStaff handles a request to /v2/courses/:course_id/staff/:user_id,
+// removing a user's staff role in a course. A role the LMS gives the user
+// is not affected.
+func DeleteCourseStaff(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *AuditEntry) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	userID, err := parseID(w, "user_id", params["user_id"])
+	if err != nil {
+		return
+	}
+	result, err := tx.Exec(`DELETE FROM course_roles WHERE course_id = $1 AND user_id = $2`, courseID, userID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		loggedHTTPErrorf(w, http.StatusNotFound, "user %d has no staff role in course %d", userID, courseID)
+		return
+	}
+	audit.Record(AuditRequest, courseID, "course %d: staff role of user %d removed", courseID, userID)
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// After fixing a problem's tests, an instructor can regrade an assignment.
+// The latest graded commit for each step of each student's copy of the
+// assignment is sent to a daycare again, using the problem as it is now
+// and the course's current default options. Each result replaces the
+// report card and score of the commit it regraded, which is marked with
+// the regrade ID, and the student's score is updated and posted back to
+// the LMS. A commit the student has saved over since the regrade started
+// is left alone. The regrade runs in the background and its
+// progress is kept in the regrades table. The commits are worked through in
+// batches with a checkpoint after each one, so a regrade interrupted by a
+// restart picks up where it left off when the TA starts again.
+
+// PostAssignmentRegrade handles a request to /v2/assignments/:assignment_id/regrade,
+// starting a regrade of every student's copy of the assignment. Only TAs
+// and instructors for the course and administrators may do this.
+func PostAssignmentRegrade(w http.ResponseWriter, tx *sql.Tx, db *sql.DB, params martini.Params, currentUser *User, audit *AuditEntry, render render.Render) {
+	now := time.Now()
+
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	// only one regrade of an assignment at a time
+	var running int64
+	err = tx.QueryRow(`SELECT id FROM regrades WHERE course_id = $1 AND problem_set_id = $2 AND finished_at IS NULL`,
+		assignment.CourseID, assignment.ProblemSetID).Scan(&running)
+	if err == nil {
+		loggedHTTPErrorf(w, http.StatusConflict, "regrade %d of this assignment is still running", running)
+		return
+	} else if err != sql.ErrNoRows {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	regrade := &Regrade{
+		CourseID:     assignment.CourseID,
+		ProblemSetID: assignment.ProblemSetID,
+		RequestedBy:  currentUser.ID,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM (`+regradeCommitsQuery+`) AS latest`, assignment.CourseID, assignment.ProblemSetID, now).Scan(&regrade.Total); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := meddler.Insert(tx, "regrades", regrade); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditRequest, regrade.ID, "regrade %d of problem set %d in course %d: %d commit%s",
+		regrade.ID, regrade.ProblemSetID, regrade.CourseID, regrade.Total, plural(regrade.Total))
+	go runRegrade(context.Background(), db, regrade)
+
+	render.JSON(http.StatusAccepted, regrade)
+}
+
+// GetRegrade handles a request to /v2/regrades/:regrade_id,
+// returning the progress of a regrade.
+func GetRegrade(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	regradeID, err := parseID(w, "regrade_id", params["regrade_id"])
+	if err != nil {
+		return
+	}
+	regrade := new(Regrade)
+	if err := meddler.Load(tx, "regrades", regrade, regradeID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, regrade)
+}
+
+// regradeCommitsQuery finds the latest graded commit for each step of each
+// student's copy of an assignment as of when the regrade started, so steps
+// a student starts while the regrade runs do not change the list as it goes.
+const regradeCommitsQuery = `SELECT DISTINCT ON (commits.assignment_id, commits.problem_id, commits.step) commits.* ` +
+	`FROM commits JOIN assignments ON commits.assignment_id = assignments.id ` +
+	`WHERE assignments.course_id = $1 AND assignments.problem_set_id = $2 AND NOT assignments.instructor ` +
+	`AND commits.action IS NOT NULL AND commits.action <> '` + StyleCheckAction + `' AND NOT commits.quarantined ` +
+	`AND commits.created_at <= $3 ` +
+	`ORDER BY commits.assignment_id, commits.problem_id, commits.step, commits.created_at DESC`
+
+// regradeBatchQuery fetches the IDs of the commits to regrade a batch at a time.
+const regradeBatchQuery = `SELECT id FROM (` + regradeCommitsQuery + `) AS latest WHERE id > $4 ORDER BY id LIMIT $5`
+
+// RegradeStartTimeout is how long a regrade waits for the request that
+// started it to commit.
+const RegradeStartTimeout = 30 * time.Second
+
+// runRegrade regrades each commit in turn, recording progress as it goes.
+// A regrade that was interrupted resumes after the last commit it finished.
+func runRegrade(ctx context.Context, db *sql.DB, regrade *Regrade) {
+	// wait for the request that started the regrade to commit
+	for start := time.Now(); ; time.Sleep(time.Second) {
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM regrades WHERE id = $1)`, regrade.ID).Scan(&exists); err != nil {
+			log.Printf("regrade %d: db error: %v", regrade.ID, err)
+			return
+		} else if exists {
+			break
+		} else if time.Since(start) > RegradeStartTimeout {
+			log.Printf("regrade %d was never saved, giving up", regrade.ID)
+			return
+		}
+	}
+
+	// an assignment changed before an interruption may be counted again after it
+	cursor, err := newBatchCursor(ctx, db, fmt.Sprintf("regrade-%d", regrade.ID), regradeBatchQuery,
+		regrade.CourseID, regrade.ProblemSetID, regrade.CreatedAt)
+	if err != nil {
+		log.Printf("regrade %d: db error loading checkpoint: %v", regrade.ID, err)
+		return
+	}
+	changed := make(map[int64]bool)
+	for {
+		var ids []int64
+		if n, err := cursor.Next(ctx, scanKey(&ids)); err != nil {
+			if ctx.Err() != nil {
+				log.Printf("regrade %d stopped after %d commit%s", regrade.ID, regrade.Done, plural(regrade.Done))
+				return
+			}
+			log.Printf("regrade %d: db error loading commits: %v", regrade.ID, err)
+			regrade.Failed += regrade.Total - regrade.Done
+			regrade.Note = fmt.Sprintf("db error loading commits: %v", err)
+			break
+		} else if n == 0 {
+			break
+		}
+
+		for _, id := range ids {
+			commit := new(Commit)
+			err := meddler.Load(db, "commits", commit, id)
+			scoreChanged := false
+			if err == nil {
+				scoreChanged, err = regradeCommit(db, regrade, commit)
+			}
+			if err != nil {
+				log.Printf("regrade %d: commit %d: %v", regrade.ID, id, err)
+				regrade.Failed++
+				regrade.Note = fmt.Sprintf("commit %d: %v", id, err)
+			}
+			if scoreChanged && !changed[commit.AssignmentID] {
+				changed[commit.AssignmentID] = true
+				regrade.Changed++
+			}
+			regrade.Done++
+			regrade.UpdatedAt = time.Now()
+			if err := meddler.Update(db, "regrades", regrade); err != nil {
+				log.Printf("regrade %d: db error saving progress: %v", regrade.ID, err)
+			}
+			if err := cursor.Checkpoint(id); err != nil {
+				log.Printf("regrade %d: db error saving checkpoint: %v", regrade.ID, err)
+			}
+		}
+	}
+
+	if err := cursor.Finish(); err != nil {
+		log.Printf("regrade %d: db error clearing checkpoint: %v", regrade.ID, err)
+	}
+	now := time.Now()
+	regrade.UpdatedAt, regrade.FinishedAt = now, &now
+	if err := meddler.Update(db, "regrades", regrade); err != nil {
+		log.Printf("regrade %d: db error saving progress: %v", regrade.ID, err)
+	}
+	log.Printf("regrade %d finished: %d commit%s, %d failed, %d score%s changed",
+		regrade.ID, regrade.Done, plural(regrade.Done), regrade.Failed, regrade.Changed, plural(regrade.Changed))
+}
+
+// resumeRegrades restarts the regrades that were running when the TA last stopped.
+func resumeRegrades(db *sql.DB) {
+	regrades := []*Regrade{}
+	if err := meddler.QueryAll(db, &regrades, `SELECT * FROM regrades WHERE finished_at IS NULL ORDER BY id`); err != nil {
+		log.Printf("db error loading unfinished regrades: %v", err)
+		return
+	}
+	for _, regrade := range regrades {
+		log.Printf("resuming regrade %d after %d of %d commit%s", regrade.ID, regrade.Done, regrade.Total, plural(regrade.Total))
+		go runRegrade(context.Background(), db, regrade)
+	}
+}
+
+// regradeCommit grades one commit again and saves the result, reporting
+// whether the student's score changed.
+func regradeCommit(db *sql.DB, regrade *Regrade, old *Commit) (bool, error) {
+	// grading can take minutes, so it happens outside of any transaction
+	bundle, err := regradeBundle(db, regrade, old)
+	if err != nil {
+		return false, err
+	}
+	graded, err := gradeBundle(bundle)
+	if err != nil {
+		return false, err
+	}
+	if graded.ReportCard == nil {
+		return false, fmt.Errorf("no report card")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// commits are unique per step, so the result replaces the graded one
+	// unless the student has saved new work over it in the meantime
+	now := time.Now()
+	commit := new(Commit)
+	if err := meddler.QueryRow(tx, commit, `SELECT * FROM commits WHERE id = $1 FOR UPDATE`, old.ID); err != nil {
+		return false, err
+	}
+	if !commit.UpdatedAt.Equal(old.UpdatedAt) {
+		log.Printf("regrade %d: commit %d was saved over while it was being regraded, leaving it alone", regrade.ID, commit.ID)
+		return false, nil
+	}
+	commit.ReportCard, commit.Transcript, commit.Score = graded.ReportCard, graded.Transcript, graded.Score
+	commit.RegradeID = regrade.ID
+	commit.UpdatedAt = now
+	if err := meddler.Update(tx, "commits", commit); err != nil {
+		return false, err
+	}
+
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, commit.AssignmentID); err != nil {
+		return false, err
+	}
+	oldScore := assignment.Score
+	if err := scoreAssignment(tx, assignment, bundle.Problem.Unique, commit.Step, commit.ReportCard.ComputeScore()); err != nil {
+		return false, err
+	}
+	assignment.UpdatedAt = now
+	if err := meddler.Save(tx, "assignments", assignment); err != nil {
+		return false, err
+	}
+	if assignment.Score != oldScore {
+		audit := &AuditEntry{UserID: regrade.RequestedBy, Method: "POST", Path: fmt.Sprintf("/v2/regrades/%d", regrade.ID), CreatedAt: now}
+		audit.Record(AuditGradeChange, assignment.ID, "assignment %d score %.4f -> %.4f (regrade %d)", assignment.ID, oldScore, assignment.Score, regrade.ID)
+		if err := saveAuditEntry(tx, audit); err != nil {
+			return false, err
+		}
+		if err := recordEvent(tx, EventScoreChanged, assignment.CourseID, assignment.UserID, assignment.ID, map[string]interface{}{
+			"oldScore":  oldScore,
+			"score":     assignment.Score,
+			"regradeID": regrade.ID,
+		}); err != nil {
+			return false, err
+		}
+		user := new(User)
+		if err := meddler.Load(tx, "users", user, assignment.UserID); err != nil {
+			return false, err
+		}
+		if err := saveGrade(tx, assignment, user); err != nil {
+			return false, fmt.Errorf("error posting grade back to LMS: %v", err)
+		}
+		if err := queueNotification(tx, user, NotifyGradePosted, "Grade posted: "+assignment.CanvasTitle,
+			fmt.Sprintf("Your work for %s was graded again and your score changed from %.0f%% to %.0f%%.\n",
+				assignment.CanvasTitle, oldScore*100, assignment.Score*100)); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return assignment.Score != oldScore, nil
+}
+
+// regradeBundle builds the signed commit bundle that asks a daycare to
+// grade a student's commit again.
+func regradeBundle(db *sql.DB, regrade *Regrade, old *Commit) (*CommitBundle, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := loadCommitFiles(tx, old); err != nil {
+		return nil, err
+	}
+	problem := new(Problem)
+	if err := meddler.Load(tx, "problems", problem, old.ProblemID); err != nil {
+		return nil, err
+	}
+	if err := applyCourseOptions(tx, regrade.CourseID, problem); err != nil {
+		return nil, err
+	}
+	if err := applyCourseFeedback(tx, regrade.CourseID, regrade.ProblemSetID, problem); err != nil {
+		return nil, err
+	}
+	steps := []*ProblemStep{}
+	if err := meddler.QueryAll(tx, &steps, `SELECT * FROM problem_steps WHERE problem_id = $1 ORDER BY step`, problem.ID); err != nil {
+		return nil, err
+	}
+	omitPrechecks(steps...)
+	if old.Step > int64(len(steps)) {
+		return nil, fmt.Errorf("problem %s no longer has a step %d", problem.Unique, old.Step)
+	}
+	var userID int64
+	var locale string
+	if err := tx.QueryRow(`SELECT users.id, COALESCE(users.locale, '') FROM assignments JOIN users ON assignments.user_id = users.id `+
+		`WHERE assignments.id = $1`, old.AssignmentID).Scan(&userID, &locale); err != nil {
+		return nil, err
+	}
+	applyUserLocale(problem, steps, locale)
+
+	now := time.Now()
+	commit := &Commit{
+		AssignmentID: old.AssignmentID,
+		ProblemID:    old.ProblemID,
+		Step:         old.Step,
+		Action:       old.Action,
+		Note:         fmt.Sprintf("regrade %d of commit %d", regrade.ID, old.ID),
+		Variant:      old.Variant,
+		Files:        old.Files,
+		Sealed:       old.Sealed,
+		RegradeID:    regrade.ID,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := issueCommitNonce(tx, now, commit); err != nil {
+		return nil, err
+	}
+	problemSig := problem.ComputeSignature(Config().DaycareSecret, steps)
+	bundle := &CommitBundle{
+		Problem:          problem,
+		ProblemSteps:     steps,
+		ProblemSignature: problemSig,
+		Commit:           commit,
+		CommitSignature:  commit.ComputeSignature(Config().DaycareSecret, problemSig),
+		UserID:           userID,
+		CourseID:         regrade.CourseID,
+	}
+	bundle.OwnerSignature = bundle.ComputeOwnerSignature(Config().DaycareSecret)
+
+	// the nonce must be recorded before the bundle is sent
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
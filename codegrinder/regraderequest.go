@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// A student who thinks a commit was graded unfairly can file a regrade
+// request against it with a message for the course staff. Instructors list
+// the open requests for a course and resolve each one as accepted or denied
+// with a decision, and the student is notified of the decision. Accepting a request
+// does not change any scores by itself; staff can follow up with a regrade
+// or a score override.
+
+// MaxRegradeRequestLength is the longest message or decision accepted, in bytes.
+const MaxRegradeRequestLength = 10000
+
+// PostCommitRegradeRequest handles requests to /v2/commits/:commit_id/regrade_requests,
+// filing a regrade request for a graded commit. Only the student who owns
+// the commit may file one, and a commit can have only one open request.
+func PostCommitRegradeRequest(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, request RegradeRequest, render render.Render) {
+	now := time.Now()
+
+	commitID, err := parseID(w, "commit_id", params["commit_id"])
+	if err != nil {
+		return
+	}
+	commit := new(Commit)
+	if err := meddler.Load(tx, "commits", commit, commitID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, commit.AssignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if assignment.UserID != currentUser.ID {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) does not own commit %d", currentUser.ID, currentUser.Name, commit.ID)
+		return
+	}
+	if commit.ReportCard == nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "commit %d has not been graded", commit.ID)
+		return
+	}
+	request.Message = strings.TrimSpace(request.Message)
+	if request.Message == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "a regrade request must explain what should be reconsidered")
+		return
+	}
+	if len(request.Message) > MaxRegradeRequestLength {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "a regrade request may be at most %d bytes", MaxRegradeRequestLength)
+		return
+	}
+	var open bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM regrade_requests WHERE commit_id = $1 AND status = $2)`,
+		commit.ID, RegradeRequestOpen).Scan(&open); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	} else if open {
+		loggedHTTPErrorf(w, http.StatusConflict, "commit %d already has an open regrade request", commit.ID)
+		return
+	}
+
+	regradeRequest := &RegradeRequest{
+		CommitID:     commit.ID,
+		AssignmentID: assignment.ID,
+		CourseID:     assignment.CourseID,
+		UserID:       currentUser.ID,
+		Message:      request.Message,
+		Status:       RegradeRequestOpen,
+		CreatedAt:    now,
+	}
+	if err := meddler.Insert(tx, "regrade_requests", regradeRequest); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := recordEvent(tx, EventRegradeRequest, assignment.CourseID, currentUser.ID, regradeRequest.ID, map[string]interface{}{
+		"assignmentID": assignment.ID,
+		"commitID":     commit.ID,
+		"step":         commit.Step,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	render.JSON(http.StatusOK, regradeRequest)
+}
+
+// GetUserMeRegradeRequests handles requests to /v2/users/me/regrade_requests,
+// returning the current user's regrade requests, newest first.
+func GetUserMeRegradeRequests(w http.ResponseWriter, tx *sql.Tx, currentUser *User, render render.Render) {
+	requests := []*RegradeRequest{}
+	if err := meddler.QueryAll(tx, &requests, `SELECT * FROM regrade_requests WHERE user_id = $1 ORDER BY created_at DESC`, currentUser.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, requests)
+}
+
+// GetCourseRegradeRequests handles requests to /v2/courses/:course_id/regrade_requests,
+// returning the regrade requests for a course, oldest first. Only open
+// requests are returned unless status=<...> asks for accepted, denied, or all.
+// Only instructors for the course and administrators may see them.
+func GetCourseRegradeRequests(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	where, args := ` WHERE course_id = $1`, []interface{}{courseID}
+	switch status := r.FormValue("status"); status {
+	case "":
+		where += ` AND status = $2`
+		args = append(args, RegradeRequestOpen)
+	case RegradeRequestOpen, RegradeRequestAccepted, RegradeRequestDenied:
+		where += ` AND status = $2`
+		args = append(args, status)
+	case "all":
+	default:
+		loggedHTTPErrorf(w, http.StatusBadRequest, "status must be %s, %s, %s, or all", RegradeRequestOpen, RegradeRequestAccepted, RegradeRequestDenied)
+		return
+	}
+	requests := []*RegradeRequest{}
+	if err := meddler.QueryAll(tx, &requests, `SELECT * FROM regrade_requests`+where+` ORDER BY created_at`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, requests)
+}
+
+// PutRegradeRequest handles requests to /v2/regrade_requests/:regrade_request_id,
+// resolving an open regrade request. The request gives the status, accepted
+// or denied, and the decision to send to the student. Only instructors for
+// the course and administrators may resolve requests.
+func PutRegradeRequest(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, request RegradeRequest, audit *AuditEntry, render render.Render) {
+	now := time.Now()
+
+	requestID, err := parseID(w, "regrade_request_id", params["regrade_request_id"])
+	if err != nil {
+		return
+	}
+	regradeRequest := new(RegradeRequest)
+	if err := meddler.Load(tx, "regrade_requests", regradeRequest, requestID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if regradeRequest.Status != RegradeRequestOpen {
+		loggedHTTPErrorf(w, http.StatusConflict, "regrade request %d was already %s", regradeRequest.ID, regradeRequest.Status)
+		return
+	}
+	if request.Status != RegradeRequestAccepted && request.Status != RegradeRequestDenied {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "status must be %s or %s", RegradeRequestAccepted, RegradeRequestDenied)
+		return
+	}
+	request.Decision = strings.TrimSpace(request.Decision)
+	if request.Decision == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "a decision explaining the resolution is required")
+		return
+	}
+	if len(request.Decision) > MaxRegradeRequestLength {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "a decision may be at most %d bytes", MaxRegradeRequestLength)
+		return
+	}
+
+	regradeRequest.Status = request.Status
+	regradeRequest.Decision = request.Decision
+	regradeRequest.ResolvedBy = currentUser.ID
+	regradeRequest.ResolvedAt = &now
+	if err := meddler.Update(tx, "regrade_requests", regradeRequest); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := recordEvent(tx, EventRegradeResolved, regradeRequest.CourseID, regradeRequest.UserID, regradeRequest.ID, map[string]interface{}{
+		"assignmentID": regradeRequest.AssignmentID,
+		"commitID":     regradeRequest.CommitID,
+		"status":       regradeRequest.Status,
+		"resolvedBy":   currentUser.ID,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditRequest, regradeRequest.ID, "regrade request %d for commit %d %s: %s",
+		regradeRequest.ID, regradeRequest.CommitID, regradeRequest.Status, regradeRequest.Decision)
+
+	notifyRegradeResolved(tx, regradeRequest)
+
+	render.JSON(http.StatusOK, regradeRequest)
+}
+
+// notifyRegradeResolved queues a notification of the decision on a regrade
+// request to the student. Failures are logged, since the decision is saved
+// either way.
+func notifyRegradeResolved(tx *sql.Tx, regradeRequest *RegradeRequest) {
+	student := new(User)
+	if err := meddler.Load(tx, "users", student, regradeRequest.UserID); err != nil {
+		log.Printf("db error loading user %d to notify about regrade request %d: %v", regradeRequest.UserID, regradeRequest.ID, err)
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, regradeRequest.AssignmentID); err != nil {
+		log.Printf("db error loading assignment %d to notify about regrade request %d: %v", regradeRequest.AssignmentID, regradeRequest.ID, err)
+		return
+	}
+	body := new(strings.Builder)
+	fmt.Fprintf(body, "Hi %s,\n\n", student.Name)
+	fmt.Fprintf(body, "Your regrade request for %s was %s.\n\n", assignment.CanvasTitle, regradeRequest.Status)
+	fmt.Fprintf(body, "You wrote:\n\n%s\n\n", regradeRequest.Message)
+	fmt.Fprintf(body, "The decision:\n\n%s\n", regradeRequest.Decision)
+	if err := queueNotification(tx, student, NotifyRegradeResolved, "Regrade request "+regradeRequest.Status+": "+assignment.CanvasTitle, body.String()); err != nil {
+		log.Printf("db error queuing notification about regrade request %d: %v", regradeRequest.ID, err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// An assignment is finalized once its lock date from the LMS has passed,
+// after which no more work can be saved or graded. An instructor can reopen
+// it for one student with a new lock date; the most recent reopen applies.
+
+// loadAssignmentReopen returns the most recent reopen of an assignment, or
+// nil if it has never been reopened.
+func loadAssignmentReopen(tx *sql.Tx, assignmentID int64) (*AssignmentReopen, error) {
+	reopen := new(AssignmentReopen)
+	err := meddler.QueryRow(tx, reopen, `SELECT * FROM assignment_reopens WHERE assignment_id = $1 ORDER BY created_at DESC, id DESC LIMIT 1`, assignmentID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reopen, nil
+}
+
+// assignmentLockAt returns when an assignment is finalized, taking the later
+// of the LMS lock date and the reopen lock date, or nil if it never is.
+func assignmentLockAt(asst *Assignment, reopen *AssignmentReopen) *time.Time {
+	if reopen == nil {
+		return asst.LockAt
+	}
+	if asst.LockAt != nil && asst.LockAt.After(reopen.LockAt) {
+		return asst.LockAt
+	}
+	return &reopen.LockAt
+}
+
+// isPostReopen reports whether work saved now is only possible because the
+// assignment was reopened.
+func isPostReopen(now time.Time, asst *Assignment, reopen *AssignmentReopen) bool {
+	return reopen != nil && asst.LockAt != nil && now.After(*asst.LockAt)
+}
+
+// PostAssignmentReopen handles a request to /v2/assignments/:assignment_id/reopen,
+// reopening a student's assignment until a new lock date. The request gives
+// the new lock date, the reason, and whether later scores should be kept out
+// of the LMS. Only instructors for the course and administrators may do this.
+func PostAssignmentReopen(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, request AssignmentReopen, audit *AuditEntry, render render.Render) {
+	now := time.Now()
+
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	request.Reason = strings.TrimSpace(request.Reason)
+	if request.Reason == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "a reason for reopening the assignment is required")
+		return
+	}
+	if !request.LockAt.After(now) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "the new lock date must be in the future")
+		return
+	}
+
+	reopen := &AssignmentReopen{
+		AssignmentID:    assignment.ID,
+		ReopenedBy:      currentUser.ID,
+		Reason:          request.Reason,
+		LockAt:          request.LockAt,
+		ExcludePassback: request.ExcludePassback,
+		CreatedAt:       now,
+	}
+	if err := meddler.Insert(tx, "assignment_reopens", reopen); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := recordEvent(tx, EventAssignmentReopen, assignment.CourseID, assignment.UserID, assignment.ID, map[string]interface{}{
+		"reopenedBy":      currentUser.ID,
+		"lockAt":          reopen.LockAt,
+		"excludePassback": reopen.ExcludePassback,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditReopen, assignment.ID, "assignment %d for user %d reopened until %s: %s",
+		assignment.ID, assignment.UserID, reopen.LockAt.Format(time.RFC3339), reopen.Reason)
+
+	render.JSON(http.StatusOK, reopen)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+const (
+	// ReuseSimilarityThreshold is the fraction of a submitted file's own
+	// lines that must appear in an earlier file to report it as reused.
+	ReuseSimilarityThreshold = 0.8
+
+	// ReuseMinimumLines is the number of distinct lines a file must add to
+	// the starter code before it is compared at all, so that small or
+	// mostly untouched files are not reported.
+	ReuseMinimumLines = 5
+)
+
+// PostCommitBundleReuseCheck handles a request to /v2/commit_bundles/reuse_check,
+// comparing the files of a commit with the student's most recent work on
+// other problems. Students sometimes submit a solution from an earlier
+// assignment by mistake, or copy one without understanding the new problem;
+// this lets the client warn them before they spend a graded attempt.
+// Nothing is saved.
+func PostCommitBundleReuseCheck(w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle CommitBundle, render render.Render) {
+	if bundle.Commit == nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must contain a commit")
+		return
+	}
+	commit := bundle.Commit
+	assignment := new(Assignment)
+	if err := meddler.QueryRow(tx, assignment, `SELECT * FROM assignments WHERE id = $1 AND user_id = $2`, commit.AssignmentID, currentUser.ID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	problem := new(Problem)
+	if err := meddler.Load(tx, "problems", problem, commit.ProblemID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	step := new(ProblemStep)
+	if err := meddler.QueryRow(tx, step, `SELECT * FROM problem_steps WHERE problem_id = $1 AND step = $2`, commit.ProblemID, commit.Step); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	// lines from the starter code do not count as the student's own work
+	starter := make(map[string]bool)
+	for name, contents := range step.VariantFiles(problem.ChooseVariant(currentUser.ID)) {
+		if !strings.Contains(name, "/") {
+			for line := range reuseLines(contents) {
+				starter[line] = true
+			}
+		}
+	}
+
+	// get the latest commit for every other problem this student has worked on
+	others := []*Commit{}
+	if err := meddler.QueryAll(tx, &others, `SELECT DISTINCT ON (commits.assignment_id, commits.problem_id) commits.* `+
+		`FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+		`WHERE assignments.user_id = $1 AND commits.problem_id != $2 `+
+		`ORDER BY commits.assignment_id, commits.problem_id, commits.step DESC, commits.updated_at DESC`,
+		currentUser.ID, commit.ProblemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := loadCommitFiles(tx, others...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading commit files: %v", err)
+		return
+	}
+
+	matches := []*ReuseMatch{}
+	for name, contents := range commit.Files {
+		own := reuseLines(contents)
+		for line := range starter {
+			delete(own, line)
+		}
+		if len(own) < ReuseMinimumLines {
+			continue
+		}
+		var best *ReuseMatch
+		for _, other := range others {
+			for otherName, otherContents := range other.Files {
+				if !strings.EqualFold(filepath.Ext(otherName), filepath.Ext(name)) {
+					continue
+				}
+				previous := reuseLines(otherContents)
+				shared := 0
+				for line := range own {
+					if previous[line] {
+						shared++
+					}
+				}
+				similarity := float64(shared) / float64(len(own))
+				if similarity >= ReuseSimilarityThreshold && (best == nil || similarity > best.Similarity) {
+					best = &ReuseMatch{
+						File:         name,
+						AssignmentID: other.AssignmentID,
+						ProblemID:    other.ProblemID,
+						Step:         other.Step,
+						MatchedFile:  otherName,
+						Similarity:   similarity,
+					}
+				}
+			}
+		}
+		if best != nil {
+			matches = append(matches, best)
+		}
+	}
+
+	// fill in names so the student can recognize the earlier work
+	for _, match := range matches {
+		if err := tx.QueryRow(`SELECT canvas_title FROM assignments WHERE id = $1`, match.AssignmentID).Scan(&match.AssignmentTitle); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if err := tx.QueryRow(`SELECT unique_id FROM problems WHERE id = $1`, match.ProblemID).Scan(&match.ProblemUnique); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].File < matches[j].File })
+
+	render.JSON(http.StatusOK, matches)
+}
+
+// reuseLines returns the distinct non-blank lines of a file with
+// surrounding whitespace removed, so reindenting code does not hide reuse.
+func reuseLines(contents string) map[string]bool {
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(contents, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines[line] = true
+		}
+	}
+	return lines
+}
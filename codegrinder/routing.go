@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// When grading uses the work queue, a problem type can require daycare
+// nodes with particular tags, e.g., arch=arm64 for a native toolchain or
+// trusted for problems that need extra privileges. Administrators tag the
+// nodes, and a worker is only handed jobs for problem types whose required
+// tags it has. A request for a problem type that no live worker can run is
+// rejected right away instead of waiting in the queue.
+
+// hasRequiredTags reports whether a worker with the given tags can run a
+// problem type.
+func hasRequiredTags(problemType *ProblemType, tags []string) bool {
+	have := make(map[string]bool)
+	for _, tag := range tags {
+		have[tag] = true
+	}
+	for _, tag := range problemType.RequiredTags {
+		if !have[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+// routableProblemTypes narrows the problem types a worker offers to the
+// ones its tags allow it to run.
+func routableProblemTypes(names []string, tags []string) []string {
+	var allowed []string
+	for _, name := range names {
+		if problemType, exists := problemTypes[name]; exists && hasRequiredTags(problemType, tags) {
+			allowed = append(allowed, name)
+		}
+	}
+	return allowed
+}
+
+// liveDaycareWorkers returns the workers that have sent a heartbeat recently.
+func liveDaycareWorkers(db meddler.DB, now time.Time) ([]*DaycareWorker, error) {
+	workers := []*DaycareWorker{}
+	err := meddler.QueryAll(db, &workers, `SELECT * FROM daycare_workers WHERE last_seen_at >= $1 ORDER BY name`, now.Add(-2*WorkerHeartbeat))
+	return workers, err
+}
+
+// daycareRoute finds the live workers that can run a problem type.
+func daycareRoute(problemType *ProblemType, workers []*DaycareWorker) *DaycareRoute {
+	route := &DaycareRoute{
+		ProblemType:  problemType.Name,
+		RequiredTags: problemType.RequiredTags,
+		Workers:      []string{},
+	}
+	if route.RequiredTags == nil {
+		route.RequiredTags = []string{}
+	}
+	for _, worker := range workers {
+		offered := false
+		for _, name := range worker.ProblemTypes {
+			offered = offered || name == problemType.Name
+		}
+		if offered && hasRequiredTags(problemType, worker.Tags) {
+			route.Workers = append(route.Workers, worker.Name)
+		}
+	}
+	if len(route.Workers) == 0 {
+		if len(route.RequiredTags) > 0 {
+			route.Error = fmt.Sprintf("no daycare node can run problem type %s: it requires a node tagged %s",
+				problemType.Name, strings.Join(route.RequiredTags, ", "))
+		} else {
+			route.Error = fmt.Sprintf("no daycare node offers problem type %s", problemType.Name)
+		}
+	}
+	return route
+}
+
+// checkDaycareRoute returns an error if a problem type has required tags
+// and no live worker can satisfy them. Problem types without requirements
+// are queued even if no worker is running, as one may start soon.
+func checkDaycareRoute(db *sql.DB, problemType *ProblemType, now time.Time) error {
+	if len(problemType.RequiredTags) == 0 {
+		return nil
+	}
+	workers, err := liveDaycareWorkers(db, now)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if route := daycareRoute(problemType, workers); route.Error != "" {
+		return fmt.Errorf("%s", route.Error)
+	}
+	return nil
+}
+
+// GetDaycareRoutes handles a request to /v2/daycare_routes,
+// listing each problem type with its required tags and the live workers
+// that can run it. Problem types that no worker can run include an error.
+func GetDaycareRoutes(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+	workers, err := liveDaycareWorkers(tx, time.Now())
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	var names []string
+	for name := range problemTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	routes := []*DaycareRoute{}
+	for _, name := range names {
+		routes = append(routes, daycareRoute(problemTypes[name], workers))
+	}
+	render.JSON(http.StatusOK, routes)
+}
+
+// PutDaycareWorkerTags handles a request to /v2/daycare_workers/:name/tags,
+// replacing the tags of a daycare worker. The request gives the new tags.
+func PutDaycareWorkerTags(w http.ResponseWriter, tx *sql.Tx, params martini.Params, request DaycareWorker, audit *AuditEntry, render render.Render) {
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range request.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || strings.ContainsAny(tag, " \t,") {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "invalid tag %q: tags cannot be empty or contain spaces or commas", tag)
+			return
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+
+	worker := new(DaycareWorker)
+	if err := meddler.QueryRow(tx, worker, `SELECT * FROM daycare_workers WHERE name = $1`, params["name"]); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	worker.Tags = tags
+	raw, err := json.Marshal(tags)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "json error: %v", err)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE daycare_workers SET tags = $1 WHERE name = $2`, string(raw), worker.Name); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditRequest, 0, "daycare worker %s tagged %s", worker.Name, strings.Join(tags, ", "))
+	render.JSON(http.StatusOK, worker)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// Rust problems are crates graded with cargo test. A cold build of even a
+// few dependencies would use up the CPU limit, so the codegrinder/rust image
+// keeps the crate registry in CARGO_HOME and a target directory with the
+// common dependencies already compiled in /opt/rust-target. The grader
+// copies that target directory into place and builds offline, so only the
+// student's crate and the tests are compiled.
+
+const rustTargetDir = "/tmp/target"
+
+func init() {
+	problemTypes["rusttest"] = &ProblemType{
+		Name:        "rusttest",
+		Image:       "codegrinder/rust",
+		MaxCPU:      60,
+		MaxFD:       100,
+		MaxFileSize: 100,
+		MaxMemory:   512,
+		MaxThreads:  100,
+		Actions: map[string]*ProblemTypeAction{
+			"grade": &ProblemTypeAction{
+				Action:  "grade",
+				Button:  "Grade",
+				Message: "Grading‥",
+				Class:   "btn-grade",
+				Handler: nannyHandler(rustTestGrade),
+			},
+			"": &ProblemTypeAction{
+				Action: "",
+				Button: "Save",
+				Class:  "btn-save",
+			},
+			"confirm": &ProblemTypeAction{
+				Action:  "confirm",
+				Handler: nannyHandler(rustTestGrade),
+			},
+		},
+	}
+}
+
+var (
+	rustTestLine    = regexp.MustCompile(`^test (\S+) \.\.\. (ok|FAILED|ignored)`)
+	rustFailureHead = regexp.MustCompile(`^---- (\S+) stdout ----$`)
+	rustPanicAt     = regexp.MustCompile(`panicked at (\S+\.rs):(\d+):\d+`)
+	rustErrorAt     = regexp.MustCompile(`(?m)^\s*--> (\S+\.rs):(\d+):\d+`)
+)
+
+func rustTestGrade(n *Nanny, args []string, options []string, files map[string]string) {
+	log.Printf("rustTestGrade")
+
+	if _, ok := files["Cargo.toml"]; !ok {
+		n.ReportCard.LogAndFailf("Cargo.toml not found")
+		return
+	}
+
+	// put the files in the container
+	if err := n.PutFiles(files); err != nil {
+		n.ReportCard.LogAndFailf("PutFiles error: %v", err)
+		return
+	}
+
+	// build and run the tests using the prebuilt dependencies
+	cmd := fmt.Sprintf("cp -a /opt/rust-target %s && CARGO_TARGET_DIR=%s cargo test --offline --color never -- --test-threads=1", rustTargetDir, rustTargetDir)
+	stdout, stderr, _, status, err := n.ExecNonInteractive([]string{"sh", "-c", cmd})
+	if err != nil {
+		n.ReportCard.LogAndFailf("exec error: %v", err)
+		return
+	}
+
+	// read the summary line for each test, then the details for failures
+	var order []string
+	outcomes := make(map[string]string)
+	details := make(map[string][]string)
+	current := ""
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if groups := rustTestLine.FindStringSubmatch(line); groups != nil {
+			if _, ok := outcomes[groups[1]]; !ok {
+				order = append(order, groups[1])
+			}
+			outcomes[groups[1]] = groups[2]
+			current = ""
+			continue
+		}
+		if groups := rustFailureHead.FindStringSubmatch(line); groups != nil {
+			current = groups[1]
+			continue
+		}
+		switch {
+		case current == "":
+		case line == "failures:" || strings.HasPrefix(line, "test result:"):
+			current = ""
+		default:
+			details[current] = append(details[current], line)
+		}
+	}
+
+	if len(order) == 0 {
+		// most likely a compile error
+		output := stderr.String()
+		context := ""
+		if groups := rustErrorAt.FindStringSubmatch(output); groups != nil {
+			context = groups[1] + ":" + groups[2]
+		}
+		n.ReportCard.AddFailedResult("build", "<h1>Build failed</h1>\n"+htmlEscapePre(output), context)
+		n.ReportCard.Duration = time.Since(n.Start)
+		n.ReportCard.Note = fmt.Sprintf("build failed, exit status %d", status)
+		return
+	}
+
+	failed := 0
+	for _, name := range order {
+		switch outcomes[name] {
+		case "ignored":
+			// ignored tests do not count either way
+		case "ok":
+			n.ReportCard.AddPassedResult(name, htmlEscapePara("test passed"))
+		default:
+			failed++
+			text := strings.TrimSpace(strings.Join(details[name], "\n"))
+			context := ""
+			if groups := rustPanicAt.FindStringSubmatch(text); groups != nil {
+				context = groups[1] + ":" + groups[2]
+			}
+			n.ReportCard.AddFailedResult(name, "<h1>Test failed</h1>\n"+htmlEscapePre(text), context)
+		}
+	}
+	if status != 0 && failed == 0 {
+		n.ReportCard.Failf("cargo test exited with status %d", status)
+	}
+	n.ReportCard.Duration = time.Since(n.Start)
+
+	if n.ReportCard.Note == "" {
+		n.ReportCard.Note = fmt.Sprintf("%d/%d tests passed in %v", len(n.ReportCard.Results)-failed, len(n.ReportCard.Results), n.ReportCard.Duration)
+	}
+}
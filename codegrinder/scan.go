@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Submitted files are scanned by Config.ScanCommand, which is run once per
+// file with the path of a temporary copy as its last argument. It must exit
+// with status 0 for a clean file and 1 for an infected one, as clamscan and
+// clamdscan do; anything else is treated as a failure to scan. Files are
+// scanned by a background worker after they are saved, never while a
+// request waits. A commit is not signed for grading until all of its files
+// have been scanned, and commits that include a flagged file are
+// quarantined: the server will not sign them, so no daycare will run them.
+// Administrators are notified through the notification queue, so nothing
+// is sent for a change that is rolled back.
+//
+// The TA cannot see the files of an encrypted commit, so a daycare with a
+// ScanCommand scans them after decrypting them and refuses to run a commit
+// with a flagged file. Nothing is recorded in that case, as daycares have
+// no database, but the daycare logs it.
+
+// ScanInterval is how often the background scanner looks for new files.
+const ScanInterval = 30 * time.Second
+
+// ScanTimeout is the longest the scanner may take on a single file.
+const ScanTimeout = 2 * time.Minute
+
+// runScanner runs the scanner on a single file. It reports whether the file
+// was flagged, along with the scanner's explanation.
+func runScanner(name, contents string) (bool, string, error) {
+	fields := strings.Fields(Config().ScanCommand)
+	if len(fields) == 0 {
+		return false, "", fmt.Errorf("cannot scan file %s: no ScanCommand is configured", name)
+	}
+	dir, err := ioutil.TempDir("", "codegrinder-scan-")
+	if err != nil {
+		return false, "", err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, filepath.Base(name))
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		return false, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ScanTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, fields[0], append(fields[1:], path)...).CombinedOutput()
+	if err != nil {
+		exit, ok := err.(*exec.ExitError)
+		if !ok || exit.ExitCode() != 1 {
+			return false, "", fmt.Errorf("scanner failed on file %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+		}
+		return true, strings.TrimSpace(strings.Replace(string(out), path, name, -1)), nil
+	}
+	return false, "", nil
+}
+
+// scanFile runs the scanner on a file from the file store and records the
+// result. It reports whether the file was flagged.
+func scanFile(db meddler.DB, hash, contents string) (bool, error) {
+	bad, note, err := runScanner(hash, contents)
+	if err != nil {
+		return false, err
+	}
+	status := "clean"
+	if bad {
+		status = "flagged"
+	}
+	if _, err := db.Exec(`UPDATE files SET scan_status = $1, scan_note = NULLIF($2, ''), scanned_at = $3 WHERE hash = $4`,
+		status, note, time.Now(), hash); err != nil {
+		return false, err
+	}
+	return bad, nil
+}
+
+// scanSealedFiles runs the scanner on the decrypted files of an encrypted
+// commit, returning an error if any file is flagged.
+func scanSealedFiles(files map[string]string) error {
+	for name, contents := range files {
+		bad, note, err := runScanner(name, contents)
+		if err != nil {
+			return err
+		}
+		if bad {
+			log.Printf("malware scanner flagged encrypted file %s: %s", name, note)
+			return fmt.Errorf("%s", scanHoldMessage(true))
+		}
+	}
+	return nil
+}
+
+// checkCommitScan sets the commit's quarantine flag from the scan results
+// of its files. It returns the notes for any flagged files, and reports
+// whether any file is still waiting to be scanned.
+func checkCommitScan(tx *sql.Tx, commit *Commit) ([]string, bool, error) {
+	var flagged []string
+	pending := false
+	for name, hash := range commit.FileHashes {
+		var status, note sql.NullString
+		if err := tx.QueryRow(`SELECT scan_status, scan_note FROM files WHERE hash = $1`, hash).Scan(&status, &note); err != nil {
+			return nil, false, err
+		}
+		switch {
+		case !status.Valid:
+			pending = true
+		case status.String == "flagged":
+			flagged = append(flagged, name+": "+note.String)
+		}
+	}
+	commit.Quarantined = len(flagged) > 0
+	return flagged, pending, nil
+}
+
+// scanHoldMessage explains to a student why a commit was saved but not
+// signed for grading.
+func scanHoldMessage(flagged bool) string {
+	if flagged {
+		return "this submission was flagged by the malware scanner and cannot be graded; contact your instructor"
+	}
+	return fmt.Sprintf("your work was saved, but it cannot be graded until the malware scanner has checked it; try again in %d seconds",
+		int(ScanInterval/time.Second))
+}
+
+// checkFilesScan looks up the scan results of files that may not be saved
+// yet, so a whole set can be checked before any of it is saved. It returns
+// the reason the files cannot be graded, or "" if they have all passed.
+// Files that are not in the store yet are waiting to be scanned.
+func checkFilesScan(tx *sql.Tx, files map[string]string) (string, error) {
+	pending := false
+	for _, contents := range files {
+		var status sql.NullString
+		err := tx.QueryRow(`SELECT scan_status FROM files WHERE hash = $1`, fileHash(contents)).Scan(&status)
+		switch {
+		case err == sql.ErrNoRows:
+			pending = true
+		case err != nil:
+			return "", err
+		case !status.Valid:
+			pending = true
+		case status.String == "flagged":
+			return scanHoldMessage(true), nil
+		}
+	}
+	if pending {
+		return scanHoldMessage(false), nil
+	}
+	return "", nil
+}
+
+// startScanner scans newly stored files in the background, quarantining
+// the commits that include flagged files and notifying administrators.
+func startScanner(db *sql.DB) {
+	if Config().ScanCommand == "" {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(ScanInterval)
+
+			rows, err := db.Query(`SELECT hash, contents FROM files WHERE scan_status IS NULL ORDER BY created_at LIMIT 100`)
+			if err != nil {
+				log.Printf("db error finding files to scan: %v", err)
+				continue
+			}
+			pending := make(map[string]string)
+			for rows.Next() {
+				var hash, contents string
+				if err := rows.Scan(&hash, &contents); err != nil {
+					log.Printf("db error reading file to scan: %v", err)
+					break
+				}
+				pending[hash] = contents
+			}
+			rows.Close()
+
+			for hash, contents := range pending {
+				bad, err := scanFile(db, hash, contents)
+				if err != nil {
+					log.Printf("%v", err)
+					continue
+				}
+				if bad {
+					quarantineFile(db, hash)
+				}
+			}
+		}
+	}()
+}
+
+// quarantineFile flags every commit that includes a file and notifies
+// administrators.
+func quarantineFile(db *sql.DB, hash string) {
+	commits := []*Commit{}
+	if err := meddler.QueryAll(db, &commits, `UPDATE commits SET quarantined = TRUE `+
+		`WHERE EXISTS (SELECT 1 FROM jsonb_each_text(files) WHERE value = $1) RETURNING *`, hash); err != nil {
+		log.Printf("db error quarantining commits with file %s: %v", hash, err)
+		return
+	}
+	var note string
+	if err := db.QueryRow(`SELECT scan_note FROM files WHERE hash = $1`, hash).Scan(&note); err != nil {
+		log.Printf("db error loading scan result for file %s: %v", hash, err)
+	}
+	notifyQuarantine(db, note, commits)
+}
+
+// notifyQuarantine queues a notice to administrators about commits that
+// were flagged by the scanner.
+func notifyQuarantine(db meddler.DB, note string, commits []*Commit) {
+	log.Printf("malware scanner flagged %d commit(s): %s", len(commits), note)
+	admins := []*User{}
+	if err := meddler.QueryAll(db, &admins, `SELECT * FROM users WHERE admin`); err != nil {
+		log.Printf("db error loading administrators: %v", err)
+		return
+	}
+	body := new(strings.Builder)
+	fmt.Fprintf(body, "The malware scanner flagged a submission:\n\n%s\n\n", note)
+	fmt.Fprintf(body, "These commits are quarantined and will not be graded:\n\n")
+	for _, commit := range commits {
+		fmt.Fprintf(body, "  assignment %d, problem %d, step %d", commit.AssignmentID, commit.ProblemID, commit.Step)
+		if commit.ID != 0 {
+			fmt.Fprintf(body, " (commit %d)", commit.ID)
+		}
+		fmt.Fprintf(body, "\n")
+	}
+	fmt.Fprintf(body, "\nReview them at /v2/quarantined_commits.\n")
+	for _, admin := range admins {
+		if err := queueNotification(db, admin, NotifyQuarantine, "Submission quarantined by malware scanner", body.String()); err != nil {
+			log.Printf("db error queuing quarantine notification for %s: %v", admin.Email, err)
+		}
+	}
+}
+
+// GetQuarantinedCommits handles a request to /v2/quarantined_commits,
+// listing commits that include a file flagged by the scanner, with their
+// files so they can be reviewed.
+func GetQuarantinedCommits(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+	commits := []*Commit{}
+	if err := meddler.QueryAll(tx, &commits, `SELECT * FROM commits WHERE quarantined ORDER BY updated_at DESC`); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := loadCommitFiles(tx, commits...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading commit files: %v", err)
+		return
+	}
+	for _, commit := range commits {
+		commit.Transcript = nil
+	}
+	render.JSON(http.StatusOK, commits)
+}
+
+// DeleteQuarantinedCommit handles a request to /v2/quarantined_commits/:commit_id,
+// releasing a commit that was flagged in error. Its files are marked clean
+// so they will not be flagged again.
+func DeleteQuarantinedCommit(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *AuditEntry) {
+	commitID, err := parseID(w, "commit_id", params["commit_id"])
+	if err != nil {
+		return
+	}
+	commit := new(Commit)
+	if err := meddler.QueryRow(tx, commit, `SELECT * FROM commits WHERE id = $1 AND quarantined`, commitID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	for _, hash := range commit.FileHashes {
+		if _, err := tx.Exec(`UPDATE files SET scan_status = 'clean', scan_note = $1 WHERE hash = $2 AND scan_status = 'flagged'`,
+			fmt.Sprintf("released by %s", currentUser.Email), hash); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	if _, err := tx.Exec(`UPDATE commits SET quarantined = FALSE WHERE id = $1`, commitID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditQuarantine, commitID, "released commit %d from quarantine", commitID)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The scheduler limits how many containers a daycare runs at once, in total
+// and for any one course or user. Requests beyond the limits wait in line,
+// and the line is served round-robin across courses: each course's first
+// waiting request comes before any course's second, and so on, so one busy
+// class cannot starve the others. Requests that do not carry a signed owner
+// share a single anonymous course and user.
+
+// runScheduler is the daycare's scheduler.
+var runScheduler = newScheduler()
+
+type scheduler struct {
+	sync.Mutex
+	running       int
+	courseRunning map[int64]int
+	userRunning   map[int64]int
+	waiting       []*schedulerWaiter
+}
+
+type schedulerWaiter struct {
+	userID   int64
+	courseID int64
+	arrived  time.Time
+	ready    chan struct{}
+	position func(int)
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		courseRunning: make(map[int64]int),
+		userRunning:   make(map[int64]int),
+	}
+}
+
+// acquire waits until a request may run, calling position with its place
+// in line whenever that changes. It returns a function to call when the
+// run is finished.
+func (s *scheduler) acquire(userID, courseID int64, position func(int)) func() {
+	w := &schedulerWaiter{
+		userID:   userID,
+		courseID: courseID,
+		arrived:  time.Now(),
+		ready:    make(chan struct{}),
+		position: position,
+	}
+	s.Lock()
+	s.waiting = append(s.waiting, w)
+	s.dispatch()
+	s.Unlock()
+	<-w.ready
+
+	return func() {
+		s.Lock()
+		s.running--
+		s.courseRunning[courseID]--
+		s.userRunning[userID]--
+		s.dispatch()
+		s.Unlock()
+	}
+}
+
+// eligible reports whether a waiting request fits within the limits.
+// The caller must hold the lock.
+func (s *scheduler) eligible(w *schedulerWaiter) bool {
+	if Config().DaycareMaxRunning > 0 && s.running >= Config().DaycareMaxRunning {
+		return false
+	}
+	if Config().CourseMaxRunning > 0 && s.courseRunning[w.courseID] >= Config().CourseMaxRunning {
+		return false
+	}
+	if Config().UserMaxRunning > 0 && s.userRunning[w.userID] >= Config().UserMaxRunning {
+		return false
+	}
+	return true
+}
+
+// order returns the waiting requests in the order they will be served.
+// The caller must hold the lock.
+func (s *scheduler) order() []*schedulerWaiter {
+	var rounds [][]*schedulerWaiter
+	rank := make(map[int64]int)
+	for _, w := range s.waiting {
+		r := rank[w.courseID]
+		rank[w.courseID]++
+		for len(rounds) <= r {
+			rounds = append(rounds, nil)
+		}
+		rounds[r] = append(rounds[r], w)
+	}
+	var line []*schedulerWaiter
+	for _, round := range rounds {
+		line = append(line, round...)
+	}
+	return line
+}
+
+// dispatch starts every waiting request that fits within the limits, then
+// tells the rest where they stand. The caller must hold the lock.
+func (s *scheduler) dispatch() {
+	var still []*schedulerWaiter
+	for _, w := range s.order() {
+		if s.eligible(w) {
+			s.running++
+			s.courseRunning[w.courseID]++
+			s.userRunning[w.userID]++
+			close(w.ready)
+			continue
+		}
+		still = append(still, w)
+	}
+	s.waiting = still
+	for n, w := range still {
+		w.position(n + 1)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+)
+
+// Encrypted submissions are sealed by grind to the daycares' public key, so
+// the TA only stores and forwards ciphertext. Clients only talk to the TA,
+// so the TA hands out the public key at /v2/daycare/key. A TA whose
+// daycares run on other hosts loads it from DaycarePublicKeyFile; a TA that
+// also runs the daycare role takes it from DaycareKeyFile.
+//
+// grind trusts the key the first time it sees one and pins its fingerprint
+// in .codegrinderrc, refusing any other key after that (trust on first
+// use). That protects against a key swapped later, but a TA that was
+// already compromised could hand out its own key on first use. Where that
+// matters, instructors should publish the fingerprint, which the server
+// logs at startup, and students should set daycareKey in .codegrinderrc to
+// it before their first encrypted submission.
+
+// daycareKey decrypts end-to-end encrypted submissions.
+// It is only loaded on daycares with a DaycareKeyFile configured.
+var daycareKey *rsa.PrivateKey
+
+// daycarePublicKey is the key the TA gives clients to encrypt submissions.
+var daycarePublicKey *rsa.PublicKey
+
+// loadDaycarePublicKey reads the PEM-encoded daycare public key for the
+// TA, e.g., one extracted from the daycare key with:
+//
+//	openssl rsa -in /etc/codegrinder/daycare.key -pubout -out /etc/codegrinder/daycare.pub
+func loadDaycarePublicKey(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error loading daycare public key: %v", err)
+	}
+	key, err := ParseDaycarePublicKey(string(raw))
+	if err != nil {
+		return fmt.Errorf("error parsing daycare public key file %s: %v", path, err)
+	}
+	fingerprint, err := KeyFingerprint(key)
+	if err != nil {
+		return err
+	}
+	daycarePublicKey = key
+	log.Printf("giving out daycare key %s for encrypted submissions", fingerprint)
+	return nil
+}
+
+// loadDaycareKey reads a PEM-encoded RSA private key in PKCS#1 or PKCS#8 form,
+// e.g., one generated by:
+//
+//	openssl genrsa -out /etc/codegrinder/daycare.key 3072
+//
+// Every daycare serving the same site must use the same key.
+func loadDaycareKey(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error loading daycare key: %v", err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return fmt.Errorf("no PEM data found in daycare key file %s", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		daycareKey = key
+	} else if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		return fmt.Errorf("error parsing daycare key file %s: %v", path, err)
+	} else if key, ok := parsed.(*rsa.PrivateKey); !ok {
+		return fmt.Errorf("daycare key file %s does not contain an RSA key", path)
+	} else {
+		daycareKey = key
+	}
+	fingerprint, err := KeyFingerprint(&daycareKey.PublicKey)
+	if err != nil {
+		return err
+	}
+	log.Printf("accepting encrypted submissions with key %s", fingerprint)
+
+	// a TA in the same process gives out the matching public key
+	if daycarePublicKey == nil {
+		daycarePublicKey = &daycareKey.PublicKey
+	} else if daycarePublicKey.N.Cmp(daycareKey.N) != 0 || daycarePublicKey.E != daycareKey.E {
+		return fmt.Errorf("DaycarePublicKeyFile does not match DaycareKeyFile")
+	}
+	return nil
+}
+
+// GetDaycareKey handles a request to /v2/daycare/key,
+// returning the public key clients use to encrypt submissions.
+func GetDaycareKey(w http.ResponseWriter, render render.Render) {
+	if daycarePublicKey == nil {
+		loggedHTTPErrorf(w, http.StatusNotFound, "this server does not accept encrypted submissions")
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey(daycarePublicKey)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error encoding daycare key: %v", err)
+		return
+	}
+	fingerprint, err := KeyFingerprint(daycarePublicKey)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error computing key fingerprint: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &DaycareKey{
+		PublicKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		Fingerprint: fingerprint,
+	})
+}
+
+// openCommit decrypts the sealed files of a commit and applies the same
+// whitelist the main server applies to plain files.
+func openCommit(problem *Problem, steps []*ProblemStep, commit *Commit) (map[string]string, error) {
+	if daycareKey == nil {
+		return nil, fmt.Errorf("this daycare does not accept encrypted submissions")
+	}
+	files, err := OpenSealedFiles(daycareKey, commit.Sealed)
+	if err != nil {
+		return nil, err
+	}
+	opened := &Commit{Files: files}
+	opened.FilterIncoming(problem.GetStepWhitelists(steps)[commit.Step-1])
+	if len(opened.Files) == 0 {
+		return nil, fmt.Errorf("commit must have at least one file")
+	}
+	return opened.Files, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+)
+
+// A problem with the "seeded" option gets a random seed for each student's
+// assignment in the CODEGRINDER_SEED environment variable of its grading
+// container, so test harnesses can generate different inputs for each
+// student. The seed is derived from the assignment ID and the daycare
+// secret, so every grading of the same assignment sees the same seed and
+// regrades give the same score. Reference solution checks, which have no
+// assignment, always see the seed for assignment 0.
+
+// SeededOption is the problem option that turns on per-student seeds.
+const SeededOption = "seeded"
+
+// SeedVariable is the environment variable that holds the seed.
+const SeedVariable = "CODEGRINDER_SEED"
+
+// assignmentSeed returns the seed for an assignment as a decimal string.
+func assignmentSeed(assignmentID int64) string {
+	mac := hmac.New(sha256.New, []byte(Config().DaycareSecret))
+	mac.Write([]byte("seed:" + strconv.FormatInt(assignmentID, 10)))
+	return strconv.FormatUint(binary.BigEndian.Uint64(mac.Sum(nil)), 10)
+}
+
+// seedEnv returns the environment for a grading container.
+func seedEnv(options []string, assignmentID int64) []string {
+	for _, option := range options {
+		if option == SeededOption {
+			return []string{SeedVariable + "=" + assignmentSeed(assignmentID)}
+		}
+	}
+	return nil
+}
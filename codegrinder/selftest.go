@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/russross/codegrinder/setup"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// The selftest command checks a deployment from end to end, e.g., after an
+// upgrade. It starts a private TA and daycare on a loopback port, creates a
+// temporary database on the configured Postgres server, and fills it with a
+// throwaway course, student, and problem of the selftest type. Then it acts
+// as a client: it signs in with an API token, fetches the assignment and
+// problem, saves a commit, has it graded, and records the graded commit,
+// checking each reply along the way. The temporary database is dropped at
+// the end unless --keep is given, so the configured user needs permission
+// to create databases. The deployment's own database is never touched.
+//
+// The selftest problem type exists only while the test runs. It is not in
+// the schema, so it is added to the temporary database's problem_types.
+
+// selftestMessage is what the selftest problem expects the student to echo.
+const selftestMessage = "hello from the codegrinder selftest\n"
+
+// selftestProblemType describes the selftest problem type.
+func selftestProblemType() *ProblemType {
+	return &ProblemType{
+		Name:        "selftest",
+		Image:       "codegrinder/python2",
+		MaxCPU:      10,
+		MaxFD:       10,
+		MaxFileSize: 10,
+		MaxMemory:   32,
+		MaxThreads:  20,
+		Actions: map[string]*ProblemTypeAction{
+			"grade": &ProblemTypeAction{
+				Action:  "grade",
+				Button:  "Grade",
+				Message: "Grading‥",
+				Class:   "btn-grade",
+				Handler: nannyHandler(selftestGrade),
+			},
+			"": &ProblemTypeAction{
+				Action: "",
+				Button: "Save",
+				Class:  "btn-save",
+			},
+		},
+	}
+}
+
+// selftestGrade checks that echo.txt, echoed by the container, matches
+// tests/expected.txt.
+func selftestGrade(n *Nanny, args []string, options []string, files map[string]string) {
+	log.Printf("selftestGrade")
+
+	if err := n.PutFiles(files); err != nil {
+		n.ReportCard.LogAndFailf("PutFiles error: %v", err)
+		return
+	}
+	stdout, stderr, _, status, err := n.ExecNonInteractive([]string{"cat", "echo.txt"})
+	if err != nil {
+		n.ReportCard.LogAndFailf("exec error: %v", err)
+		return
+	}
+	switch {
+	case status != 0:
+		n.ReportCard.AddFailedResult("echo", "<h1>cat failed</h1>\n"+htmlEscapePre(stderr.String()), "echo.txt")
+	case stdout.String() != files["tests/expected.txt"]:
+		n.ReportCard.AddFailedResult("echo", "<h1>Output did not match</h1>\n"+htmlEscapePre(stdout.String()), "echo.txt")
+	default:
+		n.ReportCard.AddPassedResult("echo", htmlEscapePara("output matched"))
+	}
+	n.ReportCard.Duration = time.Since(n.Start)
+}
+
+// selftest holds the state of a selftest run.
+type selftest struct {
+	db      *sql.DB
+	baseURL string
+	token   string
+
+	user       *User
+	course     *Course
+	problem    *Problem
+	problemSet *ProblemSet
+	assignment *Assignment
+}
+
+// runSelftest handles the selftest subcommand, returning the exit status.
+func runSelftest(args []string) int {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	keep := flags.Bool("keep", false, "Keep the temporary database instead of dropping it")
+	flags.Parse(args)
+
+	if Config().DaycareSecret == "" {
+		log.Fatalf("cannot run the selftest with no DaycareSecret in the config file")
+	}
+	if err := connectDocker(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// create a temporary database alongside the configured one
+	admin := setupDB(Config().PostgresHost, Config().PostgresPort, Config().PostgresUsername, Config().PostgresPassword, Config().PostgresDatabase)
+	defer admin.Close()
+	name := fmt.Sprintf("codegrinder_selftest_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE DATABASE ` + name); err != nil {
+		fmt.Printf("FAIL create test database: %v\n", err)
+		fmt.Println("selftest failed")
+		return 1
+	}
+	db := setupDB(Config().PostgresHost, Config().PostgresPort, Config().PostgresUsername, Config().PostgresPassword, name)
+
+	// serve both roles on a private port, grading locally even if the
+	// deployment normally uses a work queue
+	problemTypes["selftest"] = selftestProblemType()
+	m, r, _ := newMartini()
+	setupTARoutes(r, db, false)
+	setupDaycareRoutes(r, false, db)
+	server := httptest.NewServer(m)
+
+	t := &selftest{db: db, baseURL: server.URL}
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"create test database", t.schema},
+		{"create test records", t.setup},
+		{"init", t.init},
+		{"get", t.get},
+		{"save", t.save},
+		{"grade", t.grade},
+	}
+	failed := false
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			fmt.Printf("FAIL %s: %v\n", step.name, err)
+			failed = true
+			break
+		}
+		fmt.Printf("ok   %s\n", step.name)
+	}
+
+	// shut down and drop the database, which must have no connections
+	server.Close()
+	db.Close()
+	delete(problemTypes, "selftest")
+	if *keep {
+		fmt.Printf("kept test database %s\n", name)
+	} else if _, err := admin.Exec(`DROP DATABASE ` + name); err != nil {
+		fmt.Printf("FAIL drop test database %s: %v\n", name, err)
+		failed = true
+	}
+
+	if failed {
+		fmt.Println("selftest failed")
+		return 1
+	}
+	fmt.Println("selftest passed")
+	return 0
+}
+
+// schema creates the schema in the temporary database and adds the
+// selftest problem type to it.
+func (t *selftest) schema() error {
+	if _, err := t.db.Exec(setup.Schema); err != nil {
+		return fmt.Errorf("creating the schema: %v", err)
+	}
+	if _, err := t.db.Exec(`ALTER TYPE problem_types ADD VALUE 'selftest'`); err != nil {
+		return fmt.Errorf("adding the selftest problem type: %v", err)
+	}
+	return nil
+}
+
+// setup creates a course, student, problem, and assignment for the test,
+// plus an API token for the student.
+func (t *selftest) setup() error {
+	now := time.Now()
+	unique := fmt.Sprintf("selftest-%d", now.UnixNano())
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	t.course = &Course{
+		Name:      "CodeGrinder selftest",
+		Label:     unique,
+		LtiID:     unique,
+		CanvasID:  -now.UnixNano(),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := meddler.Insert(tx, "courses", t.course); err != nil {
+		return fmt.Errorf("creating course: %v", err)
+	}
+	t.user = &User{
+		Name:           "Selftest Student",
+		Email:          unique + "@selftest.invalid",
+		LtiID:          unique,
+		CanvasLogin:    unique,
+		CanvasID:       -now.UnixNano(),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		LastSignedInAt: now,
+	}
+	if err := meddler.Insert(tx, "users", t.user); err != nil {
+		return fmt.Errorf("creating user: %v", err)
+	}
+	t.problem = &Problem{
+		Unique:      unique,
+		Note:        "CodeGrinder selftest problem",
+		ProblemType: "selftest",
+		Tags:        []string{},
+		Options:     []string{},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := meddler.Insert(tx, "problems", t.problem); err != nil {
+		return fmt.Errorf("creating problem: %v", err)
+	}
+	step := &ProblemStep{
+		ProblemID:    t.problem.ID,
+		Step:         1,
+		Note:         "echo",
+		Instructions: "<p>Put the expected message in echo.txt.</p>",
+		Weight:       1.0,
+		Files: map[string]string{
+			"echo.txt":           "",
+			"tests/expected.txt": selftestMessage,
+		},
+	}
+	if err := meddler.Insert(tx, "problem_steps", step); err != nil {
+		return fmt.Errorf("creating problem step: %v", err)
+	}
+	t.problemSet = &ProblemSet{
+		Unique:    unique,
+		Note:      "CodeGrinder selftest problem set",
+		Tags:      []string{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := meddler.Insert(tx, "problem_sets", t.problemSet); err != nil {
+		return fmt.Errorf("creating problem set: %v", err)
+	}
+	psp := &ProblemSetProblem{ProblemSetID: t.problemSet.ID, ProblemID: t.problem.ID, Weight: 1.0}
+	if err := meddler.Insert(tx, "problem_set_problems", psp); err != nil {
+		return fmt.Errorf("adding problem to problem set: %v", err)
+	}
+	t.assignment = &Assignment{
+		CourseID:     t.course.ID,
+		ProblemSetID: t.problemSet.ID,
+		UserID:       t.user.ID,
+		Roles:        "Learner",
+		RawScores:    map[string][]float64{},
+		LtiID:        unique,
+		CanvasTitle:  "CodeGrinder selftest",
+		CanvasID:     -now.UnixNano(),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := meddler.Insert(tx, "assignments", t.assignment); err != nil {
+		return fmt.Errorf("creating assignment: %v", err)
+	}
+
+	secret, err := newTokenSecret()
+	if err != nil {
+		return fmt.Errorf("generating API token: %v", err)
+	}
+	token := &APIToken{
+		UserID:    t.user.ID,
+		Name:      "selftest",
+		Scope:     TokenScopeStudent,
+		TokenHash: hashToken(secret),
+		CreatedAt: now,
+	}
+	if err := meddler.Insert(tx, "api_tokens", token); err != nil {
+		return fmt.Errorf("creating API token: %v", err)
+	}
+	t.token = secret
+
+	return tx.Commit()
+}
+
+// init signs in with the API token, as grind init does.
+func (t *selftest) init() error {
+	user := new(User)
+	if err := t.request("GET", "/v2/users/me", nil, user); err != nil {
+		return err
+	}
+	if user.ID != t.user.ID {
+		return fmt.Errorf("signed in as user %d, expected %d", user.ID, t.user.ID)
+	}
+	return nil
+}
+
+// get fetches the assignment and problem, as grind get does.
+func (t *selftest) get() error {
+	assignments := []*Assignment{}
+	if err := t.request("GET", fmt.Sprintf("/v2/users/%d/assignments", t.user.ID), nil, &assignments); err != nil {
+		return err
+	}
+	if len(assignments) != 1 || assignments[0].ID != t.assignment.ID {
+		return fmt.Errorf("expected assignment %d in the list of assignments", t.assignment.ID)
+	}
+	problems := []*ProblemSetProblem{}
+	if err := t.request("GET", fmt.Sprintf("/v2/problem_sets/%d/problems", t.problemSet.ID), nil, &problems); err != nil {
+		return err
+	}
+	if len(problems) != 1 || problems[0].ProblemID != t.problem.ID {
+		return fmt.Errorf("expected problem %d in the problem set", t.problem.ID)
+	}
+	step := new(ProblemStep)
+	if err := t.request("GET", fmt.Sprintf("/v2/problems/%d/steps/1", t.problem.ID), nil, step); err != nil {
+		return err
+	}
+	if _, ok := step.Files["echo.txt"]; !ok {
+		return fmt.Errorf("problem step is missing its starter file")
+	}
+	return nil
+}
+
+// save saves the student's work without grading it, as grind save does.
+func (t *selftest) save() error {
+	signed := new(CommitBundle)
+	if err := t.request("POST", "/v2/commit_bundles/unsigned", &CommitBundle{Commit: t.commit("")}, signed); err != nil {
+		return err
+	}
+	if signed.Commit == nil || signed.Commit.ID == 0 {
+		return fmt.Errorf("server did not save the commit")
+	}
+	return nil
+}
+
+// grade has the daycare grade the student's work and records the result,
+// as grind grade does.
+func (t *selftest) grade() error {
+	signed := new(CommitBundle)
+	if err := t.request("POST", "/v2/commit_bundles/unsigned", &CommitBundle{Commit: t.commit("grade")}, signed); err != nil {
+		return err
+	}
+	if signed.Held != "" {
+		return fmt.Errorf("the commit was not signed for grading: %s", signed.Held)
+	}
+
+	// send it to the daycare
+	url := "ws" + strings.TrimPrefix(t.baseURL, "http") + "/v2/sockets/" + signed.Problem.ProblemType + "/" + signed.Commit.Action
+	socket, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return fmt.Errorf("error dialing %s: %v", url, err)
+	}
+	defer socket.Close()
+	socket.SetReadDeadline(time.Now().Add(SolutionCheckTimeout))
+	if err := socket.WriteJSON(&DaycareRequest{UserID: t.user.ID, CommitBundle: signed}); err != nil {
+		return fmt.Errorf("error writing request message: %v", err)
+	}
+	var graded *CommitBundle
+	for graded == nil {
+		reply := new(DaycareResponse)
+		if err := socket.ReadJSON(reply); err != nil {
+			return fmt.Errorf("socket error reading event: %v", err)
+		}
+		if reply.Error != "" {
+			return fmt.Errorf("daycare returned an error: %s", reply.Error)
+		}
+		graded = reply.CommitBundle
+	}
+
+	// record the graded commit
+	saved := new(CommitBundle)
+	if err := t.request("POST", "/v2/commit_bundles/signed", graded, saved); err != nil {
+		return err
+	}
+	if saved.Held != "" {
+		return fmt.Errorf("the graded commit was not recorded: %s", saved.Held)
+	}
+	card := saved.Commit.ReportCard
+	if card == nil {
+		return fmt.Errorf("graded commit has no report card")
+	}
+	if !card.Passed {
+		return fmt.Errorf("report card did not pass: %s", card.Note)
+	}
+
+	// the score should be on the assignment
+	assignment := new(Assignment)
+	if err := t.request("GET", fmt.Sprintf("/v2/assignments/%d", t.assignment.ID), nil, assignment); err != nil {
+		return err
+	}
+	if assignment.Score != 1.0 {
+		return fmt.Errorf("assignment score is %v, expected 1", assignment.Score)
+	}
+	return nil
+}
+
+// commit builds the student's commit for an action.
+func (t *selftest) commit(action string) *Commit {
+	return &Commit{
+		AssignmentID: t.assignment.ID,
+		ProblemID:    t.problem.ID,
+		Step:         1,
+		Action:       action,
+		Files:        map[string]string{"echo.txt": selftestMessage},
+	}
+}
+
+// request sends a JSON request to the private server as the test student
+// and decodes the reply into out, if given.
+func (t *selftest) request(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, t.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg := new(bytes.Buffer)
+		msg.ReadFrom(resp.Body)
+		return fmt.Errorf("%s %s: unexpected status %s: %s", method, path, resp.Status, strings.TrimSpace(msg.String()))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("%s %s: decoding reply: %v", method, path, err)
+		}
+	}
+	return nil
+}
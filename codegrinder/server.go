@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"database/sql"
 	"encoding/base64"
@@ -9,7 +10,6 @@ import (
 	"flag"
 	"fmt"
 	"html"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -17,6 +17,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
@@ -31,15 +32,17 @@ import (
 	"rsc.io/letsencrypt"
 )
 
-// Config holds site-specific configuration data.
+// ServerConfig holds site-specific configuration data.
 // Contains a mix of Daycare and main server parameters.
-var Config struct {
-	Hostname         string // Hostname for the site: "your.host.goes.here"
-	LetsEncryptEmail string // Email address to register TLS certificates: "foo@bar.com"
-	LTISecret        string // LTI authentication shared secret. Must match that given to Canvas course: "asdf..."
-	SessionSecret    string // Random string used to sign cookie sessions: "asdf..."
-	DaycareSecret    string // Random string used to sign daycare requests: "asdf..."
-	StaticDir        string // Full path of directory holding static files to serve: "/home/foo/codegrinder/client"
+type ServerConfig struct {
+	Hostname             string // Hostname for the site: "your.host.goes.here"
+	LetsEncryptEmail     string // Email address to register TLS certificates: "foo@bar.com"
+	LTISecret            string // LTI authentication shared secret. Must match that given to Canvas course: "asdf..."
+	SessionSecret        string // Random string used to sign cookie sessions: "asdf..."
+	DaycareSecret        string // Random string used to sign daycare requests: "asdf..."
+	DaycareKeyFile       string // PEM RSA private key for end-to-end encrypted submissions, blank to disable: "/etc/codegrinder/daycare.key"
+	DaycarePublicKeyFile string // PEM RSA public key the TA gives clients for encrypted submissions when its daycares run elsewhere: "/etc/codegrinder/daycare.pub"
+	StaticDir            string // Full path of directory holding static files to serve: "/home/foo/codegrinder/client"
 
 	ToolName         string // LTI human readable name: "CodeGrinder"
 	ToolID           string // LTI unique ID: "codegrinder"
@@ -50,6 +53,70 @@ var Config struct {
 	PostgresUsername string // Username parameter for Postgres: "codegrinder"
 	PostgresPassword string // Password parameter for Postgres: "super$trong"
 	PostgresDatabase string // Database parameter for Postgres: "codegrinder"
+
+	DaycareHosts []string // Hosts running the daycare role, asked to pre-pull images for new problems: ["daycare1.your.host.goes.here"]
+
+	WorkQueue     bool   // Queue grading requests on the TA server for daycare workers to pull: true
+	WorkQueueHost string // TA server that daycare workers pull jobs from, blank for Hostname: "your.host.goes.here"
+	WorkerSlots   int    // Jobs a daycare worker runs at once: 4
+
+	FirewallImage string // Image with iptables that enforces the none and allowlist network policies, blank to allow only localhost: "codegrinder/firewall"
+
+	DaycareMaxRunning  int // Containers a daycare runs at once, 0 for no limit: 8
+	CourseMaxRunning   int // Containers a daycare runs at once for any one course, 0 for no limit: 4
+	UserMaxRunning     int // Containers a daycare runs at once for any one user, 0 for no limit: 1
+	SessionIdleMinutes int // Minutes a client may go without answering heartbeats before its container is killed: 2
+	GradingCapacity    int // Containers available across all daycares for capacity planning, 0 to estimate from other settings: 32
+
+	GradeRateLimitPerMinute int // Max grading requests per user per minute, 0 for no limit: 5
+	GradeDailyQuota         int // Max grading requests per user per assignment per day, 0 for no limit: 200
+
+	SMTPServer         string // SMTP relay for outgoing messages, blank to only log them: "smtp.example.com:587"
+	SMTPUsername       string // SMTP username, blank for no authentication: "codegrinder"
+	SMTPPassword       string // SMTP password: "super$trong"
+	MailFrom           string // Sender address for outgoing messages: "codegrinder@your.host.goes.here"
+	NudgeCooldownHours int    // Hours before the same student can be nudged again about an assignment: 48
+	NudgeSubject       string // Template for nudge subject lines: "Reminder: {{.Assignment.CanvasTitle}}"
+	NudgeTemplate      string // Template for nudge message bodies: "Hi {{.User.Name}}, ..."
+
+	ImpersonationMinutes int // How long an administrator may impersonate a user before it expires: 30
+	OpenCommitMinutes    int // How long saved work waits to be graded before it is abandoned: 360
+	SignedCommitMinutes  int // How long a signed commit may take to come back from the daycare: 15
+
+	TranscriptEventCountLimit int // Max events kept in a commit transcript: 500
+	TranscriptDataLimit       int // Max bytes of stdin/stdout/stderr kept in a commit transcript: 100000
+	TranscriptRetentionDays   int // Days before transcripts of superseded commits are discarded, 0 to keep forever: 180
+
+	RevealHiddenTests bool // Show hidden test results to students before assignments are due: false
+
+	ScanCommand string // Malware scanner run on each submitted file (by daycares for encrypted ones), exiting 1 if it is infected, blank to disable: "clamdscan --no-summary"
+
+	GradeHookScriptDir string // Directory of scripts that course grade hooks may run, blank to allow only URL hooks: "/etc/codegrinder/grade-hooks"
+
+	ProfileIntervalMinutes int // Minutes between background CPU and heap profiles, 0 to disable: 15
+	ProfileSeconds         int // Length of each background CPU profile in seconds: 10
+	ProfileRetentionDays   int // Days before background profiles are discarded, 0 to keep forever: 14
+}
+
+// currentConfig holds the current configuration. Some settings are reloaded
+// from the config file on SIGHUP while requests are running, so the
+// configuration is replaced rather than modified, and the replacement is
+// stored atomically.
+var currentConfig atomic.Value
+
+func init() {
+	setConfig(defaultConfig())
+}
+
+// Config returns the current configuration, which must not be modified.
+func Config() *ServerConfig {
+	return currentConfig.Load().(*ServerConfig)
+}
+
+// setConfig makes a configuration current.
+func setConfig(config *ServerConfig) {
+	currentConfig.Store(config)
+	SetTranscriptLimits(config.TranscriptEventCountLimit, config.TranscriptDataLimit)
 }
 
 var problemTypes = make(map[string]*ProblemType)
@@ -61,46 +128,56 @@ func main() {
 	var ta, daycare bool
 	flag.BoolVar(&ta, "ta", true, "Serve the TA role")
 	flag.BoolVar(&daycare, "daycare", true, "Serve the daycare role")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [fsck [--fix] | manifest [compose|k8s] | healthcheck | selftest [--keep] | migrate [--status] [--baseline version]]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Config settings can also be given as environment variables, e.g., %sPOSTGRES_HOST\n", EnvPrefix)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if !ta && !daycare {
 		log.Fatalf("must run at least one role (ta/daycare)")
 	}
 
-	// set config defaults
-	Config.ToolName = "CodeGrinder"
-	Config.ToolID = "codegrinder"
-	Config.ToolDescription = "Programming exercises with grading"
-	Config.LetsEncryptCache = "/etc/codegrinder/letsencrypt.cache"
-	Config.PostgresHost = "/var/run/postgresql"
-	Config.PostgresPort = ""
-	Config.PostgresUsername = os.Getenv("USER")
-	Config.PostgresPassword = ""
-	Config.PostgresDatabase = os.Getenv("USER")
-
-	// load config file
-	if raw, err := ioutil.ReadFile(configFile); err != nil {
-		log.Fatalf("failed to load config file %q: %v", configFile, err)
-	} else if err := json.Unmarshal(raw, &Config); err != nil {
-		log.Fatalf("failed to parse config file: %v", err)
+	// load config file, then apply overrides from the environment
+	// the file is optional if the environment has settings, as in a container
+	command := flag.Arg(0)
+	optional := envConfigured() || command == "manifest" || command == "healthcheck"
+	config, err := loadConfig(configFile, optional)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	setConfig(config)
+
+	// run a maintenance command instead of the server?
+	switch command {
+	case "":
+	case "fsck":
+		if runFsck(flag.Args()[1:]) > 0 {
+			os.Exit(1)
+		}
+		return
+	case "manifest":
+		if status := runManifest(flag.Args()[1:]); status != 0 {
+			os.Exit(status)
+		}
+		return
+	case "healthcheck":
+		os.Exit(runHealthcheck())
+	case "selftest":
+		os.Exit(runSelftest(flag.Args()[1:]))
+	case "migrate":
+		os.Exit(runMigrate(flag.Args()[1:]))
+	default:
+		flag.Usage()
+		os.Exit(2)
 	}
-	Config.SessionSecret = unBase64(Config.SessionSecret)
-	Config.DaycareSecret = unBase64(Config.DaycareSecret)
-
-	// set up martini
-	r := martini.NewRouter()
-	m := martini.New()
-	m.Logger(log.New(os.Stderr, "", log.LstdFlags))
-	m.Use(martini.Logger())
-	m.Use(martini.Recovery())
-	m.Use(martini.Static(Config.StaticDir, martini.StaticOptions{SkipLogging: true}))
-	m.MapTo(r, (*martini.Routes)(nil))
-	m.Action(r.Handle)
 
-	m.Use(render.Renderer(render.Options{IndentJSON: true}))
+	// pick up changes to the settings that can change while running
+	startConfigReload(configFile, optional)
 
-	store := sessions.NewCookieStore([]byte(Config.SessionSecret))
-	m.Use(sessions.Sessions(CookieName, store))
+	// set up martini
+	m, r, store := newMartini()
 
 	// sessions expire June 30 and December 31
 	go func() {
@@ -125,195 +202,88 @@ func main() {
 	}()
 
 	// set up TA role
+	var db *sql.DB
 	if ta {
 		// make sure relevant secrets are included in config file
-		if Config.LTISecret == "" {
+		if Config().LTISecret == "" {
 			log.Fatalf("cannot run TA role with no LTISecret in the config file")
 		}
-		if Config.SessionSecret == "" {
+		if Config().SessionSecret == "" {
 			log.Fatalf("cannot run TA role with no SessionSecret in the config file")
 		}
-		if Config.DaycareSecret == "" {
+		if Config().DaycareSecret == "" {
 			log.Fatalf("cannot run with no DaycareSecret in the config file")
 		}
 
-		// set up the database
-		db := setupDB(Config.PostgresHost, Config.PostgresPort, Config.PostgresUsername, Config.PostgresPassword, Config.PostgresDatabase)
-
-		// martini service: wrap handler in a transaction
-		withTx := func(c martini.Context, w http.ResponseWriter) {
-			// start a transaction
-			tx, err := db.Begin()
-			if err != nil {
-				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error starting transaction: %v", err)
-				return
-			}
-
-			// pass it on to the main handler
-			c.Map(tx)
-			c.Next()
-
-			// was it a successful result?
-			rw := w.(martini.ResponseWriter)
-			if rw.Status() < http.StatusBadRequest {
-				// commit the transaction
-				if err := tx.Commit(); err != nil {
-					loggedHTTPErrorf(w, http.StatusInternalServerError, "db error committing transaction: %v", err)
-					return
-				}
-			} else {
-				// rollback
-				log.Printf("rolling back transaction")
-				if err := tx.Rollback(); err != nil {
-					loggedHTTPErrorf(w, http.StatusInternalServerError, "db error rolling back transaction: %v", err)
-					return
-				}
-			}
-		}
-
-		// martini service: to require an active logged-in session
-		auth := func(w http.ResponseWriter, session sessions.Session) {
-			if userID := session.Get("id"); userID == nil {
-				loggedHTTPErrorf(w, http.StatusUnauthorized, "authentication: no user ID found in session")
-				return
+		// the public key for encrypted submissions, if the daycares are elsewhere
+		if Config().DaycarePublicKeyFile != "" {
+			if err := loadDaycarePublicKey(Config().DaycarePublicKeyFile); err != nil {
+				log.Fatalf("%v", err)
 			}
 		}
 
-		// martini service: include the current logged-in user (requires withTx and auth)
-		withCurrentUser := func(c martini.Context, w http.ResponseWriter, tx *sql.Tx, session sessions.Session) {
-			rawID := session.Get("id")
-			if rawID == nil {
-				loggedHTTPErrorf(w, http.StatusInternalServerError, "cannot find user ID in session")
-				return
-			}
-			userID, ok := rawID.(int64)
-			if !ok {
-				session.Clear()
-				loggedHTTPErrorf(w, http.StatusInternalServerError, "error extracting user ID from session")
-				return
-			}
-
-			// load the user record
-			user := new(User)
-			if err := meddler.Load(tx, "users", user, userID); err != nil {
-				if err == sql.ErrNoRows {
-					loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d not found", userID)
-					return
-				}
-				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
-				return
-			}
-
-			// map the current user to the request context
-			c.Map(user)
+		// set up the database
+		db = setupDB(Config().PostgresHost, Config().PostgresPort, Config().PostgresUsername, Config().PostgresPassword, Config().PostgresDatabase)
+		if err := checkSchemaVersion(db); err != nil {
+			log.Fatalf("%v", err)
 		}
-
-		// martini service: require logged in user to be an administrator (requires withCurrentUser)
-		administratorOnly := func(w http.ResponseWriter, currentUser *User) {
-			if !currentUser.Admin {
-				loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an administrator", currentUser.ID, currentUser.Email)
-				return
-			}
+		startTranscriptMaintenance(db)
+		startSolutionMaintenance(db)
+		if Config().WorkQueue {
+			startSmokeTests(db)
 		}
-
-		// martini service: require logged in user to be an author or administrator (requires withCurrentUser)
-		authorOnly := func(w http.ResponseWriter, tx *sql.Tx, currentUser *User) {
-			if currentUser.Admin {
-				return
-			}
-			if !currentUser.Author {
-				loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an author", currentUser.ID, currentUser.Name)
-				return
-			}
-		}
-
-		// version
-		r.Get("/v2/version", func(w http.ResponseWriter, render render.Render) {
-			render.JSON(http.StatusOK, &CurrentVersion)
-		})
-
-		// LTI
-		r.Get("/v2/lti/config.xml", GetConfigXML)
-		r.Post("/v2/lti/problem_sets", binding.Bind(LTIRequest{}), checkOAuthSignature, withTx, LtiProblemSets)
-		r.Post("/v2/lti/problem_sets/:unique", binding.Bind(LTIRequest{}), checkOAuthSignature, withTx, LtiProblemSet)
-
-		// problem bundles--for problem creation only
-		r.Post("/v2/problem_bundles/unconfirmed", auth, withTx, withCurrentUser, authorOnly, binding.Json(ProblemBundle{}), PostProblemBundleUnconfirmed)
-		r.Post("/v2/problem_bundles/confirmed", auth, withTx, withCurrentUser, authorOnly, binding.Json(ProblemBundle{}), PostProblemBundleConfirmed)
-		r.Put("/v2/problem_bundles/:problem_id", auth, withTx, withCurrentUser, authorOnly, binding.Json(ProblemBundle{}), PutProblemBundle)
-
-		// problem set bundles--for problem set creation only
-		r.Post("/v2/problem_set_bundles", auth, withTx, withCurrentUser, authorOnly, binding.Json(ProblemSetBundle{}), PostProblemSetBundle)
-
-		// problem types
-		r.Get("/v2/problem_types", auth, GetProblemTypes)
-		r.Get("/v2/problem_types/:name", auth, GetProblemType)
-
-		// problems
-		r.Get("/v2/problems", auth, withTx, withCurrentUser, GetProblems)
-		r.Get("/v2/problems/:problem_id", auth, withTx, withCurrentUser, GetProblem)
-		r.Get("/v2/problems/:problem_id/steps", auth, withTx, withCurrentUser, GetProblemSteps)
-		r.Get("/v2/problems/:problem_id/steps/:step", auth, withTx, withCurrentUser, GetProblemStep)
-		r.Delete("/v2/problems/:problem_id", auth, withTx, withCurrentUser, administratorOnly, DeleteProblem)
-
-		// problem sets
-		r.Get("/v2/problem_sets", auth, withTx, withCurrentUser, GetProblemSets)
-		r.Get("/v2/problem_sets/:problem_set_id", auth, withTx, withCurrentUser, GetProblemSet)
-		r.Get("/v2/problem_sets/:problem_set_id/problems", auth, withTx, withCurrentUser, GetProblemSetProblems)
-		r.Delete("/v2/problem_sets/:problem_set_id", auth, withTx, withCurrentUser, administratorOnly, DeleteProblemSet)
-
-		// courses
-		r.Get("/v2/courses", auth, withTx, withCurrentUser, GetCourses)
-		r.Get("/v2/courses/:course_id", auth, withTx, withCurrentUser, GetCourse)
-		r.Delete("/v2/courses/:course_id", auth, withTx, withCurrentUser, administratorOnly, DeleteCourse)
-
-		// users
-		r.Get("/v2/users", auth, withTx, withCurrentUser, GetUsers)
-		r.Get("/v2/users/me", auth, withTx, withCurrentUser, GetUserMe)
-		r.Get("/v2/users/me/cookie", auth, GetUserMeCookie)
-		r.Get("/v2/users/:user_id", auth, withTx, withCurrentUser, GetUser)
-		r.Get("/v2/courses/:course_id/users", auth, withTx, withCurrentUser, GetCourseUsers)
-		r.Delete("/v2/users/:user_id", auth, withTx, withCurrentUser, administratorOnly, DeleteUser)
-
-		// assignments
-		r.Get("/v2/users/:user_id/assignments", auth, withTx, withCurrentUser, GetUserAssignments)
-		r.Get("/v2/courses/:course_id/users/:user_id/assignments", auth, withTx, withCurrentUser, GetCourseUserAssignments)
-		r.Get("/v2/assignments/:assignment_id", auth, withTx, withCurrentUser, GetAssignment)
-		r.Delete("/v2/assignments/:assignment_id", auth, withTx, withCurrentUser, administratorOnly, DeleteAssignment)
-
-		// commits
-		r.Get("/v2/assignments/:assignment_id/problems/:problem_id/commits/last", auth, withTx, withCurrentUser, GetAssignmentProblemCommitLast)
-		r.Get("/v2/assignments/:assignment_id/problems/:problem_id/steps/:step/commits/last", auth, withTx, withCurrentUser, GetAssignmentProblemStepCommitLast)
-		r.Delete("/v2/commits/:commit_id", auth, withTx, withCurrentUser, administratorOnly, DeleteCommit)
-
-		// commit bundles
-		r.Post("/v2/commit_bundles/unsigned", auth, withTx, withCurrentUser, binding.Json(CommitBundle{}), PostCommitBundlesUnsigned)
-		r.Post("/v2/commit_bundles/signed", auth, withTx, withCurrentUser, binding.Json(CommitBundle{}), PostCommitBundlesSigned)
+		startScanner(db)
+		startProfiling(db)
+		startNotificationDelivery(db)
+		startCourseWebhooks(db)
+		startCourseGradeHooks(db)
+		startPurgeDeleted(db)
+		startGradeRequestSweep(db)
+		resumeRegrades(db)
+		addReadinessCheck("database", db.Ping)
+
+		setupTARoutes(r, db, Config().WorkQueue)
 	}
 
 	// set up daycare role
 	if daycare {
 		// make sure relevant secrets are included in config file
-		if Config.DaycareSecret == "" {
+		if Config().DaycareSecret == "" {
 			log.Fatalf("cannot run with no DaycareSecret in the config file")
 		}
 
 		// attach to docker and try a ping
-		var err error
-		dockerClient, err = docker.NewVersionedClient("unix:///var/run/docker.sock", "1.18")
-		if err != nil {
-			log.Fatalf("NewVersionedClient: %v", err)
+		if err := connectDocker(); err != nil {
+			log.Fatalf("%v", err)
+		}
+		addReadinessCheck("docker", dockerClient.Ping)
+
+		// clean up after an earlier run that did not shut down cleanly
+		if err := removeOrphanedContainers(); err != nil {
+			log.Fatalf("error removing orphaned containers: %v", err)
 		}
-		if err = dockerClient.Ping(); err != nil {
-			log.Fatalf("Ping: %v", err)
+
+		// load the key for encrypted submissions
+		if Config().DaycareKeyFile != "" {
+			if err := loadDaycareKey(Config().DaycareKeyFile); err != nil {
+				log.Fatalf("%v", err)
+			}
 		}
 
-		r.Get("/v2/sockets/:problem_type/:action", SocketProblemTypeAction)
+		if Config().WorkQueue {
+			startQueueWorker()
+		}
+		setupDaycareRoutes(r, Config().WorkQueue, db)
 	}
 
 	// start redirecting http calls to https
 	log.Printf("starting http -> https forwarder")
 	go http.ListenAndServe(":http", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// health probes are answered directly for any host name
+		if serveHealth(w, r) {
+			return
+		}
+
 		// get the address of the client
 		addr := r.Header.Get("X-Real-IP")
 		if addr == "" {
@@ -324,26 +294,26 @@ func main() {
 		}
 
 		// make sure the request is for the right host name
-		if Config.Hostname != r.Host {
+		if Config().Hostname != r.Host {
 			loggedHTTPErrorf(w, http.StatusNotFound, "http request to invalid host: %s", r.Host)
 			return
 		}
 		var u url.URL = *r.URL
 		u.Scheme = "https"
-		u.Host = Config.Hostname
+		u.Host = Config().Hostname
 		log.Printf("redirecting http request from %s to %s", addr, u.String())
 		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
 	}))
 
 	// set up letsencrypt
 	lem := letsencrypt.Manager{}
-	if err := lem.CacheFile(Config.LetsEncryptCache); err != nil {
+	if err := lem.CacheFile(Config().LetsEncryptCache); err != nil {
 		log.Fatalf("Setting up LetsEncrypt: %v", err)
 	}
-	lem.SetHosts([]string{Config.Hostname})
+	lem.SetHosts([]string{Config().Hostname})
 	if !lem.Registered() {
 		log.Printf("registering with letsencrypt")
-		if err := lem.Register(Config.LetsEncryptEmail, nil); err != nil {
+		if err := lem.Register(Config().LetsEncryptEmail, nil); err != nil {
 			log.Fatalf("Registering with LetsEncrypt: %v", err)
 		}
 	}
@@ -363,6 +333,457 @@ func main() {
 	}
 }
 
+// renderOptions are the options for every render.Render given to handlers.
+var renderOptions = render.Options{IndentJSON: true}
+
+// newMartini creates the martini instance and router with the middleware
+// shared by all roles.
+func newMartini() (*martini.Martini, martini.Router, sessions.CookieStore) {
+	r := martini.NewRouter()
+	m := martini.New()
+	m.Logger(log.New(os.Stderr, "", log.LstdFlags))
+	m.Use(healthMiddleware)
+	m.Use(martini.Logger())
+	m.Use(martini.Recovery())
+	m.Use(compressResponses)
+	m.Use(martini.Static(Config().StaticDir, martini.StaticOptions{SkipLogging: true}))
+	m.MapTo(r, (*martini.Routes)(nil))
+	m.Action(r.Handle)
+
+	m.Use(render.Renderer(renderOptions))
+
+	store := sessions.NewCookieStore([]byte(Config().SessionSecret))
+	m.Use(sessions.Sessions(CookieName, store))
+
+	return m, r, store
+}
+
+// txResponseWriter settles a request's transaction when the handler sends
+// its status line. If settling fails, the client gets a 500 instead of the
+// handler's response.
+type txResponseWriter struct {
+	martini.ResponseWriter
+	settle  func(status int) error
+	settled bool
+	failed  bool
+}
+
+func (w *txResponseWriter) WriteHeader(status int) {
+	if w.settled {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.settled = true
+	if err := w.settle(status); err != nil {
+		w.failed = true
+		w.Header().Del("Content-Length")
+		loggedHTTPErrorf(w.ResponseWriter, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *txResponseWriter) Write(data []byte) (int, error) {
+	if !w.settled {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.failed {
+		// the handler's response was replaced by an error
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// setupTARoutes registers the handlers for the TA role. With queue set,
+// grading requests go to the work queue for daycare workers to pull.
+func setupTARoutes(r martini.Router, db *sql.DB, queue bool) {
+	// martini service: wrap handler in a transaction
+	//
+	// The transaction is settled just before the status line goes out, so a
+	// client is never told that a change worked unless it was committed.
+	// Reads may keep streaming from the transaction after that, so they
+	// save the audit entry on its own and commit when the handler is done.
+	// A failed request made while impersonating is rolled back, but its
+	// audit entry is still saved on its own.
+	txRenderer := render.Renderer(renderOptions)
+	withTx := func(c martini.Context, w http.ResponseWriter, r *http.Request) {
+		// start a transaction
+		tx, err := db.Begin()
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error starting transaction: %v", err)
+			return
+		}
+
+		audit := &AuditEntry{Method: r.Method, Path: r.URL.Path, CreatedAt: time.Now()}
+		reading := r.Method == "GET" || r.Method == "HEAD"
+		pending := false
+		settle := func(status int) error {
+			// was it a successful result?
+			if status >= http.StatusBadRequest {
+				log.Printf("rolling back transaction")
+				if err := tx.Rollback(); err != nil {
+					log.Printf("db error rolling back transaction: %v", err)
+				}
+				if audit.ImpersonatorID != 0 {
+					if audit.Summary != "" {
+						audit.Summary = fmt.Sprintf("failed with status %d: %s", status, audit.Summary)
+					} else {
+						audit.Summary = fmt.Sprintf("failed with status %d", status)
+					}
+					if err := saveAuditEntry(db, audit); err != nil {
+						log.Printf("db error saving audit log entry: %v", err)
+					}
+				}
+				return nil
+			}
+
+			// record it in the audit log
+			if reading {
+				if err := saveAuditEntry(db, audit); err != nil {
+					tx.Rollback()
+					return fmt.Errorf("db error saving audit log entry: %v", err)
+				}
+				pending = true
+				return nil
+			}
+			if err := saveAuditEntry(tx, audit); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("db error saving audit log entry: %v", err)
+			}
+
+			// commit the transaction
+			if err := tx.Commit(); err != nil {
+				return fmt.Errorf("db error committing transaction: %v", err)
+			}
+			return nil
+		}
+
+		// pass it on to the main handler
+		tw := &txResponseWriter{ResponseWriter: w.(martini.ResponseWriter), settle: settle}
+		c.Map(tx)
+		c.Map(audit)
+		c.MapTo(tw, (*http.ResponseWriter)(nil))
+		c.Invoke(txRenderer)
+		c.Next()
+
+		// a handler that writes nothing is sent as a 200
+		if !tw.settled {
+			tw.WriteHeader(http.StatusOK)
+		}
+		if pending {
+			if err := tx.Commit(); err != nil {
+				log.Printf("db error committing transaction: %v", err)
+			}
+		}
+	}
+
+	// martini service: for handlers that start background work
+	withDB := func(c martini.Context) {
+		c.Map(db)
+	}
+
+	// martini service: to require an active logged-in session or a valid API token
+	auth := func(c martini.Context, w http.ResponseWriter, r *http.Request, session sessions.Session) {
+		if secret := bearerToken(r); secret != "" {
+			token, err := loadAPIToken(db, secret)
+			if err == sql.ErrNoRows {
+				loggedHTTPErrorf(w, http.StatusUnauthorized, "authentication: API token not recognized; it may have been revoked")
+				return
+			} else if err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			c.Map(token)
+			return
+		}
+		if userID := session.Get("id"); userID == nil {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "authentication: no user ID found in session")
+			return
+		}
+		c.Map((*APIToken)(nil))
+	}
+
+	// martini service: include the current logged-in user (requires withTx and auth)
+	withCurrentUser := func(c martini.Context, w http.ResponseWriter, r *http.Request, tx *sql.Tx, session sessions.Session, token *APIToken, audit *AuditEntry) {
+		var userID, targetID, adminID int64
+		var mode string
+		var impersonating bool
+		if token != nil {
+			// API tokens identify the user directly and never impersonate
+			userID = token.UserID
+		} else {
+			rawID := session.Get("id")
+			if rawID == nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "cannot find user ID in session")
+				return
+			}
+			var ok bool
+			userID, ok = rawID.(int64)
+			if !ok {
+				session.Clear()
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "error extracting user ID from session")
+				return
+			}
+
+			// is an administrator acting as another user?
+			targetID, adminID, mode, impersonating = activeImpersonation(session, time.Now())
+			if impersonating && adminID == userID {
+				userID = targetID
+			} else if impersonating {
+				clearImpersonation(session)
+				impersonating = false
+			}
+		}
+
+		// load the user record
+		user := new(User)
+		if err := meddler.Load(tx, "users", user, userID); err != nil {
+			if err == sql.ErrNoRows {
+				loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d not found", userID)
+				return
+			}
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+
+		if token != nil {
+			applyTokenScope(user, token)
+		}
+
+		audit.UserID = user.ID
+		if impersonating {
+			audit.ImpersonatorID = adminID
+			if !impersonationAllowed(w, r, adminID, user, mode) {
+				return
+			}
+		}
+
+		// map the current user to the request context
+		c.Map(user)
+	}
+
+	// martini services: require logged in user to have a role (requires withCurrentUser)
+	administratorOnly := requireRole(RoleAdmin)
+	authorOnly := requireRole(RoleAuthor)
+	instructorOnly := requireRole(RoleInstructor)
+	staffOnly := requireRole(RoleTA)
+	chairOnly := requireRole(RoleChair)
+
+	// version
+	r.Get("/v2/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		renderJSONWithETag(w, r, &CurrentVersion)
+	})
+
+	// public key for encrypted submissions
+	r.Get("/v2/daycare/key", GetDaycareKey)
+
+	// audit log
+	r.Get("/v2/audit", auth, withTx, withCurrentUser, administratorOnly, GetAudit)
+	r.Get("/v2/capacity_plan", auth, withTx, withCurrentUser, administratorOnly, GetCapacityPlan)
+	r.Get("/v2/heatmap", auth, withTx, withCurrentUser, administratorOnly, GetHeatmap)
+
+	// runtime profiling
+	r.Get("/v2/debug/pprof/**", auth, withTx, withCurrentUser, administratorOnly, GetDebugPprof)
+	r.Get("/v2/debug/profiles", auth, withTx, withCurrentUser, administratorOnly, GetDebugProfiles)
+	r.Get("/v2/debug/profiles/:profile_id", auth, withTx, withCurrentUser, administratorOnly, GetDebugProfile)
+
+	// event outbox for external systems
+	r.Get("/v2/outbox_events", auth, withTx, withCurrentUser, administratorOnly, GetOutboxEvents)
+	r.Get("/v2/trends", auth, withTx, withCurrentUser, chairOnly, GetTrends)
+	r.Get("/v2/deleted/:kind", auth, withTx, withCurrentUser, administratorOnly, GetDeleted)
+	r.Post("/v2/deleted/:kind/:id/restore", auth, withTx, withCurrentUser, administratorOnly, PostDeletedRestore)
+
+	// LTI
+	r.Get("/v2/lti/config.xml", GetConfigXML)
+	r.Post("/v2/lti/problem_sets", binding.Bind(LTIRequest{}), checkOAuthSignature, withTx, LtiProblemSets)
+	r.Post("/v2/lti/problem_sets/:unique", binding.Bind(LTIRequest{}), checkOAuthSignature, withTx, LtiProblemSet)
+
+	// problem bundles--for problem creation only
+	r.Post("/v2/problem_bundles/unconfirmed", auth, withTx, withCurrentUser, authorOnly, binding.Json(ProblemBundle{}), PostProblemBundleUnconfirmed)
+	r.Post("/v2/problem_bundles/confirmed", auth, withTx, withCurrentUser, authorOnly, binding.Json(ProblemBundle{}), PostProblemBundleConfirmed)
+	r.Get("/v2/problem_bundles/:problem_id", auth, withTx, withCurrentUser, authorOnly, GetProblemBundle)
+	r.Put("/v2/problem_bundles/:problem_id", auth, withTx, withCurrentUser, authorOnly, binding.Json(ProblemBundle{}), PutProblemBundle)
+
+	// problem set bundles--for problem set creation only
+	r.Post("/v2/problem_set_bundles", auth, withTx, withCurrentUser, authorOnly, binding.Json(ProblemSetBundle{}), PostProblemSetBundle)
+	r.Put("/v2/problem_set_bundles/:problem_set_id", auth, withTx, withCurrentUser, authorOnly, binding.Json(ProblemSetBundle{}), PutProblemSetBundle)
+
+	// problem types
+	r.Get("/v2/problem_types", auth, GetProblemTypes)
+	r.Get("/v2/problem_types/:name", auth, GetProblemType)
+
+	// problems
+	r.Get("/v2/problems", auth, withTx, withCurrentUser, GetProblems)
+	r.Get("/v2/problems/search", auth, withTx, withCurrentUser, authorOnly, GetProblemsSearch)
+	r.Get("/v2/problems/:problem_id", auth, withTx, withCurrentUser, GetProblem)
+	r.Get("/v2/problems/:problem_id/changelog", auth, withTx, withCurrentUser, GetProblemChangelog)
+	r.Get("/v2/problems/:problem_id/steps", auth, withTx, withCurrentUser, GetProblemSteps)
+	r.Get("/v2/problems/:problem_id/steps/:step", auth, withTx, withCurrentUser, GetProblemStep)
+	r.Get("/v2/problems/:problem_id/steps/:step/precheck.wasm", auth, withTx, withCurrentUser, GetProblemStepPrecheck)
+	r.Get("/v2/problems/:problem_id/solutions", auth, withTx, withCurrentUser, authorOnly, GetProblemSolutions)
+	r.Post("/v2/problems/:problem_id/solutions/check", auth, withTx, withDB, withCurrentUser, authorOnly, PostProblemSolutionsCheck)
+	r.Get("/v2/problems/:problem_id/variants", auth, withTx, withCurrentUser, authorOnly, GetProblemVariants)
+	r.Get("/v2/problems/:problem_id/cohorts", auth, withTx, withCurrentUser, authorOnly, GetProblemCohorts)
+	r.Delete("/v2/problems/:problem_id", auth, withTx, withCurrentUser, administratorOnly, DeleteProblem)
+
+	// problem sets
+	r.Get("/v2/problem_sets", auth, withTx, withCurrentUser, GetProblemSets)
+	r.Get("/v2/problem_sets/:problem_set_id", auth, withTx, withCurrentUser, GetProblemSet)
+	r.Get("/v2/problem_sets/:problem_set_id/instructions", auth, withTx, withCurrentUser, GetProblemSetInstructions)
+	r.Get("/v2/problem_sets/:problem_set_id/problems", auth, withTx, withCurrentUser, GetProblemSetProblems)
+	r.Delete("/v2/problem_sets/:problem_set_id", auth, withTx, withCurrentUser, administratorOnly, DeleteProblemSet)
+
+	// courses
+	r.Get("/v2/courses", auth, withTx, withCurrentUser, GetCourses)
+	r.Get("/v2/courses/:course_id", auth, withTx, withCurrentUser, GetCourse)
+	r.Get("/v2/courses/:course_id/info", auth, withTx, withCurrentUser, GetCourseInfo)
+	r.Put("/v2/courses/:course_id/info", auth, withTx, withCurrentUser, instructorOnly, binding.Json(CourseInfo{}), PutCourseInfo)
+	r.Get("/v2/courses/:course_id/problem_options", auth, withTx, withCurrentUser, instructorOnly, GetCourseProblemOptions)
+	r.Put("/v2/courses/:course_id/problem_options/:problem_type", auth, withTx, withCurrentUser, instructorOnly, binding.Json(CourseProblemOptions{}), PutCourseProblemOptions)
+	r.Get("/v2/courses/:course_id/feedback_levels", auth, withTx, withCurrentUser, instructorOnly, GetCourseFeedbackLevels)
+	r.Put("/v2/courses/:course_id/feedback_levels/:problem_set_id", auth, withTx, withCurrentUser, instructorOnly, binding.Json(CourseFeedbackLevel{}), PutCourseFeedbackLevel)
+	r.Get("/v2/courses/:course_id/problem_sets/:problem_set_id/not_started", auth, withTx, withCurrentUser, instructorOnly, GetCourseProblemSetNotStarted)
+	r.Get("/v2/courses/:course_id/problem_sets/:problem_set_id/export", auth, withTx, withCurrentUser, instructorOnly, GetCourseProblemSetExport)
+	r.Get("/v2/courses/:course_id/problem_sets/:problem_set_id/metrics", auth, withTx, withCurrentUser, instructorOnly, GetCourseProblemSetMetrics)
+	r.Get("/v2/courses/:course_id/gradebook", auth, withTx, withCurrentUser, instructorOnly, GetCourseGradebook)
+	r.Get("/v2/courses/:course_id/heatmap", auth, withTx, withCurrentUser, staffOnly, GetCourseHeatmap)
+	r.Get("/v2/courses/:course_id/effort", auth, withTx, withCurrentUser, instructorOnly, GetCourseEffort)
+	r.Post("/v2/courses/:course_id/problem_sets/:problem_set_id/exam_bundles", auth, withTx, withCurrentUser, instructorOnly, binding.Json(ExamBundleRequest{}), PostCourseProblemSetExamBundle)
+	r.Post("/v2/exam_bundles/:exam_bundle_id/receipts", auth, withTx, withCurrentUser, instructorOnly, binding.Json(ExamUpload{}), PostExamBundleReceipts)
+	r.Get("/v2/exam_bundles/:exam_bundle_id/receipts", auth, withTx, withCurrentUser, staffOnly, GetExamBundleReceipts)
+	r.Post("/v2/exam_bundles/:exam_bundle_id/receipts/review", auth, withTx, withCurrentUser, staffOnly, binding.Json(ExamReceiptReview{}), PostExamBundleReceiptsReview)
+	r.Post("/v2/courses/:course_id/problem_sets/:problem_set_id/nudge", auth, withTx, withCurrentUser, instructorOnly, PostCourseProblemSetNudge)
+	r.Delete("/v2/courses/:course_id", auth, withTx, withCurrentUser, administratorOnly, DeleteCourse)
+	r.Get("/v2/courses/:course_id/staff", auth, withTx, withCurrentUser, instructorOnly, GetCourseStaff)
+	r.Put("/v2/courses/:course_id/staff/:user_id", auth, withTx, withCurrentUser, instructorOnly, binding.Json(CourseRole{}), PutCourseStaff)
+	r.Delete("/v2/courses/:course_id/staff/:user_id", auth, withTx, withCurrentUser, instructorOnly, DeleteCourseStaff)
+	r.Get("/v2/courses/:course_id/tas", auth, withTx, withCurrentUser, instructorOnly, GetCourseTAs)
+	r.Put("/v2/courses/:course_id/tas/:user_id", auth, withTx, withCurrentUser, instructorOnly, PutCourseTA)
+	r.Delete("/v2/courses/:course_id/tas/:user_id", auth, withTx, withCurrentUser, instructorOnly, DeleteCourseTA)
+	r.Get("/v2/courses/:course_id/enrollments", auth, withTx, withCurrentUser, staffOnly, GetCourseEnrollments)
+	r.Post("/v2/courses/:course_id/roster_sync", auth, withTx, withCurrentUser, instructorOnly, PostCourseRosterSync)
+
+	// users
+	r.Get("/v2/users", auth, withTx, withCurrentUser, GetUsers)
+	r.Get("/v2/users/me", auth, withTx, withCurrentUser, GetUserMe)
+	r.Get("/v2/users/me/cookie", auth, GetUserMeCookie)
+	r.Post("/v2/users/me/tutorial", auth, withTx, withCurrentUser, PostUserMeTutorial)
+	r.Put("/v2/users/me/timezone", auth, withTx, withCurrentUser, binding.Json(UserTimezone{}), PutUserMeTimezone)
+	r.Get("/v2/users/me/assignments", auth, withTx, withCurrentUser, GetUserMeAssignments)
+	r.Get("/v2/users/me/changelog", auth, withTx, withCurrentUser, GetUserMeChangelog)
+	r.Get("/v2/users/me/notifications", auth, withTx, withCurrentUser, GetUserMeNotifications)
+	r.Get("/v2/users/me/notification_preferences", auth, withTx, withCurrentUser, GetUserMeNotificationPreferences)
+	r.Put("/v2/users/me/notification_preferences", auth, withTx, withCurrentUser, binding.Json(NotificationPreferences{}), PutUserMeNotificationPreferences)
+	r.Delete("/v2/users/me/impersonate", auth, withTx, DeleteUserImpersonate)
+	r.Get("/v2/users/me/tokens", auth, withTx, withCurrentUser, GetUserMeTokens)
+	r.Post("/v2/users/me/tokens", auth, withTx, withCurrentUser, binding.Json(APIToken{}), PostUserMeToken)
+	r.Post("/v2/users/me/tokens/exchange", auth, withTx, withCurrentUser, binding.Json(APIToken{}), PostUserMeTokenExchange)
+	r.Delete("/v2/users/me/tokens/:token_id", auth, withTx, withCurrentUser, DeleteUserMeToken)
+	r.Post("/v2/users/:user_id/impersonate", auth, withTx, withCurrentUser, administratorOnly, PostUserImpersonate)
+	r.Get("/v2/users/:user_id", auth, withTx, withCurrentUser, GetUser)
+	r.Get("/v2/courses/:course_id/users", auth, withTx, withCurrentUser, GetCourseUsers)
+	r.Delete("/v2/users/:user_id", auth, withTx, withCurrentUser, administratorOnly, DeleteUser)
+	r.Put("/v2/users/:user_id/chair", auth, withTx, withCurrentUser, administratorOnly, binding.Json(UserChair{}), PutUserChair)
+
+	// assignments
+	r.Get("/v2/users/:user_id/assignments", auth, withTx, withCurrentUser, GetUserAssignments)
+	r.Get("/v2/courses/:course_id/users/:user_id/assignments", auth, withTx, withCurrentUser, GetCourseUserAssignments)
+	r.Put("/v2/users/:user_id/assignments/:assignment_id/score", auth, withTx, withCurrentUser, instructorOnly, binding.Json(ScoreOverride{}), PutAssignmentScore)
+	r.Delete("/v2/users/:user_id/assignments/:assignment_id/score", auth, withTx, withCurrentUser, instructorOnly, DeleteAssignmentScore)
+	r.Get("/v2/assignments/:assignment_id", auth, withTx, withCurrentUser, GetAssignment)
+	r.Get("/v2/assignments/:assignment_id/metrics", auth, withTx, withCurrentUser, GetAssignmentMetrics)
+	r.Get("/v2/assignments/:assignment_id/effort", auth, withTx, withCurrentUser, GetAssignmentEffort)
+	r.Get("/v2/assignments/:assignment_id/stats", auth, withTx, withCurrentUser, staffOnly, GetAssignmentStats)
+	r.Get("/v2/assignments/:assignment_id/checklist", auth, withTx, withCurrentUser, staffOnly, GetAssignmentChecklist)
+	r.Get("/v2/assignments/:assignment_id/steps/:step/failure_clusters", auth, withTx, withCurrentUser, staffOnly, GetAssignmentStepFailureClusters)
+	r.Get("/v2/assignments/:assignment_id/student_view", auth, withTx, withCurrentUser, staffOnly, GetAssignmentStudentView)
+	r.Get("/v2/assignments/:assignment_id/effective_options", auth, withTx, withCurrentUser, instructorOnly, GetAssignmentEffectiveOptions)
+	r.Put("/v2/assignments/:assignment_id/score_override", auth, withTx, withCurrentUser, instructorOnly, binding.Json(ScoreOverride{}), PutAssignmentScore)
+	r.Delete("/v2/assignments/:assignment_id/score_override", auth, withTx, withCurrentUser, instructorOnly, DeleteAssignmentScore)
+	r.Get("/v2/assignments/:assignment_id/score_history", auth, withTx, withCurrentUser, GetAssignmentScoreHistory)
+	r.Post("/v2/assignments/:assignment_id/reopen", auth, withTx, withCurrentUser, instructorOnly, binding.Json(AssignmentReopen{}), PostAssignmentReopen)
+	r.Post("/v2/assignments/:assignment_id/regrade", auth, withTx, withDB, withCurrentUser, staffOnly, PostAssignmentRegrade)
+	r.Get("/v2/regrades/:regrade_id", auth, withTx, withCurrentUser, staffOnly, GetRegrade)
+
+	// regrade requests
+	r.Post("/v2/commits/:commit_id/regrade_requests", auth, withTx, withCurrentUser, binding.Json(RegradeRequest{}), PostCommitRegradeRequest)
+	r.Get("/v2/users/me/regrade_requests", auth, withTx, withCurrentUser, GetUserMeRegradeRequests)
+	r.Get("/v2/courses/:course_id/regrade_requests", auth, withTx, withCurrentUser, instructorOnly, GetCourseRegradeRequests)
+	r.Put("/v2/regrade_requests/:regrade_request_id", auth, withTx, withCurrentUser, instructorOnly, binding.Json(RegradeRequest{}), PutRegradeRequest)
+	r.Delete("/v2/assignments/:assignment_id", auth, withTx, withCurrentUser, administratorOnly, DeleteAssignment)
+
+	// course webhooks
+	r.Get("/v2/courses/:course_id/webhooks", auth, withTx, withCurrentUser, instructorOnly, GetCourseWebhooks)
+	r.Post("/v2/courses/:course_id/webhooks", auth, withTx, withCurrentUser, instructorOnly, binding.Json(CourseWebhook{}), PostCourseWebhook)
+	r.Put("/v2/courses/:course_id/webhooks/:webhook_id", auth, withTx, withCurrentUser, instructorOnly, binding.Json(CourseWebhook{}), PutCourseWebhook)
+	r.Delete("/v2/courses/:course_id/webhooks/:webhook_id", auth, withTx, withCurrentUser, instructorOnly, DeleteCourseWebhook)
+	r.Get("/v2/courses/:course_id/grade_hooks", auth, withTx, withCurrentUser, instructorOnly, GetCourseGradeHooks)
+	r.Post("/v2/courses/:course_id/grade_hooks", auth, withTx, withCurrentUser, instructorOnly, binding.Json(CourseGradeHook{}), PostCourseGradeHook)
+	r.Put("/v2/courses/:course_id/grade_hooks/:hook_id", auth, withTx, withCurrentUser, instructorOnly, binding.Json(CourseGradeHook{}), PutCourseGradeHook)
+	r.Delete("/v2/courses/:course_id/grade_hooks/:hook_id", auth, withTx, withCurrentUser, instructorOnly, DeleteCourseGradeHook)
+
+	// commits
+	r.Get("/v2/assignments/:assignment_id/problems/:problem_id/commits/last", auth, withTx, withCurrentUser, GetAssignmentProblemCommitLast)
+	r.Get("/v2/assignments/:assignment_id/problems/:problem_id/commits/open", auth, withTx, withCurrentUser, GetAssignmentProblemCommitOpen)
+	r.Get("/v2/assignments/:assignment_id/problems/:problem_id/steps/:step/commits/last", auth, withTx, withCurrentUser, GetAssignmentProblemStepCommitLast)
+	r.Get("/v2/assignments/:assignment_id/problems/:problem_id/checkpoints", auth, withTx, withCurrentUser, GetAssignmentProblemCheckpoints)
+	r.Get("/v2/assignments/:assignment_id/problems/:problem_id/checkpoints/:checkpoint_id", auth, withTx, withCurrentUser, GetAssignmentProblemCheckpoint)
+	r.Delete("/v2/commits/:commit_id", auth, withTx, withCurrentUser, administratorOnly, DeleteCommit)
+	r.Get("/v2/commits/:commit_id/comments", auth, withTx, withCurrentUser, GetCommitComments)
+	r.Post("/v2/commits/:commit_id/comments", auth, withTx, withCurrentUser, staffOnly, binding.Json(CommitComment{}), PostCommitComment)
+	r.Get("/v2/quarantined_commits", auth, withTx, withCurrentUser, administratorOnly, GetQuarantinedCommits)
+	r.Delete("/v2/quarantined_commits/:commit_id", auth, withTx, withCurrentUser, administratorOnly, DeleteQuarantinedCommit)
+
+	// commit bundles
+	r.Post("/v2/commit_bundles/unsigned", auth, withTx, withCurrentUser, binding.Json(CommitBundle{}), PostCommitBundlesUnsigned)
+	r.Post("/v2/commit_bundles/signed", auth, withTx, withCurrentUser, binding.Json(CommitBundle{}), PostCommitBundlesSigned)
+	r.Post("/v2/set_commit_bundles/unsigned", auth, withTx, withCurrentUser, binding.Json(SetCommitBundle{}), PostSetCommitBundlesUnsigned)
+	r.Post("/v2/set_commit_bundles/signed", auth, withTx, withCurrentUser, binding.Json(SetCommitBundle{}), PostSetCommitBundlesSigned)
+	r.Post("/v2/commit_bundles/reuse_check", auth, withTx, withCurrentUser, binding.Json(CommitBundle{}), PostCommitBundleReuseCheck)
+
+	// work queue for daycare workers
+	if queue {
+		r.Get("/v2/sockets/:problem_type/:action", withDB, SocketQueueProblemTypeAction)
+		r.Get("/v2/daycare_workers", auth, withTx, withCurrentUser, administratorOnly, GetDaycareWorkers)
+		r.Put("/v2/daycare_workers/:name/tags", auth, withTx, withCurrentUser, administratorOnly, binding.Json(DaycareWorker{}), PutDaycareWorkerTags)
+		r.Get("/v2/daycare_routes", auth, withTx, withCurrentUser, administratorOnly, GetDaycareRoutes)
+		r.Get("/v2/daycare_smoke_tests", auth, withTx, withCurrentUser, administratorOnly, GetDaycareSmokeTests)
+		r.Get("/v2/grading_waits", auth, withTx, withCurrentUser, GetGradingWaits)
+		r.Get("/v2/grading_waits/:problem_type", auth, withTx, withCurrentUser, GetGradingWait)
+		r.Post("/v2/daycare_workers", daycareWorkerOnly, withDB, binding.Json(DaycareWorker{}), PostDaycareWorker)
+		r.Post("/v2/daycare_jobs/claim", daycareWorkerOnly, withDB, binding.Json(DaycareWorker{}), PostDaycareJobClaim)
+		r.Get("/v2/daycare_jobs/:job_id/socket", daycareWorkerOnly, SocketDaycareJob)
+	}
+}
+
+// connectDocker attaches to the local docker daemon and makes sure it responds.
+func connectDocker() error {
+	var err error
+	dockerClient, err = docker.NewVersionedClient("unix:///var/run/docker.sock", "1.18")
+	if err != nil {
+		return fmt.Errorf("NewVersionedClient: %v", err)
+	}
+	if err = dockerClient.Ping(); err != nil {
+		return fmt.Errorf("Ping: %v", err)
+	}
+	return nil
+}
+
+// setupDaycareRoutes registers the handlers for the daycare role. With
+// queue set, the TA role takes grading requests and this daycare pulls them
+// as a worker. db is the TA's database if this process also runs the TA
+// role, or nil.
+func setupDaycareRoutes(r martini.Router, queue bool, db *sql.DB) {
+	if !queue {
+		withTADB := func(c martini.Context) {
+			c.Map(db)
+		}
+		r.Get("/v2/sockets/:problem_type/:action", withTADB, SocketProblemTypeAction)
+	}
+	r.Post("/v2/daycare/prepull", PostDaycarePrepull)
+}
+
 func setupDB(host, port, user, password, database string) *sql.DB {
 	if port == "" {
 		log.Printf("connecting to database at %s", host)
@@ -439,6 +860,38 @@ func loggedHTTPErrorf(w http.ResponseWriter, status int, format string, params .
 	return fmt.Errorf("%s", msg)
 }
 
+// renderJSONWithETag renders elt as JSON with an ETag computed from its
+// contents. If the client reports that it already has the current version
+// using If-None-Match, it responds with 304 Not Modified and no body.
+func renderJSONWithETag(w http.ResponseWriter, r *http.Request, elt interface{}) {
+	raw, err := json.MarshalIndent(elt, "", "  ")
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "json error: %v", err)
+		return
+	}
+	sum := sha256.Sum256(raw)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(raw)
+}
+
+// etagMatches checks if an If-None-Match header value includes the given ETag.
+func etagMatches(header, etag string) bool {
+	for _, elt := range strings.Split(header, ",") {
+		elt = strings.TrimSpace(elt)
+		if elt == etag || elt == "W/"+etag || elt == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 func loggedErrorf(f string, params ...interface{}) error {
 	log.Print(logPrefix() + fmt.Sprintf(f, params...))
 	return fmt.Errorf(f, params...)
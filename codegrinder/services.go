@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	. "github.com/russross/codegrinder/types"
+)
+
+// DefaultServiceHealthTimeout is how long to wait for a sidecar service to
+// pass its health check when the problem type does not specify a timeout.
+const DefaultServiceHealthTimeout = 30 * time.Second
+
+// Services is the set of sidecar containers attached to a nanny, along with
+// the private network they share with the grader container.
+type Services struct {
+	Network    *docker.Network
+	Containers []*docker.Container
+}
+
+// createContainer creates a container, removing any stale container that
+// already holds the requested name and trying again.
+func createContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
+	container, err := dockerClient.CreateContainer(opts)
+	if err != nil {
+		if apiError, ok := err.(*docker.Error); ok && apiError.Status == http.StatusConflict && getContainerID(apiError.Message) != "" {
+			// container already exists with that name--try killing it
+			err2 := dockerClient.RemoveContainer(docker.RemoveContainerOptions{
+				ID:    getContainerID(apiError.Message),
+				Force: true,
+			})
+			if err2 != nil {
+				log.Printf("createContainer error killing existing container: %v", err2)
+				return nil, err2
+			}
+
+			// try it one more time
+			container, err = dockerClient.CreateContainer(opts)
+		}
+		if err != nil {
+			log.Printf("createContainer: %#v", err)
+			return nil, err
+		}
+	}
+	return container, nil
+}
+
+// StartServices creates an isolated network named after the nanny and starts
+// the sidecar services declared by the problem type on it, waiting for each
+// one to pass its health check. On failure, anything already started is torn
+// down before returning.
+func StartServices(problemType *ProblemType, name string) (*Services, error) {
+	if len(problemType.Services) == 0 {
+		return nil, nil
+	}
+
+	// create a private network, clearing out any leftover from an earlier run
+	netName := name + "-net"
+	network, err := dockerClient.CreateNetwork(docker.CreateNetworkOptions{
+		Name:     netName,
+		Driver:   "bridge",
+		Internal: true,
+	})
+	if err == docker.ErrNetworkAlreadyExists {
+		if err2 := dockerClient.RemoveNetwork(netName); err2 != nil {
+			log.Printf("StartServices error removing existing network: %v", err2)
+			return nil, err2
+		}
+		network, err = dockerClient.CreateNetwork(docker.CreateNetworkOptions{
+			Name:     netName,
+			Driver:   "bridge",
+			Internal: true,
+		})
+	}
+	if err != nil {
+		log.Printf("StartServices->CreateNetwork: %v", err)
+		return nil, err
+	}
+	services := &Services{Network: network}
+
+	for _, service := range problemType.Services {
+		container, err := services.start(problemType, service, name)
+		if err != nil {
+			services.Shutdown()
+			return nil, fmt.Errorf("starting service %s: %v", service.Name, err)
+		}
+		services.Containers = append(services.Containers, container)
+		if err := waitForHealthy(container, service); err != nil {
+			services.Shutdown()
+			return nil, fmt.Errorf("service %s: %v", service.Name, err)
+		}
+	}
+
+	return services, nil
+}
+
+// start creates and starts one sidecar service container, with the same
+// resource limits as the grader container.
+func (s *Services) start(problemType *ProblemType, service *ProblemTypeService, name string) (*docker.Container, error) {
+	ports := make(map[docker.Port]struct{})
+	for _, port := range service.Ports {
+		ports[docker.Port(fmt.Sprintf("%d/tcp", port))] = struct{}{}
+	}
+	config := &docker.Config{
+		Hostname:     service.Name,
+		Env:          service.Env,
+		ExposedPorts: ports,
+		Image:        service.Image,
+	}
+	hostConfig := &docker.HostConfig{
+		NetworkMode: s.Network.Name,
+	}
+	limitContainer(problemType, config, hostConfig)
+	networkingConfig := &docker.NetworkingConfig{
+		EndpointsConfig: map[string]*docker.EndpointConfig{
+			s.Network.Name: {Aliases: []string{service.Name}},
+		},
+	}
+	container, err := createContainer(docker.CreateContainerOptions{
+		Name:             name + "-" + service.Name,
+		Config:           config,
+		HostConfig:       hostConfig,
+		NetworkingConfig: networkingConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := dockerClient.StartContainer(container.ID, nil); err != nil {
+		log.Printf("Services.start->StartContainer: %v", err)
+		if err2 := dockerClient.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true}); err2 != nil {
+			log.Printf("Services.start error killing container: %v", err2)
+		}
+		return nil, err
+	}
+	return container, nil
+}
+
+// waitForHealthy runs the service's health check command inside its
+// container until it exits with status zero or the timeout expires.
+// A service with no health check is assumed to be ready immediately.
+func waitForHealthy(container *docker.Container, service *ProblemTypeService) error {
+	if len(service.HealthCheck) == 0 {
+		return nil
+	}
+	timeout := DefaultServiceHealthTimeout
+	if service.HealthTimeout > 0 {
+		timeout = time.Duration(service.HealthTimeout) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		exec, err := dockerClient.CreateExec(docker.CreateExecOptions{
+			Cmd:       service.HealthCheck,
+			Container: container.ID,
+		})
+		if err != nil {
+			return err
+		}
+		if err := dockerClient.StartExec(exec.ID, docker.StartExecOptions{Detach: true}); err != nil {
+			return err
+		}
+		for {
+			inspect, err := dockerClient.InspectExec(exec.ID)
+			if err != nil {
+				return err
+			}
+			if !inspect.Running {
+				if inspect.ExitCode == 0 {
+					return nil
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(250 * time.Millisecond)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("health check did not pass within %v", timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Shutdown removes all sidecar containers and the private network.
+// It keeps going after errors so that as much as possible is cleaned up,
+// and returns the first error encountered.
+func (s *Services) Shutdown() error {
+	if s == nil {
+		return nil
+	}
+	var first error
+	for _, container := range s.Containers {
+		err := dockerClient.RemoveContainer(docker.RemoveContainerOptions{
+			ID:    container.ID,
+			Force: true,
+		})
+		if err != nil {
+			log.Printf("Services.Shutdown: %v", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if s.Network != nil {
+		if err := dockerClient.RemoveNetwork(s.Network.ID); err != nil {
+			log.Printf("Services.Shutdown removing network: %v", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gorilla/websocket"
+)
+
+// A client waiting on a daycare session is pinged every SessionHeartbeat.
+// If it does not answer for Config.SessionIdleMinutes, or if its connection
+// drops, the session is abandoned and its container is killed rather than
+// left running until the action finishes on its own. Workers pulling from
+// the work queue watch their connection to the TA server the same way, and
+// the TA server closes that connection when the client goes away.
+//
+// Containers are named nanny-*, so any that are still around when the
+// daycare starts were left behind by an earlier run and are removed.
+
+// SessionHeartbeat is how often a daycare pings the other end of a session.
+const SessionHeartbeat = 15 * time.Second
+
+// sessionStats counts the containers killed to reclaim capacity since the
+// daycare started.
+var sessionStats struct {
+	sync.Mutex
+	abandoned int64
+	orphaned  int64
+}
+
+// watchSession keeps a session's socket alive with heartbeats and returns a
+// context that is cancelled when the other end goes away or stops
+// answering. The caller must call the cancel function when the session
+// ends. No other code may read from the socket once it is being watched.
+func watchSession(socket *websocket.Conn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	idle := time.Duration(Config().SessionIdleMinutes) * time.Minute
+	extend := func() {
+		socket.SetReadDeadline(time.Now().Add(idle))
+	}
+	extend()
+	socket.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+
+	// read until the connection fails; this also processes pongs
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := socket.NextReader(); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("session with %s lost: %v", socket.RemoteAddr(), err)
+				}
+				return
+			}
+			extend()
+		}
+	}()
+
+	// send heartbeats
+	go func() {
+		ticker := time.NewTicker(SessionHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := socket.WriteControl(websocket.PingMessage, nil, time.Now().Add(SessionHeartbeat)); err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+// Abandon kills the container of a session whose client has gone away.
+// Whatever is running in it fails, and the action finishes quickly.
+func (n *Nanny) Abandon() {
+	log.Printf("killing container %s: the client went away", n.Container.Name)
+	err := dockerClient.RemoveContainer(docker.RemoveContainerOptions{
+		ID:    n.Container.ID,
+		Force: true,
+	})
+	if err != nil {
+		log.Printf("Nanny.Abandon: %v", err)
+		return
+	}
+	sessionStats.Lock()
+	sessionStats.abandoned++
+	sessionStats.Unlock()
+}
+
+// removeOrphanedContainers removes the containers and networks left behind
+// by an earlier run of the daycare. It must be called before the daycare
+// starts any containers of its own.
+func removeOrphanedContainers() error {
+	containers, err := dockerClient.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		return err
+	}
+	removed := int64(0)
+	for _, container := range containers {
+		if !isNannyName(container.Names) {
+			continue
+		}
+		err := dockerClient.RemoveContainer(docker.RemoveContainerOptions{
+			ID:    container.ID,
+			Force: true,
+		})
+		if err != nil {
+			log.Printf("error removing orphaned container %s: %v", strings.Join(container.Names, ","), err)
+			continue
+		}
+		removed++
+	}
+	networks, err := dockerClient.ListNetworks()
+	if err != nil {
+		return err
+	}
+	for _, network := range networks {
+		if !isNannyName([]string{network.Name}) {
+			continue
+		}
+		if err := dockerClient.RemoveNetwork(network.ID); err != nil {
+			log.Printf("error removing orphaned network %s: %v", network.Name, err)
+		}
+	}
+	if removed > 0 {
+		log.Printf("removed %d orphaned container%s", removed, plural(int(removed)))
+	}
+	sessionStats.Lock()
+	sessionStats.orphaned += removed
+	sessionStats.Unlock()
+	return nil
+}
+
+// isNannyName reports whether a container or network was created for a
+// nanny or its services.
+func isNannyName(names []string) bool {
+	for _, name := range names {
+		if strings.HasPrefix(strings.TrimPrefix(name, "/"), "nanny-") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// A problem set tagged graded-together is graded as a unit: the student
+// submits a commit for every problem at once, the daycare grades them in a
+// single session, and the graded commits are saved in one transaction, so
+// either every problem's score changes or none does. Problems in such a set
+// cannot be graded one at a time.
+
+// isGradedTogether reports whether the problems of a problem set must be
+// graded together.
+func isGradedTogether(tx *sql.Tx, problemSetID int64) (bool, error) {
+	problemSet := new(ProblemSet)
+	if err := meddler.Load(tx, "problem_sets", problemSet, problemSetID); err != nil {
+		return false, err
+	}
+	for _, tag := range problemSet.Tags {
+		if tag == GradedTogetherTag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkSetCommitBundle makes sure a set commit bundle has exactly one commit
+// for each problem of a problem set that is graded together, and returns
+// the assignment and the weight of each problem in the order of the bundles.
+func checkSetCommitBundle(w http.ResponseWriter, tx *sql.Tx, currentUser *User, set *SetCommitBundle) (*Assignment, []float64, error) {
+	if len(set.Bundles) == 0 {
+		return nil, nil, loggedHTTPErrorf(w, http.StatusBadRequest, "set must include a commit bundle for each problem")
+	}
+	for _, bundle := range set.Bundles {
+		if bundle == nil || bundle.Commit == nil {
+			return nil, nil, loggedHTTPErrorf(w, http.StatusBadRequest, "each bundle must include a commit object")
+		}
+		if bundle.Commit.Action != "grade" {
+			return nil, nil, loggedHTTPErrorf(w, http.StatusBadRequest, "every commit in a set must be for grading")
+		}
+		if bundle.Commit.AssignmentID != set.Bundles[0].Commit.AssignmentID {
+			return nil, nil, loggedHTTPErrorf(w, http.StatusBadRequest, "every commit in a set must be for the same assignment")
+		}
+	}
+
+	assignment := new(Assignment)
+	if err := meddler.QueryRow(tx, assignment, `SELECT * FROM assignments WHERE id = $1 AND user_id = $2`, set.Bundles[0].Commit.AssignmentID, currentUser.ID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil, nil, err
+	}
+	together, err := isGradedTogether(tx, assignment.ProblemSetID)
+	if err != nil {
+		return nil, nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+	}
+	if !together {
+		return nil, nil, loggedHTTPErrorf(w, http.StatusBadRequest, "the problems in this problem set are graded one at a time")
+	}
+
+	problemSetProblems := []*ProblemSetProblem{}
+	if err := meddler.QueryAll(tx, &problemSetProblems, `SELECT * FROM problem_set_problems WHERE problem_set_id = $1`, assignment.ProblemSetID); err != nil {
+		return nil, nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+	}
+	weights := make(map[int64]float64)
+	for _, elt := range problemSetProblems {
+		weights[elt.ProblemID] = elt.Weight
+	}
+	if len(set.Bundles) != len(weights) {
+		return nil, nil, loggedHTTPErrorf(w, http.StatusBadRequest, "set has %d commits, but the problem set has %d problems", len(set.Bundles), len(weights))
+	}
+	seen := make(map[int64]bool)
+	ordered := []float64{}
+	for _, bundle := range set.Bundles {
+		weight, ok := weights[bundle.Commit.ProblemID]
+		if !ok {
+			return nil, nil, loggedHTTPErrorf(w, http.StatusBadRequest, "problem %d is not part of this problem set", bundle.Commit.ProblemID)
+		}
+		if seen[bundle.Commit.ProblemID] {
+			return nil, nil, loggedHTTPErrorf(w, http.StatusBadRequest, "set has more than one commit for problem %d", bundle.Commit.ProblemID)
+		}
+		seen[bundle.Commit.ProblemID] = true
+		ordered = append(ordered, weight)
+	}
+	return assignment, ordered, nil
+}
+
+// checkSetScan checks the files of every commit in a set against the
+// malware scanner before any of them is saved. If one commit cannot be
+// graded yet then none of them is, so it returns the reason to hold the
+// whole set, or "" if the set can be graded.
+func checkSetScan(w http.ResponseWriter, tx *sql.Tx, set *SetCommitBundle) (string, error) {
+	if Config().ScanCommand == "" {
+		return "", nil
+	}
+	hold := ""
+	for _, bundle := range set.Bundles {
+		reason, err := checkFilesScan(tx, bundle.Commit.Files)
+		if err != nil {
+			return "", loggedHTTPErrorf(w, http.StatusInternalServerError, "db error checking scan results: %v", err)
+		}
+		if reason != "" && hold != scanHoldMessage(true) {
+			hold = reason
+		}
+	}
+	return hold, nil
+}
+
+// PostSetCommitBundlesUnsigned handles requests to /v2/set_commit_bundles/unsigned,
+// saving a commit for every problem in a problem set that is graded
+// together and signing them as a set, ready to send to the daycare.
+func PostSetCommitBundlesUnsigned(w http.ResponseWriter, tx *sql.Tx, currentUser *User, set SetCommitBundle, audit *AuditEntry, render render.Render) {
+	now := time.Now()
+
+	if len(set.Signature) != 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "set must not include a signature")
+		return
+	}
+	assignment, weights, err := checkSetCommitBundle(w, tx, currentUser, &set)
+	if err != nil {
+		return
+	}
+
+	// the set counts as one request to grade
+	problem := new(Problem)
+	if err := meddler.Load(tx, "problems", problem, set.Bundles[0].Commit.ProblemID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if err := enforceGradeLimits(now, w, tx, currentUser, assignment, problem.ProblemType); err != nil {
+		return
+	}
+
+	hold, err := checkSetScan(w, tx, &set)
+	if err != nil {
+		return
+	}
+
+	signed := &SetCommitBundle{Weights: weights, Held: hold}
+	for _, bundle := range set.Bundles {
+		if len(bundle.CommitSignature) != 0 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must not include commit signature")
+			return
+		}
+		bundle.Commit.Transcript = []*EventMessage{}
+		bundle.Commit.ReportCard = nil
+		bundle.Commit.Score = 0.0
+		bundle.Commit.CreatedAt = now
+		bundle.Commit.UpdatedAt = now
+		elt, err := saveCommitBundle(now, w, tx, currentUser, bundle, audit, true, hold)
+		if err != nil {
+			return
+		}
+		signed.Bundles = append(signed.Bundles, elt)
+	}
+	if signed.Held == "" {
+		signed.Signature = signed.ComputeSignature(Config().DaycareSecret)
+	}
+	render.JSON(http.StatusOK, signed)
+}
+
+// PostSetCommitBundlesSigned handles requests to /v2/set_commit_bundles/signed,
+// saving the graded commits of a problem set that is graded together.
+// The commits must all come from the same daycare session, and they are
+// saved and scored as a unit.
+func PostSetCommitBundlesSigned(w http.ResponseWriter, tx *sql.Tx, currentUser *User, set SetCommitBundle, audit *AuditEntry, render render.Render) {
+	now := time.Now()
+
+	_, weights, err := checkSetCommitBundle(w, tx, currentUser, &set)
+	if err != nil {
+		return
+	}
+	if len(set.Weights) != len(weights) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "set has %d weights for %d commits", len(set.Weights), len(weights))
+		return
+	}
+	for i := range weights {
+		if set.Weights[i] != weights[i] {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "the problem weights have changed since this set was signed")
+			return
+		}
+	}
+	if set.Signature == "" || set.Signature != set.ComputeSignature(Config().DaycareSecret) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "set signature mismatch")
+		return
+	}
+
+	hold, err := checkSetScan(w, tx, &set)
+	if err != nil {
+		return
+	}
+
+	saved := &SetCommitBundle{Weights: weights, Held: hold}
+	for _, bundle := range set.Bundles {
+		if len(bundle.CommitSignature) == 0 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must include commit signature")
+			return
+		}
+		if bundle.Commit.ReportCard == nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "every commit in a set must be graded")
+			return
+		}
+		toSave := &CommitBundle{Commit: bundle.Commit, CommitSignature: bundle.CommitSignature}
+		elt, err := saveCommitBundle(now, w, tx, currentUser, toSave, audit, true, hold)
+		if err != nil {
+			return
+		}
+		saved.Bundles = append(saved.Bundles, elt)
+	}
+	if saved.Held == "" {
+		saved.Signature = saved.ComputeSignature(Config().DaycareSecret)
+		saved.Combine()
+	}
+	render.JSON(http.StatusOK, saved)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// When the work queue is enabled, the TA server runs the reference solution
+// for each problem on every worker that supports its problem type. A test is
+// run whenever the worker's images for the problem type or the problem
+// itself change. Until a worker passes, the queue does not give it jobs for
+// that problem. Failed tests are retried periodically in case the failure
+// was transient.
+
+// SmokeTestInterval is how often the TA server looks for workers and
+// problems that need a smoke test.
+const SmokeTestInterval = time.Minute
+
+// SmokeTestRetry is how long to wait before testing a worker again after it
+// failed a smoke test for a version that has not changed.
+const SmokeTestRetry = 30 * time.Minute
+
+// startSmokeTests periodically runs smoke tests on the registered workers.
+func startSmokeTests(db *sql.DB) {
+	go func() {
+		for {
+			time.Sleep(SmokeTestInterval)
+			if err := runSmokeTests(db); err != nil {
+				log.Printf("error running smoke tests: %v", err)
+			}
+		}
+	}()
+}
+
+// runSmokeTests tests every live worker against the problems that have
+// reference solutions and need testing.
+func runSmokeTests(db *sql.DB) error {
+	workers := []*DaycareWorker{}
+	if err := meddler.QueryAll(db, &workers, `SELECT * FROM daycare_workers WHERE last_seen_at > $1 ORDER BY name`, time.Now().Add(-2*WorkerHeartbeat)); err != nil {
+		return err
+	}
+	if len(workers) == 0 {
+		return nil
+	}
+	problems := []*Problem{}
+	if err := meddler.QueryAll(db, &problems, `SELECT * FROM problems WHERE id IN (SELECT problem_id FROM problem_solutions) ORDER BY id`); err != nil {
+		return err
+	}
+	for _, worker := range workers {
+		supported := make(map[string]bool)
+		for _, name := range worker.ProblemTypes {
+			supported[name] = true
+		}
+		for _, problem := range problems {
+			if !supported[problem.ProblemType] {
+				continue
+			}
+			version := worker.ImageIDs[problem.ProblemType] + "/" + problem.UpdatedAt.UTC().Format(time.RFC3339Nano)
+			old := new(SmokeTest)
+			err := meddler.QueryRow(db, old, `SELECT * FROM smoke_tests WHERE worker = $1 AND problem_id = $2`, worker.Name, problem.ID)
+			switch {
+			case err == sql.ErrNoRows:
+			case err != nil:
+				return err
+			case old.Version == version && (old.Passed || time.Since(old.CheckedAt) < SmokeTestRetry):
+				continue
+			}
+
+			test, err := smokeTest(db, worker.Name, problem)
+			if err != nil {
+				return err
+			}
+			test.Version = version
+			if _, err := db.Exec(`INSERT INTO smoke_tests (worker, problem_id, version, passed, note, checked_at) VALUES ($1, $2, $3, $4, $5, $6) `+
+				`ON CONFLICT (worker, problem_id) DO UPDATE SET version = $3, passed = $4, note = $5, checked_at = $6`,
+				test.Worker, test.ProblemID, test.Version, test.Passed, test.Note, test.CheckedAt); err != nil {
+				return err
+			}
+			if !test.Passed {
+				log.Printf("worker %s failed the smoke test for %s: %s", worker.Name, problem.Unique, test.Note)
+			}
+		}
+	}
+	return nil
+}
+
+// smokeTest runs the reference solution for every step of a problem on one
+// worker. The first step that fails decides the result.
+func smokeTest(db *sql.DB, worker string, problem *Problem) (*SmokeTest, error) {
+	steps := []*ProblemStep{}
+	if err := meddler.QueryAll(db, &steps, `SELECT * FROM problem_steps WHERE problem_id = $1 ORDER BY step`, problem.ID); err != nil {
+		return nil, err
+	}
+	omitPrechecks(steps...)
+	solutions := []*ProblemSolution{}
+	if err := meddler.QueryAll(db, &solutions, `SELECT * FROM problem_solutions WHERE problem_id = $1 ORDER BY step`, problem.ID); err != nil {
+		return nil, err
+	}
+
+	test := &SmokeTest{Worker: worker, ProblemID: problem.ID, Passed: true}
+	for _, solution := range solutions {
+		commit, err := runSolutionOnWorker(db, worker, problem, steps, solution)
+		switch {
+		case err != nil:
+			test.Passed, test.Note = false, fmt.Sprintf("step %d: %v", solution.Step, err)
+		case commit.ReportCard == nil:
+			test.Passed, test.Note = false, fmt.Sprintf("step %d: no report card", solution.Step)
+		case !commit.StepPassed():
+			test.Passed, test.Note = false, fmt.Sprintf("step %d: %s", solution.Step, commit.ReportCard.Note)
+		}
+		if !test.Passed {
+			break
+		}
+	}
+	test.CheckedAt = time.Now()
+	return test, nil
+}
+
+// runSolutionOnWorker queues one reference solution as a job that only the
+// named worker can claim and waits for the graded commit.
+func runSolutionOnWorker(db *sql.DB, worker string, problem *Problem, steps []*ProblemStep, solution *ProblemSolution) (*Commit, error) {
+	bundle, err := solutionBundle(db, problem, steps, solution)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	job := &DaycareJob{
+		ProblemType:  problem.ProblemType,
+		Action:       bundle.Commit.Action,
+		Args:         []string{},
+		Request:      &DaycareRequest{CommitBundle: bundle},
+		Status:       "queued",
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		TargetWorker: worker,
+	}
+	responses, err := queueJob(db, job)
+	if err != nil {
+		return nil, err
+	}
+	defer finishJob(db, job.ID)
+
+	timeout := time.After(SolutionCheckTimeout)
+	for {
+		select {
+		case res := <-responses:
+			switch {
+			case res.Error != "":
+				return nil, fmt.Errorf("daycare returned an error: %s", res.Error)
+			case res.CommitBundle != nil:
+				return res.CommitBundle.Commit, nil
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("worker did not finish within %v", SolutionCheckTimeout)
+		}
+	}
+}
+
+// GetDaycareSmokeTests handles a request to /v2/daycare_smoke_tests,
+// returning the latest smoke test result for each worker and problem.
+func GetDaycareSmokeTests(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+	tests := []*SmokeTest{}
+	if err := meddler.QueryAll(tx, &tests, `SELECT * FROM smoke_tests ORDER BY worker, problem_id`); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, tests)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Problems, assignments, and commits are not removed when they are
+// deleted. Instead, deleted_at is set on the row in the underlying table
+// (problems_all, assignments_all, or commits_all), and the view with the
+// usual name hides it, so the rest of the code never sees deleted rows.
+// Deleting an assignment deletes its commits with the same timestamp, so
+// restoring the assignment brings them back together. Administrators can
+// list and restore deleted objects for SoftDeleteWindow, after which the
+// purge job removes them for good.
+
+// SoftDeleteWindow is how long a deleted object can be restored.
+const SoftDeleteWindow = 30 * 24 * time.Hour
+
+// softDeleteTables maps the kinds of object that can be restored to the
+// tables that hold them, deleted or not.
+var softDeleteTables = map[string]string{
+	"problems":    "problems_all",
+	"assignments": "assignments_all",
+	"commits":     "commits_all",
+}
+
+// softDeleteProblem marks a problem as deleted.
+func softDeleteProblem(tx *sql.Tx, problemID int64, now time.Time) error {
+	_, err := tx.Exec(`UPDATE problems_all SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`, now, problemID)
+	return err
+}
+
+// softDeleteAssignment marks an assignment and its commits as deleted.
+func softDeleteAssignment(tx *sql.Tx, assignmentID int64, now time.Time) error {
+	if _, err := tx.Exec(`UPDATE commits_all SET deleted_at = $1 WHERE assignment_id = $2 AND deleted_at IS NULL`, now, assignmentID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE assignments_all SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`, now, assignmentID)
+	return err
+}
+
+// softDeleteCommit marks a commit as deleted.
+func softDeleteCommit(tx *sql.Tx, commitID int64, now time.Time) error {
+	_, err := tx.Exec(`UPDATE commits_all SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`, now, commitID)
+	return err
+}
+
+// GetDeleted handles a request to /v2/deleted/:kind,
+// returning the problems, assignments, or commits deleted within
+// SoftDeleteWindow, most recent first.
+func GetDeleted(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	table, exists := softDeleteTables[params["kind"]]
+	if !exists {
+		loggedHTTPErrorf(w, http.StatusNotFound, "unknown kind of deleted object %q: expected problems, assignments, or commits", params["kind"])
+		return
+	}
+	query := `SELECT * FROM ` + table + ` WHERE deleted_at >= $1 ORDER BY deleted_at DESC, id`
+	cutoff := time.Now().Add(-SoftDeleteWindow)
+
+	var list interface{}
+	switch table {
+	case "problems_all":
+		list = &[]*Problem{}
+	case "assignments_all":
+		list = &[]*Assignment{}
+	case "commits_all":
+		list = &[]*Commit{}
+	}
+	if err := meddler.QueryAll(tx, list, query, cutoff); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, list)
+}
+
+// PostDeletedRestore handles a request to /v2/deleted/:kind/:id/restore,
+// restoring a deleted problem, assignment, or commit. Restoring an
+// assignment also restores the commits deleted with it. An object cannot
+// be restored if a live object has taken its place, or if it is a commit
+// whose assignment is still deleted.
+func PostDeletedRestore(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *AuditEntry, render render.Render) {
+	table, exists := softDeleteTables[params["kind"]]
+	if !exists {
+		loggedHTTPErrorf(w, http.StatusNotFound, "unknown kind of deleted object %q: expected problems, assignments, or commits", params["kind"])
+		return
+	}
+	id, err := parseID(w, "id", params["id"])
+	if err != nil {
+		return
+	}
+	query := `SELECT * FROM ` + table + ` WHERE id = $1 AND deleted_at >= $2`
+	cutoff := time.Now().Add(-SoftDeleteWindow)
+
+	switch table {
+	case "problems_all":
+		problem := new(Problem)
+		if err := meddler.QueryRow(tx, problem, query, id, cutoff); err != nil {
+			loggedHTTPDBNotFoundError(w, err)
+			return
+		}
+		var taken bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM problems WHERE unique_id = $1)`, problem.Unique).Scan(&taken); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if taken {
+			loggedHTTPErrorf(w, http.StatusConflict, "cannot restore problem %d: another problem now uses the unique ID %s", problem.ID, problem.Unique)
+			return
+		}
+		if _, err := tx.Exec(`UPDATE problems_all SET deleted_at = NULL WHERE id = $1`, problem.ID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		problem.DeletedAt = nil
+		audit.Record(AuditRestore, problem.ID, "restored problem %d (%s)", problem.ID, problem.Unique)
+		render.JSON(http.StatusOK, problem)
+
+	case "assignments_all":
+		assignment := new(Assignment)
+		if err := meddler.QueryRow(tx, assignment, query, id, cutoff); err != nil {
+			loggedHTTPDBNotFoundError(w, err)
+			return
+		}
+		var taken bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM assignments WHERE (user_id = $1 AND lti_id = $2) OR grade_id = $3)`,
+			assignment.UserID, assignment.LtiID, assignment.GradeID).Scan(&taken); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if taken {
+			loggedHTTPErrorf(w, http.StatusConflict, "cannot restore assignment %d: user %d has a newer assignment for the same LMS assignment", assignment.ID, assignment.UserID)
+			return
+		}
+		result, err := tx.Exec(`UPDATE commits_all SET deleted_at = NULL WHERE assignment_id = $1 AND deleted_at = $2`, assignment.ID, *assignment.DeletedAt)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		commits, _ := result.RowsAffected()
+		if _, err := tx.Exec(`UPDATE assignments_all SET deleted_at = NULL WHERE id = $1`, assignment.ID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		assignment.DeletedAt = nil
+		audit.Record(AuditRestore, assignment.ID, "restored assignment %d for user %d with %d commit%s",
+			assignment.ID, assignment.UserID, commits, plural(int(commits)))
+		render.JSON(http.StatusOK, assignment)
+
+	case "commits_all":
+		commit := new(Commit)
+		if err := meddler.QueryRow(tx, commit, query, id, cutoff); err != nil {
+			loggedHTTPDBNotFoundError(w, err)
+			return
+		}
+		var live, taken bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM assignments WHERE id = $1)`, commit.AssignmentID).Scan(&live); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if !live {
+			loggedHTTPErrorf(w, http.StatusConflict, "cannot restore commit %d: restore assignment %d first", commit.ID, commit.AssignmentID)
+			return
+		}
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM commits WHERE assignment_id = $1 AND problem_id = $2 AND step = $3)`,
+			commit.AssignmentID, commit.ProblemID, commit.Step).Scan(&taken); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if taken {
+			loggedHTTPErrorf(w, http.StatusConflict, "cannot restore commit %d: assignment %d has a newer commit for problem %d step %d",
+				commit.ID, commit.AssignmentID, commit.ProblemID, commit.Step)
+			return
+		}
+		if _, err := tx.Exec(`UPDATE commits_all SET deleted_at = NULL WHERE id = $1`, commit.ID); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		commit.DeletedAt = nil
+		audit.Record(AuditRestore, commit.ID, "restored commit for assignment %d problem %d step %d (score %.4f)",
+			commit.AssignmentID, commit.ProblemID, commit.Step, commit.Score)
+		render.JSON(http.StatusOK, commit)
+	}
+}
+
+// purgeDeleted permanently removes objects deleted more than
+// SoftDeleteWindow ago, returning the number of rows removed. Purging a
+// problem removes its steps and everything that refers to them.
+func purgeDeleted(db *sql.DB, now time.Time) (int64, error) {
+	cutoff := now.Add(-SoftDeleteWindow)
+	var total int64
+	for _, table := range []string{"commits_all", "assignments_all", "problems_all"} {
+		result, err := db.Exec(`DELETE FROM `+table+` WHERE deleted_at < $1`, cutoff)
+		if err != nil {
+			return total, err
+		}
+		n, _ := result.RowsAffected()
+		total += n
+	}
+	return total, nil
+}
+
+// startPurgeDeleted runs the purge job once a day.
+func startPurgeDeleted(db *sql.DB) {
+	go func() {
+		for {
+			n, err := purgeDeleted(db, time.Now())
+			if err != nil {
+				log.Printf("error purging deleted objects: %v", err)
+			} else if n > 0 {
+				log.Printf("purged %d deleted object%s", n, plural(int(n)))
+			}
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/gorilla/websocket"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// SolutionCheckTimeout is the longest a daycare is given to run one
+// reference solution.
+const SolutionCheckTimeout = 10 * time.Minute
+
+// storeSolutions saves the author's passing solution for each step of a
+// problem, replacing any that were saved before.
+func storeSolutions(tx *sql.Tx, now time.Time, problemID int64, commits []*Commit) error {
+	for _, commit := range commits {
+		raw, err := json.Marshal(commit.Files)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO problem_solutions (problem_id, step, files, passed, note, checked_at, created_at, updated_at) `+
+			`VALUES ($1, $2, $3, TRUE, NULL, $4, $4, $4) `+
+			`ON CONFLICT (problem_id, step) DO UPDATE SET files = $3, passed = TRUE, note = NULL, checked_at = $4, updated_at = $4`,
+			problemID, commit.Step, raw, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetProblemSolutions handles a request to /v2/problems/:problem_id/solutions,
+// returning the reference solution for each step and the result of the
+// most recent check.
+func GetProblemSolutions(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	solutions := []*ProblemSolution{}
+	if err := meddler.QueryAll(tx, &solutions, `SELECT * FROM problem_solutions WHERE problem_id = $1 ORDER BY step`, problemID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if len(solutions) == 0 {
+		loggedHTTPErrorf(w, http.StatusNotFound, "no reference solutions found for problem %d", problemID)
+		return
+	}
+	render.JSON(http.StatusOK, solutions)
+}
+
+// PostProblemSolutionsCheck handles a request to /v2/problems/:problem_id/solutions/check,
+// running every reference solution for the problem on a daycare and
+// returning the updated results.
+func PostProblemSolutionsCheck(w http.ResponseWriter, tx *sql.Tx, db *sql.DB, params martini.Params, render render.Render) {
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+	problem := new(Problem)
+	if err := meddler.Load(tx, "problems", problem, problemID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	// the commits sent for grading must be committed before they go out
+	solutions, _, err := checkSolutions(db, problem)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadGateway, "error checking solutions for %s: %v", problem.Unique, err)
+		return
+	}
+	if len(solutions) == 0 {
+		loggedHTTPErrorf(w, http.StatusNotFound, "no reference solutions found for problem %d", problemID)
+		return
+	}
+	render.JSON(http.StatusOK, solutions)
+}
+
+// checkSolutions runs every reference solution for a problem and records
+// the results. It also returns the solutions that passed before but fail now.
+// A daycare that cannot be reached is reported as an error rather than as
+// broken solutions.
+func checkSolutions(db meddler.DB, problem *Problem) (solutions, broken []*ProblemSolution, err error) {
+	steps := []*ProblemStep{}
+	if err := meddler.QueryAll(db, &steps, `SELECT * FROM problem_steps WHERE problem_id = $1 ORDER BY step`, problem.ID); err != nil {
+		return nil, nil, err
+	}
+	omitPrechecks(steps...)
+	if err := meddler.QueryAll(db, &solutions, `SELECT * FROM problem_solutions WHERE problem_id = $1 ORDER BY step`, problem.ID); err != nil {
+		return nil, nil, err
+	}
+
+	for _, solution := range solutions {
+		commit, err := runSolution(db, problem, steps, solution)
+		if err != nil {
+			return nil, nil, err
+		}
+		passed := commit.StepPassed()
+		note := ""
+		if commit.ReportCard != nil && !passed {
+			note = commit.ReportCard.Note
+		} else if commit.ReportCard == nil {
+			note = "no report card"
+		}
+		if solution.Passed && !passed {
+			broken = append(broken, solution)
+		}
+		solution.Passed, solution.Note, solution.CheckedAt = passed, note, time.Now()
+		if _, err := db.Exec(`UPDATE problem_solutions SET passed = $1, note = NULLIF($2, ''), checked_at = $3 WHERE problem_id = $4 AND step = $5`,
+			solution.Passed, solution.Note, solution.CheckedAt, solution.ProblemID, solution.Step); err != nil {
+			return nil, nil, err
+		}
+	}
+	return solutions, broken, nil
+}
+
+// runSolution sends one reference solution to a daycare, acting as a
+// client the same way grind does, and returns the graded commit.
+func runSolution(db meddler.DB, problem *Problem, steps []*ProblemStep, solution *ProblemSolution) (*Commit, error) {
+	bundle, err := solutionBundle(db, problem, steps, solution)
+	if err != nil {
+		return nil, err
+	}
+	return gradeBundle(bundle)
+}
+
+// gradeBundle sends a signed commit bundle to a daycare and returns the
+// graded commit.
+func gradeBundle(bundle *CommitBundle) (*Commit, error) {
+	now := time.Now()
+	problem, action := bundle.Problem, bundle.Commit.Action
+
+	host := Config().Hostname
+	if len(Config().DaycareHosts) > 0 {
+		host = Config().DaycareHosts[0]
+	}
+	url := "wss://" + host + "/v2/sockets/" + problem.ProblemType + "/" + action
+	socket, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing %s: %v", url, err)
+	}
+	defer socket.Close()
+	socket.SetReadDeadline(now.Add(SolutionCheckTimeout))
+	if err := socket.WriteJSON(&DaycareRequest{CommitBundle: bundle}); err != nil {
+		return nil, fmt.Errorf("error writing request message: %v", err)
+	}
+	for {
+		reply := new(DaycareResponse)
+		if err := socket.ReadJSON(reply); err != nil {
+			return nil, fmt.Errorf("socket error reading event: %v", err)
+		}
+		switch {
+		case reply.Error != "":
+			return nil, fmt.Errorf("daycare returned an error: %s", reply.Error)
+		case reply.CommitBundle != nil:
+			return reply.CommitBundle.Commit, nil
+		}
+	}
+}
+
+// solutionBundle builds the signed commit bundle that asks a daycare to
+// grade one reference solution, using the confirm action if the problem
+// type has one. The nonce is recorded in db, which must not be a
+// transaction that is still open when the bundle is sent.
+func solutionBundle(db meddler.DB, problem *Problem, steps []*ProblemStep, solution *ProblemSolution) (*CommitBundle, error) {
+	problemType, ok := problemTypes[problem.ProblemType]
+	if !ok {
+		return nil, fmt.Errorf("unknown problem type %q", problem.ProblemType)
+	}
+	action := "confirm"
+	if _, ok := problemType.Actions[action]; !ok {
+		action = "grade"
+	}
+
+	now := time.Now()
+	commit := &Commit{
+		ProblemID: problem.ID,
+		Step:      solution.Step,
+		Action:    action,
+		Note:      "reference solution check",
+		Files:     solution.Files,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := issueCommitNonce(db, now, commit); err != nil {
+		return nil, err
+	}
+	problemSig := problem.ComputeSignature(Config().DaycareSecret, steps)
+	bundle := &CommitBundle{
+		Problem:          problem,
+		ProblemSteps:     steps,
+		ProblemSignature: problemSig,
+		Commit:           commit,
+		CommitSignature:  commit.ComputeSignature(Config().DaycareSecret, problemSig),
+	}
+	return bundle, nil
+}
+
+// startSolutionMaintenance re-runs reference solutions every night and
+// emails authors whose solutions stopped passing. When this server also
+// runs the daycare role, only problems whose container images changed
+// since the last check are re-run; otherwise every solution is checked.
+func startSolutionMaintenance(db *sql.DB) {
+	go func() {
+		images := make(map[string]string)
+		for {
+			time.Sleep(24 * time.Hour)
+
+			problems := []*Problem{}
+			if err := meddler.QueryAll(db, &problems, `SELECT * FROM problems WHERE id IN (SELECT problem_id FROM problem_solutions) ORDER BY id`); err != nil {
+				log.Printf("error loading problems with reference solutions: %v", err)
+				continue
+			}
+			changed := make(map[string]bool)
+			for name, problemType := range problemTypes {
+				id := problemTypeImageIDs(problemType)
+				changed[name] = id == "" || id != images[name]
+				images[name] = id
+			}
+
+			count := 0
+			for _, problem := range problems {
+				if !changed[problem.ProblemType] {
+					continue
+				}
+				_, broken, err := checkSolutions(db, problem)
+				if err != nil {
+					log.Printf("error checking reference solutions for %s: %v", problem.Unique, err)
+					continue
+				}
+				count++
+				if len(broken) > 0 {
+					notifyBrokenSolutions(db, problem, broken)
+				}
+			}
+			log.Printf("checked reference solutions for %d problem(s)", count)
+		}
+	}()
+}
+
+// problemTypeImageIDs identifies the current images for a problem type,
+// or returns "" if this server cannot see them.
+func problemTypeImageIDs(problemType *ProblemType) string {
+	if dockerClient == nil {
+		return ""
+	}
+	var ids []string
+	for _, image := range problemTypeImages(problemType) {
+		info, err := dockerClient.InspectImage(image)
+		if err != nil {
+			return ""
+		}
+		ids = append(ids, info.ID)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// notifyBrokenSolutions emails the author of a problem about reference
+// solutions that no longer pass.
+func notifyBrokenSolutions(db meddler.DB, problem *Problem, broken []*ProblemSolution) {
+	log.Printf("reference solution for %s failed on %d step(s)", problem.Unique, len(broken))
+	if problem.AuthorID == 0 {
+		return
+	}
+	author := new(User)
+	if err := meddler.Load(db, "users", author, problem.AuthorID); err != nil {
+		log.Printf("error loading author %d of %s: %v", problem.AuthorID, problem.Unique, err)
+		return
+	}
+	body := new(strings.Builder)
+	fmt.Fprintf(body, "The reference solution for problem %s no longer passes.\n", problem.Unique)
+	fmt.Fprintf(body, "This usually means the %s container image has changed.\n\n", problem.ProblemType)
+	for _, solution := range broken {
+		fmt.Fprintf(body, "Step %d: %s\n", solution.Step, solution.Note)
+	}
+	fmt.Fprintf(body, "\nUse \"grind create --dry-run\" to test an updated version of the problem.\n")
+	if err := sendMessage(author, "Reference solution for "+problem.Unique+" no longer passes", body.String()); err != nil {
+		log.Printf("error notifying %s about %s: %v", author.Email, problem.Unique, err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// SQL problems give the schema and seed data in schema/*.sql, which are
+// loaded in name order, and the expected result of each query in
+// expected/<name>.out. The student writes each query in <name>.sql. Every
+// query runs against a fresh database so one cannot affect another, and
+// its result is printed as CSV with a header line and compared with the
+// expected output, which may use the directives described by
+// ExpectedOutputDirective. With the "unordered" problem option, the rows
+// after the header may come back in any order.
+
+// SQLUnorderedOption is the problem option that ignores row order.
+const SQLUnorderedOption = "unordered"
+
+// sqlEngine gives the shell commands to run against one kind of database.
+type sqlEngine struct {
+	// reset creates an empty database, discarding any earlier one
+	reset string
+
+	// load reads SQL from standard input into the database
+	load string
+
+	// query runs the SQL in the named file, printing the result as CSV
+	query string
+}
+
+var sqliteEngine = &sqlEngine{
+	reset: "rm -f /tmp/grade.db",
+	load:  "sqlite3 -bail /tmp/grade.db",
+	query: "sqlite3 -bail -header -csv /tmp/grade.db < %s",
+}
+
+var postgresEngine = &sqlEngine{
+	reset: "PGHOST=db PGUSER=postgres psql -v ON_ERROR_STOP=1 -q -d postgres -c 'DROP DATABASE IF EXISTS grade' -c 'CREATE DATABASE grade'",
+	load:  "PGHOST=db PGUSER=postgres psql -v ON_ERROR_STOP=1 -q -d grade",
+	query: "PGHOST=db PGUSER=postgres psql -v ON_ERROR_STOP=1 -q --csv -d grade -f %s",
+}
+
+func init() {
+	problemTypes["sqlite"] = &ProblemType{
+		Name:        "sqlite",
+		Image:       "codegrinder/sql",
+		MaxCPU:      10,
+		MaxFD:       10,
+		MaxFileSize: 10,
+		MaxMemory:   64,
+		MaxThreads:  20,
+		Actions: map[string]*ProblemTypeAction{
+			"grade": &ProblemTypeAction{
+				Action:  "grade",
+				Button:  "Grade",
+				Message: "Grading‥",
+				Class:   "btn-grade",
+				Handler: nannyHandler(sqlGrader(sqliteEngine)),
+			},
+			"": &ProblemTypeAction{
+				Action: "",
+				Button: "Save",
+				Class:  "btn-save",
+			},
+			"confirm": &ProblemTypeAction{
+				Action:  "confirm",
+				Handler: nannyHandler(sqlGrader(sqliteEngine)),
+			},
+		},
+	}
+	problemTypes["postgres"] = &ProblemType{
+		Name:        "postgres",
+		Image:       "codegrinder/sql",
+		MaxCPU:      10,
+		MaxFD:       10,
+		MaxFileSize: 10,
+		MaxMemory:   64,
+		MaxThreads:  20,
+		Actions: map[string]*ProblemTypeAction{
+			"grade": &ProblemTypeAction{
+				Action:  "grade",
+				Button:  "Grade",
+				Message: "Grading‥",
+				Class:   "btn-grade",
+				Handler: nannyHandler(sqlGrader(postgresEngine)),
+			},
+			"": &ProblemTypeAction{
+				Action: "",
+				Button: "Save",
+				Class:  "btn-save",
+			},
+			"confirm": &ProblemTypeAction{
+				Action:  "confirm",
+				Handler: nannyHandler(sqlGrader(postgresEngine)),
+			},
+		},
+		Services: []*ProblemTypeService{
+			&ProblemTypeService{
+				Name:          "db",
+				Image:         "postgres:16-alpine",
+				Ports:         []int{5432},
+				Env:           []string{"POSTGRES_HOST_AUTH_METHOD=trust"},
+				HealthCheck:   []string{"pg_isready", "-U", "postgres"},
+				HealthTimeout: 60,
+			},
+		},
+	}
+}
+
+// sqlGrader returns a handler that grades SQL queries using an engine.
+func sqlGrader(engine *sqlEngine) func(*Nanny, []string, []string, map[string]string) {
+	return func(n *Nanny, args []string, options []string, files map[string]string) {
+		log.Printf("sqlGrade")
+
+		// find the schema files and the queries
+		var schema, queries []string
+		for name := range files {
+			switch {
+			case strings.HasPrefix(name, "schema/") && strings.HasSuffix(name, ".sql"):
+				schema = append(schema, name)
+			case strings.HasPrefix(name, "expected/") && strings.HasSuffix(name, ".out"):
+				queries = append(queries, strings.TrimSuffix(strings.TrimPrefix(name, "expected/"), ".out"))
+			}
+		}
+		sort.Strings(schema)
+		sort.Strings(queries)
+		if len(queries) == 0 {
+			n.ReportCard.LogAndFailf("no expected query results found in expected/")
+			return
+		}
+		unordered := false
+		for _, option := range options {
+			if option == SQLUnorderedOption {
+				unordered = true
+			}
+		}
+
+		// put the files in the container
+		if err := n.PutFiles(files); err != nil {
+			n.ReportCard.LogAndFailf("PutFiles error: %v", err)
+			return
+		}
+
+		failed := 0
+		for _, name := range queries {
+			query := name + ".sql"
+			if _, ok := files[query]; !ok {
+				failed++
+				n.ReportCard.AddFailedResult(name, htmlEscapePara(fmt.Sprintf("%s not found", query)), "")
+				continue
+			}
+			contents := files["expected/"+name+".out"]
+			if unordered {
+				contents = unorderedRows(contents)
+			}
+			expected, err := ParseExpectedOutput(contents)
+			if err != nil {
+				n.ReportCard.LogAndFailf("error in expected/%s.out: %v", name, err)
+				return
+			}
+
+			// start from a fresh database
+			setup := engine.reset
+			if len(schema) > 0 {
+				setup += " && cat " + strings.Join(schema, " ") + " | " + engine.load
+			}
+			_, stderr, _, status, err := n.ExecNonInteractive([]string{"sh", "-c", setup})
+			if err != nil {
+				n.ReportCard.LogAndFailf("exec error: %v", err)
+				return
+			}
+			if status != 0 {
+				n.ReportCard.LogAndFailf("error creating the database: %s", strings.TrimSpace(stderr.String()))
+				return
+			}
+
+			// run the query and compare the result
+			stdout, stderr, _, status, err := n.ExecNonInteractive([]string{"sh", "-c", fmt.Sprintf(engine.query, query)})
+			if err != nil {
+				n.ReportCard.LogAndFailf("exec error: %v", err)
+				return
+			}
+			if status != 0 {
+				failed++
+				n.ReportCard.AddFailedResult(name, "<h1>Query failed</h1>\n"+htmlEscapePre(stderr.String()), query)
+				continue
+			}
+			passed, msg := expected.Match(stdout.String())
+			if passed {
+				n.ReportCard.AddPassedResult(name, htmlEscapePara("result matched"))
+				continue
+			}
+			failed++
+			details := "<h1>Result did not match</h1>\n" + htmlEscapePara(msg) + htmlEscapePre(stdout.String())
+			n.ReportCard.AddFailedResult(name, details, query)
+		}
+		n.ReportCard.Duration = time.Since(n.Start)
+		if n.ReportCard.Note == "" {
+			n.ReportCard.Note = fmt.Sprintf("%d/%d queries passed in %v", len(n.ReportCard.Results)-failed, len(n.ReportCard.Results), n.ReportCard.Duration)
+		}
+	}
+}
+
+// unorderedRows wraps the rows after the header line of an expected result
+// in an unordered block.
+func unorderedRows(contents string) string {
+	lines := strings.SplitAfterN(contents, "\n", 2)
+	if len(lines) < 2 || strings.TrimSpace(lines[1]) == "" {
+		return contents
+	}
+	rows := lines[1]
+	if !strings.HasSuffix(rows, "\n") {
+		rows += "\n"
+	}
+	return lines[0] + ExpectedOutputDirective + " unordered\n" + rows + ExpectedOutputDirective + " end\n"
+}
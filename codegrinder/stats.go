@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// MaxCommonErrors is how many error messages the assignment stats list.
+const MaxCommonErrors = 10
+
+// MaxErrorMessageLength is where error messages are cut off before they
+// are counted.
+const MaxErrorMessageLength = 200
+
+var (
+	// errorLine matches a line of test output that reports an error, e.g.,
+	// a Python exception, a javac error, or a rustc error
+	errorLine = regexp.MustCompile(`^\s*(?:\S+:\d+: )?((?:[\w.]+(?:Error|Exception)\b|error(?:\[\w+\])?:).*)$`)
+
+	// errorNumber matches the numbers in an error message that differ
+	// from one student to the next, such as line numbers and values
+	errorNumber = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+)
+
+// extractErrorMessages finds the distinct error messages in a transcript.
+func extractErrorMessages(transcript []*EventMessage) []string {
+	seen := make(map[string]bool)
+	var messages []string
+	add := func(line string) {
+		groups := errorLine.FindStringSubmatch(line)
+		if groups == nil {
+			return
+		}
+		msg := errorNumber.ReplaceAllString(strings.TrimSpace(groups[1]), "N")
+		if len(msg) > MaxErrorMessageLength {
+			msg = msg[:MaxErrorMessageLength]
+		}
+		if !seen[msg] {
+			seen[msg] = true
+			messages = append(messages, msg)
+		}
+	}
+	for _, event := range transcript {
+		switch event.Event {
+		case "stdout", "stderr":
+			for _, line := range strings.Split(event.StreamData, "\n") {
+				add(line)
+			}
+		case "error":
+			add("error: " + event.Error)
+		}
+	}
+	return messages
+}
+
+// GetAssignmentStats handles a request to /v2/assignments/:assignment_id/stats,
+// summarizing how every student in the course did on the assignment: the
+// distribution of scores, graded submissions and time spent per student,
+// the tests failed most often, and the most common error messages in the
+// transcripts of failed submissions. Any student's assignment ID for the
+// assignment will do. Instructor work is not counted.
+func GetAssignmentStats(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	problemSet := new(ProblemSet)
+	if err := meddler.Load(tx, "problem_sets", problemSet, assignment.ProblemSetID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	stats := &AssignmentStats{
+		CourseID:     assignment.CourseID,
+		ProblemSetID: assignment.ProblemSetID,
+		Unique:       problemSet.Unique,
+		ScoreBuckets: make([]int, 10),
+		PerStudent:   []*StudentStats{},
+		TestFailures: []*TestFailureStat{},
+		CommonErrors: []*ErrorStat{},
+	}
+
+	// scores, attempts, and time from first to final commit
+	rows, err := tx.Query(`SELECT assignments.id, users.id, users.name, users.canvas_login, COALESCE(score_overrides.score, assignments.score, 0), `+
+		`(SELECT COUNT(*) FROM action_runs WHERE action_runs.course_id = assignments.course_id AND action_runs.user_id = assignments.user_id `+
+		`AND action_runs.action = 'grade' AND action_runs.problem_id IN `+
+		`(SELECT problem_id FROM problem_set_problems WHERE problem_set_id = assignments.problem_set_id)), `+
+		`COALESCE((SELECT EXTRACT(EPOCH FROM MAX(commits.updated_at) - MIN(commits.created_at))::bigint / 60 `+
+		`FROM commits WHERE commits.assignment_id = assignments.id), 0) `+
+		`FROM assignments JOIN users ON assignments.user_id = users.id `+
+		`LEFT JOIN score_overrides ON score_overrides.assignment_id = assignments.id `+
+		`WHERE assignments.course_id = $1 AND assignments.problem_set_id = $2 AND NOT assignments.instructor `+
+		`ORDER BY users.name, users.id`, assignment.CourseID, assignment.ProblemSetID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	defer rows.Close()
+	var scores []float64
+	var attempts, minutes []int
+	for rows.Next() {
+		elt := new(StudentStats)
+		if err := rows.Scan(&elt.AssignmentID, &elt.UserID, &elt.Name, &elt.Login, &elt.Score, &elt.Attempts, &elt.Minutes); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		stats.PerStudent = append(stats.PerStudent, elt)
+		bucket := int(elt.Score * 10)
+		if bucket > 9 {
+			bucket = 9
+		} else if bucket < 0 {
+			bucket = 0
+		}
+		stats.ScoreBuckets[bucket]++
+		scores = append(scores, elt.Score)
+		attempts = append(attempts, elt.Attempts)
+		minutes = append(minutes, elt.Minutes)
+	}
+	if err := rows.Err(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	rows.Close()
+	stats.Students = len(scores)
+	if len(scores) > 0 {
+		total := 0.0
+		for _, score := range scores {
+			total += score
+		}
+		stats.MeanScore = total / float64(len(scores))
+		sort.Float64s(scores)
+		if mid := len(scores) / 2; len(scores)%2 == 1 {
+			stats.MedianScore = scores[mid]
+		} else {
+			stats.MedianScore = (scores[mid-1] + scores[mid]) / 2
+		}
+		stats.Attempts = summarizeInts(attempts)
+		stats.Minutes = summarizeInts(minutes)
+	}
+
+	// the tests failed most often
+	rows, err = tx.Query(`SELECT problems.unique_id, test_failures.step, test_failures.test, SUM(test_failures.failures), COUNT(DISTINCT test_failures.assignment_id) `+
+		`FROM test_failures JOIN assignments ON test_failures.assignment_id = assignments.id `+
+		`JOIN problems ON test_failures.problem_id = problems.id `+
+		`WHERE assignments.course_id = $1 AND assignments.problem_set_id = $2 AND NOT assignments.instructor `+
+		`GROUP BY problems.unique_id, test_failures.step, test_failures.test `+
+		`ORDER BY 4 DESC, problems.unique_id, test_failures.step, test_failures.test`, assignment.CourseID, assignment.ProblemSetID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		elt := new(TestFailureStat)
+		if err := rows.Scan(&elt.Unique, &elt.Step, &elt.Test, &elt.Failures, &elt.Students); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		stats.TestFailures = append(stats.TestFailures, elt)
+	}
+	if err := rows.Err(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	rows.Close()
+
+	// error messages from the transcripts of failed submissions, read a
+	// batch at a time since transcripts can be large
+	cursor, err := newBatchCursor(r.Context(), tx, "", `SELECT commits.id, commits.assignment_id, commits.transcript `+
+		`FROM commits JOIN assignments ON commits.assignment_id = assignments.id `+
+		`WHERE assignments.course_id = $1 AND assignments.problem_set_id = $2 AND NOT assignments.instructor `+
+		`AND COALESCE(commits.score, 0) < 1 AND octet_length(commits.transcript) > 0 `+
+		`AND commits.id > $3 ORDER BY commits.id LIMIT $4`, assignment.CourseID, assignment.ProblemSetID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	counts := make(map[string]*ErrorStat)
+	students := make(map[string]map[int64]bool)
+	scan := func(rows *sql.Rows) (int64, error) {
+		var commitID, studentAssignmentID int64
+		var raw []byte
+		if err := rows.Scan(&commitID, &studentAssignmentID, &raw); err != nil {
+			return 0, err
+		}
+		var transcript []*EventMessage
+		if err := (TranscriptMeddler{}).PostRead(&transcript, &raw); err != nil {
+			return 0, fmt.Errorf("decoding transcript of commit %d: %v", commitID, err)
+		}
+		for _, msg := range extractErrorMessages(transcript) {
+			elt := counts[msg]
+			if elt == nil {
+				elt = &ErrorStat{Message: msg}
+				counts[msg] = elt
+				students[msg] = make(map[int64]bool)
+			}
+			elt.Count++
+			students[msg][studentAssignmentID] = true
+		}
+		return commitID, nil
+	}
+	for {
+		n, err := cursor.Next(r.Context(), scan)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		} else if n == 0 {
+			break
+		}
+	}
+	for msg, elt := range counts {
+		elt.Students = len(students[msg])
+		stats.CommonErrors = append(stats.CommonErrors, elt)
+	}
+	sort.Slice(stats.CommonErrors, func(i, j int) bool {
+		a, b := stats.CommonErrors[i], stats.CommonErrors[j]
+		if a.Students != b.Students {
+			return a.Students > b.Students
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Message < b.Message
+	})
+	if len(stats.CommonErrors) > MaxCommonErrors {
+		stats.CommonErrors = stats.CommonErrors[:MaxCommonErrors]
+	}
+
+	render.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// GetAssignmentStudentView handles a request to /v2/assignments/:assignment_id/student_view,
+// returning what the student currently sees for the assignment: the released
+// steps of each problem with the student's variant applied, the current step,
+// and the files the student would be working on.
+// Unlike impersonation, this does not touch the instructor's session and
+// cannot change anything.
+// Only TAs and instructors for the course and administrators may see this.
+func GetAssignmentStudentView(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	view := &StudentView{Assignment: assignment, User: new(User), ProblemSet: new(ProblemSet)}
+	if err := meddler.Load(tx, "users", view.User, assignment.UserID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading user %d: %v", assignment.UserID, err)
+		return
+	}
+	if err := meddler.Load(tx, "problem_sets", view.ProblemSet, assignment.ProblemSetID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading problem set %d: %v", assignment.ProblemSetID, err)
+		return
+	}
+
+	problemSetProblems := []*ProblemSetProblem{}
+	if err := meddler.QueryAll(tx, &problemSetProblems, `SELECT * FROM problem_set_problems WHERE problem_set_id = $1 ORDER BY problem_id`, assignment.ProblemSetID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	for _, elt := range problemSetProblems {
+		problemView, err := studentProblemView(tx, assignment, elt.ProblemID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error building view of problem %d: %v", elt.ProblemID, err)
+			return
+		}
+		view.Problems = append(view.Problems, problemView)
+	}
+
+	render.JSON(http.StatusOK, view)
+}
+
+// studentProblemView works out what a student sees for one problem,
+// following the same rules grind get uses to pick the current step.
+func studentProblemView(tx *sql.Tx, assignment *Assignment, problemID int64) (*StudentProblemView, error) {
+	problem := new(Problem)
+	if err := meddler.Load(tx, "problems", problem, problemID); err != nil {
+		return nil, err
+	}
+	steps := []*ProblemStep{}
+	if err := meddler.QueryAll(tx, &steps, `SELECT * FROM problem_steps WHERE problem_id = $1 ORDER BY step`, problemID); err != nil {
+		return nil, err
+	}
+	omitPrechecks(steps...)
+
+	view := &StudentProblemView{
+		Problem:     problem,
+		Variant:     problem.ChooseVariant(assignment.UserID),
+		StepCount:   int64(len(steps)),
+		CurrentStep: 1,
+		Files:       make(map[string]string),
+	}
+
+	// the most recent commit determines the current step
+	commit := new(Commit)
+	err := meddler.QueryRow(tx, commit, `SELECT * FROM commits WHERE assignment_id = $1 AND problem_id = $2 ORDER BY step DESC, created_at DESC LIMIT 1`,
+		assignment.ID, problemID)
+	switch {
+	case err == sql.ErrNoRows:
+		commit = nil
+	case err != nil:
+		return nil, err
+	default:
+		if err := loadCommitFiles(tx, commit); err != nil {
+			return nil, err
+		}
+		view.LastCommit = commit
+		view.CurrentStep = commit.Step
+		if commit.StepPassed() && commit.Step < view.StepCount {
+			view.CurrentStep++
+		}
+	}
+
+	for _, step := range steps {
+		if step.Step > view.CurrentStep {
+			view.Locked = append(view.Locked, fmt.Sprintf("step %d is locked until step %d is passed", step.Step, step.Step-1))
+			continue
+		}
+		step.Files = step.VariantFiles(view.Variant)
+		view.Steps = append(view.Steps, step)
+	}
+
+	// the working files are the current step's files overlaid with the student's own
+	if view.CurrentStep <= int64(len(view.Steps)) {
+		for name, contents := range view.Steps[view.CurrentStep-1].Files {
+			view.Files[name] = contents
+		}
+	}
+	if commit != nil && commit.Step == view.CurrentStep {
+		for name, contents := range commit.Files {
+			view.Files[name] = contents
+		}
+	}
+	return view, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// Problem types with a style checker offer a "stylecheck" action that runs
+// the linters for the language on the student's files and lists what they
+// find. Running it does not change the student's score.
+//
+// A problem can also check style when it is graded:
+//
+//	style=warn                  findings are listed as warnings
+//	style=deduct                each finding also costs 0.02 of the step
+//	style-deduct=<fraction>     the cost of each finding
+//	style-max=<fraction>        the most a step can lose, 0.2 by default
+//	style=part                  style is scored as a separate "style" part
+//
+// Deductions lower the score but do not keep a student from moving on to
+// the next step. As a part, style starts at full marks and each finding
+// costs 0.1 of the part, up to all of it. The part counts for a quarter
+// as much as the tests unless weight-style= says otherwise.
+
+// StyleCheckAction is the name of the style checking action.
+const StyleCheckAction = "stylecheck"
+
+const (
+	StyleOption          = "style="
+	StyleDeductionOption = "style-deduct="
+	StyleMaxOption       = "style-max="
+
+	DefaultStyleDeduction = 0.02
+	DefaultStyleMax       = 0.2
+
+	StylePart                 = "style"
+	DefaultStylePartWeight    = 0.25
+	DefaultStylePartDeduction = 0.1
+	DefaultStylePartMax       = 1.0
+)
+
+// styleChecker describes how to check style for one language. Command is
+// run with sh -c after the student's files are substituted for $FILES,
+// and every line of its combined output of the form file:line[:col]: message
+// is a finding. Formatter is run the same way to rewrite the files in
+// place when a problem asks for automatic formatting.
+type styleChecker struct {
+	Language   string
+	Extensions []string
+	Command    string
+	Formatter  string
+}
+
+var (
+	pythonStyle = &styleChecker{
+		Language:   "Python",
+		Extensions: []string{".py"},
+		Command:    "flake8 $FILES 2>&1",
+		Formatter:  "black --quiet $FILES",
+	}
+	goStyle = &styleChecker{
+		Language:   "Go",
+		Extensions: []string{".go"},
+		Command:    "gofmt -l $FILES | sed 's/$/:1: file is not formatted with gofmt/'; go vet ./... 2>&1",
+		Formatter:  "gofmt -w $FILES",
+	}
+	cStyle = &styleChecker{
+		Language:   "C",
+		Extensions: []string{".c", ".h", ".cpp", ".hpp", ".cc"},
+		Command:    "clang-format --dry-run $FILES 2>&1; clang-tidy --quiet $FILES -- 2>&1",
+		Formatter:  "clang-format -i $FILES",
+	}
+)
+
+// styleCheckers gives the style checker for each problem type that has one.
+// A problem type also needs a stylecheck action whose handler is
+// styleCheckGrade before students can run it.
+var styleCheckers = map[string]*styleChecker{
+	"python27unittest": pythonStyle,
+	"python27inout":    pythonStyle,
+	"gotest":           goStyle,
+	"cppgtest":         cStyle,
+	"cppinout":         cStyle,
+}
+
+var styleFindingLine = regexp.MustCompile(`^(?:\./)?([^\s:]+):(\d+):(?:\d+:)? *(.*)$`)
+
+// styleFinding is one problem reported by a style checker.
+type styleFinding struct {
+	File    string
+	Line    string
+	Message string
+}
+
+// styleFiles returns the student's files that a style checker applies to,
+// sorted.
+func styleFiles(checker *styleChecker, files map[string]string) []string {
+	var names []string
+	for name := range files {
+		if strings.HasPrefix(name, "tests/") {
+			continue
+		}
+		for _, ext := range checker.Extensions {
+			if strings.HasSuffix(name, ext) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// styleCommand substitutes a list of files for $FILES in a command.
+func styleCommand(command string, names []string) string {
+	var quoted []string
+	for _, name := range names {
+		quoted = append(quoted, "'"+name+"'")
+	}
+	return strings.Replace(command, "$FILES", strings.Join(quoted, " "), -1)
+}
+
+// runStyleCheck runs the style checker for a problem type on the student's
+// files, which must already be in the container.
+func runStyleCheck(n *Nanny, checker *styleChecker, files map[string]string) ([]*styleFinding, error) {
+	names := styleFiles(checker, files)
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	cmd := styleCommand(checker.Command, names)
+	stdout, _, _, _, err := n.ExecNonInteractive([]string{"sh", "-c", cmd})
+	if err != nil {
+		return nil, err
+	}
+	var findings []*styleFinding
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if groups := styleFindingLine.FindStringSubmatch(strings.TrimSpace(line)); groups != nil {
+			findings = append(findings, &styleFinding{File: groups[1], Line: groups[2], Message: groups[3]})
+		}
+	}
+	return findings, nil
+}
+
+// addStyleFindings lists style findings on the report card as warnings.
+func addStyleFindings(card *ReportCard, findings []*styleFinding) {
+	for _, finding := range findings {
+		context := finding.File + ":" + finding.Line
+		card.AddWarningResult("style: "+context, htmlEscapePara(finding.Message), context)
+	}
+}
+
+// styleCheckGrade is the handler for the stylecheck action.
+func styleCheckGrade(n *Nanny, args []string, options []string, files map[string]string) {
+	log.Printf("styleCheckGrade")
+
+	checker := styleCheckers[n.ProblemType.Name]
+	if checker == nil {
+		n.ReportCard.LogAndFailf("no style checker for problem type %s", n.ProblemType.Name)
+		return
+	}
+	if err := n.PutFiles(files); err != nil {
+		n.ReportCard.LogAndFailf("PutFiles error: %v", err)
+		return
+	}
+	findings, err := runStyleCheck(n, checker, files)
+	if err != nil {
+		n.ReportCard.LogAndFailf("exec error: %v", err)
+		return
+	}
+	addStyleFindings(n.ReportCard, findings)
+	n.ReportCard.Note = fmt.Sprintf("%s style check found %d problem%s", checker.Language, len(findings), plural(len(findings)))
+}
+
+// gradeStyle checks style after a grading action if the problem asks for
+// it, adding warnings and any deduction to the report card.
+func gradeStyle(n *Nanny, options []string, files map[string]string) {
+	checker := styleCheckers[n.ProblemType.Name]
+	mode := ""
+	var deduction, max *float64
+	for _, option := range options {
+		var err error
+		var value float64
+		switch {
+		case strings.HasPrefix(option, StyleOption):
+			mode = strings.TrimPrefix(option, StyleOption)
+		case strings.HasPrefix(option, StyleDeductionOption):
+			value, err = strconv.ParseFloat(strings.TrimPrefix(option, StyleDeductionOption), 64)
+			deduction = &value
+		case strings.HasPrefix(option, StyleMaxOption):
+			value, err = strconv.ParseFloat(strings.TrimPrefix(option, StyleMaxOption), 64)
+			max = &value
+		}
+		if err != nil {
+			n.ReportCard.LogAndFailf("invalid problem option %q: %v", option, err)
+			return
+		}
+	}
+	if mode == "" || checker == nil {
+		return
+	}
+	if mode != "warn" && mode != "deduct" && mode != "part" {
+		n.ReportCard.LogAndFailf("invalid problem option %q: must be warn, deduct, or part", StyleOption+mode)
+		return
+	}
+	if deduction == nil {
+		value := DefaultStyleDeduction
+		if mode == "part" {
+			value = DefaultStylePartDeduction
+		}
+		deduction = &value
+	}
+	if max == nil {
+		value := DefaultStyleMax
+		if mode == "part" {
+			value = DefaultStylePartMax
+		}
+		max = &value
+	}
+
+	// the grader already put the files in the container
+	findings, err := runStyleCheck(n, checker, files)
+	if err != nil {
+		n.ReportCard.LogAndFailf("exec error: %v", err)
+		return
+	}
+	card := n.ReportCard
+	if mode == "part" {
+		// a clean part still shows up in the breakdown
+		card = n.ReportCard.AddPart(StylePart, DefaultStylePartWeight)
+		card.Note = fmt.Sprintf("%d style problem%s", len(findings), plural(len(findings)))
+	}
+	if len(findings) == 0 {
+		return
+	}
+	addStyleFindings(card, findings)
+	note := fmt.Sprintf("%d style problem%s", len(findings), plural(len(findings)))
+	if mode != "warn" {
+		card.StyleDeduction = *deduction * float64(len(findings))
+		if card.StyleDeduction > *max {
+			card.StyleDeduction = *max
+		}
+		note += fmt.Sprintf(" (-%.0f%%)", card.StyleDeduction*100)
+	}
+	if mode == "part" {
+		card.Note = note
+		return
+	}
+	if n.ReportCard.Note != "" {
+		n.ReportCard.Note += ", "
+	}
+	n.ReportCard.Note += note
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// TAs help grade a course without running it. A TA can see the commits,
+// transcripts, and report cards of every student in the course, comment on
+// commits, and start regrades, but cannot delete commits, edit problems,
+// or change the course settings or LTI configuration, all of which need
+// an instructor, an author, or an administrator. Instructors manage the
+// TAs of their course here; a TA is a course staff role (see rbac.go).
+
+// GetCourseTAs handles a request to /v2/courses/:course_id/tas,
+// returning the TAs of a course.
+func GetCourseTAs(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	roles := []*CourseRole{}
+	if err := meddler.QueryAll(tx, &roles, `SELECT * FROM course_roles WHERE course_id = $1 AND role = $2 ORDER BY user_id`, courseID, RoleTA); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, roles)
+}
+
+// PutCourseTA handles a request to /v2/courses/:course_id/tas/:user_id,
+// making a user a TA in a course. A user who is already an instructor of
+// the course through the LMS keeps that role.
+func PutCourseTA(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *AuditEntry, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	userID, err := parseID(w, "user_id", params["user_id"])
+	if err != nil {
+		return
+	}
+	user := new(User)
+	if err := meddler.Load(tx, "users", user, userID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	role, err := grantCourseRole(tx, courseID, user, RoleTA, currentUser, time.Now())
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditRequest, courseID, "course %d: user %d (%s) given the %s role", courseID, user.ID, user.Name, role.Role)
+	render.JSON(http.StatusOK, role)
+}
+
+// DeleteCourseTA handles a request to /v2/courses/:course_id/tas/:user_id,
+// removing a TA from a course.
+func DeleteCourseTA(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *AuditEntry) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	userID, err := parseID(w, "user_id", params["user_id"])
+	if err != nil {
+		return
+	}
+	result, err := tx.Exec(`DELETE FROM course_roles WHERE course_id = $1 AND user_id = $2 AND role = $3`, courseID, userID, RoleTA)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		loggedHTTPErrorf(w, http.StatusNotFound, "user %d is not a TA in course %d", userID, courseID)
+		return
+	}
+	audit.Record(AuditRequest, courseID, "course %d: user %d is no longer a TA", courseID, userID)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// tokenPrefix marks API tokens so they are easy to recognize, e.g., when a
+// user pastes one into grind init.
+const tokenPrefix = "cgt_"
+
+// newTokenSecret generates a new random API token.
+func newTokenSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// hashToken returns the form of an API token that is stored in the database.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken extracts an API token from the Authorization header,
+// returning "" if there is none.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(header[len("Bearer "):])
+	}
+	return ""
+}
+
+// loadAPIToken finds the token matching a secret and notes that it was used.
+func loadAPIToken(db *sql.DB, secret string) (*APIToken, error) {
+	token := new(APIToken)
+	if err := meddler.QueryRow(db, token, `SELECT * FROM api_tokens WHERE token_hash = $1`, hashToken(secret)); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`UPDATE api_tokens SET last_used_at = $1 WHERE id = $2`, time.Now(), token.ID); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// applyTokenScope limits a user to the privileges granted by a token's scope.
+// There is no chair scope, so only an admin token reaches chair routes.
+func applyTokenScope(user *User, token *APIToken) {
+	user.TokenScope = token.Scope
+	switch token.Scope {
+	case TokenScopeStudent:
+		user.Admin = false
+		user.Author = false
+		user.Chair = false
+	case TokenScopeInstructor:
+		user.Admin = false
+		user.Chair = false
+	}
+}
+
+// PostUserMeToken handles a request to /v2/users/me/tokens,
+// creating a new API token for the current user and returning it.
+// This is the only time the token itself is revealed.
+//
+// The scope defaults to student. A user may not create a token with
+// privileges the user does not have.
+func PostUserMeToken(w http.ResponseWriter, tx *sql.Tx, currentUser *User, token APIToken, audit *AuditEntry, render render.Render) {
+	token.Name = strings.TrimSpace(token.Name)
+	if token.Name == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "a token must have a name")
+		return
+	}
+	switch token.Scope {
+	case "":
+		token.Scope = TokenScopeStudent
+	case TokenScopeStudent:
+	case TokenScopeInstructor:
+		if !currentUser.Admin && !currentUser.Author {
+			instructor, err := isAnyInstructor(tx, currentUser.ID)
+			if err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			if !instructor || currentUser.TokenScope == TokenScopeStudent {
+				loggedHTTPErrorf(w, http.StatusForbidden, "user %d (%s) cannot create an instructor token", currentUser.ID, currentUser.Name)
+				return
+			}
+		}
+	case TokenScopeAdmin:
+		if !currentUser.Admin {
+			loggedHTTPErrorf(w, http.StatusForbidden, "user %d (%s) cannot create an admin token", currentUser.ID, currentUser.Name)
+			return
+		}
+	default:
+		loggedHTTPErrorf(w, http.StatusBadRequest, "scope must be %q, %q, or %q", TokenScopeStudent, TokenScopeInstructor, TokenScopeAdmin)
+		return
+	}
+
+	// a token must not carry chair rights unless its scope grants them
+	scoped := *currentUser
+	applyTokenScope(&scoped, &token)
+	if scoped.Chair && !scoped.Admin {
+		loggedHTTPErrorf(w, http.StatusForbidden, "a %s token cannot carry department chair rights", token.Scope)
+		return
+	}
+
+	secret, err := newTokenSecret()
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error generating token: %v", err)
+		return
+	}
+	token.ID = 0
+	token.UserID = currentUser.ID
+	token.Token = ""
+	token.TokenHash = hashToken(secret)
+	token.CreatedAt = time.Now()
+	token.LastUsedAt = time.Time{}
+	if err := meddler.Insert(tx, "api_tokens", &token); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditRequest, token.ID, "created %s token %q", token.Scope, token.Name)
+
+	token.Token = secret
+	render.JSON(http.StatusOK, &token)
+}
+
+// PostUserMeTokenExchange handles a request to /v2/users/me/tokens/exchange,
+// trading the session cookie of an older grind config for an API token. It
+// only accepts a session cookie. The scope defaults to the most the user is
+// allowed, as the cookie had, and a token with the same name from an earlier
+// exchange is revoked so a retried exchange does not leave tokens behind.
+func PostUserMeTokenExchange(w http.ResponseWriter, tx *sql.Tx, currentUser *User, authToken *APIToken, request APIToken, audit *AuditEntry, render render.Render) {
+	if authToken != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "only a session cookie can be exchanged for an API token")
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "a token must have a name")
+		return
+	}
+	if request.Scope == "" {
+		switch {
+		case currentUser.Admin:
+			request.Scope = TokenScopeAdmin
+		case currentUser.Author:
+			request.Scope = TokenScopeInstructor
+		default:
+			instructor, err := isAnyInstructor(tx, currentUser.ID)
+			if err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+				return
+			}
+			request.Scope = TokenScopeStudent
+			if instructor {
+				request.Scope = TokenScopeInstructor
+			}
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM api_tokens WHERE user_id = $1 AND name = $2`, currentUser.ID, request.Name); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	PostUserMeToken(w, tx, currentUser, request, audit, render)
+}
+
+// isAnyInstructor reports whether a user is an instructor in any course.
+func isAnyInstructor(tx *sql.Tx, userID int64) (bool, error) {
+	var instructor bool
+	err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM assignments WHERE user_id = $1 AND instructor)`, userID).Scan(&instructor)
+	return instructor, err
+}
+
+// GetUserMeTokens handles a request to /v2/users/me/tokens,
+// returning the current user's API tokens without the tokens themselves.
+func GetUserMeTokens(w http.ResponseWriter, tx *sql.Tx, currentUser *User, render render.Render) {
+	tokens := []*APIToken{}
+	if err := meddler.QueryAll(tx, &tokens, `SELECT * FROM api_tokens WHERE user_id = $1 ORDER BY created_at`, currentUser.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, tokens)
+}
+
+// DeleteUserMeToken handles a request to /v2/users/me/tokens/:token_id,
+// revoking one of the current user's API tokens.
+func DeleteUserMeToken(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *AuditEntry) {
+	tokenID, err := parseID(w, "token_id", params["token_id"])
+	if err != nil {
+		return
+	}
+	result, err := tx.Exec(`DELETE FROM api_tokens WHERE id = $1 AND user_id = $2`, tokenID, currentUser.ID)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		loggedHTTPErrorf(w, http.StatusNotFound, "token %d not found", tokenID)
+		return
+	}
+	audit.Record(AuditRequest, tokenID, "revoked token")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/russross/meddler"
+)
+
+func init() {
+	meddler.Register("transcript", TranscriptMeddler{})
+}
+
+// TranscriptMeddler stores commit transcripts as gzipped JSON.
+// When reading it also accepts plain JSON, which is what rows written before
+// transcripts were compressed contain, and treats an empty value as a
+// transcript that was discarded by the retention policy.
+type TranscriptMeddler struct{}
+
+func (TranscriptMeddler) PreRead(fieldAddr interface{}) (interface{}, error) {
+	return new([]byte), nil
+}
+
+func (TranscriptMeddler) PostRead(fieldAddr, scanTarget interface{}) error {
+	raw := *scanTarget.(*[]byte)
+	switch {
+	case len(raw) == 0:
+		return nil
+	case len(raw) >= 2 && raw[0] == 0x1f && raw[1] == 0x8b:
+		return meddler.JSONMeddler(true).PostRead(fieldAddr, scanTarget)
+	default:
+		if err := json.NewDecoder(bytes.NewReader(raw)).Decode(fieldAddr); err != nil {
+			return fmt.Errorf("TranscriptMeddler.PostRead: JSON decode error: %v", err)
+		}
+		return nil
+	}
+}
+
+func (TranscriptMeddler) PreWrite(field interface{}) (interface{}, error) {
+	return meddler.JSONMeddler(true).PreWrite(field)
+}
+
+// trimTranscripts discards the transcripts of commits that have been
+// superseded by a commit on a later step of the same problem and have not
+// been touched for the given number of days. The commit that is current for
+// each problem keeps its transcript.
+func trimTranscripts(db *sql.DB, now time.Time, days int) (int64, error) {
+	if days <= 0 {
+		return 0, nil
+	}
+	cutoff := now.AddDate(0, 0, -days)
+	result, err := db.Exec(`UPDATE commits SET transcript = ''::bytea `+
+		`WHERE updated_at < $1 AND octet_length(transcript) > 0 AND EXISTS `+
+		`(SELECT 1 FROM commits AS later WHERE later.assignment_id = commits.assignment_id `+
+		`AND later.problem_id = commits.problem_id AND later.step > commits.step)`,
+		cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// startTranscriptMaintenance runs the transcript retention policy once a day.
+func startTranscriptMaintenance(db *sql.DB) {
+	if Config().TranscriptRetentionDays <= 0 {
+		return
+	}
+	go func() {
+		for {
+			n, err := trimTranscripts(db, time.Now(), Config().TranscriptRetentionDays)
+			if err != nil {
+				log.Printf("error trimming old transcripts: %v", err)
+			} else if n > 0 {
+				log.Printf("trimmed transcripts from %d superseded commits", n)
+			}
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+}
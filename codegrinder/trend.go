@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Department chairs can see how the site is used from term to term for
+// annual reports: how many students were active, how much they submitted,
+// how much grading time that took, and average scores by course level.
+// The numbers are only ever totals and averages across courses. An average
+// score is left out when it covers fewer than MinTrendStudents students.
+
+// MinTrendStudents is the fewest enrollments an average score can cover.
+const MinTrendStudents = 10
+
+// DefaultTrendYears is how many calendar years of terms are reported
+// unless the request asks for a different number.
+const DefaultTrendYears = 5
+
+// MaxTrendYears is the most calendar years a request can ask for, since
+// each term costs a pass over the commits.
+const MaxTrendYears = 20
+
+// trendTerms are the academic terms of a calendar year, by starting month.
+var trendTerms = []struct {
+	name  string
+	start time.Month
+}{
+	{"Spring", time.January},
+	{"Summer", time.June},
+	{"Fall", time.August},
+}
+
+var courseNumber = regexp.MustCompile(`\b([1-9])\d{3}\b`)
+
+// courseLevel finds the level of a course from the first course number in
+// its label or name, e.g., CS 1400 is at level 1000.
+func courseLevel(label, name string) string {
+	for _, s := range []string{label, name} {
+		if groups := courseNumber.FindStringSubmatch(s); groups != nil {
+			return groups[1] + "000"
+		}
+	}
+	return "other"
+}
+
+// termsSince lists the terms from the start of a year through the term
+// containing now.
+func termsSince(year int, now time.Time, loc *time.Location) []*TermTrend {
+	var terms []*TermTrend
+	for ; year <= now.Year(); year++ {
+		for i, term := range trendTerms {
+			start := time.Date(year, term.start, 1, 0, 0, 0, 0, loc)
+			end := time.Date(year+1, time.January, 1, 0, 0, 0, 0, loc)
+			if i+1 < len(trendTerms) {
+				end = time.Date(year, trendTerms[i+1].start, 1, 0, 0, 0, 0, loc)
+			}
+			if start.After(now) {
+				return terms
+			}
+			terms = append(terms, &TermTrend{
+				Term:   fmt.Sprintf("%s %d", term.name, year),
+				Start:  start,
+				End:    end,
+				Levels: []*LevelTrend{},
+			})
+		}
+	}
+	return terms
+}
+
+// gatherTermTrend fills in the totals for one term. Work by instructors
+// in their own courses is not counted.
+func gatherTermTrend(tx *sql.Tx, term *TermTrend) error {
+	var ms int64
+	err := tx.QueryRow(`SELECT COUNT(DISTINCT user_id), COUNT(DISTINCT course_id), COUNT(*) FILTER (WHERE action = 'grade'), COALESCE(SUM(duration_ms), 0) `+
+		`FROM action_runs WHERE created_at >= $1 AND created_at < $2 `+
+		`AND NOT EXISTS (SELECT 1 FROM assignments WHERE assignments.user_id = action_runs.user_id `+
+		`AND assignments.course_id = action_runs.course_id AND assignments.instructor)`,
+		term.Start, term.End).Scan(&term.ActiveStudents, &term.Courses, &term.Submissions, &ms)
+	if err != nil {
+		return err
+	}
+	term.GradingMinutes = float64(ms) / float64(time.Minute/time.Millisecond)
+
+	rows, err := tx.Query(`SELECT courses.lti_label, courses.name, COUNT(DISTINCT assignments.user_id), `+
+		`SUM(COALESCE(assignments.score, 0)), COUNT(*) `+
+		`FROM assignments JOIN courses ON assignments.course_id = courses.id `+
+		`WHERE NOT assignments.instructor AND assignments.created_at >= $1 AND assignments.created_at < $2 `+
+		`GROUP BY courses.id, courses.lti_label, courses.name`, term.Start, term.End)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	type levelData struct {
+		courses, enrollments, assignments int
+		total                             float64
+	}
+	levels := make(map[string]*levelData)
+	for rows.Next() {
+		var label, name string
+		var students, assignments int
+		var total float64
+		if err := rows.Scan(&label, &name, &students, &total, &assignments); err != nil {
+			return err
+		}
+		level := courseLevel(label, name)
+		data := levels[level]
+		if data == nil {
+			data = new(levelData)
+			levels[level] = data
+		}
+		data.courses++
+		data.enrollments += students
+		data.assignments += assignments
+		data.total += total
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for level, data := range levels {
+		trend := &LevelTrend{Level: level, Courses: data.courses, Enrollments: data.enrollments}
+		if data.enrollments >= MinTrendStudents && data.assignments > 0 {
+			average := data.total / float64(data.assignments)
+			trend.AverageScore = &average
+		}
+		term.Levels = append(term.Levels, trend)
+	}
+	sort.Slice(term.Levels, func(i, j int) bool { return term.Levels[i].Level < term.Levels[j].Level })
+	return nil
+}
+
+// GetTrends handles a request to /v2/trends,
+// returning site-wide totals for each academic term of the last few years,
+// oldest first. Parameters:
+//
+//	years:  how many calendar years to cover, 5 by default and at most 20
+//	format: csv for a spreadsheet with one row per course level in each term
+func GetTrends(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	years := DefaultTrendYears
+	if s := r.FormValue("years"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > MaxTrendYears {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "years must be a number from 1 to %d", MaxTrendYears)
+			return
+		}
+		years = n
+	}
+	now := time.Now()
+	terms := termsSince(now.Year()-years+1, now, time.Local)
+	for _, term := range terms {
+		if err := gatherTermTrend(tx, term); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+
+	if !wantCSV(r) {
+		render.JSON(http.StatusOK, terms)
+		return
+	}
+	out := startCSV(w, fmt.Sprintf("codegrinder-trends-%s.csv", now.Format("2006-01-02")),
+		[]string{"term", "start", "active_students", "courses", "submissions", "grading_minutes",
+			"level", "level_courses", "level_enrollments", "level_average_score"})
+	for _, term := range terms {
+		row := []string{
+			term.Term,
+			term.Start.Format("2006-01-02"),
+			strconv.Itoa(term.ActiveStudents),
+			strconv.Itoa(term.Courses),
+			strconv.Itoa(term.Submissions),
+			strconv.FormatFloat(term.GradingMinutes, 'f', 1, 64),
+		}
+		if len(term.Levels) == 0 {
+			out.Write(append(row, "", "", "", ""))
+		}
+		for _, level := range term.Levels {
+			average := ""
+			if level.AverageScore != nil {
+				average = strconv.FormatFloat(*level.AverageScore, 'f', 4, 64)
+			}
+			out.Write(append(row[:6:6], level.Level, strconv.Itoa(level.Courses), strconv.Itoa(level.Enrollments), average))
+		}
+	}
+	out.Flush()
+}
+
+// PutUserChair handles a request to /v2/users/:user_id/chair,
+// making a user a department chair or taking the role away.
+func PutUserChair(w http.ResponseWriter, tx *sql.Tx, params martini.Params, request UserChair, audit *AuditEntry, render render.Render) {
+	userID, err := parseID(w, "user_id", params["user_id"])
+	if err != nil {
+		return
+	}
+	user := new(User)
+	if err := meddler.Load(tx, "users", user, userID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	user.Chair = request.Chair
+	if _, err := tx.Exec(`UPDATE users SET chair = $1, updated_at = $2 WHERE id = $3`, user.Chair, time.Now(), user.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditRequest, user.ID, "user %d (%s) chair: %v", user.ID, user.Name, user.Chair)
+	render.JSON(http.StatusOK, user)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// New students can practice with grind before their first real assignment
+// by running grind tutorial. The server keeps a small tutorial problem built
+// into the binary, and on request it gives the student an assignment for it
+// in a tutorial course of its own. The course is not linked to an LMS, so
+// tutorial scores are never posted anywhere.
+//
+// Each step asks the student to put an answer in a file. A step file named
+// tests/<name> gives the expected contents of <name>, and grading compares
+// the two, ignoring surrounding whitespace.
+
+// tutorialCanvasID stands in for the Canvas ID of the tutorial course,
+// which is not in Canvas.
+const tutorialCanvasID = -1
+
+// tutorialSteps are the steps of the tutorial problem.
+var tutorialSteps = []*ProblemStep{
+	{
+		Step:   1,
+		Note:   "saving and grading your work",
+		Weight: 1.0,
+		Instructions: `<h1>Welcome to CodeGrinder</h1>
+<p>Each assignment is a set of problems, and each problem has one or more steps. The
+instructions for the step you are working on are always available by running:</p>
+<pre>grind doc</pre>
+<p>For this step, edit <code>hello.txt</code> so it contains:</p>
+<pre>hello, world</pre>
+<p>Then save your work on the server, which you can do as often as you like:</p>
+<pre>grind save</pre>
+<p>When you think your work is correct, ask the server to grade it:</p>
+<pre>grind grade</pre>
+<p>Grading saves your work too, so you do not need to save first.</p>`,
+		Files: map[string]string{
+			"hello.txt":       "",
+			"tests/hello.txt": "hello, world\n",
+		},
+	},
+	{
+		Step:   2,
+		Note:   "fixing a failed step",
+		Weight: 1.0,
+		Instructions: `<h1>Moving to the next step</h1>
+<p>When a step passes, grind downloads the files for the next step and these
+instructions change. Your earlier files stay where they are.</p>
+<p>For this step, put the answer to six times seven in <code>answer.txt</code>. Try
+grading a wrong answer first to see what a failure looks like:</p>
+<pre>grind grade</pre>
+<p>The grader shows the commands it ran and their output, so you can see what went
+wrong. Fix the answer and grade again.</p>`,
+		Files: map[string]string{
+			"answer.txt":       "",
+			"tests/answer.txt": "42\n",
+		},
+	},
+	{
+		Step:   3,
+		Note:   "checking your progress",
+		Weight: 1.0,
+		Instructions: `<h1>Checking your progress</h1>
+<p>You can see where you are in an assignment and whether you have unsaved work with:</p>
+<pre>grind status</pre>
+<p>To finish the tutorial, write <code>done</code> in <code>done.txt</code> and grade it.
+After that, use <code>grind list</code> to see your real assignments and
+<code>grind get</code> to download one.</p>`,
+		Files: map[string]string{
+			"done.txt":       "",
+			"tests/done.txt": "done\n",
+		},
+	},
+}
+
+func init() {
+	problemTypes["tutorial"] = &ProblemType{
+		Name:        "tutorial",
+		Image:       "codegrinder/python2",
+		MaxCPU:      10,
+		MaxFD:       10,
+		MaxFileSize: 10,
+		MaxMemory:   32,
+		MaxThreads:  20,
+		Actions: map[string]*ProblemTypeAction{
+			"grade": &ProblemTypeAction{
+				Action:  "grade",
+				Button:  "Grade",
+				Message: "Grading‥",
+				Class:   "btn-grade",
+				Handler: nannyHandler(tutorialGrade),
+			},
+			"": &ProblemTypeAction{
+				Action: "",
+				Button: "Save",
+				Class:  "btn-save",
+			},
+		},
+	}
+}
+
+// tutorialGrade shows each answer file, as the container sees it, and
+// compares it with the expected contents from tests/.
+func tutorialGrade(n *Nanny, args []string, options []string, files map[string]string) {
+	log.Printf("tutorialGrade")
+
+	if err := n.PutFiles(files); err != nil {
+		n.ReportCard.LogAndFailf("PutFiles error: %v", err)
+		return
+	}
+	var names []string
+	for name := range files {
+		if strings.HasPrefix(name, "tests/") {
+			names = append(names, strings.TrimPrefix(name, "tests/"))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stdout, stderr, _, status, err := n.ExecNonInteractive([]string{"cat", name})
+		if err != nil {
+			n.ReportCard.LogAndFailf("exec error: %v", err)
+			return
+		}
+		expected := strings.TrimSpace(files["tests/"+name])
+		switch {
+		case status != 0:
+			n.ReportCard.AddFailedResult(name, "<h1>cat failed</h1>\n"+htmlEscapePre(stderr.String()), name)
+		case strings.TrimSpace(stdout.String()) != expected:
+			n.ReportCard.AddFailedResult(name, "<h1>Wrong answer</h1>\n"+htmlEscapePara(fmt.Sprintf("expected %q", expected)), name)
+		default:
+			n.ReportCard.AddPassedResult(name, htmlEscapePara("correct"))
+		}
+	}
+	n.ReportCard.Duration = time.Since(n.Start)
+}
+
+// ensureTutorial returns the tutorial course and problem set, creating them
+// and the tutorial problem the first time they are needed.
+func ensureTutorial(tx *sql.Tx, now time.Time) (*Course, *ProblemSet, error) {
+	course, problemSet := new(Course), new(ProblemSet)
+	err := meddler.QueryRow(tx, course, `SELECT * FROM courses WHERE lti_label = $1`, TutorialLabel)
+	if err == nil {
+		err = meddler.QueryRow(tx, problemSet, `SELECT * FROM problem_sets WHERE unique_id = $1`, TutorialLabel)
+	}
+	if err == nil {
+		return course, problemSet, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+
+	log.Printf("creating the tutorial course and problem")
+	course = &Course{
+		Name:      "CodeGrinder tutorial",
+		Label:     TutorialLabel,
+		LtiID:     TutorialLabel,
+		CanvasID:  tutorialCanvasID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := meddler.Insert(tx, "courses", course); err != nil {
+		return nil, nil, fmt.Errorf("creating tutorial course: %v", err)
+	}
+	problem := &Problem{
+		Unique:      TutorialLabel,
+		Note:        "Learn to use grind",
+		ProblemType: "tutorial",
+		Tags:        []string{},
+		Options:     []string{},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := meddler.Insert(tx, "problems", problem); err != nil {
+		return nil, nil, fmt.Errorf("creating tutorial problem: %v", err)
+	}
+	for _, elt := range tutorialSteps {
+		step := *elt
+		step.ProblemID = problem.ID
+		if err := meddler.Insert(tx, "problem_steps", &step); err != nil {
+			return nil, nil, fmt.Errorf("creating tutorial step %d: %v", step.Step, err)
+		}
+	}
+	problemSet = &ProblemSet{
+		Unique:    TutorialLabel,
+		Note:      "CodeGrinder tutorial",
+		Tags:      []string{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := meddler.Insert(tx, "problem_sets", problemSet); err != nil {
+		return nil, nil, fmt.Errorf("creating tutorial problem set: %v", err)
+	}
+	psp := &ProblemSetProblem{ProblemSetID: problemSet.ID, ProblemID: problem.ID, Weight: 1.0}
+	if err := meddler.Insert(tx, "problem_set_problems", psp); err != nil {
+		return nil, nil, fmt.Errorf("adding tutorial problem to problem set: %v", err)
+	}
+	return course, problemSet, nil
+}
+
+// PostUserMeTutorial handles a request to /v2/users/me/tutorial,
+// returning the current user's tutorial assignment and creating it if
+// this is the first request.
+func PostUserMeTutorial(w http.ResponseWriter, tx *sql.Tx, currentUser *User, audit *AuditEntry, render render.Render) {
+	now := time.Now()
+	course, problemSet, err := ensureTutorial(tx, now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	assignment := new(Assignment)
+	err = meddler.QueryRow(tx, assignment, `SELECT * FROM assignments WHERE user_id = $1 AND course_id = $2 AND problem_set_id = $3`,
+		currentUser.ID, course.ID, problemSet.ID)
+	if err == nil {
+		render.JSON(http.StatusOK, assignment)
+		return
+	}
+	if err != sql.ErrNoRows {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	assignment = &Assignment{
+		CourseID:     course.ID,
+		ProblemSetID: problemSet.ID,
+		UserID:       currentUser.ID,
+		Roles:        "Learner",
+		RawScores:    map[string][]float64{},
+		LtiID:        TutorialLabel,
+		CanvasTitle:  course.Name,
+		CanvasID:     tutorialCanvasID,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := meddler.Insert(tx, "assignments", assignment); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditRequest, assignment.ID, "created tutorial assignment %d for user %d (%s)", assignment.ID, currentUser.ID, currentUser.Name)
+	render.JSON(http.StatusOK, assignment)
+}
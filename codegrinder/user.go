@@ -3,6 +3,8 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
@@ -76,6 +78,67 @@ func GetCourse(w http.ResponseWriter, tx *sql.Tx, params martini.Params, current
 	render.JSON(http.StatusOK, course)
 }
 
+// GetCourseInfo handles /v2/courses/:course_id/info requests,
+// returning the display name and help contact for a course.
+func GetCourseInfo(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+
+	course := new(Course)
+
+	if currentUser.Admin {
+		err = meddler.Load(tx, "courses", course, courseID)
+	} else {
+		err = meddler.QueryRow(tx, course, `SELECT DISTINCT courses.* `+
+			`FROM courses JOIN assignments ON courses.id = assignments.course_id `+
+			`WHERE assignments.user_id = $1 AND assignments.course_id = $2`,
+			currentUser.ID, courseID)
+	}
+
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	render.JSON(http.StatusOK, course.Info())
+}
+
+// PutCourseInfo handles /v2/courses/:course_id/info requests,
+// updating the display name and help contact for a course.
+// Only instructors for the course and administrators may do this.
+func PutCourseInfo(w http.ResponseWriter, tx *sql.Tx, params martini.Params, info CourseInfo, audit *AuditEntry, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	info.DisplayName = strings.TrimSpace(info.DisplayName)
+	info.HelpEmail = strings.TrimSpace(info.HelpEmail)
+	info.HelpText = strings.TrimSpace(info.HelpText)
+	if info.HelpEmail != "" && !strings.Contains(info.HelpEmail, "@") {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "help email %q is not a valid email address", info.HelpEmail)
+		return
+	}
+
+	audit.Record(AuditRequest, course.ID, "course info: display name %q -> %q, help email %q -> %q",
+		course.DisplayName, info.DisplayName, course.HelpEmail, info.HelpEmail)
+	course.DisplayName = info.DisplayName
+	course.HelpEmail = info.HelpEmail
+	course.HelpText = info.HelpText
+	course.UpdatedAt = time.Now()
+	if err := meddler.Update(tx, "courses", course); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, course.Info())
+}
+
 // DeleteCourse handles /v2/courses/:course_id requests,
 // deleting a single course.
 // This will also delete all assignments and commits related to the course.
@@ -150,7 +213,29 @@ func GetUsers(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser *U
 
 // GetUserMe handles /v2/users/me requests,
 // returning the current user.
-func GetUserMe(w http.ResponseWriter, tx *sql.Tx, currentUser *User, render render.Render) {
+//
+// The response carries an ETag and must be revalidated on every use.
+func GetUserMe(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser *User) {
+	w.Header().Set("Cache-Control", "private, no-cache")
+	renderJSONWithETag(w, r, currentUser)
+}
+
+// PutUserMeTimezone handles /v2/users/me/timezone requests,
+// setting the timezone used to display deadlines to the current user.
+// An empty timezone clears the preference, and the next LTI launch
+// will fill it in from the LMS.
+func PutUserMeTimezone(w http.ResponseWriter, tx *sql.Tx, currentUser *User, tz UserTimezone, render render.Render) {
+	tz.Timezone = strings.TrimSpace(tz.Timezone)
+	if _, err := LoadTimezone(tz.Timezone); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE users SET timezone = NULLIF($1, ''), updated_at = $2 WHERE id = $3`,
+		tz.Timezone, time.Now(), currentUser.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	currentUser.Timezone = tz.Timezone
 	render.JSON(http.StatusOK, currentUser)
 }
 
@@ -269,6 +354,13 @@ func GetUserAssignments(w http.ResponseWriter, tx *sql.Tx, params martini.Params
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
+	for _, asst := range assignments {
+		asst.Localize(currentUser.Timezone)
+	}
+	if err := attachScoreOverrides(tx, assignments...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
 
 	render.JSON(http.StatusOK, assignments)
 }
@@ -308,13 +400,116 @@ func GetCourseUserAssignments(w http.ResponseWriter, tx *sql.Tx, params martini.
 		loggedHTTPErrorf(w, http.StatusNotFound, "not found")
 		return
 	}
+	for _, asst := range assignments {
+		asst.Localize(currentUser.Timezone)
+	}
+	if err := attachScoreOverrides(tx, assignments...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
 
 	render.JSON(http.StatusOK, assignments)
 }
 
+// GetUserMeAssignments handles requests to /v2/users/me/assignments,
+// returning the current user's assignments grouped by course. Courses are
+// in order by name and assignments by due date. Parameters:
+//
+//	course:      a course ID or LTI label, to list only that course
+//	problem_set: a problem set unique ID, to list only its assignments
+//	open:        true to leave out assignments that are finalized
+func GetUserMeAssignments(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser *User, render render.Render) {
+	now := time.Now()
+	where, args := addWhereEq("", nil, "assignments.user_id", currentUser.ID)
+	if course := r.FormValue("course"); course != "" {
+		if id, err := strconv.ParseInt(course, 10, 64); err == nil {
+			where, args = addWhereEq(where, args, "assignments.course_id", id)
+		} else {
+			where, args = addWhereEq(where, args, "courses.lti_label", course)
+		}
+	}
+	if unique := r.FormValue("problem_set"); unique != "" {
+		where, args = addWhereEq(where, args, "problem_sets.unique_id", unique)
+	}
+	openOnly := false
+	if s := r.FormValue("open"); s != "" {
+		var err error
+		if openOnly, err = strconv.ParseBool(s); err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "open must be true or false")
+			return
+		}
+	}
+
+	from := ` FROM assignments JOIN courses ON assignments.course_id = courses.id ` +
+		`JOIN problem_sets ON assignments.problem_set_id = problem_sets.id` + where
+	assignments := []*Assignment{}
+	if err := meddler.QueryAll(tx, &assignments, `SELECT assignments.*`+from+
+		` ORDER BY courses.name, courses.id, assignments.due_at NULLS LAST, assignments.canvas_title, assignments.id`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	courses := []*Course{}
+	if err := meddler.QueryAll(tx, &courses, `SELECT * FROM courses WHERE id IN (SELECT assignments.course_id`+from+`)`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	problemSets := []*ProblemSet{}
+	if err := meddler.QueryAll(tx, &problemSets, `SELECT * FROM problem_sets WHERE id IN (SELECT assignments.problem_set_id`+from+`)`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	reopens := []*AssignmentReopen{}
+	if err := meddler.QueryAll(tx, &reopens, `SELECT DISTINCT ON (assignment_id) * FROM assignment_reopens `+
+		`WHERE assignment_id IN (SELECT id FROM assignments WHERE user_id = $1) `+
+		`ORDER BY assignment_id, created_at DESC, id DESC`, currentUser.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := attachScoreOverrides(tx, assignments...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	courseByID := make(map[int64]*Course)
+	for _, course := range courses {
+		courseByID[course.ID] = course
+	}
+	problemSetByID := make(map[int64]*ProblemSet)
+	for _, problemSet := range problemSets {
+		problemSetByID[problemSet.ID] = problemSet
+	}
+	reopenByAssignment := make(map[int64]*AssignmentReopen)
+	for _, reopen := range reopens {
+		reopenByAssignment[reopen.AssignmentID] = reopen
+	}
+
+	groups := []*CourseAssignments{}
+	for _, asst := range assignments {
+		lockAt := assignmentLockAt(asst, reopenByAssignment[asst.ID])
+		open := lockAt == nil || now.Before(*lockAt)
+		if openOnly && !open {
+			continue
+		}
+		asst.Localize(currentUser.Timezone)
+		listing := &AssignmentListing{Assignment: asst, FinalizedAt: lockAt, Open: open}
+		if problemSet := problemSetByID[asst.ProblemSetID]; problemSet != nil {
+			listing.ProblemSetUnique = problemSet.Unique
+			listing.ProblemSetNote = problemSet.Note
+		}
+		if len(groups) == 0 || groups[len(groups)-1].Course.ID != asst.CourseID {
+			groups = append(groups, &CourseAssignments{Course: courseByID[asst.CourseID]})
+		}
+		group := groups[len(groups)-1]
+		group.Assignments = append(group.Assignments, listing)
+	}
+
+	render.JSON(http.StatusOK, groups)
+}
+
 // GetAssignment handles requests to /v2/assignments/:assignment_id,
 // returning the given assignment.
-func GetAssignment(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+//
+// The response carries an ETag and must be revalidated on every use.
+func GetAssignment(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params martini.Params, currentUser *User) {
 	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
 	if err != nil {
 		return
@@ -336,18 +531,26 @@ func GetAssignment(w http.ResponseWriter, tx *sql.Tx, params martini.Params, cur
 		return
 	}
 
-	render.JSON(http.StatusOK, assignment)
+	assignment.Localize(currentUser.Timezone)
+	if err := attachScoreOverrides(tx, assignment); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache")
+	renderJSONWithETag(w, r, assignment)
 }
 
 // DeleteAssignment handles requests to /v2/assignments/:assignment_id,
-// deleting the given assignment.
+// deleting the given assignment and its commits. They can be restored
+// together until they are purged.
 func DeleteAssignment(w http.ResponseWriter, tx *sql.Tx, params martini.Params) {
 	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
 	if err != nil {
 		return
 	}
 
-	if _, err := tx.Exec(`DELETE FROM assignments WHERE id = $1`, assignmentID); err != nil {
+	if err := softDeleteAssignment(tx, assignmentID, time.Now()); err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
@@ -381,10 +584,59 @@ func GetAssignmentProblemCommitLast(w http.ResponseWriter, tx *sql.Tx, params ma
 		loggedHTTPDBNotFoundError(w, err)
 		return
 	}
+	if err := loadCommitFiles(tx, commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading commit files: %v", err)
+		return
+	}
+	if err := revealHiddenTests(tx, currentUser, commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error revealing hidden tests: %v", err)
+		return
+	}
+	if err := limitCommitFeedback(tx, currentUser, commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error limiting feedback: %v", err)
+		return
+	}
 
 	render.JSON(http.StatusOK, commit)
 }
 
+// GetAssignmentProblemCommitOpen handles requests to /v2/assignments/:assignment_id/problems/:problem_id/commits/open,
+// returning the age of the most recent commit that was saved but not graded.
+// It returns not found if there is no open commit or if it has already timed out.
+func GetAssignmentProblemCommitOpen(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	now := time.Now()
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+
+	open := &OpenCommit{ProblemID: problemID, Timeout: int64(Config().openCommitTimeout().Seconds())}
+	if currentUser.Admin {
+		err = tx.QueryRow(`SELECT id, step, updated_at FROM commits `+
+			`WHERE assignment_id = $1 AND problem_id = $2 AND action IS NULL AND updated_at > $3 `+
+			`ORDER BY step DESC LIMIT 1`, assignmentID, problemID, now.Add(-Config().openCommitTimeout())).
+			Scan(&open.CommitID, &open.Step, &open.UpdatedAt)
+	} else {
+		err = tx.QueryRow(`SELECT commits.id, step, commits.updated_at `+
+			`FROM commits JOIN user_assignments ON commits.assignment_id = user_assignments.assignment_id `+
+			`WHERE commits.assignment_id = $1 AND problem_id = $2 AND user_assignments.user_id = $3 `+
+			`AND action IS NULL AND commits.updated_at > $4 `+
+			`ORDER BY step DESC LIMIT 1`, assignmentID, problemID, currentUser.ID, now.Add(-Config().openCommitTimeout())).
+			Scan(&open.CommitID, &open.Step, &open.UpdatedAt)
+	}
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	open.Age = int64(now.Sub(open.UpdatedAt).Seconds())
+
+	render.JSON(http.StatusOK, open)
+}
+
 // GetUserAssignmentProblemStepCommitLast handles requests to /v2/assignments/:assignment_id/problems/:problem_id/steps/:step/commits/last,
 // returning the most recent commit for the given step of the given problem of the given assignment.
 func GetAssignmentProblemStepCommitLast(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
@@ -417,28 +669,47 @@ func GetAssignmentProblemStepCommitLast(w http.ResponseWriter, tx *sql.Tx, param
 		loggedHTTPDBNotFoundError(w, err)
 		return
 	}
+	if err := loadCommitFiles(tx, commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading commit files: %v", err)
+		return
+	}
+	if err := revealHiddenTests(tx, currentUser, commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error revealing hidden tests: %v", err)
+		return
+	}
+	if err := limitCommitFeedback(tx, currentUser, commit); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error limiting feedback: %v", err)
+		return
+	}
 
 	render.JSON(http.StatusOK, commit)
 }
 
 // DeleteCommit handles requests to /v2/commits/:commit_id,
-// deleting the given commit.
-func DeleteCommit(w http.ResponseWriter, tx *sql.Tx, params martini.Params) {
+// deleting the given commit. It can be restored until it is purged.
+func DeleteCommit(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *AuditEntry) {
 	commitID, err := parseID(w, "commit_id", params["commit_id"])
 	if err != nil {
 		return
 	}
 
-	if _, err = tx.Exec(`DELETE FROM commits WHERE id = $1`, commitID); err != nil {
+	commit := new(Commit)
+	if err := meddler.Load(tx, "commits", commit, commitID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if err := softDeleteCommit(tx, commitID, time.Now()); err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
+	audit.Record(AuditCommitDelete, commitID, "deleted commit for assignment %d problem %d step %d (score %.4f)",
+		commit.AssignmentID, commit.ProblemID, commit.Step, commit.Score)
 }
 
 // PostCommitBundlesUnsigned handles requests to /v2/commit_bundles/unsigned,
 // saving a new commit (or updating the most recent one), gathering the problem data,
 // signing everything, and returning it in a form ready to send to the daycare.
-func PostCommitBundlesUnsigned(w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle CommitBundle, render render.Render) {
+func PostCommitBundlesUnsigned(w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle CommitBundle, audit *AuditEntry, render render.Render) {
 	now := time.Now()
 
 	if bundle.Commit == nil {
@@ -454,13 +725,13 @@ func PostCommitBundlesUnsigned(w http.ResponseWriter, tx *sql.Tx, currentUser *U
 	bundle.Commit.Score = 0.0
 	bundle.Commit.CreatedAt = now
 	bundle.Commit.UpdatedAt = now
-	saveCommitBundleCommon(now, w, tx, currentUser, bundle, render)
+	saveCommitBundleCommon(now, w, tx, currentUser, bundle, audit, render)
 }
 
 // PostCommitBundlesSigned handles requests to /v2/commit_bundles/signed,
 // saving a new commit (or updating the most recent one), gathering the problem data,
 // verifying signatures, and posting a grade (if appropriate).
-func PostCommitBundlesSigned(w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle CommitBundle, render render.Render) {
+func PostCommitBundlesSigned(w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle CommitBundle, audit *AuditEntry, render render.Render) {
 	now := time.Now()
 
 	if bundle.Commit == nil {
@@ -471,45 +742,104 @@ func PostCommitBundlesSigned(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must include commit signature")
 		return
 	}
-	saveCommitBundleCommon(now, w, tx, currentUser, bundle, render)
+	saveCommitBundleCommon(now, w, tx, currentUser, bundle, audit, render)
 }
 
-func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle CommitBundle, render render.Render) {
-	if bundle.Problem != nil {
-		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must not include a problem object")
+func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle CommitBundle, audit *AuditEntry, render render.Render) {
+	signed, err := saveCommitBundle(now, w, tx, currentUser, &bundle, audit, false, "")
+	if err != nil {
 		return
 	}
+	render.JSON(http.StatusOK, signed)
+}
+
+// saveCommitBundle does the work of saving a commit bundle, returning the
+// signed bundle. Errors are reported to the client before they are
+// returned. A bundle that is part of a problem set graded together is only
+// accepted for grading as part of the whole set. A commit that cannot be
+// graded yet, or that the caller holds back with a non-empty hold, is
+// saved without its action and returned unsigned with Held set.
+func saveCommitBundle(now time.Time, w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle *CommitBundle, audit *AuditEntry, inSet bool, hold string) (*CommitBundle, error) {
+	if bundle.Problem != nil {
+		return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must not include a problem object")
+	}
 	if len(bundle.ProblemSteps) != 0 {
-		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must not include problem step objects")
-		return
+		return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must not include problem step objects")
 	}
 	if len(bundle.ProblemSignature) != 0 {
-		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must not include problem signature")
-		return
+		return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must not include problem signature")
 	}
 	commit := bundle.Commit
+	if bundle.Checkpoint {
+		commit.Note = strings.TrimSpace(commit.Note)
+		switch {
+		case bundle.CommitSignature != "":
+			return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "only unsigned commits can be saved as checkpoints")
+		case len(commit.Sealed) > 0:
+			return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "encrypted commits cannot be saved as checkpoints")
+		case commit.Note == "":
+			return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "a checkpoint must have a label")
+		}
+	}
 
 	// get the assignment and make sure it is for this user
 	assignment := new(Assignment)
 	if err := meddler.QueryRow(tx, assignment, `SELECT * FROM assignments WHERE id = $1 AND user_id = $2`, commit.AssignmentID, currentUser.ID); err != nil {
 		loggedHTTPDBNotFoundError(w, err)
-		return
+		return nil, err
+	}
+
+	// no changes once the assignment is finalized
+	reopen, err := loadAssignmentReopen(tx, assignment.ID)
+	if err != nil {
+		return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+	}
+	if lockAt := assignmentLockAt(assignment, reopen); lockAt != nil && now.After(*lockAt) {
+		return nil, loggedHTTPErrorf(w, http.StatusForbidden, "this assignment was finalized at %s; ask your instructor if you need it reopened", lockAt.Format(time.RFC1123))
+	}
+	postReopen := isPostReopen(now, assignment, reopen)
+
+	// problems that are graded together can only be graded as a set
+	if commit.Action == "grade" && !inSet {
+		together, err := isGradedTogether(tx, assignment.ProblemSetID)
+		if err != nil {
+			return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		}
+		if together {
+			return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "the problems in this problem set are graded together, so they must all be submitted at once")
+		}
 	}
 
 	// get the problem
 	problem := new(Problem)
 	if err := meddler.QueryRow(tx, problem, `SELECT * FROM problems WHERE id = $1`, commit.ProblemID); err != nil {
-		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
-		return
+		return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+	}
+	if err := applyCourseOptions(tx, assignment.CourseID, problem); err != nil {
+		return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+	}
+	if err := applyCourseFeedback(tx, assignment.CourseID, assignment.ProblemSetID, problem); err != nil {
+		return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 	}
 	steps := []*ProblemStep{}
 	if err := meddler.QueryAll(tx, &steps, `SELECT * FROM problem_steps WHERE problem_id = $1 ORDER BY step`, commit.ProblemID); err != nil {
-		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
-		return
+		return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 	}
+	omitPrechecks(steps...)
 	if len(steps) == 0 {
-		loggedHTTPErrorf(w, http.StatusInternalServerError, "no steps found for problem %s (%d)", problem.Unique, problem.ID)
-		return
+		return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "no steps found for problem %s (%d)", problem.Unique, problem.ID)
+	}
+	applyUserLocale(problem, steps, currentUser.Locale)
+	hints := takeHints(steps)
+	if err := sealHiddenTests(steps); err != nil {
+		return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "error sealing hidden tests: %v", err)
+	}
+
+	// enforce rate limits on requests to grade; a set is checked once as a whole
+	if bundle.CommitSignature == "" && commit.Action != "" && !inSet {
+		if err := enforceGradeLimits(now, w, tx, currentUser, assignment, problem.ProblemType); err != nil {
+			return nil, err
+		}
 	}
 
 	// reject commit if a previous step remains incomplete
@@ -519,20 +849,17 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 	scores := assignment.RawScores[problem.Unique]
 	for i := 0; i < int(commit.Step)-1; i++ {
 		if i >= len(scores) || scores[i] != 1.0 {
-			loggedHTTPErrorf(w, http.StatusBadRequest, "commit is for step %d, but user has not passed step %d", commit.Step, i+1)
-			return
+			return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "commit is for step %d, but user has not passed step %d", commit.Step, i+1)
 		}
 	}
 
 	// validate commit
 	if commit.Step > int64(len(steps)) {
-		loggedHTTPErrorf(w, http.StatusBadRequest, "commit has step number %d, but there are only %d steps in the problem", commit.Step, len(steps))
-		return
+		return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "commit has step number %d, but there are only %d steps in the problem", commit.Step, len(steps))
 	}
 	whitelists := problem.GetStepWhitelists(steps)
 	if err := commit.Normalize(now, whitelists[commit.Step-1]); err != nil {
-		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
-		return
+		return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
 	}
 
 	// update an existing commit if it exists
@@ -542,31 +869,52 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 		if err == sql.ErrNoRows {
 			commit.ID = 0
 		} else {
-			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
-			return
+			return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		}
 	} else {
 		commit.ID = openCommit.ID
 		commit.CreatedAt = openCommit.CreatedAt
 	}
 
+	// the first graded attempt at each step must confirm the problem's
+	// checklist, and later attempts keep that confirmation
+	if len(commit.Checklist) == 0 && commit.ID != 0 {
+		commit.Checklist = openCommit.Checklist
+	}
+	commit.Checklist = confirmedChecklist(problem, commit.Checklist)
+	if bundle.CommitSignature == "" && commit.Action == "grade" && !problem.ChecklistConfirmed(commit.Checklist) {
+		return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "before your first graded attempt at step %d of %s, confirm each item on its checklist:\n  %s",
+			commit.Step, problem.Unique, strings.Join(problem.Checklist, "\n  "))
+	}
+
+	// record which starter variant this user is working on
+	commit.Variant = problem.ChooseVariant(currentUser.ID)
+
 	// sign the problem and the commit
-	problemSig := problem.ComputeSignature(Config.DaycareSecret, steps)
-	commitSig := commit.ComputeSignature(Config.DaycareSecret, problemSig)
+	problemSig := problem.ComputeSignature(Config().DaycareSecret, steps)
+	commitSig := commit.ComputeSignature(Config().DaycareSecret, problemSig)
 
 	// verify signature
 	if bundle.CommitSignature != "" {
 		if bundle.CommitSignature != commitSig {
-			loggedHTTPErrorf(w, http.StatusBadRequest, "found commit signature of %s, but expected %s", bundle.CommitSignature, commitSig)
-			return
+			return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "found commit signature of %s, but expected %s", bundle.CommitSignature, commitSig)
 		}
 		age := now.Sub(commit.UpdatedAt)
 		if age < 0 {
 			age = -age
 		}
-		if age > SignedCommitTimeout {
-			loggedHTTPErrorf(w, http.StatusBadRequest, "commit signature has expired")
-			return
+		if age > Config().signedCommitTimeout() {
+			return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "commit signature has expired")
+		}
+		if err := useCommitNonce(tx, now, commit); err != nil {
+			return nil, loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+		}
+	}
+
+	// count failed tests and add any hints the student has earned
+	if bundle.CommitSignature != "" && commit.ReportCard != nil && commit.Action != StyleCheckAction {
+		if err := applyFailureHints(tx, commit, hints[commit.Step]); err != nil {
+			return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		}
 	}
 
@@ -576,96 +924,164 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 		// if unsigned, save it without the action
 		commit.Action = ""
 	}
+	if len(commit.Sealed) > 0 {
+		// the server cannot see inside sealed files
+		commit.Metrics = nil
+	} else {
+		commit.Metrics = computeCommitMetrics(commit.Files)
+	}
+	if err := storeCommitFiles(tx, now, commit); err != nil {
+		return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error saving commit files: %v", err)
+	}
+
+	// files must pass the malware scanner before they can be graded; a
+	// commit that cannot be graded yet is saved without its action
+	var flagged []string
+	held := ""
+	if action != "" {
+		held = hold
+	}
+	if Config().ScanCommand != "" {
+		var pending bool
+		var err error
+		if flagged, pending, err = checkCommitScan(tx, commit); err != nil {
+			return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error checking scan results: %v", err)
+		}
+		switch {
+		case action == "":
+		case len(flagged) > 0:
+			held = scanHoldMessage(true)
+		case pending && held == "":
+			held = scanHoldMessage(false)
+		}
+	}
+	if held != "" {
+		commit.Action = ""
+	}
 	if err := meddler.Save(tx, "commits", commit); err != nil {
-		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
-		return
+		return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+	}
+	if bundle.Checkpoint {
+		if err := saveCheckpoint(tx, now, commit); err != nil {
+			return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error saving checkpoint: %v", err)
+		}
+	}
+	if held != "" {
+		if len(flagged) > 0 {
+			notifyQuarantine(tx, strings.Join(flagged, "\n"), []*Commit{commit})
+		}
+
+		// the commit and the quarantine must be kept, so this is a
+		// successful result rather than an error
+		return &CommitBundle{
+			Commit:   commit,
+			UserID:   currentUser.ID,
+			CourseID: assignment.CourseID,
+			Held:     held,
+		}, nil
 	}
 	commit.Action = action
 
+	// a commit signed for grading can only be graded once
+	if bundle.CommitSignature == "" && action != "" {
+		if err := issueCommitNonce(tx, now, commit); err != nil {
+			return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		}
+	}
+
 	// recompute the signature as the ID may have changed when saving
-	commitSig = commit.ComputeSignature(Config.DaycareSecret, problemSig)
+	commitSig = commit.ComputeSignature(Config().DaycareSecret, problemSig)
 	signed := &CommitBundle{
 		Problem:          problem,
 		ProblemSteps:     steps,
 		ProblemSignature: problemSig,
 		Commit:           commit,
 		CommitSignature:  commitSig,
+		UserID:           currentUser.ID,
+		CourseID:         assignment.CourseID,
 	}
+	signed.OwnerSignature = signed.ComputeOwnerSignature(Config().DaycareSecret)
 
-	// save the grade update
-	if signed.Commit.ReportCard != nil {
-		// save the raw score for this problem step
-		scores := assignment.RawScores[problem.Unique]
-		for int(signed.Commit.Step) > len(scores) {
-			scores = append(scores, 0.0)
-		}
-		scores[signed.Commit.Step-1] = signed.Commit.ReportCard.ComputeScore()
-		assignment.RawScores[problem.Unique] = scores
-
-		// get the weight of each step in the problem and problem in the set
-		weights := []*StepWeights{}
-		if err := meddler.QueryAll(tx, &weights, `SELECT problems.unique_id, problem_set_problems.weight AS problem_weight, problem_steps.step, problem_steps.weight AS step_weight `+
-			`FROM problem_set_problems JOIN problems ON problem_set_problems.problem_id = problems.id `+
-			`JOIN problem_steps ON problem_steps.problem_id = problems.id `+
-			`WHERE problem_set_problems.problem_set_id = $1 `+
-			`ORDER BY unique_id, step`, assignment.ProblemSetID); err != nil {
-			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
-			return
+	// record how long the daycare took for capacity planning and attempt counts
+	if bundle.CommitSignature != "" && signed.Commit.ReportCard != nil {
+		if _, err := tx.Exec(`INSERT INTO action_runs (course_id, user_id, problem_type, action, duration_ms, created_at, problem_id, step) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			assignment.CourseID, currentUser.ID, problem.ProblemType, action, signed.Commit.ReportCard.Duration.Milliseconds(), now, problem.ID, signed.Commit.Step); err != nil {
+			return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		}
-		if len(weights) == 0 {
-			loggedHTTPErrorf(w, http.StatusInternalServerError, "no problem step weights found, unable to compute score")
-			return
-		}
-		problemWeights := make(map[string]float64)
-		stepWeights := make(map[string][]float64)
-		for _, elt := range weights {
-			problemWeights[elt.Unique] = elt.ProblemWeight
-			stepWeights[elt.Unique] = append(stepWeights[elt.Unique], elt.StepWeight)
-			if len(stepWeights[elt.Unique]) != int(elt.Step) {
-				loggedHTTPErrorf(w, http.StatusInternalServerError, "step weights do not line up when computing score")
-				return
-			}
+	}
+
+	// save the grade update; style checks do not affect the score
+	if signed.Commit.ReportCard != nil && action != StyleCheckAction {
+		if err := recordEvent(tx, EventCommitGraded, assignment.CourseID, currentUser.ID, commit.ID, map[string]interface{}{
+			"assignmentID": assignment.ID,
+			"problemID":    problem.ID,
+			"step":         signed.Commit.Step,
+			"action":       action,
+			"passed":       signed.Commit.ReportCard.Passed,
+			"score":        signed.Commit.Score,
+			"note":         signed.Commit.ReportCard.Note,
+		}); err != nil {
+			return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		}
 
-		// compute an overall score
-		setWeightTotal, setScore := 0.0, 0.0
-		for unique, problemWeight := range problemWeights {
-			setWeightTotal += problemWeight
-			scores := assignment.RawScores[unique]
-			problemWeightTotal, problemScore := 0.0, 0.0
-			for i, stepWeight := range stepWeights[unique] {
-				problemWeightTotal += stepWeight
-				if i < len(scores) {
-					problemScore += scores[i] * stepWeight
-				}
-			}
-			if problemWeightTotal == 0.0 {
-				loggedHTTPErrorf(w, http.StatusInternalServerError, "problem %s has no weight", unique)
-				return
-			}
-			problemScore /= problemWeightTotal
-			setScore += problemScore * problemWeight
+		// save the raw score for this problem step and compute an overall score
+		oldScore := assignment.Score
+		if err := scoreAssignment(tx, assignment, problem.Unique, signed.Commit.Step, signed.Commit.ReportCard.ComputeScore()); err != nil {
+			return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "%v", err)
 		}
-		if setWeightTotal == 0.0 {
-			loggedHTTPErrorf(w, http.StatusInternalServerError, "problem set has no weight")
-			return
+		auditScoreChange(audit, assignment, oldScore, postReopen)
+		if assignment.Score != oldScore {
+			if err := recordEvent(tx, EventScoreChanged, assignment.CourseID, assignment.UserID, assignment.ID, map[string]interface{}{
+				"oldScore":   oldScore,
+				"score":      assignment.Score,
+				"postReopen": postReopen,
+			}); err != nil {
+				return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			}
 		}
-		assignment.Score = setScore / setWeightTotal
 
 		// save the updates to the assignment
 		assignment.UpdatedAt = now
 		if err := meddler.Save(tx, "assignments", assignment); err != nil {
-			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
-			return
+			return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		}
 		// post grade to LMS using LTI
-		if err := saveGrade(tx, assignment, currentUser); err != nil {
-			loggedHTTPErrorf(w, http.StatusInternalServerError, "error posting grade back to LMS: %v", err)
-			return
+		if postReopen && reopen.ExcludePassback {
+			log.Printf("not posting grade for assignment %d user %d (%s) because it was reopened without passback", assignment.ID, currentUser.ID, currentUser.Name)
+		} else if err := saveGrade(tx, assignment, currentUser); err != nil {
+			return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "error posting grade back to LMS: %v", err)
+		}
+	}
+
+	// after a passing grade, suggest what to do next
+	if bundle.CommitSignature != "" && action != StyleCheckAction && signed.Commit.StepPassed() {
+		next, err := nextSuggestion(tx, assignment, problem, steps, signed.Commit.Step)
+		if err != nil {
+			return nil, loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		}
+		signed.Next = next
 	}
 
-	render.JSON(http.StatusOK, &signed)
+	return signed, nil
+}
+
+// enforceGradeLimits checks a request to grade against the rate limits for
+// the course, reporting an error to the client if it is over the limit.
+func enforceGradeLimits(now time.Time, w http.ResponseWriter, tx *sql.Tx, currentUser *User, assignment *Assignment, problemType string) error {
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, assignment.CourseID); err != nil {
+		return loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+	}
+	perMinute, perDay := gradeLimits(problemTypes[problemType], course)
+	msg, wait, err := checkGradeLimits(tx, now, currentUser.ID, assignment.ID, perMinute, perDay)
+	if err != nil {
+		return loggedHTTPErrorf(w, http.StatusInternalServerError, "db error checking grading limits: %v", err)
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return loggedHTTPErrorf(w, http.StatusTooManyRequests, "%s", msg)
+	}
+	return nil
 }
 
 type StepWeights struct {
@@ -674,3 +1090,71 @@ type StepWeights struct {
 	Step          int64   `meddler:"step"`
 	StepWeight    float64 `meddler:"step_weight"`
 }
+
+// scoreAssignment records the raw score for one step of a problem and
+// recomputes the overall score for the assignment, noting any change in
+// the score history. The caller saves the assignment.
+func scoreAssignment(tx *sql.Tx, assignment *Assignment, unique string, step int64, score float64) error {
+	// save the raw score for this problem step
+	if assignment.RawScores == nil {
+		assignment.RawScores = map[string][]float64{}
+	}
+	scores := assignment.RawScores[unique]
+	for int(step) > len(scores) {
+		scores = append(scores, 0.0)
+	}
+	scores[step-1] = score
+	assignment.RawScores[unique] = scores
+
+	// get the weight of each step in the problem and problem in the set
+	weights := []*StepWeights{}
+	if err := meddler.QueryAll(tx, &weights, `SELECT problems.unique_id, problem_set_problems.weight AS problem_weight, problem_steps.step, problem_steps.weight AS step_weight `+
+		`FROM problem_set_problems JOIN problems ON problem_set_problems.problem_id = problems.id `+
+		`JOIN problem_steps ON problem_steps.problem_id = problems.id `+
+		`WHERE problem_set_problems.problem_set_id = $1 `+
+		`ORDER BY unique_id, step`, assignment.ProblemSetID); err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if len(weights) == 0 {
+		return fmt.Errorf("no problem step weights found, unable to compute score")
+	}
+	problemWeights := make(map[string]float64)
+	stepWeights := make(map[string][]float64)
+	for _, elt := range weights {
+		problemWeights[elt.Unique] = elt.ProblemWeight
+		stepWeights[elt.Unique] = append(stepWeights[elt.Unique], elt.StepWeight)
+		if len(stepWeights[elt.Unique]) != int(elt.Step) {
+			return fmt.Errorf("step weights do not line up when computing score")
+		}
+	}
+
+	// compute an overall score
+	setWeightTotal, setScore := 0.0, 0.0
+	for unique, problemWeight := range problemWeights {
+		setWeightTotal += problemWeight
+		scores := assignment.RawScores[unique]
+		problemWeightTotal, problemScore := 0.0, 0.0
+		for i, stepWeight := range stepWeights[unique] {
+			problemWeightTotal += stepWeight
+			if i < len(scores) {
+				problemScore += scores[i] * stepWeight
+			}
+		}
+		if problemWeightTotal == 0.0 {
+			return fmt.Errorf("problem %s has no weight", unique)
+		}
+		problemScore /= problemWeightTotal
+		setScore += problemScore * problemWeight
+	}
+	if setWeightTotal == 0.0 {
+		return fmt.Errorf("problem set has no weight")
+	}
+	oldScore := assignment.Score
+	assignment.Score = setScore / setWeightTotal
+	if assignment.Score != oldScore {
+		if err := recordScoreChange(tx, assignment.ID, assignment.Score, ScoreSourceGraded, "", 0, time.Now()); err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// Web problems are graded by loading the student's page in headless
+// Chromium and running the instructor's assertions against it. The page is
+// index.html unless the problem has a "page=<file>" option. Each file in
+// tests/*.js registers one or more checks with the webcheck harness from
+// the codegrinder/web image:
+//
+//	test("heading says hello", async (page) => {
+//	    const text = await page.$eval("h1", e => e.textContent);
+//	    assert.equal(text.trim(), "Hello");
+//	});
+//
+// The page is a puppeteer Page loaded fresh from a file:// URL for every
+// test file, so checks may inspect the DOM and computed styles or trigger
+// events. The harness prints one JSON object per check on standard output.
+
+// WebPageOption is the prefix of the problem option naming the page to load.
+const WebPageOption = "page="
+
+// webCheckResult is one line of output from the webcheck harness.
+type webCheckResult struct {
+	File    string   `json:"file"`
+	Test    string   `json:"test"`
+	Passed  bool     `json:"passed"`
+	Message string   `json:"message"`
+	Console []string `json:"console"`
+}
+
+func init() {
+	problemTypes["web"] = &ProblemType{
+		Name:        "web",
+		Image:       "codegrinder/web",
+		MaxCPU:      30,
+		MaxFD:       400,
+		MaxFileSize: 10,
+		MaxMemory:   512,
+		MaxThreads:  400,
+		Actions: map[string]*ProblemTypeAction{
+			"grade": &ProblemTypeAction{
+				Action:  "grade",
+				Button:  "Grade",
+				Message: "Grading‥",
+				Class:   "btn-grade",
+				Handler: nannyHandler(webGrade),
+			},
+			"": &ProblemTypeAction{
+				Action: "",
+				Button: "Save",
+				Class:  "btn-save",
+			},
+			"confirm": &ProblemTypeAction{
+				Action:  "confirm",
+				Handler: nannyHandler(webGrade),
+			},
+		},
+	}
+}
+
+func webGrade(n *Nanny, args []string, options []string, files map[string]string) {
+	log.Printf("webGrade")
+
+	// find the page and the checks
+	page := "index.html"
+	for _, option := range options {
+		if strings.HasPrefix(option, WebPageOption) {
+			page = strings.TrimPrefix(option, WebPageOption)
+		}
+	}
+	var tests []string
+	for name := range files {
+		if strings.HasPrefix(name, "tests/") && strings.HasSuffix(name, ".js") {
+			tests = append(tests, name)
+		}
+	}
+	sort.Strings(tests)
+	if _, ok := files[page]; !ok {
+		n.ReportCard.LogAndFailf("%s not found", page)
+		return
+	}
+	if len(tests) == 0 {
+		n.ReportCard.LogAndFailf("no checks found in tests/")
+		return
+	}
+
+	// put the files in the container
+	if err := n.PutFiles(files); err != nil {
+		n.ReportCard.LogAndFailf("PutFiles error: %v", err)
+		return
+	}
+
+	// launch the browser and run the checks
+	cmd := append([]string{"webcheck", page}, tests...)
+	stdout, stderr, _, status, err := n.ExecNonInteractive(cmd)
+	if err != nil {
+		n.ReportCard.LogAndFailf("exec error: %v", err)
+		return
+	}
+
+	failed := 0
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		result := new(webCheckResult)
+		if err := json.Unmarshal([]byte(line), result); err != nil {
+			n.ReportCard.LogAndFailf("unexpected output from the browser harness: %s", line)
+			return
+		}
+		if result.Passed {
+			n.ReportCard.AddPassedResult(result.Test, htmlEscapePara("check passed"))
+			continue
+		}
+		failed++
+		details := "<h1>Check failed</h1>\n" + htmlEscapePara(result.Message)
+		if len(result.Console) > 0 {
+			details += "<h1>Browser console</h1>\n" + htmlEscapePre(strings.Join(result.Console, "\n"))
+		}
+		n.ReportCard.AddFailedResult(result.Test, details, result.File)
+	}
+	if err := scanner.Err(); err != nil {
+		n.ReportCard.LogAndFailf("error reading check results: %v", err)
+		return
+	}
+	if len(n.ReportCard.Results) == 0 {
+		n.ReportCard.Failf("no check results found")
+		n.ReportCard.AddFailedResult("browser", "<h1>Unable to run checks</h1>\n"+htmlEscapePre(stderr.String()), "")
+	} else if status != 0 && failed == 0 {
+		n.ReportCard.Failf("browser harness exited with status %d", status)
+	}
+	n.ReportCard.Duration = time.Since(n.Start)
+
+	if n.ReportCard.Note == "" {
+		n.ReportCard.Note = fmt.Sprintf("%d/%d checks passed in %v", len(n.ReportCard.Results)-failed, len(n.ReportCard.Results), n.ReportCard.Duration)
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/meddler"
+)
+
+// Instructors can register webhooks for a course so that outside tools
+// hear about course events without polling. Each webhook follows the
+// outbox with its own cursor, so deliveries are in order and an event is
+// retried until the webhook accepts it. Each delivery is the outbox event
+// as JSON, signed with an HMAC-SHA256 of the body using the webhook secret:
+//
+//	X-Codegrinder-Event: commit-graded
+//	X-Codegrinder-Delivery: <outbox event id>
+//	X-Codegrinder-Signature: sha256=<hex digest>
+
+const (
+	// CourseWebhookInterval is how often webhooks are sent new events.
+	CourseWebhookInterval = 15 * time.Second
+
+	// MaxCourseWebhookFailures is how many failed deliveries in a row
+	// deactivate a webhook.
+	MaxCourseWebhookFailures = 20
+
+	// courseWebhookBatch is the most events sent to a webhook per interval.
+	courseWebhookBatch = 100
+)
+
+// courseWebhookKinds are the outbox events that can be sent to a course webhook.
+var courseWebhookKinds = map[string]bool{
+	EventCommitGraded:      true,
+	EventAssignmentCreated: true,
+	EventScoreChanged:      true,
+	EventScoreOverridden:   true,
+}
+
+// newWebhookSecret generates a new random webhook signing secret.
+func newWebhookSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// signWebhook returns the signature header value for a webhook body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// publicWebhookClient posts to webhooks whose URLs come from users and
+// instructors: user notification webhooks, course webhooks, and grade
+// hooks. It refuses to connect to anything but public addresses, so a URL
+// cannot be used to reach the server's own network. The check is made on the address
+// actually dialed, after DNS resolution and on every redirect, and no
+// proxy is used.
+var publicWebhookClient = &http.Client{
+	Timeout: WebhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: WebhookTimeout,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+					return fmt.Errorf("webhook address %s is not a public address", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: WebhookTimeout,
+	},
+}
+
+// privateNetworks are the address ranges that are not reachable from the
+// public internet, beyond the loopback and link-local ranges that net.IP
+// can identify on its own.
+var privateNetworks = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "0.0.0.0/8", "fc00::/7"} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// isPublicIP reports whether an address is a public unicast address.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkCourseWebhook validates the URL and kinds of a webhook request.
+func checkCourseWebhook(w http.ResponseWriter, hook *CourseWebhook) error {
+	hook.URL = strings.TrimSpace(hook.URL)
+	u, err := url.Parse(hook.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return loggedHTTPErrorf(w, http.StatusBadRequest, "webhook must be an https URL")
+	}
+	for _, kind := range hook.Kinds {
+		if !courseWebhookKinds[kind] {
+			return loggedHTTPErrorf(w, http.StatusBadRequest, "unknown webhook event kind %q", kind)
+		}
+	}
+	if hook.Kinds == nil {
+		hook.Kinds = []string{}
+	}
+	return nil
+}
+
+// loadCourseWebhook loads the webhook named in a request.
+func loadCourseWebhook(w http.ResponseWriter, tx *sql.Tx, params martini.Params) (*CourseWebhook, error) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return nil, err
+	}
+	webhookID, err := parseID(w, "webhook_id", params["webhook_id"])
+	if err != nil {
+		return nil, err
+	}
+	hook := new(CourseWebhook)
+	if err := meddler.QueryRow(tx, hook, `SELECT * FROM course_webhooks WHERE id = $1 AND course_id = $2`, webhookID, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil, err
+	}
+	return hook, nil
+}
+
+// GetCourseWebhooks handles requests to /v2/courses/:course_id/webhooks,
+// returning the webhooks registered for a course. Secrets are not included.
+func GetCourseWebhooks(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	hooks := []*CourseWebhook{}
+	if err := meddler.QueryAll(tx, &hooks, `SELECT * FROM course_webhooks WHERE course_id = $1 ORDER BY id`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	for _, hook := range hooks {
+		hook.Secret = ""
+	}
+	render.JSON(http.StatusOK, hooks)
+}
+
+// PostCourseWebhook handles requests to /v2/courses/:course_id/webhooks,
+// registering a new webhook for a course. The request gives the URL and
+// optionally the event kinds to send. The response includes the signing
+// secret, which is not shown again. The webhook is sent events recorded
+// from now on.
+func PostCourseWebhook(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, hook CourseWebhook, audit *AuditEntry, render render.Render) {
+	now := time.Now()
+
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	if err := checkCourseWebhook(w, &hook); err != nil {
+		return
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error generating webhook secret: %v", err)
+		return
+	}
+
+	// start after every transaction that has already finished
+	var xmin int64
+	if err := tx.QueryRow(`SELECT txid_snapshot_xmin(txid_current_snapshot())`).Scan(&xmin); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	hook.ID = 0
+	hook.CourseID = courseID
+	hook.Secret = secret
+	hook.Active = true
+	hook.Cursor = fmt.Sprintf("%d-0", xmin)
+	hook.Failures = 0
+	hook.LastError = ""
+	hook.CreatedBy = currentUser.ID
+	hook.CreatedAt = now
+	hook.UpdatedAt = now
+	if err := meddler.Insert(tx, "course_webhooks", &hook); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditWebhook, hook.ID, "course %d webhook %d added for %s", courseID, hook.ID, hook.URL)
+	render.JSON(http.StatusOK, &hook)
+}
+
+// PutCourseWebhook handles requests to /v2/courses/:course_id/webhooks/:webhook_id,
+// changing the URL, event kinds, or active setting of a webhook.
+// Reactivating a webhook clears its failure count; it picks up with the
+// event it last failed to deliver.
+func PutCourseWebhook(w http.ResponseWriter, tx *sql.Tx, params martini.Params, request CourseWebhook, audit *AuditEntry, render render.Render) {
+	hook, err := loadCourseWebhook(w, tx, params)
+	if err != nil {
+		return
+	}
+	if err := checkCourseWebhook(w, &request); err != nil {
+		return
+	}
+	if request.Active && !hook.Active {
+		hook.Failures = 0
+		hook.LastError = ""
+	}
+	hook.URL = request.URL
+	hook.Kinds = request.Kinds
+	hook.Active = request.Active
+	hook.UpdatedAt = time.Now()
+	if err := meddler.Update(tx, "course_webhooks", hook); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditWebhook, hook.ID, "course %d webhook %d updated for %s (active %v)", hook.CourseID, hook.ID, hook.URL, hook.Active)
+	hook.Secret = ""
+	render.JSON(http.StatusOK, hook)
+}
+
+// DeleteCourseWebhook handles requests to /v2/courses/:course_id/webhooks/:webhook_id,
+// removing a webhook.
+func DeleteCourseWebhook(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *AuditEntry) {
+	hook, err := loadCourseWebhook(w, tx, params)
+	if err != nil {
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM course_webhooks WHERE id = $1`, hook.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	audit.Record(AuditWebhook, hook.ID, "course %d webhook %d removed", hook.CourseID, hook.ID)
+}
+
+// startCourseWebhooks sends new course events to webhooks in the background.
+func startCourseWebhooks(db *sql.DB) {
+	go func() {
+		for {
+			time.Sleep(CourseWebhookInterval)
+
+			hooks := []*CourseWebhook{}
+			if err := meddler.QueryAll(db, &hooks, `SELECT * FROM course_webhooks WHERE active ORDER BY id`); err != nil {
+				log.Printf("db error finding course webhooks: %v", err)
+				continue
+			}
+			for _, hook := range hooks {
+				deliverCourseWebhook(db, hook)
+			}
+		}
+	}()
+}
+
+// deliverCourseWebhook sends a webhook the events recorded since its
+// cursor, stopping at the first failure so it can be retried next time.
+func deliverCourseWebhook(db *sql.DB, hook *CourseWebhook) {
+	kinds := make(map[string]bool)
+	for _, kind := range hook.Kinds {
+		kinds[kind] = true
+	}
+	name := fmt.Sprintf("course webhook %d", hook.ID)
+	cursor, found, failure := deliverOutbox(db, name, hook.CourseID, "", hook.Cursor, func(event *OutboxEvent) error {
+		if !courseWebhookKinds[event.Kind] || (len(kinds) > 0 && !kinds[event.Kind]) {
+			return nil
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return postSignedWebhook(publicWebhookClient, hook.URL, hook.Secret, event, body)
+	})
+	if !found {
+		return
+	}
+	hook.Cursor = cursor
+	recordDelivery(name, hook.CourseID, failure, &hook.Failures, &hook.LastError, &hook.Active)
+	hook.UpdatedAt = time.Now()
+	if err := meddler.Update(db, "course_webhooks", hook); err != nil {
+		log.Printf("db error saving %s: %v", name, err)
+	}
+}
+
+// deliverOutbox passes the events for a course recorded since cursor to
+// send, in order, stopping at the first failure. If kind is not empty,
+// only events of that kind are considered. It returns the cursor after
+// the last event delivered, whether there were any events to deliver, and
+// the failure, if any. Course webhooks and grade hooks both use it.
+func deliverOutbox(db *sql.DB, name string, courseID int64, kind, cursor string, send func(*OutboxEvent) error) (string, bool, error) {
+	txid, id, err := parseOutboxCursor(cursor)
+	if err != nil {
+		log.Printf("%s: %v", name, err)
+		return cursor, false, nil
+	}
+	events := []*OutboxEvent{}
+	if err := meddler.QueryAll(db, &events, `SELECT * FROM outbox_events `+
+		`WHERE course_id = $1 AND ($2 = '' OR kind = $2) AND (txid, id) > ($3, $4) AND txid < txid_snapshot_xmin(txid_current_snapshot()) `+
+		`ORDER BY txid, id LIMIT $5`, courseID, kind, txid, id, courseWebhookBatch); err != nil {
+		log.Printf("db error finding events for %s: %v", name, err)
+		return cursor, false, nil
+	}
+	if len(events) == 0 {
+		return cursor, false, nil
+	}
+
+	for _, event := range events {
+		if err := send(event); err != nil {
+			return cursor, true, err
+		}
+		cursor = outboxCursor(event)
+	}
+	return cursor, true, nil
+}
+
+// recordDelivery updates the failure count of a webhook or grade hook
+// after a delivery attempt, deactivating it after MaxCourseWebhookFailures
+// failures in a row.
+func recordDelivery(name string, courseID int64, failure error, failures *int, lastError *string, active *bool) {
+	if failure == nil {
+		*failures = 0
+		*lastError = ""
+		return
+	}
+	*failures++
+	*lastError = failure.Error()
+	if *failures >= MaxCourseWebhookFailures {
+		*active = false
+		log.Printf("deactivating %s for course %d after %d failures: %v", name, courseID, *failures, failure)
+	}
+}
+
+// postSignedWebhook posts the body for one event to a URL, signed with
+// the given secret.
+func postSignedWebhook(client *http.Client, url, secret string, event *OutboxEvent, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Codegrinder-Event", event.Kind)
+	req.Header.Set("X-Codegrinder-Delivery", fmt.Sprintf("%d", event.ID))
+	req.Header.Set("X-Codegrinder-Signature", signWebhook(secret, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
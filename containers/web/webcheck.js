@@ -0,0 +1,107 @@
+// webcheck loads a page in headless Chromium and runs instructor checks
+// against it, printing one JSON result per check on standard output.
+//
+// usage: webcheck <page.html> <tests/checks.js>...
+
+"use strict";
+
+const assert = require("assert");
+const fs = require("fs");
+const path = require("path");
+const vm = require("vm");
+const puppeteer = require("/usr/local/lib/webcheck/node_modules/puppeteer-core");
+
+const TEST_TIMEOUT = 10000;
+
+function report(file, test, passed, message, consoleLines) {
+    process.stdout.write(JSON.stringify({ file, test, passed, message, console: consoleLines }) + "\n");
+}
+
+// load a check file, collecting the tests it registers
+function loadTests(file) {
+    const tests = [];
+    const sandbox = {
+        test: (name, fn) => tests.push({ name, fn }),
+        assert,
+        console,
+        setTimeout,
+        clearTimeout,
+    };
+    vm.runInNewContext(fs.readFileSync(file, "utf8"), sandbox, { filename: file });
+    return tests;
+}
+
+function withTimeout(promise, ms) {
+    let timer;
+    return Promise.race([
+        promise,
+        new Promise((_, reject) => {
+            timer = setTimeout(() => reject(new Error(`timed out after ${ms / 1000} seconds`)), ms);
+        }),
+    ]).finally(() => clearTimeout(timer));
+}
+
+async function main() {
+    const [pageFile, ...testFiles] = process.argv.slice(2);
+    if (!pageFile || testFiles.length === 0) {
+        console.error("usage: webcheck <page.html> <tests/checks.js>...");
+        process.exit(2);
+    }
+    const url = "file://" + path.resolve(pageFile);
+
+    const browser = await puppeteer.launch({
+        executablePath: "/usr/bin/chromium",
+        headless: true,
+        args: ["--no-sandbox", "--disable-gpu", "--disable-dev-shm-usage", "--no-first-run"],
+    });
+
+    let failed = 0;
+    try {
+        for (const file of testFiles) {
+            let tests;
+            try {
+                tests = loadTests(file);
+            } catch (err) {
+                failed++;
+                report(file, path.basename(file, ".js"), false, `error loading checks: ${err.message}`, []);
+                continue;
+            }
+
+            // each check file gets a fresh page
+            const page = await browser.newPage();
+            const consoleLines = [];
+            page.on("console", (msg) => consoleLines.push(`${msg.type()}: ${msg.text()}`));
+            page.on("pageerror", (err) => consoleLines.push(`uncaught: ${err.message}`));
+            try {
+                await page.goto(url, { waitUntil: "load", timeout: TEST_TIMEOUT });
+            } catch (err) {
+                for (const t of tests) {
+                    failed++;
+                    report(file, t.name, false, `error loading ${pageFile}: ${err.message}`, consoleLines.slice());
+                }
+                await page.close();
+                continue;
+            }
+
+            for (const t of tests) {
+                const start = consoleLines.length;
+                try {
+                    await withTimeout(Promise.resolve(t.fn(page)), TEST_TIMEOUT);
+                    report(file, t.name, true, "", []);
+                } catch (err) {
+                    failed++;
+                    report(file, t.name, false, err && err.message ? err.message : String(err), consoleLines.slice(start));
+                }
+            }
+            await page.close();
+        }
+    } finally {
+        await browser.close();
+    }
+    process.exit(failed > 0 ? 1 : 0);
+}
+
+main().catch((err) => {
+    console.error(err && err.stack ? err.stack : String(err));
+    process.exit(3);
+});
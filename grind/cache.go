@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// maxCachedResponse is the largest response body that will be kept in the
+// on-disk cache. Larger responses are rare and not worth the disk space.
+const maxCachedResponse = 1 << 20
+
+// cachedResponse is a GET response saved along with the ETag the server
+// gave it, so the next request can ask whether it has changed. Every
+// successful GET is kept, even without an ETag, so that commands like
+// "grind status" still work when the server cannot be reached.
+type cachedResponse struct {
+	ETag    string    `json:"etag"`
+	Body    []byte    `json:"body"`
+	SavedAt time.Time `json:"savedAt"`
+}
+
+// offlineSince is the save time of the oldest cached response used in
+// place of a live one during this run, or zero if everything came from
+// the server.
+var offlineSince time.Time
+
+// cachePath returns the file that holds the cached response for a URL.
+// The session cookie is part of the key so that users sharing a machine
+// never see each other's responses.
+func cachePath(url string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(Config.Cookie + Config.Token + "\n" + url))
+	return filepath.Join(dir, "codegrinder", hex.EncodeToString(sum[:])+".bin"), nil
+}
+
+// cacheCipher returns the cipher used to seal cache entries. The key comes
+// from the user's credentials, so the cache is unreadable to anyone who
+// does not also hold the grind config file.
+func cacheCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("codegrinder cache\n" + Config.Cookie + Config.Token))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// cacheLookup returns the cached response for a URL, or nil if there is none.
+func cacheLookup(url string) *cachedResponse {
+	path, err := cachePath(url)
+	if err != nil {
+		return nil
+	}
+	sealed, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	gcm, err := cacheCipher()
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return nil
+	}
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	raw, err := gcm.Open(nil, nonce, sealed, []byte(url))
+	if err != nil {
+		return nil
+	}
+	elt := new(cachedResponse)
+	if err := json.Unmarshal(raw, elt); err != nil {
+		return nil
+	}
+	return elt
+}
+
+// cacheStore saves a response for a URL. Failures are not fatal since the
+// cache is only an optimization.
+func cacheStore(url, etag string, body []byte) {
+	if len(body) > maxCachedResponse {
+		return
+	}
+	path, err := cachePath(url)
+	if err != nil {
+		return
+	}
+	raw, err := json.Marshal(&cachedResponse{ETag: etag, Body: body, SavedAt: time.Now()})
+	if err != nil {
+		return
+	}
+	gcm, err := cacheCipher()
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return
+	}
+	sealed := gcm.Seal(nonce, nonce, raw, []byte(url))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		if Config.apiReport {
+			log.Printf("error creating cache directory: %v", err)
+		}
+		return
+	}
+	if err := ioutil.WriteFile(path, sealed, 0600); err != nil && Config.apiReport {
+		log.Printf("error saving cached response: %v", err)
+	}
+}
+
+// useCached notes that a cached response is standing in for one the
+// server could not provide. The user is told once per run.
+func useCached(url string, elt *cachedResponse) {
+	if offlineSince.IsZero() {
+		log.Printf(T("offline: showing information cached %s ago"), roughDuration(time.Since(elt.SavedAt)))
+	}
+	if Config.apiReport {
+		log.Printf("using response for %s cached at %s", url, elt.SavedAt.Local().Format(DeadlineFormat))
+	}
+	if offlineSince.IsZero() || elt.SavedAt.Before(offlineSince) {
+		offlineSince = elt.SavedAt
+	}
+}
+
+// cachedLabel returns a note to add to information shown to the user if
+// any of it came from the cache, or "" if it is all current.
+func cachedLabel() string {
+	if offlineSince.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf(T(" (cached %s)"), offlineSince.Local().Format(DeadlineFormat))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/mattn/go-isatty"
+	. "github.com/russross/codegrinder/types"
+)
+
+// confirmChecklist asks the student to confirm each item on the problem's
+// checklist before the first graded attempt at a step, and records the
+// confirmation in the commit. Steps already confirmed are not asked again.
+func confirmChecklist(problem *Problem, commit *Commit) error {
+	if len(problem.Checklist) == 0 {
+		return nil
+	}
+	last := new(Commit)
+	found, err := getObjectIfExists(fmt.Sprintf("/assignments/%d/problems/%d/steps/%d/commits/last", commit.AssignmentID, commit.ProblemID, commit.Step), nil, last)
+	if err != nil {
+		return err
+	}
+	if found && problem.ChecklistConfirmed(last.Checklist) {
+		commit.Checklist = last.Checklist
+		return nil
+	}
+
+	if !isatty.IsTerminal(os.Stdin.Fd()) {
+		return validationErrorf("%s has a checklist to confirm before your first graded attempt at step %d; run this in a terminal to confirm it", problem.Unique, commit.Step)
+	}
+	fmt.Printf(T("before your first graded attempt at step %d of %s, confirm each item:")+"\n", commit.Step, problem.Unique)
+	in := bufio.NewReader(os.Stdin)
+	for _, item := range problem.Checklist {
+		fmt.Printf("  %s %s ", item, T("[y/N]"))
+		line, _ := in.ReadString('\n')
+		if !isYes(line) {
+			return validationErrorf("%s", T("stopped at your request"))
+		}
+	}
+	commit.Checklist = append([]string{}, problem.Checklist...)
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// CommandHistory lists the checkpoints saved for the current problem.
+func CommandHistory(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	dir := ""
+	switch len(args) {
+	case 0:
+		dir = "."
+	case 1:
+		dir = args[0]
+	default:
+		cmd.Help()
+		return nil
+	}
+
+	problem, _, commit, _, err := gather(now, dir)
+	if err != nil {
+		return err
+	}
+	checkpoints, err := getCheckpoints(commit)
+	if err != nil {
+		return err
+	}
+	if len(checkpoints) == 0 {
+		log.Printf("no checkpoints saved for %s", problem.Unique)
+		log.Printf(`  use "grind save -m <label>" to save one`)
+		return nil
+	}
+	for n, checkpoint := range checkpoints {
+		fmt.Printf("%3d: %s  step %d  %s\n", n+1, checkpoint.CreatedAt.Local().Format("Jan 2 15:04"), checkpoint.Step, checkpoint.Label)
+	}
+	return nil
+}
+
+// CommandCheckout restores the files for the current problem from a
+// checkpoint, first saving the current files as a checkpoint of their own.
+func CommandCheckout(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	if len(args) != 1 {
+		cmd.Help()
+		return nil
+	}
+	name := args[0]
+
+	problem, _, commit, dotfile, err := gather(now, ".")
+	if err != nil {
+		return err
+	}
+	checkpoints, err := getCheckpoints(commit)
+	if err != nil {
+		return err
+	}
+
+	// find the checkpoint by label, newest first, then by number
+	var found *Checkpoint
+	for i := len(checkpoints) - 1; i >= 0 && found == nil; i-- {
+		if checkpoints[i].Label == name {
+			found = checkpoints[i]
+		}
+	}
+	if n, err := strconv.Atoi(name); found == nil && err == nil && n >= 1 && n <= len(checkpoints) {
+		found = checkpoints[n-1]
+	}
+	if found == nil {
+		return validationErrorf("no checkpoint named %q\nuse \"grind history\" to list your checkpoints", name)
+	}
+	if found.Step != commit.Step {
+		return validationErrorf("checkpoint %q is from step %d, but you are working on step %d", found.Label, found.Step, commit.Step)
+	}
+
+	checkpoint := new(Checkpoint)
+	if err := getObject(fmt.Sprintf("/assignments/%d/problems/%d/checkpoints/%d", commit.AssignmentID, commit.ProblemID, found.ID), nil, checkpoint); err != nil {
+		return err
+	}
+
+	// keep the current files so the checkout can be undone
+	backup := fmt.Sprintf("before checkout of %s", found.Label)
+	if err := saveCommit(commit, backup); err != nil {
+		return err
+	}
+	log.Printf("saved your current files as checkpoint %q", backup)
+
+	// replace the files
+	problemDir := filepath.Dir(dotfile.Path)
+	if len(dotfile.Problems) > 1 {
+		problemDir = filepath.Join(problemDir, problem.Unique)
+	}
+	for name := range commit.Files {
+		if _, ok := checkpoint.Files[name]; !ok {
+			if err := os.Remove(filepath.Join(problemDir, name)); err != nil {
+				return configErrorf("error removing %s: %w", name, err)
+			}
+		}
+	}
+	for name, contents := range checkpoint.Files {
+		if err := ioutil.WriteFile(filepath.Join(problemDir, name), []byte(localLineEndings(contents)), 0644); err != nil {
+			return configErrorf("error writing %s: %w", name, err)
+		}
+	}
+	log.Printf("restored %d file%s from checkpoint %q", len(checkpoint.Files), plural(len(checkpoint.Files)), found.Label)
+	return nil
+}
+
+// getCheckpoints fetches the checkpoints for a commit's problem, oldest first.
+func getCheckpoints(commit *Commit) ([]*Checkpoint, error) {
+	checkpoints := []*Checkpoint{}
+	path := fmt.Sprintf("/assignments/%d/problems/%d/checkpoints", commit.AssignmentID, commit.ProblemID)
+	if err := getObject(path, nil, &checkpoints); err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
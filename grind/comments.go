@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// CommandComments shows the comments instructors have left on the saved
+// work for the current problem, each with the lines of code it refers to.
+func CommandComments(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	dir := ""
+	switch len(args) {
+	case 0:
+		dir = "."
+	case 1:
+		dir = args[0]
+	default:
+		cmd.Help()
+		return nil
+	}
+
+	problem, assignment, _, _, err := gather(now, dir)
+	if err != nil {
+		return err
+	}
+	commit := new(Commit)
+	found, err := getObjectIfExists(fmt.Sprintf("/assignments/%d/problems/%d/commits/last", assignment.ID, problem.ID), nil, commit)
+	if err != nil {
+		return err
+	}
+	if !found {
+		log.Printf("no work has been saved for %s", problem.Unique)
+		return nil
+	}
+	comments := []*CommitComment{}
+	if err := getObject(fmt.Sprintf("/commits/%d/comments", commit.ID), nil, &comments); err != nil {
+		return err
+	}
+	if len(comments) == 0 {
+		log.Printf("no comments on your work for %s step %d", problem.Unique, commit.Step)
+		return nil
+	}
+
+	log.Printf("%d comment%s on your work for %s step %d", len(comments), plural(len(comments)), problem.Unique, commit.Step)
+	for _, comment := range comments {
+		fmt.Println()
+		lines := fmt.Sprintf("line %d", comment.LineStart)
+		if comment.LineEnd > comment.LineStart {
+			lines = fmt.Sprintf("lines %d-%d", comment.LineStart, comment.LineEnd)
+		}
+		color.Cyan("%s %s, %s on %s\n", comment.File, lines, comment.AuthorName, comment.CreatedAt.Local().Format("Jan 2 15:04"))
+		for n, line := range strings.Split(comment.Excerpt, "\n") {
+			fmt.Printf("%5d | %s\n", comment.LineStart+n, line)
+		}
+		for _, line := range strings.Split(comment.Body, "\n") {
+			color.Yellow("    %s\n", line)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// completionCacheAge is how long the list of assignment names used for shell
+// completion is reused before it is fetched from the server again.
+const completionCacheAge = time.Hour
+
+// bashCompletionFunction is called by the generated bash completion script
+// when cobra has no completions of its own, which is the case for the
+// assignment argument to grind get.
+const bashCompletionFunction = `
+__custom_func() {
+    case ${last_command} in
+        grind_get)
+            local names
+            names=$(grind __complete-names 2>/dev/null)
+            COMPREPLY=( $(compgen -W "${names}" -- "${cur}") )
+            return
+            ;;
+        *)
+            ;;
+    esac
+}
+`
+
+// CommandCompletion prints a shell completion script.
+func CommandCompletion(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return validationErrorf("usage: grind completion [bash|zsh|fish]")
+	}
+	root := cmd.Root()
+	switch args[0] {
+	case "bash":
+		return root.GenBashCompletion(os.Stdout)
+	case "zsh":
+		// zsh can run bash completion scripts through bashcompinit
+		fmt.Println("autoload -U +X compinit && compinit")
+		fmt.Println("autoload -U +X bashcompinit && bashcompinit")
+		return root.GenBashCompletion(os.Stdout)
+	case "fish":
+		return genFishCompletion(root)
+	default:
+		return validationErrorf("unknown shell %q: expected bash, zsh, or fish", args[0])
+	}
+}
+
+func genFishCompletion(root *cobra.Command) error {
+	for _, sub := range root.Commands() {
+		if sub.Hidden {
+			continue
+		}
+		fmt.Printf("complete -c grind -f -n '__fish_use_subcommand' -a %s -d %q\n", sub.Name(), sub.Short)
+	}
+	fmt.Printf("complete -c grind -f -n '__fish_seen_subcommand_from get' -a '(grind __complete-names 2>/dev/null)'\n")
+	fmt.Printf("complete -c grind -f -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'\n")
+	return nil
+}
+
+// CommandCompleteNames prints the names of the assignments available to the
+// user, one per line, for use by shell completion scripts.
+// The list is cached locally so that completion stays fast.
+func CommandCompleteNames(cmd *cobra.Command, args []string) error {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return configErrorf("unable to locate cache directory: %w", err)
+	}
+	path := filepath.Join(dir, "codegrinder", "completion-names.json")
+
+	var names []string
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < completionCacheAge {
+		if raw, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(raw, &names) == nil {
+			fmt.Println(strings.Join(names, "\n"))
+			return nil
+		}
+	}
+
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	user := new(User)
+	if err := getObject("/users/me", nil, user); err != nil {
+		return err
+	}
+	assignments := []*Assignment{}
+	if err := getObject(fmt.Sprintf("/users/%d/assignments", user.ID), nil, &assignments); err != nil {
+		return err
+	}
+	courses := make(map[int64]*Course)
+	for _, asst := range assignments {
+		course, ok := courses[asst.CourseID]
+		if !ok {
+			course = new(Course)
+			if err := getObject(fmt.Sprintf("/courses/%d", asst.CourseID), nil, course); err != nil {
+				return err
+			}
+			courses[course.ID] = course
+		}
+		problemSet := new(ProblemSet)
+		if err := getObject(fmt.Sprintf("/problem_sets/%d", asst.ProblemSetID), nil, problemSet); err != nil {
+			return err
+		}
+		names = append(names, course.Label+"/"+problemSet.Unique)
+	}
+
+	if raw, err := json.Marshal(names); err == nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+			ioutil.WriteFile(path, raw, 0600)
+		}
+	}
+	fmt.Println(strings.Join(names, "\n"))
+	return nil
+}
+
+// expandAlias replaces a user-defined alias from .codegrinderrc at the start
+// of the command line with its expansion. Aliases cannot override built-in
+// commands, and a missing or unreadable config file is ignored here since
+// the command itself will report it.
+func expandAlias(root *cobra.Command, args []string) []string {
+	if len(args) == 0 {
+		return args
+	}
+	for _, sub := range root.Commands() {
+		if sub.Name() == args[0] || sub.HasAlias(args[0]) {
+			return args
+		}
+	}
+	configFile, err := configPath(false)
+	if err != nil {
+		return args
+	}
+	raw, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return args
+	}
+	var config struct {
+		Aliases map[string]string `json:"aliases"`
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return args
+	}
+	expansion, ok := config.Aliases[args[0]]
+	if !ok {
+		return args
+	}
+	return append(strings.Fields(expansion), args[1:]...)
+}
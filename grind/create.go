@@ -21,8 +21,10 @@ import (
 
 const ProblemConfigName string = "problem.cfg"
 
-func CommandCreate(cmd *cobra.Command, args []string) {
-	mustLoadConfig(cmd)
+func CommandCreate(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
 	now := time.Now()
 
 	// find the directory
@@ -34,11 +36,11 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 		d = args[0]
 	default:
 		cmd.Help()
-		return
+		return nil
 	}
 	dir, err := filepath.Abs(d)
 	if err != nil {
-		log.Fatalf("error finding directory %q: %v", d, err)
+		return configErrorf("error finding directory %q: %w", d, err)
 	}
 
 	// find the problem.cfg file
@@ -50,13 +52,13 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 				old := dir
 				dir = filepath.Dir(dir)
 				if dir == old {
-					log.Fatalf("unable to find %s in %s or an ancestor directory", ProblemConfigName, d)
+					return configErrorf("unable to find %s in %s or an ancestor directory", ProblemConfigName, d)
 				}
 				log.Printf("could not find %s in %s, trying %s", ProblemConfigName, old, dir)
 				continue
 			}
 
-			log.Fatalf("error searching for %s in %s: %v", ProblemConfigName, dir, err)
+			return configErrorf("error searching for %s in %s: %w", ProblemConfigName, dir, err)
 		}
 		break
 	}
@@ -64,23 +66,27 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 	// parse problem.cfg
 	cfg := struct {
 		Problem struct {
-			Unique string
-			Note   string
-			Type   string
-			Tag    []string
-			Option []string
+			Unique    string
+			Note      string
+			Type      string
+			Tag       []string
+			Option    []string
+			Checklist []string
 		}
 		Step map[string]*struct {
 			Note   string
 			Weight float64
 		}
+		Variant map[string]*struct {
+			Weight float64
+		}
 	}{}
 
 	configPath := filepath.Join(dir, ProblemConfigName)
 	fmt.Printf("reading %s\n", configPath)
 	err = gcfg.ReadFileInto(&cfg, configPath)
 	if err != nil {
-		log.Fatalf("failed to parse %s: %v", configPath, err)
+		return validationErrorf("failed to parse %s: %w", configPath, err)
 	}
 
 	// create problem object
@@ -90,9 +96,26 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 		ProblemType: cfg.Problem.Type,
 		Tags:        cfg.Problem.Tag,
 		Options:     cfg.Problem.Option,
+		Checklist:   cfg.Problem.Checklist,
 		CreatedAt:   now,
 		UpdatedAt:   now,
 	}
+	if len(cfg.Variant) > 0 {
+		problem.Variants = make(map[string]float64)
+		for name, variant := range cfg.Variant {
+			weight := variant.Weight
+			if weight <= 0.0 {
+				weight = 1.0
+			}
+			problem.Variants[name] = weight
+		}
+	}
+
+	// a dry run tests the solution without saving anything
+	dryRun := cmd.Flag("dry-run").Value.String() == "true"
+	if dryRun {
+		log.Printf("dry run: the problem will be tested but not saved")
+	}
 
 	// start forming the problem bundle
 	unsigned := &ProblemBundle{
@@ -101,30 +124,35 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 
 	// check if this is an existing problem
 	existing := []*Problem{}
-	mustGetObject("/problems", map[string]string{"unique": problem.Unique}, &existing)
+	if err := getObject("/problems", map[string]string{"unique": problem.Unique}, &existing); err != nil {
+		return err
+	}
 	switch len(existing) {
 	case 0:
 		// new problem
 		if cmd.Flag("update").Value.String() == "true" {
-			log.Fatalf("you specified --update, but no existing problem with unique ID %q was found", problem.Unique)
+			return validationErrorf("you specified --update, but no existing problem with unique ID %q was found", problem.Unique)
 		}
 
 		// make sure the problem set with this unique name is free as well
 		existingSets := []*ProblemSet{}
-		mustGetObject("/problem_sets", map[string]string{"unique": problem.Unique}, &existingSets)
+		if err := getObject("/problem_sets", map[string]string{"unique": problem.Unique}, &existingSets); err != nil {
+			return err
+		}
 		if len(existingSets) > 1 {
-			log.Fatalf("error: server found multiple problem sets with matching unique ID %q", problem.Unique)
+			return validationErrorf("error: server found multiple problem sets with matching unique ID %q", problem.Unique)
 		}
-		if len(existingSets) != 0 {
-			log.Printf("problem set %d already exists with unique ID %q", existingSets[0].ID, existingSets[0].Unique)
-			log.Fatalf("  this would prevent creating a problem set containing just this problem with matching id")
+		if len(existingSets) != 0 && !dryRun {
+			return validationErrorf("problem set %d already exists with unique ID %q\n"+
+				"  this would prevent creating a problem set containing just this problem with matching id",
+				existingSets[0].ID, existingSets[0].Unique)
 		}
 
 		log.Printf("this problem is new--no existing problem has the same unique ID")
 	case 1:
 		// update to existing problem
-		if cmd.Flag("update").Value.String() == "false" {
-			log.Fatalf("you did not specify --update, but a problem already exists with unique ID %q", problem.Unique)
+		if cmd.Flag("update").Value.String() == "false" && !dryRun {
+			return validationErrorf("you did not specify --update, but a problem already exists with unique ID %q", problem.Unique)
 		}
 		log.Printf("unique ID is %s", problem.Unique)
 		log.Printf("  this is an update of problem %d (%q)", existing[0].ID, existing[0].Note)
@@ -132,7 +160,7 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 		problem.CreatedAt = existing[0].CreatedAt
 	default:
 		// server does not know what "unique" means
-		log.Fatalf("error: server found multiple problems with matching unique ID %q", problem.Unique)
+		return validationErrorf("error: server found multiple problems with matching unique ID %q", problem.Unique)
 	}
 
 	// generate steps
@@ -160,20 +188,26 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 		stepdir := filepath.Join(dir, strconv.FormatInt(i, 10))
 		err := filepath.Walk(stepdir, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
-				log.Fatalf("walk error for %s: %v", path, err)
+				return err
 			}
 			if info.IsDir() {
 				return nil
 			}
 			relpath, err := filepath.Rel(stepdir, path)
 			if err != nil {
-				log.Fatalf("error finding relative path of %s: %v", path, err)
+				return fmt.Errorf("error finding relative path of %s: %w", path, err)
 			}
 
 			// load the file and add it to the appropriate place
 			contents, err := ioutil.ReadFile(path)
 			if err != nil {
-				log.Fatalf("error reading %s: %v", relpath, err)
+				return fmt.Errorf("error reading %s: %w", relpath, err)
+			}
+
+			// an optional WebAssembly pre-check module
+			if relpath == precheckFile {
+				step.Precheck = contents
+				return nil
 			}
 
 			// pick out solution/starter files
@@ -191,12 +225,12 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 			return nil
 		})
 		if err != nil {
-			log.Fatalf("walk error for %s: %v", stepdir, err)
+			return configErrorf("walk error for %s: %w", stepdir, err)
 		}
 
 		// find starter files and solution files
 		if len(solution) > 0 && len(starter) > 0 && len(root) > 0 {
-			log.Fatalf("found files in _starter, _solution, and root directory; unsure how to proceed")
+			return validationErrorf("found files in _starter, _solution, and root directory; unsure how to proceed")
 		}
 		if len(solution) > 0 {
 			// explicit solution
@@ -205,7 +239,7 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 			solution = root
 			root = nil
 		} else {
-			log.Fatalf("no solution files found in _solution or root directory; problem must have a solution")
+			return validationErrorf("no solution files found in _solution or root directory; problem must have a solution")
 		}
 		if len(starter) == 0 && root != nil {
 			starter = root
@@ -235,18 +269,24 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 	}
 
 	if len(unsigned.ProblemSteps) != len(cfg.Step) {
-		log.Fatalf("expected to find %d step%s, but only found %d", len(cfg.Step), plural(len(cfg.Step)), len(unsigned.ProblemSteps))
+		return validationErrorf("expected to find %d step%s, but only found %d", len(cfg.Step), plural(len(cfg.Step)), len(unsigned.ProblemSteps))
 	}
 
 	// get user ID
 	user := new(User)
-	mustGetObject("/users/me", nil, user)
+	if err := getObject("/users/me", nil, user); err != nil {
+		return err
+	}
 
 	// get the request validated and signed
 	signed := new(ProblemBundle)
-	mustPostObject("/problem_bundles/unconfirmed", nil, unsigned, signed)
+	if err := postObject("/problem_bundles/unconfirmed", nil, unsigned, signed); err != nil {
+		return err
+	}
 
 	// validate the commits one at a time
+	// a dry run keeps going after a failure so every step is reported
+	passed := make([]bool, len(signed.ProblemSteps))
 	for n := 0; n < len(signed.ProblemSteps); n++ {
 		log.Printf("validating solution for step %d", n+1)
 		unvalidated := &CommitBundle{
@@ -256,10 +296,17 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 			Commit:           signed.Commits[n],
 			CommitSignature:  signed.CommitSignatures[n],
 		}
-		validated := mustConfirmCommitBundle(user.ID, unvalidated, nil)
+		validated, err := confirmCommitBundle(user.ID, unvalidated, nil)
+		if err != nil {
+			return err
+		}
 		log.Printf("  finished validating solution")
-		if validated.Commit.ReportCard == nil || validated.Commit.Score != 1.0 || !validated.Commit.ReportCard.Passed {
-			log.Printf("  solution for step %d failed: %s", n+1, validated.Commit.ReportCard.Note)
+		if !validated.Commit.StepPassed() {
+			note := "no report card"
+			if validated.Commit.ReportCard != nil {
+				note = validated.Commit.ReportCard.Note
+			}
+			log.Printf("  solution for step %d failed: %s", n+1, note)
 
 			// play the transcript
 			for _, event := range validated.Commit.Transcript {
@@ -276,10 +323,16 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 					color.Cyan("%s\n", event.ExitStatus)
 				case "error":
 					color.Red("Error: %s\n", event.Error)
+				case "usage":
+					color.Cyan("resources: %s\n", event.Usage)
 				}
 			}
-			log.Fatalf("please fix solution and try again")
+			if dryRun {
+				continue
+			}
+			return validationErrorf("please fix solution and try again")
 		}
+		passed[n] = true
 		signed.Problem = validated.Problem
 		signed.ProblemSteps = validated.ProblemSteps
 		signed.ProblemSignature = validated.ProblemSignature
@@ -287,14 +340,36 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 		signed.CommitSignatures[n] = validated.CommitSignature
 	}
 
+	if dryRun {
+		failed := 0
+		log.Printf("dry run results for %s:", signed.Problem.Unique)
+		for n, ok := range passed {
+			if ok {
+				log.Printf("  step %d: passed", n+1)
+			} else {
+				log.Printf("  step %d: FAILED", n+1)
+				failed++
+			}
+		}
+		if failed > 0 {
+			return validationErrorf("%d of %d step%s failed; nothing was saved", failed, len(passed), plural(len(passed)))
+		}
+		log.Printf("all steps passed; nothing was saved")
+		return nil
+	}
+
 	log.Printf("problem and solution confirmed successfully")
 
 	// save the problem
 	final := new(ProblemBundle)
 	if signed.Problem.ID == 0 {
-		mustPostObject("/problem_bundles/confirmed", nil, signed, final)
+		err = postObject("/problem_bundles/confirmed", nil, signed, final)
 	} else {
-		mustPutObject(fmt.Sprintf("/problem_bundles/%d", signed.Problem.ID), nil, signed, final)
+		signed.Changelog, _ = cmd.Flags().GetString("changelog")
+		err = putObject(fmt.Sprintf("/problem_bundles/%d", signed.Problem.ID), nil, signed, final)
+	}
+	if err != nil {
+		return err
 	}
 	log.Printf("problem %q saved and ready to use", final.Problem.Unique)
 
@@ -316,51 +391,108 @@ func CommandCreate(cmd *cobra.Command, args []string) {
 			Weights:    []float64{1.0},
 		}
 		finalPSBundle := new(ProblemSetBundle)
-		mustPostObject("/problem_set_bundles", nil, psBundle, finalPSBundle)
+		if err := postObject("/problem_set_bundles", nil, psBundle, finalPSBundle); err != nil {
+			return err
+		}
 		log.Printf("problem set %q created and ready to use for this problem", finalPSBundle.ProblemSet.Unique)
 	}
+	return nil
 }
 
-func mustConfirmCommitBundle(userID int64, bundle *CommitBundle, args []string) *CommitBundle {
+// reportImagePull tells the user why grading is taking a while when the
+// daycare has to download a container image first.
+func reportImagePull(pull *ImagePull) {
+	switch pull.Status {
+	case "waiting":
+		log.Printf("waiting for the server to finish downloading %s", pull.Image)
+	case "pulling":
+		log.Printf("server is downloading %s: %d/%d layers, %d%%", pull.Image, pull.LayersDone, pull.Layers, pull.Percent)
+	case "complete":
+		log.Printf("server finished downloading %s", pull.Image)
+	}
+}
+
+// ordinal formats a place in line, e.g., 1st, 2nd, 7th.
+func ordinal(n int) string {
+	suffix := "th"
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+	return strconv.Itoa(n) + suffix
+}
+
+func confirmCommitBundle(userID int64, bundle *CommitBundle, args []string) (*CommitBundle, error) {
+	reply, err := runDaycareRequest(bundle.Problem.ProblemType, bundle.Commit.Action, &DaycareRequest{UserID: userID, CommitBundle: bundle})
+	if err != nil {
+		return nil, err
+	}
+	return reply.CommitBundle, nil
+}
+
+// confirmSetCommitBundle sends every commit of a problem set that is graded
+// together to the daycare in one session.
+func confirmSetCommitBundle(userID int64, set *SetCommitBundle) (*SetCommitBundle, error) {
+	first := set.Bundles[0]
+	reply, err := runDaycareRequest(first.Problem.ProblemType, first.Commit.Action, &DaycareRequest{UserID: userID, SetCommitBundle: set})
+	if err != nil {
+		return nil, err
+	}
+	if reply.SetCommitBundle == nil {
+		return nil, networkErrorf("unexpected reply from server")
+	}
+	return reply.SetCommitBundle, nil
+}
+
+// runDaycareRequest sends a request to the daycare and reports its progress
+// until it returns the graded result.
+func runDaycareRequest(problemType, action string, req *DaycareRequest) (*DaycareResponse, error) {
 	verbose := false
 
 	// create a websocket connection to the server
 	headers := make(http.Header)
-	url := "wss://" + Config.Host + "/v2/sockets/" + bundle.Problem.ProblemType + "/" + bundle.Commit.Action
+	url := "wss://" + Config.Host + "/v2/sockets/" + problemType + "/" + action
 	socket, resp, err := websocket.DefaultDialer.Dial(url, headers)
 	if err != nil {
-		log.Printf("error dialing %s: %v", url, err)
 		if resp != nil && resp.Body != nil {
 			io.Copy(os.Stderr, resp.Body)
 			resp.Body.Close()
 		}
-		log.Fatalf("giving up")
+		return nil, networkErrorf("error dialing %s: %w", url, err)
 	}
 	defer socket.Close()
 
-	// form the initial request
-	req := &DaycareRequest{UserID: userID, CommitBundle: bundle}
+	// send the initial request
 	if err := socket.WriteJSON(req); err != nil {
-		log.Fatalf("error writing request message: %v", err)
+		return nil, networkErrorf("error writing request message: %w", err)
 	}
 
 	// start listening for events
 	for {
 		reply := new(DaycareResponse)
 		if err := socket.ReadJSON(reply); err != nil {
-			log.Fatalf("socket error reading event: %v", err)
-			break
+			return nil, networkErrorf("socket error reading event: %w", err)
 		}
 
 		switch {
 		case reply.Error != "":
-			log.Printf("server returned an error:")
-			log.Fatalf("  %s", reply.Error)
+			return nil, validationErrorf("server returned an error:\n  %s", reply.Error)
 
-		case reply.CommitBundle != nil:
-			return reply.CommitBundle
+		case reply.CommitBundle != nil, reply.SetCommitBundle != nil:
+			return reply, nil
 
 		case reply.Event != nil:
+			if reply.Event.Event == "pull" && reply.Event.Pull != nil {
+				reportImagePull(reply.Event.Pull)
+			}
+			if reply.Event.Event == "queue" {
+				log.Printf("the grader is busy: you are %s in line", ordinal(reply.Event.Position))
+			}
 			if verbose {
 				switch reply.Event.Event {
 				case "exec":
@@ -375,14 +507,13 @@ func mustConfirmCommitBundle(userID int64, bundle *CommitBundle, args []string)
 					color.Cyan("exit: %s\n", reply.Event.ExitStatus)
 				case "error":
 					color.Red("Error: %s\n", reply.Event.Error)
+				case "usage":
+					color.Cyan("resources: %s\n", reply.Event.Usage)
 				}
 			}
 
 		default:
-			log.Fatalf("unexpected reply from server")
+			return nil, networkErrorf("unexpected reply from server")
 		}
 	}
-
-	log.Fatalf("no commit returned from server")
-	return nil
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// localDeadline renders an assignment's due date, or "" if it has none.
+// It uses the timezone chosen on the server if there is one, and the
+// timezone of this machine otherwise.
+func localDeadline(asst *Assignment) string {
+	if asst.DueAt == nil {
+		return ""
+	}
+	if asst.Deadline != nil && asst.Deadline.Timezone != "" {
+		return asst.Deadline.Local
+	}
+	return asst.DueAt.Local().Format(DeadlineFormat)
+}
+
+// warnDeadline prints the due date of an assignment, with a warning if it
+// has passed or is close.
+func warnDeadline(now time.Time, asst *Assignment) {
+	if asst.DueAt == nil {
+		return
+	}
+	due := localDeadline(asst)
+	remaining := asst.DueAt.Sub(now)
+	switch {
+	case remaining < 0:
+		log.Printf("warning: %s was due %s (%s ago)%s", asst.CanvasTitle, due, roughDuration(-remaining), cachedLabel())
+	case remaining < DeadlineWarning:
+		log.Printf("warning: %s is due %s (in %s)%s", asst.CanvasTitle, due, roughDuration(remaining), cachedLabel())
+	default:
+		log.Printf("%s is due %s%s", asst.CanvasTitle, due, cachedLabel())
+	}
+}
+
+// roughDuration renders a duration in the largest sensible unit.
+func roughDuration(d time.Duration) string {
+	n, unit := int(d.Minutes()+0.5), "minute"
+	switch {
+	case d >= 48*time.Hour:
+		n, unit = int(d.Hours()/24), "day"
+	case d >= 2*time.Hour:
+		n, unit = int(d.Hours()), "hour"
+	case n < 1:
+		n = 1
+	}
+	return fmt.Sprintf("%d %s%s", n, unit, plural(n))
+}
+
+// CommandTimezone shows or sets the timezone used to display deadlines.
+func CommandTimezone(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+
+	user := new(User)
+	clear, _ := cmd.Flags().GetBool("clear")
+	switch {
+	case clear && len(args) == 0:
+		if _, err := doRequest("/users/me/timezone", nil, "PUT", &UserTimezone{}, user, false); err != nil {
+			return err
+		}
+	case len(args) == 0:
+		if err := getObject("/users/me", nil, user); err != nil {
+			return err
+		}
+	case len(args) == 1 && !clear:
+		if _, err := LoadTimezone(args[0]); err != nil {
+			return validationErrorf("%v", err)
+		}
+		if _, err := doRequest("/users/me/timezone", nil, "PUT", &UserTimezone{Timezone: args[0]}, user, false); err != nil {
+			return err
+		}
+	default:
+		cmd.Help()
+		return nil
+	}
+
+	if user.Timezone == "" {
+		log.Printf("no timezone is set: deadlines are shown in this computer's timezone (%s)", time.Now().Format("MST"))
+	} else {
+		log.Printf("deadlines are shown in %s", user.Timezone)
+	}
+	return nil
+}
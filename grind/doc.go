@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// htmlBreak matches tags that end a block of text in step instructions.
+var htmlBreak = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|li|h[1-6]|pre|tr)>`)
+
+// blankLines matches runs of blank lines left behind by stripped markup.
+var blankLines = regexp.MustCompile(`\n\s*\n\s*\n+`)
+
+// CommandDoc prints the instructions for the current step of a problem.
+// The instructions are cached like any other response, so this works
+// without a connection once the step has been viewed or checked.
+func CommandDoc(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	dir := ""
+	switch len(args) {
+	case 0:
+		dir = "."
+	case 1:
+		dir = args[0]
+	default:
+		cmd.Help()
+		return nil
+	}
+
+	problem, assignment, commit, _, err := gather(now, dir)
+	if err != nil {
+		return err
+	}
+	step := new(ProblemStep)
+	if err := getObject(fmt.Sprintf("/problems/%d/steps/%d", problem.ID, commit.Step), nil, step); err != nil {
+		return err
+	}
+
+	log.Printf("%s: %s step %d%s", assignment.CanvasTitle, problem.Unique, commit.Step, cachedLabel())
+	warnDeadline(now, assignment)
+	fmt.Println()
+	fmt.Println(instructionsText(step.Instructions))
+	return nil
+}
+
+// instructionsText renders step instructions from HTML as plain text.
+func instructionsText(instructions string) string {
+	text := htmlBreak.ReplaceAllString(instructions, "$0\n")
+	text = html.UnescapeString(htmlTag.ReplaceAllString(text, ""))
+	text = blankLines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit codes returned by grind. Scripts and tools that embed grind can use
+// these to tell a local configuration problem apart from a server that could
+// not be reached or a request that was rejected.
+const (
+	exitOK         = 0
+	exitFailure    = 1
+	exitConfig     = 2
+	exitNetwork    = 3
+	exitValidation = 4
+)
+
+// ConfigError reports a problem with local configuration or the local
+// file system, such as a missing .codegrinderrc or an unreadable .grind file.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string { return e.Err.Error() }
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// NetworkError reports a failure talking to the TA server or the daycare,
+// including server-side failures that are not the user's fault.
+// Status is the HTTP status code if the server sent a response.
+type NetworkError struct {
+	Status int
+	Err    error
+}
+
+func (e *NetworkError) Error() string { return e.Err.Error() }
+func (e *NetworkError) Unwrap() error { return e.Err }
+
+// ValidationError reports a request that was rejected, either locally before
+// it was sent or by the server.
+// Status is the HTTP status code if the server rejected it.
+type ValidationError struct {
+	Status int
+	Err    error
+}
+
+func (e *ValidationError) Error() string { return e.Err.Error() }
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// The error constructors below translate their format with T, so any
+// message in the catalog is shown in the user's language.
+
+func configErrorf(format string, args ...interface{}) error {
+	return &ConfigError{Err: fmt.Errorf(T(format), args...)}
+}
+
+func networkErrorf(format string, args ...interface{}) error {
+	return &NetworkError{Err: fmt.Errorf(T(format), args...)}
+}
+
+func validationErrorf(format string, args ...interface{}) error {
+	return &ValidationError{Err: fmt.Errorf(T(format), args...)}
+}
+
+// serverErrorf reports an error response from the server, classified by its
+// status code: 4xx responses are validation errors, anything else is a
+// network error.
+func serverErrorf(status int, format string, args ...interface{}) error {
+	if status >= 400 && status < 500 {
+		return &ValidationError{Status: status, Err: fmt.Errorf(T(format), args...)}
+	}
+	return &NetworkError{Status: status, Err: fmt.Errorf(T(format), args...)}
+}
+
+// fromServer reports whether an error is a response from the server, as
+// opposed to a local problem or a failure to reach the server at all.
+func fromServer(err error) bool {
+	var networkErr *NetworkError
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &networkErr):
+		return networkErr.Status != 0
+	case errors.As(err, &validationErr):
+		return validationErr.Status != 0
+	default:
+		return false
+	}
+}
+
+// exitCode maps an error returned by a command to the process exit status.
+func exitCode(err error) int {
+	var configErr *ConfigError
+	var networkErr *NetworkError
+	var validationErr *ValidationError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &configErr):
+		return exitConfig
+	case errors.As(err, &networkErr):
+		return exitNetwork
+	case errors.As(err, &validationErr):
+		return exitValidation
+	default:
+		return exitFailure
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// An exam bundle holds everything needed to grade a problem set on a lab
+// machine with no network. The instructor downloads it ahead of time with
+// grind exam-bundle, which also prints the key that opens it. On the lab
+// machines, grind exam-grade --unpack writes the starter files, and grind
+// exam-grade grades a student's work with the local Docker daemon and
+// writes a signed receipt. When the network is back, grind exam-upload
+// sends the receipts to the server, where they wait until course staff
+// accept or reject them with grind exam-review.
+
+// examOutputLimit is the most test output kept in a receipt.
+const examOutputLimit = 64 * 1024
+
+// CommandExamBundle downloads an exam bundle for a problem set.
+func CommandExamBundle(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		cmd.Help()
+		return nil
+	}
+	courseID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return validationErrorf("course ID must be a number, not %q", args[0])
+	}
+	unique := args[1]
+	hours, _ := cmd.Flags().GetInt("hours")
+	if hours < 1 {
+		return validationErrorf("the bundle must be good for at least one hour")
+	}
+	out, _ := cmd.Flags().GetString("output")
+	if out == "" {
+		out = unique + ".cgx"
+	}
+	if _, err := os.Stat(out); err == nil {
+		return validationErrorf("%s already exists; delete it first or choose another name with --output", out)
+	}
+
+	// find the problem set
+	problemSets := []*ProblemSet{}
+	if err := getObject("/problem_sets", map[string]string{"unique": unique}, &problemSets); err != nil {
+		return err
+	}
+	if len(problemSets) != 1 {
+		return validationErrorf("no problem set found with unique ID %s", unique)
+	}
+
+	request := &ExamBundleRequest{ExpiresAt: time.Now().Add(time.Duration(hours) * time.Hour)}
+	response := new(ExamBundleResponse)
+	if err := postObject(fmt.Sprintf("/courses/%d/problem_sets/%d/exam_bundles", courseID, problemSets[0].ID), nil, request, response); err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(response.File, "", "    ")
+	if err != nil {
+		return configErrorf("JSON error encoding exam bundle: %w", err)
+	}
+	raw = append(raw, '\n')
+	if err := ioutil.WriteFile(out, raw, 0644); err != nil {
+		return configErrorf("error saving exam bundle %s: %w", out, err)
+	}
+	log.Printf("exam bundle %d for %s saved in %s; it expires %s", response.File.ID, unique, out, response.File.ExpiresAt.Local().Format(time.RFC1123))
+	log.Printf("the key is shown only this once, so keep it somewhere safe and do not share it with students:")
+	fmt.Println(response.Key)
+	return nil
+}
+
+// CommandExamGrade grades a student's work against an exam bundle without
+// contacting the server, or unpacks the starter files with --unpack.
+func CommandExamGrade(cmd *cobra.Command, args []string) error {
+	now := time.Now()
+	dir := ""
+	switch len(args) {
+	case 1:
+	case 2:
+		dir = args[1]
+	default:
+		cmd.Help()
+		return nil
+	}
+	key, _ := cmd.Flags().GetString("key")
+	if key == "" {
+		key = os.Getenv("GRIND_EXAM_KEY")
+	}
+	if key == "" {
+		return validationErrorf("give the exam key with --key or in GRIND_EXAM_KEY")
+	}
+
+	// open the bundle
+	raw, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return configErrorf("error reading exam bundle %s: %w", args[0], err)
+	}
+	file := new(ExamBundleFile)
+	if err := json.Unmarshal(raw, file); err != nil {
+		return validationErrorf("%s is not an exam bundle: %w", args[0], err)
+	}
+	if now.After(file.ExpiresAt) {
+		return validationErrorf("exam bundle %d expired %s", file.ID, file.ExpiresAt.Local().Format(time.RFC1123))
+	}
+	bundle, err := file.Open(key)
+	if err != nil {
+		return validationErrorf("unable to open %s: %w", args[0], err)
+	}
+
+	if unpack, _ := cmd.Flags().GetBool("unpack"); unpack {
+		if dir == "" {
+			dir = bundle.ProblemSet.Unique
+		}
+		return unpackExamBundle(bundle, dir)
+	}
+	if dir == "" {
+		dir = "."
+	}
+
+	// find the problem and step
+	login, _ := cmd.Flags().GetString("login")
+	if login == "" {
+		return validationErrorf("give the student's login with --login")
+	}
+	unique, _ := cmd.Flags().GetString("problem")
+	var problem *ExamProblem
+	for _, elt := range bundle.Problems {
+		if elt.Problem.Unique == unique || (unique == "" && len(bundle.Problems) == 1) {
+			problem = elt
+		}
+	}
+	if problem == nil {
+		names := []string{}
+		for _, elt := range bundle.Problems {
+			names = append(names, elt.Problem.Unique)
+		}
+		if unique == "" {
+			return validationErrorf("choose a problem with --problem: %s", strings.Join(names, ", "))
+		}
+		return validationErrorf("problem %s is not in this bundle, which has: %s", unique, strings.Join(names, ", "))
+	}
+	stepNumber, _ := cmd.Flags().GetInt64("step")
+	var step *ProblemStep
+	for _, elt := range problem.Steps {
+		if elt.Step == stepNumber {
+			step = elt
+		}
+	}
+	if step == nil {
+		return validationErrorf("problem %s has %d step%s, so there is no step %d", problem.Problem.Unique, len(problem.Steps), plural(len(problem.Steps)), stepNumber)
+	}
+
+	// gather the student's files: top-level files the step gives them
+	hidden := make(map[string]bool)
+	for _, name := range problem.Hidden {
+		hidden[name] = true
+	}
+	whitelist := make(map[string]bool)
+	for name := range step.Files {
+		if !strings.Contains(name, "/") && !hidden[fmt.Sprintf("%d/%s", step.Step, name)] {
+			whitelist[name] = true
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return configErrorf("error reading directory %s: %w", dir, err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		name, ok := matchWhitelist(whitelist, entry.Name())
+		if !ok || !entry.Mode().IsRegular() {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return configErrorf("error reading %s: %w", entry.Name(), err)
+		}
+		files[name] = serverLineEndings(string(contents))
+	}
+	if len(files) == 0 {
+		return validationErrorf("no files for step %d of %s found in %s", step.Step, problem.Problem.Unique, dir)
+	}
+
+	passed, output, err := runExamTests(problem, step, files)
+	if err != nil {
+		return err
+	}
+	fmt.Print(output)
+	if len(output) > examOutputLimit {
+		output = output[len(output)-examOutputLimit:]
+	}
+
+	// save the receipt
+	receipt := &ExamReceipt{
+		BundleID: bundle.ID,
+		Login:    login,
+		Unique:   problem.Problem.Unique,
+		Step:     step.Step,
+		Files:    files,
+		Passed:   passed,
+		Output:   output,
+		GradedAt: now,
+	}
+	receipt.Signature = receipt.ComputeSignature(bundle.ReceiptKey)
+	receipts, _ := cmd.Flags().GetString("receipts")
+	if err := os.MkdirAll(receipts, 0755); err != nil {
+		return configErrorf("error creating directory %s: %w", receipts, err)
+	}
+	path := filepath.Join(receipts, fmt.Sprintf("%s-%s-step%d-%s.json", login, problem.Problem.Unique, step.Step, now.Format("20060102-150405")))
+	raw, err = json.MarshalIndent(receipt, "", "    ")
+	if err != nil {
+		return configErrorf("JSON error encoding receipt: %w", err)
+	}
+	raw = append(raw, '\n')
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		return configErrorf("error saving receipt %s: %w", path, err)
+	}
+	if passed {
+		log.Printf("step %d of %s passed for %s; receipt saved in %s", step.Step, problem.Problem.Unique, login, path)
+	} else {
+		log.Printf("step %d of %s failed for %s; receipt saved in %s", step.Step, problem.Problem.Unique, login, path)
+	}
+	return nil
+}
+
+// unpackExamBundle writes the starter files of the first step of each
+// problem, leaving out the hidden ones.
+func unpackExamBundle(bundle *ExamBundle, rootDir string) error {
+	if _, err := os.Stat(rootDir); err == nil {
+		return validationErrorf("directory %s already exists\ndelete it first if you want to unpack the bundle again", rootDir)
+	} else if !os.IsNotExist(err) {
+		return configErrorf("error checking if directory %s exists: %w", rootDir, err)
+	}
+	log.Printf(T("unpacking problem set %s in %s"), bundle.ProblemSet.Unique, rootDir)
+	for _, problem := range bundle.Problems {
+		if len(problem.Steps) == 0 {
+			continue
+		}
+		hidden := make(map[string]bool)
+		for _, name := range problem.Hidden {
+			hidden[name] = true
+		}
+
+		// as with grind get, a set with one problem uses the main directory
+		target := rootDir
+		if len(bundle.Problems) > 1 {
+			target = filepath.Join(rootDir, problem.Problem.Unique)
+		}
+		step := problem.Steps[0]
+		for name, contents := range step.Files {
+			if hidden[fmt.Sprintf("%d/%s", step.Step, name)] {
+				continue
+			}
+			path := filepath.Join(target, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return configErrorf("error creating directory %s: %w", filepath.Dir(path), err)
+			}
+			if err := ioutil.WriteFile(path, []byte(localLineEndings(contents)), 0644); err != nil {
+				return configErrorf("error saving file %s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// runExamTests runs the tests for a step in a container with no network,
+// using the step files with the student's files on top of them. It
+// returns whether every test passed and the output of the run.
+func runExamTests(problem *ExamProblem, step *ProblemStep, files map[string]string) (bool, string, error) {
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return false, "", configErrorf("unable to find docker; exam grading needs a local Docker daemon with the %s image", problem.Image)
+	}
+	tmp, err := ioutil.TempDir("", "grind-exam-")
+	if err != nil {
+		return false, "", configErrorf("error creating temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	all := make(map[string]string)
+	for name, contents := range step.Files {
+		all[name] = contents
+	}
+	for name, contents := range files {
+		all[name] = contents
+	}
+	names := []string{}
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := filepath.Join(tmp, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return false, "", configErrorf("error creating directory %s: %w", filepath.Dir(path), err)
+		}
+		if err := ioutil.WriteFile(path, []byte(all[name]), 0644); err != nil {
+			return false, "", configErrorf("error writing %s: %w", name, err)
+		}
+	}
+
+	log.Printf("grading step %d of %s with %s", step.Step, problem.Problem.Unique, problem.Image)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(problem.Timeout)*time.Second)
+	defer cancel()
+	run := exec.CommandContext(ctx, docker, "run", "--rm", "--network", "none",
+		"-v", tmp+":/home/student", "-w", "/home/student", problem.Image, "sh", "-c", problem.Runner)
+	output, err := run.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return false, string(output) + fmt.Sprintf("\ntests did not finish within %d seconds\n", problem.Timeout), nil
+	}
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return false, string(output), nil
+		}
+		return false, "", configErrorf("error running docker: %w", err)
+	}
+	return true, string(output), nil
+}
+
+// CommandExamUpload sends exam receipts to the server.
+func CommandExamUpload(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		cmd.Help()
+		return nil
+	}
+
+	// receipts may be named one by one or by the directory holding them
+	paths := []string{}
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return configErrorf("error reading %s: %w", arg, err)
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*.json"))
+		if err != nil {
+			return configErrorf("error listing receipts in %s: %w", arg, err)
+		}
+		paths = append(paths, matches...)
+	}
+	bundles := make(map[int64]*ExamUpload)
+	ids := []int64{}
+	for _, path := range paths {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return configErrorf("error reading receipt %s: %w", path, err)
+		}
+		receipt := new(ExamReceipt)
+		if err := json.Unmarshal(raw, receipt); err != nil || receipt.BundleID == 0 {
+			return validationErrorf("%s is not an exam receipt", path)
+		}
+		upload, ok := bundles[receipt.BundleID]
+		if !ok {
+			upload = new(ExamUpload)
+			bundles[receipt.BundleID] = upload
+			ids = append(ids, receipt.BundleID)
+		}
+		upload.Receipts = append(upload.Receipts, receipt)
+	}
+	if len(ids) == 0 {
+		return validationErrorf("no receipts found")
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	rejected := 0
+	for _, id := range ids {
+		result := new(ExamUploadResult)
+		if err := postObject(fmt.Sprintf("/exam_bundles/%d/receipts", id), nil, bundles[id], result); err != nil {
+			return err
+		}
+		log.Printf("exam bundle %d: %d receipt%s waiting for review, %d already uploaded, %d rejected",
+			id, result.Pending, plural(result.Pending), result.Duplicate, len(result.Rejected))
+		for _, msg := range result.Rejected {
+			log.Printf("  rejected: %s", msg)
+		}
+		rejected += len(result.Rejected)
+	}
+	if rejected > 0 {
+		return validationErrorf("%d receipt%s rejected", rejected, plural(rejected))
+	}
+	return nil
+}
+
+// CommandExamReview lists the receipts from an exam bundle that are waiting
+// for review, or accepts or rejects them.
+func CommandExamReview(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		cmd.Help()
+		return nil
+	}
+	bundleID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return validationErrorf("exam bundle ID must be a number, not %q", args[0])
+	}
+	accept, _ := cmd.Flags().GetIntSlice("accept")
+	reject, _ := cmd.Flags().GetIntSlice("reject")
+	acceptAll, _ := cmd.Flags().GetBool("accept-all")
+	if acceptAll && len(accept) > 0 {
+		return validationErrorf("use --accept or --accept-all, not both")
+	}
+
+	pending := []*UploadedExamReceipt{}
+	if err := getObject(fmt.Sprintf("/exam_bundles/%d/receipts", bundleID), map[string]string{"status": ExamReceiptPending}, &pending); err != nil {
+		return err
+	}
+	review := new(ExamReceiptReview)
+	for _, id := range reject {
+		review.Reject = append(review.Reject, int64(id))
+	}
+	if acceptAll {
+		rejecting := make(map[int64]bool)
+		for _, id := range review.Reject {
+			rejecting[id] = true
+		}
+		for _, receipt := range pending {
+			if !rejecting[receipt.ID] {
+				review.Accept = append(review.Accept, receipt.ID)
+			}
+		}
+	}
+	for _, id := range accept {
+		review.Accept = append(review.Accept, int64(id))
+	}
+
+	if len(review.Accept) == 0 && len(review.Reject) == 0 {
+		if len(pending) == 0 {
+			fmt.Printf("exam bundle %d has no receipts waiting for review\n", bundleID)
+			return nil
+		}
+		for _, receipt := range pending {
+			result := "failed"
+			if receipt.Passed {
+				result = "passed"
+			}
+			fmt.Printf("%6d  %-12s %s step %d %s, graded %s\n", receipt.ID, receipt.Login, receipt.Unique, receipt.Step, result,
+				receipt.GradedAt.Local().Format("Mon Jan 2 15:04"))
+		}
+		fmt.Printf("accept or reject them with --accept, --reject, or --accept-all\n")
+		return nil
+	}
+
+	reviewed := []*UploadedExamReceipt{}
+	if err := postObject(fmt.Sprintf("/exam_bundles/%d/receipts/review", bundleID), nil, review, &reviewed); err != nil {
+		return err
+	}
+	log.Printf("exam bundle %d: %d receipt%s accepted, %d rejected", bundleID, len(review.Accept), plural(len(review.Accept)), len(review.Reject))
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// CommandProblemExport downloads an existing problem into the directory
+// layout that grind create reads, so it can be edited and uploaded again
+// with grind create --update.
+func CommandProblemExport(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+
+	if len(args) < 1 || len(args) > 2 {
+		cmd.Help()
+		return nil
+	}
+
+	// find the problem by ID or unique ID
+	var problemID int64
+	if id, err := strconv.ParseInt(args[0], 10, 64); err == nil {
+		problemID = id
+	} else {
+		problems := []*Problem{}
+		if err := getObject("/problems", map[string]string{"unique": args[0]}, &problems); err != nil {
+			return err
+		}
+		if len(problems) != 1 {
+			return validationErrorf("no problem found with unique ID %q", args[0])
+		}
+		problemID = problems[0].ID
+	}
+	bundle := new(ProblemBundle)
+	if err := getObject(fmt.Sprintf("/problem_bundles/%d", problemID), nil, bundle); err != nil {
+		return err
+	}
+	problem := bundle.Problem
+
+	dir := problem.Unique
+	if len(args) == 2 {
+		dir = args[1]
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return validationErrorf("%s already exists; remove it or give a different directory", dir)
+	}
+	log.Printf("exporting %s (%d) with %d step%s to %s", problem.Unique, problem.ID, len(bundle.ProblemSteps), plural(len(bundle.ProblemSteps)), dir)
+
+	// write problem.cfg
+	var cfg strings.Builder
+	fmt.Fprintf(&cfg, "[problem]\n")
+	fmt.Fprintf(&cfg, "unique = %s\n", cfgValue(problem.Unique))
+	fmt.Fprintf(&cfg, "note = %s\n", cfgValue(problem.Note))
+	fmt.Fprintf(&cfg, "type = %s\n", cfgValue(problem.ProblemType))
+	for _, tag := range problem.Tags {
+		fmt.Fprintf(&cfg, "tag = %s\n", cfgValue(tag))
+	}
+	for _, option := range problem.Options {
+		fmt.Fprintf(&cfg, "option = %s\n", cfgValue(option))
+	}
+	for _, item := range problem.Checklist {
+		fmt.Fprintf(&cfg, "checklist = %s\n", cfgValue(item))
+	}
+	for _, step := range bundle.ProblemSteps {
+		fmt.Fprintf(&cfg, "\n[step \"%d\"]\n", step.Step)
+		fmt.Fprintf(&cfg, "note = %s\n", cfgValue(step.Note))
+		fmt.Fprintf(&cfg, "weight = %s\n", strconv.FormatFloat(step.Weight, 'g', -1, 64))
+	}
+	variants := []string{}
+	for name := range problem.Variants {
+		variants = append(variants, name)
+	}
+	sort.Strings(variants)
+	for _, name := range variants {
+		fmt.Fprintf(&cfg, "\n[variant %q]\n", name)
+		fmt.Fprintf(&cfg, "weight = %s\n", strconv.FormatFloat(problem.Variants[name], 'g', -1, 64))
+	}
+	if err := writeExportFile(filepath.Join(dir, ProblemConfigName), []byte(cfg.String())); err != nil {
+		return err
+	}
+
+	// write the files for each step
+	// starter files go in _starter since the root of a step directory is
+	// reserved for the solution
+	solutions := make(map[int64]*Commit)
+	for _, commit := range bundle.Commits {
+		solutions[commit.Step] = commit
+	}
+	for _, step := range bundle.ProblemSteps {
+		stepDir := filepath.Join(dir, strconv.FormatInt(step.Step, 10))
+		for name, contents := range step.Files {
+			path := filepath.Join(stepDir, filepath.FromSlash(name))
+			if !strings.Contains(name, "/") {
+				path = filepath.Join(stepDir, "_starter", name)
+			}
+			if err := writeExportFile(path, []byte(localLineEndings(contents))); err != nil {
+				return err
+			}
+		}
+		if solution := solutions[step.Step]; solution != nil {
+			for name, contents := range solution.Files {
+				if err := writeExportFile(filepath.Join(stepDir, "_solution", name), []byte(localLineEndings(contents))); err != nil {
+					return err
+				}
+			}
+		}
+		if len(step.Precheck) > 0 {
+			if err := writeExportFile(filepath.Join(stepDir, precheckFile), step.Precheck); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(solutions) < len(bundle.ProblemSteps) {
+		log.Printf("the server does not have a reference solution for every step, so add a")
+		log.Printf("  _solution directory to those steps before running \"grind create --update\"")
+	}
+	return nil
+}
+
+func writeExportFile(path string, contents []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return configErrorf("error creating directory %s: %w", filepath.Dir(path), err)
+	}
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		return configErrorf("error saving file %s: %w", path, err)
+	}
+	return nil
+}
+
+// cfgValue quotes a value for a .cfg file if it would not otherwise be
+// read back unchanged.
+func cfgValue(s string) string {
+	if s != strings.TrimSpace(s) || strings.ContainsAny(s, ";#\"\\\n\t") {
+		r := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\t", "\\t")
+		return "\"" + r.Replace(s) + "\""
+	}
+	return s
+}
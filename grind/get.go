@@ -14,15 +14,17 @@ import (
 	"github.com/spf13/cobra"
 )
 
-func CommandGet(cmd *cobra.Command, args []string) {
-	mustLoadConfig(cmd)
+func CommandGet(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
 
 	// parse parameters
 	name, rootDir := "", ""
 	switch len(args) {
 	case 0:
-		log.Printf("you must specify the problem set to download")
-		log.Fatalf("in the form COURSE/problem-set-id as displayed by \"grind list\"")
+		return validationErrorf("you must specify the problem set to download\n" +
+			"in the form COURSE/problem-set-id as displayed by \"grind list\"")
 	case 1:
 		name = args[0]
 	case 2:
@@ -30,7 +32,7 @@ func CommandGet(cmd *cobra.Command, args []string) {
 		rootDir = args[1]
 	default:
 		cmd.Help()
-		return
+		return nil
 	}
 
 	var assignment *Assignment
@@ -38,41 +40,61 @@ func CommandGet(cmd *cobra.Command, args []string) {
 	if id, err := strconv.Atoi(name); err == nil && id > 0 {
 		// look it up by ID
 		assignment = new(Assignment)
-		mustGetObject(fmt.Sprintf("/assignments/%d", id), nil, assignment)
+		if err := getObject(fmt.Sprintf("/assignments/%d", id), nil, assignment); err != nil {
+			return err
+		}
 	} else {
 		// parse the course label and the problem unique id
 		parts := strings.Split(name, "/")
 		if len(parts) != 2 {
-			log.Fatalf("problem name %q must be of form course/problem-id as displayed by \"grind list\"", name)
+			return validationErrorf("problem name %q must be of form course/problem-id as displayed by \"grind list\"", name)
 		}
 		label, unique := parts[0], parts[1]
 
 		// find the assignment
+		groups := []*CourseAssignments{}
+		if err := getObject("/users/me/assignments",
+			map[string]string{"course": label, "problem_set": unique},
+			&groups); err != nil {
+			return err
+		}
 		assignmentList := []*Assignment{}
-		mustGetObject("/users/me/assignments",
-			map[string]string{"course_lti_label": label, "problem_unique": unique},
-			&assignmentList)
+		for _, group := range groups {
+			for _, listing := range group.Assignments {
+				assignmentList = append(assignmentList, listing.Assignment)
+			}
+		}
 		if len(assignmentList) == 0 {
-			log.Printf("no matching assignment found")
-			log.Fatalf("use \"grind list\" to see available assignments")
+			return validationErrorf("no matching assignment found\nuse \"grind list\" to see available assignments")
 		} else if len(assignmentList) != 1 {
-			log.Printf("found more than one matching assignment")
-			log.Fatalf("try searching by assignment ID instead")
+			return validationErrorf("found more than one matching assignment\ntry searching by assignment ID instead")
 		}
 		assignment = assignmentList[0]
 	}
+	return downloadAssignment(assignment, rootDir)
+}
 
+// downloadAssignment unpacks the problems of an assignment in rootDir, or
+// in a directory named after the course and problem set if it is empty.
+// Work saved earlier is restored over the starter files.
+func downloadAssignment(assignment *Assignment, rootDir string) error {
 	// get the course
 	course := new(Course)
-	mustGetObject(fmt.Sprintf("/courses/%d", assignment.CourseID), nil, course)
+	if err := getObject(fmt.Sprintf("/courses/%d", assignment.CourseID), nil, course); err != nil {
+		return err
+	}
 
 	// get the problem set
 	problemSet := new(ProblemSet)
-	mustGetObject(fmt.Sprintf("/problem_sets/%d", assignment.ProblemSetID), nil, problemSet)
+	if err := getObject(fmt.Sprintf("/problem_sets/%d", assignment.ProblemSetID), nil, problemSet); err != nil {
+		return err
+	}
 
 	// get the list of problems in the problem set
 	problemSetProblems := []*ProblemSetProblem{}
-	mustGetObject(fmt.Sprintf("/problem_sets/%d/problems", assignment.ProblemSetID), nil, &problemSetProblems)
+	if err := getObject(fmt.Sprintf("/problem_sets/%d/problems", assignment.ProblemSetID), nil, &problemSetProblems); err != nil {
+		return err
+	}
 
 	// for each problem get the problem, the most recent commit (or create one), and the corresponding step
 	commits := make(map[string]*Commit)
@@ -81,10 +103,16 @@ func CommandGet(cmd *cobra.Command, args []string) {
 	steps := make(map[string]*ProblemStep)
 	for _, elt := range problemSetProblems {
 		problem, commit, info, step := new(Problem), new(Commit), new(ProblemInfo), new(ProblemStep)
-		mustGetObject(fmt.Sprintf("/problems/%d", elt.ProblemID), nil, problem)
+		if err := getObject(fmt.Sprintf("/problems/%d", elt.ProblemID), nil, problem); err != nil {
+			return err
+		}
 		problems[problem.Unique] = problem
 
-		if getObject(fmt.Sprintf("/assignments/%d/problems/%d/commits/last", assignment.ID, problem.ID), nil, commit) {
+		found, err := getObjectIfExists(fmt.Sprintf("/assignments/%d/problems/%d/commits/last", assignment.ID, problem.ID), nil, commit)
+		if err != nil {
+			return err
+		}
+		if found {
 			info.ID = problem.ID
 			info.Step = commit.Step
 			info.Whitelist = make(map[string]bool)
@@ -101,7 +129,9 @@ func CommandGet(cmd *cobra.Command, args []string) {
 			info.Whitelist = make(map[string]bool)
 		}
 
-		mustGetObject(fmt.Sprintf("/problems/%d/steps/%d", problem.ID, info.Step), nil, step)
+		if err := getObject(fmt.Sprintf("/problems/%d/steps/%d", problem.ID, info.Step), nil, step); err != nil {
+			return err
+		}
 		for name := range step.Files {
 			// starter files are added to the whitelist
 			dir, _ := filepath.Split(name)
@@ -120,16 +150,15 @@ func CommandGet(cmd *cobra.Command, args []string) {
 	}
 
 	if _, err := os.Stat(rootDir); err == nil {
-		log.Printf("directory %s already exists", rootDir)
-		log.Fatalf("delete it first if you want to re-download the assignment")
+		return validationErrorf("directory %s already exists\ndelete it first if you want to re-download the assignment", rootDir)
 	} else if !os.IsNotExist(err) {
-		log.Fatalf("error checking if directory %s exists: %v", rootDir, err)
+		return configErrorf("error checking if directory %s exists: %w", rootDir, err)
 	}
 
 	// create the target directory
-	log.Printf("unpacking problem set %s in %s", problemSet.Unique, rootDir)
+	log.Printf(T("unpacking problem set %s in %s"), problemSet.Unique, rootDir)
 	if err := os.MkdirAll(rootDir, 0755); err != nil {
-		log.Fatalf("error creating directory %s: %v", rootDir, err)
+		return configErrorf("error creating directory %s: %w", rootDir, err)
 	}
 
 	for unique := range steps {
@@ -142,7 +171,7 @@ func CommandGet(cmd *cobra.Command, args []string) {
 			target = filepath.Join(rootDir, unique)
 			log.Printf("unpacking problem %s", unique)
 			if err := os.MkdirAll(target, 0755); err != nil {
-				log.Fatalf("error creating directory %s: %v", target, err)
+				return configErrorf("error creating directory %s: %w", target, err)
 			}
 		}
 
@@ -151,10 +180,10 @@ func CommandGet(cmd *cobra.Command, args []string) {
 			path := filepath.Join(target, name)
 			log.Printf("writing step %d file %s", step.Step, name)
 			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-				log.Fatalf("error create directory %s: %v", filepath.Dir(path), err)
+				return configErrorf("error create directory %s: %w", filepath.Dir(path), err)
 			}
-			if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
-				log.Fatalf("error saving file %s: %v", path, err)
+			if err := ioutil.WriteFile(path, []byte(localLineEndings(contents)), 0644); err != nil {
+				return configErrorf("error saving file %s: %w", path, err)
 			}
 		}
 
@@ -163,14 +192,16 @@ func CommandGet(cmd *cobra.Command, args []string) {
 			for name, contents := range commit.Files {
 				path := filepath.Join(target, name)
 				log.Printf("writing commit file %s", name)
-				if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
-					log.Fatalf("error saving file %s: %v", path, err)
+				if err := ioutil.WriteFile(path, []byte(localLineEndings(contents)), 0644); err != nil {
+					return configErrorf("error saving file %s: %w", path, err)
 				}
 			}
 
 			// does this commit indicate the step was finished and needs to advance?
-			if commit.ReportCard != nil && commit.ReportCard.Passed && commit.Score == 1.0 {
-				nextStep(target, infos[unique], problem, commit)
+			if commit.StepPassed() {
+				if _, err := nextStep(target, infos[unique], problem, commit); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -179,12 +210,17 @@ func CommandGet(cmd *cobra.Command, args []string) {
 		Problems:     infos,
 		Path:         filepath.Join(rootDir, perProblemSetDotFile),
 	}
+	return saveDotFile(dotfile)
+}
+
+func saveDotFile(dotfile *DotFileInfo) error {
 	contents, err := json.MarshalIndent(dotfile, "", "    ")
 	if err != nil {
-		log.Fatalf("JSON error encoding %s: %v", dotfile.Path, err)
+		return fmt.Errorf("JSON error encoding %s: %w", dotfile.Path, err)
 	}
 	contents = append(contents, '\n')
 	if err := ioutil.WriteFile(dotfile.Path, contents, 0644); err != nil {
-		log.Fatalf("error saving file %s: %v", dotfile.Path, err)
+		return configErrorf("error saving file %s: %w", dotfile.Path, err)
 	}
+	return nil
 }
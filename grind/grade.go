@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -15,8 +14,10 @@ import (
 	"github.com/spf13/cobra"
 )
 
-func CommandGrade(cmd *cobra.Command, args []string) {
-	mustLoadConfig(cmd)
+func CommandGrade(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
 	now := time.Now()
 
 	// find the directory
@@ -28,27 +29,74 @@ func CommandGrade(cmd *cobra.Command, args []string) {
 		dir = args[0]
 	default:
 		cmd.Help()
-		return
+		return nil
+	}
+
+	problem, assignment, commit, dotfile, err := gather(now, dir)
+	if err != nil {
+		return err
+	}
+	if assignment.DueAt != nil && assignment.DueAt.Sub(now) < DeadlineWarning {
+		warnDeadline(now, assignment)
+	}
+	encrypt, _ := cmd.Flags().GetBool("encrypt")
+	encrypt = encrypt || Config.Encrypt
+
+	// some problem sets must have all their problems graded at once
+	problemSet := new(ProblemSet)
+	if err := getObject(fmt.Sprintf("/problem_sets/%d", assignment.ProblemSetID), nil, problemSet); err != nil {
+		return err
+	}
+	for _, tag := range problemSet.Tags {
+		if tag == GradedTogetherTag {
+			force, _ := cmd.Flags().GetBool("force")
+			return gradeSet(now, dir, encrypt, force)
+		}
 	}
 
-	problem, _, commit, dotfile := gather(now, dir)
 	commit.Action = "grade"
 	commit.Note = "grading from grind tool"
+	if err := confirmChecklist(problem, commit); err != nil {
+		return err
+	}
+
+	// the server cannot compare encrypted files
+	if force, _ := cmd.Flags().GetBool("force"); !force && !encrypt {
+		if err := checkReuse(commit); err != nil {
+			return err
+		}
+	}
+	if encrypt {
+		if err := sealCommit(commit); err != nil {
+			return err
+		}
+	}
 	unsigned := &CommitBundle{Commit: commit}
 
 	// send the commit bundle to the server
 	signed := new(CommitBundle)
-	mustPostObject("/commit_bundles/unsigned", nil, unsigned, signed)
+	if err := postObject("/commit_bundles/unsigned", nil, unsigned, signed); err != nil {
+		return err
+	}
+	if signed.Held != "" {
+		return validationErrorf("%s", signed.Held)
+	}
 
 	// TODO: get a daycare referral
 
 	// get the user ID
 	user := new(User)
-	mustGetObject("/users/me", nil, user)
+	if err := getObject("/users/me", nil, user); err != nil {
+		return err
+	}
 
 	// send it to the daycare for grading
-	log.Printf("submitting %s step %d for grading", problem.Unique, commit.Step)
-	graded := mustConfirmCommitBundle(user.ID, signed, nil)
+	reportGradingWait(problem.ProblemType)
+	log.Printf(T("submitting %s step %d for grading"), problem.Unique, commit.Step)
+	graded, err := confirmCommitBundle(user.ID, signed, nil)
+	if err != nil {
+		return err
+	}
 
 	// save the commit with report card
 	toSave := &CommitBundle{
@@ -56,59 +104,146 @@ func CommandGrade(cmd *cobra.Command, args []string) {
 		CommitSignature: graded.CommitSignature,
 	}
 	saved := new(CommitBundle)
-	mustPostObject("/commit_bundles/signed", nil, toSave, saved)
+	if err := postObject("/commit_bundles/signed", nil, toSave, saved); err != nil {
+		return err
+	}
+	if saved.Held != "" {
+		return validationErrorf("%s", saved.Held)
+	}
 	commit = saved.Commit
+	printBreakdown(commit.ReportCard)
+	printScoreOverride(assignment)
 
-	if commit.ReportCard != nil && commit.ReportCard.Passed && commit.Score == 1.0 {
-		if nextStep(dir, dotfile.Problems[problem.Unique], problem, commit) {
+	if commit.StepPassed() {
+		advanced, err := nextStep(dir, dotfile.Problems[problem.Unique], problem, commit)
+		if err != nil {
+			return err
+		}
+		if advanced {
 			// save the updated dotfile with whitelist updates and new step number
-			contents, err := json.MarshalIndent(dotfile, "", "    ")
-			if err != nil {
-				log.Fatalf("JSON error encoding %s: %v", dotfile.Path, err)
-			}
-			contents = append(contents, '\n')
-			if err := ioutil.WriteFile(dotfile.Path, contents, 0644); err != nil {
-				log.Fatalf("error saving file %s: %v", dotfile.Path, err)
+			if err := saveDotFile(dotfile); err != nil {
+				return err
 			}
 		}
+		printNext(saved.Next)
 	} else {
-		// solution failed
-		log.Printf("  solution for step %d failed", commit.Step)
-		if commit.ReportCard != nil {
-			log.Printf("  ReportCard: %s", commit.ReportCard.Note)
-		}
+		printFailure(commit)
+	}
+	return nil
+}
 
-		// play the transcript
-		for _, event := range commit.Transcript {
-			switch event.Event {
-			case "exec":
-				color.Cyan("$ %s\n", strings.Join(event.ExecCommand, " "))
-			case "stdin":
-				color.Yellow("%s", event.StreamData)
-			case "stdout":
-				color.White("%s", event.StreamData)
-			case "stderr":
-				color.Red("%s", event.StreamData)
-			case "exit":
-				color.Cyan("%s\n", event.ExitStatus)
-			case "error":
-				color.Red("Error: %s\n", event.Error)
+// printFailure explains why a commit did not pass its step and plays back
+// the transcript of the grading run.
+func printFailure(commit *Commit) {
+	// solution failed
+	log.Printf(T("  solution for step %d failed"), commit.Step)
+	if commit.ReportCard != nil {
+		log.Printf("  ReportCard: %s", commit.ReportCard.Note)
+		switch card := commit.ReportCard; {
+		case card.Feedback == FeedbackCounts:
+			passed, total := card.Counts()
+			log.Printf(T("  %d of %d tests failed (details limited by your instructor)"), total-passed, total)
+		case card.HiddenFailed > 0:
+			log.Printf(T("  %d of %d hidden tests failed (details after the due date)"), card.HiddenFailed, card.HiddenPassed+card.HiddenFailed)
+		}
+		if commit.ReportCard.Feedback == FeedbackNames {
+			log.Printf("%s", T("  failed tests (details limited by your instructor):"))
+			for _, result := range commit.ReportCard.Results {
+				if result.Outcome != "passed" && result.Outcome != "warning" {
+					color.Red("    %s\n", result.Name)
+				}
+			}
+		}
+		for _, result := range commit.ReportCard.Results {
+			if result.Hint != "" {
+				color.Yellow(T("  hint for %s: %s")+"\n", result.Name, result.Hint)
 			}
 		}
 	}
+
+	// play the transcript
+	for _, event := range commit.Transcript {
+		switch event.Event {
+		case "exec":
+			color.Cyan("$ %s\n", strings.Join(event.ExecCommand, " "))
+		case "stdin":
+			color.Yellow("%s", event.StreamData)
+		case "stdout":
+			color.White("%s", event.StreamData)
+		case "stderr":
+			color.Red("%s", event.StreamData)
+		case "exit":
+			color.Cyan("%s\n", event.ExitStatus)
+		case "error":
+			color.Red("Error: %s\n", event.Error)
+		case "usage":
+			color.Cyan("resources: %s\n", event.Usage)
+		}
+	}
 }
 
-func nextStep(dir string, info *ProblemInfo, problem *Problem, commit *Commit) bool {
-	log.Printf("step %d passed", commit.Step)
+// printBreakdown shows how the parts of a report card were weighed.
+func printBreakdown(card *ReportCard) {
+	if card == nil || len(card.Parts) == 0 {
+		return
+	}
+	log.Printf("%s", T("  score breakdown:"))
+	for _, part := range card.Breakdown() {
+		log.Printf(T("    %-12s %3.0f%% (weight %g)"), part.Name, part.Score*100, part.Weight)
+	}
+}
+
+// printScoreOverride notes when an instructor has set the assignment's
+// score by hand, since grading more work will not change it.
+func printScoreOverride(assignment *Assignment) {
+	if assignment == nil || assignment.ScoreOverride == nil {
+		return
+	}
+	override := assignment.ScoreOverride
+	color.Yellow(T("  your instructor set your assignment score to %.0f%%: %s")+"\n", override.Score*100, override.Comment)
+	color.Yellow("%s\n", T("  this score is used in place of your graded work"))
+}
+
+// printNext shows what the server suggests doing after a passing grade.
+func printNext(next *NextSuggestion) {
+	if next == nil {
+		return
+	}
+	color.Green("%s\n", T("what to do next:"))
+	switch {
+	case next.Complete:
+		color.Green("%s\n", T("  every problem in this assignment is finished"))
+		return
+	case next.Step > 0:
+		color.Green(T("  step %d: %s")+"\n", next.Step, next.Note)
+	default:
+		color.Green(T("  next problem: %s (%s)")+"\n", next.Unique, next.Note)
+	}
+	if next.Summary != "" {
+		fmt.Printf("    %s\n", next.Summary)
+	}
+	if next.Remaining > 0 {
+		fmt.Printf(T("  %d unfinished problems left in this assignment")+"\n", next.Remaining)
+	}
+}
+
+func nextStep(dir string, info *ProblemInfo, problem *Problem, commit *Commit) (bool, error) {
+	log.Printf(T("step %d passed"), commit.Step)
 
 	// advance to the next step
 	oldStep, newStep := new(ProblemStep), new(ProblemStep)
-	if !getObject(fmt.Sprintf("/problems/%d/steps/%d", problem.ID, commit.Step+1), nil, newStep) {
-		log.Printf("you have completed all steps for this problem")
-		return false
+	found, err := getObjectIfExists(fmt.Sprintf("/problems/%d/steps/%d", problem.ID, commit.Step+1), nil, newStep)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		log.Print(T("you have completed all steps for this problem"))
+		return false, nil
+	}
+	if err := getObject(fmt.Sprintf("/problems/%d/steps/%d", problem.ID, commit.Step), nil, oldStep); err != nil {
+		return false, err
 	}
-	mustGetObject(fmt.Sprintf("/problems/%d/steps/%d", problem.ID, commit.Step), nil, oldStep)
-	log.Printf("moving to step %d", newStep.Step)
+	log.Printf(T("moving to step %d"), newStep.Step)
 
 	// delete all the files from the old step
 	for name := range oldStep.Files {
@@ -118,7 +253,7 @@ func nextStep(dir string, info *ProblemInfo, problem *Problem, commit *Commit) b
 		path := filepath.Join(dir, name)
 		log.Printf("deleting %s from old step", path)
 		if err := os.Remove(path); err != nil {
-			log.Fatalf("error deleting %s: %v", path, err)
+			return false, configErrorf("error deleting %s: %w", path, err)
 		}
 		dirpath := filepath.Dir(path)
 		if err := os.Remove(dirpath); err != nil {
@@ -131,10 +266,10 @@ func nextStep(dir string, info *ProblemInfo, problem *Problem, commit *Commit) b
 		path := filepath.Join(dir, name)
 		log.Printf("writing %s from new step", path)
 		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-			log.Fatalf("error creating directory %s: %v", filepath.Dir(path), err)
+			return false, configErrorf("error creating directory %s: %w", filepath.Dir(path), err)
 		}
-		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
-			log.Fatalf("error saving file %s: %v", path, err)
+		if err := ioutil.WriteFile(path, []byte(localLineEndings(contents)), 0644); err != nil {
+			return false, configErrorf("error saving file %s: %w", path, err)
 		}
 
 		// add the file to the whitelist as well if it is in the root directory
@@ -144,5 +279,46 @@ func nextStep(dir string, info *ProblemInfo, problem *Problem, commit *Commit) b
 	}
 
 	info.Step++
-	return true
+	return true, nil
+}
+
+// checkReuse asks the server whether the files being submitted match work
+// the student turned in for a different problem, and if so asks before
+// spending a graded attempt on them.
+func checkReuse(commit *Commit) error {
+	matches := []*ReuseMatch{}
+	if err := postObject("/commit_bundles/reuse_check", nil, &CommitBundle{Commit: commit}, &matches); err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	for _, match := range matches {
+		color.Yellow("warning: %s is %.0f%% the same as %s from %s (%s step %d)\n",
+			match.File, match.Similarity*100, match.MatchedFile, match.AssignmentTitle, match.ProblemUnique, match.Step)
+	}
+	fmt.Print(T("this may be code from a different problem; submit it for grading anyway? [y/N] "))
+	var answer string
+	fmt.Scanln(&answer)
+	if !isYes(answer) {
+		return validationErrorf("grading canceled; use --force to skip this check")
+	}
+	return nil
+}
+
+// reportGradingWait tells the student how long grading may take to start
+// when the grading queue is busy, so they know to wait instead of grading
+// again. Servers without a work queue have nothing to report.
+func reportGradingWait(problemType string) {
+	wait := new(GradingWait)
+	if found, err := getObjectIfExists("/grading_waits/"+problemType, nil, wait); err != nil || !found {
+		return
+	}
+	switch {
+	case wait.Slots == 0:
+		log.Printf(T("no grader for %s is running; your request will wait for one"), problemType)
+	case wait.JobsAhead > 0:
+		estimate := time.Duration(wait.WaitSeconds * float64(time.Second)).Round(time.Second)
+		log.Printf(T("estimated wait: ~%v (%d jobs ahead)"), estimate, wait.JobsAhead)
+	}
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fatih/color"
+	. "github.com/russross/codegrinder/types"
+)
+
+// gradeSet grades every problem of a problem set that is graded together.
+// The commits are sent to the daycare as one set and saved as a unit, so
+// either every problem's score changes or none does.
+func gradeSet(now time.Time, dir string, encrypt, force bool) error {
+	dotfile, problemSetDir, _, err := findDotFile(dir)
+	if err != nil {
+		return err
+	}
+	uniques := []string{}
+	for unique := range dotfile.Problems {
+		uniques = append(uniques, unique)
+	}
+	sort.Strings(uniques)
+
+	// gather the work on every problem
+	unsigned := new(SetCommitBundle)
+	dirs := make(map[int64]string)
+	var assignment *Assignment
+	for _, unique := range uniques {
+		problemDir := problemSetDir
+		if len(uniques) > 1 {
+			problemDir = filepath.Join(problemSetDir, unique)
+		}
+		problem, asst, commit, _, err := gather(now, problemDir)
+		if err != nil {
+			return err
+		}
+		assignment = asst
+		commit.Action = "grade"
+		commit.Note = "grading from grind tool"
+		if err := confirmChecklist(problem, commit); err != nil {
+			return err
+		}
+		if !force && !encrypt {
+			if err := checkReuse(commit); err != nil {
+				return err
+			}
+		}
+		if encrypt {
+			if err := sealCommit(commit); err != nil {
+				return err
+			}
+		}
+		dirs[commit.ProblemID] = problemDir
+		unsigned.Bundles = append(unsigned.Bundles, &CommitBundle{Commit: commit})
+	}
+
+	// send the set to the server
+	signed := new(SetCommitBundle)
+	if err := postObject("/set_commit_bundles/unsigned", nil, unsigned, signed); err != nil {
+		return err
+	}
+	if signed.Held != "" {
+		return validationErrorf("%s", signed.Held)
+	}
+	user := new(User)
+	if err := getObject("/users/me", nil, user); err != nil {
+		return err
+	}
+
+	// send it to the daycare for grading
+	reportGradingWait(signed.Bundles[0].Problem.ProblemType)
+	log.Printf(T("submitting all %d problems in %s for grading together"), len(signed.Bundles), filepath.Base(problemSetDir))
+	graded, err := confirmSetCommitBundle(user.ID, signed)
+	if err != nil {
+		return err
+	}
+
+	// save the commits with their report cards
+	toSave := &SetCommitBundle{Weights: graded.Weights, Signature: graded.Signature}
+	for _, bundle := range graded.Bundles {
+		toSave.Bundles = append(toSave.Bundles, &CommitBundle{
+			Commit:          bundle.Commit,
+			CommitSignature: bundle.CommitSignature,
+		})
+	}
+	saved := new(SetCommitBundle)
+	if err := postObject("/set_commit_bundles/signed", nil, toSave, saved); err != nil {
+		return err
+	}
+	if saved.Held != "" {
+		return validationErrorf("%s", saved.Held)
+	}
+
+	// report on each problem, then the set as a whole
+	advanced := false
+	for _, bundle := range saved.Bundles {
+		problem, commit := bundle.Problem, bundle.Commit
+		log.Printf(T("%s step %d:"), problem.Unique, commit.Step)
+		printBreakdown(commit.ReportCard)
+		if !commit.StepPassed() {
+			printFailure(commit)
+			continue
+		}
+		moved, err := nextStep(dirs[problem.ID], dotfile.Problems[problem.Unique], problem, commit)
+		if err != nil {
+			return err
+		}
+		advanced = advanced || moved
+	}
+	if saved.ReportCard != nil && saved.ReportCard.Passed {
+		color.Green(T("problem set passed with a combined score of %.0f%%")+"\n", saved.Score*100)
+	} else {
+		color.Red(T("problem set did not pass; combined score %.0f%%")+"\n", saved.Score*100)
+	}
+	if saved.ReportCard != nil {
+		for _, part := range saved.ReportCard.Parts {
+			log.Printf(T("    %-12s %3.0f%% (weight %g)"), part.Name, part.Score*100, part.Weight)
+		}
+	}
+	printScoreOverride(assignment)
+
+	if advanced {
+		// save the updated dotfile with whitelist updates and new step numbers
+		if err := saveDotFile(dotfile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
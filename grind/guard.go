@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+)
+
+// Before any files are read, gather looks over the problem directory to
+// catch the common mistake of working in a directory full of installed
+// packages or build output. Only the problem's own files are ever sent, but
+// a directory with thousands of entries or huge files is almost always a
+// sign that something went wrong. The checks can be skipped with --force.
+const (
+	maxProblemDirEntries = 1000
+	maxGatherFileSize    = 1 << 20
+	maxGatherTotalSize   = 8 << 20
+)
+
+// generatedDirectories are directory names that tools create, with a
+// description of what they usually hold.
+var generatedDirectories = map[string]string{
+	"node_modules":     "installed npm packages",
+	"bower_components": "installed bower packages",
+	"venv":             "a Python virtual environment",
+	".venv":            "a Python virtual environment",
+	".tox":             "tox test environments",
+	"target":           "build output",
+	".gradle":          "Gradle caches",
+}
+
+// checkProblemDir applies the size checks to a problem directory, using
+// only the directory listing and file sizes.
+func checkProblemDir(problemDir string, whitelist map[string]bool) error {
+	if Config.force {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(problemDir)
+	if err != nil {
+		return configErrorf("error reading directory %s: %w", problemDir, err)
+	}
+
+	var problems, generated []string
+	if len(entries) > maxProblemDirEntries {
+		problems = append(problems, fmt.Sprintf(T("%s holds %d files and directories"), problemDir, len(entries)))
+	}
+	var total int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			if what, ok := generatedDirectories[name]; ok {
+				generated = append(generated, fmt.Sprintf("%s (%s)", name, T(what)))
+			} else if _, err := os.Stat(filepath.Join(problemDir, name, "pyvenv.cfg")); err == nil {
+				generated = append(generated, fmt.Sprintf("%s (%s)", name, T("a Python virtual environment")))
+			}
+			continue
+		}
+		if _, ok := matchWhitelist(whitelist, name); !ok || !entry.Mode().IsRegular() {
+			continue
+		}
+		total += entry.Size()
+		if entry.Size() > maxGatherFileSize {
+			problems = append(problems, fmt.Sprintf(T("%s is %s"), name, formatSize(entry.Size())))
+		}
+	}
+	if total > maxGatherTotalSize {
+		problems = append(problems, fmt.Sprintf(T("the problem files add up to %s"), formatSize(total)))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	sort.Strings(generated)
+	msg := T("this does not look like a normal problem directory:") + "\n  " + strings.Join(problems, "\n  ")
+	if len(generated) > 0 {
+		msg += "\n" + T("it contains directories that tools usually generate:") + "\n  " + strings.Join(generated, "\n  ")
+	}
+	if !isatty.IsTerminal(os.Stdin.Fd()) {
+		return validationErrorf("%s\n%s", msg, T("check the directory, or use --force to continue anyway"))
+	}
+	fmt.Printf("%s\n%s ", msg, T("continue anyway? [y/N]"))
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if answer := strings.ToLower(strings.TrimSpace(line)); answer != "y" && answer != "yes" {
+		return validationErrorf("%s", T("stopped at your request"))
+	}
+	return nil
+}
+
+// formatSize gives a file size in readable units.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
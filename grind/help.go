@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// printHelpContact tells the user who to ask for help with the course they
+// are working in. It is called after the server reports a fatal error, and
+// quietly does nothing if the course cannot be determined.
+func printHelpContact() {
+	dir, err := os.Getwd()
+	if err != nil {
+		return
+	}
+
+	// look for the problem set dot file without logging each directory tried
+	var dotfile *DotFileInfo
+	for {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, perProblemSetDotFile))
+		if err == nil {
+			dotfile = new(DotFileInfo)
+			if err := json.Unmarshal(contents, dotfile); err != nil {
+				return
+			}
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return
+		}
+		dir = parent
+	}
+
+	assignment := new(Assignment)
+	if err := getObject(fmt.Sprintf("/assignments/%d", dotfile.AssignmentID), nil, assignment); err != nil {
+		return
+	}
+	info := new(CourseInfo)
+	if err := getObject(fmt.Sprintf("/courses/%d/info", assignment.CourseID), nil, info); err != nil {
+		return
+	}
+	if info.HelpEmail == "" && info.HelpText == "" {
+		return
+	}
+
+	fmt.Fprintln(os.Stderr)
+	if info.HelpEmail != "" {
+		fmt.Fprintf(os.Stderr, T("For help with %s, contact %s\n"), info.DisplayName, info.HelpEmail)
+	}
+	if info.HelpText != "" {
+		fmt.Fprintln(os.Stderr, info.HelpText)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// User-facing messages are written in English in the source and looked up
+// in a catalog of translations when they are shown, so the English text is
+// the message key. Translations must use the same formatting verbs in the
+// same order as the English text. Messages missing from a catalog are shown
+// in English.
+//
+// The language comes from "language" in .codegrinderrc if set, otherwise
+// from GRIND_LANG, LC_ALL, LC_MESSAGES, or LANG, in that order. Only the
+// language part of a locale such as es_MX.UTF-8 is used.
+
+// translations maps a language code to its catalog of messages.
+var translations = map[string]map[string]string{
+	"es": messagesES,
+	"fr": messagesFR,
+}
+
+// language returns the code of the language to show messages in.
+func language() string {
+	candidates := []string{Config.Language, os.Getenv("GRIND_LANG"), os.Getenv("LC_ALL"), os.Getenv("LC_MESSAGES"), os.Getenv("LANG")}
+	for _, locale := range candidates {
+		if locale == "" {
+			continue
+		}
+		if i := strings.IndexAny(locale, "_.@-"); i >= 0 {
+			locale = locale[:i]
+		}
+		return strings.ToLower(locale)
+	}
+	return "en"
+}
+
+// T translates a message into the user's language.
+func T(msg string) string {
+	if translated, ok := translations[language()][msg]; ok {
+		return translated
+	}
+	return msg
+}
+
+// isYes reports whether an answer to a yes/no prompt means yes in English
+// or in the user's language.
+func isYes(answer string) bool {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes" || answer == T("y") || answer == T("yes")
+}
+
+// statusExplanation describes what an error status from the server means
+// for the user, or returns "" if there is nothing useful to add.
+func statusExplanation(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return T("your login was not accepted; run \"grind init\" to log in again")
+	case status == http.StatusForbidden:
+		return T("you do not have permission to do that")
+	case status == http.StatusNotFound:
+		return T("the server could not find what you asked for")
+	case status == http.StatusTooManyRequests:
+		return T("you are sending requests too quickly")
+	case status >= 500:
+		return T("the server had a problem; please try again later")
+	default:
+		return ""
+	}
+}
+
+var messagesES = map[string]string{
+	// prompts
+	"y":   "s",
+	"yes": "si",
+	"Please follow these steps:\n\n1.  Use Canvas to load a CodeGrinder window\n2.  Open a new tab in your browser and copy this URL into the address bar:\n\n    https://%s/v2/users/me/cookie\n\n3.  The browser will display something of the form: %s=...\n4.  Copy that entire string to the clipboard and paste it below.\n\ngrind will use the cookie once to create an API token, which is saved\nin place of the cookie. If you already have an API token, you can paste\nthat instead.\n\nPaste here: ": "Siga estos pasos:\n\n1.  Use Canvas para abrir una ventana de CodeGrinder\n2.  Abra una nueva pestaña en su navegador y copie esta URL en la barra de direcciones:\n\n    https://%s/v2/users/me/cookie\n\n3.  El navegador mostrará algo de la forma: %s=...\n4.  Copie todo ese texto al portapapeles y péguelo abajo.\n\ngrind usará la cookie una sola vez para crear un token de API, que se guarda\nen lugar de la cookie. Si ya tiene un token de API, puede pegarlo\nen su lugar.\n\nPegue aquí: ",
+	"this may be code from a different problem; submit it for grading anyway? [y/N] ": "esto puede ser código de otro problema; ¿enviarlo para calificar de todos modos? [s/N] ",
+	"For help with %s, contact %s\n": "Para obtener ayuda con %s, comuníquese con %s\n",
+
+	// progress
+	"created %s API token %q":                                          "se creó el token de API %s %q",
+	"warning: unable to save the new API token: %v":                    "advertencia: no se pudo guardar el nuevo token de API: %v",
+	"credentials verified and saved: welcome %s":                       "credenciales verificadas y guardadas: bienvenido/a, %s",
+	"problem %s step %d saved":                                         "problema %s paso %d guardado",
+	"problem %s step %d saved as checkpoint %q":                        "problema %s paso %d guardado como punto de control %q",
+	"submitting %s step %d for grading":                                "enviando %s paso %d para calificar",
+	"  solution for step %d failed":                                    "  la solución del paso %d falló",
+	"  %d of %d hidden tests failed (details after the due date)":      "  %d de %d pruebas ocultas fallaron (detalles después de la fecha de entrega)",
+	"step %d passed":                                                   "paso %d aprobado",
+	"you have completed all steps for this problem":                    "ha completado todos los pasos de este problema",
+	"moving to step %d":                                                "pasando al paso %d",
+	"what to do next:":                                                 "qué hacer a continuación:",
+	"  step %d: %s":                                                    "  paso %d: %s",
+	"  next problem: %s (%s)":                                          "  siguiente problema: %s (%s)",
+	"  hint for %s: %s":                                                "  pista para %s: %s",
+	"no grader for %s is running; your request will wait for one":      "no hay ningún evaluador de %s en marcha; tu solicitud esperará a que haya uno",
+	"estimated wait: ~%v (%d jobs ahead)":                              "espera estimada: ~%v (%d trabajos por delante)",
+	"%s holds %d files and directories":                                "%s contiene %d archivos y directorios",
+	"%s is %s":                                                         "%s ocupa %s",
+	"the problem files add up to %s":                                   "los archivos del problema suman %s",
+	"this does not look like a normal problem directory:":              "esto no parece un directorio de problema normal:",
+	"it contains directories that tools usually generate:":             "contiene directorios que suelen generar las herramientas:",
+	"check the directory, or use --force to continue anyway":           "revisa el directorio, o usa --force para continuar de todos modos",
+	"continue anyway? [y/N]":                                           "¿continuar de todos modos? [y/N]",
+	"stopped at your request":                                          "detenido a petición tuya",
+	"installed npm packages":                                           "paquetes npm instalados",
+	"installed bower packages":                                         "paquetes bower instalados",
+	"a Python virtual environment":                                     "un entorno virtual de Python",
+	"tox test environments":                                            "entornos de prueba de tox",
+	"build output":                                                     "resultados de compilación",
+	"Gradle caches":                                                    "cachés de Gradle",
+	"the tutorial is already in %s":                                    "el tutorial ya está en %s",
+	"to start the tutorial, go to %s and run \"grind doc\"":            "para empezar el tutorial, ve a %s y ejecuta \"grind doc\"",
+	"  %d of %d tests failed (details limited by your instructor)":     "  %d de %d pruebas fallaron (detalles limitados por tu instructor)",
+	"  failed tests (details limited by your instructor):":             "  pruebas fallidas (detalles limitados por tu instructor):",
+	"submitting all %d problems in %s for grading together":            "enviando los %d problemas de %s para calificarlos juntos",
+	"%s step %d:":                                                      "%s paso %d:",
+	"problem set passed with a combined score of %.0f%%":               "el conjunto de problemas aprobó con una puntuación combinada de %.0f%%",
+	"problem set did not pass; combined score %.0f%%":                  "el conjunto de problemas no aprobó; puntuación combinada %.0f%%",
+	"offline: showing information cached %s ago":                       "sin conexión: mostrando información guardada hace %s",
+	" (cached %s)":                                                     " (guardado %s)",
+	"  score breakdown:":                                               "  desglose de la nota:",
+	"    %-12s %3.0f%% (weight %g)":                                    "    %-12s %3.0f%% (peso %g)",
+	"  your instructor set your assignment score to %.0f%%: %s":        "  tu instructor fijó tu nota de esta tarea en %.0f%%: %s",
+	"  this score is used in place of your graded work":                "  esta nota se usa en lugar de la de tu trabajo calificado",
+	"  %d unfinished problems left in this assignment":                 "  quedan %d problemas sin terminar en esta tarea",
+	"  every problem in this assignment is finished":                   "  todos los problemas de esta tarea están terminados",
+	"unpacking problem set %s in %s":                                   "desempaquetando el conjunto de problemas %s en %s",
+	"this is grind version %s, but the server recommends %s or higher": "esta es la versión %s de grind, pero el servidor recomienda %s o superior",
+	"  please upgrade as soon as possible":                             "  actualice lo antes posible",
+
+	// errors
+	"error encountered while reading the cookie you pasted: %w":                                                                                                 "error al leer la cookie que pegó: %w",
+	"failed to read the cookie you pasted; please try again":                                                                                                    "no se pudo leer la cookie que pegó; inténtelo de nuevo",
+	"the cookie must start with %s=; perhaps you copied the wrong thing?":                                                                                       "la cookie debe comenzar con %s=; ¿quizás copió algo equivocado?",
+	"unable to load config file; try running \"grind init\": %w":                                                                                                "no se pudo cargar el archivo de configuración; intente ejecutar \"grind init\": %w",
+	"failed to parse %s: %w\nyou may wish to try deleting the file and running \"grind init\" again":                                                            "no se pudo interpretar %s: %w\npuede intentar borrar el archivo y ejecutar \"grind init\" de nuevo",
+	"this is grind version %s, but the server requires %s or higher\n  you must upgrade to continue":                                                            "esta es la versión %s de grind, pero el servidor requiere %s o superior\n  debe actualizar para continuar",
+	"error connecting to %s: %w":                                                                                                                                "error al conectar con %s: %w",
+	"unexpected status from %s: %s: %s":                                                                                                                         "estado inesperado de %s: %s: %s",
+	"%s\nplease wait %s seconds before trying again":                                                                                                            "%s\nespere %s segundos antes de intentarlo de nuevo",
+	"unable to locate home directory, giving up":                                                                                                                "no se encontró el directorio personal; abandonando",
+	"you must specify the problem set to download\nin the form COURSE/problem-set-id as displayed by \"grind list\"":                                            "debe indicar el conjunto de problemas a descargar\nen la forma CURSO/id-del-conjunto como lo muestra \"grind list\"",
+	"problem name %q must be of form course/problem-id as displayed by \"grind list\"":                                                                          "el nombre del problema %q debe tener la forma curso/id-del-problema como lo muestra \"grind list\"",
+	"no matching assignment found\nuse \"grind list\" to see available assignments":                                                                             "no se encontró ninguna tarea que coincida\nuse \"grind list\" para ver las tareas disponibles",
+	"found more than one matching assignment\ntry searching by assignment ID instead":                                                                           "se encontró más de una tarea que coincide\nintente buscar por el ID de la tarea",
+	"directory %s already exists\ndelete it first if you want to re-download the assignment":                                                                    "el directorio %s ya existe\nbórrelo primero si quiere volver a descargar la tarea",
+	"you must identify the problem within this problem set\n  either run this from with the problem directory, or\n  identify it as a parameter in the command": "debe identificar el problema dentro de este conjunto\n  ejecute esto desde el directorio del problema, o\n  indíquelo como parámetro del comando",
+	"unable to recognize the problem based on the directory name of %q":                                                                                         "no se reconoce el problema a partir del nombre de directorio %q",
+	"did not find all the expected files\n%s\nall expected files must be present":                                                                               "no se encontraron todos los archivos esperados\n%s\ntodos los archivos esperados deben estar presentes",
+	"unable to find %s in %s or an ancestor directory":                                                                                                          "no se encontró %s en %s ni en un directorio superior",
+	"grading canceled; use --force to skip this check":                                                                                                          "calificación cancelada; use --force para omitir esta verificación",
+
+	// server status explanations
+	"your login was not accepted; run \"grind init\" to log in again": "no se aceptó su inicio de sesión; ejecute \"grind init\" para iniciar sesión de nuevo",
+	"you do not have permission to do that":                           "no tiene permiso para hacer eso",
+	"the server could not find what you asked for":                    "el servidor no encontró lo que pidió",
+	"you are sending requests too quickly":                            "está enviando solicitudes demasiado rápido",
+	"the server had a problem; please try again later":                "el servidor tuvo un problema; inténtelo más tarde",
+
+	// problem checklists
+	"before your first graded attempt at step %d of %s, confirm each item:": "antes de su primer intento calificado del paso %d de %s, confirme cada punto:",
+	"[y/N]": "[s/N]",
+}
+
+var messagesFR = map[string]string{
+	// prompts
+	"y":   "o",
+	"yes": "oui",
+	"Please follow these steps:\n\n1.  Use Canvas to load a CodeGrinder window\n2.  Open a new tab in your browser and copy this URL into the address bar:\n\n    https://%s/v2/users/me/cookie\n\n3.  The browser will display something of the form: %s=...\n4.  Copy that entire string to the clipboard and paste it below.\n\ngrind will use the cookie once to create an API token, which is saved\nin place of the cookie. If you already have an API token, you can paste\nthat instead.\n\nPaste here: ": "Veuillez suivre ces étapes :\n\n1.  Utilisez Canvas pour ouvrir une fenêtre CodeGrinder\n2.  Ouvrez un nouvel onglet dans votre navigateur et copiez cette URL dans la barre d'adresse :\n\n    https://%s/v2/users/me/cookie\n\n3.  Le navigateur affichera quelque chose de la forme : %s=...\n4.  Copiez toute cette chaîne dans le presse-papiers et collez-la ci-dessous.\n\ngrind utilisera le cookie une seule fois pour créer un jeton d'API, qui est\nenregistré à la place du cookie. Si vous avez déjà un jeton d'API, vous pouvez\nle coller à la place.\n\nCollez ici : ",
+	"this may be code from a different problem; submit it for grading anyway? [y/N] ": "ce code provient peut-être d'un autre problème ; le soumettre quand même pour évaluation ? [o/N] ",
+	"For help with %s, contact %s\n": "Pour de l'aide avec %s, contactez %s\n",
+
+	// progress
+	"created %s API token %q":                                          "jeton d'API %s %q créé",
+	"warning: unable to save the new API token: %v":                    "avertissement : impossible d'enregistrer le nouveau jeton d'API : %v",
+	"credentials verified and saved: welcome %s":                       "identifiants vérifiés et enregistrés : bienvenue %s",
+	"problem %s step %d saved":                                         "problème %s étape %d enregistré",
+	"problem %s step %d saved as checkpoint %q":                        "problème %s étape %d enregistré comme point de sauvegarde %q",
+	"submitting %s step %d for grading":                                "envoi de %s étape %d pour évaluation",
+	"  solution for step %d failed":                                    "  la solution de l'étape %d a échoué",
+	"  %d of %d hidden tests failed (details after the due date)":      "  %d sur %d tests cachés ont échoué (détails après la date limite)",
+	"step %d passed":                                                   "étape %d réussie",
+	"you have completed all steps for this problem":                    "vous avez terminé toutes les étapes de ce problème",
+	"moving to step %d":                                                "passage à l'étape %d",
+	"what to do next:":                                                 "que faire ensuite :",
+	"  step %d: %s":                                                    "  étape %d : %s",
+	"  next problem: %s (%s)":                                          "  problème suivant : %s (%s)",
+	"  hint for %s: %s":                                                "  indice pour %s : %s",
+	"no grader for %s is running; your request will wait for one":      "aucun correcteur pour %s ne tourne ; votre demande attendra qu'il y en ait un",
+	"estimated wait: ~%v (%d jobs ahead)":                              "attente estimée : ~%v (%d tâches avant la vôtre)",
+	"%s holds %d files and directories":                                "%s contient %d fichiers et répertoires",
+	"%s is %s":                                                         "%s fait %s",
+	"the problem files add up to %s":                                   "les fichiers du problème totalisent %s",
+	"this does not look like a normal problem directory:":              "ceci ne ressemble pas à un répertoire de problème normal :",
+	"it contains directories that tools usually generate:":             "il contient des répertoires habituellement générés par des outils :",
+	"check the directory, or use --force to continue anyway":           "vérifiez le répertoire, ou utilisez --force pour continuer quand même",
+	"continue anyway? [y/N]":                                           "continuer quand même ? [y/N]",
+	"stopped at your request":                                          "arrêté à votre demande",
+	"installed npm packages":                                           "paquets npm installés",
+	"installed bower packages":                                         "paquets bower installés",
+	"a Python virtual environment":                                     "un environnement virtuel Python",
+	"tox test environments":                                            "environnements de test tox",
+	"build output":                                                     "sorties de compilation",
+	"Gradle caches":                                                    "caches Gradle",
+	"the tutorial is already in %s":                                    "le tutoriel est déjà dans %s",
+	"to start the tutorial, go to %s and run \"grind doc\"":            "pour commencer le tutoriel, allez dans %s et lancez \"grind doc\"",
+	"  %d of %d tests failed (details limited by your instructor)":     "  %d tests sur %d ont échoué (détails limités par votre enseignant)",
+	"  failed tests (details limited by your instructor):":             "  tests échoués (détails limités par votre enseignant) :",
+	"submitting all %d problems in %s for grading together":            "envoi des %d problèmes de %s pour une évaluation commune",
+	"%s step %d:":                                                      "%s étape %d :",
+	"problem set passed with a combined score of %.0f%%":               "l'ensemble de problèmes a réussi avec une note combinée de %.0f%%",
+	"problem set did not pass; combined score %.0f%%":                  "l'ensemble de problèmes n'a pas réussi ; note combinée %.0f%%",
+	"offline: showing information cached %s ago":                       "hors ligne : informations en cache depuis %s",
+	" (cached %s)":                                                     " (en cache %s)",
+	"  score breakdown:":                                               "  détail de la note :",
+	"    %-12s %3.0f%% (weight %g)":                                    "    %-12s %3.0f%% (poids %g)",
+	"  your instructor set your assignment score to %.0f%%: %s":        "  votre enseignant a fixé votre note pour ce devoir à %.0f%% : %s",
+	"  this score is used in place of your graded work":                "  cette note remplace celle de votre travail évalué",
+	"  %d unfinished problems left in this assignment":                 "  il reste %d problèmes inachevés dans ce devoir",
+	"  every problem in this assignment is finished":                   "  tous les problèmes de ce devoir sont terminés",
+	"unpacking problem set %s in %s":                                   "extraction de l'ensemble de problèmes %s dans %s",
+	"this is grind version %s, but the server recommends %s or higher": "ceci est grind version %s, mais le serveur recommande %s ou plus récent",
+	"  please upgrade as soon as possible":                             "  veuillez mettre à jour dès que possible",
+
+	// errors
+	"error encountered while reading the cookie you pasted: %w":                                                                                                 "erreur lors de la lecture du cookie collé : %w",
+	"failed to read the cookie you pasted; please try again":                                                                                                    "impossible de lire le cookie collé ; veuillez réessayer",
+	"the cookie must start with %s=; perhaps you copied the wrong thing?":                                                                                       "le cookie doit commencer par %s= ; avez-vous copié la mauvaise chose ?",
+	"unable to load config file; try running \"grind init\": %w":                                                                                                "impossible de charger le fichier de configuration ; essayez \"grind init\" : %w",
+	"failed to parse %s: %w\nyou may wish to try deleting the file and running \"grind init\" again":                                                            "impossible d'analyser %s : %w\nvous pouvez supprimer le fichier et relancer \"grind init\"",
+	"this is grind version %s, but the server requires %s or higher\n  you must upgrade to continue":                                                            "ceci est grind version %s, mais le serveur exige %s ou plus récent\n  vous devez mettre à jour pour continuer",
+	"error connecting to %s: %w":                                                                                                                                "erreur de connexion à %s : %w",
+	"unexpected status from %s: %s: %s":                                                                                                                         "statut inattendu de %s : %s : %s",
+	"%s\nplease wait %s seconds before trying again":                                                                                                            "%s\nveuillez attendre %s secondes avant de réessayer",
+	"unable to locate home directory, giving up":                                                                                                                "impossible de trouver le répertoire personnel, abandon",
+	"you must specify the problem set to download\nin the form COURSE/problem-set-id as displayed by \"grind list\"":                                            "vous devez indiquer l'ensemble de problèmes à télécharger\nsous la forme COURS/id-ensemble comme affiché par \"grind list\"",
+	"problem name %q must be of form course/problem-id as displayed by \"grind list\"":                                                                          "le nom de problème %q doit être de la forme cours/id-problème comme affiché par \"grind list\"",
+	"no matching assignment found\nuse \"grind list\" to see available assignments":                                                                             "aucun devoir correspondant trouvé\nutilisez \"grind list\" pour voir les devoirs disponibles",
+	"found more than one matching assignment\ntry searching by assignment ID instead":                                                                           "plusieurs devoirs correspondent\nessayez plutôt de chercher par identifiant de devoir",
+	"directory %s already exists\ndelete it first if you want to re-download the assignment":                                                                    "le répertoire %s existe déjà\nsupprimez-le d'abord pour retélécharger le devoir",
+	"you must identify the problem within this problem set\n  either run this from with the problem directory, or\n  identify it as a parameter in the command": "vous devez identifier le problème dans cet ensemble\n  lancez la commande depuis le répertoire du problème, ou\n  indiquez-le en paramètre de la commande",
+	"unable to recognize the problem based on the directory name of %q":                                                                                         "impossible de reconnaître le problème à partir du nom de répertoire %q",
+	"did not find all the expected files\n%s\nall expected files must be present":                                                                               "tous les fichiers attendus n'ont pas été trouvés\n%s\ntous les fichiers attendus doivent être présents",
+	"unable to find %s in %s or an ancestor directory":                                                                                                          "impossible de trouver %s dans %s ou un répertoire parent",
+	"grading canceled; use --force to skip this check":                                                                                                          "évaluation annulée ; utilisez --force pour ignorer cette vérification",
+
+	// server status explanations
+	"your login was not accepted; run \"grind init\" to log in again": "votre connexion n'a pas été acceptée ; lancez \"grind init\" pour vous reconnecter",
+	"you do not have permission to do that":                           "vous n'avez pas la permission de faire cela",
+	"the server could not find what you asked for":                    "le serveur n'a pas trouvé ce que vous avez demandé",
+	"you are sending requests too quickly":                            "vous envoyez des requêtes trop rapidement",
+	"the server had a problem; please try again later":                "le serveur a rencontré un problème ; veuillez réessayer plus tard",
+
+	// problem checklists
+	"before your first graded attempt at step %d of %s, confirm each item:": "avant votre première tentative notée de l'étape %d de %s, confirmez chaque point :",
+	"[y/N]": "[o/N]",
+}
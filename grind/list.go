@@ -2,43 +2,59 @@ package main
 
 import (
 	"fmt"
-	"log"
 
 	. "github.com/russross/codegrinder/types"
 	"github.com/spf13/cobra"
 )
 
-func CommandList(cmd *cobra.Command, args []string) {
-	mustLoadConfig(cmd)
-
-	user := new(User)
-	mustGetObject("/users/me", nil, user)
-	assignments := []*Assignment{}
-	mustGetObject(fmt.Sprintf("/users/%d/assignments", user.ID), nil, &assignments)
-	if len(assignments) == 0 {
-		log.Printf("no assignments found")
-		log.Fatalf("you must start each assignment through Canvas before you can access it here")
+func CommandList(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
 	}
 
-	var course *Course
-	for _, asst := range assignments {
-		if course == nil || asst.CourseID != course.ID {
-			if course != nil {
-				fmt.Println()
-			}
+	params := make(map[string]string)
+	openOnly, _ := cmd.Flags().GetBool("open")
+	if openOnly {
+		params["open"] = "true"
+	}
+	if course, _ := cmd.Flags().GetString("course"); course != "" {
+		params["course"] = course
+	}
+	groups := []*CourseAssignments{}
+	if err := getObject("/users/me/assignments", params, &groups); err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		if openOnly {
+			return validationErrorf("no open assignments found\nuse \"grind list\" without --open to see all of your assignments")
+		}
+		return validationErrorf("no assignments found\nyou must start each assignment through Canvas before you can access it here")
+	}
 
-			// fetch the course
-			course = new(Course)
-			mustGetObject(fmt.Sprintf("/courses/%d", asst.CourseID), nil, course)
-			fmt.Println(course.Name)
-			fmt.Println(dashes(len(course.Name)))
+	for i, group := range groups {
+		if i > 0 {
+			fmt.Println()
 		}
+		course := group.Course
+		fmt.Println(course.Name)
+		fmt.Println(dashes(len(course.Name)))
 
-		// fetch the problem
-		problemSet := new(ProblemSet)
-		mustGetObject(fmt.Sprintf("/problem_sets/%d", asst.ProblemSetID), nil, problemSet)
-		fmt.Printf("%d: %s (%s/%s)\n", asst.ID, asst.CanvasTitle, course.Label, problemSet.Unique)
+		for _, asst := range group.Assignments {
+			fmt.Printf("%d: %s (%s/%s)\n", asst.ID, asst.CanvasTitle, course.Label, asst.ProblemSetUnique)
+			if due := localDeadline(asst.Assignment); due != "" {
+				fmt.Printf("    due %s\n", due)
+			}
+			if override := asst.ScoreOverride; override != nil {
+				fmt.Printf("    score set to %.0f%% by your instructor: %s\n", override.Score*100, override.Comment)
+			} else if asst.Score > 0 {
+				fmt.Printf("    score %.0f%%\n", asst.Score*100)
+			}
+			if !asst.Open {
+				fmt.Println("    finalized; no more work can be submitted")
+			}
+		}
 	}
+	return nil
 }
 
 func dashes(n int) string {
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// grind lock encrypts the student files of every problem in a problem set
+// into a single file and removes the originals, so work is not left readable
+// on a shared lab machine. grind unlock restores them. The key is derived
+// from a passphrase with PBKDF2 and the files are sealed with AES-GCM.
+// While a problem set is locked, grind refuses to save or grade it.
+//
+// The originals are deleted, not securely erased, so this protects against
+// the next person at the machine, not against recovery from the disk.
+
+const (
+	lockFile       = ".grind-locked"
+	lockVersion    = 1
+	lockIterations = 600000
+	lockMinLength  = 8
+)
+
+// lockedFiles is the content of the lock file. Files maps the path of each
+// file relative to the problem set directory to its contents once decrypted.
+type lockedFiles struct {
+	Version    int    `json:"version"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// isLocked reports whether a problem set directory is locked.
+func isLocked(problemSetDir string) bool {
+	_, err := os.Stat(filepath.Join(problemSetDir, lockFile))
+	return err == nil
+}
+
+func CommandLock(cmd *cobra.Command, args []string) error {
+	dir := "."
+	if len(args) > 1 {
+		cmd.Help()
+		return nil
+	} else if len(args) == 1 {
+		dir = args[0]
+	}
+	dotfile, problemSetDir, _, err := findDotFile(dir)
+	if err != nil {
+		return err
+	}
+	if isLocked(problemSetDir) {
+		return validationErrorf("%s is already locked", problemSetDir)
+	}
+
+	// collect the student files from each problem directory
+	files := make(map[string][]byte)
+	for unique, info := range dotfile.Problems {
+		problemDir := problemSetDir
+		if len(dotfile.Problems) > 1 {
+			problemDir = filepath.Join(problemSetDir, unique)
+		}
+		for name := range info.Whitelist {
+			path := filepath.Join(problemDir, name)
+			contents, err := ioutil.ReadFile(path)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return configErrorf("error reading %s: %w", path, err)
+			}
+			rel, err := filepath.Rel(problemSetDir, path)
+			if err != nil {
+				return configErrorf("error finding relative path of %s: %w", path, err)
+			}
+			files[filepath.ToSlash(rel)] = contents
+		}
+	}
+	if len(files) == 0 {
+		return validationErrorf("no student files found to lock in %s", problemSetDir)
+	}
+
+	passphrase, err := readPassphrase("passphrase: ")
+	if err != nil {
+		return err
+	}
+	if len(passphrase) < lockMinLength {
+		return validationErrorf("the passphrase must be at least %d characters long", lockMinLength)
+	}
+	again, err := readPassphrase("passphrase again: ")
+	if err != nil {
+		return err
+	}
+	if again != passphrase {
+		return validationErrorf("the passphrases did not match")
+	}
+
+	// encrypt the files
+	plaintext, err := json.Marshal(files)
+	if err != nil {
+		return fmt.Errorf("JSON error encoding files: %w", err)
+	}
+	locked := &lockedFiles{
+		Version:    lockVersion,
+		Iterations: lockIterations,
+		Salt:       make([]byte, 16),
+	}
+	if _, err := rand.Read(locked.Salt); err != nil {
+		return fmt.Errorf("error generating salt: %w", err)
+	}
+	aead, err := lockCipher(passphrase, locked)
+	if err != nil {
+		return err
+	}
+	locked.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(locked.Nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %w", err)
+	}
+	locked.Ciphertext = aead.Seal(nil, locked.Nonce, plaintext, []byte(lockFile))
+
+	// write the lock file before removing anything
+	raw, err := json.MarshalIndent(locked, "", "    ")
+	if err != nil {
+		return fmt.Errorf("JSON error encoding %s: %w", lockFile, err)
+	}
+	path := filepath.Join(problemSetDir, lockFile)
+	if err := ioutil.WriteFile(path+".tmp", raw, 0600); err != nil {
+		return configErrorf("error writing %s: %w", path, err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return configErrorf("error writing %s: %w", path, err)
+	}
+	for name := range files {
+		if err := os.Remove(filepath.Join(problemSetDir, filepath.FromSlash(name))); err != nil {
+			return configErrorf("error removing %s: %w", name, err)
+		}
+	}
+	log.Printf("locked %d file%s in %s", len(files), plural(len(files)), problemSetDir)
+	log.Printf("  use \"grind unlock\" with the same passphrase to restore them")
+	return nil
+}
+
+func CommandUnlock(cmd *cobra.Command, args []string) error {
+	dir := "."
+	if len(args) > 1 {
+		cmd.Help()
+		return nil
+	} else if len(args) == 1 {
+		dir = args[0]
+	}
+	_, problemSetDir, _, err := findDotFile(dir)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(problemSetDir, lockFile)
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return validationErrorf("%s is not locked", problemSetDir)
+	} else if err != nil {
+		return configErrorf("error reading %s: %w", path, err)
+	}
+	locked := new(lockedFiles)
+	if err := json.Unmarshal(raw, locked); err != nil {
+		return configErrorf("error parsing %s: %w", path, err)
+	}
+	if locked.Version != lockVersion {
+		return configErrorf("%s was written by a different version of grind", path)
+	}
+
+	passphrase, err := readPassphrase("passphrase: ")
+	if err != nil {
+		return err
+	}
+	aead, err := lockCipher(passphrase, locked)
+	if err != nil {
+		return err
+	}
+	plaintext, err := aead.Open(nil, locked.Nonce, locked.Ciphertext, []byte(lockFile))
+	if err != nil {
+		return validationErrorf("wrong passphrase, or %s has been damaged", lockFile)
+	}
+	files := make(map[string][]byte)
+	if err := json.Unmarshal(plaintext, &files); err != nil {
+		return configErrorf("error parsing the contents of %s: %w", path, err)
+	}
+
+	// refuse to overwrite anything created since the files were locked
+	var names []string
+	for name := range files {
+		names = append(names, name)
+		if _, err := os.Stat(filepath.Join(problemSetDir, filepath.FromSlash(name))); err == nil {
+			return validationErrorf("%s already exists; move it out of the way and try again", name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		target := filepath.Join(problemSetDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return configErrorf("error creating directory %s: %w", filepath.Dir(target), err)
+		}
+		if err := ioutil.WriteFile(target, files[name], 0644); err != nil {
+			return configErrorf("error saving file %s: %w", target, err)
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return configErrorf("error removing %s: %w", path, err)
+	}
+	log.Printf("unlocked %d file%s in %s", len(names), plural(len(names)), problemSetDir)
+	return nil
+}
+
+// lockCipher derives the key for a lock file from a passphrase.
+func lockCipher(passphrase string, locked *lockedFiles) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(passphrase), locked.Salt, locked.Iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readPassphrase prompts for a passphrase, turning off echo on terminals
+// that support it.
+func readPassphrase(prompt string) (string, error) {
+	fmt.Print(prompt)
+	if !isWindows {
+		stty := exec.Command("stty", "-echo")
+		stty.Stdin = os.Stdin
+		if stty.Run() == nil {
+			defer func() {
+				restore := exec.Command("stty", "echo")
+				restore.Stdin = os.Stdin
+				restore.Run()
+				fmt.Println()
+			}()
+		}
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", validationErrorf("error reading passphrase: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -20,14 +22,27 @@ import (
 const (
 	defaultHost          = "dorking.cs.dixie.edu"
 	perUserDotFile       = ".codegrinderrc"
+	apiTokenPrefix       = "cgt_"
 	perProblemSetDotFile = ".grind"
 )
 
 var Config struct {
-	Host      string `json:"host"`
-	Cookie    string `json:"cookie"`
+	Host      string            `json:"host"`
+	Cookie    string            `json:"cookie,omitempty"`
+	Token     string            `json:"token,omitempty"`
+	Aliases   map[string]string `json:"aliases,omitempty"`
 	apiReport bool
 	apiDump   bool
+	force     bool
+
+	// Encrypt seals files sent for grading so only the daycare can read them.
+	// DaycareKey pins the fingerprint of the daycare key once it is first used.
+	Encrypt    bool   `json:"encrypt,omitempty"`
+	DaycareKey string `json:"daycareKey,omitempty"`
+
+	// Language selects the language for messages, e.g., "es" or "fr".
+	// When blank, it comes from the environment.
+	Language string `json:"language,omitempty"`
 }
 
 type DotFileInfo struct {
@@ -50,6 +65,8 @@ func main() {
 		Short: "Command-line interface to CodeGrinder",
 		Long: "A command-line tool to access CodeGrinder\n" +
 			"by Russ Ross <russ@russross.com>",
+		SilenceErrors: true,
+		SilenceUsage:  true,
 	}
 	cmdGrind.PersistentFlags().BoolP("api", "", false, "report all API requests")
 	cmdGrind.PersistentFlags().BoolP("api-dump", "", false, "dump API request and response data")
@@ -66,15 +83,18 @@ func main() {
 	cmdInit := &cobra.Command{
 		Use:   "init",
 		Short: "connect to codegrinder server",
-		Run:   CommandInit,
+		RunE:  CommandInit,
 	}
+	cmdInit.Flags().String("scope", "", "scope of the API token to create: student, instructor, or admin (default: highest available)")
 	cmdGrind.AddCommand(cmdInit)
 
 	cmdList := &cobra.Command{
 		Use:   "list",
 		Short: "list all of your active assignments",
-		Run:   CommandList,
+		RunE:  CommandList,
 	}
+	cmdList.Flags().Bool("open", false, "only list assignments that are still open for work")
+	cmdList.Flags().String("course", "", "only list assignments for one course, by ID or label")
 	cmdGrind.AddCommand(cmdList)
 
 	cmdGet := &cobra.Command{
@@ -88,95 +108,436 @@ func main() {
 			"   name as an additional argument.\n\n" +
 			"   Example: grind get CS-1400/cs1400-loops\n\n" +
 			"   Note: you must load an assignment through Canvas before you can access it.",
-		Run: CommandGet,
+		RunE: CommandGet,
 	}
 	cmdGrind.AddCommand(cmdGet)
 
+	cmdTutorial := &cobra.Command{
+		Use:   "tutorial [directory]",
+		Short: "download a practice assignment that shows how to use grind",
+		Long: "   The tutorial walks through saving, grading, and moving from one step\n" +
+			"   to the next. It is not part of any course and is never graded.\n\n" +
+			"   Example: grind tutorial",
+		RunE: CommandTutorial,
+	}
+	cmdGrind.AddCommand(cmdTutorial)
+
 	cmdSave := &cobra.Command{
 		Use:   "save",
 		Short: "save your work to the server without additional action",
-		Run:   CommandSave,
+		Long: "   Use -m to also keep this save as a checkpoint with a label, which you\n" +
+			"   can return to later with \"grind checkout\".\n\n" +
+			"   Example: grind save -m \"before refactor\"",
+		RunE: CommandSave,
 	}
+	cmdSave.Flags().StringP("message", "m", "", "label this save as a checkpoint")
+	cmdSave.Flags().BoolP("force", "f", false, "save even if the problem directory looks too large")
 	cmdGrind.AddCommand(cmdSave)
 
+	cmdHistory := &cobra.Command{
+		Use:   "history",
+		Short: "list the checkpoints you have saved for this problem",
+		RunE:  CommandHistory,
+	}
+	cmdGrind.AddCommand(cmdHistory)
+
+	cmdComments := &cobra.Command{
+		Use:   "comments",
+		Short: "show your instructor's comments on your saved work",
+		RunE:  CommandComments,
+	}
+	cmdGrind.AddCommand(cmdComments)
+
+	cmdRegradeRequest := &cobra.Command{
+		Use:   "regrade-request <message>",
+		Short: "ask your instructor to reconsider how your saved work was graded",
+		Long: "   Run this in the directory of the problem. The message should explain\n" +
+			"   what you think was graded incorrectly.\n\n" +
+			"   Example: grind regrade-request \"my output matches but the test timed out\"",
+		RunE: CommandRegradeRequest,
+	}
+	cmdGrind.AddCommand(cmdRegradeRequest)
+
+	cmdWhatsNew := &cobra.Command{
+		Use:   "whatsnew",
+		Short: "see what has changed in the problems you are working on",
+		Long: "   Lists the notes authors wrote when they updated problems in your\n" +
+			"   open assignments after you started them.\n\n" +
+			"   Example: grind whatsnew --days 7",
+		RunE: CommandWhatsNew,
+	}
+	cmdWhatsNew.Flags().Int("days", 0, "only list changes from the last few days")
+	cmdGrind.AddCommand(cmdWhatsNew)
+
+	cmdCheckout := &cobra.Command{
+		Use:   "checkout <label or number>",
+		Short: "restore your files from a checkpoint",
+		Long: "   Give the label of a checkpoint, or its number from \"grind history\".\n" +
+			"   If more than one checkpoint has the label, the newest one is used.\n\n" +
+			"   Your current files are saved as a checkpoint first, so you can\n" +
+			"   always come back to them.\n\n" +
+			"   Example: grind checkout \"before refactor\"",
+		RunE: CommandCheckout,
+	}
+	cmdGrind.AddCommand(cmdCheckout)
+
+	cmdLock := &cobra.Command{
+		Use:   "lock [directory]",
+		Short: "encrypt your files with a passphrase before leaving a shared computer",
+		Long: "   Encrypts your files for every problem in the problem set into a single\n" +
+			"   file and removes the originals. Saving and grading are refused until you\n" +
+			"   run \"grind unlock\" with the same passphrase. If you forget the passphrase,\n" +
+			"   use \"grind get\" in a new directory to download your last saved work.\n\n" +
+			"   The removed files are not securely erased from the disk.",
+		RunE: CommandLock,
+	}
+	cmdGrind.AddCommand(cmdLock)
+
+	cmdUnlock := &cobra.Command{
+		Use:   "unlock [directory]",
+		Short: "restore files encrypted with \"grind lock\"",
+		RunE:  CommandUnlock,
+	}
+	cmdGrind.AddCommand(cmdUnlock)
+
+	cmdStatus := &cobra.Command{
+		Use:   "status",
+		Short: "show the current step and any saved work not yet graded",
+		RunE:  CommandStatus,
+	}
+	cmdGrind.AddCommand(cmdStatus)
+
+	cmdDoc := &cobra.Command{
+		Use:   "doc [directory]",
+		Short: "show the instructions for the current step",
+		RunE:  CommandDoc,
+	}
+	cmdGrind.AddCommand(cmdDoc)
+
+	cmdTimezone := &cobra.Command{
+		Use:   "timezone [zone]",
+		Short: "show or set the timezone used to display deadlines",
+		Long: "   With no argument, shows your timezone setting. Give an IANA timezone\n" +
+			"   name to change it, or use --clear to go back to the timezone from Canvas.\n\n" +
+			"   Example: grind timezone America/Denver",
+		RunE: CommandTimezone,
+	}
+	cmdTimezone.Flags().Bool("clear", false, "clear your timezone setting")
+	cmdGrind.AddCommand(cmdTimezone)
+
 	cmdGrade := &cobra.Command{
 		Use:   "grade",
 		Short: "save your work and submit it for grading",
-		Run:   CommandGrade,
-	}
+		Long: "   Before grading, grind checks whether your files match work you submitted\n" +
+			"   for a different problem, and asks before continuing if they do.\n\n" +
+			"   Use --encrypt, or set \"encrypt\": true in your config file, to encrypt your\n" +
+			"   files so only the grading daycare can read them. Encrypted submissions are\n" +
+			"   stored on the server as ciphertext, so they cannot be restored with grind get.\n" +
+			"   The daycare's key is trusted the first time it is used and required after\n" +
+			"   that. To check it from the start, set \"daycareKey\" in your config file to\n" +
+			"   the fingerprint your instructor gives you.",
+		RunE: CommandGrade,
+	}
+	cmdGrade.Flags().Bool("encrypt", false, "encrypt files so only the daycare can read them")
+	cmdGrade.Flags().BoolP("force", "f", false, "skip the checks for reused code and oversized problem directories")
 	cmdGrind.AddCommand(cmdGrade)
 
+	cmdStyleCheck := &cobra.Command{
+		Use:   "stylecheck",
+		Short: "check your code for style problems without grading it",
+		Long: "   Runs the style checker for the problem's language, such as flake8 for\n" +
+			"   Python, and lists what it finds. This does not change your score, but\n" +
+			"   some problems check style when graded.",
+		RunE: CommandStyleCheck,
+	}
+	cmdGrind.AddCommand(cmdStyleCheck)
+
+	cmdSearch := &cobra.Command{
+		Use:   "search [words...]",
+		Short: "search for existing problems to reuse (authors only)",
+		Long: "   Searches problem notes, step instructions, and unique IDs.\n" +
+			"   Quoted phrases and -word exclusions are supported.\n\n" +
+			"   Example: grind search \"linked list\" --tags recursion --type python27unittest",
+		RunE: CommandSearch,
+	}
+	cmdSearch.Flags().String("tags", "", "only problems with all of these comma-separated tags")
+	cmdSearch.Flags().String("type", "", "only problems of this problem type")
+	cmdSearch.Flags().String("author", "", "only problems created by this author (user ID or email)")
+	cmdGrind.AddCommand(cmdSearch)
+
+	cmdPrecheck := &cobra.Command{
+		Use:   "precheck",
+		Short: "run a quick local sanity check before grading (experimental)",
+		Long: "   Runs the pre-check supplied with the problem, if any, on your machine.\n" +
+			"   Pre-checks are WebAssembly programs, so a WASI runtime such as wasmtime,\n" +
+			"   wasmer, or wasmedge must be installed. Set GRIND_WASM_RUNTIME to choose one.\n\n" +
+			"   Passing the pre-check does not guarantee passing when graded.",
+		RunE: CommandPrecheck,
+	}
+	cmdGrind.AddCommand(cmdPrecheck)
+
 	cmdCreate := &cobra.Command{
 		Use:   "create",
 		Short: "create a new problem (authors only)",
-		Run:   CommandCreate,
+		RunE:  CommandCreate,
 	}
 	cmdCreate.Flags().BoolP("update", "u", false, "update an existing problem")
+	cmdCreate.Flags().String("changelog", "", "what changed in this update, shown to students working on the problem")
+	cmdCreate.Flags().Bool("dry-run", false, "test the solution for every step without saving the problem")
 	cmdGrind.AddCommand(cmdCreate)
 
-	cmdGrind.Execute()
+	cmdProblem := &cobra.Command{
+		Use:   "problem",
+		Short: "manage problems (authors only)",
+	}
+	cmdProblemExport := &cobra.Command{
+		Use:   "export <problem> [directory]",
+		Short: "download a problem to edit it locally",
+		Long: "   Give either the numeric problem ID or its unique ID. The problem is\n" +
+			"   written in the layout that \"grind create\" reads, in a directory\n" +
+			"   named after the unique ID unless another is given.\n\n" +
+			"   Example: grind problem export cs1400-loops",
+		RunE: CommandProblemExport,
+	}
+	cmdProblem.AddCommand(cmdProblemExport)
+	cmdGrind.AddCommand(cmdProblem)
+
+	cmdSet := &cobra.Command{
+		Use:   "set",
+		Short: "manage problem sets (authors only)",
+	}
+	cmdSetCreate := &cobra.Command{
+		Use:   "create [set.cfg]",
+		Short: "create or update a problem set from a manifest",
+		Long: "   Reads a manifest (set.cfg by default) naming the problem set and\n" +
+			"   listing its problems by unique ID with optional weights:\n\n" +
+			"   [set]\n" +
+			"   unique = cs1400-week3\n" +
+			"   note = Week 3: loops\n" +
+			"   tag = loops\n\n" +
+			"   [problem \"cs1400-for-loops\"]\n" +
+			"   weight = 2\n\n" +
+			"   An existing problem set with the same unique ID is updated to match.",
+		RunE: CommandSetCreate,
+	}
+	cmdSet.AddCommand(cmdSetCreate)
+	cmdGrind.AddCommand(cmdSet)
+
+	cmdRegrade := &cobra.Command{
+		Use:   "regrade <assignment-id>",
+		Short: "regrade every student's work on an assignment (instructors only)",
+		Long: "   Grades the latest submission for every step of every student's copy of\n" +
+			"   the assignment again, using the problem as it is now. Scores are updated\n" +
+			"   and posted to the LMS. Any student's assignment ID for the assignment\n" +
+			"   will do, including your own.",
+		RunE: CommandRegrade,
+	}
+	cmdRegrade.Flags().Bool("no-wait", false, "start the regrade without waiting for it to finish")
+	cmdRegrade.Flags().Int64("status", 0, "follow a regrade that is already running, given its ID")
+	cmdGrind.AddCommand(cmdRegrade)
+
+	cmdStats := &cobra.Command{
+		Use:   "stats <assignment-id>",
+		Short: "summarize how students did on an assignment (instructors and TAs only)",
+		Long: "   Shows the distribution of scores, graded submissions and time spent per\n" +
+			"   student, the tests failed most often, and the most common error\n" +
+			"   messages in failed submissions. Any student's assignment ID for the\n" +
+			"   assignment will do, including your own.",
+		RunE: CommandStats,
+	}
+	cmdStats.Flags().Int("top", 10, "how many of the most failed tests to list (0 for all)")
+	cmdStats.Flags().Bool("students", false, "list each student's score, submissions, and time")
+	cmdGrind.AddCommand(cmdStats)
+
+	cmdExamBundle := &cobra.Command{
+		Use:   "exam-bundle <course-id> <problem-set>",
+		Short: "download a problem set for grading offline (instructors only)",
+		Long: "   Downloads an encrypted exam bundle of a problem set, with its tests,\n" +
+			"   for grading in a lab with no network. The key that opens it is\n" +
+			"   printed once; keep it from students. The lab machines need Docker\n" +
+			"   and the images for the problem types in the set.\n\n" +
+			"   Example: grind exam-bundle 12 cs1400-midterm --hours 48",
+		RunE: CommandExamBundle,
+	}
+	cmdExamBundle.Flags().Int("hours", 24, "how many hours the bundle is good for")
+	cmdExamBundle.Flags().StringP("output", "o", "", "where to save the bundle (default <problem-set>.cgx)")
+	cmdGrind.AddCommand(cmdExamBundle)
+
+	cmdExamGrade := &cobra.Command{
+		Use:   "exam-grade <bundle.cgx> [directory]",
+		Short: "grade work offline with an exam bundle",
+		Long: "   Grades a student's work in the directory (the current one by default)\n" +
+			"   against the tests in an exam bundle, using the local Docker daemon,\n" +
+			"   and saves a signed receipt to upload later with \"grind exam-upload\".\n" +
+			"   The server is not contacted. With --unpack, writes the starter files\n" +
+			"   for the problem set instead.\n\n" +
+			"   Example: grind exam-grade midterm.cgx --login jsmith --problem cs1400-sum",
+		RunE: CommandExamGrade,
+	}
+	cmdExamGrade.Flags().String("key", "", "the key for the bundle (default from GRIND_EXAM_KEY)")
+	cmdExamGrade.Flags().String("login", "", "the login of the student whose work is graded")
+	cmdExamGrade.Flags().String("problem", "", "the unique ID of the problem to grade")
+	cmdExamGrade.Flags().Int64("step", 1, "the step to grade")
+	cmdExamGrade.Flags().String("receipts", "receipts", "the directory to save receipts in")
+	cmdExamGrade.Flags().Bool("unpack", false, "write the starter files instead of grading")
+	cmdGrind.AddCommand(cmdExamGrade)
+
+	cmdExamUpload := &cobra.Command{
+		Use:   "exam-upload <receipt-or-directory>...",
+		Short: "upload receipts from offline grading (instructors only)",
+		Long: "   Sends receipts saved by \"grind exam-grade\" to the server, where each\n" +
+			"   waits for course staff to accept it with \"grind exam-review\".\n" +
+			"   Receipts already uploaded are skipped, so uploading twice is safe.",
+		RunE: CommandExamUpload,
+	}
+	cmdGrind.AddCommand(cmdExamUpload)
+
+	cmdExamReview := &cobra.Command{
+		Use:   "exam-review <bundle-id>",
+		Short: "accept or reject uploaded exam receipts (instructors and TAs only)",
+		Long: "   Anyone who can open an exam bundle can sign a receipt, so uploaded\n" +
+			"   receipts do not count until course staff review them. With no flags,\n" +
+			"   lists the receipts waiting for review. An accepted receipt becomes\n" +
+			"   the graded submission for its step and counts toward the student's\n" +
+			"   score, unless the student has saved newer work on that step.\n\n" +
+			"   Example: grind exam-review 7 --accept-all --reject 41,42",
+		RunE: CommandExamReview,
+	}
+	cmdExamReview.Flags().IntSlice("accept", nil, "IDs of receipts to accept")
+	cmdExamReview.Flags().IntSlice("reject", nil, "IDs of receipts to reject")
+	cmdExamReview.Flags().Bool("accept-all", false, "accept every receipt waiting for review that is not rejected")
+	cmdGrind.AddCommand(cmdExamReview)
+
+	cmdCompletion := &cobra.Command{
+		Use:   "completion [bash|zsh|fish]",
+		Short: "print a shell completion script",
+		Long: "   Load completions in the current shell with one of:\n\n" +
+			"   bash: source <(grind completion bash)\n" +
+			"   zsh:  source <(grind completion zsh)\n" +
+			"   fish: grind completion fish | source\n\n" +
+			"   Add the same line to your shell startup file to load them every time.",
+		ValidArgs: []string{"bash", "zsh", "fish"},
+		RunE:      CommandCompletion,
+	}
+	cmdGrind.AddCommand(cmdCompletion)
+
+	cmdCompleteNames := &cobra.Command{
+		Use:    "__complete-names",
+		Short:  "list assignment names for shell completion",
+		Hidden: true,
+		RunE:   CommandCompleteNames,
+	}
+	cmdGrind.AddCommand(cmdCompleteNames)
+	cmdGrind.BashCompletionFunction = bashCompletionFunction
+
+	// user-defined aliases from .codegrinderrc, e.g., "aliases": {"g": "grade"}
+	cmdGrind.SetArgs(expandAlias(cmdGrind, os.Args[1:]))
+
+	if err := cmdGrind.Execute(); err != nil {
+		log.Print(err)
+		if fromServer(err) {
+			printHelpContact()
+		}
+		os.Exit(exitCode(err))
+	}
 }
 
-func CommandInit(cmd *cobra.Command, args []string) {
-	fmt.Println(
-		`Please follow these steps:
-
-1.  Use Canvas to load a CodeGrinder window
-2.  Open a new tab in your browser and copy this URL into the address bar:
-
-    https://` + defaultHost + `/v2/users/me/cookie
-
-3.  The browser will display something of the form: ` + CookieName + `=...
-4.  Copy that entire string to the clipboard and paste it below.
-
-Paste here: `)
-
-	var cookie string
-	n, err := fmt.Scanln(&cookie)
+func CommandInit(cmd *cobra.Command, args []string) error {
+	fmt.Printf(T("Please follow these steps:\n\n"+
+		"1.  Use Canvas to load a CodeGrinder window\n"+
+		"2.  Open a new tab in your browser and copy this URL into the address bar:\n\n"+
+		"    https://%s/v2/users/me/cookie\n\n"+
+		"3.  The browser will display something of the form: %s=...\n"+
+		"4.  Copy that entire string to the clipboard and paste it below.\n\n"+
+		"grind will use the cookie once to create an API token, which is saved\n"+
+		"in place of the cookie. If you already have an API token, you can paste\n"+
+		"that instead.\n\n"+
+		"Paste here: "), defaultHost, CookieName)
+
+	var pasted string
+	n, err := fmt.Scanln(&pasted)
 	if err != nil {
-		log.Fatalf("error encountered while reading the cookie you pasted: %v\n", err)
+		return validationErrorf("error encountered while reading the cookie you pasted: %w", err)
 	}
 	if n != 1 {
-		log.Fatalf("failed to read the cookie you pasted; please try again\n")
-	}
-	if !strings.HasPrefix(cookie, CookieName+"=") {
-		log.Fatalf("the cookie must start with %s=; perhaps you copied the wrong thing?\n", CookieName)
+		return validationErrorf("failed to read the cookie you pasted; please try again")
 	}
-
-	// set up config
-	Config.Cookie = cookie
 	Config.Host = defaultHost
+	Config.Cookie = ""
+	Config.Token = ""
+	switch {
+	case strings.HasPrefix(pasted, apiTokenPrefix):
+		Config.Token = pasted
+	case strings.HasPrefix(pasted, CookieName+"="):
+		Config.Cookie = pasted
+	default:
+		return validationErrorf("the cookie must start with %s=; perhaps you copied the wrong thing?", CookieName)
+	}
 
 	// see if they need an upgrade
-	checkVersion()
+	if err := checkVersion(); err != nil {
+		return err
+	}
 
 	// try it out by fetching a user record
 	user := new(User)
-	mustGetObject("/users/me", nil, user)
+	if err := getObject("/users/me", nil, user); err != nil {
+		return err
+	}
+
+	// trade the cookie for an API token
+	if Config.Cookie != "" {
+		scope := cmd.Flag("scope").Value.String()
+		if scope == "" {
+			switch {
+			case user.Admin:
+				scope = TokenScopeAdmin
+			case user.Author:
+				scope = TokenScopeInstructor
+			default:
+				scope = TokenScopeStudent
+			}
+		}
+		token := new(APIToken)
+		if err := postObject("/users/me/tokens", nil, &APIToken{Name: tokenName(), Scope: scope}, token); err != nil {
+			return err
+		}
+		Config.Cookie = ""
+		Config.Token = token.Token
+		log.Printf(T("created %s API token %q"), token.Scope, token.Name)
+	}
 
 	// save config for later use
-	mustWriteConfig()
+	if err := writeConfig(); err != nil {
+		return err
+	}
 
-	log.Printf("cookie verified and saved: welcome %s", user.Name)
+	log.Printf(T("credentials verified and saved: welcome %s"), user.Name)
+	return nil
 }
 
-func mustGetObject(path string, params map[string]string, download interface{}) {
-	doRequest(path, params, "GET", nil, download, false)
+func getObject(path string, params map[string]string, download interface{}) error {
+	_, err := doRequest(path, params, "GET", nil, download, false)
+	return err
 }
 
-func getObject(path string, params map[string]string, download interface{}) bool {
+// getObjectIfExists is like getObject, but reports false instead of an error
+// if the server says the object does not exist.
+func getObjectIfExists(path string, params map[string]string, download interface{}) (bool, error) {
 	return doRequest(path, params, "GET", nil, download, true)
 }
 
-func mustPostObject(path string, params map[string]string, upload interface{}, download interface{}) {
-	doRequest(path, params, "POST", upload, download, false)
+func postObject(path string, params map[string]string, upload interface{}, download interface{}) error {
+	_, err := doRequest(path, params, "POST", upload, download, false)
+	return err
 }
 
-func mustPutObject(path string, params map[string]string, upload interface{}, download interface{}) {
-	doRequest(path, params, "PUT", upload, download, false)
+func putObject(path string, params map[string]string, upload interface{}, download interface{}) error {
+	_, err := doRequest(path, params, "PUT", upload, download, false)
+	return err
 }
 
-func doRequest(path string, params map[string]string, method string, upload interface{}, download interface{}, notfoundokay bool) bool {
+func doRequest(path string, params map[string]string, method string, upload interface{}, download interface{}, notfoundokay bool) (bool, error) {
 	if !strings.HasPrefix(path, "/") {
 		log.Panicf("doRequest path must start with /")
 	}
@@ -186,7 +547,7 @@ func doRequest(path string, params map[string]string, method string, upload inte
 	url := fmt.Sprintf("https://%s/v2%s", Config.Host, path)
 	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
-		log.Fatalf("error creating http request: %v\n", err)
+		return false, networkErrorf("error creating http request: %w", err)
 	}
 
 	// add any parameters
@@ -204,14 +565,24 @@ func doRequest(path string, params map[string]string, method string, upload inte
 
 	// set the headers
 	req.Header["Accept"] = []string{"application/json"}
-	req.Header["Cookie"] = []string{Config.Cookie}
+	req.Header["Accept-Encoding"] = []string{"gzip, deflate"}
+	addCredentials(req)
+
+	// ask the server to skip the body if our cached copy is current
+	var cached *cachedResponse
+	if method == "GET" {
+		if cached = cacheLookup(req.URL.String()); cached != nil && cached.ETag != "" {
+			req.Header["If-None-Match"] = []string{cached.ETag}
+		}
+	}
 
 	// upload the payload if any
+	var payload []byte
 	if upload != nil && (method == "POST" || method == "PUT") {
 		req.Header["Content-Type"] = []string{"application/json"}
-		payload, err := json.MarshalIndent(upload, "", "    ")
+		payload, err = json.MarshalIndent(upload, "", "    ")
 		if err != nil {
-			log.Fatalf("doRequest: JSON error encoding object to upload: %v", err)
+			return false, fmt.Errorf("doRequest: JSON error encoding object to upload: %w", err)
 		}
 		req.Body = ioutil.NopCloser(bytes.NewReader(payload))
 
@@ -221,54 +592,133 @@ func doRequest(path string, params map[string]string, method string, upload inte
 	}
 
 	resp, err := http.DefaultClient.Do(req)
+	if err != nil && cached != nil {
+		// fall back to the last copy we saw so grind still works offline
+		useCached(req.URL.String(), cached)
+		return decodeDownload(bytes.NewReader(cached.Body), download)
+	}
 	if err != nil {
-		log.Fatalf("error connecting to %s: %v\n", Config.Host, err)
+		return false, networkErrorf("error connecting to %s: %w", Config.Host, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized && Config.Token != "" && Config.Cookie != "" {
+		// a server that does not know the token yet may still take the cookie
+		resp.Body.Close()
+		delete(req.Header, "Authorization")
+		req.Header["Cookie"] = []string{Config.Cookie}
+		if payload != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(payload))
+		}
+		if Config.apiReport {
+			log.Printf("token rejected, retrying with session cookie")
+		}
+		if resp, err = http.DefaultClient.Do(req); err != nil {
+			return false, networkErrorf("error connecting to %s: %w", Config.Host, err)
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			dropLegacyCookie()
+		}
 	}
 	defer resp.Body.Close()
+	body, err := decodeBody(resp)
+	if err != nil {
+		return false, networkErrorf("error decoding response from %s: %w", Config.Host, err)
+	}
 	if notfoundokay && resp.StatusCode == http.StatusNotFound {
-		return false
+		return false, nil
 	}
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("unexpected status from %s: %s\n", url, resp.Status)
-		io.Copy(os.Stderr, resp.Body)
-		log.Fatalf("giving up")
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		if Config.apiReport {
+			log.Printf("using cached response")
+		}
+		body = bytes.NewReader(cached.Body)
+	} else if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		raw, _ := ioutil.ReadAll(io.LimitReader(body, 1e4))
+		msg := strings.TrimSpace(string(raw))
+		if explanation := statusExplanation(resp.StatusCode); explanation != "" {
+			msg += "\n" + explanation
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return false, serverErrorf(resp.StatusCode, "%s\nplease wait %s seconds before trying again", msg, resp.Header.Get("Retry-After"))
+		}
+		return false, serverErrorf(resp.StatusCode, "unexpected status from %s: %s: %s", url, resp.Status, msg)
+	} else if method == "GET" {
+		raw, err := ioutil.ReadAll(body)
+		if err != nil {
+			return false, networkErrorf("error reading response from %s: %w", Config.Host, err)
+		}
+		cacheStore(req.URL.String(), resp.Header.Get("ETag"), raw)
+		body = bytes.NewReader(raw)
 	}
 
-	// parse the result if any
+	return decodeDownload(body, download)
+}
+
+// decodeDownload parses a response body into the download object, if any.
+func decodeDownload(body io.Reader, download interface{}) (bool, error) {
 	if download != nil {
-		decoder := json.NewDecoder(resp.Body)
+		decoder := json.NewDecoder(body)
 		if err := decoder.Decode(download); err != nil {
-			log.Fatalf("failed to parse result object from server: %v\n", err)
+			return false, networkErrorf("failed to parse result object from server: %w", err)
 		}
 
 		if Config.apiDump {
 			raw, err := json.MarshalIndent(download, "", "    ")
 			if err != nil {
-				log.Fatalf("doRequest: JSON error encoding downloaded object: %v", err)
+				return false, fmt.Errorf("doRequest: JSON error encoding downloaded object: %w", err)
 			}
 			log.Printf("Response data: %s", raw)
 		}
 
-		return true
+		return true, nil
+	}
+	return false, nil
+}
+
+// decodeBody returns a reader for the response body, undoing any
+// Content-Encoding applied by the server.
+func decodeBody(resp *http.Response) (io.Reader, error) {
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "":
+		return resp.Body, nil
+	case "gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		return zlib.NewReader(resp.Body)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", resp.Header.Get("Content-Encoding"))
 	}
-	return false
 }
 
-func mustLoadConfig(cmd *cobra.Command) {
+// addCredentials adds the user's API token or session cookie to a request.
+func addCredentials(req *http.Request) {
+	if Config.Token != "" {
+		req.Header["Authorization"] = []string{"Bearer " + Config.Token}
+	} else {
+		req.Header["Cookie"] = []string{Config.Cookie}
+	}
+}
+
+func homeDir() (string, error) {
 	home := os.Getenv("HOME")
 	if home == "" {
 		home = os.Getenv("USERPROFILE")
 	}
 	if home == "" {
-		log.Fatalf("Unable to locate home directory, giving up\n")
+		return "", configErrorf("unable to locate home directory, giving up")
+	}
+	return home, nil
+}
+
+func loadConfig(cmd *cobra.Command) error {
+	configFile, err := configPath(false)
+	if err != nil {
+		return err
 	}
-	configFile := filepath.Join(home, perUserDotFile)
 
 	if raw, err := ioutil.ReadFile(configFile); err != nil {
-		log.Fatalf("Unable to load config file; try running \"grind init\"\n")
+		return configErrorf("unable to load config file; try running \"grind init\": %w", err)
 	} else if err := json.Unmarshal(raw, &Config); err != nil {
-		log.Printf("failed to parse %s: %v", configFile, err)
-		log.Fatalf("you may wish to try deleting the file and running \"grind init\" again\n")
+		return configErrorf("failed to parse %s: %w\nyou may wish to try deleting the file and running \"grind init\" again", configFile, err)
 	}
 	if cmd.Flag("api").Value.String() == "true" {
 		Config.apiReport = true
@@ -277,29 +727,49 @@ func mustLoadConfig(cmd *cobra.Command) {
 		Config.apiReport = true
 		Config.apiDump = true
 	}
+	if flag := cmd.Flag("force"); flag != nil && flag.Value.String() == "true" {
+		Config.force = true
+	}
 
-	checkVersion()
+	if err := checkVersion(); err != nil {
+		return err
+	}
+	migrateLegacyConfig()
+	return nil
 }
 
-func mustWriteConfig() {
-	home := os.Getenv("HOME")
-	if home == "" {
-		home = os.Getenv("USERPROFILE")
-	}
-	if home == "" {
-		log.Fatalf("Unable to locate home directory, giving up\n")
+func writeConfig() error {
+	configFile, err := configPath(true)
+	if err != nil {
+		return err
 	}
-	configFile := filepath.Join(home, perUserDotFile)
 
 	raw, err := json.MarshalIndent(&Config, "", "    ")
 	if err != nil {
-		log.Fatalf("JSON error encoding cookie file: %v", err)
+		return fmt.Errorf("JSON error encoding cookie file: %w", err)
 	}
 	raw = append(raw, '\n')
 
-	if err = ioutil.WriteFile(configFile, raw, 0644); err != nil {
-		log.Fatalf("error writing %s: %v", configFile, err)
+	// write a new file and move it into place so the config is never left
+	// half written
+	tmp, err := ioutil.TempFile(filepath.Dir(configFile), perUserDotFile+".tmp")
+	if err != nil {
+		return configErrorf("error writing %s: %w", configFile, err)
 	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return configErrorf("error writing %s: %w", configFile, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return configErrorf("error writing %s: %w", configFile, err)
+	}
+	if err := os.Rename(tmp.Name(), configFile); err != nil {
+		os.Remove(tmp.Name())
+		return configErrorf("error writing %s: %w", configFile, err)
+	}
+	return nil
 }
 
 func plural(n int) string {
@@ -309,18 +779,27 @@ func plural(n int) string {
 	return "s"
 }
 
-func checkVersion() {
+func checkVersion() error {
 	server := new(Version)
-	mustGetObject("/version", nil, server)
+	if err := getObject("/version", nil, server); err != nil {
+		return err
+	}
 	grindCurrent := semver.MustParse(CurrentVersion.Version)
-	grindRequired := semver.MustParse(server.GrindVersionRequired)
+	grindRequired, err := semver.Parse(server.GrindVersionRequired)
+	if err != nil {
+		return networkErrorf("server reported an invalid required version %q: %w", server.GrindVersionRequired, err)
+	}
 	if grindRequired.GT(grindCurrent) {
-		log.Printf("this is grind version %s, but the server requires %s or higher", CurrentVersion.Version, server.GrindVersionRequired)
-		log.Fatalf("  you must upgrade to continue")
+		return configErrorf("this is grind version %s, but the server requires %s or higher\n  you must upgrade to continue",
+			CurrentVersion.Version, server.GrindVersionRequired)
+	}
+	grindRecommended, err := semver.Parse(server.GrindVersionRecommended)
+	if err != nil {
+		return networkErrorf("server reported an invalid recommended version %q: %w", server.GrindVersionRecommended, err)
 	}
-	grindRecommended := semver.MustParse(server.GrindVersionRecommended)
 	if grindRecommended.GT(grindCurrent) {
-		log.Printf("this is grind version %s, but the server recommends %s or higher", CurrentVersion.Version, server.GrindVersionRecommended)
-		log.Printf("  please upgrade as soon as possible")
+		log.Printf(T("this is grind version %s, but the server recommends %s or higher"), CurrentVersion.Version, server.GrindVersionRecommended)
+		log.Print(T("  please upgrade as soon as possible"))
 	}
+	return nil
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// Config files written by older versions of grind hold a session cookie
+// instead of an API token. When grind finds one, it asks the server to
+// exchange the cookie for a token and saves the token in the config. The
+// cookie is kept as a fallback while some servers may not know about
+// tokens yet, and dropped once the server stops accepting it. If the
+// server predates the exchange or the cookie has expired, grind keeps
+// using the cookie and tries again next time.
+
+// tokenName is the name given to API tokens that grind creates.
+func tokenName() string {
+	if hostname, err := os.Hostname(); err == nil {
+		return "grind on " + hostname
+	}
+	return "grind"
+}
+
+// migrateLegacyConfig exchanges the session cookie of a legacy config for
+// an API token. Failures are not fatal, since the cookie still works.
+func migrateLegacyConfig() {
+	if Config.Cookie == "" || Config.Token != "" {
+		return
+	}
+	token := new(APIToken)
+	found, err := doRequest("/users/me/tokens/exchange", nil, "POST", &APIToken{Name: tokenName()}, token, true)
+	if err != nil {
+		if Config.apiReport {
+			log.Printf("unable to exchange the session cookie for an API token: %v", err)
+		}
+		return
+	}
+	if !found || token.Token == "" {
+		// the server does not offer the exchange yet
+		return
+	}
+	Config.Token = token.Token
+	if err := writeConfig(); err != nil {
+		log.Printf(T("warning: unable to save the new API token: %v"), err)
+		return
+	}
+	log.Printf(T("created %s API token %q"), token.Scope, token.Name)
+}
+
+// dropLegacyCookie forgets a fallback cookie the server no longer accepts.
+func dropLegacyCookie() {
+	Config.Cookie = ""
+	if err := writeConfig(); err != nil {
+		log.Printf(T("warning: unable to save the new API token: %v"), err)
+	}
+}
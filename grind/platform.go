@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+)
+
+// isWindows is true when grind is running on Windows, where the config file
+// lives under %APPDATA% and text files use CRLF line endings.
+var isWindows = runtime.GOOS == "windows"
+
+// configPath returns the location of the per-user config file.
+// On Windows this is %APPDATA%\codegrinder\.codegrinderrc, but an existing
+// file in the home directory from an older version of grind is still used
+// for reading until the config is written again.
+// When forWrite is true, the parent directory is created if necessary.
+func configPath(forWrite bool) (string, error) {
+	if isWindows {
+		if appData := os.Getenv("APPDATA"); appData != "" {
+			dir := filepath.Join(appData, "codegrinder")
+			path := filepath.Join(dir, perUserDotFile)
+			if forWrite {
+				if err := os.MkdirAll(dir, 0700); err != nil {
+					return "", configErrorf("error creating directory %s: %w", dir, err)
+				}
+				return path, nil
+			}
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+			if home, err := homeDir(); err == nil {
+				legacy := filepath.Join(home, perUserDotFile)
+				if _, err := os.Stat(legacy); err == nil {
+					return legacy, nil
+				}
+			}
+			return path, nil
+		}
+	}
+	home, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, perUserDotFile), nil
+}
+
+// isText guesses if file contents are text, in which case line endings
+// can be converted safely.
+func isText(contents string) bool {
+	return utf8.ValidString(contents) && !strings.ContainsRune(contents, 0)
+}
+
+// localLineEndings converts text files from the LF line endings used by the
+// server to the native line endings of the platform.
+func localLineEndings(contents string) string {
+	if !isWindows || !isText(contents) {
+		return contents
+	}
+	return strings.Replace(strings.Replace(contents, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+// serverLineEndings reverses localLineEndings before files are uploaded,
+// matching the normalization that the server applies to problem files.
+func serverLineEndings(contents string) string {
+	if !isText(contents) {
+		return contents
+	}
+	return strings.Replace(contents, "\r\n", "\n", -1)
+}
+
+// matchWhitelist finds the whitelist entry for a file name.
+// Case-insensitive file systems and editors can change the case of a name,
+// so an exact match is preferred but a match ignoring case is accepted.
+// The canonical name from the whitelist is returned.
+func matchWhitelist(whitelist map[string]bool, name string) (string, bool) {
+	if whitelist[name] {
+		return name, true
+	}
+	for candidate := range whitelist {
+		if strings.EqualFold(candidate, name) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
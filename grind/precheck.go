@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// precheckFile is the name of the optional pre-check module in a step
+// directory when creating a problem.
+const precheckFile = "_precheck.wasm"
+
+// wasmRuntimes lists the WASI runtimes that grind knows how to use, in order
+// of preference, with the arguments each needs to run a module in the
+// current directory. The module and file names are appended, with "--"
+// between them if separator is set.
+var wasmRuntimes = []struct {
+	name      string
+	args      []string
+	separator bool
+}{
+	{name: "wasmtime", args: []string{"run", "--dir=."}},
+	{name: "wasmer", args: []string{"run", "--dir=."}, separator: true},
+	{name: "wasmedge", args: []string{"--dir", ".:."}},
+}
+
+// CommandPrecheck runs the problem's WebAssembly pre-check on the local
+// files without submitting anything to the server.
+func CommandPrecheck(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	// find the directory
+	dir := ""
+	switch len(args) {
+	case 0:
+		dir = "."
+	case 1:
+		dir = args[0]
+	default:
+		cmd.Help()
+		return nil
+	}
+
+	problem, _, commit, _, err := gather(now, dir)
+	if err != nil {
+		return err
+	}
+
+	module, err := downloadPrecheck(problem.ID, commit.Step)
+	if err != nil {
+		return err
+	}
+	if module == nil {
+		log.Printf("step %d of %s does not have a pre-check; use \"grind grade\" to test your code", commit.Step, problem.Unique)
+		return nil
+	}
+
+	// run it on a copy of the files so the pre-check cannot change them
+	tmp, err := ioutil.TempDir("", "grind-precheck-")
+	if err != nil {
+		return configErrorf("error creating temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	modulePath := filepath.Join(tmp, "precheck.wasm")
+	if err := ioutil.WriteFile(modulePath, module, 0644); err != nil {
+		return configErrorf("error saving pre-check: %w", err)
+	}
+	work := filepath.Join(tmp, "work")
+	if err := os.Mkdir(work, 0755); err != nil {
+		return configErrorf("error creating directory %s: %w", work, err)
+	}
+	names := []string{}
+	for name, contents := range commit.Files {
+		if err := ioutil.WriteFile(filepath.Join(work, name), []byte(contents), 0644); err != nil {
+			return configErrorf("error copying %s: %w", name, err)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	runtime, runtimeArgs, separator, err := findWasmRuntime()
+	if err != nil {
+		return err
+	}
+	runtimeArgs = append(runtimeArgs, modulePath)
+	if separator {
+		runtimeArgs = append(runtimeArgs, "--")
+	}
+	runtimeArgs = append(runtimeArgs, names...)
+
+	log.Printf("running pre-check for step %d of %s", commit.Step, problem.Unique)
+	run := exec.Command(runtime, runtimeArgs...)
+	run.Dir = work
+	run.Stdout = os.Stdout
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return validationErrorf("pre-check failed; fix the problems reported above before grading")
+		}
+		return configErrorf("error running %s: %w", runtime, err)
+	}
+	log.Printf("pre-check passed; use \"grind grade\" to submit your code for grading")
+	return nil
+}
+
+// downloadPrecheck fetches the pre-check module for a problem step,
+// returning nil if the step does not have one.
+func downloadPrecheck(problemID, step int64) ([]byte, error) {
+	url := fmt.Sprintf("https://%s/v2/problems/%d/steps/%d/precheck.wasm", Config.Host, problemID, step)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, networkErrorf("error creating http request: %w", err)
+	}
+	if Config.apiReport {
+		log.Printf("GET %s", req.URL)
+	}
+	req.Header["Accept"] = []string{"application/wasm"}
+	req.Header["Accept-Encoding"] = []string{"gzip, deflate"}
+	addCredentials(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, networkErrorf("error connecting to %s: %w", Config.Host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	body, err := decodeBody(resp)
+	if err != nil {
+		return nil, networkErrorf("error decoding response from %s: %w", Config.Host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		raw, _ := ioutil.ReadAll(body)
+		return nil, serverErrorf(resp.StatusCode, "%s", strings.TrimSpace(string(raw)))
+	}
+	module, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, networkErrorf("error downloading pre-check: %w", err)
+	}
+	return module, nil
+}
+
+// findWasmRuntime locates a WASI runtime, preferring the one named by
+// GRIND_WASM_RUNTIME if it is set.
+func findWasmRuntime() (path string, args []string, separator bool, err error) {
+	preferred := os.Getenv("GRIND_WASM_RUNTIME")
+	for _, elt := range wasmRuntimes {
+		if preferred != "" && preferred != elt.name {
+			continue
+		}
+		if path, err := exec.LookPath(elt.name); err == nil {
+			return path, append([]string{}, elt.args...), elt.separator, nil
+		}
+	}
+	if preferred != "" {
+		return "", nil, false, configErrorf("unable to find %s; install it or unset GRIND_WASM_RUNTIME", preferred)
+	}
+	return "", nil, false, configErrorf("unable to find a WebAssembly runtime; install wasmtime, wasmer, or wasmedge to use pre-checks")
+}
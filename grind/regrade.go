@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// RegradePollInterval is how often grind regrade checks on progress.
+const RegradePollInterval = 2 * time.Second
+
+// CommandRegrade starts a regrade of every student's copy of an assignment
+// and follows its progress until it finishes. With --status, it follows a
+// regrade that is already running instead.
+func CommandRegrade(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	if status, _ := cmd.Flags().GetInt64("status"); status > 0 {
+		regrade := new(Regrade)
+		if err := getObject(fmt.Sprintf("/regrades/%d", status), nil, regrade); err != nil {
+			return err
+		}
+		return followRegrade(regrade)
+	}
+	if len(args) != 1 {
+		cmd.Help()
+		return nil
+	}
+	assignmentID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return validationErrorf("assignment ID must be a number, not %q", args[0])
+	}
+
+	regrade := new(Regrade)
+	if err := postObject(fmt.Sprintf("/assignments/%d/regrade", assignmentID), nil, nil, regrade); err != nil {
+		return err
+	}
+	log.Printf("regrade %d started: %d commit%s to grade", regrade.ID, regrade.Total, plural(regrade.Total))
+	if noWait, _ := cmd.Flags().GetBool("no-wait"); noWait {
+		log.Printf("check on it later with: grind regrade --status %d", regrade.ID)
+		return nil
+	}
+	return followRegrade(regrade)
+}
+
+// followRegrade reports the progress of a regrade until it finishes.
+func followRegrade(regrade *Regrade) error {
+	done := -1
+	for {
+		if regrade.Done != done {
+			done = regrade.Done
+			log.Printf("  %d/%d graded, %d failed, %d score%s changed", regrade.Done, regrade.Total, regrade.Failed, regrade.Changed, plural(regrade.Changed))
+		}
+		if regrade.FinishedAt != nil {
+			break
+		}
+		time.Sleep(RegradePollInterval)
+		if err := getObject(fmt.Sprintf("/regrades/%d", regrade.ID), nil, regrade); err != nil {
+			return err
+		}
+	}
+	if regrade.Failed > 0 {
+		log.Printf("regrade %d finished with %d failure%s; the last was: %s", regrade.ID, regrade.Failed, plural(regrade.Failed), regrade.Note)
+	} else {
+		log.Printf("regrade %d finished", regrade.ID)
+	}
+	return nil
+}
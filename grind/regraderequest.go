@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// CommandRegradeRequest asks the course staff to take another look at how
+// the saved work for the current problem was graded.
+func CommandRegradeRequest(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	message := strings.TrimSpace(strings.Join(args, " "))
+	if message == "" {
+		cmd.Help()
+		return nil
+	}
+
+	problem, assignment, _, _, err := gather(now, ".")
+	if err != nil {
+		return err
+	}
+	commit := new(Commit)
+	found, err := getObjectIfExists(fmt.Sprintf("/assignments/%d/problems/%d/commits/last", assignment.ID, problem.ID), nil, commit)
+	if err != nil {
+		return err
+	}
+	if !found || commit.ReportCard == nil {
+		return validationErrorf("no graded work has been saved for %s", problem.Unique)
+	}
+
+	request := new(RegradeRequest)
+	if err := postObject(fmt.Sprintf("/commits/%d/regrade_requests", commit.ID), nil, &RegradeRequest{Message: message}, request); err != nil {
+		return err
+	}
+	log.Printf("regrade request sent for %s step %d; you will be notified of the decision", problem.Unique, commit.Step)
+	return nil
+}
@@ -7,14 +7,17 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	. "github.com/russross/codegrinder/types"
 	"github.com/spf13/cobra"
 )
 
-func CommandSave(cmd *cobra.Command, args []string) {
-	mustLoadConfig(cmd)
+func CommandSave(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
 	now := time.Now()
 
 	// find the directory
@@ -26,27 +29,58 @@ func CommandSave(cmd *cobra.Command, args []string) {
 		dir = args[0]
 	default:
 		cmd.Help()
-		return
+		return nil
+	}
+
+	problem, _, commit, _, err := gather(now, dir)
+	if err != nil {
+		return err
+	}
+	label, _ := cmd.Flags().GetString("message")
+	if err := saveCommit(commit, label); err != nil {
+		return err
+	}
+	if label != "" {
+		log.Printf(T("problem %s step %d saved as checkpoint %q"), problem.Unique, commit.Step, label)
+	} else {
+		log.Printf(T("problem %s step %d saved"), problem.Unique, commit.Step)
+	}
+	if _, err := warnOpenCommit(commit.AssignmentID, problem.ID); err != nil {
+		return err
 	}
+	return nil
+}
 
-	problem, _, commit, _ := gather(now, dir)
+// saveCommit sends a commit to the server without grading it. If label is
+// not empty, the server also keeps it as a checkpoint with that label.
+func saveCommit(commit *Commit, label string) error {
 	commit.Action = ""
 	commit.Note = "saving from grind tool"
 	unsigned := &CommitBundle{Commit: commit}
+	if label = strings.TrimSpace(label); label != "" {
+		commit.Note = label
+		unsigned.Checkpoint = true
+	}
 
-	// send the commit to the server
 	signed := new(CommitBundle)
-	mustPostObject("/commit_bundles/unsigned", nil, unsigned, signed)
-	log.Printf("problem %s step %d saved", problem.Unique, commit.Step)
+	return postObject("/commit_bundles/unsigned", nil, unsigned, signed)
 }
 
-func gather(now time.Time, startDir string) (*Problem, *Assignment, *Commit, *DotFileInfo) {
+func gather(now time.Time, startDir string) (*Problem, *Assignment, *Commit, *DotFileInfo, error) {
 	// find the .grind file containing the problem set info
-	dotfile, problemSetDir, problemDir := findDotFile(startDir)
+	dotfile, problemSetDir, problemDir, err := findDotFile(startDir)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if isLocked(problemSetDir) {
+		return nil, nil, nil, nil, validationErrorf("this problem set is locked\nuse \"grind unlock\" to restore your files first")
+	}
 
 	// get the assignment
 	assignment := new(Assignment)
-	mustGetObject(fmt.Sprintf("/assignments/%d", dotfile.AssignmentID), nil, assignment)
+	if err := getObject(fmt.Sprintf("/assignments/%d", dotfile.AssignmentID), nil, assignment); err != nil {
+		return nil, nil, nil, nil, err
+	}
 
 	// get the problem
 	unique := ""
@@ -59,24 +93,31 @@ func gather(now time.Time, startDir string) (*Problem, *Assignment, *Commit, *Do
 	} else {
 		// use the subdirectory name to identify the problem
 		if problemDir == "" {
-			log.Printf("you must identify the problem within this problem set")
-			log.Printf("  either run this from with the problem directory, or")
-			log.Fatalf("  identify it as a parameter in the command")
+			return nil, nil, nil, nil, validationErrorf("you must identify the problem within this problem set\n" +
+				"  either run this from with the problem directory, or\n" +
+				"  identify it as a parameter in the command")
 		}
 		_, unique = filepath.Split(problemDir)
 	}
 	info := dotfile.Problems[unique]
 	if info == nil {
-		log.Fatalf("unable to recognize the problem based on the directory name of %q", unique)
+		return nil, nil, nil, nil, validationErrorf("unable to recognize the problem based on the directory name of %q", unique)
 	}
 	problem := new(Problem)
-	mustGetObject(fmt.Sprintf("/problems/%d", info.ID), nil, problem)
+	if err := getObject(fmt.Sprintf("/problems/%d", info.ID), nil, problem); err != nil {
+		return nil, nil, nil, nil, err
+	}
 
 	// TODO: get the problem step and verify local files match
 
+	// make sure this looks like a problem directory before reading anything
+	if err := checkProblemDir(problemDir, info.Whitelist); err != nil {
+		return nil, nil, nil, nil, err
+	}
+
 	// gather the commit files from the file system
 	files := make(map[string]string)
-	err := filepath.Walk(problemDir, func(path string, stat os.FileInfo, err error) error {
+	err = filepath.Walk(problemDir, func(path string, stat os.FileInfo, err error) error {
 		// skip errors, directories, non-regular files
 		if err != nil {
 			return err
@@ -98,28 +139,29 @@ func gather(now time.Time, startDir string) (*Problem, *Assignment, *Commit, *Do
 			return nil
 		}
 
-		if info.Whitelist[name] {
+		if canonical, ok := matchWhitelist(info.Whitelist, name); ok {
 			contents, err := ioutil.ReadFile(path)
 			if err != nil {
 				return err
 			}
-			files[name] = string(contents)
+			files[canonical] = serverLineEndings(string(contents))
 		} else {
 			log.Printf("skipping %q which is not a file introduced by the problem", name)
 		}
 		return nil
 	})
 	if err != nil {
-		log.Fatalf("walk error: %v", err)
+		return nil, nil, nil, nil, configErrorf("walk error: %w", err)
 	}
 	if len(files) != len(info.Whitelist) {
-		log.Printf("did not find all the expected files")
+		missing := []string{}
 		for name := range info.Whitelist {
 			if _, ok := files[name]; !ok {
-				log.Printf("  %s not found", name)
+				missing = append(missing, "  "+name+" not found")
 			}
 		}
-		log.Fatalf("all expected files must be present")
+		return nil, nil, nil, nil, validationErrorf("did not find all the expected files\n%s\nall expected files must be present",
+			strings.Join(missing, "\n"))
 	}
 
 	// form a commit object
@@ -133,10 +175,10 @@ func gather(now time.Time, startDir string) (*Problem, *Assignment, *Commit, *Do
 		UpdatedAt:    now,
 	}
 
-	return problem, assignment, commit, dotfile
+	return problem, assignment, commit, dotfile, nil
 }
 
-func findDotFile(startDir string) (dotfile *DotFileInfo, problemSetDir, problemDir string) {
+func findDotFile(startDir string) (dotfile *DotFileInfo, problemSetDir, problemDir string, err error) {
 	abs := false
 	problemSetDir, problemDir = startDir, ""
 	for {
@@ -147,7 +189,7 @@ func findDotFile(startDir string) (dotfile *DotFileInfo, problemSetDir, problemD
 					abs = true
 					path, err := filepath.Abs(problemSetDir)
 					if err != nil {
-						log.Fatalf("error finding absolute path of %s: %v", problemSetDir, err)
+						return nil, "", "", configErrorf("error finding absolute path of %s: %w", problemSetDir, err)
 					}
 					problemSetDir = path
 				}
@@ -156,13 +198,13 @@ func findDotFile(startDir string) (dotfile *DotFileInfo, problemSetDir, problemD
 				problemDir = problemSetDir
 				problemSetDir = filepath.Dir(problemSetDir)
 				if problemSetDir == problemDir {
-					log.Fatalf("unable to find %s in %s or an ancestor directory", perProblemSetDotFile, startDir)
+					return nil, "", "", configErrorf("unable to find %s in %s or an ancestor directory", perProblemSetDotFile, startDir)
 				}
 				log.Printf("could not find %s in %s, trying %s", perProblemSetDotFile, problemDir, problemSetDir)
 				continue
 			}
 
-			log.Fatalf("error searching for %s in %s: %v", perProblemSetDotFile, problemSetDir, err)
+			return nil, "", "", configErrorf("error searching for %s in %s: %w", perProblemSetDotFile, problemSetDir, err)
 		}
 		break
 	}
@@ -171,13 +213,13 @@ func findDotFile(startDir string) (dotfile *DotFileInfo, problemSetDir, problemD
 	path := filepath.Join(problemSetDir, perProblemSetDotFile)
 	contents, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalf("error reading %s: %v", path, err)
+		return nil, "", "", configErrorf("error reading %s: %w", path, err)
 	}
 	dotfile = new(DotFileInfo)
 	if err := json.Unmarshal(contents, dotfile); err != nil {
-		log.Fatalf("error parsing %s: %v", path, err)
+		return nil, "", "", configErrorf("error parsing %s: %w", path, err)
 	}
 	dotfile.Path = path
 
-	return dotfile, problemSetDir, problemDir
+	return dotfile, problemSetDir, problemDir, nil
 }
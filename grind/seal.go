@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+
+	. "github.com/russross/codegrinder/types"
+)
+
+// sealCommit replaces the files of a commit with a copy encrypted to the
+// daycare's public key, so the main server only sees ciphertext.
+//
+// The key comes from the TA, which cannot read what is sealed to it. Its
+// fingerprint is pinned in .codegrinderrc the first time it is used, and a
+// different key from the server is rejected after that. This trusts the
+// server on first use. To avoid that, set daycareKey in .codegrinderrc to
+// the fingerprint the instructor publishes before the first submission.
+func sealCommit(commit *Commit) error {
+	key := new(DaycareKey)
+	if err := getObject("/daycare/key", nil, key); err != nil {
+		return err
+	}
+	pub, err := ParseDaycarePublicKey(key.PublicKey)
+	if err != nil {
+		return networkErrorf("bad daycare key from %s: %w", Config.Host, err)
+	}
+	fingerprint, err := KeyFingerprint(pub)
+	if err != nil {
+		return networkErrorf("bad daycare key from %s: %w", Config.Host, err)
+	}
+
+	switch Config.DaycareKey {
+	case "":
+		log.Printf("encrypting submissions to daycare key %s", fingerprint)
+		log.Printf("  this key will be required from now on; compare it with your instructor's if in doubt")
+		Config.DaycareKey = fingerprint
+		if err := writeConfig(); err != nil {
+			return err
+		}
+	case fingerprint:
+	default:
+		return validationErrorf("the daycare key has changed from %s to %s\n"+
+			"  if your instructor confirms the change, remove \"daycareKey\" from your config file and try again",
+			Config.DaycareKey, fingerprint)
+	}
+
+	sealed, err := SealFiles(pub, commit.Files)
+	if err != nil {
+		return validationErrorf("error encrypting files: %w", err)
+	}
+	commit.Sealed = sealed
+	commit.Files = nil
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// CommandSearch finds existing problems matching a query so authors can
+// reuse them instead of writing duplicates.
+func CommandSearch(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+
+	params := make(map[string]string)
+	if len(args) > 0 {
+		params["q"] = strings.Join(args, " ")
+	}
+	for flag, param := range map[string]string{"tags": "tags", "type": "problemType", "author": "author"} {
+		if value := cmd.Flag(flag).Value.String(); value != "" {
+			params[param] = value
+		}
+	}
+	if len(params) == 0 {
+		return validationErrorf("usage: grind search [words...] [--tags a,b] [--type problemtype] [--author email]")
+	}
+
+	results := []*ProblemSearchResult{}
+	if err := getObject("/problems/search", params, &results); err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return validationErrorf("no matching problems found")
+	}
+
+	for _, result := range results {
+		problem := result.Problem
+		fmt.Printf("%d: %s (%s)", problem.ID, problem.Unique, problem.ProblemType)
+		if len(problem.Tags) > 0 {
+			fmt.Printf(" [%s]", strings.Join(problem.Tags, ", "))
+		}
+		fmt.Println()
+		if note := strings.TrimSpace(strings.SplitN(problem.Note, "\n", 2)[0]); note != "" {
+			fmt.Printf("    %s\n", note)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/russross/gcfg"
+	"github.com/spf13/cobra"
+)
+
+// ProblemSetConfigName is the default name of a problem set manifest.
+const ProblemSetConfigName string = "set.cfg"
+
+// CommandSetCreate creates or updates a problem set from a manifest.
+// The manifest uses the same format as problem.cfg:
+//
+//	[set]
+//	unique = cs1400-week3
+//	note = Week 3: loops
+//	tag = loops
+//
+//	[problem "cs1400-for-loops"]
+//	weight = 2
+//
+//	[problem "cs1400-while-loops"]
+//
+// An optional _doc directory next to the manifest holds the overview of
+// the problem set. A set tagged graded-together has all of its problems
+// graded at once as a unit.
+func CommandSetCreate(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	configPath := ProblemSetConfigName
+	switch len(args) {
+	case 0:
+	case 1:
+		configPath = args[0]
+		if info, err := os.Stat(configPath); err == nil && info.IsDir() {
+			configPath = filepath.Join(configPath, ProblemSetConfigName)
+		}
+	default:
+		cmd.Help()
+		return nil
+	}
+
+	// parse the manifest
+	cfg := struct {
+		Set struct {
+			Unique string
+			Note   string
+			Tag    []string
+		}
+		Problem map[string]*struct {
+			Weight float64
+		}
+	}{}
+	fmt.Printf("reading %s\n", configPath)
+	if err := gcfg.ReadFileInto(&cfg, configPath); err != nil {
+		return validationErrorf("failed to parse %s: %w", configPath, err)
+	}
+	if len(cfg.Problem) == 0 {
+		return validationErrorf("%s does not list any problems", configPath)
+	}
+
+	set := &ProblemSet{
+		Unique:    cfg.Set.Unique,
+		Note:      cfg.Set.Note,
+		Tags:      cfg.Set.Tag,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := set.Normalize(now); err != nil {
+		return validationErrorf("%s: %w", configPath, err)
+	}
+
+	// look up every problem, reporting all of the missing ones at once
+	uniques := []string{}
+	for unique := range cfg.Problem {
+		uniques = append(uniques, unique)
+	}
+	sort.Strings(uniques)
+	bundle := &ProblemSetBundle{ProblemSet: set}
+	var missing []string
+	for _, unique := range uniques {
+		problems := []*Problem{}
+		if err := getObject("/problems", map[string]string{"unique": unique}, &problems); err != nil {
+			return err
+		}
+		if len(problems) != 1 {
+			missing = append(missing, unique)
+			continue
+		}
+		weight := cfg.Problem[unique].Weight
+		if weight <= 0.0 {
+			weight = 1.0
+		}
+		log.Printf("  %s (problem %d) with weight %g", unique, problems[0].ID, weight)
+		bundle.ProblemIDs = append(bundle.ProblemIDs, problems[0].ID)
+		bundle.Weights = append(bundle.Weights, weight)
+	}
+	if len(missing) > 0 {
+		return validationErrorf("no problem found with unique ID: %s", strings.Join(missing, ", "))
+	}
+
+	// gather the overview, if any
+	docDir := filepath.Join(filepath.Dir(configPath), "_doc")
+	if info, err := os.Stat(docDir); err == nil && info.IsDir() {
+		bundle.Files = make(map[string]string)
+		err := filepath.Walk(docDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			relpath, err := filepath.Rel(filepath.Dir(configPath), path)
+			if err != nil {
+				return fmt.Errorf("error finding relative path of %s: %w", path, err)
+			}
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %w", relpath, err)
+			}
+			bundle.Files[filepath.ToSlash(relpath)] = string(contents)
+			return nil
+		})
+		if err != nil {
+			return configErrorf("%w", err)
+		}
+	}
+
+	// create or update the problem set
+	existing := []*ProblemSet{}
+	if err := getObject("/problem_sets", map[string]string{"unique": set.Unique}, &existing); err != nil {
+		return err
+	}
+	final := new(ProblemSetBundle)
+	switch len(existing) {
+	case 0:
+		if err := postObject("/problem_set_bundles", nil, bundle, final); err != nil {
+			return err
+		}
+		log.Printf("problem set %q created with %d problem(s)", final.ProblemSet.Unique, len(final.ProblemIDs))
+	case 1:
+		set.ID = existing[0].ID
+		if err := putObject(fmt.Sprintf("/problem_set_bundles/%d", set.ID), nil, bundle, final); err != nil {
+			return err
+		}
+		log.Printf("problem set %q (%d) updated with %d problem(s)", final.ProblemSet.Unique, final.ProblemSet.ID, len(final.ProblemIDs))
+	default:
+		return validationErrorf("error: server found multiple problem sets with matching unique ID %q", set.Unique)
+	}
+	return nil
+}
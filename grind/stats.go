@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// statsBarWidth is the width of the longest bar in the score histogram.
+const statsBarWidth = 40
+
+// CommandStats prints a summary of how the students in a course did on an
+// assignment.
+func CommandStats(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		cmd.Help()
+		return nil
+	}
+	assignmentID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return validationErrorf("assignment ID must be a number, not %q", args[0])
+	}
+	stats := new(AssignmentStats)
+	if err := getObject(fmt.Sprintf("/assignments/%d/stats", assignmentID), nil, stats); err != nil {
+		return err
+	}
+	title := fmt.Sprintf("%s: %d student%s", stats.Unique, stats.Students, plural(stats.Students))
+	fmt.Println(title)
+	fmt.Println(dashes(len(title)))
+	if stats.Students == 0 {
+		return nil
+	}
+
+	fmt.Printf("score: mean %.0f%%, median %.0f%%\n", stats.MeanScore*100, stats.MedianScore*100)
+	most := 0
+	for _, count := range stats.ScoreBuckets {
+		if count > most {
+			most = count
+		}
+	}
+	for i, count := range stats.ScoreBuckets {
+		label := fmt.Sprintf("%3d-%d%%", i*10, i*10+9)
+		if i == len(stats.ScoreBuckets)-1 {
+			label = fmt.Sprintf("%3d-100%%", i*10)
+		}
+		fmt.Printf("  %-8s %4d %s\n", label, count, strings.Repeat("#", (count*statsBarWidth+most-1)/most))
+	}
+	if s := stats.Attempts; s != nil {
+		fmt.Printf("graded submissions per student: median %.1f, mean %.1f, range %d-%d\n", s.Median, s.Mean, s.Min, s.Max)
+	}
+	if s := stats.Minutes; s != nil {
+		fmt.Printf("minutes from first to final commit: median %.0f, mean %.0f, range %d-%d\n", s.Median, s.Mean, s.Min, s.Max)
+	}
+
+	if len(stats.TestFailures) > 0 {
+		fmt.Println()
+		fmt.Println("most failed tests:")
+		limit, _ := cmd.Flags().GetInt("top")
+		for i, elt := range stats.TestFailures {
+			if limit > 0 && i >= limit {
+				break
+			}
+			fmt.Printf("  %5d failure%s, %d student%s: %s step %d %s\n", elt.Failures, plural(elt.Failures), elt.Students, plural(elt.Students), elt.Unique, elt.Step, elt.Test)
+		}
+	}
+	if len(stats.CommonErrors) > 0 {
+		fmt.Println()
+		fmt.Println("most common errors:")
+		for _, elt := range stats.CommonErrors {
+			fmt.Printf("  %d student%s: %s\n", elt.Students, plural(elt.Students), elt.Message)
+		}
+	}
+
+	if students, _ := cmd.Flags().GetBool("students"); students {
+		fmt.Println()
+		fmt.Println("students:")
+		for _, elt := range stats.PerStudent {
+			fmt.Printf("  %4.0f%%  %4d graded  %6d min  %s (%s)\n", elt.Score*100, elt.Attempts, elt.Minutes, elt.Name, elt.Login)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// CommandStatus reports which problem step the local files are for and
+// whether there is saved work that has not been graded yet.
+func CommandStatus(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	// find the directory
+	dir := ""
+	switch len(args) {
+	case 0:
+		dir = "."
+	case 1:
+		dir = args[0]
+	default:
+		cmd.Help()
+		return nil
+	}
+
+	if _, problemSetDir, _, err := findDotFile(dir); err != nil {
+		return err
+	} else if isLocked(problemSetDir) {
+		log.Printf("%s is locked; use \"grind unlock\" to restore your files", problemSetDir)
+		return nil
+	}
+
+	problem, assignment, commit, _, err := gather(now, dir)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s: working on %s step %d with %d file%s%s", assignment.CanvasTitle, problem.Unique, commit.Step, len(commit.Files), plural(len(commit.Files)), cachedLabel())
+	warnDeadline(now, assignment)
+
+	// refresh the cached instructions while we can so "grind doc" works offline
+	if offlineSince.IsZero() {
+		getObject(fmt.Sprintf("/problems/%d/steps/%d", problem.ID, commit.Step), nil, new(ProblemStep))
+	}
+
+	found, err := warnOpenCommit(assignment.ID, problem.ID)
+	var networkErr *NetworkError
+	if errors.As(err, &networkErr) && !offlineSince.IsZero() && !fromServer(err) {
+		log.Printf("unable to check for saved work while offline")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !found {
+		log.Printf("no saved work is waiting to be graded")
+	}
+	return nil
+}
+
+// warnOpenCommit tells the user how long until work that was saved but not
+// graded is finalized, reporting false if there is no such work.
+func warnOpenCommit(assignmentID, problemID int64) (bool, error) {
+	open := new(OpenCommit)
+	found, err := getObjectIfExists(fmt.Sprintf("/assignments/%d/problems/%d/commits/open", assignmentID, problemID), nil, open)
+	if err != nil || !found {
+		return false, err
+	}
+	remaining := time.Duration(open.Timeout-open.Age) * time.Second
+	minutes := int(remaining.Minutes() + 0.5)
+	if minutes < 1 {
+		minutes = 1
+	}
+	log.Printf("your in-progress attempt at step %d will be finalized in %d minute%s without further activity",
+		open.Step, minutes, plural(minutes))
+	log.Printf("  use \"grind grade\" to submit it for grading")
+	return true, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"html"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+func CommandStyleCheck(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	// find the directory
+	dir := ""
+	switch len(args) {
+	case 0:
+		dir = "."
+	case 1:
+		dir = args[0]
+	default:
+		cmd.Help()
+		return nil
+	}
+
+	problem, _, commit, _, err := gather(now, dir)
+	if err != nil {
+		return err
+	}
+	commit.Action = "stylecheck"
+	commit.Note = "style check from grind tool"
+	unsigned := &CommitBundle{Commit: commit}
+
+	// send the commit bundle to the server
+	signed := new(CommitBundle)
+	if err := postObject("/commit_bundles/unsigned", nil, unsigned, signed); err != nil {
+		return err
+	}
+	if signed.Held != "" {
+		return validationErrorf("%s", signed.Held)
+	}
+	user := new(User)
+	if err := getObject("/users/me", nil, user); err != nil {
+		return err
+	}
+
+	// the result is not saved, since it does not change the score
+	log.Printf("checking style for %s step %d", problem.Unique, commit.Step)
+	checked, err := confirmCommitBundle(user.ID, signed, nil)
+	if err != nil {
+		return err
+	}
+	card := checked.Commit.ReportCard
+	if card == nil {
+		return validationErrorf("no style report was returned")
+	}
+	for _, result := range card.Results {
+		text := strings.TrimSpace(html.UnescapeString(htmlTag.ReplaceAllString(result.Details, "")))
+		color.Yellow("%s: %s\n", result.Context, text)
+	}
+	log.Print(card.Note)
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// CommandTutorial downloads the practice assignment that teaches the grind
+// workflow. The server creates it the first time it is requested, and work
+// on it never counts toward a grade.
+func CommandTutorial(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	rootDir := ""
+	switch len(args) {
+	case 0:
+	case 1:
+		rootDir = args[0]
+	default:
+		cmd.Help()
+		return nil
+	}
+
+	assignment := new(Assignment)
+	if err := postObject("/users/me/tutorial", nil, nil, assignment); err != nil {
+		return err
+	}
+	if rootDir == "" {
+		rootDir = filepath.Join(TutorialLabel, TutorialLabel)
+	}
+	if _, err := os.Stat(rootDir); err == nil {
+		log.Printf(T("the tutorial is already in %s"), rootDir)
+	} else if err := downloadAssignment(assignment, rootDir); err != nil {
+		return err
+	}
+	log.Printf(T("to start the tutorial, go to %s and run \"grind doc\""), rootDir)
+	return nil
+}
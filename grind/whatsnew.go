@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	. "github.com/russross/codegrinder/types"
+	"github.com/spf13/cobra"
+)
+
+// CommandWhatsNew lists what authors have changed in the problems of the
+// user's open assignments since the user started them.
+func CommandWhatsNew(cmd *cobra.Command, args []string) error {
+	if err := loadConfig(cmd); err != nil {
+		return err
+	}
+	params := make(map[string]string)
+	if days, _ := cmd.Flags().GetInt("days"); days > 0 {
+		params["days"] = strconv.Itoa(days)
+	}
+	entries := []*ProblemChangelog{}
+	if err := getObject("/users/me/changelog", params, &entries); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("no problems in your open assignments have changed since you started them")
+		return nil
+	}
+	for i, entry := range entries {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s (%s), updated %s\n", entry.Unique, entry.ProblemNote, entry.CreatedAt.Local().Format(DeadlineFormat))
+		for _, line := range strings.Split(entry.Entry, "\n") {
+			fmt.Printf("    %s\n", line)
+		}
+	}
+	fmt.Println()
+	fmt.Println("run \"grind get\" again for a fresh copy of a problem's instructions and starter files")
+	return nil
+}
@@ -0,0 +1,3 @@
+-- Let courses override the grading rate limit and daily quota.
+ALTER TABLE courses ADD COLUMN rate_limit_per_minute integer;
+ALTER TABLE courses ADD COLUMN daily_quota integer;
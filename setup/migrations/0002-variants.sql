@@ -0,0 +1,4 @@
+-- Add weighted starter variants to problems and record the variant in each commit.
+ALTER TABLE problems ADD COLUMN variants jsonb NOT NULL DEFAULT 'null';
+ALTER TABLE problems ALTER COLUMN variants DROP DEFAULT;
+ALTER TABLE commits ADD COLUMN variant text;
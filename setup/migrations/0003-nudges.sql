@@ -0,0 +1,12 @@
+-- Record reminders sent to students who have not started an assignment.
+CREATE TABLE nudges (
+    id                      bigserial NOT NULL,
+    assignment_id           bigint NOT NULL,
+    sent_by                 bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE,
+    FOREIGN KEY (sent_by) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX nudges_assignment_id ON nudges (assignment_id, created_at);
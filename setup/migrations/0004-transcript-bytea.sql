@@ -0,0 +1,4 @@
+-- Convert commit transcripts from jsonb to bytea so they can be stored
+-- gzip-compressed. Existing rows keep their plain JSON text, which the
+-- server still reads; they are compressed the next time they are saved.
+ALTER TABLE commits ALTER COLUMN transcript TYPE bytea USING convert_to(transcript::text, 'UTF8');
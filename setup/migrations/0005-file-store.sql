@@ -0,0 +1,22 @@
+-- Move commit file contents into the content-addressed files table.
+-- Afterward, commits.files maps each file name to the SHA-256 hash of its
+-- contents instead of holding the contents directly.
+-- Requires PostgreSQL 11 or later for the sha256 function.
+CREATE TABLE files (
+    hash                    text NOT NULL,
+    contents                text NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (hash)
+);
+
+INSERT INTO files (hash, contents, created_at)
+    SELECT encode(sha256(convert_to(value, 'UTF8')), 'hex'), value, MIN(created_at)
+    FROM commits, jsonb_each_text(commits.files)
+    GROUP BY value
+    ON CONFLICT (hash) DO NOTHING;
+
+UPDATE commits SET files = COALESCE(
+    (SELECT jsonb_object_agg(key, encode(sha256(convert_to(value, 'UTF8')), 'hex'))
+     FROM jsonb_each_text(commits.files)),
+    '{}'::jsonb);
@@ -0,0 +1,2 @@
+-- Keep the compiled overview of each problem set.
+ALTER TABLE problem_sets ADD COLUMN instructions text;
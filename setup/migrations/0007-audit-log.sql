@@ -0,0 +1,16 @@
+-- Add the audit log of mutating API calls.
+CREATE TABLE audit_log (
+    id                      bigserial NOT NULL,
+    user_id                 bigint,
+    impersonator_id         bigint,
+    method                  text NOT NULL,
+    path                    text NOT NULL,
+    type                    text NOT NULL,
+    object_id               bigint,
+    summary                 text,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id)
+);
+CREATE INDEX audit_log_created_at ON audit_log (created_at);
+CREATE INDEX audit_log_user_id ON audit_log (user_id, created_at);
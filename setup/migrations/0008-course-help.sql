@@ -0,0 +1,4 @@
+-- Add a display name and help contact to courses.
+ALTER TABLE courses ADD COLUMN display_name text;
+ALTER TABLE courses ADD COLUMN help_email text;
+ALTER TABLE courses ADD COLUMN help_text text;
@@ -0,0 +1,15 @@
+-- Add scoped, revocable API tokens.
+CREATE TABLE api_tokens (
+    id                      bigserial NOT NULL,
+    user_id                 bigint NOT NULL,
+    name                    text NOT NULL,
+    scope                   text NOT NULL,
+    token_hash              text NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    last_used_at            timestamp with time zone,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX api_tokens_token_hash ON api_tokens (token_hash);
+CREATE INDEX api_tokens_user_id ON api_tokens (user_id);
@@ -0,0 +1,2 @@
+-- Add optional WebAssembly pre-check modules to problem steps.
+ALTER TABLE problem_steps ADD COLUMN precheck bytea;
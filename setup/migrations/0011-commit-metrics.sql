@@ -0,0 +1,3 @@
+-- Add static size and complexity metrics to commits.
+-- Existing commits have no metrics until they are saved again.
+ALTER TABLE commits ADD COLUMN metrics jsonb NOT NULL DEFAULT 'null';
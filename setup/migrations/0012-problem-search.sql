@@ -0,0 +1,6 @@
+-- Record problem authors and add indexes for problem search.
+-- Requires PostgreSQL 11 or later for websearch_to_tsquery.
+ALTER TABLE problems ADD COLUMN author_id bigint;
+CREATE INDEX problems_note_search ON problems USING gin (to_tsvector('english', note));
+CREATE INDEX problems_tags ON problems USING gin (tags jsonb_path_ops);
+CREATE INDEX problem_steps_instructions_search ON problem_steps USING gin (to_tsvector('english', instructions));
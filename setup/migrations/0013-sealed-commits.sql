@@ -0,0 +1,2 @@
+-- Add end-to-end encrypted commit files.
+ALTER TABLE commits ADD COLUMN sealed bytea;
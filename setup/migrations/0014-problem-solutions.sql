@@ -0,0 +1,14 @@
+-- Keep author reference solutions so they can be re-validated.
+CREATE TABLE problem_solutions (
+    problem_id              bigint NOT NULL,
+    step                    bigint NOT NULL,
+    files                   jsonb NOT NULL,
+    passed                  boolean NOT NULL,
+    note                    text,
+    checked_at              timestamp with time zone NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (problem_id, step),
+    FOREIGN KEY (problem_id, step) REFERENCES problem_steps (problem_id, step) ON DELETE CASCADE
+);
@@ -0,0 +1,26 @@
+-- Queue grading requests so several daycare workers can share the load.
+CREATE TABLE daycare_workers (
+    name                    text NOT NULL,
+    problem_types           json NOT NULL DEFAULT 'null',
+    slots                   bigint NOT NULL,
+    running                 bigint NOT NULL,
+    last_seen_at            timestamp with time zone NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (name)
+);
+
+CREATE TABLE daycare_jobs (
+    id                      bigserial NOT NULL,
+    problem_type            text NOT NULL,
+    action                  text NOT NULL,
+    args                    json NOT NULL DEFAULT 'null',
+    request                 json NOT NULL DEFAULT 'null',
+    status                  text NOT NULL,
+    worker                  text,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id)
+);
+CREATE INDEX daycare_jobs_queued ON daycare_jobs (problem_type, id) WHERE status = 'queued';
@@ -0,0 +1,6 @@
+-- Track malware scanning of submitted files and quarantined commits.
+ALTER TABLE files ADD COLUMN scan_status text;
+ALTER TABLE files ADD COLUMN scan_note text;
+ALTER TABLE files ADD COLUMN scanned_at timestamp with time zone;
+CREATE INDEX files_unscanned ON files (created_at) WHERE scan_status IS NULL;
+ALTER TABLE commits ADD COLUMN quarantined boolean NOT NULL DEFAULT FALSE;
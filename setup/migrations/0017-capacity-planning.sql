@@ -0,0 +1,14 @@
+-- Record assignment due dates and grading runtimes for capacity planning.
+ALTER TABLE assignments ADD COLUMN due_at timestamp with time zone;
+CREATE TABLE action_runs (
+    id                      bigserial NOT NULL,
+    course_id               bigint NOT NULL,
+    user_id                 bigint NOT NULL,
+    problem_type            text NOT NULL,
+    action                  text NOT NULL,
+    duration_ms             bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id)
+);
+CREATE INDEX action_runs_course_created_at ON action_runs (course_id, created_at);
@@ -0,0 +1,2 @@
+-- Record each user's preferred timezone for displaying deadlines.
+ALTER TABLE users ADD COLUMN timezone text;
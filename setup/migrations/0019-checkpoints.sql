@@ -0,0 +1,15 @@
+-- Keep labeled copies of saved work that students can return to.
+CREATE TABLE checkpoints (
+    id                      bigserial NOT NULL,
+    assignment_id           bigint NOT NULL,
+    problem_id              bigint NOT NULL,
+    step                    bigint NOT NULL,
+    label                   text NOT NULL,
+    files                   jsonb NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE,
+    FOREIGN KEY (problem_id, step) REFERENCES problem_steps (problem_id, step) ON DELETE CASCADE
+);
+CREATE INDEX checkpoints_assignment_problem ON checkpoints (assignment_id, problem_id, created_at);
@@ -0,0 +1,3 @@
+-- Add the SQL problem types.
+ALTER TYPE problem_types ADD VALUE 'sqlite';
+ALTER TYPE problem_types ADD VALUE 'postgres';
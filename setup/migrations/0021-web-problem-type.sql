@@ -0,0 +1,2 @@
+-- Add the web frontend problem type.
+ALTER TYPE problem_types ADD VALUE 'web';
@@ -0,0 +1,4 @@
+-- Record the problem step of each grading run so attempts can be counted.
+ALTER TABLE action_runs ADD COLUMN problem_id bigint;
+ALTER TABLE action_runs ADD COLUMN step bigint;
+CREATE INDEX action_runs_problem_id ON action_runs (problem_id);
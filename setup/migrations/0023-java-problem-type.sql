@@ -0,0 +1,2 @@
+-- Add the Java JUnit problem type.
+ALTER TYPE problem_types ADD VALUE 'javaunit';
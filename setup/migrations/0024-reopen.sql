@@ -0,0 +1,16 @@
+-- Record assignment lock dates and let instructors reopen locked assignments.
+ALTER TABLE assignments ADD COLUMN lock_at timestamp with time zone;
+CREATE TABLE assignment_reopens (
+    id                      bigserial NOT NULL,
+    assignment_id           bigint NOT NULL,
+    reopened_by             bigint NOT NULL,
+    reason                  text NOT NULL,
+    lock_at                 timestamp with time zone NOT NULL,
+    exclude_passback        boolean NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE,
+    FOREIGN KEY (reopened_by) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX assignment_reopens_assignment_id ON assignment_reopens (assignment_id, created_at);
@@ -0,0 +1,2 @@
+-- Add the Rust cargo test problem type.
+ALTER TYPE problem_types ADD VALUE 'rusttest';
@@ -0,0 +1,15 @@
+-- Smoke test reference solutions on each daycare worker.
+ALTER TABLE daycare_workers ADD COLUMN image_ids json NOT NULL DEFAULT 'null';
+ALTER TABLE daycare_jobs ADD COLUMN problem_id bigint;
+ALTER TABLE daycare_jobs ADD COLUMN target_worker text;
+CREATE TABLE smoke_tests (
+    worker                  text NOT NULL,
+    problem_id              bigint NOT NULL,
+    version                 text NOT NULL,
+    passed                  boolean NOT NULL,
+    note                    text NOT NULL,
+    checked_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (worker, problem_id),
+    FOREIGN KEY (problem_id) REFERENCES problems (id) ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+-- Add the MIPS and ARM assembly problem types.
+ALTER TYPE problem_types ADD VALUE 'mipsasm';
+ALTER TYPE problem_types ADD VALUE 'armasm';
@@ -0,0 +1,14 @@
+-- Append-only outbox of events for external integrations.
+CREATE TABLE outbox_events (
+    id                      bigserial NOT NULL,
+    txid                    bigint NOT NULL,
+    kind                    text NOT NULL,
+    course_id               bigint,
+    user_id                 bigint,
+    object_id               bigint NOT NULL,
+    data                    json NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id)
+);
+CREATE INDEX outbox_events_txid ON outbox_events (txid, id);
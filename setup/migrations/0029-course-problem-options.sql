@@ -0,0 +1,10 @@
+-- Default problem options for each problem type in a course.
+CREATE TABLE course_problem_options (
+    course_id               bigint NOT NULL,
+    problem_type            text NOT NULL,
+    options                 json NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (course_id, problem_type),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE
+);
@@ -0,0 +1,22 @@
+-- Regrade every student's latest work on an assignment.
+CREATE TABLE regrades (
+    id                      bigserial NOT NULL,
+    course_id               bigint NOT NULL,
+    problem_set_id          bigint NOT NULL,
+    requested_by            bigint NOT NULL,
+    total                   integer NOT NULL,
+    done                    integer NOT NULL,
+    failed                  integer NOT NULL,
+    changed                 integer NOT NULL,
+    note                    text,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+    finished_at             timestamp with time zone,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (problem_set_id) REFERENCES problem_sets (id) ON DELETE CASCADE,
+    FOREIGN KEY (requested_by) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX regrades_running ON regrades (course_id, problem_set_id) WHERE finished_at IS NULL;
+ALTER TABLE commits ADD COLUMN regrade_id bigint;
@@ -0,0 +1,15 @@
+-- Let instructors override the computed score of an assignment.
+CREATE TABLE score_overrides (
+    id                      bigserial NOT NULL,
+    assignment_id           bigint NOT NULL,
+    score                   double precision NOT NULL,
+    comment                 text NOT NULL,
+    overridden_by           bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    UNIQUE (assignment_id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE,
+    FOREIGN KEY (overridden_by) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,17 @@
+-- Let instructors comment on lines of code in a student's commit.
+CREATE TABLE commit_comments (
+    id                      bigserial NOT NULL,
+    commit_id               bigint NOT NULL,
+    author_id               bigint NOT NULL,
+    file                    text NOT NULL,
+    line_start              integer NOT NULL,
+    line_end                integer NOT NULL,
+    excerpt                 text NOT NULL,
+    body                    text NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (commit_id) REFERENCES commits (id) ON DELETE CASCADE,
+    FOREIGN KEY (author_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX commit_comments_commit_id ON commit_comments (commit_id, file, line_start);
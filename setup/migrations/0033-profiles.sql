@@ -0,0 +1,12 @@
+-- Keep runtime profiles taken in the background.
+CREATE TABLE profiles (
+    id                      bigserial NOT NULL,
+    kind                    text NOT NULL,
+    host                    text NOT NULL,
+    size                    integer NOT NULL,
+    data                    bytea NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id)
+);
+CREATE INDEX profiles_created_at ON profiles (created_at);
@@ -0,0 +1,23 @@
+-- Let students ask for a second look at how a commit was graded.
+CREATE TABLE regrade_requests (
+    id                      bigserial NOT NULL,
+    commit_id               bigint NOT NULL,
+    assignment_id           bigint NOT NULL,
+    course_id               bigint NOT NULL,
+    user_id                 bigint NOT NULL,
+    message                 text NOT NULL,
+    status                  text NOT NULL,
+    decision                text,
+    resolved_by             bigint,
+    resolved_at             timestamp with time zone,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (commit_id) REFERENCES commits (id) ON DELETE CASCADE,
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE,
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (resolved_by) REFERENCES users (id) ON DELETE SET NULL
+);
+CREATE INDEX regrade_requests_course_status ON regrade_requests (course_id, status, created_at);
+CREATE UNIQUE INDEX regrade_requests_open_commit ON regrade_requests (commit_id) WHERE status = 'open';
@@ -0,0 +1,12 @@
+-- Count how often each student fails each test, for failure hints.
+CREATE TABLE test_failures (
+    assignment_id           bigint NOT NULL,
+    problem_id              bigint NOT NULL,
+    step                    bigint NOT NULL,
+    test                    text NOT NULL,
+    failures                integer NOT NULL,
+
+    PRIMARY KEY (assignment_id, problem_id, step, test),
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE,
+    FOREIGN KEY (problem_id, step) REFERENCES problem_steps (problem_id, step) ON DELETE CASCADE
+);
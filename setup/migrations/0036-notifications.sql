@@ -0,0 +1,21 @@
+-- Queue notifications to users and keep their notification preferences.
+ALTER TABLE users ADD COLUMN notifications jsonb;
+
+CREATE TABLE notifications (
+    id                      bigserial NOT NULL,
+    user_id                 bigint NOT NULL,
+    kind                    text NOT NULL,
+    channel                 text NOT NULL,
+    subject                 text NOT NULL,
+    body                    text NOT NULL,
+    status                  text NOT NULL,
+    attempts                integer NOT NULL,
+    last_error              text,
+    created_at              timestamp with time zone NOT NULL,
+    sent_at                 timestamp with time zone,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX notifications_pending ON notifications (created_at) WHERE status = 'pending';
+CREATE INDEX notifications_user_id ON notifications (user_id, created_at);
@@ -0,0 +1,2 @@
+-- Let administrators tag daycare workers for problem type routing.
+ALTER TABLE daycare_workers ADD COLUMN tags json NOT NULL DEFAULT '[]';
@@ -0,0 +1,11 @@
+-- Let instructors limit how much grading detail students see for a problem set.
+CREATE TABLE course_feedback_levels (
+    course_id               bigint NOT NULL,
+    problem_set_id          bigint NOT NULL,
+    level                   text NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (course_id, problem_set_id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (problem_set_id) REFERENCES problem_sets (id) ON DELETE CASCADE
+);
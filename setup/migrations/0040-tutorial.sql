@@ -0,0 +1,2 @@
+-- Add the problem type used by grind tutorial.
+ALTER TYPE problem_types ADD VALUE 'tutorial';
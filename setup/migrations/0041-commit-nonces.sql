@@ -0,0 +1,11 @@
+-- Track the nonces of commits signed for grading so each can be saved once.
+CREATE TABLE commit_nonces (
+    nonce                   text NOT NULL,
+    commit_id               bigint NOT NULL,
+    expires_at              timestamp with time zone NOT NULL,
+    used_at                 timestamp with time zone,
+
+    PRIMARY KEY (nonce),
+    FOREIGN KEY (commit_id) REFERENCES commits (id) ON DELETE CASCADE
+);
+CREATE INDEX commit_nonces_expires_at ON commit_nonces (expires_at);
@@ -0,0 +1,8 @@
+-- Save the progress of long-running jobs so they can resume after an interruption.
+CREATE TABLE job_checkpoints (
+    job                     text NOT NULL,
+    last_key                bigint NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (job)
+);
@@ -0,0 +1,69 @@
+-- Give users staff roles in courses, beyond what the LMS gives them.
+CREATE TABLE course_roles (
+    course_id               bigint NOT NULL,
+    user_id                 bigint NOT NULL,
+    role                    text NOT NULL,
+    granted_by              bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (course_id, user_id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (granted_by) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX course_roles_user ON course_roles (user_id);
+
+CREATE OR REPLACE VIEW user_problem_sets AS
+    (SELECT DISTINCT assignments.user_id, problem_sets.id AS problem_set_id FROM
+    assignments JOIN problem_sets ON assignments.problem_set_id = problem_sets.id)
+    UNION
+    (SELECT DISTINCT instructors.id AS user_id, assignments.problem_set_id AS problem_set_id FROM
+    users AS instructors JOIN assignments AS instructors_assignments ON instructors.id = instructors_assignments.user_id
+    JOIN courses ON instructors_assignments.course_id = courses.id
+    JOIN assignments ON courses.id = assignments.id
+    WHERE instructors_assignments.instructor)
+    UNION
+    (SELECT DISTINCT course_roles.user_id, assignments.problem_set_id FROM
+    course_roles JOIN assignments ON course_roles.course_id = assignments.course_id);
+
+CREATE OR REPLACE VIEW user_problems AS
+    (SELECT DISTINCT assignments.user_id, problem_set_problems.problem_id FROM
+    assignments JOIN problem_sets ON assignments.problem_set_id = problem_sets.id
+    JOIN problem_set_problems ON problem_sets.id = problem_set_problems.problem_set_id)
+    UNION
+    (SELECT DISTINCT instructors.id AS user_id, problem_set_problems.problem_id FROM
+    users AS instructors JOIN assignments AS instructors_assignments ON instructors.id = instructors_assignments.user_id
+    JOIN courses ON instructors_assignments.course_id = courses.id
+    JOIN assignments ON courses.id = assignments.id
+    JOIN problem_sets ON assignments.problem_set_id = problem_sets.id
+    JOIN problem_set_problems ON problem_sets.id = problem_set_problems.problem_id
+    WHERE instructors_assignments.instructor)
+    UNION
+    (SELECT DISTINCT course_roles.user_id, problem_set_problems.problem_id FROM
+    course_roles JOIN assignments ON course_roles.course_id = assignments.course_id
+    JOIN problem_set_problems ON assignments.problem_set_id = problem_set_problems.problem_set_id);
+
+CREATE OR REPLACE VIEW user_users AS
+    (SELECT DISTINCT instructors.id AS user_id, users.id AS other_user_id FROM
+    users AS instructors JOIN assignments AS instructors_assignments ON instructors.id = instructors_assignments.user_id
+    JOIN courses ON instructors_assignments.course_id = courses.id
+    JOIN assignments ON courses.id = assignments.id
+    JOIN users ON assignments.user_id = users.id
+    WHERE instructors_assignments.instructor)
+    UNION
+    (SELECT DISTINCT course_roles.user_id, assignments.user_id AS other_user_id FROM
+    course_roles JOIN assignments ON course_roles.course_id = assignments.course_id)
+    UNION
+    (SELECT id as user_id, id AS other_user_id FROM users);
+
+CREATE OR REPLACE VIEW user_assignments AS
+    (SELECT DISTINCT instructors.id AS user_id, assignments.id AS assignment_id FROM
+    users AS instructors JOIN assignments AS instructors_assignments ON instructors.id = instructors_assignments.user_id
+    JOIN courses ON instructors_assignments.course_id = courses.id
+    JOIN assignments ON courses.id = assignments.id
+    WHERE instructors_assignments.instructor)
+    UNION
+    (SELECT DISTINCT course_roles.user_id, assignments.id AS assignment_id FROM
+    course_roles JOIN assignments ON course_roles.course_id = assignments.course_id)
+    UNION
+    (SELECT user_id, id as assignment_id FROM assignments);
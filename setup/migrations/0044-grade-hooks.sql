@@ -0,0 +1,20 @@
+-- Let courses run hooks after each grading action.
+CREATE TABLE course_grade_hooks (
+    id                      bigserial NOT NULL,
+    course_id               bigint NOT NULL,
+    url                     text,
+    script                  text,
+    secret                  text NOT NULL,
+    active                  boolean NOT NULL,
+    outbox_cursor           text NOT NULL,
+    failures                integer NOT NULL,
+    last_error              text,
+    created_by              bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX course_grade_hooks_course_id ON course_grade_hooks (course_id);
@@ -0,0 +1,81 @@
+-- Delete problems, assignments, and commits by setting deleted_at, behind views that hide deleted rows.
+ALTER TABLE problems RENAME TO problems_all;
+ALTER TABLE assignments RENAME TO assignments_all;
+ALTER TABLE commits RENAME TO commits_all;
+
+ALTER TABLE problems_all ADD COLUMN deleted_at timestamp with time zone;
+ALTER TABLE assignments_all ADD COLUMN deleted_at timestamp with time zone;
+ALTER TABLE commits_all ADD COLUMN deleted_at timestamp with time zone;
+
+DROP INDEX problems_unique_id;
+CREATE UNIQUE INDEX problems_unique_id ON problems_all (unique_id) WHERE deleted_at IS NULL;
+DROP INDEX assignments_unique_user;
+CREATE UNIQUE INDEX assignments_unique_user ON assignments_all (user_id, lti_id) WHERE deleted_at IS NULL;
+DROP INDEX assignments_grade_id;
+CREATE UNIQUE INDEX assignments_grade_id ON assignments_all (grade_id) WHERE deleted_at IS NULL;
+DROP INDEX commits_unique_assignment_problem_step;
+CREATE UNIQUE INDEX commits_unique_assignment_problem_step ON commits_all (assignment_id, problem_id, step) WHERE deleted_at IS NULL;
+
+CREATE INDEX problems_deleted_at ON problems_all (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX assignments_deleted_at ON assignments_all (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX commits_deleted_at ON commits_all (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE VIEW problems AS SELECT * FROM problems_all WHERE deleted_at IS NULL;
+CREATE VIEW assignments AS SELECT * FROM assignments_all WHERE deleted_at IS NULL;
+CREATE VIEW commits AS SELECT * FROM commits_all WHERE deleted_at IS NULL;
+
+-- the user views followed the renamed tables, so point them at the new views
+CREATE OR REPLACE VIEW user_problem_sets AS
+    (SELECT DISTINCT assignments.user_id, problem_sets.id AS problem_set_id FROM
+    assignments JOIN problem_sets ON assignments.problem_set_id = problem_sets.id)
+    UNION
+    (SELECT DISTINCT instructors.id AS user_id, assignments.problem_set_id AS problem_set_id FROM
+    users AS instructors JOIN assignments AS instructors_assignments ON instructors.id = instructors_assignments.user_id
+    JOIN courses ON instructors_assignments.course_id = courses.id
+    JOIN assignments ON courses.id = assignments.id
+    WHERE instructors_assignments.instructor)
+    UNION
+    (SELECT DISTINCT course_roles.user_id, assignments.problem_set_id FROM
+    course_roles JOIN assignments ON course_roles.course_id = assignments.course_id);
+
+CREATE OR REPLACE VIEW user_problems AS
+    (SELECT DISTINCT assignments.user_id, problem_set_problems.problem_id FROM
+    assignments JOIN problem_sets ON assignments.problem_set_id = problem_sets.id
+    JOIN problem_set_problems ON problem_sets.id = problem_set_problems.problem_set_id)
+    UNION
+    (SELECT DISTINCT instructors.id AS user_id, problem_set_problems.problem_id FROM
+    users AS instructors JOIN assignments AS instructors_assignments ON instructors.id = instructors_assignments.user_id
+    JOIN courses ON instructors_assignments.course_id = courses.id
+    JOIN assignments ON courses.id = assignments.id
+    JOIN problem_sets ON assignments.problem_set_id = problem_sets.id
+    JOIN problem_set_problems ON problem_sets.id = problem_set_problems.problem_id
+    WHERE instructors_assignments.instructor)
+    UNION
+    (SELECT DISTINCT course_roles.user_id, problem_set_problems.problem_id FROM
+    course_roles JOIN assignments ON course_roles.course_id = assignments.course_id
+    JOIN problem_set_problems ON assignments.problem_set_id = problem_set_problems.problem_set_id);
+
+CREATE OR REPLACE VIEW user_users AS
+    (SELECT DISTINCT instructors.id AS user_id, users.id AS other_user_id FROM
+    users AS instructors JOIN assignments AS instructors_assignments ON instructors.id = instructors_assignments.user_id
+    JOIN courses ON instructors_assignments.course_id = courses.id
+    JOIN assignments ON courses.id = assignments.id
+    JOIN users ON assignments.user_id = users.id
+    WHERE instructors_assignments.instructor)
+    UNION
+    (SELECT DISTINCT course_roles.user_id, assignments.user_id AS other_user_id FROM
+    course_roles JOIN assignments ON course_roles.course_id = assignments.course_id)
+    UNION
+    (SELECT id as user_id, id AS other_user_id FROM users);
+
+CREATE OR REPLACE VIEW user_assignments AS
+    (SELECT DISTINCT instructors.id AS user_id, assignments.id AS assignment_id FROM
+    users AS instructors JOIN assignments AS instructors_assignments ON instructors.id = instructors_assignments.user_id
+    JOIN courses ON instructors_assignments.course_id = courses.id
+    JOIN assignments ON courses.id = assignments.id
+    WHERE instructors_assignments.instructor)
+    UNION
+    (SELECT DISTINCT course_roles.user_id, assignments.id AS assignment_id FROM
+    course_roles JOIN assignments ON course_roles.course_id = assignments.course_id)
+    UNION
+    (SELECT user_id, id as assignment_id FROM assignments);
@@ -0,0 +1,2 @@
+-- Record each user's language from the LMS for choosing localized expected output.
+ALTER TABLE users ADD COLUMN locale text;
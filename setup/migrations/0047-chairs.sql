@@ -0,0 +1,2 @@
+-- Let administrators make users department chairs, who can see site-wide trends.
+ALTER TABLE users ADD COLUMN chair boolean NOT NULL DEFAULT FALSE;
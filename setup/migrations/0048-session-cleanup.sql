@@ -0,0 +1,3 @@
+-- Let daycare workers report the containers they kill to reclaim capacity.
+ALTER TABLE daycare_workers ADD COLUMN abandoned_sessions bigint NOT NULL DEFAULT 0;
+ALTER TABLE daycare_workers ADD COLUMN orphaned_containers bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,13 @@
+-- Keep a changelog entry for each update to a problem that is in use.
+CREATE TABLE problem_changelogs (
+    id                      bigserial NOT NULL,
+    problem_id              bigint NOT NULL,
+    author_id               bigint NOT NULL,
+    entry                   text NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (problem_id) REFERENCES problems_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (author_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX problem_changelogs_problem_id ON problem_changelogs (problem_id, created_at);
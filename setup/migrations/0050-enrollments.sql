@@ -0,0 +1,25 @@
+-- Track course enrollments from LTI launches and roster syncs.
+ALTER TABLE courses ADD COLUMN memberships_url text;
+ALTER TABLE courses ADD COLUMN consumer_key text;
+
+CREATE TABLE enrollments (
+    course_id               bigint NOT NULL,
+    user_id                 bigint NOT NULL,
+    roles                   text NOT NULL,
+    instructor              boolean NOT NULL,
+    section                 text,
+    status                  text NOT NULL,
+    source                  text NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (course_id, user_id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX enrollments_user ON enrollments (user_id);
+
+INSERT INTO enrollments (course_id, user_id, roles, instructor, status, source, created_at, updated_at)
+SELECT course_id, user_id, MAX(roles), BOOL_OR(instructor), 'active', 'launch', MIN(created_at), MAX(updated_at)
+FROM assignments_all WHERE deleted_at IS NULL
+GROUP BY course_id, user_id;
@@ -0,0 +1,15 @@
+-- Keep a history of assignment score changes, including manual overrides.
+CREATE TABLE score_history (
+    id                      bigserial NOT NULL,
+    assignment_id           bigint NOT NULL,
+    score                   double precision NOT NULL,
+    source                  text NOT NULL,
+    comment                 text,
+    changed_by              bigint,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (changed_by) REFERENCES users (id) ON DELETE SET NULL
+);
+CREATE INDEX score_history_assignment ON score_history (assignment_id, created_at);
@@ -0,0 +1,27 @@
+-- Keep exam bundles for offline grading and the receipts uploaded from them.
+CREATE TABLE exam_bundles (
+    id                      bigserial NOT NULL,
+    course_id               bigint NOT NULL,
+    problem_set_id          bigint NOT NULL,
+    created_by              bigint NOT NULL,
+    receipt_key             bytea NOT NULL,
+    expires_at              timestamp with time zone NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (problem_set_id) REFERENCES problem_sets (id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX exam_bundles_course ON exam_bundles (course_id);
+
+CREATE TABLE exam_receipts (
+    signature               text NOT NULL,
+    bundle_id               bigint NOT NULL,
+    commit_id               bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (signature),
+    FOREIGN KEY (bundle_id) REFERENCES exam_bundles (id) ON DELETE CASCADE,
+    FOREIGN KEY (commit_id) REFERENCES commits_all (id) ON DELETE CASCADE
+);
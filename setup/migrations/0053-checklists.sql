@@ -0,0 +1,5 @@
+-- Let authors give a problem a checklist that students confirm on their first graded attempt at each step.
+ALTER TABLE problems_all ADD COLUMN checklist jsonb NOT NULL DEFAULT 'null';
+CREATE OR REPLACE VIEW problems AS SELECT * FROM problems_all WHERE deleted_at IS NULL;
+ALTER TABLE commits_all ADD COLUMN checklist jsonb NOT NULL DEFAULT 'null';
+CREATE OR REPLACE VIEW commits AS SELECT * FROM commits_all WHERE deleted_at IS NULL;
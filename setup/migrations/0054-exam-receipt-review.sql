@@ -0,0 +1,17 @@
+-- Hold uploaded exam receipts until course staff accept or reject them.
+ALTER TABLE exam_receipts ADD COLUMN id bigserial NOT NULL UNIQUE;
+ALTER TABLE exam_receipts ADD COLUMN status text NOT NULL DEFAULT 'accepted';
+ALTER TABLE exam_receipts ALTER COLUMN status DROP DEFAULT;
+ALTER TABLE exam_receipts ADD COLUMN assignment_id bigint REFERENCES assignments_all (id) ON DELETE CASCADE;
+ALTER TABLE exam_receipts ADD COLUMN problem_id bigint REFERENCES problems_all (id) ON DELETE CASCADE;
+ALTER TABLE exam_receipts ADD COLUMN login text NOT NULL DEFAULT '';
+ALTER TABLE exam_receipts ADD COLUMN unique_id text NOT NULL DEFAULT '';
+ALTER TABLE exam_receipts ADD COLUMN step bigint NOT NULL DEFAULT 0;
+ALTER TABLE exam_receipts ADD COLUMN files jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE exam_receipts ADD COLUMN passed boolean NOT NULL DEFAULT false;
+ALTER TABLE exam_receipts ADD COLUMN output text NOT NULL DEFAULT '';
+ALTER TABLE exam_receipts ADD COLUMN graded_at timestamp with time zone;
+ALTER TABLE exam_receipts ADD COLUMN reviewed_by bigint REFERENCES users (id) ON DELETE SET NULL;
+ALTER TABLE exam_receipts ADD COLUMN reviewed_at timestamp with time zone;
+ALTER TABLE exam_receipts ALTER COLUMN commit_id DROP NOT NULL;
+CREATE INDEX exam_receipts_bundle_status ON exam_receipts (bundle_id, status, id);
@@ -0,0 +1,3 @@
+-- Record when each signed commit is sent for grading, and give nonces to commits that are never saved.
+ALTER TABLE commit_nonces ALTER COLUMN commit_id DROP NOT NULL;
+ALTER TABLE commit_nonces ADD COLUMN dispatched_at timestamp with time zone;
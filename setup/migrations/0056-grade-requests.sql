@@ -0,0 +1,13 @@
+-- Count grading requests in the database so rate limits hold across TA servers.
+CREATE TABLE grade_requests (
+    id                      bigserial NOT NULL,
+    user_id                 bigint NOT NULL,
+    assignment_id           bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (assignment_id) REFERENCES assignments_all (id) ON DELETE CASCADE
+);
+CREATE INDEX grade_requests_user_created_at ON grade_requests (user_id, created_at);
+CREATE INDEX grade_requests_created_at ON grade_requests (created_at);
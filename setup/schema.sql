@@ -9,22 +9,43 @@ CREATE TYPE problem_types AS ENUM (
     'nasmgtest',
     'ocamlounit',
     'prologunittest',
-    'standardmlunittest'
+    'standardmlunittest',
+    'sqlite',
+    'postgres',
+    'web',
+    'javaunit',
+    'rusttest',
+    'mipsasm',
+    'armasm',
+    'tutorial'
 );
 
-CREATE TABLE problems (
+-- Problems, assignments, and commits are deleted by setting deleted_at, and
+-- purged for good after 30 days. Each table has a view of the same name that
+-- hides deleted rows, and the rest of the code uses the view. A view does not
+-- pick up new columns, so adding a column to one of these tables means
+-- recreating its view.
+CREATE TABLE problems_all (
     id                      bigserial NOT NULL,
     unique_id               text NOT NULL,
     note                    text NOT NULL,
     problem_type            problem_types NOT NULL,
     tags                    jsonb NOT NULL,
     options                 jsonb NOT NULL,
+    variants                jsonb NOT NULL,
+    checklist               jsonb NOT NULL DEFAULT 'null',
+    author_id               bigint,
     created_at              timestamp with time zone NOT NULL,
     updated_at              timestamp with time zone NOT NULL,
+    deleted_at              timestamp with time zone,
 
     PRIMARY KEY (id)
 );
-CREATE UNIQUE INDEX problems_unique_id ON problems (unique_id);
+CREATE UNIQUE INDEX problems_unique_id ON problems_all (unique_id) WHERE deleted_at IS NULL;
+CREATE INDEX problems_note_search ON problems_all USING gin (to_tsvector('english', note));
+CREATE INDEX problems_tags ON problems_all USING gin (tags jsonb_path_ops);
+CREATE INDEX problems_deleted_at ON problems_all (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE VIEW problems AS SELECT * FROM problems_all WHERE deleted_at IS NULL;
 
 CREATE TABLE problem_steps (
     problem_id              bigint NOT NULL,
@@ -33,9 +54,25 @@ CREATE TABLE problem_steps (
     instructions            text NOT NULL,
     weight                  double precision NOT NULL,
     files                   jsonb NOT NULL,
+    precheck                bytea,
 
     PRIMARY KEY (problem_id, step),
-    FOREIGN KEY (problem_id) REFERENCES problems (id) ON DELETE CASCADE
+    FOREIGN KEY (problem_id) REFERENCES problems_all (id) ON DELETE CASCADE
+);
+CREATE INDEX problem_steps_instructions_search ON problem_steps USING gin (to_tsvector('english', instructions));
+
+CREATE TABLE problem_solutions (
+    problem_id              bigint NOT NULL,
+    step                    bigint NOT NULL,
+    files                   jsonb NOT NULL,
+    passed                  boolean NOT NULL,
+    note                    text,
+    checked_at              timestamp with time zone NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (problem_id, step),
+    FOREIGN KEY (problem_id, step) REFERENCES problem_steps (problem_id, step) ON DELETE CASCADE
 );
 
 CREATE TABLE problem_sets (
@@ -43,6 +80,7 @@ CREATE TABLE problem_sets (
     unique_id               text NOT NULL,
     note                    text NOT NULL,
     tags                    jsonb NOT NULL,
+    instructions            text,
     created_at              timestamp with time zone NOT NULL,
     updated_at              timestamp with time zone NOT NULL,
 
@@ -57,7 +95,7 @@ CREATE TABLE problem_set_problems (
 
     PRIMARY KEY (problem_set_id, problem_id),
     FOREIGN KEY (problem_set_id) REFERENCES problem_sets (id) ON DELETE CASCADE,
-    FOREIGN KEY (problem_id) REFERENCES problems (id) ON DELETE CASCADE
+    FOREIGN KEY (problem_id) REFERENCES problems_all (id) ON DELETE CASCADE
 );
 
 CREATE TABLE courses (
@@ -66,6 +104,13 @@ CREATE TABLE courses (
     lti_label               text NOT NULL,
     lti_id                  text NOT NULL,
     canvas_id               bigint NOT NULL,
+    rate_limit_per_minute   integer,
+    daily_quota             integer,
+    display_name            text,
+    help_email              text,
+    help_text               text,
+    memberships_url         text,
+    consumer_key            text,
     created_at              timestamp with time zone NOT NULL,
     updated_at              timestamp with time zone NOT NULL,
 
@@ -75,6 +120,27 @@ CREATE UNIQUE INDEX courses_lti_label ON courses (lti_label);
 CREATE UNIQUE INDEX courses_lti_id ON courses (lti_id);
 CREATE UNIQUE INDEX courses_canvas_id ON courses (canvas_id);
 
+CREATE TABLE course_feedback_levels (
+    course_id               bigint NOT NULL,
+    problem_set_id          bigint NOT NULL,
+    level                   text NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (course_id, problem_set_id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (problem_set_id) REFERENCES problem_sets (id) ON DELETE CASCADE
+);
+
+CREATE TABLE course_problem_options (
+    course_id               bigint NOT NULL,
+    problem_type            text NOT NULL,
+    options                 json NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (course_id, problem_type),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE
+);
+
 CREATE TABLE users (
     id                      bigserial NOT NULL,
     name                    text NOT NULL,
@@ -85,9 +151,13 @@ CREATE TABLE users (
     canvas_id               bigint NOT NULL,
     author                  boolean NOT NULL,
     admin                   boolean NOT NULL,
+    chair                   boolean NOT NULL DEFAULT FALSE,
     created_at              timestamp with time zone NOT NULL,
     updated_at              timestamp with time zone NOT NULL,
     last_signed_in_at       timestamp with time zone NOT NULL,
+    timezone                text,
+    locale                  text,
+    notifications           jsonb,
 
     PRIMARY KEY (id)
 );
@@ -95,7 +165,38 @@ CREATE UNIQUE INDEX users_lti_id ON users (lti_id);
 CREATE UNIQUE INDEX users_canvas_login ON users (canvas_login);
 CREATE UNIQUE INDEX users_canvas_id ON users (canvas_id);
 
-CREATE TABLE assignments (
+CREATE TABLE course_roles (
+    course_id               bigint NOT NULL,
+    user_id                 bigint NOT NULL,
+    role                    text NOT NULL,
+    granted_by              bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (course_id, user_id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (granted_by) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX course_roles_user ON course_roles (user_id);
+
+CREATE TABLE enrollments (
+    course_id               bigint NOT NULL,
+    user_id                 bigint NOT NULL,
+    roles                   text NOT NULL,
+    instructor              boolean NOT NULL,
+    section                 text,
+    status                  text NOT NULL,
+    source                  text NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (course_id, user_id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX enrollments_user ON enrollments (user_id);
+
+CREATE TABLE assignments_all (
     id                      bigserial NOT NULL,
     course_id               bigint NOT NULL,
     problem_set_id          bigint NOT NULL,
@@ -109,6 +210,8 @@ CREATE TABLE assignments (
     canvas_title            text NOT NULL,
     canvas_id               bigint NOT NULL,
     canvas_api_domain       text NOT NULL,
+    due_at                  timestamp with time zone,
+    lock_at                 timestamp with time zone,
     outcome_url             text NOT NULL,
     outcome_ext_url         text NOT NULL,
     outcome_ext_accepted    text NOT NULL,
@@ -116,34 +219,269 @@ CREATE TABLE assignments (
     consumer_key            text NOT NULL,
     created_at              timestamp with time zone NOT NULL,
     updated_at              timestamp with time zone NOT NULL,
+    deleted_at              timestamp with time zone,
 
     PRIMARY KEY (id),
     FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
     FOREIGN KEY (problem_set_id) REFERENCES problem_sets (id) ON DELETE CASCADE,
     FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
 );
-CREATE UNIQUE INDEX assignments_unique_user ON assignments (user_id, lti_id);
-CREATE UNIQUE INDEX assignments_grade_id ON assignments (grade_id);
+CREATE UNIQUE INDEX assignments_unique_user ON assignments_all (user_id, lti_id) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX assignments_grade_id ON assignments_all (grade_id) WHERE deleted_at IS NULL;
+CREATE INDEX assignments_deleted_at ON assignments_all (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE VIEW assignments AS SELECT * FROM assignments_all WHERE deleted_at IS NULL;
+
+CREATE TABLE files (
+    hash                    text NOT NULL,
+    contents                text NOT NULL,
+    scan_status             text,
+    scan_note               text,
+    scanned_at              timestamp with time zone,
+    created_at              timestamp with time zone NOT NULL,
 
-CREATE TABLE commits (
+    PRIMARY KEY (hash)
+);
+CREATE INDEX files_unscanned ON files (created_at) WHERE scan_status IS NULL;
+
+CREATE TABLE commits_all (
     id                      bigserial NOT NULL,
     assignment_id           bigint NOT NULL,
     problem_id              bigint NOT NULL,
     step                    bigint NOT NULL,
     action                  text,
     note                    text,
+    variant                 text,
     files                   jsonb NOT NULL,
-    transcript              jsonb NOT NULL,
+    sealed                  bytea,
+    quarantined             boolean NOT NULL DEFAULT FALSE,
+    regrade_id              bigint,
+    transcript              bytea NOT NULL,
     report_card             jsonb NOT NULL,
+    metrics                 jsonb NOT NULL DEFAULT 'null',
+    checklist               jsonb NOT NULL DEFAULT 'null',
     score                   double precision,
     created_at              timestamp with time zone NOT NULL,
     updated_at              timestamp with time zone NOT NULL,
+    deleted_at              timestamp with time zone,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (problem_id, step) REFERENCES problem_steps (problem_id, step) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX commits_unique_assignment_problem_step ON commits_all (assignment_id, problem_id, step) WHERE deleted_at IS NULL;
+CREATE INDEX commits_deleted_at ON commits_all (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE VIEW commits AS SELECT * FROM commits_all WHERE deleted_at IS NULL;
+
+CREATE TABLE commit_nonces (
+    nonce                   text NOT NULL,
+    commit_id               bigint,
+    expires_at              timestamp with time zone NOT NULL,
+    used_at                 timestamp with time zone,
+    dispatched_at           timestamp with time zone,
+
+    PRIMARY KEY (nonce),
+    FOREIGN KEY (commit_id) REFERENCES commits_all (id) ON DELETE CASCADE
+);
+CREATE INDEX commit_nonces_expires_at ON commit_nonces (expires_at);
+
+CREATE TABLE checkpoints (
+    id                      bigserial NOT NULL,
+    assignment_id           bigint NOT NULL,
+    problem_id              bigint NOT NULL,
+    step                    bigint NOT NULL,
+    label                   text NOT NULL,
+    files                   jsonb NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
 
     PRIMARY KEY (id),
-    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE,
+    FOREIGN KEY (assignment_id) REFERENCES assignments_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (problem_id, step) REFERENCES problem_steps (problem_id, step) ON DELETE CASCADE
+);
+CREATE INDEX checkpoints_assignment_problem ON checkpoints (assignment_id, problem_id, created_at);
+
+CREATE TABLE test_failures (
+    assignment_id           bigint NOT NULL,
+    problem_id              bigint NOT NULL,
+    step                    bigint NOT NULL,
+    test                    text NOT NULL,
+    failures                integer NOT NULL,
+
+    PRIMARY KEY (assignment_id, problem_id, step, test),
+    FOREIGN KEY (assignment_id) REFERENCES assignments_all (id) ON DELETE CASCADE,
     FOREIGN KEY (problem_id, step) REFERENCES problem_steps (problem_id, step) ON DELETE CASCADE
 );
-CREATE UNIQUE INDEX commits_unique_assignment_problem_step ON commits (assignment_id, problem_id, step);
+
+CREATE TABLE commit_comments (
+    id                      bigserial NOT NULL,
+    commit_id               bigint NOT NULL,
+    author_id               bigint NOT NULL,
+    file                    text NOT NULL,
+    line_start              integer NOT NULL,
+    line_end                integer NOT NULL,
+    excerpt                 text NOT NULL,
+    body                    text NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (commit_id) REFERENCES commits_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (author_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX commit_comments_commit_id ON commit_comments (commit_id, file, line_start);
+
+CREATE TABLE nudges (
+    id                      bigserial NOT NULL,
+    assignment_id           bigint NOT NULL,
+    sent_by                 bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (sent_by) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX nudges_assignment_id ON nudges (assignment_id, created_at);
+
+CREATE TABLE assignment_reopens (
+    id                      bigserial NOT NULL,
+    assignment_id           bigint NOT NULL,
+    reopened_by             bigint NOT NULL,
+    reason                  text NOT NULL,
+    lock_at                 timestamp with time zone NOT NULL,
+    exclude_passback        boolean NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (reopened_by) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX assignment_reopens_assignment_id ON assignment_reopens (assignment_id, created_at);
+
+CREATE TABLE regrades (
+    id                      bigserial NOT NULL,
+    course_id               bigint NOT NULL,
+    problem_set_id          bigint NOT NULL,
+    requested_by            bigint NOT NULL,
+    total                   integer NOT NULL,
+    done                    integer NOT NULL,
+    failed                  integer NOT NULL,
+    changed                 integer NOT NULL,
+    note                    text,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+    finished_at             timestamp with time zone,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (problem_set_id) REFERENCES problem_sets (id) ON DELETE CASCADE,
+    FOREIGN KEY (requested_by) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX regrades_running ON regrades (course_id, problem_set_id) WHERE finished_at IS NULL;
+
+CREATE TABLE job_checkpoints (
+    job                     text NOT NULL,
+    last_key                bigint NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (job)
+);
+
+CREATE TABLE regrade_requests (
+    id                      bigserial NOT NULL,
+    commit_id               bigint NOT NULL,
+    assignment_id           bigint NOT NULL,
+    course_id               bigint NOT NULL,
+    user_id                 bigint NOT NULL,
+    message                 text NOT NULL,
+    status                  text NOT NULL,
+    decision                text,
+    resolved_by             bigint,
+    resolved_at             timestamp with time zone,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (commit_id) REFERENCES commits_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (assignment_id) REFERENCES assignments_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (resolved_by) REFERENCES users (id) ON DELETE SET NULL
+);
+CREATE INDEX regrade_requests_course_status ON regrade_requests (course_id, status, created_at);
+CREATE UNIQUE INDEX regrade_requests_open_commit ON regrade_requests (commit_id) WHERE status = 'open';
+
+CREATE TABLE score_overrides (
+    id                      bigserial NOT NULL,
+    assignment_id           bigint NOT NULL,
+    score                   double precision NOT NULL,
+    comment                 text NOT NULL,
+    overridden_by           bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    UNIQUE (assignment_id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (overridden_by) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE score_history (
+    id                      bigserial NOT NULL,
+    assignment_id           bigint NOT NULL,
+    score                   double precision NOT NULL,
+    source                  text NOT NULL,
+    comment                 text,
+    changed_by              bigint,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (changed_by) REFERENCES users (id) ON DELETE SET NULL
+);
+CREATE INDEX score_history_assignment ON score_history (assignment_id, created_at);
+
+CREATE TABLE api_tokens (
+    id                      bigserial NOT NULL,
+    user_id                 bigint NOT NULL,
+    name                    text NOT NULL,
+    scope                   text NOT NULL,
+    token_hash              text NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    last_used_at            timestamp with time zone,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX api_tokens_token_hash ON api_tokens (token_hash);
+CREATE INDEX api_tokens_user_id ON api_tokens (user_id);
+
+CREATE TABLE notifications (
+    id                      bigserial NOT NULL,
+    user_id                 bigint NOT NULL,
+    kind                    text NOT NULL,
+    channel                 text NOT NULL,
+    subject                 text NOT NULL,
+    body                    text NOT NULL,
+    status                  text NOT NULL,
+    attempts                integer NOT NULL,
+    last_error              text,
+    created_at              timestamp with time zone NOT NULL,
+    sent_at                 timestamp with time zone,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX notifications_pending ON notifications (created_at) WHERE status = 'pending';
+CREATE INDEX notifications_user_id ON notifications (user_id, created_at);
+
+CREATE TABLE profiles (
+    id                      bigserial NOT NULL,
+    kind                    text NOT NULL,
+    host                    text NOT NULL,
+    size                    integer NOT NULL,
+    data                    bytea NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id)
+);
+CREATE INDEX profiles_created_at ON profiles (created_at);
 
 CREATE VIEW user_problem_sets AS
     (SELECT DISTINCT assignments.user_id, problem_sets.id AS problem_set_id FROM
@@ -153,7 +491,10 @@ CREATE VIEW user_problem_sets AS
     users AS instructors JOIN assignments AS instructors_assignments ON instructors.id = instructors_assignments.user_id
     JOIN courses ON instructors_assignments.course_id = courses.id
     JOIN assignments ON courses.id = assignments.id
-    WHERE instructors_assignments.instructor);
+    WHERE instructors_assignments.instructor)
+    UNION
+    (SELECT DISTINCT course_roles.user_id, assignments.problem_set_id FROM
+    course_roles JOIN assignments ON course_roles.course_id = assignments.course_id);
 
 CREATE VIEW user_problems AS
     (SELECT DISTINCT assignments.user_id, problem_set_problems.problem_id FROM
@@ -166,7 +507,11 @@ CREATE VIEW user_problems AS
     JOIN assignments ON courses.id = assignments.id
     JOIN problem_sets ON assignments.problem_set_id = problem_sets.id
     JOIN problem_set_problems ON problem_sets.id = problem_set_problems.problem_id
-    WHERE instructors_assignments.instructor);
+    WHERE instructors_assignments.instructor)
+    UNION
+    (SELECT DISTINCT course_roles.user_id, problem_set_problems.problem_id FROM
+    course_roles JOIN assignments ON course_roles.course_id = assignments.course_id
+    JOIN problem_set_problems ON assignments.problem_set_id = problem_set_problems.problem_set_id);
 
 CREATE VIEW user_users AS
     (SELECT DISTINCT instructors.id AS user_id, users.id AS other_user_id FROM
@@ -176,6 +521,9 @@ CREATE VIEW user_users AS
     JOIN users ON assignments.user_id = users.id
     WHERE instructors_assignments.instructor)
     UNION
+    (SELECT DISTINCT course_roles.user_id, assignments.user_id AS other_user_id FROM
+    course_roles JOIN assignments ON course_roles.course_id = assignments.course_id)
+    UNION
     (SELECT id as user_id, id AS other_user_id FROM users);
 
 CREATE VIEW user_assignments AS
@@ -185,4 +533,215 @@ CREATE VIEW user_assignments AS
     JOIN assignments ON courses.id = assignments.id
     WHERE instructors_assignments.instructor)
     UNION
+    (SELECT DISTINCT course_roles.user_id, assignments.id AS assignment_id FROM
+    course_roles JOIN assignments ON course_roles.course_id = assignments.course_id)
+    UNION
     (SELECT user_id, id as assignment_id FROM assignments);
+
+CREATE TABLE audit_log (
+    id                      bigserial NOT NULL,
+    user_id                 bigint,
+    impersonator_id         bigint,
+    method                  text NOT NULL,
+    path                    text NOT NULL,
+    type                    text NOT NULL,
+    object_id               bigint,
+    summary                 text,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id)
+);
+CREATE INDEX audit_log_created_at ON audit_log (created_at);
+CREATE INDEX audit_log_user_id ON audit_log (user_id, created_at);
+
+CREATE TABLE outbox_events (
+    id                      bigserial NOT NULL,
+    txid                    bigint NOT NULL,
+    kind                    text NOT NULL,
+    course_id               bigint,
+    user_id                 bigint,
+    object_id               bigint NOT NULL,
+    data                    json NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id)
+);
+CREATE INDEX outbox_events_txid ON outbox_events (txid, id);
+
+CREATE TABLE course_webhooks (
+    id                      bigserial NOT NULL,
+    course_id               bigint NOT NULL,
+    url                     text NOT NULL,
+    secret                  text NOT NULL,
+    kinds                   json NOT NULL,
+    active                  boolean NOT NULL,
+    outbox_cursor           text NOT NULL,
+    failures                integer NOT NULL,
+    last_error              text,
+    created_by              bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX course_webhooks_course_id ON course_webhooks (course_id);
+
+CREATE TABLE course_grade_hooks (
+    id                      bigserial NOT NULL,
+    course_id               bigint NOT NULL,
+    url                     text,
+    script                  text,
+    secret                  text NOT NULL,
+    active                  boolean NOT NULL,
+    outbox_cursor           text NOT NULL,
+    failures                integer NOT NULL,
+    last_error              text,
+    created_by              bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX course_grade_hooks_course_id ON course_grade_hooks (course_id);
+
+CREATE TABLE daycare_workers (
+    name                    text NOT NULL,
+    problem_types           json NOT NULL DEFAULT 'null',
+    slots                   bigint NOT NULL,
+    running                 bigint NOT NULL,
+    last_seen_at            timestamp with time zone NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    image_ids               json NOT NULL DEFAULT 'null',
+    tags                    json NOT NULL DEFAULT '[]',
+    abandoned_sessions      bigint NOT NULL DEFAULT 0,
+    orphaned_containers     bigint NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (name)
+);
+
+CREATE TABLE daycare_jobs (
+    id                      bigserial NOT NULL,
+    problem_type            text NOT NULL,
+    action                  text NOT NULL,
+    args                    json NOT NULL DEFAULT 'null',
+    request                 json NOT NULL DEFAULT 'null',
+    status                  text NOT NULL,
+    worker                  text,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+    problem_id              bigint,
+    target_worker           text,
+
+    PRIMARY KEY (id)
+);
+CREATE INDEX daycare_jobs_queued ON daycare_jobs (problem_type, id) WHERE status = 'queued';
+
+CREATE TABLE problem_changelogs (
+    id                      bigserial NOT NULL,
+    problem_id              bigint NOT NULL,
+    author_id               bigint NOT NULL,
+    entry                   text NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (problem_id) REFERENCES problems_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (author_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX problem_changelogs_problem_id ON problem_changelogs (problem_id, created_at);
+
+CREATE TABLE smoke_tests (
+    worker                  text NOT NULL,
+    problem_id              bigint NOT NULL,
+    version                 text NOT NULL,
+    passed                  boolean NOT NULL,
+    note                    text NOT NULL,
+    checked_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (worker, problem_id),
+    FOREIGN KEY (problem_id) REFERENCES problems_all (id) ON DELETE CASCADE
+);
+
+CREATE TABLE grade_requests (
+    id                      bigserial NOT NULL,
+    user_id                 bigint NOT NULL,
+    assignment_id           bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (assignment_id) REFERENCES assignments_all (id) ON DELETE CASCADE
+);
+CREATE INDEX grade_requests_user_created_at ON grade_requests (user_id, created_at);
+CREATE INDEX grade_requests_created_at ON grade_requests (created_at);
+
+CREATE TABLE action_runs (
+    id                      bigserial NOT NULL,
+    course_id               bigint NOT NULL,
+    user_id                 bigint NOT NULL,
+    problem_type            text NOT NULL,
+    action                  text NOT NULL,
+    duration_ms             bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    problem_id              bigint,
+    step                    bigint,
+
+    PRIMARY KEY (id)
+);
+CREATE INDEX action_runs_course_created_at ON action_runs (course_id, created_at);
+CREATE INDEX action_runs_problem_id ON action_runs (problem_id);
+
+CREATE TABLE exam_bundles (
+    id                      bigserial NOT NULL,
+    course_id               bigint NOT NULL,
+    problem_set_id          bigint NOT NULL,
+    created_by              bigint NOT NULL,
+    receipt_key             bytea NOT NULL,
+    expires_at              timestamp with time zone NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (problem_set_id) REFERENCES problem_sets (id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX exam_bundles_course ON exam_bundles (course_id);
+
+CREATE TABLE exam_receipts (
+    signature               text NOT NULL,
+    bundle_id               bigint NOT NULL,
+    commit_id               bigint,
+    created_at              timestamp with time zone NOT NULL,
+    id                      bigserial NOT NULL UNIQUE,
+    status                  text NOT NULL,
+    assignment_id           bigint,
+    problem_id              bigint,
+    login                   text NOT NULL DEFAULT '',
+    unique_id               text NOT NULL DEFAULT '',
+    step                    bigint NOT NULL DEFAULT 0,
+    files                   jsonb NOT NULL DEFAULT '{}',
+    passed                  boolean NOT NULL DEFAULT false,
+    output                  text NOT NULL DEFAULT '',
+    graded_at               timestamp with time zone,
+    reviewed_by             bigint,
+    reviewed_at             timestamp with time zone,
+
+    PRIMARY KEY (signature),
+    FOREIGN KEY (bundle_id) REFERENCES exam_bundles (id) ON DELETE CASCADE,
+    FOREIGN KEY (commit_id) REFERENCES commits_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (assignment_id) REFERENCES assignments_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (problem_id) REFERENCES problems_all (id) ON DELETE CASCADE,
+    FOREIGN KEY (reviewed_by) REFERENCES users (id) ON DELETE SET NULL
+);
+CREATE INDEX exam_receipts_bundle_status ON exam_receipts (bundle_id, status, id);
+
+CREATE TABLE schema_migrations (
+    version                 integer NOT NULL,
+    name                    text NOT NULL,
+    applied_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (version)
+);
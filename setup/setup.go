@@ -0,0 +1,21 @@
+// Package setup holds the database schema and the migrations that bring
+// an existing database up to date with it. Both are built into the server
+// binary, which applies them with codegrinder migrate.
+//
+// A schema change goes in schema.sql, which creates a new database from
+// scratch, and in a new file in migrations/ named <version>-<name>.sql,
+// where version is one more than the latest. Its first line is a comment
+// describing the change.
+package setup
+
+import "embed"
+
+// Schema creates the current schema in an empty database.
+//
+//go:embed schema.sql
+var Schema string
+
+// Migrations holds the versioned migrations in migrations/.
+//
+//go:embed migrations/*.sql
+var Migrations embed.FS
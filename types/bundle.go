@@ -1,11 +1,21 @@
 package types
 
-import "time"
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
 
 type ProblemSetBundle struct {
 	ProblemSet *ProblemSet `json:"problemSets"`
 	ProblemIDs []int64     `json:"problemIDs"`
 	Weights    []float64   `json:"weights"`
+
+	// Files holds the _doc directory for an overview of the problem set.
+	// It is compiled the same way as the instructions for a problem step.
+	Files map[string]string `json:"files,omitempty"`
 }
 
 type ProblemBundle struct {
@@ -14,6 +24,10 @@ type ProblemBundle struct {
 	ProblemSignature string         `json:"problemSignature,omitempty"`
 	Commits          []*Commit      `json:"commits"`
 	CommitSignatures []string       `json:"commitSignatures,omitempty"`
+
+	// Changelog tells students what changed in an update. It is required
+	// when updating a problem that is in use.
+	Changelog string `json:"changelog,omitempty"`
 }
 
 type CommitBundle struct {
@@ -22,6 +36,110 @@ type CommitBundle struct {
 	ProblemSignature string         `json:"problemSignature,omitempty"`
 	Commit           *Commit        `json:"commit"`
 	CommitSignature  string         `json:"commitSignature,omitempty"`
+
+	// UserID and CourseID identify whose work a commit is so a daycare can
+	// share its capacity fairly. The TA fills them in when it signs a
+	// commit, and OwnerSignature covers them.
+	UserID         int64  `json:"userID,omitempty"`
+	CourseID       int64  `json:"courseID,omitempty"`
+	OwnerSignature string `json:"ownerSignature,omitempty"`
+
+	// Checkpoint asks the TA to keep a labeled copy of an unsigned commit,
+	// using the commit's note as the label.
+	Checkpoint bool `json:"checkpoint,omitempty"`
+
+	// Next suggests what to work on after a graded commit passes its step.
+	Next *NextSuggestion `json:"next,omitempty"`
+
+	// Held explains why the TA saved a commit without signing it for
+	// grading, e.g., while its files wait for the malware scanner. A held
+	// bundle carries only the saved commit.
+	Held string `json:"held,omitempty"`
+}
+
+// NextSuggestion tells a student what to do after passing a step: move on
+// to the next step of the problem, start another problem in the set, or
+// nothing if the assignment is complete.
+type NextSuggestion struct {
+	Step      int64  `json:"step,omitempty"`
+	Note      string `json:"note,omitempty"`
+	Summary   string `json:"summary,omitempty"`
+	ProblemID int64  `json:"problemID,omitempty"`
+	Unique    string `json:"unique,omitempty"`
+	Remaining int    `json:"remaining"`
+	Complete  bool   `json:"complete,omitempty"`
+}
+
+// ComputeOwnerSignature signs the owner of the bundle's commit.
+func (bundle *CommitBundle) ComputeOwnerSignature(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "commit=%d&assignment=%d&user=%d&course=%d",
+		bundle.Commit.ID, bundle.Commit.AssignmentID, bundle.UserID, bundle.CourseID)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// GradedTogetherTag marks a problem set whose problems must be graded as a
+// unit, e.g., because they share design constraints.
+const GradedTogetherTag = "graded-together"
+
+// SetCommitBundle carries a commit bundle for every problem in a problem set
+// that is graded together. The commits are graded in one daycare session
+// and saved as a unit. Weights gives the weight of each problem in the set,
+// and Signature ties the signed commits and weights together so a commit
+// graded in one session cannot be mixed into another. ReportCard and Score
+// combine the results once the commits have been graded. Held is set
+// instead of Signature when the set cannot be graded yet.
+type SetCommitBundle struct {
+	Bundles    []*CommitBundle `json:"bundles"`
+	Weights    []float64       `json:"weights"`
+	Signature  string          `json:"signature,omitempty"`
+	ReportCard *ReportCard     `json:"reportCard,omitempty"`
+	Score      float64         `json:"score,omitempty"`
+	Held       string          `json:"held,omitempty"`
+}
+
+// ComputeSignature signs the commit signatures and weights of a set.
+func (set *SetCommitBundle) ComputeSignature(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for i, bundle := range set.Bundles {
+		weight := 0.0
+		if i < len(set.Weights) {
+			weight = set.Weights[i]
+		}
+		fmt.Fprintf(mac, "commit=%s&weight=%v\n", bundle.CommitSignature, weight)
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Combine fills in the combined report card and score of a graded set.
+// Each problem is a part of the report card, weighted as in the problem
+// set, and the set passes only if every problem passes.
+func (set *SetCommitBundle) Combine() {
+	card := NewReportCard()
+	score, weights := 0.0, 0.0
+	for i, bundle := range set.Bundles {
+		commit := bundle.Commit
+		name := fmt.Sprintf("problem %d", commit.ProblemID)
+		if bundle.Problem != nil {
+			name = bundle.Problem.Unique
+		}
+		if commit.ReportCard == nil {
+			card.Failf("%s was not graded", name)
+		} else {
+			if !commit.ReportCard.Passed {
+				card.Failf("%s failed", name)
+			}
+			card.Duration += commit.ReportCard.Duration
+		}
+		card.Parts = append(card.Parts, &ReportCardPart{Name: name, Weight: set.Weights[i], Score: commit.Score})
+		score += commit.Score * set.Weights[i]
+		weights += set.Weights[i]
+	}
+	set.ReportCard = card
+	set.Score = 0.0
+	if weights > 0.0 {
+		set.Score = score / weights
+	}
 }
 
 // MaxDaycareRequestAge is the maximum age of a daycare-signed commit to be saved.
@@ -31,15 +149,98 @@ const MaxDaycareRequestAge = 15 * time.Minute
 // DaycareRequest represents a single request from a client to the daycare.
 // These objects are streamed across a websockets connection.
 type DaycareRequest struct {
-	UserID       int64         `json:"userID,omitempty"`
-	CommitBundle *CommitBundle `json:"commitBundle,omitempty"`
-	Stdin        string        `json:"stdin,omitempty"`
+	UserID          int64            `json:"userID,omitempty"`
+	CommitBundle    *CommitBundle    `json:"commitBundle,omitempty"`
+	SetCommitBundle *SetCommitBundle `json:"setCommitBundle,omitempty"`
+	Stdin           string           `json:"stdin,omitempty"`
 }
 
 // DaycareResponse represents a single response from the daycare back to a client.
 // These objects are streamed across a websockets connection.
 type DaycareResponse struct {
-	CommitBundle *CommitBundle `json:"commitBundle,omitempty"`
-	Event        *EventMessage `json:"event,omitempty"`
-	Error        string        `json:"error,omitempty"`
+	CommitBundle    *CommitBundle    `json:"commitBundle,omitempty"`
+	SetCommitBundle *SetCommitBundle `json:"setCommitBundle,omitempty"`
+	Event           *EventMessage    `json:"event,omitempty"`
+	Error           string           `json:"error,omitempty"`
+}
+
+// DaycareWorker is a daycare that pulls grading jobs from the work queue
+// instead of accepting client connections directly.
+type DaycareWorker struct {
+	Name         string    `json:"name" meddler:"name"`
+	ProblemTypes []string  `json:"problemTypes" meddler:"problem_types,json"`
+	Slots        int64     `json:"slots" meddler:"slots"`
+	Running      int64     `json:"running" meddler:"running"`
+	LastSeenAt   time.Time `json:"lastSeenAt" meddler:"last_seen_at,localtime"`
+	CreatedAt    time.Time `json:"createdAt" meddler:"created_at,localtime"`
+
+	// ImageIDs identifies the images the worker has for each problem type,
+	// so a smoke test can be run when they change.
+	ImageIDs map[string]string `json:"imageIDs,omitempty" meddler:"image_ids,json"`
+
+	// Tags are set by an administrator to describe the node, e.g.,
+	// arch=arm64, gpu, or trusted. A worker is only given jobs for problem
+	// types whose required tags it has.
+	Tags []string `json:"tags" meddler:"tags,json"`
+
+	// AbandonedSessions and OrphanedContainers count the containers the
+	// worker has killed since it started to reclaim capacity: those whose
+	// clients went away, and those left behind by an earlier run.
+	AbandonedSessions  int64 `json:"abandonedSessions" meddler:"abandoned_sessions"`
+	OrphanedContainers int64 `json:"orphanedContainers" meddler:"orphaned_containers"`
+}
+
+// DaycareRoute describes which workers can run a problem type. Error
+// explains why none can.
+type DaycareRoute struct {
+	ProblemType  string   `json:"problemType"`
+	RequiredTags []string `json:"requiredTags"`
+	Workers      []string `json:"workers"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// GradingWait estimates how long a new grading request for a problem type
+// will wait in the work queue. Slots is the number of jobs the live
+// workers for the problem type can run at once; when it is zero, no
+// worker is available and the wait cannot be estimated.
+type GradingWait struct {
+	ProblemType    string  `json:"problemType"`
+	JobsAhead      int64   `json:"jobsAhead"`
+	Running        int64   `json:"running"`
+	Slots          int64   `json:"slots"`
+	AverageSeconds float64 `json:"averageSeconds"`
+	WaitSeconds    float64 `json:"waitSeconds"`
+}
+
+// DaycareJob is a grading request waiting in the work queue or being
+// run by a worker. Jobs are removed once the result is delivered.
+type DaycareJob struct {
+	ID          int64           `json:"id" meddler:"id,pk"`
+	ProblemType string          `json:"problemType" meddler:"problem_type"`
+	Action      string          `json:"action" meddler:"action"`
+	Args        []string        `json:"args" meddler:"args,json"`
+	Request     *DaycareRequest `json:"request" meddler:"request,json"`
+	Status      string          `json:"status" meddler:"status"`
+	Worker      string          `json:"worker,omitempty" meddler:"worker,zeroisnull"`
+	CreatedAt   time.Time       `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt   time.Time       `json:"updatedAt" meddler:"updated_at,localtime"`
+
+	// ProblemID is the problem being graded, used to keep jobs away from
+	// workers that failed a smoke test for it. A job with a TargetWorker
+	// can only be claimed by that worker.
+	ProblemID    int64  `json:"problemID,omitempty" meddler:"problem_id,zeroisnull"`
+	TargetWorker string `json:"targetWorker,omitempty" meddler:"target_worker,zeroisnull"`
+}
+
+// SmokeTest records whether a worker passed the reference solution for a
+// problem. Version identifies the worker's images and the version of the
+// problem that were tested; a new version is tested again. Jobs for the
+// problem are not given to a worker whose latest smoke test failed.
+type SmokeTest struct {
+	Worker    string    `json:"worker" meddler:"worker"`
+	ProblemID int64     `json:"problemID" meddler:"problem_id"`
+	Version   string    `json:"version" meddler:"version"`
+	Passed    bool      `json:"passed" meddler:"passed"`
+	Note      string    `json:"note" meddler:"note"`
+	CheckedAt time.Time `json:"checkedAt" meddler:"checked_at,localtime"`
 }
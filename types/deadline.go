@@ -0,0 +1,63 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// DeadlineFormat is how deadlines are rendered in a user's timezone.
+const DeadlineFormat = "Mon Jan 2, 2006 at 3:04 PM MST"
+
+// DeadlineWarning is how close a deadline must be before grind warns about it.
+const DeadlineWarning = 24 * time.Hour
+
+// Deadline is an assignment due date rendered for display. UTC is in
+// RFC 3339 form, and Local is in the viewer's preferred timezone, which is
+// named by Timezone. If the viewer has no preference, Timezone is empty and
+// Local is in UTC.
+type Deadline struct {
+	UTC      string `json:"utc"`
+	Local    string `json:"local"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// UserTimezone is the request body used to set a user's timezone. An empty
+// timezone clears the preference.
+type UserTimezone struct {
+	Timezone string `json:"timezone"`
+}
+
+// LoadTimezone returns the location for an IANA timezone name such as
+// America/Denver, or UTC if the name is empty.
+func LoadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q: use a name like America/Denver", name)
+	}
+	return loc, nil
+}
+
+// NewDeadline renders a due date for a viewer in the given timezone,
+// falling back to UTC if the timezone is unknown.
+func NewDeadline(dueAt time.Time, timezone string) *Deadline {
+	loc, err := LoadTimezone(timezone)
+	if err != nil {
+		loc, timezone = time.UTC, ""
+	}
+	return &Deadline{
+		UTC:      dueAt.UTC().Format(time.RFC3339),
+		Local:    dueAt.In(loc).Format(DeadlineFormat),
+		Timezone: timezone,
+	}
+}
+
+// Localize fills in the assignment's deadline for a viewer in the given
+// timezone. Assignments without a due date are left alone.
+func (asst *Assignment) Localize(timezone string) {
+	if asst.DueAt != nil {
+		asst.Deadline = NewDeadline(*asst.DueAt, timezone)
+	}
+}
@@ -15,6 +15,92 @@ type ReportCard struct {
 	Note     string              `json:"note"`
 	Duration time.Duration       `json:"duration"`
 	Results  []*ReportCardResult `json:"results"`
+	Usage    *ResourceUsage      `json:"usage,omitempty"`
+
+	// StyleDeduction is the fraction of the step's score taken off for
+	// style problems when the problem asks for style to be graded.
+	StyleDeduction float64 `json:"styleDeduction,omitempty"`
+
+	// Formatted holds the files that were changed by automatic formatting
+	// before grading, as the tests saw them. The commit keeps the files
+	// as the student wrote them.
+	Formatted map[string]string `json:"formatted,omitempty"`
+
+	// HiddenPassed and HiddenFailed count the results of hidden tests,
+	// which are withheld from students until they are revealed. Hidden
+	// holds those results and the full transcript, sealed by the daycare.
+	HiddenPassed int    `json:"hiddenPassed,omitempty"`
+	HiddenFailed int    `json:"hiddenFailed,omitempty"`
+	Hidden       []byte `json:"hidden,omitempty"`
+
+	// Feedback is the feedback level the results were limited to, if the
+	// instructor chose to show students less than everything. At the
+	// counts level every result is withheld and counted as hidden.
+	Feedback string `json:"feedback,omitempty"`
+
+	// Parts are separately weighted components of the grade, such as
+	// style or performance, each with its own report card. When there are
+	// parts, the results of this report card form the tests part with the
+	// given Weight, or 1 if it is zero.
+	Parts  []*ReportCardPart `json:"parts,omitempty"`
+	Weight float64           `json:"weight,omitempty"`
+}
+
+// TestsPart is the name of the part of a score that comes from the results
+// of the main report card.
+const TestsPart = "tests"
+
+// ReportCardPart is one weighted component of a grade. Score is filled in
+// when the score is computed.
+type ReportCardPart struct {
+	Name       string      `json:"name"`
+	Weight     float64     `json:"weight"`
+	Score      float64     `json:"score"`
+	ReportCard *ReportCard `json:"reportCard,omitempty"`
+}
+
+// ResourceUsage measures what a daycare action consumed, alongside the
+// limits set by the problem type. Killed explains why a process was
+// stopped by a limit:
+//   memory: the container reached MemoryLimit
+//   cpu: a process used more than its CPU time limit
+// or is empty if nothing was killed.
+type ResourceUsage struct {
+	CPUTime     time.Duration `json:"cpuTime"`
+	WallTime    time.Duration `json:"wallTime"`
+	MaxMemory   int64         `json:"maxMemory"`
+	MemoryLimit int64         `json:"memoryLimit"`
+	CPULimit    time.Duration `json:"cpuLimit"`
+	OutputBytes int64         `json:"outputBytes"`
+	Killed      string        `json:"killed,omitempty"`
+}
+
+func (u *ResourceUsage) String() string {
+	s := fmt.Sprintf("cpu %v, wall %v, memory %s of %s, output %s",
+		u.CPUTime.Round(time.Millisecond),
+		u.WallTime.Round(time.Millisecond),
+		formatBytes(u.MaxMemory),
+		formatBytes(u.MemoryLimit),
+		formatBytes(u.OutputBytes))
+	switch u.Killed {
+	case "memory":
+		s += "; killed for exceeding the memory limit"
+	case "cpu":
+		s += fmt.Sprintf("; killed for exceeding the CPU time limit of %v", u.CPULimit)
+	}
+	return s
+}
+
+// formatBytes renders a byte count for humans.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
 }
 
 // ReportCardResult Outcomes:
@@ -22,6 +108,7 @@ type ReportCard struct {
 //   failed
 //   error
 //   skipped
+//   warning: a style finding, which does not count toward the score
 // Details: a multi-line message that should
 //   be displayed in a monospace font
 // Context:
@@ -31,6 +118,10 @@ type ReportCardResult struct {
 	Outcome string `json:"outcome"`
 	Details string `json:"details,omitempty"`
 	Context string `json:"context,omitempty"`
+
+	// Hint is the problem author's advice for a test the student keeps
+	// failing. It is added by the server and is not signed.
+	Hint string `json:"hint,omitempty"`
 }
 
 // EventMessage follows one of these forms:
@@ -43,6 +134,9 @@ type ReportCardResult struct {
 //   error Error
 //   reportcard ReportCard
 //   files Files
+//   pull Pull
+//   queue Position
+//   usage Usage
 //   shutdown
 type EventMessage struct {
 	Time        time.Time         `json:"time"`
@@ -53,6 +147,22 @@ type EventMessage struct {
 	Error       string            `json:"error,omitempty"`
 	ReportCard  *ReportCard       `json:"reportcard,omitempty"`
 	Files       map[string]string `json:"files,omitempty"`
+	Pull        *ImagePull        `json:"pull,omitempty"`
+	Position    int               `json:"position,omitempty"`
+	Usage       *ResourceUsage    `json:"usage,omitempty"`
+}
+
+// ImagePull reports progress while a daycare downloads a container image
+// that it does not have yet. Status is one of:
+//   waiting: another request is already downloading the image
+//   pulling: the download is in progress
+//   complete: the image is ready
+type ImagePull struct {
+	Image      string `json:"image"`
+	Status     string `json:"status"`
+	Layers     int    `json:"layers"`
+	LayersDone int    `json:"layersDone"`
+	Percent    int    `json:"percent"`
 }
 
 func (e *EventMessage) String() string {
@@ -78,6 +188,17 @@ func (e *EventMessage) String() string {
 			names = append(names, name)
 		}
 		return fmt.Sprintf("event: files %s", strings.Join(names, ", "))
+	case "pull":
+		return fmt.Sprintf("event: pull %s %s %d/%d layers %d%%",
+			e.Pull.Image,
+			e.Pull.Status,
+			e.Pull.LayersDone,
+			e.Pull.Layers,
+			e.Pull.Percent)
+	case "queue":
+		return fmt.Sprintf("event: queue position %d", e.Position)
+	case "usage":
+		return fmt.Sprintf("event: usage %s", e.Usage)
 	case "shutdown":
 		return fmt.Sprintf("event: shutdown")
 	default:
@@ -137,19 +258,103 @@ func (elt *ReportCard) AddPassedResult(name, details string) *ReportCardResult {
 	return r
 }
 
-func (elt *ReportCard) ComputeScore() float64 {
-	if len(elt.Results) == 0 {
-		return 0.0
+// AddWarningResult records a finding that is reported to the student but
+// does not count toward the score.
+func (elt *ReportCard) AddWarningResult(name, details, context string) *ReportCardResult {
+	r := &ReportCardResult{
+		Name:    name,
+		Outcome: "warning",
+		Details: details,
+		Context: context,
 	}
-	passed := 0
+	elt.Results = append(elt.Results, r)
+	return r
+}
+
+// Counts returns the number of results that passed and the number that
+// count toward the score, leaving out warnings and including hidden tests.
+func (elt *ReportCard) Counts() (passed, total int) {
+	passed, total = elt.HiddenPassed, elt.HiddenPassed+elt.HiddenFailed
 	for _, result := range elt.Results {
-		if result.Outcome == "passed" {
+		switch result.Outcome {
+		case "warning":
+		case "passed":
 			passed++
+			total++
+		default:
+			total++
 		}
 	}
-	score := float64(passed) / float64(len(elt.Results))
+	return passed, total
+}
+
+// AddPart adds a separately weighted part to a report card and returns the
+// report card for the part.
+func (elt *ReportCard) AddPart(name string, weight float64) *ReportCard {
+	card := NewReportCard()
+	elt.Parts = append(elt.Parts, &ReportCardPart{Name: name, Weight: weight, ReportCard: card})
+	return card
+}
+
+// ComputeScore combines the scores of the parts of a report card by weight,
+// or scores its results if it has no parts.
+func (elt *ReportCard) ComputeScore() float64 {
+	if len(elt.Parts) == 0 {
+		return elt.ownScore()
+	}
+	score, weights := 0.0, 0.0
+	for _, part := range elt.Breakdown() {
+		score += part.Score * part.Weight
+		weights += part.Weight
+	}
+	if weights == 0.0 {
+		return 0.0
+	}
+	return score / weights
+}
+
+// Breakdown returns the weighted components of the score: the tests part
+// followed by the other parts, with the score of each filled in.
+func (elt *ReportCard) Breakdown() []*ReportCardPart {
+	weight := elt.Weight
+	if weight == 0.0 {
+		weight = 1.0
+	}
+	parts := []*ReportCardPart{{Name: TestsPart, Weight: weight, Score: elt.partScore()}}
+	for _, part := range elt.Parts {
+		part.Score = part.ReportCard.partScore()
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// partScore scores the report card of a part. Unlike a whole step, a part
+// that passes without any scored results earns full credit.
+func (elt *ReportCard) partScore() float64 {
+	if _, total := elt.Counts(); total == 0 && elt.Passed {
+		return elt.Deduct(1.0)
+	}
+	return elt.ownScore()
+}
+
+// ownScore scores the results of a report card, leaving out its parts.
+func (elt *ReportCard) ownScore() float64 {
+	passed, total := elt.Counts()
+	if total == 0 {
+		return 0.0
+	}
+	score := float64(passed) / float64(total)
 	if !elt.Passed && score >= 1.0 {
-		score = float64(passed) / float64(len(elt.Results)+1)
+		score = float64(passed) / float64(total+1)
+	}
+	return elt.Deduct(score)
+}
+
+// Deduct applies the style deduction to a score.
+func (elt *ReportCard) Deduct(score float64) float64 {
+	score -= elt.StyleDeduction
+	if score < 0.0 {
+		score = 0.0
 	}
 	return score
 }
@@ -0,0 +1,216 @@
+package types
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// An exam bundle lets a problem set be graded in a lab with no network.
+// The instructor downloads the bundle ahead of time and gets a key to go
+// with it. The bundle holds everything needed to grade the problems with
+// a local Docker daemon, encrypted with that key, along with the time it
+// expires. Each grading run produces a receipt signed with a secret from
+// inside the bundle, and the receipts are uploaded once the network is
+// back.
+
+// ExamBundleFile is the contents of a .cgx file.
+type ExamBundleFile struct {
+	ID        int64     `json:"id"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Sealed    []byte    `json:"sealed"`
+}
+
+// ExamBundle is what an exam bundle file holds once it is opened.
+type ExamBundle struct {
+	ID         int64          `json:"id"`
+	CourseID   int64          `json:"courseID"`
+	ProblemSet *ProblemSet    `json:"problemSet"`
+	Problems   []*ExamProblem `json:"problems"`
+	ExpiresAt  time.Time      `json:"expiresAt"`
+	ReceiptKey []byte         `json:"receiptKey"`
+}
+
+// ExamProblem is one problem of an exam bundle, with every file of every
+// step, including hidden tests, and how to run its tests. Hidden lists the
+// files that are not given to students when the problem is unpacked.
+type ExamProblem struct {
+	Problem *Problem       `json:"problem"`
+	Steps   []*ProblemStep `json:"steps"`
+	Hidden  []string       `json:"hidden"`
+	Image   string         `json:"image"`
+	Runner  string         `json:"runner"`
+	Timeout int            `json:"timeout"`
+}
+
+// ExamBundleRequest asks for a new exam bundle that expires at a given time.
+type ExamBundleRequest struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ExamBundleResponse is a new exam bundle and the key that opens it. The
+// key is not kept in the bundle, and is shown only this once.
+type ExamBundleResponse struct {
+	File *ExamBundleFile `json:"file"`
+	Key  string          `json:"key"`
+}
+
+// ExamReceipt records one offline grading run.
+type ExamReceipt struct {
+	BundleID  int64             `json:"bundleID"`
+	Login     string            `json:"login"`
+	Unique    string            `json:"unique"`
+	Step      int64             `json:"step"`
+	Files     map[string]string `json:"files"`
+	Passed    bool              `json:"passed"`
+	Output    string            `json:"output"`
+	GradedAt  time.Time         `json:"gradedAt"`
+	Signature string            `json:"signature"`
+}
+
+// ExamUpload is a batch of receipts from one exam bundle.
+type ExamUpload struct {
+	Receipts []*ExamReceipt `json:"receipts"`
+}
+
+// ExamUploadResult reports what happened to a batch of uploaded receipts.
+// Receipts that check out wait for course staff to review them.
+type ExamUploadResult struct {
+	Pending   int      `json:"pending"`
+	Duplicate int      `json:"duplicate"`
+	Rejected  []string `json:"rejected"`
+}
+
+// Exam receipt review statuses.
+const (
+	ExamReceiptPending  = "pending"
+	ExamReceiptAccepted = "accepted"
+	ExamReceiptRejected = "rejected"
+)
+
+// UploadedExamReceipt is a receipt as the server keeps it. Anyone who can
+// open a bundle can sign a receipt, so an uploaded receipt does not count
+// until course staff accept it. Accepting it saves it as a graded commit.
+type UploadedExamReceipt struct {
+	ID           int64             `json:"id" meddler:"id,pk"`
+	BundleID     int64             `json:"bundleID" meddler:"bundle_id"`
+	AssignmentID int64             `json:"assignmentID,omitempty" meddler:"assignment_id,zeroisnull"`
+	ProblemID    int64             `json:"problemID,omitempty" meddler:"problem_id,zeroisnull"`
+	Login        string            `json:"login" meddler:"login"`
+	Unique       string            `json:"unique" meddler:"unique_id"`
+	Step         int64             `json:"step" meddler:"step"`
+	Files        map[string]string `json:"files,omitempty" meddler:"-"`
+	FileHashes   map[string]string `json:"-" meddler:"files,json"`
+	Passed       bool              `json:"passed" meddler:"passed"`
+	Output       string            `json:"output" meddler:"output"`
+	Signature    string            `json:"-" meddler:"signature"`
+	Status       string            `json:"status" meddler:"status"`
+	CommitID     int64             `json:"commitID,omitempty" meddler:"commit_id,zeroisnull"`
+	ReviewedBy   int64             `json:"reviewedBy,omitempty" meddler:"reviewed_by,zeroisnull"`
+	ReviewedAt   *time.Time        `json:"reviewedAt,omitempty" meddler:"reviewed_at,localtime"`
+	GradedAt     *time.Time        `json:"gradedAt" meddler:"graded_at,localtime"`
+	CreatedAt    time.Time         `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// ExamReceiptReview gives the IDs of the uploaded receipts to accept and
+// to reject.
+type ExamReceiptReview struct {
+	Accept []int64 `json:"accept"`
+	Reject []int64 `json:"reject"`
+}
+
+// ComputeSignature signs a receipt with the receipt key of its bundle.
+func (receipt *ExamReceipt) ComputeSignature(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "bundle:%d\nlogin:%q\nunique:%q\nstep:%d\npassed:%v\ngraded:%s\n",
+		receipt.BundleID, receipt.Login, receipt.Unique, receipt.Step, receipt.Passed, receipt.GradedAt.UTC().Format(time.RFC3339Nano))
+	names := make([]string, 0, len(receipt.Files))
+	for name := range receipt.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sum := sha256.Sum256([]byte(receipt.Files[name]))
+		fmt.Fprintf(mac, "file:%q:%s\n", name, hex.EncodeToString(sum[:]))
+	}
+	sum := sha256.Sum256([]byte(receipt.Output))
+	fmt.Fprintf(mac, "output:%s\n", hex.EncodeToString(sum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewExamKey returns a new random key for an exam bundle, in the printable
+// form given to instructors.
+func NewExamKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// examCipher returns the cipher for an exam key.
+func examCipher(key string) (cipher.AEAD, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("the exam key is not valid")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealExamBundle encrypts an exam bundle with its key. The ID and expiry
+// are bound to the ciphertext, so they cannot be changed in the file.
+func SealExamBundle(key string, bundle *ExamBundle) (*ExamBundleFile, error) {
+	gcm, err := examCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	file := &ExamBundleFile{ID: bundle.ID, ExpiresAt: bundle.ExpiresAt}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	file.Sealed = gcm.Seal(nonce, nonce, plaintext, file.additionalData())
+	return file, nil
+}
+
+// Open decrypts an exam bundle file with its key.
+func (file *ExamBundleFile) Open(key string) (*ExamBundle, error) {
+	gcm, err := examCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("the exam bundle is truncated")
+	}
+	plaintext, err := gcm.Open(nil, file.Sealed[:gcm.NonceSize()], file.Sealed[gcm.NonceSize():], file.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("the exam key does not match this bundle, or the bundle has been changed")
+	}
+	bundle := new(ExamBundle)
+	if err := json.Unmarshal(plaintext, bundle); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+func (file *ExamBundleFile) additionalData() []byte {
+	return []byte("codegrinder exam bundle " + strconv.FormatInt(file.ID, 10) + " " + file.ExpiresAt.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,404 @@
+package types
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ExpectedOutputDirective starts a line in an expected output file that
+// controls how the following lines are compared instead of being compared
+// itself. The directives are:
+//
+//	@@ regex <pattern>   the next output line must match the pattern
+//	@@ epsilon <value>   numbers in later lines may differ by up to value
+//	@@ epsilon off       numbers must match exactly again
+//	@@ unordered         the lines up to the next "@@ end" may appear in any order
+//	@@ end               closes an unordered block
+//
+// A line that should literally start with "@@" is written with one extra
+// "@" in front, so "@@@@ total" expects the output line "@@@ total".
+const ExpectedOutputDirective = "@@"
+
+// ExpectedOutput is a parsed expected output file.
+type ExpectedOutput struct {
+	items []*expectedItem
+}
+
+// expectedItem is a single expected line, or an unordered block of lines
+// when block is not nil.
+type expectedItem struct {
+	line    int
+	text    string
+	pattern *regexp.Regexp
+	epsilon float64
+	block   []*expectedItem
+}
+
+// ParseExpectedOutput parses an expected output file, reporting any
+// malformed directive.
+func ParseExpectedOutput(contents string) (*ExpectedOutput, error) {
+	expected := new(ExpectedOutput)
+	epsilon := 0.0
+	var block *expectedItem
+	var pattern *regexp.Regexp
+	patternLine := 0
+
+	for i, text := range splitOutputLines(contents) {
+		n := i + 1
+		if !strings.HasPrefix(text, ExpectedOutputDirective) || strings.HasPrefix(text, ExpectedOutputDirective+"@") {
+			if strings.HasPrefix(text, ExpectedOutputDirective) {
+				text = text[1:]
+			}
+			item := &expectedItem{line: n, text: text, pattern: pattern, epsilon: epsilon}
+			pattern = nil
+			if block != nil {
+				block.block = append(block.block, item)
+			} else {
+				expected.items = append(expected.items, item)
+			}
+			continue
+		}
+
+		if pattern != nil {
+			return nil, fmt.Errorf("line %d: directive follows the regex directive on line %d", n, patternLine)
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(text, ExpectedOutputDirective))
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %d: missing directive name", n)
+		}
+		switch fields[0] {
+		case "regex":
+			src := strings.TrimSpace(strings.TrimPrefix(rest, "regex"))
+			if src == "" {
+				return nil, fmt.Errorf("line %d: regex directive needs a pattern", n)
+			}
+			re, err := regexp.Compile(`^(?:` + src + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad regex: %v", n, err)
+			}
+			pattern, patternLine = re, n
+
+		case "epsilon":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: epsilon directive needs a single value", n)
+			}
+			if fields[1] == "off" {
+				epsilon = 0.0
+				break
+			}
+			value, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil || value < 0.0 || math.IsNaN(value) || math.IsInf(value, 0) {
+				return nil, fmt.Errorf("line %d: epsilon must be a non-negative number or off, found %q", n, fields[1])
+			}
+			epsilon = value
+
+		case "unordered":
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("line %d: unordered directive takes no arguments", n)
+			}
+			if block != nil {
+				return nil, fmt.Errorf("line %d: unordered blocks cannot be nested (block started on line %d)", n, block.line)
+			}
+			block = &expectedItem{line: n}
+
+		case "end":
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("line %d: end directive takes no arguments", n)
+			}
+			if block == nil {
+				return nil, fmt.Errorf("line %d: end directive without a matching unordered directive", n)
+			}
+			expected.items = append(expected.items, block)
+			block = nil
+
+		default:
+			return nil, fmt.Errorf("line %d: unknown directive %q", n, fields[0])
+		}
+	}
+
+	if pattern != nil {
+		return nil, fmt.Errorf("line %d: regex directive is not followed by an output line", patternLine)
+	}
+	if block != nil {
+		return nil, fmt.Errorf("line %d: unordered block is never closed with an end directive", block.line)
+	}
+	return expected, nil
+}
+
+// Match compares actual output against the expected output. Trailing
+// whitespace on each line and trailing blank lines are ignored. If the
+// output does not match, the returned message describes the first
+// difference.
+func (expected *ExpectedOutput) Match(output string) (bool, string) {
+	actual := splitOutputLines(output)
+	pos := 0
+	for _, item := range expected.items {
+		if item.block == nil {
+			if pos >= len(actual) {
+				return false, fmt.Sprintf("output ended early: expected %s", item.describe())
+			}
+			if !item.matches(actual[pos]) {
+				return false, fmt.Sprintf("output line %d: expected %s, found %q", pos+1, item.describe(), actual[pos])
+			}
+			pos++
+			continue
+		}
+
+		size := len(item.block)
+		if pos+size > len(actual) {
+			return false, fmt.Sprintf("output ended early: expected %d more line%s in any order", size, pluralS(size))
+		}
+		if line := matchUnordered(item.block, actual[pos:pos+size]); line >= 0 {
+			return false, fmt.Sprintf("output line %d: %q does not match any expected line in the unordered block starting on line %d", pos+line+1, actual[pos+line], item.line)
+		}
+		pos += size
+	}
+	if pos < len(actual) {
+		return false, fmt.Sprintf("output line %d: unexpected extra output %q", pos+1, actual[pos])
+	}
+	return true, ""
+}
+
+func (item *expectedItem) describe() string {
+	if item.pattern != nil {
+		return fmt.Sprintf("a line matching /%s/", strings.TrimSuffix(strings.TrimPrefix(item.pattern.String(), `^(?:`), `)$`))
+	}
+	if item.epsilon > 0.0 {
+		return fmt.Sprintf("%q (numbers within %g)", item.text, item.epsilon)
+	}
+	return fmt.Sprintf("%q", item.text)
+}
+
+func (item *expectedItem) matches(line string) bool {
+	if item.pattern != nil {
+		return item.pattern.MatchString(line)
+	}
+	if line == item.text {
+		return true
+	}
+	if item.epsilon == 0.0 {
+		return false
+	}
+
+	// compare word by word, allowing numbers to differ by epsilon
+	want, got := strings.Fields(item.text), strings.Fields(line)
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if want[i] == got[i] {
+			continue
+		}
+		a, errA := strconv.ParseFloat(want[i], 64)
+		b, errB := strconv.ParseFloat(got[i], 64)
+		if errA != nil || errB != nil || math.Abs(a-b) > item.epsilon {
+			return false
+		}
+	}
+	return true
+}
+
+// matchUnordered pairs each actual line with a distinct expected line.
+// It returns -1 if every line is paired, or the index of the first
+// actual line that could not be.
+func matchUnordered(items []*expectedItem, lines []string) int {
+	owner := make([]int, len(items))
+	for i := range owner {
+		owner[i] = -1
+	}
+	var assign func(line int, seen []bool) bool
+	assign = func(line int, seen []bool) bool {
+		for i, item := range items {
+			if seen[i] || !item.matches(lines[line]) {
+				continue
+			}
+			seen[i] = true
+			if owner[i] < 0 || assign(owner[i], seen) {
+				owner[i] = line
+				return true
+			}
+		}
+		return false
+	}
+	for line := range lines {
+		if !assign(line, make([]bool, len(items))) {
+			return line
+		}
+	}
+	return -1
+}
+
+// splitOutputLines breaks output into lines, ignoring trailing whitespace
+// on each line and any trailing blank lines.
+func splitOutputLines(s string) []string {
+	lines := strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func pluralS(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+// Expected output can be localized for courses taught in more than one
+// language. Alongside the default out/<name> for each input in/<name>, a
+// problem step can give a complete set of expected outputs for a language
+// in out/<language>/<name>, e.g., out/es/01.txt. The TA sets LocaleOption
+// from the student's language when it signs the problem, and graders then
+// use that language's set if the step has one.
+
+// LocaleOption is the problem option that carries the student's language.
+const LocaleOption = "locale="
+
+var outputLanguage = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// LocaleLanguage reduces a locale such as es_MX.UTF-8 or es-MX to its
+// lowercase language code, returning "" if it has none.
+func LocaleLanguage(locale string) string {
+	if i := strings.IndexAny(locale, "_.@-"); i >= 0 {
+		locale = locale[:i]
+	}
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	if !outputLanguage.MatchString(locale) {
+		return ""
+	}
+	return locale
+}
+
+// OutputLocale returns the language set by LocaleOption, or "" if none.
+func OutputLocale(options []string) string {
+	locale := ""
+	for _, option := range options {
+		if strings.HasPrefix(option, LocaleOption) {
+			locale = strings.TrimPrefix(option, LocaleOption)
+		}
+	}
+	return locale
+}
+
+// ExpectedOutputFile returns the name of the expected output file for the
+// input in/<name>: out/<locale>/<name> if the files include one, or the
+// default out/<name> otherwise.
+func ExpectedOutputFile(files map[string]string, name, locale string) string {
+	if locale != "" {
+		localized := "out/" + locale + "/" + name
+		if _, exists := files[localized]; exists {
+			return localized
+		}
+	}
+	return "out/" + name
+}
+
+// OutputLocales returns the languages that have localized expected output
+// in a set of step files, sorted.
+func OutputLocales(files map[string]string) []string {
+	seen := make(map[string]bool)
+	var locales []string
+	for name := range files {
+		parts := strings.Split(name, "/")
+		if len(parts) > 2 && parts[0] == VariantDirectory {
+			parts = parts[2:]
+		}
+		if len(parts) == 3 && parts[0] == "out" && !seen[parts[1]] {
+			seen[parts[1]] = true
+			locales = append(locales, parts[1])
+		}
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// CheckLocalizedOutputs makes sure that each language with localized
+// expected output in a step covers exactly the inputs in in/. Files in a
+// variant directory are checked against the variant's inputs, or against
+// the step's inputs if the variant has none of its own.
+func CheckLocalizedOutputs(files map[string]string) error {
+	inputs := make(map[string]map[string]bool)
+	outputs := make(map[string]map[string]map[string]bool)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts := strings.Split(name, "/")
+		prefix := ""
+		if len(parts) > 2 && parts[0] == VariantDirectory {
+			prefix = parts[0] + "/" + parts[1] + "/"
+			parts = parts[2:]
+		}
+		switch {
+		case len(parts) == 2 && parts[0] == "in":
+			if inputs[prefix] == nil {
+				inputs[prefix] = make(map[string]bool)
+			}
+			inputs[prefix][parts[1]] = true
+		case len(parts) == 3 && parts[0] == "out":
+			if !outputLanguage.MatchString(parts[1]) {
+				return fmt.Errorf("%s: localized output must be in a directory named for a lowercase language code such as es", name)
+			}
+			if outputs[prefix] == nil {
+				outputs[prefix] = make(map[string]map[string]bool)
+			}
+			if outputs[prefix][parts[1]] == nil {
+				outputs[prefix][parts[1]] = make(map[string]bool)
+			}
+			outputs[prefix][parts[1]][parts[2]] = true
+		}
+	}
+
+	var prefixes []string
+	for prefix := range outputs {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		want := inputs[prefix]
+		if len(want) == 0 {
+			want = inputs[""]
+		}
+		var locales []string
+		for locale := range outputs[prefix] {
+			locales = append(locales, locale)
+		}
+		sort.Strings(locales)
+		for _, locale := range locales {
+			have := outputs[prefix][locale]
+			var missing, extra []string
+			for name := range want {
+				if !have[name] {
+					missing = append(missing, name)
+				}
+			}
+			for name := range have {
+				if !want[name] {
+					extra = append(extra, name)
+				}
+			}
+			sort.Strings(missing)
+			sort.Strings(extra)
+			if len(missing) > 0 {
+				return fmt.Errorf("%sout/%s/ is missing expected output for input%s %s",
+					prefix, locale, pluralS(len(missing)), strings.Join(missing, ", "))
+			}
+			if len(extra) > 0 {
+				return fmt.Errorf("%sout/%s/ has expected output with no matching input: %s",
+					prefix, locale, strings.Join(extra, ", "))
+			}
+		}
+	}
+	return nil
+}
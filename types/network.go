@@ -0,0 +1,111 @@
+package types
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Network policies for grader containers, from most to least restrictive:
+//
+//	none: no network at all, not even loopback
+//	localhost: loopback and the problem type's sidecar services only
+//	allowlist: as localhost, plus the host:port pairs in Allow
+//
+// A problem type with no policy gets localhost.
+const (
+	NetworkNone      = "none"
+	NetworkLocalhost = "localhost"
+	NetworkAllowlist = "allowlist"
+)
+
+// NetworkOption is the prefix of a problem option that narrows the problem
+// type's network policy for one problem, e.g.:
+//
+//	network=none
+//	network=allowlist api.example.com:443
+//
+// A problem may only narrow the policy: it cannot choose a less restrictive
+// mode, and every host:port it allows must also be allowed by the type.
+const NetworkOption = "network="
+
+// NetworkPolicy controls what a grader container may connect to.
+type NetworkPolicy struct {
+	Mode  string   `json:"mode"`
+	Allow []string `json:"allow,omitempty"`
+}
+
+var networkModeRank = map[string]int{
+	NetworkNone:      0,
+	NetworkLocalhost: 1,
+	NetworkAllowlist: 2,
+}
+
+// Validate checks the mode and the format of each allowlist entry.
+func (policy *NetworkPolicy) Validate() error {
+	if _, ok := networkModeRank[policy.Mode]; !ok {
+		return fmt.Errorf("unknown network mode %q: must be %s, %s, or %s", policy.Mode, NetworkNone, NetworkLocalhost, NetworkAllowlist)
+	}
+	if policy.Mode != NetworkAllowlist && len(policy.Allow) > 0 {
+		return fmt.Errorf("network mode %s cannot have an allowlist", policy.Mode)
+	}
+	for _, entry := range policy.Allow {
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil || host == "" {
+			return fmt.Errorf("network allowlist entry %q must be host:port", entry)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("network allowlist entry %q has an invalid port", entry)
+		}
+	}
+	return nil
+}
+
+// NetworkPolicyFor returns the network policy for a problem of this type,
+// narrowed by a network= option if the problem has one.
+func (problemType *ProblemType) NetworkPolicyFor(options []string) (*NetworkPolicy, error) {
+	base := &NetworkPolicy{Mode: NetworkLocalhost}
+	if problemType.Network != nil {
+		base = problemType.Network
+	}
+	if err := base.Validate(); err != nil {
+		return nil, fmt.Errorf("problem type %s: %v", problemType.Name, err)
+	}
+
+	var policy *NetworkPolicy
+	for _, option := range options {
+		if !strings.HasPrefix(option, NetworkOption) {
+			continue
+		}
+		if policy != nil {
+			return nil, fmt.Errorf("only one %s option is allowed", NetworkOption)
+		}
+		fields := strings.Fields(strings.TrimPrefix(option, NetworkOption))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("option %q must name a network mode", option)
+		}
+		policy = &NetworkPolicy{Mode: fields[0], Allow: fields[1:]}
+		if err := policy.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if policy == nil {
+		return base, nil
+	}
+
+	// make sure the problem only narrows the type's policy
+	if networkModeRank[policy.Mode] > networkModeRank[base.Mode] {
+		return nil, fmt.Errorf("problem type %s only permits network mode %s, not %s", problemType.Name, base.Mode, policy.Mode)
+	}
+	allowed := make(map[string]bool)
+	for _, entry := range base.Allow {
+		allowed[entry] = true
+	}
+	for _, entry := range policy.Allow {
+		if !allowed[entry] {
+			return nil, fmt.Errorf("problem type %s does not allow network access to %s", problemType.Name, entry)
+		}
+	}
+	return policy, nil
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"log"
 	"net/url"
@@ -23,16 +24,36 @@ var BeginningOfTime = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
 
 // ProblemType defines one type of problem.
 type ProblemType struct {
-	Name        string                        `json:"name"`
-	Image       string                        `json:"image"`
-	MaxCPU      int                           `json:"maxCPU"`
-	MaxClock    int                           `json:"maxClock"`
-	MaxFD       int                           `json:"maxFD"`
-	MaxFileSize int                           `json:"maxFileSize"`
-	MaxMemory   int                           `json:"maxMemory"`
-	MaxThreads  int                           `json:"maxThreads"`
-	Actions     map[string]*ProblemTypeAction `json:"actions"`
-	Files       map[string]string             `json:"files,omitempty"`
+	Name               string                        `json:"name"`
+	Image              string                        `json:"image"`
+	MaxCPU             int                           `json:"maxCPU"`
+	MaxClock           int                           `json:"maxClock"`
+	MaxFD              int                           `json:"maxFD"`
+	MaxFileSize        int                           `json:"maxFileSize"`
+	MaxMemory          int                           `json:"maxMemory"`
+	MaxThreads         int                           `json:"maxThreads"`
+	RateLimitPerMinute int                           `json:"rateLimitPerMinute,omitempty"`
+	DailyQuota         int                           `json:"dailyQuota,omitempty"`
+	Actions            map[string]*ProblemTypeAction `json:"actions"`
+	Files              map[string]string             `json:"files,omitempty"`
+	Services           []*ProblemTypeService         `json:"services,omitempty"`
+	Network            *NetworkPolicy                `json:"network,omitempty"`
+
+	// RequiredTags are daycare node tags a worker must have to be given
+	// jobs for this problem type when grading uses the work queue.
+	RequiredTags []string `json:"requiredTags,omitempty"`
+}
+
+// ProblemTypeService describes a sidecar container, such as a database or
+// message broker, that is started alongside the grader for every action.
+// The grader can reach it on a private network using Name as the hostname.
+type ProblemTypeService struct {
+	Name          string   `json:"name"`
+	Image         string   `json:"image"`
+	Ports         []int    `json:"ports,omitempty"`
+	Env           []string `json:"env,omitempty"`
+	HealthCheck   []string `json:"healthCheck,omitempty"`
+	HealthTimeout int      `json:"healthTimeout,omitempty"`
 }
 
 // ProblemTypeAction defines the label, button, UI classes, and handler for a
@@ -46,14 +67,55 @@ type ProblemTypeAction struct {
 }
 
 type Problem struct {
+	ID          int64              `json:"id" meddler:"id,pk"`
+	Unique      string             `json:"unique" meddler:"unique_id"`
+	Note        string             `json:"note" meddler:"note"`
+	ProblemType string             `json:"problemType" meddler:"problem_type"`
+	Tags        []string           `json:"tags" meddler:"tags,json"`
+	Options     []string           `json:"options" meddler:"options,json"`
+	Variants    map[string]float64 `json:"variants,omitempty" meddler:"variants,json"`
+	Checklist   []string           `json:"checklist,omitempty" meddler:"checklist,json"`
+	AuthorID    int64              `json:"authorID,omitempty" meddler:"author_id,zeroisnull"`
+	CreatedAt   time.Time          `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt   time.Time          `json:"updatedAt" meddler:"updated_at,localtime"`
+	DeletedAt   *time.Time         `json:"deletedAt,omitempty" meddler:"deleted_at,localtime"`
+}
+
+// A problem can have a checklist of short statements, such as "I ran the
+// style checker", that a student must confirm before the first graded
+// attempt at each step. The confirmed items are kept with the commit.
+const (
+	MaxChecklistItems      = 10
+	MaxChecklistItemLength = 200
+)
+
+// ChecklistConfirmed reports whether a list of confirmed items covers
+// every item on the problem's checklist.
+func (problem *Problem) ChecklistConfirmed(confirmed []string) bool {
+	have := make(map[string]bool)
+	for _, item := range confirmed {
+		have[item] = true
+	}
+	for _, item := range problem.Checklist {
+		if !have[item] {
+			return false
+		}
+	}
+	return true
+}
+
+// ProblemChangelog is the author's note on what changed when a problem
+// was updated. One is required for each update while students are working
+// on the problem, and it is kept as the record of that version. The
+// problem's unique ID and note are filled in for listings.
+type ProblemChangelog struct {
 	ID          int64     `json:"id" meddler:"id,pk"`
-	Unique      string    `json:"unique" meddler:"unique_id"`
-	Note        string    `json:"note" meddler:"note"`
-	ProblemType string    `json:"problemType" meddler:"problem_type"`
-	Tags        []string  `json:"tags" meddler:"tags,json"`
-	Options     []string  `json:"options" meddler:"options,json"`
+	ProblemID   int64     `json:"problemID" meddler:"problem_id"`
+	AuthorID    int64     `json:"authorID" meddler:"author_id"`
+	Entry       string    `json:"entry" meddler:"entry"`
 	CreatedAt   time.Time `json:"createdAt" meddler:"created_at,localtime"`
-	UpdatedAt   time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+	Unique      string    `json:"unique,omitempty" meddler:"-"`
+	ProblemNote string    `json:"problemNote,omitempty" meddler:"-"`
 }
 
 // ProblemStep represents a single step of a problem.
@@ -67,6 +129,29 @@ type ProblemStep struct {
 	Instructions string            `json:"instructions" meddler:"instructions"`
 	Weight       float64           `json:"weight" meddler:"weight"`
 	Files        map[string]string `json:"files" meddler:"files,json"`
+
+	// Precheck is an optional WebAssembly module that clients can run for a
+	// quick sanity check before submitting. It is advisory only, so it is
+	// not part of the problem signature and is served separately.
+	Precheck []byte `json:"precheck,omitempty" meddler:"precheck"`
+
+	// HiddenFiles holds the hidden test files of the step, sealed so only
+	// a daycare can read them. It is only set in commit bundles.
+	HiddenFiles []byte `json:"hiddenFiles,omitempty" meddler:"-"`
+}
+
+// ProblemSolution is the author's reference solution for one problem step.
+// It is kept so solutions can be re-run when a problem type changes,
+// and is never shown to students.
+type ProblemSolution struct {
+	ProblemID int64             `json:"problemID" meddler:"problem_id"`
+	Step      int64             `json:"step" meddler:"step"`
+	Files     map[string]string `json:"files" meddler:"files,json"`
+	Passed    bool              `json:"passed" meddler:"passed"`
+	Note      string            `json:"note" meddler:"note,zeroisnull"`
+	CheckedAt time.Time         `json:"checkedAt" meddler:"checked_at,localtime"`
+	CreatedAt time.Time         `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt time.Time         `json:"updatedAt" meddler:"updated_at,localtime"`
 }
 
 type ProblemSet struct {
@@ -76,6 +161,17 @@ type ProblemSet struct {
 	Tags      []string  `json:"tags" meddler:"tags,json"`
 	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
 	UpdatedAt time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+
+	// Instructions is the compiled overview of the whole problem set.
+	// It can be large, so it is served separately from the problem set.
+	Instructions string `json:"-" meddler:"instructions,zeroisnull"`
+}
+
+// ProblemSearchResult is a problem found by a search, with its relevance
+// to the query. Rank is zero when no text query was given.
+type ProblemSearchResult struct {
+	Problem *Problem `json:"problem"`
+	Rank    float64  `json:"rank"`
 }
 
 type ProblemSetProblem struct {
@@ -117,12 +213,54 @@ func (problem *Problem) Normalize(now time.Time, steps []*ProblemStep) error {
 		problem.Options[i] = strings.TrimSpace(option)
 	}
 
+	// check the checklist
+	var checklist []string
+	for _, item := range problem.Checklist {
+		if item = strings.TrimSpace(item); item != "" {
+			checklist = append(checklist, item)
+		}
+	}
+	problem.Checklist = checklist
+	if len(problem.Checklist) > MaxChecklistItems {
+		return fmt.Errorf("the checklist can have at most %d items", MaxChecklistItems)
+	}
+	for _, item := range problem.Checklist {
+		if utf8.RuneCountInString(item) > MaxChecklistItemLength {
+			return fmt.Errorf("checklist item %q is longer than %d characters", item, MaxChecklistItemLength)
+		}
+	}
+
+	// check variants
+	for name, weight := range problem.Variants {
+		if name == "" || url.QueryEscape(name) != name || strings.Contains(name, ".") {
+			return fmt.Errorf("variant name %q must be URL friendly", name)
+		}
+		if weight <= 0.0 {
+			return fmt.Errorf("variant %q must have a positive weight", name)
+		}
+	}
+
 	// check steps
 	if len(steps) == 0 {
 		return fmt.Errorf("problem must have at least one step")
 	}
 	for n, step := range steps {
 		step.Normalize(int64(n) + 1)
+		for name := range step.Files {
+			parts := strings.Split(name, "/")
+			if parts[0] != VariantDirectory {
+				continue
+			}
+			if len(parts) < 3 {
+				return fmt.Errorf("step %d: file %s must be inside a variant directory", n+1, name)
+			}
+			if _, exists := problem.Variants[parts[1]]; !exists {
+				return fmt.Errorf("step %d: file %s is for undeclared variant %q", n+1, name, parts[1])
+			}
+		}
+		if err := CheckLocalizedOutputs(step.Files); err != nil {
+			return fmt.Errorf("step %d: %v", n+1, err)
+		}
 	}
 
 	// sanity check timestamps
@@ -146,6 +284,10 @@ func (problem *Problem) ComputeSignature(secret string, steps []*ProblemStep) st
 	v.Add("problemType", problem.ProblemType)
 	v["tags"] = problem.Tags
 	v["options"] = problem.Options
+	v["checklist"] = problem.Checklist
+	for name, weight := range problem.Variants {
+		v.Add("variant-"+name, strconv.FormatFloat(weight, 'g', -1, 64))
+	}
 	v.Add("createdAt", problem.CreatedAt.Round(time.Second).UTC().Format(time.RFC3339))
 	v.Add("updatedAt", problem.UpdatedAt.Round(time.Second).UTC().Format(time.RFC3339))
 	for _, step := range steps {
@@ -154,6 +296,9 @@ func (problem *Problem) ComputeSignature(secret string, steps []*ProblemStep) st
 		for name, contents := range step.Files {
 			v.Add(fmt.Sprintf("step-%d-file-%s", step.Step, name), contents)
 		}
+		if len(step.HiddenFiles) > 0 {
+			v.Add(fmt.Sprintf("step-%d-hidden", step.Step), base64.StdEncoding.EncodeToString(step.HiddenFiles))
+		}
 	}
 
 	// compute signature
@@ -191,6 +336,15 @@ func (step *ProblemStep) Normalize(n int64) error {
 	clean := make(map[string]string)
 	for name, contents := range step.Files {
 		parts := strings.Split(name, "/")
+		if len(parts) > 2 && parts[0] == VariantDirectory {
+			// judge variant files by their path within the variant
+			parts = parts[2:]
+		}
+		if (len(parts) == 2 || len(parts) == 3) && parts[0] == "out" {
+			if _, err := ParseExpectedOutput(contents); err != nil {
+				return fmt.Errorf("step %d: %s: %v", n+1, name, err)
+			}
+		}
 		fixed := contents
 		if (len(parts) < 2 || !ProblemStepDirectoryWhitelist[parts[0]]) && utf8.ValidString(contents) {
 			fixed = fixLineEndings(contents)
@@ -223,9 +377,13 @@ func (problem *Problem) GetStepWhitelists(steps []*ProblemStep) []map[string]boo
 		}
 
 		// add files defined in the root directory of the problem step
+		// or in the root directory of one of its variants
 		for name := range step.Files {
-			if len(strings.Split(name, "/")) == 1 {
+			parts := strings.Split(name, "/")
+			if len(parts) == 1 {
 				m[name] = true
+			} else if len(parts) == 3 && parts[0] == VariantDirectory {
+				m[parts[2]] = true
 			}
 		}
 		lists = append(lists, m)
@@ -234,22 +392,82 @@ func (problem *Problem) GetStepWhitelists(steps []*ProblemStep) []map[string]boo
 	return lists
 }
 
+// VariantDirectory is the step directory holding per-variant files.
+// A file at _variant/<name>/<path> replaces <path> for users assigned
+// that variant.
+const VariantDirectory = "_variant"
+
+// ChooseVariant deterministically picks a starter variant for a user,
+// with each variant chosen in proportion to its weight.
+// It returns "" if the problem has no variants.
+func (problem *Problem) ChooseVariant(userID int64) string {
+	if len(problem.Variants) == 0 {
+		return ""
+	}
+	var names []string
+	total := 0.0
+	for name, weight := range problem.Variants {
+		names = append(names, name)
+		total += weight
+	}
+	sort.Strings(names)
+
+	// hash the user and problem to a number in [0,total)
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", problem.Unique, userID)))
+	x := float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53) * total
+	for _, name := range names {
+		x -= problem.Variants[name]
+		if x < 0.0 {
+			return name
+		}
+	}
+	return names[len(names)-1]
+}
+
+// VariantFiles returns the files of this step as seen by a user assigned
+// the given variant. Files for the variant replace the matching step files,
+// and files for other variants are left out.
+func (step *ProblemStep) VariantFiles(variant string) map[string]string {
+	files := make(map[string]string)
+	for name, contents := range step.Files {
+		if !strings.HasPrefix(name, VariantDirectory+"/") {
+			files[name] = contents
+		}
+	}
+	if variant == "" {
+		return files
+	}
+	prefix := VariantDirectory + "/" + variant + "/"
+	for name, contents := range step.Files {
+		if strings.HasPrefix(name, prefix) {
+			files[name[len(prefix):]] = contents
+		}
+	}
+	return files
+}
+
 // buildInstructions builds the instructions for a problem step as a single
 // html document. Markdown is processed and images are inlined.
 func (step *ProblemStep) BuildInstructions() (string, error) {
+	return BuildInstructions(step.Files)
+}
+
+// BuildInstructions builds a single html document from the _doc directory
+// in a set of files. Markdown is processed and images are inlined.
+func BuildInstructions(files map[string]string) (string, error) {
 	// get a list of all files in the _doc directory
 	used := make(map[string]bool)
-	for name := range step.Files {
+	for name := range files {
 		if strings.HasPrefix(name, "_doc/") {
 			used[name] = false
 		}
 	}
 
 	var justHTML string
-	if data, ok := step.Files["_doc/index.html"]; ok {
+	if data, ok := files["_doc/index.html"]; ok {
 		justHTML = data
 		used["_doc/index.html"] = true
-	} else if data, ok := step.Files["_doc/index.md"]; ok {
+	} else if data, ok := files["_doc/index.md"]; ok {
 		// render markdown
 		extensions := 0
 		extensions |= blackfriday.EXTENSION_NO_INTRA_EMPHASIS
@@ -286,7 +504,7 @@ func (step *ProblemStep) BuildInstructions() (string, error) {
 		if n.Type == html.ElementNode && n.Data == "img" {
 			for i, a := range n.Attr {
 				if a.Key == "src" {
-					if contents, present := step.Files["_doc/"+a.Val]; present {
+					if contents, present := files["_doc/"+a.Val]; present {
 						mime := ""
 						switch {
 						case strings.HasSuffix(a.Val, ".gif"):
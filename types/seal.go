@@ -0,0 +1,130 @@
+package types
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+)
+
+// sealVersion is the first byte of every sealed set of files.
+const sealVersion = 1
+
+// DaycareKey is the public key a daycare uses for end-to-end encrypted
+// submissions. Clients encrypt commit files to this key so that the main
+// server only ever stores and forwards ciphertext.
+type DaycareKey struct {
+	PublicKey   string `json:"publicKey"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// ParseDaycarePublicKey decodes a PEM-encoded RSA public key.
+func ParseDaycarePublicKey(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in daycare key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing daycare key: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("daycare key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// KeyFingerprint returns a short, printable digest of a public key
+// so users can compare keys out of band.
+func KeyFingerprint(key *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
+
+// SealFiles encrypts a set of files to a daycare's public key.
+// A fresh AES-256-GCM key encrypts the files, and is itself encrypted
+// with RSA-OAEP. The result is laid out as:
+//
+//	version (1 byte) | key length (2 bytes) | encrypted key | nonce | ciphertext
+func SealFiles(key *rsa.PublicKey, files map[string]string) ([]byte, error) {
+	plaintext, err := json.Marshal(files)
+	if err != nil {
+		return nil, err
+	}
+	fileKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, fileKey); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, fileKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newFileCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := []byte{sealVersion, 0, 0}
+	binary.BigEndian.PutUint16(out[1:], uint16(len(encryptedKey)))
+	out = append(out, encryptedKey...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+// OpenSealedFiles reverses SealFiles using the daycare's private key.
+func OpenSealedFiles(key *rsa.PrivateKey, sealed []byte) (map[string]string, error) {
+	if len(sealed) < 3 || sealed[0] != sealVersion {
+		return nil, fmt.Errorf("unrecognized sealed file format")
+	}
+	keyLen := int(binary.BigEndian.Uint16(sealed[1:]))
+	rest := sealed[3:]
+	if len(rest) < keyLen {
+		return nil, fmt.Errorf("sealed files are truncated")
+	}
+	fileKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, rest[:keyLen], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting file key: %v", err)
+	}
+	rest = rest[keyLen:]
+	gcm, err := newFileCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed files are truncated")
+	}
+	plaintext, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting files: %v", err)
+	}
+	files := make(map[string]string)
+	if err := json.Unmarshal(plaintext, &files); err != nil {
+		return nil, fmt.Errorf("error decoding files: %v", err)
+	}
+	return files, nil
+}
+
+func newFileCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/url"
@@ -12,26 +13,186 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// Transcript limits applied by Commit.Compress. The server may change these
+// from its config file while commits are being compressed, so they are only
+// used through SetTranscriptLimits and transcriptLimits.
+var (
+	transcriptEventCountLimit int64 = 500
+	transcriptDataLimit       int64 = 100000
+)
+
+// SetTranscriptLimits changes the maximum number of events and bytes of
+// stream data kept in a transcript. A limit that is not positive is left
+// unchanged.
+func SetTranscriptLimits(events, data int) {
+	if events > 0 {
+		atomic.StoreInt64(&transcriptEventCountLimit, int64(events))
+	}
+	if data > 0 {
+		atomic.StoreInt64(&transcriptDataLimit, int64(data))
+	}
+}
+
+// transcriptLimits returns the current transcript limits.
+func transcriptLimits() (events, data int) {
+	return int(atomic.LoadInt64(&transcriptEventCountLimit)), int(atomic.LoadInt64(&transcriptDataLimit))
+}
+
 const (
-	TranscriptEventCountLimit = 500
-	TranscriptDataLimit       = 1e5
-	OpenCommitTimeout         = 6 * time.Hour
-	SignedCommitTimeout       = 15 * time.Minute
-	CookieName                = "codegrinder"
+	OpenCommitTimeout   = 6 * time.Hour
+	SignedCommitTimeout = 15 * time.Minute
+	CookieName          = "codegrinder"
 )
 
 // Course represents a single instance of a course as defined by LTI.
 type Course struct {
-	ID        int64     `json:"id" meddler:"id,pk"`
-	Name      string    `json:"name" meddler:"name"`
-	Label     string    `json:"label" meddler:"lti_label"`
-	LtiID     string    `json:"ltiID" meddler:"lti_id"`
-	CanvasID  int64     `json:"canvasID" meddler:"canvas_id"`
+	ID                 int64     `json:"id" meddler:"id,pk"`
+	Name               string    `json:"name" meddler:"name"`
+	Label              string    `json:"label" meddler:"lti_label"`
+	LtiID              string    `json:"ltiID" meddler:"lti_id"`
+	CanvasID           int64     `json:"canvasID" meddler:"canvas_id"`
+	RateLimitPerMinute int       `json:"rateLimitPerMinute,omitempty" meddler:"rate_limit_per_minute,zeroisnull"`
+	DailyQuota         int       `json:"dailyQuota,omitempty" meddler:"daily_quota,zeroisnull"`
+	DisplayName        string    `json:"displayName,omitempty" meddler:"display_name,zeroisnull"`
+	HelpEmail          string    `json:"helpEmail,omitempty" meddler:"help_email,zeroisnull"`
+	HelpText           string    `json:"helpText,omitempty" meddler:"help_text,zeroisnull"`
+	MembershipsURL     string    `json:"-" meddler:"memberships_url,zeroisnull"`
+	ConsumerKey        string    `json:"-" meddler:"consumer_key,zeroisnull"`
+	CreatedAt          time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt          time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// CourseProblemOptions are the default problem options a course sets for
+// one problem type. They are merged with each problem's own options when
+// work is graded, with the problem's options taking precedence.
+type CourseProblemOptions struct {
+	CourseID    int64     `json:"courseID" meddler:"course_id"`
+	ProblemType string    `json:"problemType" meddler:"problem_type"`
+	Options     []string  `json:"options" meddler:"options,json"`
+	UpdatedAt   time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// Feedback levels control how much of the grader's output students see:
+// the full transcript, the names of the tests that failed, or only how many
+// tests passed and failed.
+const (
+	FeedbackFull   = "full"
+	FeedbackNames  = "names"
+	FeedbackCounts = "counts"
+)
+
+// CourseFeedbackLevel sets how much grading detail students in a course see
+// for the problems of one problem set. Instructors always see everything.
+type CourseFeedbackLevel struct {
+	CourseID     int64     `json:"courseID" meddler:"course_id"`
+	ProblemSetID int64     `json:"problemSetID" meddler:"problem_set_id"`
+	Level        string    `json:"level" meddler:"level"`
+	UpdatedAt    time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// Roles a user can have. Administrators, authors, and chairs are roles of
+// the whole site, set on the user. A chair can see site-wide trends, but
+// nothing about individual courses or students. The others apply within one course, and each
+// includes the access of the ones before it: a TA can see the work of every
+// student in a course, and an instructor can also manage the course.
+const (
+	RoleStudent    = "student"
+	RoleTA         = "ta"
+	RoleInstructor = "instructor"
+	RoleAuthor     = "author"
+	RoleChair      = "chair"
+	RoleAdmin      = "admin"
+)
+
+// CourseRole gives a user a staff role in a course, either a TA or an
+// instructor, in addition to the role the LMS gives them.
+type CourseRole struct {
+	CourseID  int64     `json:"courseID" meddler:"course_id"`
+	UserID    int64     `json:"userID" meddler:"user_id"`
+	Role      string    `json:"role" meddler:"role"`
+	GrantedBy int64     `json:"grantedBy" meddler:"granted_by"`
 	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
-	UpdatedAt time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// Enrollment statuses and sources.
+const (
+	EnrollmentActive   = "active"
+	EnrollmentInactive = "inactive"
+	EnrollmentLaunch   = "launch"
+	EnrollmentRoster   = "roster"
+)
+
+// Enrollment records a user's membership in a course as reported by the
+// LMS, either when the user launches an assignment or when the course
+// roster is synced.
+type Enrollment struct {
+	CourseID   int64     `json:"courseID" meddler:"course_id"`
+	UserID     int64     `json:"userID" meddler:"user_id"`
+	Roles      string    `json:"roles" meddler:"roles"`
+	Instructor bool      `json:"instructor" meddler:"instructor"`
+	Section    string    `json:"section,omitempty" meddler:"section,zeroisnull"`
+	Status     string    `json:"status" meddler:"status"`
+	Source     string    `json:"source" meddler:"source"`
+	CreatedAt  time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt  time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+	Name       string    `json:"name,omitempty" meddler:"-"`
+	Email      string    `json:"email,omitempty" meddler:"-"`
+}
+
+// RosterSync reports the result of syncing a course roster from the LMS.
+// Unknown counts members of the roster who have never launched the tool,
+// and so have no user record yet.
+type RosterSync struct {
+	Members  int `json:"members"`
+	Enrolled int `json:"enrolled"`
+	Updated  int `json:"updated"`
+	Dropped  int `json:"dropped"`
+	Unknown  int `json:"unknown"`
+}
+
+// TutorialLabel is the label of the course that holds the grind tutorial
+// and the unique ID of the tutorial problem and problem set.
+const TutorialLabel = "codegrinder-tutorial"
+
+// EffectiveOptions shows how the options for one problem in an assignment
+// are worked out. Sources gives where each effective option came from,
+// either "course" or "problem".
+type EffectiveOptions struct {
+	ProblemID      int64             `json:"problemID"`
+	Unique         string            `json:"unique"`
+	ProblemType    string            `json:"problemType"`
+	CourseOptions  []string          `json:"courseOptions"`
+	ProblemOptions []string          `json:"problemOptions"`
+	Options        []string          `json:"options"`
+	Sources        map[string]string `json:"sources"`
+}
+
+// CourseInfo is the student-facing branding for a course: the name to show
+// and who to contact for help.
+type CourseInfo struct {
+	CourseID    int64  `json:"courseID"`
+	DisplayName string `json:"displayName"`
+	HelpEmail   string `json:"helpEmail,omitempty"`
+	HelpText    string `json:"helpText,omitempty"`
+}
+
+// Info returns the branding for a course, falling back to the LMS course
+// name if no display name has been set.
+func (course *Course) Info() *CourseInfo {
+	info := &CourseInfo{
+		CourseID:    course.ID,
+		DisplayName: course.DisplayName,
+		HelpEmail:   course.HelpEmail,
+		HelpText:    course.HelpText,
+	}
+	if info.DisplayName == "" {
+		info.DisplayName = course.Name
+	}
+	return info
 }
 
 // User represents a single user as defined by LTI.
@@ -45,9 +206,109 @@ type User struct {
 	CanvasID       int64     `json:"canvasID" meddler:"canvas_id"`
 	Author         bool      `json:"author" meddler:"author"`
 	Admin          bool      `json:"admin" meddler:"admin"`
+	Chair          bool      `json:"chair,omitempty" meddler:"chair"`
 	CreatedAt      time.Time `json:"createdAt" meddler:"created_at,localtime"`
 	UpdatedAt      time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
 	LastSignedInAt time.Time `json:"lastSignedInAt" meddler:"last_signed_in_at,localtime"`
+	Timezone       string    `json:"timezone,omitempty" meddler:"timezone,zeroisnull"`
+	Locale         string    `json:"locale,omitempty" meddler:"locale,zeroisnull"` // language code from the LMS, e.g., es
+
+	// Notifications holds the user's notification preferences; nil means
+	// the defaults
+	Notifications *NotificationPreferences `json:"notifications,omitempty" meddler:"notifications,json"`
+
+	// TokenScope is set when the request was authenticated with an API token
+	TokenScope string `json:"-" meddler:"-"`
+}
+
+// NotificationPreferences controls how a user hears about things that
+// happen to their work. Email is sent unless NoEmail is set, and each
+// notification is also posted as JSON to WebhookURL if there is one.
+// Muted lists kinds of notifications the user does not want at all.
+type NotificationPreferences struct {
+	NoEmail    bool     `json:"noEmail,omitempty"`
+	WebhookURL string   `json:"webhookURL,omitempty"`
+	Muted      []string `json:"muted,omitempty"`
+}
+
+// Notification is one message to a user, delivered through one channel.
+type Notification struct {
+	ID        int64      `json:"id" meddler:"id,pk"`
+	UserID    int64      `json:"userID" meddler:"user_id"`
+	Kind      string     `json:"kind" meddler:"kind"`
+	Channel   string     `json:"channel" meddler:"channel"`
+	Subject   string     `json:"subject" meddler:"subject"`
+	Body      string     `json:"body" meddler:"body"`
+	Status    string     `json:"status" meddler:"status"`
+	Attempts  int        `json:"attempts" meddler:"attempts"`
+	LastError string     `json:"lastError,omitempty" meddler:"last_error,zeroisnull"`
+	CreatedAt time.Time  `json:"createdAt" meddler:"created_at,localtime"`
+	SentAt    *time.Time `json:"sentAt,omitempty" meddler:"sent_at,localtime"`
+}
+
+// Notification kinds.
+const (
+	NotifyGradePosted     = "grade-posted"
+	NotifyCommitComment   = "commit-comment"
+	NotifyRegradeResolved = "regrade-resolved"
+	NotifyProblemUpdated  = "problem-updated"
+	NotifyQuarantine      = "quarantine"
+	NotifyNudge           = "nudge"
+)
+
+// CourseWebhook is a URL registered by an instructor that is sent course
+// events as they happen. Each delivery is signed with Secret, which is only
+// shown when the webhook is created. Kinds limits the events sent, with
+// none meaning all of them. A webhook that keeps failing is deactivated.
+type CourseWebhook struct {
+	ID        int64     `json:"id" meddler:"id,pk"`
+	CourseID  int64     `json:"courseID" meddler:"course_id"`
+	URL       string    `json:"url" meddler:"url"`
+	Secret    string    `json:"secret,omitempty" meddler:"secret"`
+	Kinds     []string  `json:"kinds" meddler:"kinds,json"`
+	Active    bool      `json:"active" meddler:"active"`
+	Cursor    string    `json:"-" meddler:"outbox_cursor"`
+	Failures  int       `json:"failures" meddler:"failures"`
+	LastError string    `json:"lastError,omitempty" meddler:"last_error,zeroisnull"`
+	CreatedBy int64     `json:"createdBy" meddler:"created_by"`
+	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// CourseGradeHook runs after each grading action in a course, either by
+// posting the result to a URL or by running a script that an administrator
+// installed on the server. Exactly one of URL and Script is set.
+type CourseGradeHook struct {
+	ID        int64     `json:"id" meddler:"id,pk"`
+	CourseID  int64     `json:"courseID" meddler:"course_id"`
+	URL       string    `json:"url,omitempty" meddler:"url,zeroisnull"`
+	Script    string    `json:"script,omitempty" meddler:"script,zeroisnull"`
+	Secret    string    `json:"secret,omitempty" meddler:"secret"`
+	Active    bool      `json:"active" meddler:"active"`
+	Cursor    string    `json:"-" meddler:"outbox_cursor"`
+	Failures  int       `json:"failures" meddler:"failures"`
+	LastError string    `json:"lastError,omitempty" meddler:"last_error,zeroisnull"`
+	CreatedBy int64     `json:"createdBy" meddler:"created_by"`
+	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// GradeHookPayload is what a grade hook receives after a grading action.
+// The report card is as the student sees it, so results withheld from the
+// student stay sealed.
+type GradeHookPayload struct {
+	EventID      int64       `json:"eventID"`
+	CourseID     int64       `json:"courseID"`
+	UserID       int64       `json:"userID"`
+	AssignmentID int64       `json:"assignmentID"`
+	CommitID     int64       `json:"commitID"`
+	ProblemID    int64       `json:"problemID"`
+	Step         int64       `json:"step"`
+	Action       string      `json:"action"`
+	Score        float64     `json:"score"`
+	Passed       bool        `json:"passed"`
+	ReportCard   *ReportCard `json:"reportCard"`
+	GradedAt     time.Time   `json:"gradedAt"`
 }
 
 // Assignment represents a single instance of a problem set for a student in a course.
@@ -66,6 +327,10 @@ type Assignment struct {
 	CanvasTitle        string               `json:"canvasTitle" meddler:"canvas_title"`
 	CanvasID           int64                `json:"canvasID" meddler:"canvas_id"`
 	CanvasAPIDomain    string               `json:"canvasAPIDomain" meddler:"canvas_api_domain"`
+	DueAt              *time.Time           `json:"dueAt,omitempty" meddler:"due_at,localtime"`
+	LockAt             *time.Time           `json:"lockAt,omitempty" meddler:"lock_at,localtime"`
+	Deadline           *Deadline            `json:"deadline,omitempty" meddler:"-"`
+	ScoreOverride      *ScoreOverride       `json:"scoreOverride,omitempty" meddler:"-"`
 	OutcomeURL         string               `json:"-" meddler:"outcome_url"`
 	OutcomeExtURL      string               `json:"-" meddler:"outcome_ext_url"`
 	OutcomeExtAccepted string               `json:"-" meddler:"outcome_ext_accepted"`
@@ -73,6 +338,132 @@ type Assignment struct {
 	ConsumerKey        string               `json:"-" meddler:"consumer_key"`
 	CreatedAt          time.Time            `json:"createdAt" meddler:"created_at,localtime"`
 	UpdatedAt          time.Time            `json:"updatedAt" meddler:"updated_at,localtime"`
+	DeletedAt          *time.Time           `json:"deletedAt,omitempty" meddler:"deleted_at,localtime"`
+}
+
+// CourseAssignments lists a user's assignments in one course.
+type CourseAssignments struct {
+	Course      *Course              `json:"course"`
+	Assignments []*AssignmentListing `json:"assignments"`
+}
+
+// AssignmentListing is an assignment with what a user needs to choose it
+// from a list: its problem set, when it is finalized, and whether work can
+// still be submitted.
+type AssignmentListing struct {
+	*Assignment
+	ProblemSetUnique string     `json:"problemSetUnique"`
+	ProblemSetNote   string     `json:"problemSetNote"`
+	FinalizedAt      *time.Time `json:"finalizedAt,omitempty"`
+	Open             bool       `json:"open"`
+}
+
+// AssignmentReopen records an instructor reopening a student's assignment
+// after its lock date, with a new lock date for that student. Scores earned
+// after the original lock date are marked post-reopen in the audit log and,
+// with ExcludePassback set, are not posted back to the LMS.
+type AssignmentReopen struct {
+	ID              int64     `json:"id" meddler:"id,pk"`
+	AssignmentID    int64     `json:"assignmentID" meddler:"assignment_id"`
+	ReopenedBy      int64     `json:"reopenedBy" meddler:"reopened_by"`
+	Reason          string    `json:"reason" meddler:"reason"`
+	LockAt          time.Time `json:"lockAt" meddler:"lock_at,localtime"`
+	ExcludePassback bool      `json:"excludePassback" meddler:"exclude_passback"`
+	CreatedAt       time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// RegradeRequest is a student asking course staff to take another look at
+// how a commit was graded. Status is open until staff resolve it as
+// accepted or denied, with Decision explaining why.
+type RegradeRequest struct {
+	ID           int64      `json:"id" meddler:"id,pk"`
+	CommitID     int64      `json:"commitID" meddler:"commit_id"`
+	AssignmentID int64      `json:"assignmentID" meddler:"assignment_id"`
+	CourseID     int64      `json:"courseID" meddler:"course_id"`
+	UserID       int64      `json:"userID" meddler:"user_id"`
+	Message      string     `json:"message" meddler:"message"`
+	Status       string     `json:"status" meddler:"status"`
+	Decision     string     `json:"decision,omitempty" meddler:"decision,zeroisnull"`
+	ResolvedBy   int64      `json:"resolvedBy,omitempty" meddler:"resolved_by,zeroisnull"`
+	ResolvedAt   *time.Time `json:"resolvedAt,omitempty" meddler:"resolved_at,localtime"`
+	CreatedAt    time.Time  `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// Regrade request statuses.
+const (
+	RegradeRequestOpen     = "open"
+	RegradeRequestAccepted = "accepted"
+	RegradeRequestDenied   = "denied"
+)
+
+// ScoreOverride records an instructor replacing the computed score of an
+// assignment. The computed score is still kept up to date, but the override
+// is what students see as their grade and what is posted to the LMS.
+type ScoreOverride struct {
+	ID           int64     `json:"id" meddler:"id,pk"`
+	AssignmentID int64     `json:"assignmentID" meddler:"assignment_id"`
+	Score        float64   `json:"score" meddler:"score"`
+	Comment      string    `json:"comment" meddler:"comment"`
+	OverriddenBy int64     `json:"overriddenBy" meddler:"overridden_by"`
+	CreatedAt    time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt    time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// Sources of a change in an assignment's score.
+const (
+	ScoreSourceGraded          = "graded"
+	ScoreSourceOverride        = "override"
+	ScoreSourceOverrideRemoved = "override-removed"
+)
+
+// ScoreChange is one entry in the history of an assignment's score. Graded
+// entries come from the student's work; override entries are set by hand,
+// with the instructor's justification in Comment.
+type ScoreChange struct {
+	ID           int64     `json:"id" meddler:"id,pk"`
+	AssignmentID int64     `json:"assignmentID" meddler:"assignment_id"`
+	Score        float64   `json:"score" meddler:"score"`
+	Source       string    `json:"source" meddler:"source"`
+	Comment      string    `json:"comment,omitempty" meddler:"comment,zeroisnull"`
+	ChangedBy    int64     `json:"changedBy,omitempty" meddler:"changed_by,zeroisnull"`
+	CreatedAt    time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// GradebookEntry is one student's score on one assignment in a course.
+// Score is the score that counts: the override if there is one, otherwise
+// the computed score.
+type GradebookEntry struct {
+	AssignmentID     int64     `json:"assignmentID"`
+	UserID           int64     `json:"userID"`
+	Name             string    `json:"name"`
+	Email            string    `json:"email"`
+	Login            string    `json:"login"`
+	ProblemSetUnique string    `json:"problemSetUnique"`
+	Title            string    `json:"title"`
+	ComputedScore    float64   `json:"computedScore"`
+	OverrideScore    *float64  `json:"overrideScore,omitempty"`
+	OverrideComment  string    `json:"overrideComment,omitempty"`
+	Score            float64   `json:"score"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+}
+
+// Regrade tracks an instructor re-running the latest graded commit for
+// every step of every student's copy of an assignment. Done counts the
+// commits finished so far, including the Failed ones, and Changed counts
+// the students whose scores changed.
+type Regrade struct {
+	ID           int64      `json:"id" meddler:"id,pk"`
+	CourseID     int64      `json:"courseID" meddler:"course_id"`
+	ProblemSetID int64      `json:"problemSetID" meddler:"problem_set_id"`
+	RequestedBy  int64      `json:"requestedBy" meddler:"requested_by"`
+	Total        int        `json:"total" meddler:"total"`
+	Done         int        `json:"done" meddler:"done"`
+	Failed       int        `json:"failed" meddler:"failed"`
+	Changed      int        `json:"changed" meddler:"changed"`
+	Note         string     `json:"note,omitempty" meddler:"note,zeroisnull"`
+	CreatedAt    time.Time  `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt    time.Time  `json:"updatedAt" meddler:"updated_at,localtime"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty" meddler:"finished_at,localtime"`
 }
 
 // Commit defines an attempt at solving one step of a Problem.
@@ -83,12 +474,421 @@ type Commit struct {
 	Step         int64             `json:"step" meddler:"step"` // note: one-based
 	Action       string            `json:"action" meddler:"action,zeroisnull"`
 	Note         string            `json:"note" meddler:"note,zeroisnull"`
-	Files        map[string]string `json:"files" meddler:"files,json"`
-	Transcript   []*EventMessage   `json:"transcript,omitempty" meddler:"transcript,json"`
+	Variant      string            `json:"variant,omitempty" meddler:"variant,zeroisnull"`
+	Files        map[string]string `json:"files" meddler:"-"`
+	FileHashes   map[string]string `json:"-" meddler:"files,json"`
+	Sealed       []byte            `json:"sealed,omitempty" meddler:"sealed"`           // files encrypted to the daycare key, in place of Files
+	Quarantined  bool              `json:"quarantined,omitempty" meddler:"quarantined"` // a file was flagged by the malware scanner
+	RegradeID    int64             `json:"regradeID,omitempty" meddler:"regrade_id,zeroisnull"`
+	Transcript   []*EventMessage   `json:"transcript,omitempty" meddler:"transcript,transcript"`
 	ReportCard   *ReportCard       `json:"reportCard" meddler:"report_card,json"`
+	Metrics      *CommitMetrics    `json:"metrics,omitempty" meddler:"metrics,json"`
+	Checklist    []string          `json:"checklist,omitempty" meddler:"checklist,json"`
 	Score        float64           `json:"score" meddler:"score,zeroisnull"`
 	CreatedAt    time.Time         `json:"createdAt" meddler:"created_at,localtime"`
 	UpdatedAt    time.Time         `json:"updatedAt" meddler:"updated_at,localtime"`
+	DeletedAt    *time.Time        `json:"deletedAt,omitempty" meddler:"deleted_at,localtime"`
+
+	// Nonce and ExpiresAt are set when the TA signs a commit for grading.
+	// Both are covered by the signature, so a signed commit can be graded
+	// only once, and only until it expires.
+	Nonce     string     `json:"nonce,omitempty" meddler:"-"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" meddler:"-"`
+}
+
+// StepPassed reports whether a graded commit completes its step. A style
+// deduction lowers the score but does not keep the student on the step.
+func (commit *Commit) StepPassed() bool {
+	card := commit.ReportCard
+	if card != nil && len(card.Parts) > 0 {
+		// the other parts are weighed in the score but only the tests gate progress
+		return card.Passed
+	}
+	return card != nil && card.Passed && commit.Score+card.StyleDeduction >= 1.0-1e-9
+}
+
+// CommitComment is an instructor's note on a range of lines in one file of
+// a commit. Excerpt holds the lines as they were when the comment was made,
+// since later work on the same step replaces the commit's files.
+type CommitComment struct {
+	ID         int64     `json:"id" meddler:"id,pk"`
+	CommitID   int64     `json:"commitID" meddler:"commit_id"`
+	AuthorID   int64     `json:"authorID" meddler:"author_id"`
+	AuthorName string    `json:"authorName,omitempty" meddler:"-"`
+	File       string    `json:"file" meddler:"file"`
+	LineStart  int       `json:"lineStart" meddler:"line_start"`
+	LineEnd    int       `json:"lineEnd" meddler:"line_end"`
+	Excerpt    string    `json:"excerpt" meddler:"excerpt"`
+	Body       string    `json:"body" meddler:"body"`
+	CreatedAt  time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// OpenCommit describes a commit that has been saved but not yet graded.
+// It is finalized as-is once it has been inactive for Timeout seconds.
+type OpenCommit struct {
+	CommitID  int64     `json:"commitID"`
+	ProblemID int64     `json:"problemID"`
+	Step      int64     `json:"step"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Age       int64     `json:"ageSeconds"`
+	Timeout   int64     `json:"timeoutSeconds"`
+}
+
+// Checkpoint is a labeled copy of the files a student saved, kept even
+// after later saves replace the commit it was taken from.
+type Checkpoint struct {
+	ID           int64             `json:"id" meddler:"id,pk"`
+	AssignmentID int64             `json:"assignmentID" meddler:"assignment_id"`
+	ProblemID    int64             `json:"problemID" meddler:"problem_id"`
+	Step         int64             `json:"step" meddler:"step"`
+	Label        string            `json:"label" meddler:"label"`
+	Files        map[string]string `json:"files,omitempty" meddler:"-"`
+	FileHashes   map[string]string `json:"-" meddler:"files,json"`
+	CreatedAt    time.Time         `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// ReuseMatch reports a submitted file that closely matches one the same
+// student submitted for a different problem.
+type ReuseMatch struct {
+	File            string  `json:"file"`
+	AssignmentID    int64   `json:"assignmentID"`
+	AssignmentTitle string  `json:"assignmentTitle"`
+	ProblemID       int64   `json:"problemID"`
+	ProblemUnique   string  `json:"problemUnique"`
+	Step            int64   `json:"step"`
+	MatchedFile     string  `json:"matchedFile"`
+	Similarity      float64 `json:"similarity"`
+}
+
+// CommitMetrics holds cheap static measurements of the files in a commit.
+// They are computed by the server when a commit is saved.
+// Functions and Complexity are only filled in for languages the server
+// knows how to scan, in which case Supported is true.
+type CommitMetrics struct {
+	Files        int  `json:"files"`
+	Lines        int  `json:"lines"`
+	CodeLines    int  `json:"codeLines"`
+	CommentLines int  `json:"commentLines"`
+	Supported    bool `json:"supported"`
+	Functions    int  `json:"functions,omitempty"`
+	Complexity   int  `json:"complexity,omitempty"`
+}
+
+// CommitMetricsEntry is one point in a student's metrics trend.
+type CommitMetricsEntry struct {
+	CommitID  int64          `json:"commitID"`
+	ProblemID int64          `json:"problemID"`
+	Step      int64          `json:"step"`
+	Score     float64        `json:"score"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	Metrics   *CommitMetrics `json:"metrics"`
+}
+
+// MetricSummary describes the distribution of one metric across students.
+type MetricSummary struct {
+	Min    int     `json:"min"`
+	Max    int     `json:"max"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+}
+
+// StepMetrics aggregates commit metrics for one step of a problem
+// across all students in a course.
+type StepMetrics struct {
+	ProblemID  int64          `json:"problemID"`
+	Step       int64          `json:"step"`
+	Commits    int            `json:"commits"`
+	CodeLines  *MetricSummary `json:"codeLines"`
+	Functions  *MetricSummary `json:"functions,omitempty"`
+	Complexity *MetricSummary `json:"complexity,omitempty"`
+}
+
+// CohortComparison compares how students in each offering of a course did
+// on one problem. Problems are edited in place, so VersionUpdatedAt marks
+// the start of the current version; with CurrentVersionOnly set, work
+// begun before then is left out.
+type CohortComparison struct {
+	ProblemID          int64     `json:"problemID"`
+	Unique             string    `json:"unique"`
+	VersionUpdatedAt   time.Time `json:"versionUpdatedAt"`
+	CurrentVersionOnly bool      `json:"currentVersionOnly"`
+	Cohorts            []*Cohort `json:"cohorts"`
+}
+
+// Cohort summarizes the students of one course offering on a problem.
+// EarlierVersion is set if any of the work counted was begun on an earlier
+// version of the problem.
+type Cohort struct {
+	CourseID       int64         `json:"courseID"`
+	CourseName     string        `json:"courseName"`
+	CourseLabel    string        `json:"courseLabel"`
+	FirstCommitAt  time.Time     `json:"firstCommitAt"`
+	LastCommitAt   time.Time     `json:"lastCommitAt"`
+	EarlierVersion bool          `json:"earlierVersion"`
+	Steps          []*CohortStep `json:"steps"`
+}
+
+// CohortStep gives the results of a cohort on one step of a problem.
+// Attempts counts graded submissions per student and is only available for
+// submissions graded since attempts were first recorded. MinutesToPass runs
+// from a student's first save of the step to their passing submission.
+type CohortStep struct {
+	Step          int64          `json:"step"`
+	Students      int            `json:"students"`
+	Passed        int            `json:"passed"`
+	PassRate      float64        `json:"passRate"`
+	Attempts      *MetricSummary `json:"attempts,omitempty"`
+	MinutesToPass *MetricSummary `json:"minutesToPass,omitempty"`
+}
+
+// AssignmentStats describes how the students in a course did on one
+// assignment. ScoreBuckets counts students by score in tenths, with a
+// perfect score in the last bucket. Minutes runs from a student's first
+// commit on the assignment to their final one.
+type AssignmentStats struct {
+	CourseID     int64              `json:"courseID"`
+	ProblemSetID int64              `json:"problemSetID"`
+	Unique       string             `json:"unique"`
+	Students     int                `json:"students"`
+	ScoreBuckets []int              `json:"scoreBuckets"`
+	MeanScore    float64            `json:"meanScore"`
+	MedianScore  float64            `json:"medianScore"`
+	Attempts     *MetricSummary     `json:"attempts,omitempty"`
+	Minutes      *MetricSummary     `json:"minutes,omitempty"`
+	PerStudent   []*StudentStats    `json:"perStudent"`
+	TestFailures []*TestFailureStat `json:"testFailures"`
+	CommonErrors []*ErrorStat       `json:"commonErrors"`
+}
+
+// StudentStats is one student's row in the assignment stats. Attempts
+// counts graded submissions.
+type StudentStats struct {
+	AssignmentID int64   `json:"assignmentID"`
+	UserID       int64   `json:"userID"`
+	Name         string  `json:"name"`
+	Login        string  `json:"login"`
+	Score        float64 `json:"score"`
+	Attempts     int     `json:"attempts"`
+	Minutes      int     `json:"minutes"`
+}
+
+// TestFailureStat counts the failures of one test across students.
+type TestFailureStat struct {
+	Unique   string `json:"unique"`
+	Step     int64  `json:"step"`
+	Test     string `json:"test"`
+	Failures int    `json:"failures"`
+	Students int    `json:"students"`
+}
+
+// ErrorStat counts an error message found in the transcripts of failed
+// submissions, after numbers in it have been replaced with N.
+type ErrorStat struct {
+	Message  string `json:"message"`
+	Count    int    `json:"count"`
+	Students int    `json:"students"`
+}
+
+// FailureClusters groups the students whose latest submission for a step
+// of a problem did not pass, so the most common ways of failing stand out.
+// Clusters are listed largest first.
+type FailureClusters struct {
+	ProblemID int64             `json:"problemID"`
+	Unique    string            `json:"unique"`
+	Step      int64             `json:"step"`
+	Failing   int               `json:"failing"`
+	Clusters  []*FailureCluster `json:"clusters"`
+}
+
+// FailureCluster is a group of students whose submissions failed the same
+// tests with the same first error message. Signature is that message with
+// numbers replaced by N, or empty if the transcript has none.
+type FailureCluster struct {
+	FailedTests     []string `json:"failedTests"`
+	Signature       string   `json:"signature,omitempty"`
+	Students        int      `json:"students"`
+	AssignmentIDs   []int64  `json:"assignmentIDs"`
+	ExampleCommitID int64    `json:"exampleCommitID"`
+}
+
+// ChecklistCompliance counts how many of the students with work on a step
+// of a problem have confirmed its checklist, as a whole and item by item.
+type ChecklistCompliance struct {
+	ProblemID int64                 `json:"problemID"`
+	Unique    string                `json:"unique"`
+	Step      int64                 `json:"step"`
+	Students  int                   `json:"students"`
+	Confirmed int                   `json:"confirmed"`
+	Items     []*ChecklistItemCount `json:"items"`
+}
+
+// ChecklistItemCount is the number of students who confirmed one item.
+type ChecklistItemCount struct {
+	Item      string `json:"item"`
+	Confirmed int    `json:"confirmed"`
+}
+
+// AssignmentEffort describes the work one student put into an assignment.
+// Attempts count graded submissions, and minutes run from the first commit
+// on a step to the last. Hours counts graded submissions by the hour of the
+// day they were made, in the student's time zone.
+type AssignmentEffort struct {
+	AssignmentID int64         `json:"assignmentID"`
+	UserID       int64         `json:"userID"`
+	Timezone     string        `json:"timezone"`
+	Attempts     int           `json:"attempts"`
+	Minutes      int           `json:"minutes"`
+	Steps        []*StepEffort `json:"steps"`
+	Hours        [24]int       `json:"hours"`
+}
+
+// StepEffort is a student's work on one step of a problem.
+type StepEffort struct {
+	ProblemID     int64     `json:"problemID"`
+	Unique        string    `json:"unique"`
+	Step          int64     `json:"step"`
+	Attempts      int       `json:"attempts"`
+	Minutes       int       `json:"minutes"`
+	FirstCommitAt time.Time `json:"firstCommitAt"`
+	LastCommitAt  time.Time `json:"lastCommitAt"`
+}
+
+// CourseEffort summarizes the work of all the students in a course without
+// identifying any of them, for research use. Steps with fewer students than
+// MinEffortStudents are left out.
+type CourseEffort struct {
+	CourseID     int64                `json:"courseID"`
+	ProblemSetID int64                `json:"problemSetID,omitempty"`
+	Timezone     string               `json:"timezone"`
+	Students     int                  `json:"students"`
+	Steps        []*StepEffortSummary `json:"steps"`
+	Hours        [24]int              `json:"hours"`
+}
+
+// StepEffortSummary describes the work of the students on one step.
+type StepEffortSummary struct {
+	ProblemID int64          `json:"problemID"`
+	Unique    string         `json:"unique"`
+	Step      int64          `json:"step"`
+	Students  int            `json:"students"`
+	Attempts  *MetricSummary `json:"attempts"`
+	Minutes   *MetricSummary `json:"minutes"`
+}
+
+// MinEffortStudents is the fewest students a step in a course effort
+// summary can describe, so no one student's work can be picked out.
+const MinEffortStudents = 5
+
+// ActivityHeatmap counts graded submissions by day of the week and hour of
+// the day, in a time zone, for one course or for the whole site. Counts[0]
+// is Sunday, and Counts[d][h] covers the hour starting at h o'clock.
+// Instructor work is not counted.
+type ActivityHeatmap struct {
+	CourseID int64      `json:"courseID,omitempty"`
+	Timezone string     `json:"timezone"`
+	Start    time.Time  `json:"start"`
+	End      time.Time  `json:"end"`
+	Total    int        `json:"total"`
+	Counts   [7][24]int `json:"counts"`
+}
+
+// TermTrend summarizes use of the whole site over one academic term, for
+// departmental reporting. It carries only counts and averages, never
+// anything about an individual student.
+type TermTrend struct {
+	Term           string        `json:"term"`
+	Start          time.Time     `json:"start"`
+	End            time.Time     `json:"end"`
+	ActiveStudents int           `json:"activeStudents"`
+	Courses        int           `json:"courses"`
+	Submissions    int           `json:"submissions"`
+	GradingMinutes float64       `json:"gradingMinutes"`
+	Levels         []*LevelTrend `json:"levels"`
+}
+
+// LevelTrend gives the average assignment score for the courses at one
+// level, e.g., 1000 for CS 1400, in a term. The average is left out when
+// too few students are counted for it to be anonymous.
+type LevelTrend struct {
+	Level        string   `json:"level"`
+	Courses      int      `json:"courses"`
+	Enrollments  int      `json:"enrollments"`
+	AverageScore *float64 `json:"averageScore,omitempty"`
+}
+
+// UserChair is the request body used to make a user a department chair.
+type UserChair struct {
+	Chair bool `json:"chair"`
+}
+
+// StudentView is what a student currently sees for an assignment, as
+// rendered for an instructor answering a support question.
+type StudentView struct {
+	User       *User                 `json:"user"`
+	Assignment *Assignment           `json:"assignment"`
+	ProblemSet *ProblemSet           `json:"problemSet"`
+	Problems   []*StudentProblemView `json:"problems"`
+}
+
+// StudentProblemView is the student's view of one problem in an assignment.
+// Steps holds only the released steps, with the student's starter variant
+// applied, and Files is the set of files grind get would unpack for the
+// current step.
+type StudentProblemView struct {
+	Problem     *Problem          `json:"problem"`
+	Variant     string            `json:"variant,omitempty"`
+	StepCount   int64             `json:"stepCount"`
+	CurrentStep int64             `json:"currentStep"`
+	Steps       []*ProblemStep    `json:"steps"`
+	LastCommit  *Commit           `json:"lastCommit,omitempty"`
+	Files       map[string]string `json:"files"`
+	Locked      []string          `json:"locked,omitempty"`
+}
+
+// Nudge records a reminder sent to a student who had not started an assignment.
+type Nudge struct {
+	ID           int64     `json:"id" meddler:"id,pk"`
+	AssignmentID int64     `json:"assignmentID" meddler:"assignment_id"`
+	SentBy       int64     `json:"sentBy" meddler:"sent_by"`
+	CreatedAt    time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// NotStarted describes a student with no commits on an assignment.
+type NotStarted struct {
+	User         *User       `json:"user"`
+	Assignment   *Assignment `json:"assignment"`
+	LastNudgedAt *time.Time  `json:"lastNudgedAt,omitempty"`
+}
+
+// NudgeReport summarizes the outcome of nudging the students who have not
+// started an assignment. Messages to the students listed as sent are
+// queued as notifications and delivered once the request completes.
+type NudgeReport struct {
+	Sent       []int64 `json:"sent"`
+	Suppressed []int64 `json:"suppressed"`
+}
+
+// Scopes for API tokens, from least to most privileged.
+// A token grants no more than its scope allows, even if the user who
+// created it has more privileges.
+const (
+	TokenScopeStudent    = "student"
+	TokenScopeInstructor = "instructor"
+	TokenScopeAdmin      = "admin"
+)
+
+// APIToken is a named, revocable credential that a user can give to a tool
+// instead of a session cookie. The token itself is only returned when it is
+// created; the server stores a hash of it.
+type APIToken struct {
+	ID         int64     `json:"id" meddler:"id,pk"`
+	UserID     int64     `json:"userID" meddler:"user_id"`
+	Name       string    `json:"name" meddler:"name"`
+	Scope      string    `json:"scope" meddler:"scope"`
+	Token      string    `json:"token,omitempty" meddler:"-"`
+	TokenHash  string    `json:"-" meddler:"token_hash"`
+	CreatedAt  time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	LastUsedAt time.Time `json:"lastUsedAt" meddler:"last_used_at,localtimez"`
 }
 
 // isInstructorRole returns true if the given LTI Roles field indicates this
@@ -112,9 +912,15 @@ func (commit *Commit) ComputeSignature(secret string, problemSignature string) s
 	v.Add("step", strconv.FormatInt(commit.Step, 10))
 	v.Add("action", commit.Action)
 	v.Add("note", commit.Note)
+	if commit.Variant != "" {
+		v.Add("variant", commit.Variant)
+	}
 	for name, contents := range commit.Files {
 		v.Add(fmt.Sprintf("file-%s", name), contents)
 	}
+	if len(commit.Sealed) > 0 {
+		v.Add("sealed", base64.StdEncoding.EncodeToString(commit.Sealed))
+	}
 	for n, event := range commit.Transcript {
 		v.Add(fmt.Sprintf("transcript-%d", n), event.String())
 	}
@@ -132,10 +938,39 @@ func (commit *Commit) ComputeSignature(secret string, problemSignature string) s
 				v.Add(fmt.Sprintf("reportcard-%d-context", n), result.Context)
 			}
 		}
+		if commit.ReportCard.Usage != nil {
+			v.Add("reportcard-usage", commit.ReportCard.Usage.String())
+		}
+		if commit.ReportCard.StyleDeduction != 0 {
+			v.Add("reportcard-style-deduction", strconv.FormatFloat(commit.ReportCard.StyleDeduction, 'g', -1, 64))
+		}
+		if len(commit.ReportCard.Hidden) > 0 {
+			v.Add("reportcard-hidden-passed", strconv.Itoa(commit.ReportCard.HiddenPassed))
+			v.Add("reportcard-hidden-failed", strconv.Itoa(commit.ReportCard.HiddenFailed))
+			v.Add("reportcard-hidden", base64.StdEncoding.EncodeToString(commit.ReportCard.Hidden))
+		}
+		if len(commit.ReportCard.Parts) > 0 {
+			v.Add("reportcard-weight", strconv.FormatFloat(commit.ReportCard.Weight, 'g', -1, 64))
+		}
+		for n, part := range commit.ReportCard.Parts {
+			v.Add(fmt.Sprintf("reportcard-part-%d-name", n), part.Name)
+			v.Add(fmt.Sprintf("reportcard-part-%d-weight", n), strconv.FormatFloat(part.Weight, 'g', -1, 64))
+			card, err := json.Marshal(part.ReportCard)
+			if err != nil {
+				log.Panicf("error encoding report card part %s: %v", part.Name, err)
+			}
+			v.Add(fmt.Sprintf("reportcard-part-%d", n), string(card))
+		}
 	}
 	v.Add("score", strconv.FormatFloat(commit.Score, 'g', -1, 64))
 	v.Add("created_at", commit.CreatedAt.Round(time.Second).UTC().Format(time.RFC3339))
 	v.Add("updated_at", commit.UpdatedAt.Round(time.Second).UTC().Format(time.RFC3339))
+	if commit.Nonce != "" {
+		v.Add("nonce", commit.Nonce)
+	}
+	if commit.ExpiresAt != nil {
+		v.Add("expires_at", commit.ExpiresAt.Round(time.Second).UTC().Format(time.RFC3339))
+	}
 	v.Add("problem_signature", problemSignature)
 
 	// compute signature
@@ -152,7 +987,12 @@ func (commit *Commit) Normalize(now time.Time, whitelist map[string]bool) error
 	commit.Action = strings.TrimSpace(commit.Action)
 	commit.Note = strings.TrimSpace(commit.Note)
 	commit.FilterIncoming(whitelist)
-	if len(commit.Files) == 0 {
+	if len(commit.Sealed) > 0 {
+		// sealed files can only be checked by the daycare
+		if len(commit.Files) > 0 {
+			return fmt.Errorf("commit with sealed files must not include plain files")
+		}
+	} else if len(commit.Files) == 0 {
 		return fmt.Errorf("commit must have at least one file")
 	}
 	commit.Compress()
@@ -197,6 +1037,7 @@ func (commit *Commit) FilterIncoming(whitelist map[string]bool) {
 // it also truncates the total stdin, stdout, stderr data to a fixed limit
 // and sets a maximum number of events
 func (commit *Commit) Compress() {
+	eventLimit, dataLimit := transcriptLimits()
 	count := 0
 	overflow := 0
 	out := []*EventMessage{}
@@ -204,7 +1045,7 @@ func (commit *Commit) Compress() {
 		if len(out) > 0 {
 			prev := out[len(out)-1]
 			if elt.Event == "stdin" || elt.Event == "stdout" || elt.Event == "stderr" {
-				if count >= TranscriptDataLimit {
+				if count >= dataLimit {
 					overflow += len(elt.StreamData)
 					continue
 				}
@@ -224,9 +1065,9 @@ func (commit *Commit) Compress() {
 	} else if len(commit.Transcript) != len(out) {
 		log.Printf("transcript compressed from %d to %d events", len(commit.Transcript), len(out))
 	}
-	if len(out) > TranscriptEventCountLimit {
-		log.Printf("transcript truncated from %d to %d events", len(out), TranscriptEventCountLimit)
-		out = out[:TranscriptEventCountLimit]
+	if len(out) > eventLimit {
+		log.Printf("transcript truncated from %d to %d events", len(out), eventLimit)
+		out = out[:eventLimit]
 	}
 
 	commit.Transcript = out